@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyFDEnv names the environment variable giving a daemon started by
+// spawnBackground the file descriptor it reports its start on
+const readyFDEnv = "BGRUN_READY_FD"
+
+// readyMessage is what the daemon writes once its control socket listens;
+// anything else is the error it failed to start with
+const readyMessage = "ready\n"
+
+// readyTimeout bounds how long spawnBackground waits for the daemon
+const readyTimeout = 30 * time.Second
+
+// readyFile is the pipe to the bgrun waiting for this daemon in
+// spawnBackground, nil when the daemon runs in the foreground
+var readyFile *os.File
+
+// spawnBackground starts a detached daemon and returns its PID once its
+// control socket listens, so that the caller can connect right away. The
+// daemon runs in a session of its own, without a controlling terminal, with
+// stdin, stdout and stderr on /dev/null: it logs to daemon.log instead.
+//
+// There is no second fork: the daemon leads its session, but only opens
+// terminals with O_NOCTTY, so it never acquires one. env is added to the
+// environment of the daemon.
+func spawnBackground(executable string, args []string, env ...string) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(append(os.Environ(), env...), readyFDEnv+"=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	r.SetReadDeadline(time.Now().Add(readyTimeout))
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("daemon %d not ready: %w", cmd.Process.Pid, err)
+	}
+	if string(msg) == readyMessage {
+		pid := cmd.Process.Pid
+		cmd.Process.Release()
+		return pid, nil
+	}
+
+	// The daemon failed, and is exiting
+	waitErr := cmd.Wait()
+	if len(msg) > 0 {
+		return 0, errors.New(strings.TrimSpace(string(msg)))
+	}
+	return 0, fmt.Errorf("daemon exited before it was ready: %v", waitErr)
+}
+
+// openReadyFile takes the pipe to the bgrun that started this daemon in the
+// background, if any. The process run by the daemon must not inherit it.
+func openReadyFile() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	os.Unsetenv(readyFDEnv)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	readyFile = os.NewFile(uintptr(fd), "ready")
+}
+
+// notifyReady tells the bgrun waiting in spawnBackground that the daemon
+// started, or why it did not when err is not nil
+func notifyReady(err error) {
+	if readyFile == nil {
+		return
+	}
+	if err != nil {
+		readyFile.WriteString(err.Error())
+	} else {
+		readyFile.WriteString(readyMessage)
+	}
+	readyFile.Close()
+	readyFile = nil
+}
@@ -0,0 +1,516 @@
+package bgattach
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// scrollbackPage is the number of scrollback lines loaded per request
+const scrollbackPage = 500
+
+// maxHeldOutput bounds the output held while in copy mode
+const maxHeldOutput = 1 << 20
+
+// CopyMode is the copy mode of an interactive attach, entered with
+// <Enter>~[: the scrollback held by the daemon and the screen are shown for
+// the user to scroll through, search and select text in, while the process
+// keeps running. The output of the process goes through Write, which holds
+// it while in copy mode, and the selections are kept to be printed once
+// detached.
+type CopyMode struct {
+	// Connect opens the connection copy mode requests are made on, the
+	// attached one being busy streaming output
+	Connect func() (*bgclient.Client, error)
+	In      io.Reader // keys
+	Out     io.Writer // the terminal
+
+	mu         sync.Mutex
+	held       []byte
+	hold       bool
+	selections []string
+}
+
+// Selections returns the texts selected, in order
+func (m *CopyMode) Selections() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.selections)
+}
+
+// Write writes the output of the process to the terminal, or holds it
+// while in copy mode
+func (m *CopyMode) Write(data []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hold {
+		if len(m.held)+len(data) <= maxHeldOutput {
+			m.held = append(m.held, data...)
+		}
+		return len(data), nil
+	}
+	return m.Out.Write(data)
+}
+
+// Run runs copy mode in a view of rows x cols until the user leaves it,
+// then redraws the screen of the process and resumes its output
+func (m *CopyMode) Run(rows, cols int) error {
+	m.mu.Lock()
+	m.hold = true
+	m.mu.Unlock()
+
+	c, err := m.Connect()
+	if err != nil {
+		m.release(nil)
+		return err
+	}
+	defer c.Close()
+
+	v, err := loadCopyView(c, rows, cols)
+	if err != nil {
+		m.release(nil)
+		return err
+	}
+	if err := m.interact(v); err != nil {
+		m.release(nil)
+		return err
+	}
+
+	// The output held up to now is on the screen fetched to redraw
+	m.mu.Lock()
+	before := m.held
+	m.held = nil
+	m.mu.Unlock()
+	screen, err := c.GetScreen()
+	if err != nil {
+		m.release(before)
+		return err
+	}
+	m.Out.Write([]byte(drawScreen(screen)))
+	m.release(nil)
+	return nil
+}
+
+// release writes before and the output held, and stops holding it
+func (m *CopyMode) release(before []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Out.Write(append(before, m.held...))
+	m.held, m.hold = nil, false
+}
+
+// interact draws v and handles the keys read until the user leaves
+func (m *CopyMode) interact(v *copyView) error {
+	buf := make([]byte, 256)
+	for {
+		if _, err := m.Out.Write(v.render()); err != nil {
+			return err
+		}
+		n, err := m.In.Read(buf)
+		for _, key := range parseKeys(buf[:n]) {
+			done, selected := v.key(key)
+			if selected != "" {
+				m.mu.Lock()
+				m.selections = append(m.selections, selected)
+				m.mu.Unlock()
+			}
+			if done {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drawScreen returns the escape sequences drawing screen on a cleared
+// terminal, with the cursor and input modes of the process
+func drawScreen(screen *protocol.ScreenResponse) string {
+	var b strings.Builder
+	b.WriteString("\x1b[0m\x1b[2J\x1b[H")
+	for i, line := range screen.Lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(strings.TrimRight(line, " "))
+	}
+	fmt.Fprintf(&b, "\x1b[%d;%dH", screen.CursorRow+1, screen.CursorCol+1)
+	b.WriteString(InputModesSequence(screen.InputModes))
+	return b.String()
+}
+
+// InputModesSequence returns the escape sequences setting a terminal to
+// modes
+func InputModesSequence(modes protocol.InputModes) string {
+	seq := "\x1b[?2004l"
+	if modes.BracketedPaste {
+		seq = "\x1b[?2004h"
+	}
+	if modes.ApplicationCursor {
+		seq += "\x1b[?1h"
+	} else {
+		seq += "\x1b[?1l"
+	}
+	if modes.ApplicationKeypad {
+		seq += "\x1b="
+	} else {
+		seq += "\x1b>"
+	}
+	return seq
+}
+
+// copyView is the state of copy mode: the lines of the scrollback followed
+// by those of the screen, the part of them shown, the cursor and selection
+type copyView struct {
+	lines      [][]rune
+	rows, cols int // of the view, the last row being the status line
+	top        int // first line shown
+	row, col   int // cursor
+
+	marked           bool // a selection starts at markRow, markCol
+	markRow, markCol int
+
+	prompt     []rune // search being typed, nil when none
+	promptBack bool   // the search typed goes backward
+	search     string // last search
+	searchBack bool
+	message    string // shown on the status line until the next key
+}
+
+// loadCopyView loads the scrollback and screen of the process attached to
+// over c into a view of rows x cols, the cursor where the process has it
+func loadCopyView(c *bgclient.Client, rows, cols int) (*copyView, error) {
+	screen, err := c.GetScreen()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &copyView{rows: max(rows, 2), cols: max(cols, 1)}
+	for offset := 0; ; {
+		page, err := c.GetScrollback(offset, scrollbackPage)
+		if err != nil {
+			// Older daemons have no GET_SCROLLBACK
+			v.message = "scrollback not available"
+			break
+		}
+		for _, line := range page.Lines {
+			var text strings.Builder
+			for _, span := range line.Spans {
+				text.WriteString(span.Text)
+			}
+			v.lines = append(v.lines, []rune(text.String()))
+		}
+		offset = page.Offset + len(page.Lines)
+		if len(page.Lines) == 0 || offset >= page.Total {
+			break
+		}
+	}
+	scrollback := len(v.lines)
+	for _, line := range screen.Lines {
+		v.lines = append(v.lines, []rune(strings.TrimRight(line, " ")))
+	}
+
+	v.row = min(scrollback+screen.CursorRow, len(v.lines)-1)
+	v.col = screen.CursorCol
+	v.top = max(len(v.lines)-v.height(), 0)
+	v.scrollToCursor()
+	return v, nil
+}
+
+// height returns the number of lines shown
+func (v *copyView) height() int {
+	return v.rows - 1
+}
+
+// scrollToCursor scrolls the view for the cursor to be in it
+func (v *copyView) scrollToCursor() {
+	v.row = max(min(v.row, len(v.lines)-1), 0)
+	if v.row < v.top {
+		v.top = v.row
+	}
+	if v.row >= v.top+v.height() {
+		v.top = v.row - v.height() + 1
+	}
+}
+
+// lineEnd returns the column of the last character of line row
+func (v *copyView) lineEnd(row int) int {
+	if row < 0 || row >= len(v.lines) {
+		return 0
+	}
+	return max(len(v.lines[row])-1, 0)
+}
+
+// key handles a key, returning whether copy mode ends and the text it
+// selected
+func (v *copyView) key(key string) (bool, string) {
+	v.message = ""
+	if v.prompt != nil {
+		v.promptKey(key)
+		return false, ""
+	}
+
+	page := v.height()
+	switch key {
+	case "q", "esc", "ctrl-c":
+		return true, ""
+	case "enter", "y":
+		if !v.marked {
+			return true, ""
+		}
+		return true, v.selection()
+	case "v", " ":
+		v.marked = !v.marked
+		v.markRow, v.markCol = v.row, v.col
+	case "up", "k":
+		v.row--
+	case "down", "j":
+		v.row++
+	case "left", "h":
+		v.col = max(min(v.col, v.lineEnd(v.row))-1, 0)
+	case "right", "l":
+		v.col = min(v.col+1, v.lineEnd(v.row))
+	case "pgup", "ctrl-b":
+		v.row -= page
+		v.top = max(v.top-page, 0)
+	case "pgdn", "ctrl-f":
+		v.row += page
+		v.top = min(v.top+page, max(len(v.lines)-page, 0))
+	case "ctrl-u":
+		v.row -= page / 2
+	case "ctrl-d":
+		v.row += page / 2
+	case "g":
+		v.row = 0
+	case "G":
+		v.row = len(v.lines) - 1
+	case "home", "0":
+		v.col = 0
+	case "end", "$":
+		v.col = v.lineEnd(v.row)
+	case "/", "?":
+		v.prompt, v.promptBack = []rune{}, key == "?"
+	case "n":
+		v.find(v.searchBack)
+	case "N":
+		v.find(!v.searchBack)
+	}
+	v.scrollToCursor()
+	return false, ""
+}
+
+// promptKey handles a key while a search is typed
+func (v *copyView) promptKey(key string) {
+	switch key {
+	case "esc", "ctrl-c":
+		v.prompt = nil
+	case "enter":
+		if len(v.prompt) > 0 {
+			v.search, v.searchBack = string(v.prompt), v.promptBack
+		}
+		v.prompt = nil
+		v.find(v.searchBack)
+		v.scrollToCursor()
+	case "backspace":
+		if len(v.prompt) > 0 {
+			v.prompt = v.prompt[:len(v.prompt)-1]
+		}
+	default:
+		if r, size := utf8.DecodeRuneInString(key); size == len(key) && r >= ' ' {
+			v.prompt = append(v.prompt, r)
+		}
+	}
+}
+
+// find moves the cursor to the next match of the last search, backward or
+// forward from the cursor, wrapping around, ignoring case
+func (v *copyView) find(back bool) {
+	if v.search == "" || len(v.lines) == 0 {
+		return
+	}
+	pattern := []rune(v.search)
+	match := func(row, col int) bool {
+		line := v.lines[row]
+		if col+len(pattern) > len(line) {
+			return false
+		}
+		return strings.EqualFold(string(line[col:col+len(pattern)]), string(pattern))
+	}
+
+	n := len(v.lines)
+	for i := 0; i <= n; i++ {
+		row := v.row + i
+		if back {
+			row = v.row - i
+		}
+		row = (row%n + n) % n
+		cols := len(v.lines[row]) - len(pattern)
+		for j := 0; j <= cols; j++ {
+			col := j
+			if back {
+				col = cols - j
+			}
+			// Skip the match at the cursor and those before it on its
+			// line, or after it going backward
+			if i == 0 && (!back && col <= v.col || back && col >= v.col) {
+				continue
+			}
+			if i == n && (!back && col > v.col || back && col < v.col) {
+				continue
+			}
+			if match(row, col) {
+				v.row, v.col = row, col
+				return
+			}
+		}
+	}
+	v.message = "not found: " + v.search
+}
+
+// selected reports whether the cell at row, col is in the selection
+func (v *copyView) selected(row, col int) bool {
+	if !v.marked {
+		return false
+	}
+	r1, c1, r2, c2 := v.markRow, v.markCol, v.row, v.col
+	if r1 > r2 || r1 == r2 && c1 > c2 {
+		r1, c1, r2, c2 = r2, c2, r1, c1
+	}
+	if row < r1 || row > r2 {
+		return false
+	}
+	return (row > r1 || col >= c1) && (row < r2 || col <= c2)
+}
+
+// selection returns the text selected, from the mark to the cursor
+// included, the lines joined by line feeds
+func (v *copyView) selection() string {
+	r1, r2 := min(v.markRow, v.row), max(v.markRow, v.row)
+	var lines []string
+	for row := r1; row <= r2; row++ {
+		var text []rune
+		for col, ch := range v.lines[row] {
+			if v.selected(row, col) {
+				text = append(text, ch)
+			}
+		}
+		lines = append(lines, string(text))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// render returns the escape sequences drawing the view
+func (v *copyView) render() []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b[?25l\x1b[H")
+	for i := 0; i < v.height(); i++ {
+		row := v.top + i
+		b.WriteString("\x1b[0m")
+		if row < len(v.lines) {
+			reverse := false
+			for col, ch := range v.lines[row] {
+				if col >= v.cols {
+					break
+				}
+				if sel := v.selected(row, col); sel != reverse {
+					reverse = sel
+					if sel {
+						b.WriteString("\x1b[7m")
+					} else {
+						b.WriteString("\x1b[27m")
+					}
+				}
+				b.WriteRune(ch)
+			}
+			b.WriteString("\x1b[0m")
+		}
+		b.WriteString("\x1b[K\r\n")
+	}
+
+	// Status line
+	status := fmt.Sprintf("[copy mode] %d/%d", v.row+1, len(v.lines))
+	switch {
+	case v.prompt != nil && v.promptBack:
+		status = "?" + string(v.prompt)
+	case v.prompt != nil:
+		status = "/" + string(v.prompt)
+	case v.message != "":
+		status = v.message
+	}
+	if runes := []rune(status); len(runes) > v.cols {
+		status = string(runes[:v.cols])
+	}
+	fmt.Fprintf(&b, "\x1b[7m%s\x1b[0m\x1b[K", status)
+
+	if v.prompt == nil {
+		fmt.Fprintf(&b, "\x1b[%d;%dH", v.row-v.top+1, min(v.col, v.cols-1)+1)
+	}
+	b.WriteString("\x1b[?25h")
+	return b.Bytes()
+}
+
+// keyNames are the names of the escape sequences of the keys copy mode
+// handles, sent in normal or application cursor mode
+var keyNames = map[string]string{
+	"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+	"\x1bOA": "up", "\x1bOB": "down", "\x1bOC": "right", "\x1bOD": "left",
+	"\x1b[H": "home", "\x1b[F": "end", "\x1bOH": "home", "\x1bOF": "end",
+	"\x1b[1~": "home", "\x1b[4~": "end", "\x1b[5~": "pgup", "\x1b[6~": "pgdn",
+}
+
+// controlKeys are the names of the control characters copy mode handles
+var controlKeys = map[byte]string{
+	0x02: "ctrl-b", 0x03: "ctrl-c", 0x04: "ctrl-d", 0x06: "ctrl-f", 0x15: "ctrl-u",
+	'\r': "enter", '\n': "enter", 0x7f: "backspace", 0x08: "backspace",
+}
+
+// parseKeys splits the input read from the terminal into keys: the names
+// of special keys, or the characters typed. Unknown escape sequences are
+// skipped, and an escape alone is the Escape key.
+func parseKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch {
+		case data[0] == 0x1b && len(data) == 1:
+			keys = append(keys, "esc")
+			data = data[1:]
+		case data[0] == 0x1b:
+			n := 2
+			if data[1] == '[' {
+				// CSI: parameters up to the final byte
+				for n < len(data) && (data[n] < 0x40 || data[n] > 0x7e) {
+					n++
+				}
+				n = min(n+1, len(data))
+			} else if data[1] == 'O' {
+				n = min(3, len(data))
+			}
+			if name, ok := keyNames[string(data[:n])]; ok {
+				keys = append(keys, name)
+			} else if data[1] != '[' && data[1] != 'O' {
+				// Escape followed by a key typed right after it
+				keys = append(keys, "esc")
+				n = 1
+			}
+			data = data[n:]
+		case data[0] < 0x20 || data[0] == 0x7f:
+			if name, ok := controlKeys[data[0]]; ok {
+				keys = append(keys, name)
+			}
+			data = data[1:]
+		default:
+			_, size := utf8.DecodeRune(data)
+			keys = append(keys, string(data[:size]))
+			data = data[size:]
+		}
+	}
+	return keys
+}
@@ -0,0 +1,99 @@
+package bgattach
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("\x1b[Ak\x1bOB\x1b[5~\x1b[1;5C\ré\x7f\x02\x1b"))
+	expected := []string{"up", "k", "down", "pgup", "enter", "é", "backspace", "ctrl-b", "esc"}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("Expected %q, got %q", expected, keys)
+	}
+}
+
+func TestCopyView(t *testing.T) {
+	v := &copyView{rows: 3, cols: 20, row: 2}
+	for _, line := range []string{"alpha", "beta gamma", "delta"} {
+		v.lines = append(v.lines, []rune(line))
+	}
+	keys := func(keys ...string) (bool, string) {
+		for i, key := range keys {
+			if done, selected := v.key(key); done || i == len(keys)-1 {
+				return done, selected
+			}
+		}
+		return false, ""
+	}
+
+	// Searching wraps around, ignoring case
+	keys("/", "G", "a", "M", "enter")
+	if v.row != 1 || v.col != 5 || v.top != 1 {
+		t.Errorf("Expected the cursor on the match at 1,5 in view, got %d,%d from %d", v.row, v.col, v.top)
+	}
+	keys("?", "x", "enter")
+	if v.message != "not found: x" || v.row != 1 || v.col != 5 {
+		t.Errorf("Expected the search to fail in place, got %q at %d,%d", v.message, v.row, v.col)
+	}
+
+	if done, selected := keys("v", "$", "enter"); !done || selected != "gamma" {
+		t.Errorf("Expected gamma to be selected, got %q (done=%v)", selected, done)
+	}
+
+	// Selections span lines from the mark to the cursor
+	v.row, v.col, v.marked = 0, 2, false
+	if _, selected := keys("v", "j", "l", "enter"); selected != "pha\nbeta" {
+		t.Errorf("Expected the selection across lines, got %q", selected)
+	}
+
+	if done, selected := keys("q"); !done || selected != "" {
+		t.Errorf("Expected q to leave without a selection, got %q (done=%v)", selected, done)
+	}
+}
+
+func TestCopyMode(t *testing.T) {
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"sh", "-c", "seq 0 49; sleep 10"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+		RuntimeDir: filepath.Join(t.TempDir(), "job"),
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// From the top of the scrollback, select its first two lines
+	var out bytes.Buffer
+	m := &CopyMode{
+		Connect: func() (*bgclient.Client, error) { return bgclient.Connect(d.SocketPath()) },
+		In:      strings.NewReader("gvj$\r"),
+		Out:     &out,
+	}
+	m.Write([]byte("before\n"))
+	if err := m.Run(24, 80); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	m.Write([]byte("after\n"))
+
+	if selections := m.Selections(); !slices.Equal(selections, []string{"0\n1"}) {
+		t.Errorf("Expected the first lines to be selected, got %q", selections)
+	}
+	if !strings.HasPrefix(out.String(), "before\n") || !strings.Contains(out.String(), "[copy mode]") || !strings.HasSuffix(out.String(), "after\n") {
+		t.Errorf("Expected the output around copy mode, got %q", out.String())
+	}
+}
@@ -0,0 +1,351 @@
+// Package bgattach attaches a terminal to the VTY process of a bgrun daemon,
+// as bgrun -ctl attach and bgctl attach do: the terminal is put in raw mode
+// and starts with the screen of the process, its size follows that of the
+// terminal, and SSH-style escape sequences detach or enter copy mode. Go
+// programs embedding bgrun drive it with a Session.
+package bgattach
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/terminal"
+)
+
+// DefaultEscape is the character escape sequences start with, after a
+// newline
+const DefaultEscape = '~'
+
+// Session is an interactive attach of a terminal to a VTY process. Typed
+// after a newline, <Escape>. detaches, <Escape>[ enters copy mode and
+// <Escape><Escape> sends the escape character itself, <Escape> being ~
+// unless set otherwise.
+type Session struct {
+	Client *bgclient.Client
+
+	// Connect opens another connection to the daemon, which copy mode
+	// makes its requests on. Copy mode is disabled when nil.
+	Connect func() (*bgclient.Client, error)
+
+	In     *os.File  // the terminal, os.Stdin when nil
+	Out    io.Writer // os.Stdout when nil
+	Escape byte      // DefaultEscape when zero
+
+	// Exclusive detaches the other clients and refuses their input while
+	// attached, as tmux attach -d
+	Exclusive bool
+
+	detachOnce sync.Once
+	detachCh   chan struct{}
+	copyMode   *CopyMode
+
+	mu       sync.Mutex
+	exitCode *int
+}
+
+// Detach ends the session as <Escape>. does, leaving the process running
+func (s *Session) Detach() {
+	s.init()
+	s.detachOnce.Do(func() { close(s.detachCh) })
+}
+
+// Selections returns the texts selected in copy mode, in order. Run prints
+// them once the session ended.
+func (s *Session) Selections() []string {
+	s.init()
+	return s.copyMode.Selections()
+}
+
+// ExitCode returns the exit code of the process, and whether it exited
+// while attached
+func (s *Session) ExitCode() (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exitCode == nil {
+		return 0, false
+	}
+	return *s.exitCode, true
+}
+
+// init sets the defaults of the session
+func (s *Session) init() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.detachCh != nil {
+		return
+	}
+	if s.In == nil {
+		s.In = os.Stdin
+	}
+	if s.Out == nil {
+		s.Out = os.Stdout
+	}
+	if s.Escape == 0 {
+		s.Escape = DefaultEscape
+	}
+	s.detachCh = make(chan struct{})
+	// Copy mode requests go over a connection of their own
+	s.copyMode = &CopyMode{Connect: s.Connect, In: s.In, Out: s.Out}
+}
+
+// Run forwards the terminal to the process until it exits or the session
+// is detached. The terminal starts with the screen, cursor, input modes and
+// title of the process, and is restored once done. Other clients attaching,
+// detaching or resizing the terminal are shown on its last row.
+func (s *Session) Run() error {
+	s.init()
+	c := s.Client
+
+	// Put terminal in raw mode
+	fd := int(s.In.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to make terminal raw: %w", err)
+	}
+	defer state.Restore()
+
+	// Send initial resize before getting screen (ensures screen is sized correctly)
+	rows, cols, err := terminal.GetSize(fd)
+	if err != nil {
+		return fmt.Errorf("failed to get terminal size: %w", err)
+	}
+	if err := c.Resize(uint16(rows), uint16(cols)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to resize terminal: %v\r\n", err)
+	}
+
+	// Keep the title of the terminal, to restore it once detached
+	fmt.Fprint(s.Out, "\x1b[22;0t")
+	defer fmt.Fprint(s.Out, "\x1b[23;0t")
+
+	// Have the local terminal show the screen and encode keys and pastes
+	// as the program expects, it did not see the program switching modes
+	if screen, err := c.GetScreen(); err != nil {
+		// Non-fatal - just warn and continue
+		fmt.Fprintf(os.Stderr, "Warning: failed to get screen state: %v\r\n", err)
+	} else {
+		fmt.Fprint(s.Out, drawScreen(screen))
+	}
+	if title, err := c.GetTitle(); err == nil {
+		fmt.Fprint(s.Out, titleSequence(title))
+	}
+
+	// Leave the local terminal in its default input modes, whatever the
+	// program set while attached
+	defer fmt.Fprint(s.Out, InputModesSequence(protocol.InputModes{}))
+
+	// Detect a daemon gone silent, older daemons do without
+	if err := c.SetHeartbeat(bgclient.DefaultHeartbeatInterval); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return err
+	}
+
+	// Tell the user why the view changed when another client attaches,
+	// detaches or resizes the terminal, older daemons do without
+	if err := c.SetNoticeHandler(func(ev *protocol.Event) { s.notice(fd, ev) }); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return err
+	}
+
+	// Attach to output
+	attach := c.Attach
+	if s.Exclusive {
+		attach = c.AttachExclusive
+	}
+	if err := attach(protocol.StreamBoth); err != nil {
+		return err
+	}
+
+	// Watch for resize signals
+	resizeCh := terminal.WatchResize()
+	defer terminal.StopWatchingResize(resizeCh)
+
+	errCh := make(chan error, 2)
+	doneCh := make(chan struct{})
+
+	// The text selected in copy mode is printed once done
+	defer func() {
+		for _, text := range s.copyMode.Selections() {
+			fmt.Fprintln(s.Out, text)
+		}
+	}()
+
+	go s.readInput(fd, errCh)
+
+	// Goroutine to read from server and write to the terminal
+	go func() {
+		err := c.ReadMessages(
+			func(stream byte, data []byte) error {
+				s.copyMode.Write(data)
+				return nil
+			},
+			func(exitCode int) {
+				s.mu.Lock()
+				s.exitCode = &exitCode
+				s.mu.Unlock()
+				close(doneCh)
+			},
+		)
+		if err != nil && err != io.EOF {
+			errCh <- err
+		}
+	}()
+
+	// Main loop: handle resize events and detach signal
+	for {
+		select {
+		case <-resizeCh:
+			if rows, cols, err := terminal.GetSize(fd); err == nil {
+				c.Resize(uint16(rows), uint16(cols))
+			}
+
+		case <-s.detachCh:
+			c.Detach()
+			state.Restore()
+			fmt.Fprintln(s.Out, "\r\n[Detached]")
+			return nil
+
+		case err := <-errCh:
+			state.Restore()
+			if errors.Is(err, bgclient.ErrDetached) {
+				fmt.Fprintln(s.Out, "\r\n[Detached by another client]")
+				return nil
+			}
+			return err
+
+		case <-doneCh:
+			state.Restore()
+			fmt.Fprintln(s.Out, "\r\n[Process exited]")
+			return nil
+		}
+	}
+}
+
+// readInput sends what is typed on the terminal fd to the process,
+// handling the escape sequences, until it detaches or fails
+func (s *Session) readInput(fd int, errCh chan<- error) {
+	c := s.Client
+	buf := make([]byte, 1024)
+	var lastByte byte // Track last byte for escape sequence detection
+
+	for {
+		n, err := s.In.Read(buf)
+		output := make([]byte, 0, n)
+		for i := 0; i < n; i++ {
+			if (lastByte == '\r' || lastByte == '\n') && buf[i] == s.Escape && i+1 < n {
+				switch buf[i+1] {
+				case '.':
+					// Send accumulated output (not including the escape)
+					if len(output) > 0 {
+						c.WriteStdin(output)
+					}
+					s.Detach()
+					return
+
+				case '[':
+					if s.Connect == nil {
+						break
+					}
+					// Send accumulated output, drop what was typed after
+					// the sequence
+					if len(output) > 0 {
+						c.WriteStdin(output)
+						output = output[:0]
+					}
+					s.runCopyMode(fd)
+					i = n
+					lastByte = 0
+					continue
+
+				case s.Escape:
+					i++ // Skip the second escape character
+				}
+			}
+			output = append(output, buf[i])
+			lastByte = buf[i]
+		}
+
+		if len(output) > 0 {
+			if err := c.WriteStdin(output); err != nil {
+				errCh <- fmt.Errorf("failed to write stdin: %w", err)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				errCh <- fmt.Errorf("failed to read stdin: %w", err)
+			}
+			return
+		}
+	}
+}
+
+// runCopyMode runs copy mode in the size of the terminal fd
+func (s *Session) runCopyMode(fd int) {
+	rows, cols, err := terminal.GetSize(fd)
+	if err == nil {
+		err = s.copyMode.Run(rows, cols)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\r\n[Copy mode failed: %v]\r\n", err)
+	}
+}
+
+// notice shows what another client did on the last row of the terminal fd,
+// in reverse video as tmux shows its messages, until the program draws over
+// it
+func (s *Session) notice(fd int, ev *protocol.Event) {
+	text := noticeText(ev)
+	if text == "" {
+		return
+	}
+	rows, cols, err := terminal.GetSize(fd)
+	if err != nil {
+		return
+	}
+	if len(text) > cols {
+		text = text[:cols]
+	}
+	s.copyMode.Write(fmt.Appendf(nil, "\x1b7\x1b[%d;1H\x1b[0;7m%s\x1b8", rows, text))
+}
+
+// noticeText returns the text of the notice of ev, empty for events that
+// are not notices
+func noticeText(ev *protocol.Event) string {
+	switch ev.Type {
+	case protocol.EventAttached:
+		return fmt.Sprintf("[client %d attached]", ev.Client)
+	case protocol.EventDetached:
+		return fmt.Sprintf("[client %d detached]", ev.Client)
+	case protocol.EventResized:
+		if ev.Client == 0 {
+			return fmt.Sprintf("[terminal resized to %dx%d]", ev.Cols, ev.Rows)
+		}
+		return fmt.Sprintf("[client %d resized the terminal to %dx%d]", ev.Client, ev.Cols, ev.Rows)
+	default:
+		return ""
+	}
+}
+
+// titleSequence returns the escape sequences setting the window title and
+// icon name of a terminal to those of title, the control characters they
+// may hold left out
+func titleSequence(title *protocol.TitleResponse) string {
+	printable := func(r rune) rune {
+		if r < ' ' || r >= 0x7f && r < 0xa0 {
+			return -1
+		}
+		return r
+	}
+	var seq string
+	if title.IconName != "" {
+		seq += "\x1b]1;" + strings.Map(printable, title.IconName) + "\x07"
+	}
+	if title.Title != "" {
+		seq += "\x1b]2;" + strings.Map(printable, title.Title) + "\x07"
+	}
+	return seq
+}
@@ -0,0 +1,117 @@
+package bgattach
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestDrawScreen(t *testing.T) {
+	screen := &protocol.ScreenResponse{
+		Lines:      []string{"$ ls   ", "a  b   ", "$      "},
+		CursorRow:  2,
+		CursorCol:  2,
+		InputModes: protocol.InputModes{BracketedPaste: true},
+	}
+	expected := "\x1b[0m\x1b[2J\x1b[H$ ls\r\na  b\r\n$\x1b[3;3H\x1b[?2004h\x1b[?1l\x1b>"
+	if seq := drawScreen(screen); seq != expected {
+		t.Errorf("Expected %q, got %q", expected, seq)
+	}
+}
+
+func TestTitleSequence(t *testing.T) {
+	seq := titleSequence(&protocol.TitleResponse{Title: "vim\x07\x1b]2;x", IconName: "vim"})
+	if expected := "\x1b]1;vim\x07\x1b]2;vim]2;x\x07"; seq != expected {
+		t.Errorf("Expected %q, got %q", expected, seq)
+	}
+	if seq := titleSequence(&protocol.TitleResponse{}); seq != "" {
+		t.Errorf("Expected no sequence without a title, got %q", seq)
+	}
+}
+
+func TestNoticeText(t *testing.T) {
+	tests := []struct {
+		ev   protocol.Event
+		want string
+	}{
+		{protocol.Event{Type: protocol.EventAttached, Client: 3}, "[client 3 attached]"},
+		{protocol.Event{Type: protocol.EventDetached, Client: 3}, "[client 3 detached]"},
+		{protocol.Event{Type: protocol.EventResized, Client: 3, Rows: 40, Cols: 120}, "[client 3 resized the terminal to 120x40]"},
+		{protocol.Event{Type: protocol.EventTitle, Title: "vim"}, ""},
+	}
+	for _, tt := range tests {
+		if got := noticeText(&tt.ev); got != tt.want {
+			t.Errorf("Expected %q for %+v, got %q", tt.want, tt.ev, got)
+		}
+	}
+}
+
+func TestSessionInput(t *testing.T) {
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"cat"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+		RuntimeDir: filepath.Join(t.TempDir(), "job"),
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	c, err := bgclient.Connect(d.SocketPath())
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer r.Close()
+	s := &Session{Client: c, In: r, Escape: '%'}
+	s.init()
+
+	// The escape character is sent doubled, and detaches before a dot
+	w.WriteString("a~b\r%%c\r%.d")
+	errCh := make(chan error, 1)
+	s.readInput(0, errCh)
+	w.Close()
+
+	select {
+	case <-s.detachCh:
+	default:
+		t.Error("Expected the session to be detached")
+	}
+	if len(errCh) > 0 {
+		t.Errorf("Unexpected error: %v", <-errCh)
+	}
+
+	// The terminal echoes what cat received
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		screen, err := c.GetScreen()
+		if err != nil {
+			t.Fatalf("GetScreen failed: %v", err)
+		}
+		if strings.TrimRight(screen.Lines[0], " ") == "a~b" && strings.TrimRight(screen.Lines[1], " ") == "%c" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the input on the screen, got %q", screen.Lines[:4])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,79 @@
+package bgclient
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+)
+
+// ErrNotRoot is returned when inspecting the daemons of all users without
+// being root
+var ErrNotRoot = errors.New("inspecting the daemons of all users requires root")
+
+// userRuntimeRoots are the patterns of the runtime roots of every user:
+// $XDG_RUNTIME_DIR/bgrun as set by systemd-logind, and the /tmp fallback
+var userRuntimeRoots = []string{"/run/user/*/bgrun", "/tmp/.bgrun-*"}
+
+// ListAllDaemons is like ListDaemons for the daemons of every user of the
+// host, each one with its owner. It is reserved to root, and leaves the
+// registries of the users untouched.
+func ListAllDaemons() ([]DaemonInfo, error) {
+	if os.Geteuid() != 0 {
+		return nil, ErrNotRoot
+	}
+
+	var roots []string
+	for _, pattern := range userRuntimeRoots {
+		matches, _ := filepath.Glob(pattern)
+		roots = append(roots, matches...)
+	}
+	for _, root := range runtimeRoots() {
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+
+	var daemons []DaemonInfo
+	for _, root := range roots {
+		found, err := listDaemons([]string{root}, false)
+		if err != nil {
+			return nil, err
+		}
+		owner := ownerName(root)
+		for i := range found {
+			found[i].User = owner
+		}
+		daemons = append(daemons, found...)
+	}
+
+	slices.SortFunc(daemons, func(a, b DaemonInfo) int { return a.PID - b.PID })
+	return daemons, nil
+}
+
+// ownerName returns the name of the owner of a file, or its UID if it has
+// no name
+func ownerName(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	uid := strconv.FormatUint(uint64(st.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// Open connects to a daemon listed by ListDaemons or ListAllDaemons, with
+// the same zombie handling as New
+func Open(info DaemonInfo) (*Client, error) {
+	return newClient(info.PID, info.RuntimeDir, runStorage(info.RuntimeDir))
+}
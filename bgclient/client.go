@@ -1,31 +1,73 @@
 package bgclient
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/registry"
+	"github.com/KarpelesLab/bgrun/storage"
+	"github.com/KarpelesLab/bgrun/termemu"
 )
 
 // ErrProcessTerminated is returned when attempting operations on a terminated process
 var ErrProcessTerminated = errors.New("process has terminated")
 
+// ErrNoSuchDaemon is returned when no runtime directory exists for a PID
+var ErrNoSuchDaemon = errors.New("no such daemon")
+
+// ErrNotReady is returned when the runtime directory of a daemon exists but
+// its control socket is not accepting connections yet, typically right
+// after starting it with -background
+var ErrNotReady = errors.New("daemon control socket not ready yet")
+
+// ErrNotSupported is returned by GetCapabilities when the daemon predates
+// capability reporting
+var ErrNotSupported = errors.New("not supported by the daemon")
+
+// ErrUnauthorized is returned when the daemon refuses the connection, its
+// user not being in the allowlists of the daemon
+var ErrUnauthorized = errors.New("not authorized by the daemon")
+
+// ErrDetached is returned by ReadMessages when another client attached
+// exclusively, detaching this one
+var ErrDetached = errors.New("detached by another client")
+
 // Client represents a connection to a bgrun daemon
 type Client struct {
 	conn       net.Conn
 	pid        int
 	runtimeDir string
+	storage    storage.Storage // where the daemon keeps its artifacts
 	isZombie   bool
 	status     *protocol.StatusResponse // cached status for zombie processes
-	outputLog  *os.File                 // opened output.log for zombie processes (keeps inode alive)
+	outputLog  io.ReadSeekCloser        // opened output.log for zombie processes (keeps inode alive)
+	heartbeat  time.Duration            // ping interval of the read loops, see SetHeartbeat
+
+	// outputOffset follows the last output received with its offset, see
+	// AttachFrom
+	outputOffset uint64
+
+	// Flow control window, see AttachFlow, and the output consumed since
+	// credit was last granted
+	window   uint32
+	consumed uint32
+
+	// notices handles the events of other clients, see SetNoticeHandler
+	notices NoticeHandler
 }
 
 // Connect connects to a bgrun daemon at the specified socket path
@@ -49,76 +91,179 @@ func New(pid int) (*Client, error) {
 		return nil, err
 	}
 
+	return newClient(pid, runtimeDir, runStorage(runtimeDir))
+}
+
+// NewWithStorage is like New for daemons started with a custom
+// daemon.Config.Storage; status.json and output.log of a terminated daemon
+// are read from store instead of the runtime directory
+func NewWithStorage(pid int, store storage.Storage) (*Client, error) {
+	runtimeDir, err := getRuntimeDirForPID(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(pid, runtimeDir, store)
+}
+
+// NewFromRuntimeDir creates a client for the daemon owning the given runtime
+// directory, with the same zombie handling as New
+func NewFromRuntimeDir(runtimeDir string) (*Client, error) {
+	pid, _ := strconv.Atoi(filepath.Base(runtimeDir))
+	return newClient(pid, runtimeDir, runStorage(runtimeDir))
+}
+
+// newClient connects to the daemon socket in runtimeDir, or falls back to
+// its leftover status.json in store if the daemon has terminated
+func newClient(pid int, runtimeDir string, store storage.Storage) (*Client, error) {
 	socketPath := filepath.Join(runtimeDir, "control.sock")
-	statusPath := filepath.Join(runtimeDir, "status.json")
 
 	// Check if socket exists (daemon is running)
 	if _, err := os.Stat(socketPath); err == nil {
 		conn, err := net.Dial("unix", socketPath)
-		if err != nil {
+		switch {
+		case err == nil:
+			return &Client{
+				conn:       conn,
+				pid:        pid,
+				runtimeDir: runtimeDir,
+				storage:    store,
+				isZombie:   false,
+			}, nil
+		case errors.Is(err, syscall.ECONNREFUSED) && daemonGone(pid):
+			// The daemon died without cleaning up: its last status.json
+			// is all there is
+		case errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT):
+			// Bound but not listening yet, or removed in the meantime
+			return nil, fmt.Errorf("failed to connect to socket: %w: %w", ErrNotReady, err)
+		default:
 			return nil, fmt.Errorf("failed to connect to socket: %w", err)
 		}
-		return &Client{
-			conn:       conn,
-			pid:        pid,
-			runtimeDir: runtimeDir,
-			isZombie:   false,
-		}, nil
 	}
 
-	// Socket doesn't exist, check for zombie (status.json exists)
-	if _, err := os.Stat(statusPath); err == nil {
-		// Read zombie status
-		data, err := os.ReadFile(statusPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read zombie status: %w", err)
-		}
-
+	// No daemon to connect to, check for zombie (status.json exists)
+	data, err := store.ReadFile("status.json")
+	if err == nil {
 		var status protocol.StatusResponse
 		if err := json.Unmarshal(data, &status); err != nil {
 			return nil, fmt.Errorf("failed to parse zombie status: %w", err)
 		}
+		// A retry links the new run from the runtime directory, leaving the
+		// signed status.json untouched
+		if next, err := os.Readlink(filepath.Join(runtimeDir, "next")); err == nil {
+			status.NextRun = next
+		}
 
 		// Open output.log for reading (keeps inode alive even after reaping)
-		outputLogPath := filepath.Join(runtimeDir, "output.log")
-		var outputLog *os.File
-		if _, err := os.Stat(outputLogPath); err == nil {
-			outputLog, err = os.Open(outputLogPath)
-			if err != nil {
+		outputLog, err := store.Open("output.log")
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
 				return nil, fmt.Errorf("failed to open zombie output log: %w", err)
 			}
+			outputLog = nil
 		}
 
 		return &Client{
 			pid:        pid,
 			runtimeDir: runtimeDir,
+			storage:    store,
 			isZombie:   true,
 			status:     &status,
 			outputLog:  outputLog,
 		}, nil
 	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read zombie status: %w", err)
+	}
 
-	return nil, fmt.Errorf("process %d not found (no socket or status.json in %s)", pid, runtimeDir)
+	return nil, fmt.Errorf("%w (no socket or status.json in %s)", ErrNotReady, runtimeDir)
 }
 
-// getRuntimeDirForPID finds the runtime directory for a given daemon PID
-func getRuntimeDirForPID(pid int) (string, error) {
-	// Try XDG_RUNTIME_DIR first
+// daemonGone reports whether the daemon process pid no longer exists
+func daemonGone(pid int) bool {
+	return pid > 0 && errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// runStorage returns the artifact storage of the run in runtimeDir, able to
+// decrypt output.log when the key the daemon used is available
+func runStorage(runtimeDir string) storage.Storage {
+	dir := storage.Dir(runtimeDir)
+
+	var config struct {
+		LogKeyFile string `json:"log_key_file"`
+	}
+	if data, err := dir.ReadFile("config.json"); err == nil {
+		json.Unmarshal(data, &config)
+	}
+
+	key, err := storage.LoadKey(config.LogKeyFile)
+	if err != nil || key == nil {
+		return dir
+	}
+	encrypted, err := storage.NewEncrypted(dir, key, "output.log", "session.cast", "timeline.jsonl", "terminal.json")
+	if err != nil {
+		return dir
+	}
+	return encrypted
+}
+
+// quotaError decodes a MsgQuotaExceeded payload into a
+// *protocol.QuotaExceeded error
+func quotaError(payload []byte) error {
+	q, err := protocol.ParseQuotaExceeded(payload)
+	if err != nil {
+		return err
+	}
+	return q
+}
+
+// runtimeRoots returns the directories that may hold the runtime directory
+// of a daemon, in lookup order
+func runtimeRoots() []string {
+	var roots []string
 	if xdgDir := os.Getenv("XDG_RUNTIME_DIR"); xdgDir != "" {
-		dir := filepath.Join(xdgDir, "bgrun", strconv.Itoa(pid))
+		roots = append(roots, filepath.Join(xdgDir, "bgrun"))
+	}
+	return append(roots, tmpRuntimeRoot)
+}
+
+// tmpRuntimeRoot is the runtime root of the daemons started without
+// XDG_RUNTIME_DIR, searched in all cases
+var tmpRuntimeRoot = filepath.Join("/tmp", ".bgrun-"+strconv.Itoa(os.Getuid()))
+
+// getRuntimeDirForPID finds the runtime directory for a given daemon PID.
+// Daemons using a custom runtime directory have a symlink to it in the
+// runtime root, which is resolved.
+func getRuntimeDirForPID(pid int) (string, error) {
+	for _, root := range runtimeRoots() {
+		dir := filepath.Join(root, strconv.Itoa(pid))
 		if _, err := os.Stat(dir); err == nil {
+			if target, err := os.Readlink(dir); err == nil && filepath.IsAbs(target) {
+				dir = target
+			}
 			return dir, nil
 		}
 	}
 
-	// Fall back to /tmp/.bgrun-<uid>/<pid>
-	uid := os.Getuid()
-	dir := filepath.Join("/tmp", ".bgrun-"+strconv.Itoa(uid), strconv.Itoa(pid))
-	if _, err := os.Stat(dir); err == nil {
-		return dir, nil
-	}
+	return "", fmt.Errorf("%w: runtime directory not found for PID %d (tried XDG_RUNTIME_DIR/bgrun and /tmp/.bgrun-%d)", ErrNoSuchDaemon, pid, os.Getuid())
+}
 
-	return "", fmt.Errorf("runtime directory not found for PID %d (tried XDG_RUNTIME_DIR/bgrun and /tmp/.bgrun-%d)", pid, uid)
+// RuntimeDir returns the runtime directory of the daemon (empty when
+// connected by socket path)
+func (c *Client) RuntimeDir() string {
+	return c.runtimeDir
+}
+
+// Storage returns the storage holding the daemon artifacts (output.log,
+// config.json, status.json)
+func (c *Client) Storage() storage.Storage {
+	return c.storage
+}
+
+// IsZombie reports whether the daemon has terminated and the client is
+// operating on its leftover status.json and output.log
+func (c *Client) IsZombie() bool {
+	return c.isZombie
 }
 
 // Close closes the connection and any open files
@@ -135,6 +280,16 @@ func (c *Client) Close() error {
 	return err
 }
 
+// readMessage reads the next message from the daemon. A connection the
+// daemon refused is answered with UNAUTHORIZED whatever the request.
+func (c *Client) readMessage() (*protocol.Message, error) {
+	msg, err := protocol.ReadMessage(c.conn)
+	if err == nil && msg.Type == protocol.MsgUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, msg.Payload)
+	}
+	return msg, err
+}
+
 // GetStatus retrieves the current process status
 func (c *Client) GetStatus() (*protocol.StatusResponse, error) {
 	// Return cached status for zombie processes
@@ -149,7 +304,7 @@ func (c *Client) GetStatus() (*protocol.StatusResponse, error) {
 	// We might receive a PROCESS_EXIT message before the status response
 	// if the process just exited. Keep reading until we get a status response.
 	for {
-		msg, err := protocol.ReadMessage(c.conn)
+		msg, err := c.readMessage()
 		if err != nil {
 			return nil, fmt.Errorf("failed to read response: %w", err)
 		}
@@ -197,6 +352,143 @@ func (c *Client) CloseStdin() error {
 	return nil
 }
 
+// SetLogLevel changes the level of the daemon log (debug, info, warn or
+// error) and returns the level in effect. An empty level only reads it.
+func (c *Client) SetLogLevel(level string) (string, error) {
+	if c.isZombie {
+		return "", ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgSetLogLevel, []byte(level)); err != nil {
+		return "", fmt.Errorf("failed to send set log level request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return "", ErrNotSupported
+		}
+		return "", fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgLogLevel {
+		return "", fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return string(msg.Payload), nil
+}
+
+// Checkpoint has the daemon dump the process tree with CRIU to the
+// checkpoint directory of its runtime directory, which it returns, for
+// "bgrun -restore" to restore it later, on this host or another. Unless
+// leaveRunning, the process is killed once checkpointed. Experimental.
+func (c *Client) Checkpoint(leaveRunning bool) (string, error) {
+	if c.isZombie {
+		return "", ErrProcessTerminated
+	}
+
+	payload, err := json.Marshal(protocol.CheckpointRequest{LeaveRunning: leaveRunning})
+	if err != nil {
+		return "", err
+	}
+	if err := protocol.WriteMessage(c.conn, protocol.MsgCheckpoint, payload); err != nil {
+		return "", fmt.Errorf("failed to send checkpoint request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return "", ErrNotSupported
+		}
+		return "", fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgCheckpointResponse {
+		return "", fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	var resp protocol.CheckpointResponse
+	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+		return "", fmt.Errorf("failed to parse checkpoint response: %w", err)
+	}
+	return resp.Dir, nil
+}
+
+// WriteStdinFile has the daemon write the file at path to the process
+// stdin, closing it afterwards with closeStdin, instead of sending the data
+// over the connection. The path is relative to the current directory of the
+// caller. It blocks until the whole file was written, calling progress, if
+// not nil, as it goes, and returns the number of bytes written. Daemons
+// without stdin files return ErrNotSupported.
+func (c *Client) WriteStdinFile(path string, closeStdin bool, progress func(*protocol.StdinFileProgress)) (int64, error) {
+	if c.isZombie {
+		return 0, ErrProcessTerminated
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := protocol.WriteStdinFileRequest(c.conn, &protocol.StdinFileRequest{Path: abs, Close: closeStdin}); err != nil {
+		return 0, fmt.Errorf("failed to send stdin file request: %w", err)
+	}
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		switch msg.Type {
+		case protocol.MsgStdinFileProgress:
+			p, err := protocol.ParseStdinFileProgress(msg.Payload)
+			if err != nil {
+				return 0, err
+			}
+			if progress != nil {
+				progress(p)
+			}
+			if p.Done {
+				return p.Sent, nil
+			}
+		case protocol.MsgProcessExit, protocol.MsgOutput:
+			// The process may exit as stdin is closed, before the last
+			// progress
+			continue
+		case protocol.MsgQuotaExceeded:
+			return 0, quotaError(msg.Payload)
+		case protocol.MsgError:
+			if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+				return 0, ErrNotSupported
+			}
+			return 0, fmt.Errorf("server error: %s", string(msg.Payload))
+		default:
+			return 0, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+		}
+	}
+}
+
+// PostSignal sends a signal to the process like SendSignal, without
+// waiting for the acknowledgment, so that it can be called while
+// ReadMessages runs: ReadMessages skips the acknowledgment, and returns the
+// error if the signal failed.
+func (c *Client) PostSignal(sig syscall.Signal) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	if err := protocol.WriteMessage(c.conn, protocol.MsgSignal, []byte{byte(sig)}); err != nil {
+		return fmt.Errorf("failed to send signal: %w", err)
+	}
+	return nil
+}
+
 // SendSignal sends a signal to the process
 func (c *Client) SendSignal(sig syscall.Signal) error {
 	if c.isZombie {
@@ -208,7 +500,7 @@ func (c *Client) SendSignal(sig syscall.Signal) error {
 	}
 
 	// Wait for acknowledgment
-	msg, err := protocol.ReadMessage(c.conn)
+	msg, err := c.readMessage()
 	if err != nil {
 		return fmt.Errorf("failed to read response: %w", err)
 	}
@@ -224,6 +516,45 @@ func (c *Client) SendSignal(sig syscall.Signal) error {
 	return nil
 }
 
+// Pause stops the process group with SIGSTOP, the status reporting it as
+// paused until Resume. Daemons without pausing return ErrNotSupported.
+func (c *Client) Pause() error {
+	return c.pause(protocol.MsgPause)
+}
+
+// Resume continues the process group stopped by Pause, or by SIGSTOP
+func (c *Client) Resume() error {
+	return c.pause(protocol.MsgResume)
+}
+
+// pause sends a pause or resume request
+func (c *Client) pause(msgType protocol.MessageType) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	if err := protocol.WriteMessage(c.conn, msgType, nil); err != nil {
+		return fmt.Errorf("failed to send %s: %w", msgType.Name(), err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return ErrNotSupported
+		}
+		return fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgPauseResponse {
+		return fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return nil
+}
+
 // Resize resizes the VTY terminal
 func (c *Client) Resize(rows, cols uint16) error {
 	if c.isZombie {
@@ -240,7 +571,7 @@ func (c *Client) Resize(rows, cols uint16) error {
 	}
 
 	// Wait for acknowledgment
-	msg, err := protocol.ReadMessage(c.conn)
+	msg, err := c.readMessage()
 	if err != nil {
 		return fmt.Errorf("failed to read response: %w", err)
 	}
@@ -256,15 +587,28 @@ func (c *Client) Resize(rows, cols uint16) error {
 	return nil
 }
 
-// Wait waits for a condition to be met with timeout
+// Wait waits for a condition to be met with timeout, 0 waiting forever
 // waitType: protocol.WaitTypeExit (wait for process exit) or protocol.WaitTypeForeground (wait for foreground control)
 // Returns: protocol.WaitStatusCompleted, protocol.WaitStatusTimeout, or protocol.WaitStatusNotApplicable
 // For zombie processes, returns immediately with WaitStatusCompleted and cleans up the runtime directory
 func (c *Client) Wait(timeoutSecs uint32, waitType byte) (byte, error) {
+	return c.waitCondition(&protocol.WaitRequest{TimeoutSecs: timeoutSecs, Type: waitType})
+}
+
+// WaitUntil is like Wait with an absolute deadline instead of a timeout,
+// so that a long wait can be retried after a lost connection without
+// extending it. Daemons without deadlines return ErrNotSupported.
+func (c *Client) WaitUntil(deadline time.Time, waitType byte) (byte, error) {
+	return c.waitCondition(&protocol.WaitRequest{Type: waitType, Deadline: deadline})
+}
+
+// waitCondition sends a wait for the process exit or foreground control,
+// reaping zombies instead
+func (c *Client) waitCondition(req *protocol.WaitRequest) (byte, error) {
 	// For zombie processes, return immediately and reap
 	if c.isZombie {
 		// Only reap on exit wait
-		if waitType == protocol.WaitTypeExit {
+		if req.Type == protocol.WaitTypeExit {
 			if err := c.reapZombie(); err != nil {
 				return 0, fmt.Errorf("failed to reap zombie: %w", err)
 			}
@@ -274,23 +618,84 @@ func (c *Client) Wait(timeoutSecs uint32, waitType byte) (byte, error) {
 		return protocol.WaitStatusNotApplicable, nil
 	}
 
-	payload := make([]byte, 5)
-	binary.BigEndian.PutUint32(payload[0:4], timeoutSecs)
-	payload[4] = waitType
+	return c.wait(req)
+}
+
+// WaitForPattern waits for the regular expression pattern (RE2 syntax) to
+// match a line of the output, or of the screen and scrollback in VTY mode.
+// Output printed before the call counts, so there is no race with a program
+// quick to print it. It returns protocol.WaitStatusCompleted,
+// protocol.WaitStatusTimeout, or protocol.WaitStatusNotApplicable when the
+// process exited without printing it. For terminated processes the output
+// log is searched. Daemons without pattern waits return ErrNotSupported.
+func (c *Client) WaitForPattern(timeoutSecs uint32, pattern string) (byte, error) {
+	if c.isZombie {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return 0, fmt.Errorf("invalid pattern: %w", err)
+		}
+		data, err := c.ReadOutput()
+		if err != nil {
+			return 0, err
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if re.Match(bytes.TrimSuffix(line, []byte("\r"))) {
+				return protocol.WaitStatusCompleted, nil
+			}
+		}
+		return protocol.WaitStatusNotApplicable, nil
+	}
+
+	return c.wait(&protocol.WaitRequest{TimeoutSecs: timeoutSecs, Type: protocol.WaitTypePattern, Pattern: pattern})
+}
+
+// WaitForOutputIdle waits until the process printed nothing for idle, the
+// quiet time counting output from before the call. It returns
+// protocol.WaitStatusCompleted, also right away once the process exited, or
+// protocol.WaitStatusTimeout. Daemons without idle waits return
+// ErrNotSupported.
+func (c *Client) WaitForOutputIdle(timeoutSecs uint32, idle time.Duration) (byte, error) {
+	if c.isZombie {
+		return protocol.WaitStatusCompleted, nil
+	}
+	return c.wait(&protocol.WaitRequest{TimeoutSecs: timeoutSecs, Type: protocol.WaitTypeOutputIdle, QuietMillis: uint32(idle.Milliseconds())})
+}
+
+// WaitForScreenStable waits until neither the screen nor the cursor changed
+// for stable, watching from the call on, so that a TUI is done redrawing
+// before its screen is read. It returns protocol.WaitStatusCompleted, also
+// right away once the process exited, protocol.WaitStatusTimeout, or
+// protocol.WaitStatusNotApplicable without VTY. Daemons without screen
+// waits return ErrNotSupported.
+func (c *Client) WaitForScreenStable(timeoutSecs uint32, stable time.Duration) (byte, error) {
+	if c.isZombie {
+		return protocol.WaitStatusCompleted, nil
+	}
+	return c.wait(&protocol.WaitRequest{TimeoutSecs: timeoutSecs, Type: protocol.WaitTypeScreenStable, QuietMillis: uint32(stable.Milliseconds())})
+}
 
-	if err := protocol.WriteMessage(c.conn, protocol.MsgWait, payload); err != nil {
+// wait sends a wait request and returns the status of the wait
+func (c *Client) wait(req *protocol.WaitRequest) (byte, error) {
+	if err := protocol.WriteWait(c.conn, req); err != nil {
 		return 0, fmt.Errorf("failed to send wait: %w", err)
 	}
 
 	// Wait for response (may receive MsgProcessExit first)
 	for {
-		msg, err := protocol.ReadMessage(c.conn)
+		msg, err := c.readMessage()
 		if err != nil {
 			return 0, fmt.Errorf("failed to read response: %w", err)
 		}
 
 		switch msg.Type {
+		case protocol.MsgQuotaExceeded:
+			return 0, quotaError(msg.Payload)
+
 		case protocol.MsgError:
+			// Daemons predating a wait type with a payload reject it
+			if strings.HasPrefix(string(msg.Payload), "invalid wait payload length") {
+				return 0, ErrNotSupported
+			}
 			return 0, fmt.Errorf("server error: %s", string(msg.Payload))
 
 		case protocol.MsgWaitResponse:
@@ -315,6 +720,21 @@ func (c *Client) reapZombie() error {
 	if !c.isZombie {
 		return fmt.Errorf("cannot reap non-zombie process")
 	}
+	if err := c.storage.RemoveAll(); err != nil {
+		return err
+	}
+
+	// Drop the index entry of a custom runtime directory and the registry
+	// entry
+	for _, root := range runtimeRoots() {
+		link := filepath.Join(root, strconv.Itoa(c.pid))
+		if target, err := os.Readlink(link); err == nil && target == c.runtimeDir {
+			os.Remove(link)
+		}
+		if _, err := os.Stat(filepath.Join(root, registry.FileName)); err == nil {
+			registry.Open(root).Remove(c.pid, c.runtimeDir)
+		}
+	}
 	return os.RemoveAll(c.runtimeDir)
 }
 
@@ -325,13 +745,94 @@ func (c *Client) Attach(streams byte) error {
 	if c.isZombie {
 		return ErrProcessTerminated
 	}
-	payload := []byte{streams}
-	if err := protocol.WriteMessage(c.conn, protocol.MsgAttach, payload); err != nil {
+	c.window = 0
+	if err := protocol.WriteAttach(c.conn, &protocol.AttachRequest{Streams: streams, Notify: c.notices != nil}); err != nil {
+		return fmt.Errorf("failed to attach: %w", err)
+	}
+	return nil
+}
+
+// AttachExclusive attaches to output streams like Attach, detaching every
+// other client, whose ReadMessages returns ErrDetached, and holding stdin:
+// the input of other clients is refused until this one detaches or
+// disconnects. Daemons supporting it report the "exclusive" feature.
+func (c *Client) AttachExclusive(streams byte) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	c.window = 0
+	if err := protocol.WriteAttach(c.conn, &protocol.AttachRequest{Streams: streams, Exclusive: true, Notify: c.notices != nil}); err != nil {
+		return fmt.Errorf("failed to attach: %w", err)
+	}
+	return nil
+}
+
+// AttachFrom attaches to output streams like Attach, starting with the
+// output the daemon still holds from offset on, an offset counting the bytes
+// of both streams since the process started. A client reconnecting with
+// the OutputOffset of its previous connection gets the output it missed,
+// as long as it is among the last megabyte the daemon holds. Otherwise
+// ReadMessages fails with the earliest offset available; offset 0 starts
+// with all the output held.
+// Daemons supporting it report the "resume" feature in their capabilities,
+// older ones reject the attachment.
+func (c *Client) AttachFrom(streams byte, offset uint64) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	c.outputOffset, c.window = offset, 0
+	if err := protocol.WriteAttach(c.conn, &protocol.AttachRequest{Streams: streams, Resume: true, Offset: offset, Notify: c.notices != nil}); err != nil {
+		return fmt.Errorf("failed to attach: %w", err)
+	}
+	return nil
+}
+
+// AttachFlow attaches from offset like AttachFrom, with flow control: the
+// daemon sends at most window bytes of output, possibly exceeding it by one
+// message, until ReadMessages grants more as the output handler consumes
+// it. Once the credit is used up, FlowPause stops sending, later resuming
+// from the last megabyte of output the daemon holds, while FlowBlock stops
+// reading the program's output, blocking the program. Daemons supporting it
+// report the "flow_control" feature.
+func (c *Client) AttachFlow(streams byte, offset uint64, policy byte, window uint32) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	if policy == protocol.FlowNone || window == 0 {
+		return fmt.Errorf("flow control needs a policy and a window")
+	}
+	c.outputOffset = offset
+	c.window, c.consumed = window, 0
+	req := &protocol.AttachRequest{Streams: streams, Resume: true, Offset: offset, Flow: policy, Window: window, Notify: c.notices != nil}
+	if err := protocol.WriteAttach(c.conn, req); err != nil {
 		return fmt.Errorf("failed to attach: %w", err)
 	}
 	return nil
 }
 
+// grantCredit grants back the credit of n bytes of output consumed, in
+// batches of half the flow control window
+func (c *Client) grantCredit(n int) error {
+	if c.window == 0 {
+		return nil
+	}
+	c.consumed += uint32(n)
+	if c.consumed < c.window/2 {
+		return nil
+	}
+	if err := protocol.WriteCredit(c.conn, c.consumed); err != nil {
+		return fmt.Errorf("failed to grant credit: %w", err)
+	}
+	c.consumed = 0
+	return nil
+}
+
+// OutputOffset returns the offset following the last output ReadMessages
+// received after AttachFrom, where a later AttachFrom resumes
+func (c *Client) OutputOffset() uint64 {
+	return c.outputOffset
+}
+
 // Detach detaches from output streams
 func (c *Client) Detach() error {
 	if c.isZombie {
@@ -360,6 +861,30 @@ type OutputHandler func(stream byte, data []byte) error
 // ExitHandler is called when the process exits
 type ExitHandler func(exitCode int)
 
+// NoticeHandler is called with the attached, detached and resized events of
+// the other clients
+type NoticeHandler func(ev *protocol.Event)
+
+// SetNoticeHandler has the following attachments ask for notices, which
+// ReadMessages hands to handler: another client attached, detached or
+// resized the terminal. A nil handler stops asking.
+//
+// SetNoticeHandler checks the daemon reports the "notices" feature,
+// returning ErrNotSupported otherwise, and must be called before Attach.
+func (c *Client) SetNoticeHandler(handler NoticeHandler) error {
+	if handler != nil {
+		caps, err := c.GetCapabilities()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(caps.Features, "notices") {
+			return ErrNotSupported
+		}
+	}
+	c.notices = handler
+	return nil
+}
+
 // ReadMessages reads and handles messages from the daemon for real-time streaming
 // This is typically run in a goroutine after calling Attach()
 // For zombie processes, use ReadOutput() instead
@@ -368,8 +893,10 @@ func (c *Client) ReadMessages(outputHandler OutputHandler, exitHandler ExitHandl
 		return ErrProcessTerminated
 	}
 
+	defer c.startHeartbeat()()
+
 	for {
-		msg, err := protocol.ReadMessage(c.conn)
+		msg, err := c.readStreamed()
 		if err != nil {
 			if err == io.EOF {
 				return nil
@@ -389,6 +916,21 @@ func (c *Client) ReadMessages(outputHandler OutputHandler, exitHandler ExitHandl
 				}
 			}
 
+		case protocol.MsgOutputAt:
+			stream, offset, data, err := protocol.ParseOutputAt(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to parse output: %w", err)
+			}
+			c.outputOffset = max(c.outputOffset, offset+uint64(len(data)))
+			if outputHandler != nil {
+				if err := outputHandler(stream, data); err != nil {
+					return err
+				}
+			}
+			if err := c.grantCredit(len(data)); err != nil {
+				return err
+			}
+
 		case protocol.MsgProcessExit:
 			exitCode, err := protocol.ParseProcessExit(msg.Payload)
 			if err != nil {
@@ -399,6 +941,25 @@ func (c *Client) ReadMessages(outputHandler OutputHandler, exitHandler ExitHandl
 			}
 			return nil
 
+		case protocol.MsgEvent:
+			if c.notices != nil {
+				ev, err := protocol.ParseEvent(msg.Payload)
+				if err != nil {
+					return fmt.Errorf("failed to parse event: %w", err)
+				}
+				c.notices(ev)
+			}
+
+		case protocol.MsgDetached:
+			by, err := protocol.ParseDetached(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to parse detachment: %w", err)
+			}
+			return fmt.Errorf("%w (client %d attached exclusively)", ErrDetached, by)
+
+		case protocol.MsgQuotaExceeded:
+			return quotaError(msg.Payload)
+
 		case protocol.MsgError:
 			return fmt.Errorf("server error: %s", string(msg.Payload))
 
@@ -408,81 +969,917 @@ func (c *Client) ReadMessages(outputHandler OutputHandler, exitHandler ExitHandl
 	}
 }
 
-// ReadOutput reads the complete output log from a terminated process
-// This only works on zombie processes - use Attach/ReadMessages for live processes
-// Returns the complete output as a byte slice
-func (c *Client) ReadOutput() ([]byte, error) {
-	if !c.isZombie {
+// SubscribeScreen asks the daemon to push screen updates, the rows changed
+// with their attributes, instead of raw output (VTY mode only). The first
+// update holds the whole screen. Read them with ReadScreenUpdates.
+func (c *Client) SubscribeScreen() error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	if err := protocol.WriteSubscribeScreen(c.conn, protocol.ScreenSubscribe); err != nil {
+		return fmt.Errorf("failed to subscribe to the screen: %w", err)
+	}
+	return nil
+}
+
+// UnsubscribeScreen stops the screen updates
+func (c *Client) UnsubscribeScreen() error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+	if err := protocol.WriteSubscribeScreen(c.conn, protocol.ScreenUnsubscribe); err != nil {
+		return fmt.Errorf("failed to unsubscribe from the screen: %w", err)
+	}
+	return nil
+}
+
+// eventQueueSize is the number of events Subscribe buffers for a slow reader
+const eventQueueSize = 16
+
+// Subscribe subscribes to the lifecycle events of the daemon: process
+// exited, terminal resized, title changed, foreground process group changed
+// and clients attached or detached. The first event, of type started,
+// describes the process; it is followed by its exited event if it already
+// exited. The channel is closed after the exit, or when the connection
+// fails.
+//
+// The connection only receives events from then on: requests need another
+// Client. Daemons without events return ErrNotSupported.
+func (c *Client) Subscribe() (<-chan *protocol.Event, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteSubscribe(c.conn, protocol.EventsSubscribe); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to events: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return nil, ErrNotSupported
+		}
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgEvent {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	started, err := protocol.ParseEvent(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *protocol.Event, eventQueueSize)
+	events <- started
+	go c.readEvents(events)
+	return events, nil
+}
+
+// readEvents delivers the events received to events until the process
+// exits or the connection fails
+func (c *Client) readEvents(events chan<- *protocol.Event) {
+	defer close(events)
+	defer c.startHeartbeat()()
+
+	for {
+		msg, err := c.readStreamed()
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgEvent:
+			ev, err := protocol.ParseEvent(msg.Payload)
+			if err != nil {
+				return
+			}
+			events <- ev
+
+		case protocol.MsgProcessExit, protocol.MsgError:
+			return
+
+		default:
+			// Ignore output and unknown message types
+		}
+	}
+}
+
+// Expect sets rules the daemon applies to the output on its own: when a
+// rule's pattern matches, its input is written to the process right away,
+// without a round trip through the client. Each match is then reported on
+// the channel, which is closed after the process exits or when the
+// connection fails. Output printed before the call only counts for the
+// current line, so that a prompt already displayed is answered.
+//
+// The rules last as long as the connection, which only receives matches
+// from then on: requests need another Client. Daemons without expect return
+// ErrNotSupported.
+func (c *Client) Expect(rules []protocol.ExpectRule) (<-chan *protocol.ExpectMatch, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteExpectRequest(c.conn, &protocol.ExpectRequest{Rules: rules}); err != nil {
+		return nil, fmt.Errorf("failed to send expect rules: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return nil, ErrNotSupported
+		}
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgExpectResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	matches := make(chan *protocol.ExpectMatch, eventQueueSize)
+	go c.readExpectMatches(matches)
+	return matches, nil
+}
+
+// readExpectMatches delivers the expect matches received to matches until
+// the process exits or the connection fails
+func (c *Client) readExpectMatches(matches chan<- *protocol.ExpectMatch) {
+	defer close(matches)
+	defer c.startHeartbeat()()
+
+	for {
+		msg, err := c.readStreamed()
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgExpectMatch:
+			match, err := protocol.ParseExpectMatch(msg.Payload)
+			if err != nil {
+				return
+			}
+			matches <- match
+
+		case protocol.MsgProcessExit, protocol.MsgError:
+			return
+
+		default:
+			// Ignore output and unknown message types
+		}
+	}
+}
+
+// ScreenUpdateHandler is called when a screen update is received
+type ScreenUpdateHandler func(update *protocol.ScreenUpdate) error
+
+// ReadScreenUpdates reads the screen updates pushed after SubscribeScreen
+// until the process exits. Output received while attached is ignored.
+func (c *Client) ReadScreenUpdates(updateHandler ScreenUpdateHandler, exitHandler ExitHandler) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+
+	defer c.startHeartbeat()()
+
+	for {
+		msg, err := c.readStreamed()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+
+		switch msg.Type {
+		case protocol.MsgScreenUpdate:
+			update, err := protocol.ParseScreenUpdate(msg.Payload)
+			if err != nil {
+				return err
+			}
+			if updateHandler != nil {
+				if err := updateHandler(update); err != nil {
+					return err
+				}
+			}
+
+		case protocol.MsgProcessExit:
+			exitCode, err := protocol.ParseProcessExit(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to parse exit code: %w", err)
+			}
+			if exitHandler != nil {
+				exitHandler(exitCode)
+			}
+			return nil
+
+		case protocol.MsgError:
+			return fmt.Errorf("server error: %s", string(msg.Payload))
+
+		default:
+			// Ignore output and unknown message types
+		}
+	}
+}
+
+// ReadOutput reads the complete output log from a terminated process
+// This only works on zombie processes - use Attach/ReadMessages for live processes
+// Returns the complete output as a byte slice
+func (c *Client) ReadOutput() ([]byte, error) {
+	if !c.isZombie {
 		return nil, fmt.Errorf("ReadOutput only works on terminated processes, use Attach/ReadMessages for live processes")
 	}
 
-	if c.outputLog == nil {
-		return []byte{}, nil // No output log available
+	if c.outputLog == nil {
+		return []byte{}, nil // No output log available
+	}
+
+	// Seek to beginning of file
+	if _, err := c.outputLog.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("failed to seek output log: %w", err)
+	}
+
+	// Read entire file
+	data, err := io.ReadAll(c.outputLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output log: %w", err)
+	}
+	if storage.IsEncrypted(data) {
+		return nil, storage.ErrEncrypted
+	}
+
+	return data, nil
+}
+
+// GetScreen retrieves the current terminal screen state (VTY mode only)
+// This returns the current screen buffer, cursor position, and dimensions.
+// For terminated processes it is the last screen, restored from the terminal
+// state saved in the run storage.
+func (c *Client) GetScreen() (*protocol.ScreenResponse, error) {
+	if c.isZombie {
+		return c.storedScreen()
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetScreen, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get screen request: %w", err)
+	}
+
+	// Wait for response
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgScreenResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	screen, err := protocol.ParseScreenResponse(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse screen response: %w", err)
+	}
+
+	return screen, nil
+}
+
+// storedTerminal returns the terminal of a terminated daemon, restored from
+// the state it saved, or replayed from its output log when it ran with
+// replay_screen or replay is set. It returns ErrProcessTerminated if there
+// is neither.
+func (c *Client) storedTerminal(replay bool) (*termemu.Terminal, error) {
+	if c.storage == nil {
+		return nil, ErrProcessTerminated
+	}
+	data, err := c.storage.ReadFile("terminal.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return c.replayedTerminal(replay)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terminal state: %w", err)
+	}
+	if storage.IsEncrypted(data) {
+		return nil, storage.ErrEncrypted
+	}
+
+	term := termemu.NewTerminal(1, 1)
+	if err := term.Restore(data); err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+// replayedTerminal replays the output log of a terminated daemon through a
+// terminal, as it did when it ran with replay_screen. Without it, the log
+// is only replayed if replay is set.
+func (c *Client) replayedTerminal(replay bool) (*termemu.Terminal, error) {
+	if c.outputLog == nil {
+		return nil, ErrProcessTerminated
+	}
+	if !replay {
+		var config struct {
+			ReplayScreen bool `json:"replay_screen"`
+		}
+		data, err := c.storage.ReadFile("config.json")
+		if err != nil || json.Unmarshal(data, &config) != nil || !config.ReplayScreen {
+			return nil, ErrProcessTerminated
+		}
+	}
+	term, err := termemu.ReplayLog(c.outputLog, 24, 80)
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay output log: %w", err)
+	}
+	return term, nil
+}
+
+// storedScreen returns the screen of a terminated daemon, or
+// ErrProcessTerminated if there is none
+func (c *Client) storedScreen() (*protocol.ScreenResponse, error) {
+	term, err := c.storedTerminal(false)
+	if err != nil {
+		return nil, err
+	}
+
+	screen := term.GetScreen()
+	lines := make([]string, len(screen))
+	for i, row := range screen {
+		line := make([]rune, len(row))
+		for j, cell := range row {
+			line[j] = cell.Char
+			if cell.Char == 0 {
+				line[j] = ' '
+			}
+		}
+		lines[i] = string(line)
+	}
+
+	rows, cols := term.Size()
+	cursorRow, cursorCol := term.GetCursor()
+	modes := term.InputModes()
+	return &protocol.ScreenResponse{
+		Rows:      rows,
+		Cols:      cols,
+		CursorRow: cursorRow,
+		CursorCol: cursorCol,
+		Lines:     lines,
+		InputModes: protocol.InputModes{
+			BracketedPaste:    modes.BracketedPaste,
+			ApplicationCursor: modes.ApplicationCursor,
+			ApplicationKeypad: modes.ApplicationKeypad,
+		},
+	}, nil
+}
+
+// GetScreenCells retrieves the current terminal screen like GetScreen, with
+// the colors, attributes and hyperlinks of the cells (VTY mode only)
+func (c *Client) GetScreenCells() (*protocol.ScreenCellsResponse, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetScreenCells, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get screen request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgScreenCellsResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return protocol.ParseScreenCellsResponse(msg.Payload)
+}
+
+// GetScrollback retrieves a page of the scrollback, with the colors,
+// attributes and hyperlinks of its cells, and the number of lines in it
+// (VTY mode only). A negative offset counts from the end of the scrollback,
+// and a limit of 0 retrieves the lines up to the end.
+func (c *Client) GetScrollback(offset, limit int) (*protocol.ScrollbackResponse, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteScrollbackRequest(c.conn, &protocol.ScrollbackRequest{Offset: offset, Limit: limit}); err != nil {
+		return nil, fmt.Errorf("failed to send scrollback request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgScrollbackResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return protocol.ParseScrollbackResponse(msg.Payload)
+}
+
+// GetTitle retrieves the window title and icon name set by the program
+// (VTY mode only). The title of a terminated process is in GetStatus.
+func (c *Client) GetTitle() (*protocol.TitleResponse, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetTitle, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get title request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgTitleResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	title, err := protocol.ParseTitleResponse(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse title response: %w", err)
+	}
+
+	return title, nil
+}
+
+// GetCommands lists the commands executed in the terminal, as delimited by
+// the shell integration marks (OSC 133) of the shell running in it
+func (c *Client) GetCommands() ([]protocol.CommandInfo, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetCommands, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get commands request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgCommandsResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
 	}
 
-	// Seek to beginning of file
-	if _, err := c.outputLog.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek output log: %w", err)
+	resp, err := protocol.ParseCommandsResponse(msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse commands response: %w", err)
 	}
 
-	// Read entire file
-	data, err := io.ReadAll(c.outputLog)
+	return resp.Commands, nil
+}
+
+// GetCommandOutput exports the output of the command at index in
+// GetCommands. Negative indexes count from the end, -1 being the last
+// command.
+func (c *Client) GetCommandOutput(index int, format protocol.ExportFormat) (string, error) {
+	if c.isZombie {
+		return "", ErrProcessTerminated
+	}
+
+	req := &protocol.CommandOutputRequest{Index: index, Format: format}
+	if err := protocol.WriteCommandOutputRequest(c.conn, req); err != nil {
+		return "", fmt.Errorf("failed to send command output request: %w", err)
+	}
+
+	msg, err := c.readMessage()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read output log: %w", err)
+		return "", fmt.Errorf("failed to read response: %w", err)
 	}
 
-	return data, nil
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return "", quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return "", fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgExportResponse {
+		return "", fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	resp, err := protocol.ParseExportResponse(msg.Payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse export response: %w", err)
+	}
+
+	return resp.Content, nil
 }
 
-// GetScreen retrieves the current terminal screen state (VTY mode only)
-// This returns the current screen buffer, cursor position, and dimensions
-func (c *Client) GetScreen() (*protocol.ScreenResponse, error) {
+// Search returns the matches of a regular expression (RE2 syntax) in the
+// screen, and in the scrollback if requested (VTY mode only)
+func (c *Client) Search(req *protocol.SearchRequest) ([]protocol.SearchMatch, error) {
 	if c.isZombie {
 		return nil, ErrProcessTerminated
 	}
 
-	if err := protocol.WriteMessage(c.conn, protocol.MsgGetScreen, nil); err != nil {
-		return nil, fmt.Errorf("failed to send get screen request: %w", err)
+	if err := protocol.WriteSearchRequest(c.conn, req); err != nil {
+		return nil, fmt.Errorf("failed to send search request: %w", err)
 	}
 
-	// Wait for response
-	msg, err := protocol.ReadMessage(c.conn)
+	msg, err := c.readMessage()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
 	if msg.Type == protocol.MsgError {
 		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
 	}
 
-	if msg.Type != protocol.MsgScreenResponse {
+	if msg.Type != protocol.MsgSearchResponse {
 		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
 	}
 
-	screen, err := protocol.ParseScreenResponse(msg.Payload)
+	resp, err := protocol.ParseSearchResponse(msg.Payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse screen response: %w", err)
+		return nil, fmt.Errorf("failed to parse search response: %w", err)
 	}
 
-	return screen, nil
+	return resp.Matches, nil
 }
 
-// Export exports the terminal content in the specified format
-func (c *Client) Export(req *protocol.ExportRequest) (*protocol.ExportResponse, error) {
+// StartRecording starts recording the session as an asciinema v2 file,
+// replacing any previous recording (VTY mode only). The recording begins
+// with the current screen content.
+func (c *Client) StartRecording() error {
+	return c.record(protocol.RecordStart)
+}
+
+// StopRecording stops recording the session
+func (c *Client) StopRecording() error {
+	return c.record(protocol.RecordStop)
+}
+
+func (c *Client) record(action byte) error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgRecord, []byte{action}); err != nil {
+		return fmt.Errorf("failed to send record request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgRecordResponse {
+		return fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return nil
+}
+
+// GetRecording returns the asciinema v2 recording of the session, which can
+// be played with `asciinema play`. For terminated processes it is read from
+// the run storage.
+func (c *Client) GetRecording() ([]byte, error) {
+	if c.isZombie {
+		data, err := c.storage.ReadFile("session.cast")
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("session has not been recorded")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recording: %w", err)
+		}
+		if storage.IsEncrypted(data) {
+			return nil, storage.ErrEncrypted
+		}
+		return data, nil
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetRecording, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get recording request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgRecording {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return msg.Payload, nil
+}
+
+// GetTimeline returns the timeline of the recorded session as JSON lines
+// (see protocol.ParseTimeline), interleaving the output with the input,
+// resizes, signals and shell marks. For terminated processes it is read from
+// the run storage.
+func (c *Client) GetTimeline() ([]byte, error) {
+	if c.isZombie {
+		data, err := c.storage.ReadFile("timeline.jsonl")
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("session has not been recorded")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read timeline: %w", err)
+		}
+		if storage.IsEncrypted(data) {
+			return nil, storage.ErrEncrypted
+		}
+		return data, nil
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgGetTimeline, nil); err != nil {
+		return nil, fmt.Errorf("failed to send get timeline request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
+	if msg.Type == protocol.MsgError {
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgTimeline {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return msg.Payload, nil
+}
+
+// Replay plays the recording of the session back with its original timing,
+// scaled by speed (2 plays twice as fast), passing the output to handler.
+// The daemon drives the replay, whether or not the process is still running;
+// for terminated processes it is played from the run storage.
+func (c *Client) Replay(speed float64, handler func(data []byte) error) error {
+	if c.isZombie {
+		return c.replayStored(speed, handler)
+	}
+
+	if err := protocol.WriteReplayRequest(c.conn, &protocol.ReplayRequest{Speed: speed}); err != nil {
+		return fmt.Errorf("failed to send replay request: %w", err)
+	}
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+
+		switch msg.Type {
+		case protocol.MsgOutput:
+			_, data, err := protocol.ParseOutput(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to parse output: %w", err)
+			}
+			if err := handler(data); err != nil {
+				return err
+			}
+
+		case protocol.MsgReplayEnd:
+			return nil
+
+		case protocol.MsgProcessExit:
+			// Sent to every client when the process exits, not part of
+			// the replay
+
+		case protocol.MsgQuotaExceeded:
+			return quotaError(msg.Payload)
+
+		case protocol.MsgError:
+			return fmt.Errorf("server error: %s", string(msg.Payload))
+
+		default:
+			return fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+		}
+	}
+}
+
+// replayStored plays the recording left by a terminated daemon
+func (c *Client) replayStored(speed float64, handler func(data []byte) error) error {
+	if speed < 0 {
+		return fmt.Errorf("invalid replay speed %g", speed)
+	}
+	if speed == 0 {
+		speed = 1
+	}
+
+	data, err := c.GetRecording()
+	if err != nil {
+		return err
+	}
+	events, err := protocol.ParseRecording(data)
+	if err != nil {
+		return err
+	}
+
+	var last float64
+	for _, ev := range events {
+		if ev.Type != "o" {
+			continue
+		}
+		time.Sleep(time.Duration((ev.Time - last) / speed * float64(time.Second)))
+		last = ev.Time
+		if err := handler([]byte(ev.Data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCapabilities returns the message types, export formats, wait types and
+// features supported by the daemon. Daemons too old to report them return
+// ErrNotSupported, which means none of the requests newer than SHUTDOWN can
+// be used.
+func (c *Client) GetCapabilities() (*protocol.Capabilities, error) {
 	if c.isZombie {
 		return nil, ErrProcessTerminated
 	}
 
-	if err := protocol.WriteExportRequest(c.conn, req); err != nil {
-		return nil, fmt.Errorf("failed to send export request: %w", err)
+	if err := protocol.WriteMessage(c.conn, protocol.MsgCapabilities, nil); err != nil {
+		return nil, fmt.Errorf("failed to send capabilities request: %w", err)
 	}
 
-	// Wait for response
-	msg, err := protocol.ReadMessage(c.conn)
+	msg, err := c.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return nil, ErrNotSupported
+		}
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgCapabilitiesResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return protocol.ParseCapabilities(msg.Payload)
+}
+
+// EnableCompression asks the daemon to compress the large messages it sends
+// from then on, output and exports mostly, which is worth it over a slow
+// link. They are decompressed transparently when read. Daemons without
+// compression return ErrNotSupported.
+func (c *Client) EnableCompression() error {
+	if c.isZombie {
+		return ErrProcessTerminated
+	}
+
+	if err := protocol.WriteCompressionRequest(c.conn, protocol.CompressionGzip); err != nil {
+		return fmt.Errorf("failed to send capabilities request: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return ErrNotSupported
+		}
+		return fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgCapabilitiesResponse {
+		return fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	caps, err := protocol.ParseCapabilities(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if caps.Compression == "" {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// Health reports the internal health of the daemon: whether its state lock,
+// goroutines, log writer and output readers work, regardless of the state of
+// the process it runs
+func (c *Client) Health() (*protocol.HealthResponse, error) {
+	if c.isZombie {
+		return nil, ErrProcessTerminated
+	}
+
+	if err := protocol.WriteMessage(c.conn, protocol.MsgHealth, nil); err != nil {
+		return nil, fmt.Errorf("failed to send health request: %w", err)
+	}
+
+	msg, err := c.readMessage()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return nil, ErrNotSupported
+		}
+		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgHealthResponse {
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return protocol.ParseHealthResponse(msg.Payload)
+}
+
+// Export exports the terminal content in the specified format. For
+// terminated processes it is the last screen, as GetScreen.
+func (c *Client) Export(req *protocol.ExportRequest) (*protocol.ExportResponse, error) {
+	if c.isZombie {
+		return c.storedExport(req)
+	}
+
+	if err := protocol.WriteExportRequest(c.conn, req); err != nil {
+		return nil, fmt.Errorf("failed to send export request: %w", err)
+	}
+
+	// Wait for response, skipping the exit notification of a process that
+	// exited meanwhile
+	var msg *protocol.Message
+	for {
+		var err error
+		if msg, err = c.readMessage(); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if msg.Type != protocol.MsgProcessExit && msg.Type != protocol.MsgOutput {
+			break
+		}
+	}
+
+	if msg.Type == protocol.MsgQuotaExceeded {
+		return nil, quotaError(msg.Payload)
+	}
+
 	if msg.Type == protocol.MsgError {
 		return nil, fmt.Errorf("server error: %s", string(msg.Payload))
 	}
@@ -499,6 +1896,41 @@ func (c *Client) Export(req *protocol.ExportRequest) (*protocol.ExportResponse,
 	return resp, nil
 }
 
+// storedExport exports the terminal of a terminated daemon, replaying its
+// output log when it did not save its terminal state, so that a post-mortem
+// report can be made of any run
+func (c *Client) storedExport(req *protocol.ExportRequest) (*protocol.ExportResponse, error) {
+	term, err := c.storedTerminal(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var format termemu.ExportFormat
+	switch req.Format {
+	case protocol.ExportFormatPlainText:
+		format = termemu.FormatPlainText
+	case protocol.ExportFormatMarkdown:
+		format = termemu.FormatMarkdown
+	case protocol.ExportFormatHTML:
+		format = termemu.FormatHTML
+	case protocol.ExportFormatANSI:
+		format = termemu.FormatANSI
+	default:
+		return nil, fmt.Errorf("unsupported export format: %d", req.Format)
+	}
+
+	return &protocol.ExportResponse{
+		Content: term.Export(termemu.ExportOptions{
+			Format:                 format,
+			IncludeScrollback:      req.IncludeScrollback,
+			StartLine:              req.StartLine,
+			EndLine:                req.EndLine,
+			PreserveTrailingSpaces: req.PreserveTrailingSpaces,
+		}),
+		Format: req.Format,
+	}, nil
+}
+
 // ExportPlainText is a convenience method to export as plain text
 func (c *Client) ExportPlainText(includeScrollback bool) (string, error) {
 	resp, err := c.Export(&protocol.ExportRequest{
@@ -527,6 +1959,21 @@ func (c *Client) ExportMarkdown(includeScrollback bool) (string, error) {
 	return resp.Content, nil
 }
 
+// ExportANSI is a convenience method to export as text with the escape
+// sequences reproducing colors, attributes and hyperlinks in a terminal
+func (c *Client) ExportANSI(includeScrollback bool) (string, error) {
+	resp, err := c.Export(&protocol.ExportRequest{
+		Format:            protocol.ExportFormatANSI,
+		IncludeScrollback: includeScrollback,
+		StartLine:         0,
+		EndLine:           -1,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
 // ExportHTML is a convenience method to export as HTML
 func (c *Client) ExportHTML(includeScrollback bool) (string, error) {
 	resp, err := c.Export(&protocol.ExportRequest{
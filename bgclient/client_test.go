@@ -3,15 +3,24 @@ package bgclient
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/KarpelesLab/bgrun/daemon"
 	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/storage"
 )
 
 func setupDaemon(t *testing.T, config *daemon.Config) (*daemon.Daemon, string) {
@@ -239,6 +248,96 @@ func TestCloseStdin(t *testing.T) {
 	}
 }
 
+func TestSetLogLevel(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	d, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if level, err := c.SetLogLevel(""); err != nil || level != "info" {
+		t.Errorf("Expected the default level info, got %q, %v", level, err)
+	}
+	if level, err := c.SetLogLevel("debug"); err != nil || level != "debug" {
+		t.Errorf("Expected the level to be set to debug, got %q, %v", level, err)
+	}
+	if _, err := c.SetLogLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+
+	// Requests are logged at the debug level, the connection handling them
+	// in order
+	if err := c.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	if _, err := c.SetLogLevel(""); err != nil {
+		t.Fatalf("SetLogLevel failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(d.RuntimeDir(), daemon.DaemonLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "DEBUG Client attached") {
+		t.Errorf("Expected the wait request in daemon.log, got:\n%s", data)
+	}
+}
+
+func TestWriteStdinFile(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, bytes.Repeat([]byte("0123456789abcdef"), 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	count := filepath.Join(dir, "count")
+
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", `wc -c > "$0"`, count},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteStdinFile(filepath.Join(dir, "missing"), false, nil); err == nil {
+		t.Error("Expected a missing file to be rejected")
+	}
+
+	var last *protocol.StdinFileProgress
+	sent, err := c.WriteStdinFile(input, true, func(p *protocol.StdinFileProgress) { last = p })
+	if err != nil {
+		t.Fatalf("WriteStdinFile failed: %v", err)
+	}
+	if sent != 1<<20 || last == nil || !last.Done || last.Size != 1<<20 {
+		t.Errorf("Expected the whole file to be sent, got %d bytes and last progress %+v", sent, last)
+	}
+
+	// Closing stdin let wc finish
+	if status, err := c.Wait(5, protocol.WaitTypeExit); err != nil || status != protocol.WaitStatusCompleted {
+		t.Fatalf("Wait failed: status %d, %v", status, err)
+	}
+	data, err := os.ReadFile(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "1048576" {
+		t.Errorf("Expected the process to read 1048576 bytes, got %s", got)
+	}
+}
+
 func TestSendSignal(t *testing.T) {
 	config := &daemon.Config{
 		Command:    []string{"sleep", "60"},
@@ -411,14 +510,13 @@ func TestWaitForeground(t *testing.T) {
 	}
 }
 
-func TestAttachDetach(t *testing.T) {
+func TestStatusForeground(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"sh", "-c", "echo hello; sleep 1; echo world"},
-		StdinMode:  daemon.StdinNull,
-		StdoutMode: daemon.IOModeLog,
-		StderrMode: daemon.IOModeLog,
+		Command: []string{"bash", "--norc", "-i"},
+		UseVTY:  true,
 	}
 	_, socketPath := setupDaemon(t, config)
+	time.Sleep(200 * time.Millisecond)
 
 	c, err := Connect(socketPath)
 	if err != nil {
@@ -426,22 +524,32 @@ func TestAttachDetach(t *testing.T) {
 	}
 	defer c.Close()
 
-	// Attach to stdout
-	if err := c.Attach(protocol.StreamStdout); err != nil {
-		t.Fatalf("Attach failed: %v", err)
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if fg := status.Foreground; fg == nil || fg.PID != status.PID || fg.Name != "bash" {
+		t.Errorf("Expected the shell in the foreground, got %+v", fg)
 	}
 
-	// Detach
-	if err := c.Detach(); err != nil {
-		t.Fatalf("Detach failed: %v", err)
+	if err := c.WriteStdin([]byte("sleep 5\n")); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
 	}
+	time.Sleep(300 * time.Millisecond)
 
-	t.Log("Attach/Detach succeeded")
+	status, err = c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	fg := status.Foreground
+	if fg == nil || fg.PID == status.PID || fg.Name != "sleep" || !slices.Equal(fg.Command, []string{"sleep", "5"}) {
+		t.Errorf("Expected sleep in the foreground, got %+v", fg)
+	}
 }
 
-func TestShutdown(t *testing.T) {
+func TestPauseResume(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"sleep", "60"},
+		Command:    []string{"sleep", "5"},
 		StdinMode:  daemon.StdinNull,
 		StdoutMode: daemon.IOModeLog,
 		StderrMode: daemon.IOModeLog,
@@ -452,23 +560,44 @@ func TestShutdown(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Connect failed: %v", err)
 	}
+	defer c.Close()
 
-	// Send shutdown - should succeed
-	// Note: The shutdown handler calls os.Exit() which would terminate
-	// the test process, so we just verify the message is sent successfully
-	if err := c.Shutdown(); err != nil {
-		t.Fatalf("Shutdown failed: %v", err)
+	paused := func(want bool) {
+		t.Helper()
+		status, err := c.GetStatus()
+		if err != nil {
+			t.Fatalf("GetStatus failed: %v", err)
+		}
+		if !status.Running || status.Paused != want {
+			t.Errorf("Expected running with paused=%v, got running=%v paused=%v", want, status.Running, status.Paused)
+		}
 	}
 
-	// Shutdown message was sent successfully
-	t.Log("Shutdown message sent successfully")
+	if err := c.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	paused(true)
+	if err := c.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	paused(false)
 
-	c.Close()
+	// A stop signal sent to the process counts as well
+	if err := c.SendSignal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("SendSignal failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	paused(true)
+	if err := c.SendSignal(syscall.SIGCONT); err != nil {
+		t.Fatalf("SendSignal failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	paused(false)
 }
 
-func TestReadMessages(t *testing.T) {
+func TestWaitDeadline(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"sh", "-c", "echo line1; echo line2; echo line3"},
+		Command:    []string{"sleep", "1"},
 		StdinMode:  daemon.StdinNull,
 		StdoutMode: daemon.IOModeLog,
 		StderrMode: daemon.IOModeLog,
@@ -481,54 +610,32 @@ func TestReadMessages(t *testing.T) {
 	}
 	defer c.Close()
 
-	// Attach to output
-	if attachErr := c.Attach(protocol.StreamBoth); attachErr != nil {
-		t.Fatalf("Attach failed: %v", attachErr)
-	}
-
-	var output bytes.Buffer
-	var exitCode int
-	exitReceived := false
-
-	err = c.ReadMessages(
-		func(stream byte, data []byte) error {
-			output.Write(data)
-			return nil
-		},
-		func(code int) {
-			exitCode = code
-			exitReceived = true
-		},
-	)
-
+	start := time.Now()
+	status, err := c.WaitUntil(start.Add(300*time.Millisecond), protocol.WaitTypeExit)
 	if err != nil {
-		t.Fatalf("ReadMessages failed: %v", err)
+		t.Fatalf("WaitUntil failed: %v", err)
 	}
-
-	if !exitReceived {
-		t.Fatal("Exit handler was not called")
+	if elapsed := time.Since(start); status != protocol.WaitStatusTimeout || elapsed < 250*time.Millisecond || elapsed > 800*time.Millisecond {
+		t.Errorf("Expected a timeout at the deadline, got status %d after %v", status, elapsed)
 	}
 
-	if exitCode != 0 {
-		t.Errorf("Expected exit code 0, got %d", exitCode)
+	// Without a timeout the wait lasts until the exit
+	status, err = c.Wait(0, protocol.WaitTypeExit)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
 	}
-
-	outputStr := output.String()
-	if len(outputStr) == 0 {
-		t.Error("Expected some output")
+	if status != protocol.WaitStatusCompleted {
+		t.Errorf("Expected WaitStatusCompleted, got %d", status)
 	}
-
-	t.Logf("Received output: %q", outputStr)
 }
 
-func TestReadMessagesWithError(t *testing.T) {
+func TestConcurrentWaits(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"sh", "-c", "echo test; sleep 0.1"},
-		StdinMode:  daemon.StdinNull,
-		StdoutMode: daemon.IOModeLog,
-		StderrMode: daemon.IOModeLog,
+		Command: []string{"bash", "--norc", "-i"},
+		UseVTY:  true,
 	}
 	_, socketPath := setupDaemon(t, config)
+	time.Sleep(200 * time.Millisecond)
 
 	c, err := Connect(socketPath)
 	if err != nil {
@@ -536,28 +643,91 @@ func TestReadMessagesWithError(t *testing.T) {
 	}
 	defer c.Close()
 
-	// Attach to output
-	if attachErr := c.Attach(protocol.StreamBoth); attachErr != nil {
-		t.Fatalf("Attach failed: %v", attachErr)
-	}
+	// Many clients wait at once, until the command is done
+	waitAll := func(waitType byte, command string) {
+		if err := c.WriteStdin([]byte(command)); err != nil {
+			t.Fatalf("WriteStdin failed: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := Connect(socketPath)
+				if err != nil {
+					t.Errorf("Connect failed: %v", err)
+					return
+				}
+				defer c.Close()
+				status, err := c.Wait(5, waitType)
+				if err != nil {
+					t.Errorf("Wait failed: %v", err)
+				} else if status != protocol.WaitStatusCompleted {
+					t.Errorf("Expected WaitStatusCompleted for wait type %d, got %d", waitType, status)
+				}
+			}()
+		}
+		wg.Wait()
 
-	// Output handler that returns an error
-	expectedErr := fmt.Errorf("test error")
-	err = c.ReadMessages(
-		func(stream byte, data []byte) error {
-			return expectedErr
-		},
-		nil,
-	)
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("Expected the waits of type %d to end with the command, took %v", waitType, elapsed)
+		}
+	}
+	waitAll(protocol.WaitTypeForeground, "sleep 0.6\n")
+	waitAll(protocol.WaitTypeExit, "sleep 0.6; exit\n")
+}
 
-	if err != expectedErr {
-		t.Errorf("Expected error %v, got %v", expectedErr, err)
+func TestWaitForPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		vty     bool
+		pattern string
+		status  byte
+	}{
+		{"printed before", "echo 'server: Ready'; sleep 5", false, `^server: Ready$`, protocol.WaitStatusCompleted},
+		{"printed later", "sleep 0.3; echo 'listening on port 8080' >&2; sleep 5", false, `port \d+`, protocol.WaitStatusCompleted},
+		{"split line", "printf 'Rea'; sleep 0.3; printf 'dy\\n'; sleep 5", false, `Ready`, protocol.WaitStatusCompleted},
+		{"prompt", "printf 'Password: '; sleep 5", false, `^Password: $`, protocol.WaitStatusCompleted},
+		{"screen", "sleep 0.3; printf '\\033[1mReady\\033[0m\\n'; sleep 5", true, `^Ready$`, protocol.WaitStatusCompleted},
+		{"exited", "echo done; sleep 0.5", false, `Ready`, protocol.WaitStatusNotApplicable},
+		{"timeout", "sleep 5", false, `Ready`, protocol.WaitStatusTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &daemon.Config{
+				Command:    []string{"sh", "-c", tt.command},
+				StdinMode:  daemon.StdinNull,
+				StdoutMode: daemon.IOModeLog,
+				StderrMode: daemon.IOModeLog,
+				UseVTY:     tt.vty,
+			}
+			_, socketPath := setupDaemon(t, config)
+			time.Sleep(100 * time.Millisecond)
+
+			c, err := Connect(socketPath)
+			if err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			defer c.Close()
+
+			status, err := c.WaitForPattern(1, tt.pattern)
+			if err != nil {
+				t.Fatalf("WaitForPattern failed: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, status)
+			}
+		})
 	}
 }
 
-func TestReadMessagesEOF(t *testing.T) {
+func TestWaitForPatternInvalid(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"true"},
+		Command:    []string{"sleep", "5"},
 		StdinMode:  daemon.StdinNull,
 		StdoutMode: daemon.IOModeLog,
 		StderrMode: daemon.IOModeLog,
@@ -570,105 +740,1212 @@ func TestReadMessagesEOF(t *testing.T) {
 	}
 	defer c.Close()
 
-	// Don't attach, just try to read messages
-	// Process will exit quickly and socket will close
-	time.Sleep(200 * time.Millisecond)
-
-	// Detach to trigger a clean close
-	c.Detach()
+	if _, err := c.WaitForPattern(1, "("); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("Expected an invalid pattern error, got %v", err)
+	}
+}
 
-	err = c.ReadMessages(nil, nil)
-	if err != nil {
-		// EOF is acceptable here
-		t.Logf("ReadMessages returned: %v", err)
+func TestWaitForQuiet(t *testing.T) {
+	const ticks = "i=0; while [ $i -lt 8 ]; do echo tick $i; sleep 0.05; i=$((i+1)); done; sleep 5"
+	const ticking = "i=0; while :; do echo tick $i; sleep 0.05; i=$((i+1)); done"
+	tests := []struct {
+		name    string
+		command string
+		vty     bool
+		screen  bool
+		status  byte
+	}{
+		{"idle", ticks, false, false, protocol.WaitStatusCompleted},
+		{"busy", ticking, false, false, protocol.WaitStatusTimeout},
+		{"stable", ticks, true, true, protocol.WaitStatusCompleted},
+		{"redrawing", ticking, true, true, protocol.WaitStatusTimeout},
+		{"no vty", "sleep 5", false, true, protocol.WaitStatusNotApplicable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &daemon.Config{
+				Command:    []string{"sh", "-c", tt.command},
+				StdinMode:  daemon.StdinNull,
+				StdoutMode: daemon.IOModeLog,
+				StderrMode: daemon.IOModeLog,
+				UseVTY:     tt.vty,
+			}
+			_, socketPath := setupDaemon(t, config)
+
+			c, err := Connect(socketPath)
+			if err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			defer c.Close()
+
+			wait := c.WaitForOutputIdle
+			if tt.screen {
+				wait = c.WaitForScreenStable
+			}
+			start := time.Now()
+			status, err := wait(2, 200*time.Millisecond)
+			if err != nil {
+				t.Fatalf("Wait failed: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, status)
+			}
+			if status == protocol.WaitStatusCompleted && time.Since(start) < 200*time.Millisecond {
+				t.Errorf("Expected the wait to last the quiet period, it took %v", time.Since(start))
+			}
+		})
 	}
 }
 
-func TestNew(t *testing.T) {
+func TestExpect(t *testing.T) {
+	// The first prompt is displayed before the rules are set
 	config := &daemon.Config{
-		Command:    []string{"sleep", "10"},
-		StdinMode:  daemon.StdinNull,
-		StdoutMode: daemon.IOModeLog,
-		StderrMode: daemon.IOModeLog,
+		Command: []string{"sh", "-c", "printf 'Password: '; read pw; echo \"got $pw\"; printf 'Continue? '; read a; echo \"answer $a\"; sleep 0.3"},
+		UseVTY:  true,
 	}
+	_, socketPath := setupDaemon(t, config)
+	time.Sleep(200 * time.Millisecond)
 
-	tmpDir := t.TempDir()
-	config.RuntimeDir = tmpDir
-
-	d, err := daemon.New(config)
+	c, err := Connect(socketPath)
 	if err != nil {
-		t.Fatalf("Failed to create daemon: %v", err)
+		t.Fatalf("Connect failed: %v", err)
 	}
+	defer c.Close()
 
-	if err := d.Start(); err != nil {
-		t.Fatalf("Failed to start daemon: %v", err)
+	matches, err := c.Expect([]protocol.ExpectRule{
+		{Pattern: `Password: $`, Send: "secret\n"},
+		{Pattern: `Continue\? $`, Send: "yes\n", Once: true},
+		{Pattern: `got \w+`},
+		{Pattern: `answer \w+`},
+	})
+	if err != nil {
+		t.Fatalf("Expect failed: %v", err)
+	}
+
+	var texts []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case match, ok := <-matches:
+			if !ok {
+				done = true
+				continue
+			}
+			texts = append(texts, fmt.Sprintf("%d:%s", match.Rule, match.Text))
+		case <-timeout:
+			t.Fatalf("Timed out, got matches %v", texts)
+		}
 	}
 
-	// Get the daemon PID
-	status := d.GetStatus()
-	if status == nil || status.PID == 0 {
-		t.Fatal("Failed to get daemon status")
+	want := []string{"0:Password: ", "2:got secret", "1:Continue? ", "3:answer yes"}
+	if !slices.Equal(texts, want) {
+		t.Errorf("Expected matches %v, got %v", want, texts)
 	}
+}
 
-	// Set environment variable for runtime directory discovery
-	oldXdgDir := os.Getenv("XDG_RUNTIME_DIR")
-	defer os.Setenv("XDG_RUNTIME_DIR", oldXdgDir)
-	os.Setenv("XDG_RUNTIME_DIR", "")
-
-	// Create symlink in /tmp for the PID
-	uid := os.Getuid()
-	bgrunDir := filepath.Join("/tmp", fmt.Sprintf(".bgrun-%d", uid))
-	if err := os.MkdirAll(bgrunDir, 0700); err != nil {
-		t.Fatalf("Failed to create bgrun dir: %v", err)
+func TestExpectInvalid(t *testing.T) {
+	config := &daemon.Config{
+		Command: []string{"sleep", "5"},
+		UseVTY:  true,
 	}
-	defer os.RemoveAll(bgrunDir)
+	_, socketPath := setupDaemon(t, config)
 
-	pidDir := filepath.Join(bgrunDir, fmt.Sprintf("%d", status.PID))
-	if err := os.Symlink(tmpDir, pidDir); err != nil {
-		t.Fatalf("Failed to create symlink: %v", err)
+	for _, pattern := range []string{"(", "x*"} {
+		c, err := Connect(socketPath)
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if _, err := c.Expect([]protocol.ExpectRule{{Pattern: pattern, Send: "x"}}); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+			t.Errorf("Expected an invalid pattern error for %q, got %v", pattern, err)
+		}
+		c.Close()
 	}
+}
 
-	// Wait for socket to be ready
-	socketPath := filepath.Join(tmpDir, "control.sock")
-	maxRetries := 50
-	for i := 0; i < maxRetries; i++ {
-		if _, err := os.Stat(socketPath); err == nil {
-			break
-		}
-		time.Sleep(10 * time.Millisecond)
+func TestAttachDetach(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "echo hello; sleep 1; echo world"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
 	}
+	_, socketPath := setupDaemon(t, config)
 
-	// Test New with the daemon PID
-	c, err := New(status.PID)
+	c, err := Connect(socketPath)
 	if err != nil {
-		t.Fatalf("New failed: %v", err)
+		t.Fatalf("Connect failed: %v", err)
 	}
 	defer c.Close()
 
-	// Verify we can get status through the new client
-	clientStatus, err := c.GetStatus()
-	if err != nil {
-		t.Fatalf("GetStatus failed: %v", err)
+	// Attach to stdout
+	if err := c.Attach(protocol.StreamStdout); err != nil {
+		t.Fatalf("Attach failed: %v", err)
 	}
 
-	if clientStatus.PID != status.PID {
-		t.Errorf("PID mismatch: expected %d, got %d", status.PID, clientStatus.PID)
+	// Detach
+	if err := c.Detach(); err != nil {
+		t.Fatalf("Detach failed: %v", err)
 	}
 
-	// Test New with non-existent PID
-	_, err = New(999999)
-	if err == nil {
-		t.Error("Expected error for non-existent PID")
-	}
+	t.Log("Attach/Detach succeeded")
 }
 
-func TestGetScreen(t *testing.T) {
+func TestAttachExclusive(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"bash", "-c", "echo 'Hello, World!'; sleep 10"},
+		Command:    []string{"cat"},
 		StdinMode:  daemon.StdinStream,
 		StdoutMode: daemon.IOModeLog,
 		StderrMode: daemon.IOModeLog,
-		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	var clients []*Client
+	for range 3 {
+		c, err := Connect(socketPath)
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	first, second, other := clients[0], clients[1], clients[2]
+
+	if err := first.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	// Wait for the attachment before taking it over
+	if _, err := first.GetStatus(); err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if err := second.AttachExclusive(protocol.StreamBoth); err != nil {
+		t.Fatalf("AttachExclusive failed: %v", err)
+	}
+	if err := first.ReadMessages(nil, nil); !errors.Is(err, ErrDetached) {
+		t.Fatalf("Expected ErrDetached, got %v", err)
+	}
+
+	status, err := other.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	exclusive := 0
+	for _, client := range status.Clients {
+		if client.Exclusive {
+			exclusive++
+			if !client.Attached {
+				t.Errorf("Expected the exclusive client to be attached: %+v", client)
+			}
+		} else if client.Attached {
+			t.Errorf("Expected only the exclusive client to be attached: %+v", client)
+		}
+	}
+	if exclusive != 1 {
+		t.Errorf("Expected one exclusive client, got %+v", status.Clients)
+	}
+
+	// The input of other clients is refused
+	if err := other.WriteStdin([]byte("refused\n")); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
+	}
+	if err := other.ReadMessages(nil, nil); err == nil || !strings.Contains(err.Error(), "attached exclusively") {
+		t.Fatalf("Expected the input to be refused, got %v", err)
+	}
+
+	// Until the exclusive client detaches, which the daemon handles on the
+	// connection of that client
+	if err := second.Detach(); err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := other.GetStatus()
+		if err != nil {
+			t.Fatalf("GetStatus failed: %v", err)
+		}
+		if !slices.ContainsFunc(status.Clients, func(c protocol.ClientStats) bool { return c.Exclusive }) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the exclusive client to detach, got %+v", status.Clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := first.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	// Wait for the attachment before writing
+	if _, err := first.GetStatus(); err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if err := other.WriteStdin([]byte("accepted\n")); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
+	}
+	errDone := errors.New("done")
+	var output bytes.Buffer
+	first.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = first.ReadMessages(func(stream byte, data []byte) error {
+		output.Write(data)
+		if strings.Contains(output.String(), "accepted\n") {
+			return errDone
+		}
+		return nil
+	}, nil)
+	if err != errDone {
+		t.Fatalf("Expected the input to be accepted, got %v after %q", err, output.String())
+	}
+	if strings.Contains(output.String(), "refused") {
+		t.Errorf("Expected the refused input to be dropped, got %q", output.String())
+	}
+}
+
+func TestAttachNotices(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+	other, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer other.Close()
+
+	notices := make(chan *protocol.Event, 10)
+	if err := c.SetNoticeHandler(func(ev *protocol.Event) { notices <- ev }); err != nil {
+		t.Fatalf("SetNoticeHandler failed: %v", err)
+	}
+	if err := c.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	// The resizes of the client itself are not notices
+	if err := c.Resize(30, 90); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	go c.ReadMessages(nil, nil)
+
+	if err := other.Resize(40, 120); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	if err := other.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	if err := other.Detach(); err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+
+	status, err := other.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	var id uint64
+	for _, client := range status.Clients {
+		if !client.Attached {
+			id = client.ID
+		}
+	}
+
+	want := []protocol.Event{
+		{Type: protocol.EventResized, Rows: 40, Cols: 120, Client: id},
+		{Type: protocol.EventAttached, Client: id},
+		{Type: protocol.EventDetached, Client: id},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-notices:
+			if ev.Type != w.Type || ev.Rows != w.Rows || ev.Cols != w.Cols || ev.Client != w.Client {
+				t.Errorf("Expected notice %+v, got %+v", w, *ev)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected notice %+v", w)
+		}
+	}
+	select {
+	case ev := <-notices:
+		t.Errorf("Unexpected notice %+v", *ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "60"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	// Send shutdown - should succeed
+	// Note: The shutdown handler calls os.Exit() which would terminate
+	// the test process, so we just verify the message is sent successfully
+	if err := c.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// Shutdown message was sent successfully
+	t.Log("Shutdown message sent successfully")
+
+	c.Close()
+}
+
+func TestReadMessages(t *testing.T) {
+	// The output is produced once the client attached and wrote to stdin
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "read go; echo line1; echo line2; echo line3"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Attach to output
+	if attachErr := c.Attach(protocol.StreamBoth); attachErr != nil {
+		t.Fatalf("Attach failed: %v", attachErr)
+	}
+	// The daemon handles the messages of a connection in order, so the
+	// attachment takes effect first
+	if err := c.WriteStdin([]byte("go\n")); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
+	}
+
+	var output bytes.Buffer
+	var exitCode int
+	exitReceived := false
+
+	err = c.ReadMessages(
+		func(stream byte, data []byte) error {
+			output.Write(data)
+			return nil
+		},
+		func(code int) {
+			exitCode = code
+			exitReceived = true
+		},
+	)
+
+	if err != nil {
+		t.Fatalf("ReadMessages failed: %v", err)
+	}
+
+	if !exitReceived {
+		t.Fatal("Exit handler was not called")
+	}
+
+	if exitCode != 0 {
+		t.Errorf("Expected exit code 0, got %d", exitCode)
+	}
+
+	if output.String() != "line1\nline2\nline3\n" {
+		t.Errorf("Expected the whole output, got %q", output.String())
+	}
+}
+
+func TestAttachFrom(t *testing.T) {
+	// Output produced before the clients attach, the process exiting later
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "echo one; echo two >&2; sleep 0.5; echo three"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+	time.Sleep(200 * time.Millisecond)
+
+	// Both clients attach before the process exits
+	attach := func(offset uint64, streams byte) *Client {
+		t.Helper()
+		c, err := Connect(socketPath)
+		if err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.AttachFrom(streams, offset); err != nil {
+			t.Fatalf("AttachFrom failed: %v", err)
+		}
+		return c
+	}
+	read := func(c *Client) string {
+		var output bytes.Buffer
+		if err := c.ReadMessages(func(stream byte, data []byte) error {
+			output.Write(data)
+			return nil
+		}, nil); err != nil {
+			t.Errorf("ReadMessages failed: %v", err)
+		}
+		return output.String()
+	}
+	all := attach(0, protocol.StreamBoth)
+	resumed := attach(2, protocol.StreamStdout)
+
+	// The output missed is replayed before the live output
+	if output := read(all); output != "one\ntwo\nthree\n" || all.OutputOffset() != 14 {
+		t.Errorf("Expected the whole output up to offset 14, got %q up to %d", output, all.OutputOffset())
+	}
+
+	// Resuming, for one stream
+	if output := read(resumed); output != "e\nthree\n" {
+		t.Errorf("Expected the stdout output from offset 2, got %q", output)
+	}
+}
+
+func TestAttachFromExpired(t *testing.T) {
+	// More output than the daemon holds
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "yes 0123456789abcdef | head -c 1200000; sleep 5"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+	time.Sleep(500 * time.Millisecond)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.AttachFrom(protocol.StreamBoth, 10); err != nil {
+		t.Fatalf("AttachFrom failed: %v", err)
+	}
+	err = c.ReadMessages(func(stream byte, data []byte) error { return nil }, nil)
+	if err == nil || !strings.Contains(err.Error(), "no longer held, the earliest available is ") {
+		t.Errorf("Expected the attachment refused with the earliest offset, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	config := &daemon.Config{
+		Command: []string{"sh", "-c", "sleep 0.5; printf '\\033]2;hello\\007'; sleep 0.5; exit 3"},
+		UseVTY:  true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+	events, err := c.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Another client resizes the terminal, attaches and detaches
+	other, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer other.Close()
+	if err := other.Resize(30, 100); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	if err := other.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	if err := other.Detach(); err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+
+	var types []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				done = true
+				continue
+			}
+			types = append(types, ev.Type)
+			switch ev.Type {
+			case protocol.EventStarted:
+				if ev.PID <= 0 {
+					t.Errorf("Expected the PID in the started event, got %+v", ev)
+				}
+			case protocol.EventResized:
+				if ev.Rows != 30 || ev.Cols != 100 {
+					t.Errorf("Expected a 100x30 terminal, got %+v", ev)
+				}
+			case protocol.EventTitle:
+				if ev.Title != "hello" {
+					t.Errorf("Expected the title hello, got %+v", ev)
+				}
+			case protocol.EventExited:
+				if ev.ExitCode == nil || *ev.ExitCode != 3 {
+					t.Errorf("Expected exit code 3, got %+v", ev)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for events, got %v", types)
+		}
+	}
+
+	expected := []string{
+		protocol.EventStarted, protocol.EventResized, protocol.EventAttached,
+		protocol.EventDetached, protocol.EventTitle, protocol.EventExited,
+	}
+	if !slices.Equal(types, expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+}
+
+// countingConn counts the bytes read from a connection
+type countingConn struct {
+	net.Conn
+	n int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestEnableCompression(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "seq 1 20000; sleep 0.5"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+	time.Sleep(200 * time.Millisecond)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.EnableCompression(); err != nil {
+		t.Fatalf("EnableCompression failed: %v", err)
+	}
+	conn := &countingConn{Conn: c.conn}
+	c.conn = conn
+	if err := c.AttachFrom(protocol.StreamBoth, 0); err != nil {
+		t.Fatalf("AttachFrom failed: %v", err)
+	}
+
+	var output bytes.Buffer
+	if err := c.ReadMessages(func(stream byte, data []byte) error {
+		output.Write(data)
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("ReadMessages failed: %v", err)
+	}
+
+	var expected strings.Builder
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(&expected, "%d\n", i)
+	}
+	if output.String() != expected.String() {
+		t.Fatalf("Expected the output of seq, got %d bytes", output.Len())
+	}
+	if conn.n > output.Len()/2 {
+		t.Errorf("Expected the output to be compressed, read %d bytes for %d", conn.n, output.Len())
+	}
+}
+
+func TestReadMessagesWithError(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "echo test; sleep 0.1"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Attach to output
+	if attachErr := c.Attach(protocol.StreamBoth); attachErr != nil {
+		t.Fatalf("Attach failed: %v", attachErr)
+	}
+
+	// Output handler that returns an error
+	expectedErr := fmt.Errorf("test error")
+	err = c.ReadMessages(
+		func(stream byte, data []byte) error {
+			return expectedErr
+		},
+		nil,
+	)
+
+	if err != expectedErr {
+		t.Errorf("Expected error %v, got %v", expectedErr, err)
+	}
+}
+
+func TestReadMessagesEOF(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"true"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Don't attach, just try to read messages
+	// Process will exit quickly and socket will close
+	time.Sleep(200 * time.Millisecond)
+
+	// Detach to trigger a clean close
+	c.Detach()
+
+	err = c.ReadMessages(nil, nil)
+	if err != nil {
+		// EOF is acceptable here
+		t.Logf("ReadMessages returned: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+
+	tmpDir := t.TempDir()
+	config.RuntimeDir = tmpDir
+
+	d, err := daemon.New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+
+	// Get the daemon PID
+	status := d.GetStatus()
+	if status == nil || status.PID == 0 {
+		t.Fatal("Failed to get daemon status")
+	}
+
+	// Set environment variable for runtime directory discovery
+	oldXdgDir := os.Getenv("XDG_RUNTIME_DIR")
+	defer os.Setenv("XDG_RUNTIME_DIR", oldXdgDir)
+	os.Setenv("XDG_RUNTIME_DIR", "")
+
+	// Create symlink in /tmp for the PID
+	uid := os.Getuid()
+	bgrunDir := filepath.Join("/tmp", fmt.Sprintf(".bgrun-%d", uid))
+	if err := os.MkdirAll(bgrunDir, 0700); err != nil {
+		t.Fatalf("Failed to create bgrun dir: %v", err)
+	}
+	defer os.RemoveAll(bgrunDir)
+
+	pidDir := filepath.Join(bgrunDir, fmt.Sprintf("%d", status.PID))
+	if err := os.Symlink(tmpDir, pidDir); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	// Wait for socket to be ready
+	socketPath := filepath.Join(tmpDir, "control.sock")
+	maxRetries := 50
+	for i := 0; i < maxRetries; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test New with the daemon PID
+	c, err := New(status.PID)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	// Verify we can get status through the new client
+	clientStatus, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+
+	if clientStatus.PID != status.PID {
+		t.Errorf("PID mismatch: expected %d, got %d", status.PID, clientStatus.PID)
+	}
+
+	// Test New with non-existent PID
+	_, err = New(999999)
+	if err == nil {
+		t.Error("Expected error for non-existent PID")
+	}
+}
+
+func TestGetScreen(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "echo 'Hello, World!'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to write output
+	time.Sleep(200 * time.Millisecond)
+
+	// Get screen content
+	screen, err := c.GetScreen()
+	if err != nil {
+		t.Fatalf("GetScreen failed: %v", err)
+	}
+
+	if screen == nil {
+		t.Fatal("GetScreen returned nil screen")
+	}
+
+	if screen.Rows != 24 {
+		t.Errorf("Expected 24 rows, got %d", screen.Rows)
+	}
+
+	if screen.Cols != 80 {
+		t.Errorf("Expected 80 cols, got %d", screen.Cols)
+	}
+
+	if len(screen.Lines) == 0 {
+		t.Error("Expected non-empty screen lines")
+	}
+
+	t.Logf("Screen content: %+v", screen)
+}
+
+func TestGetScreenCells(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf 'plain \\033[1;31mred\\033[0m \\033]8;;https://example.com\\007link\\033]8;;\\007'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	screen, err := c.GetScreenCells()
+	if err != nil {
+		t.Fatalf("GetScreenCells failed: %v", err)
+	}
+	if screen.Rows != 24 || screen.Cols != 80 || len(screen.Lines) != 24 {
+		t.Fatalf("Expected 24 lines of 80 columns, got %d lines, %dx%d", len(screen.Lines), screen.Rows, screen.Cols)
+	}
+	if screen.CursorRow != 0 || screen.CursorCol != 14 {
+		t.Errorf("Expected the cursor at 0,14, got %d,%d", screen.CursorRow, screen.CursorCol)
+	}
+
+	expected := []protocol.ScreenSpan{
+		{Text: "plain ", Fg: -1, Bg: -1},
+		{Text: "red", Fg: 1, Bg: -1, Bold: true},
+		{Text: " ", Fg: -1, Bg: -1},
+		{Text: "link", Fg: -1, Bg: -1, Link: "https://example.com"},
+	}
+	if !slices.Equal(screen.Lines[0].Spans, expected) {
+		t.Errorf("Expected spans %+v, got %+v", expected, screen.Lines[0].Spans)
+	}
+	if screen.Lines[1].Row != 1 || len(screen.Lines[1].Spans) != 0 {
+		t.Errorf("Expected an empty second line, got %+v", screen.Lines[1])
+	}
+}
+
+func TestGetScrollback(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "for i in $(seq 0 99); do printf '\\033[32mline\\033[0m %d\\n' $i; done; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// 100 lines and the cursor line on a 24 row screen leave 77 lines in
+	// the scrollback
+	page, err := c.GetScrollback(10, 5)
+	if err != nil {
+		t.Fatalf("GetScrollback failed: %v", err)
+	}
+	if page.Total != 77 || page.Offset != 10 || len(page.Lines) != 5 {
+		t.Fatalf("Expected 5 lines from 10 of 77, got %d from %d of %d", len(page.Lines), page.Offset, page.Total)
+	}
+	expected := []protocol.ScreenSpan{
+		{Text: "line", Fg: 2, Bg: -1},
+		{Text: " 10", Fg: -1, Bg: -1},
+	}
+	if page.Lines[0].Row != 10 || !slices.Equal(page.Lines[0].Spans, expected) {
+		t.Errorf("Expected line 10 with spans %+v, got %+v", expected, page.Lines[0])
+	}
+
+	// A negative offset counts from the end
+	page, err = c.GetScrollback(-2, 0)
+	if err != nil {
+		t.Fatalf("GetScrollback failed: %v", err)
+	}
+	if page.Offset != 75 || len(page.Lines) != 2 || page.Lines[1].Spans[1].Text != " 76" {
+		t.Errorf("Expected the last 2 lines, got %+v", page)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "echo ready; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	health, err := c.Health()
+	if err != nil {
+		t.Fatalf("Health failed: %v", err)
+	}
+	if !health.Healthy {
+		t.Errorf("Expected a healthy daemon, got %+v", health.Checks)
+	}
+	var names []string
+	for _, check := range health.Checks {
+		names = append(names, check.Name)
+	}
+	if expected := []string{"state_lock", "goroutines", "log_writer", "output_reader"}; !slices.Equal(names, expected) {
+		t.Errorf("Expected checks %v, got %v", expected, names)
+	}
+}
+
+func TestGetScreenWithoutVTY(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// GetScreen should fail without VTY
+	_, err = c.GetScreen()
+	if err == nil {
+		t.Error("Expected error when getting screen without VTY")
+	}
+}
+
+func TestGetTitle(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf '\\033]0;building project\\007'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to set its title
+	time.Sleep(200 * time.Millisecond)
+
+	title, err := c.GetTitle()
+	if err != nil {
+		t.Fatalf("GetTitle failed: %v", err)
+	}
+	if title.Title != "building project" || title.IconName != "building project" {
+		t.Errorf("Unexpected title response: %+v", title)
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if status.Title != "building project" {
+		t.Errorf("Expected title in status, got %q", status.Title)
+	}
+}
+
+func TestGetCommands(t *testing.T) {
+	marks := `\033]133;A\007$ \033]133;B\007make\r\n\033]133;C\007built\r\n\033]133;D;2\007`
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf '" + marks + "'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to write its marks
+	time.Sleep(200 * time.Millisecond)
+
+	commands, err := c.GetCommands()
+	if err != nil {
+		t.Fatalf("GetCommands failed: %v", err)
+	}
+	if len(commands) != 1 {
+		t.Fatalf("Expected 1 command, got %d", len(commands))
+	}
+	cmd := commands[0]
+	if cmd.Command != "make" || cmd.ExitCode == nil || *cmd.ExitCode != 2 || cmd.FinishedAt == nil {
+		t.Errorf("Unexpected command: %+v", cmd)
+	}
+
+	output, err := c.GetCommandOutput(-1, protocol.ExportFormatPlainText)
+	if err != nil {
+		t.Fatalf("GetCommandOutput failed: %v", err)
+	}
+	if output != "built\n" {
+		t.Errorf("Expected %q, got %q", "built\n", output)
+	}
+
+	if _, err := c.GetCommandOutput(1, protocol.ExportFormatPlainText); err == nil {
+		t.Error("Expected an error for an out of range command")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "echo starting; echo 'Listening on port 8080'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to write its output
+	time.Sleep(200 * time.Millisecond)
+
+	matches, err := c.Search(&protocol.SearchRequest{Pattern: `port (\d+)`})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	expected := []protocol.SearchMatch{{Row: 1, Col: 13, EndCol: 22, Text: "port 8080"}}
+	if !slices.Equal(matches, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, matches)
+	}
+
+	matches, err = c.Search(&protocol.SearchRequest{Pattern: "ready"})
+	if err != nil || len(matches) != 0 {
+		t.Errorf("Expected no matches, got %+v, %v", matches, err)
+	}
+
+	if _, err := c.Search(&protocol.SearchRequest{Pattern: "("}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestScreenUpdates(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", `echo ready; read line; printf '\033[1;31m%s\033[0m done\n' "$line"; sleep 10`},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to write its output
+	time.Sleep(200 * time.Millisecond)
+
+	if err := c.SubscribeScreen(); err != nil {
+		t.Fatalf("SubscribeScreen failed: %v", err)
+	}
+
+	// The first update is the whole screen, the next ones what changed
+	var updates []*protocol.ScreenUpdate
+	errDone := errors.New("done")
+	err = c.ReadScreenUpdates(func(update *protocol.ScreenUpdate) error {
+		updates = append(updates, update)
+		if len(updates) == 1 {
+			// The program echoes the line and colors it
+			c.WriteStdin([]byte("hello\n"))
+		}
+		for _, line := range update.Lines {
+			if len(line.Spans) > 1 && strings.Contains(line.Spans[1].Text, "done") {
+				return errDone
+			}
+		}
+		return nil
+	}, nil)
+	if !errors.Is(err, errDone) {
+		t.Fatalf("ReadScreenUpdates failed: %v", err)
+	}
+
+	full := updates[0]
+	if !full.Full || full.Rows != 24 || full.Cols != 80 || len(full.Lines) != 24 {
+		t.Fatalf("Unexpected first update: %+v", full)
+	}
+	if spans := full.Lines[0].Spans; len(spans) != 1 || spans[0].Text != "ready" || spans[0].Fg != -1 {
+		t.Errorf("Unexpected first line: %+v", spans)
+	}
+
+	last := updates[len(updates)-1]
+	if last.Full || len(last.Lines) >= 24 {
+		t.Errorf("Expected an incremental update, got %+v", last)
+	}
+	line := last.Lines[len(last.Lines)-1]
+	if line.Row != 2 || line.Spans[0].Text != "hello" || !line.Spans[0].Bold || line.Spans[0].Fg != 1 {
+		t.Errorf("Unexpected changed line: %+v", line)
+	}
+}
+
+func TestGetScreenInputModes(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf '\\033[?2004h\\033[?1h'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to set its modes
+	time.Sleep(200 * time.Millisecond)
+
+	screen, err := c.GetScreen()
+	if err != nil {
+		t.Fatalf("GetScreen failed: %v", err)
+	}
+
+	expected := protocol.InputModes{BracketedPaste: true, ApplicationCursor: true}
+	if screen.InputModes != expected {
+		t.Errorf("Expected input modes %+v, got %+v", expected, screen.InputModes)
+	}
+}
+
+func TestStrictVTY(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf '\\033[?1049hfull screen'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+		StrictVTY:  true,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	// Wait a bit for the process to switch screens
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := c.GetScreen(); err == nil || !strings.Contains(err.Error(), "CSI ?1049h") {
+		t.Errorf("Expected GetScreen to fail naming the sequence, got %v", err)
+	}
+	if _, err := c.ExportPlainText(false); err == nil {
+		t.Error("Expected export to fail in strict mode")
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if status.UnsupportedSequences["CSI ?1049h"] != 1 {
+		t.Errorf("Expected the alternate screen switch to be counted, got %v", status.UnsupportedSequences)
+	}
+}
+
+func TestRecording(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf 'before\\n'; sleep 0.3; printf 'after\\n'; sleep 10"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
 	}
 	_, socketPath := setupDaemon(t, config)
 
@@ -678,40 +1955,50 @@ func TestGetScreen(t *testing.T) {
 	}
 	defer c.Close()
 
-	// Wait a bit for the process to write output
-	time.Sleep(200 * time.Millisecond)
-
-	// Get screen content
-	screen, err := c.GetScreen()
-	if err != nil {
-		t.Fatalf("GetScreen failed: %v", err)
+	if _, err := c.GetRecording(); err == nil {
+		t.Error("Expected GetRecording to fail before recording")
 	}
 
-	if screen == nil {
-		t.Fatal("GetScreen returned nil screen")
+	// Start once the first line is displayed
+	time.Sleep(150 * time.Millisecond)
+	if err := c.StartRecording(); err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
 	}
-
-	if screen.Rows != 24 {
-		t.Errorf("Expected 24 rows, got %d", screen.Rows)
+	time.Sleep(300 * time.Millisecond)
+	if err := c.StopRecording(); err != nil {
+		t.Fatalf("StopRecording failed: %v", err)
 	}
 
-	if screen.Cols != 80 {
-		t.Errorf("Expected 80 cols, got %d", screen.Cols)
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
 	}
-
-	if len(screen.Lines) == 0 {
-		t.Error("Expected non-empty screen lines")
+	if status.Recording {
+		t.Error("Expected recording to be stopped")
 	}
 
-	t.Logf("Screen content: %+v", screen)
+	cast, err := c.GetRecording()
+	if err != nil {
+		t.Fatalf("GetRecording failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(cast), "\n"), "\n")
+	if !strings.HasPrefix(lines[0], `{"version":2,`) {
+		t.Errorf("Expected an asciinema v2 header, got %q", lines[0])
+	}
+	// The current screen comes first, then the new output
+	if len(lines) < 3 || !strings.Contains(lines[1], "before") || !strings.Contains(lines[len(lines)-1], "after") {
+		t.Errorf("Unexpected recording:\n%s", cast)
+	}
 }
 
-func TestGetScreenWithoutVTY(t *testing.T) {
+func TestTimeline(t *testing.T) {
 	config := &daemon.Config{
-		Command:    []string{"sleep", "10"},
-		StdinMode:  daemon.StdinNull,
+		Command:    []string{"bash", "-c", "printf '\\033]133;A\\007$ '; read line; echo \"got $line\"; exit 3"},
+		StdinMode:  daemon.StdinStream,
 		StdoutMode: daemon.IOModeLog,
 		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+		Record:     true,
 	}
 	_, socketPath := setupDaemon(t, config)
 
@@ -721,10 +2008,57 @@ func TestGetScreenWithoutVTY(t *testing.T) {
 	}
 	defer c.Close()
 
-	// GetScreen should fail without VTY
-	_, err = c.GetScreen()
-	if err == nil {
-		t.Error("Expected error when getting screen without VTY")
+	time.Sleep(150 * time.Millisecond)
+	if err := c.WriteStdin([]byte("hi\r")); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
+	}
+	if _, err := c.Wait(5, protocol.WaitTypeExit); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+
+	data, err := c.GetTimeline()
+	if err != nil {
+		t.Fatalf("GetTimeline failed: %v", err)
+	}
+	events, err := protocol.ParseTimeline(data)
+	if err != nil {
+		t.Fatalf("ParseTimeline failed: %v", err)
+	}
+
+	// The events come in the order they happened
+	var kinds []string
+	for _, ev := range events {
+		if len(kinds) == 0 || kinds[len(kinds)-1] != ev.Type {
+			kinds = append(kinds, ev.Type)
+		}
+	}
+	expected := []string{
+		protocol.TimelineStart,
+		protocol.TimelineOutput,
+		protocol.TimelineMark,
+		protocol.TimelineInput,
+		protocol.TimelineOutput,
+		protocol.TimelineExit,
+	}
+	if !slices.Equal(kinds, expected) {
+		t.Errorf("Expected events %v, got %s", expected, data)
+	}
+
+	for _, ev := range events {
+		switch ev.Type {
+		case protocol.TimelineMark:
+			if ev.Data != "A" {
+				t.Errorf("Expected mark A, got %q", ev.Data)
+			}
+		case protocol.TimelineInput:
+			if ev.Data != "hi\r" || ev.Client == 0 {
+				t.Errorf("Expected input from a client, got %+v", ev)
+			}
+		case protocol.TimelineExit:
+			if ev.ExitCode == nil || *ev.ExitCode != 3 {
+				t.Errorf("Expected exit code 3, got %+v", ev)
+			}
+		}
 	}
 }
 
@@ -783,3 +2117,402 @@ func TestGetScreenZombie(t *testing.T) {
 		t.Errorf("Expected ErrProcessTerminated, got %v", err)
 	}
 }
+
+func TestGetScreenStored(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf 'last words\\n\\033[?2004h> '"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+	}
+	d, _ := setupDaemon(t, config)
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	c, err := NewFromRuntimeDir(d.RuntimeDir())
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+	if !c.IsZombie() {
+		t.Fatal("Expected a terminated daemon")
+	}
+
+	// The last screen is restored from the saved terminal state
+	screen, err := c.GetScreen()
+	if err != nil {
+		t.Fatalf("GetScreen failed: %v", err)
+	}
+	if screen.Rows != 24 || screen.Cols != 80 || len(screen.Lines) != 24 {
+		t.Fatalf("Expected 24 lines of 80 columns, got %d lines, %dx%d", len(screen.Lines), screen.Rows, screen.Cols)
+	}
+	if strings.TrimRight(screen.Lines[0], " ") != "last words" || strings.TrimRight(screen.Lines[1], " ") != ">" {
+		t.Errorf("Unexpected screen %q", screen.Lines[:2])
+	}
+	if screen.CursorRow != 1 || screen.CursorCol != 2 || !screen.InputModes.BracketedPaste {
+		t.Errorf("Unexpected cursor %d,%d or input modes %+v", screen.CursorRow, screen.CursorCol, screen.InputModes)
+	}
+}
+
+func TestExportReplayed(t *testing.T) {
+	config := &daemon.Config{
+		Command:      []string{"printf", `\033[1mdone\033[0m\n`},
+		StdoutMode:   daemon.IOModeLog,
+		StderrMode:   daemon.IOModeLog,
+		ReplayScreen: true,
+	}
+	d, _ := setupDaemon(t, config)
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	c, err := NewFromRuntimeDir(d.RuntimeDir())
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+
+	// The output log is replayed through a terminal
+	output, err := c.ExportMarkdown(false)
+	if err != nil {
+		t.Fatalf("ExportMarkdown failed: %v", err)
+	}
+	if !strings.Contains(output, "**done**") {
+		t.Errorf("Expected bold text in the export, got %q", output)
+	}
+}
+
+func TestExportZombie(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sh", "-c", "seq 1500; printf '\\033[4mreport\\033[0m\\n'"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	d, _ := setupDaemon(t, config)
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	c, err := NewFromRuntimeDir(d.RuntimeDir())
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+
+	// The screen is not replayed without replay_screen, exports are
+	if _, err := c.GetScreen(); err != ErrProcessTerminated {
+		t.Errorf("Expected ErrProcessTerminated, got %v", err)
+	}
+	html, err := c.ExportHTML(false)
+	if err != nil {
+		t.Fatalf("ExportHTML failed: %v", err)
+	}
+	if !strings.Contains(html, "report</span>") {
+		t.Errorf("Expected the styled output in the export, got %q", html)
+	}
+
+	// The scrollback holds the whole output
+	resp, err := c.Export(&protocol.ExportRequest{
+		Format:            protocol.ExportFormatPlainText,
+		IncludeScrollback: true,
+		StartLine:         0,
+		EndLine:           2,
+	})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if resp.Content != "1\n2\n3\n" {
+		t.Errorf("Expected the first lines of the output, got %q", resp.Content)
+	}
+}
+
+func TestNewFromRuntimeDirZombie(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	status := protocol.StatusResponse{
+		PID:         4321,
+		ExitCode:    func() *int { code := 2; return &code }(),
+		StartedAt:   "2025-01-01T00:00:00Z",
+		Command:     []string{"false"},
+		PreviousRun: "/nonexistent/previous",
+	}
+	data, err := json.Marshal(&status)
+	if err != nil {
+		t.Fatalf("Failed to marshal status: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "status.json"), data, 0644); err != nil {
+		t.Fatalf("Failed to write status.json: %v", err)
+	}
+
+	c, err := NewFromRuntimeDir(tmpDir)
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+
+	if !c.IsZombie() {
+		t.Error("Expected zombie client")
+	}
+	if c.RuntimeDir() != tmpDir {
+		t.Errorf("Expected runtime dir %q, got %q", tmpDir, c.RuntimeDir())
+	}
+
+	got, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if got.PreviousRun != status.PreviousRun {
+		t.Errorf("Expected previous run %q, got %q", status.PreviousRun, got.PreviousRun)
+	}
+
+	if _, err := NewFromRuntimeDir(t.TempDir()); err == nil {
+		t.Error("Expected error for empty runtime dir")
+	}
+}
+
+func TestNewFromRuntimeDirCrashedDaemon(t *testing.T) {
+	// A daemon that died, leaving its socket and a status.json written
+	// while the process ran
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run true: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), strconv.Itoa(cmd.Process.Pid))
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "control.sock"))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := os.WriteFile(filepath.Join(dir, "status.json"), []byte(`{"pid":4321,"running":true}`), 0644); err != nil {
+		t.Fatalf("Failed to write status.json: %v", err)
+	}
+
+	c, err := NewFromRuntimeDir(dir)
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+
+	if !c.IsZombie() {
+		t.Error("Expected zombie client")
+	}
+	if status, err := c.GetStatus(); err != nil || status.PID != 4321 {
+		t.Errorf("Expected the last status written, got %+v (%v)", status, err)
+	}
+}
+
+func TestZombieEncryptedOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "status.json"), []byte(`{"pid":4321}`), 0644); err != nil {
+		t.Fatalf("Failed to write status.json: %v", err)
+	}
+	keyFile := filepath.Join(tmpDir, "log.key")
+	if err := os.WriteFile(keyFile, []byte("secret"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	config := fmt.Sprintf(`{"log_key_file":%q}`, keyFile)
+	if err := os.WriteFile(filepath.Join(tmpDir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config.json: %v", err)
+	}
+
+	store, err := storage.NewEncrypted(storage.Dir(tmpDir), []byte("secret"), "output.log")
+	if err != nil {
+		t.Fatalf("NewEncrypted failed: %v", err)
+	}
+	if err := store.WriteFile("output.log", []byte("sensitive output\n")); err != nil {
+		t.Fatalf("Failed to write output.log: %v", err)
+	}
+
+	// The key recorded in config.json is used transparently
+	c, err := NewFromRuntimeDir(tmpDir)
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	output, err := c.ReadOutput()
+	c.Close()
+	if err != nil || string(output) != "sensitive output\n" {
+		t.Errorf("Expected decrypted output, got %q (err=%v)", output, err)
+	}
+
+	// Without the key, reading fails instead of returning ciphertext
+	os.Remove(keyFile)
+	t.Setenv(storage.KeyEnv, "")
+	c, err = NewFromRuntimeDir(tmpDir)
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.ReadOutput(); err != storage.ErrEncrypted {
+		t.Errorf("Expected ErrEncrypted, got %v", err)
+	}
+}
+
+func TestNewCustomRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	runtimeDir := filepath.Join(t.TempDir(), "job")
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"true"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		RuntimeDir: runtimeDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	// The daemon is found by PID through its index entry
+	c, err := New(os.Getpid())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	if c.RuntimeDir() != runtimeDir {
+		t.Errorf("Expected runtime dir %s, got %s", runtimeDir, c.RuntimeDir())
+	}
+	if !c.IsZombie() {
+		t.Fatal("Expected a terminated daemon")
+	}
+
+	// Reaping removes both the runtime directory and the index entry
+	if _, err := c.Wait(0, protocol.WaitTypeExit); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(daemon.RuntimeRoot(), strconv.Itoa(os.Getpid()))); !os.IsNotExist(err) {
+		t.Errorf("Expected the index entry to be removed, got %v", err)
+	}
+	if _, err := New(os.Getpid()); !errors.Is(err, ErrNoSuchDaemon) {
+		t.Errorf("Expected ErrNoSuchDaemon after reaping, got %v", err)
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: daemon.IOModeNull,
+		StderrMode: daemon.IOModeNull,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	caps, err := c.GetCapabilities()
+	if err != nil {
+		t.Fatalf("GetCapabilities failed: %v", err)
+	}
+	if !caps.HasMessage(protocol.MsgExport) || !slices.Contains(caps.WaitTypes, "foreground") {
+		t.Errorf("Unexpected capabilities %+v", caps)
+	}
+
+	// A daemon that predates capabilities answers with an unknown message error
+	server, conn := net.Pipe()
+	defer server.Close()
+	go func() {
+		if _, err := protocol.ReadMessage(server); err == nil {
+			protocol.WriteError(server, fmt.Errorf("unknown message type: 0x%02X", byte(protocol.MsgCapabilities)))
+		}
+	}()
+	old := &Client{conn: conn}
+	if _, err := old.GetCapabilities(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	// The daemon answers a refused connection with UNAUTHORIZED, reading
+	// whatever the client sends
+	server, conn := net.Pipe()
+	defer server.Close()
+	go protocol.WriteMessage(server, protocol.MsgUnauthorized, []byte("uid 1001 is not allowed to control this daemon"))
+	go io.Copy(io.Discard, server)
+
+	c := &Client{conn: conn}
+	if _, err := c.GetStatus(); !errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "uid 1001") {
+		t.Errorf("Expected ErrUnauthorized with the reason, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"bash", "-c", "printf 'before\\n'; sleep 0.4; printf 'after\\n'"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		UseVTY:     true,
+		Record:     true,
+	}
+	d, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+	d.Wait()
+
+	replay := func(c *Client) string {
+		t.Helper()
+		var out bytes.Buffer
+		start := time.Now()
+		err := c.Replay(2, func(data []byte) error {
+			out.Write(data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("Expected the replay to take about 200ms at speed 2, took %v", elapsed)
+		}
+		return out.String()
+	}
+
+	// The process is gone but the daemon still drives the replay
+	if out := replay(c); !strings.Contains(out, "before") || !strings.Contains(out, "after") {
+		t.Errorf("Unexpected replay output %q", out)
+	}
+
+	// The connection is usable again afterwards
+	if _, err := c.GetStatus(); err != nil {
+		t.Errorf("GetStatus after replay failed: %v", err)
+	}
+	if err := c.Replay(-1, nil); err == nil {
+		t.Error("Expected a negative speed to be rejected")
+	}
+
+	// Once the daemon is gone, the recording is played from the storage
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+	zombie, err := NewFromRuntimeDir(d.RuntimeDir())
+	if err != nil {
+		t.Fatalf("NewFromRuntimeDir failed: %v", err)
+	}
+	defer zombie.Close()
+	if !zombie.IsZombie() {
+		t.Fatal("Expected a terminated daemon")
+	}
+	if out := replay(zombie); !strings.Contains(out, "after") {
+		t.Errorf("Unexpected stored replay output %q", out)
+	}
+}
@@ -0,0 +1,170 @@
+package bgclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/KarpelesLab/bgrun/registry"
+)
+
+// ErrAmbiguousName is returned by FindByName when several running daemons
+// match the name
+var ErrAmbiguousName = errors.New("several daemons match")
+
+// DaemonInfo describes a daemon found in the runtime roots
+type DaemonInfo struct {
+	PID        int      `json:"pid"`
+	RuntimeDir string   `json:"runtime_dir"`
+	Command    []string `json:"command"`
+	Running    bool     `json:"running"`        // the control socket exists
+	User       string   `json:"user,omitempty"` // owner of the daemon, listed by ListAllDaemons
+}
+
+// ListDaemons returns the daemons of the current user found in the runtime
+// roots, running or terminated, ordered by PID. They are read from the
+// registry of each root, pruned of the daemons that are gone; the runtime
+// directories are scanned in roots without a registry, written by older
+// daemons.
+func ListDaemons() ([]DaemonInfo, error) {
+	return listDaemons(runtimeRoots(), true)
+}
+
+// listDaemons lists the daemons of the runtime roots, pruning their
+// registry when the roots are owned
+func listDaemons(roots []string, owned bool) ([]DaemonInfo, error) {
+	seen := make(map[int]bool)
+	var daemons []DaemonInfo
+
+	for _, root := range roots {
+		reg := registry.Open(root)
+		var registered []registry.Entry
+		var err error
+		if owned {
+			registered, err = reg.Prune()
+		} else {
+			// Rewriting the registry would hand it to another user
+			registered, err = reg.Check()
+		}
+		if err == nil {
+			for _, e := range registered {
+				if seen[e.PID] {
+					continue
+				}
+				seen[e.PID] = true
+				daemons = append(daemons, DaemonInfo{PID: e.PID, RuntimeDir: e.RuntimeDir, Command: e.Command, Running: e.Running})
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read registry: %w", err)
+		}
+
+		entries, err := os.ReadDir(root)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read runtime root: %w", err)
+		}
+
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil || pid <= 0 || seen[pid] {
+				continue
+			}
+			dir := filepath.Join(root, entry.Name())
+			if target, err := os.Readlink(dir); err == nil && filepath.IsAbs(target) {
+				dir = target
+			}
+			info, ok := daemonInfo(pid, dir)
+			if !ok {
+				continue
+			}
+			seen[pid] = true
+			daemons = append(daemons, info)
+		}
+	}
+
+	slices.SortFunc(daemons, func(a, b DaemonInfo) int { return a.PID - b.PID })
+	return daemons, nil
+}
+
+// daemonInfo reads what a runtime directory tells about its daemon. The
+// command comes from config.json, written when the daemon starts.
+func daemonInfo(pid int, dir string) (DaemonInfo, bool) {
+	info := DaemonInfo{PID: pid, RuntimeDir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		if data, err = os.ReadFile(filepath.Join(dir, "status.json")); err != nil {
+			return info, false
+		}
+	}
+	var config struct {
+		Command []string `json:"command"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return info, false
+	}
+	info.Command = config.Command
+
+	if _, err := os.Stat(filepath.Join(dir, "control.sock")); err == nil {
+		info.Running = true
+	}
+	return info, true
+}
+
+// FindByName returns the PID of the daemon whose command is name, compared
+// with the base name of the program or with the whole command line. Running
+// daemons are preferred over terminated ones; ErrAmbiguousName is returned
+// if the choice is not unique.
+func FindByName(name string) (int, error) {
+	daemons, err := ListDaemons()
+	if err != nil {
+		return 0, err
+	}
+	d, err := FindDaemon(daemons, name)
+	return d.PID, err
+}
+
+// FindDaemon picks the daemon whose command is name among daemons, as
+// FindByName does
+func FindDaemon(daemons []DaemonInfo, name string) (DaemonInfo, error) {
+	var running, terminated []DaemonInfo
+	for _, d := range daemons {
+		if len(d.Command) == 0 {
+			continue
+		}
+		if filepath.Base(d.Command[0]) != name && strings.Join(d.Command, " ") != name {
+			continue
+		}
+		if d.Running {
+			running = append(running, d)
+		} else {
+			terminated = append(terminated, d)
+		}
+	}
+
+	matches := running
+	if len(matches) == 0 {
+		matches = terminated
+	}
+	switch len(matches) {
+	case 0:
+		return DaemonInfo{}, fmt.Errorf("%w: no daemon running %q", ErrNoSuchDaemon, name)
+	case 1:
+		return matches[0], nil
+	}
+
+	pids := make([]string, len(matches))
+	for i, d := range matches {
+		pids[i] = strconv.Itoa(d.PID)
+	}
+	return DaemonInfo{}, fmt.Errorf("%w %q: PIDs %s", ErrAmbiguousName, name, strings.Join(pids, ", "))
+}
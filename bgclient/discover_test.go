@@ -0,0 +1,228 @@
+package bgclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/registry"
+)
+
+func TestListDaemons(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	// Ignore the daemons of other tests running in parallel
+	defer func(root string) { tmpRuntimeRoot = root }(tmpRuntimeRoot)
+	tmpRuntimeRoot = t.TempDir()
+
+	runtimeDir := filepath.Join(t.TempDir(), "job")
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"/bin/sleep", "10"},
+		StdoutMode: daemon.IOModeNull,
+		StderrMode: daemon.IOModeNull,
+		RuntimeDir: runtimeDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	c, err := NewWithRetry(os.Getpid(), DefaultRetryPolicy)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	defer c.Shutdown()
+
+	daemons, err := ListDaemons()
+	if err != nil {
+		t.Fatalf("ListDaemons failed: %v", err)
+	}
+	if len(daemons) != 1 {
+		t.Fatalf("Expected 1 daemon, got %+v", daemons)
+	}
+	info := daemons[0]
+	if info.PID != os.Getpid() || info.RuntimeDir != runtimeDir || !info.Running {
+		t.Errorf("Unexpected daemon info %+v", info)
+	}
+
+	pid, err := FindByName("sleep")
+	if err != nil {
+		t.Fatalf("FindByName failed: %v", err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("Expected PID %d, got %d", os.Getpid(), pid)
+	}
+	if pid, err := FindByName("/bin/sleep 10"); err != nil || pid != os.Getpid() {
+		t.Errorf("Expected the full command line to match, got %d, %v", pid, err)
+	}
+	if _, err := FindByName("make"); !errors.Is(err, ErrNoSuchDaemon) {
+		t.Errorf("Expected ErrNoSuchDaemon, got %v", err)
+	}
+
+	// A terminated daemon with the same name does not make it ambiguous...
+	other := filepath.Join(daemon.RuntimeRoot(), "999999")
+	if err := os.MkdirAll(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.Open(daemon.RuntimeRoot())
+	entry := registry.Entry{PID: 999999, RuntimeDir: other, Command: []string{"sleep", "1"}}
+	if err := reg.Register(entry); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := FindByName("sleep"); err != nil || pid != os.Getpid() {
+		t.Errorf("Expected the running daemon to be preferred, got %d, %v", pid, err)
+	}
+
+	// ...but a second running one does
+	entry.PID, entry.Running = os.Getppid(), true
+	if err := reg.Register(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "control.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindByName("sleep"); !errors.Is(err, ErrAmbiguousName) {
+		t.Errorf("Expected ErrAmbiguousName, got %v", err)
+	}
+
+	// Entries of daemons that died or were cleaned up are pruned
+	if err := os.Remove(filepath.Join(other, "control.sock")); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := FindByName("sleep"); err != nil || pid != os.Getpid() {
+		t.Errorf("Expected the dead daemon to be ignored, got %d, %v", pid, err)
+	}
+	if err := os.RemoveAll(other); err != nil {
+		t.Fatal(err)
+	}
+	daemons, err = ListDaemons()
+	if err != nil || len(daemons) != 1 {
+		t.Fatalf("Expected the removed daemon to be pruned, got %+v (%v)", daemons, err)
+	}
+}
+
+func TestListDaemonsWithoutRegistry(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	defer func(root string) { tmpRuntimeRoot = root }(tmpRuntimeRoot)
+	tmpRuntimeRoot = t.TempDir()
+
+	// Runtime directories left by daemons predating the registry are scanned
+	dir := filepath.Join(daemon.RuntimeRoot(), "999999")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "status.json"), []byte(`{"command":["sleep","1"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daemons, err := ListDaemons()
+	if err != nil || len(daemons) != 1 || daemons[0].PID != 999999 || daemons[0].Running {
+		t.Errorf("Expected the terminated daemon, got %+v (%v)", daemons, err)
+	}
+}
+
+func TestProbeSessions(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	defer func(root string) { tmpRuntimeRoot = root }(tmpRuntimeRoot)
+	tmpRuntimeRoot = t.TempDir()
+
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"/bin/sleep", "10"},
+		StdoutMode: daemon.IOModeNull,
+		StderrMode: daemon.IOModeNull,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	c, err := NewWithRetry(os.Getpid(), DefaultRetryPolicy)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	defer c.Shutdown()
+
+	// A daemon that exited and left its status, and one that died
+	reg := registry.Open(daemon.RuntimeRoot())
+	zombie := filepath.Join(daemon.RuntimeRoot(), "999998")
+	if err := os.MkdirAll(zombie, 0700); err != nil {
+		t.Fatal(err)
+	}
+	status := `{"pid":5,"running":false,"exit_code":3,"started_at":"2026-01-01T10:00:00Z","ended_at":"2026-01-01T10:01:00Z","command":["make"]}`
+	if err := os.WriteFile(filepath.Join(zombie, "status.json"), []byte(status), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dead := filepath.Join(daemon.RuntimeRoot(), "999999")
+	if err := os.MkdirAll(dead, 0700); err != nil {
+		t.Fatal(err)
+	}
+	reg.Register(registry.Entry{PID: 999998, RuntimeDir: zombie, Command: []string{"/usr/bin/make"}})
+	reg.Register(registry.Entry{PID: 999999, RuntimeDir: dead, Command: []string{"top"}, Running: true})
+
+	sessions, err := ProbeSessions(time.Second)
+	if err != nil {
+		t.Fatalf("ProbeSessions failed: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", sessions)
+	}
+	if s := sessions[0]; s.PID != os.Getpid() || s.Name != "sleep" || s.State != SessionRunning || s.ProcessPID == 0 || s.StartedAt.IsZero() {
+		t.Errorf("Unexpected running session %+v", s)
+	}
+	if s := sessions[1]; s.Name != "make" || s.State != SessionZombie || s.ExitCode == nil || *s.ExitCode != 3 || s.Uptime != time.Minute {
+		t.Errorf("Unexpected zombie session %+v", s)
+	}
+	if s := sessions[2]; s.State != SessionDead || s.Error == "" {
+		t.Errorf("Unexpected dead session %+v", s)
+	}
+}
+
+func TestListAllDaemons(t *testing.T) {
+	if os.Geteuid() != 0 {
+		if _, err := ListAllDaemons(); !errors.Is(err, ErrNotRoot) {
+			t.Errorf("Expected ErrNotRoot, got %v", err)
+		}
+		t.Skip("listing the daemons of all users requires root")
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	defer func(root string) { tmpRuntimeRoot = root }(tmpRuntimeRoot)
+	tmpRuntimeRoot = t.TempDir()
+
+	// The runtime root of another user, with a daemon that died
+	users := t.TempDir()
+	defer func(roots []string) { userRuntimeRoots = roots }(userRuntimeRoots)
+	userRuntimeRoots = []string{filepath.Join(users, "*", "bgrun")}
+	root := filepath.Join(users, "1000", "bgrun")
+	dir := filepath.Join(root, "999999")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "control.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(root, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.Open(root)
+	if err := reg.Register(registry.Entry{PID: 999999, RuntimeDir: dir, Command: []string{"top"}, Running: true}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(reg.Path())
+
+	daemons, err := ListAllDaemons()
+	if err != nil {
+		t.Fatalf("ListAllDaemons failed: %v", err)
+	}
+	if len(daemons) != 1 || daemons[0].PID != 999999 || daemons[0].Running || daemons[0].User == "" {
+		t.Errorf("Unexpected daemons %+v", daemons)
+	}
+	if after, _ := os.ReadFile(reg.Path()); string(after) != string(before) {
+		t.Error("Expected the registry of the user to be left untouched")
+	}
+}
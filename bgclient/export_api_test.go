@@ -59,6 +59,18 @@ func TestExportAPI(t *testing.T) {
 		}
 	})
 
+	t.Run("ExportANSI", func(t *testing.T) {
+		content, err := c.ExportANSI(false)
+		if err != nil {
+			t.Fatalf("ExportANSI failed: %v", err)
+		}
+
+		// Should keep the OSC 8 link
+		if !strings.Contains(content, "\x1b]8;;https://github.com\x1b\\GitHub\x1b]8;;\x1b\\") {
+			t.Errorf("Expected OSC 8 link, got: %q", content)
+		}
+	})
+
 	t.Run("ExportHTML", func(t *testing.T) {
 		content, err := c.ExportHTML(false)
 		if err != nil {
@@ -0,0 +1,125 @@
+package bgclient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// DefaultHeartbeatInterval is the heartbeat interval of the attach commands
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// heartbeatMisses is the number of heartbeat intervals without a message
+// after which either end gives up on the other
+const heartbeatMisses = 3
+
+// ErrDaemonUnresponsive is returned by ReadMessages and ReadScreenUpdates
+// when the heartbeat is enabled and the daemon sent nothing, not even a
+// reply to a ping, for 3 heartbeat intervals
+var ErrDaemonUnresponsive = errors.New("daemon stopped responding")
+
+// Ping sends a ping to the daemon and returns the time its reply took, the
+// latency of the socket and of the daemon's message handling. It must not
+// be used while attached, use SetHeartbeat instead.
+func (c *Client) Ping() (time.Duration, error) {
+	return c.ping(c.heartbeatTimeout())
+}
+
+// ping sends a ping with an idle timeout and waits for the reply
+func (c *Client) ping(idleTimeout time.Duration) (time.Duration, error) {
+	if c.isZombie {
+		return 0, ErrProcessTerminated
+	}
+
+	start := time.Now()
+	if err := protocol.WritePing(c.conn, idleTimeout); err != nil {
+		return 0, fmt.Errorf("failed to send ping: %w", err)
+	}
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if msg.Type == protocol.MsgError {
+		if strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			return 0, ErrNotSupported
+		}
+		return 0, fmt.Errorf("server error: %s", string(msg.Payload))
+	}
+
+	if msg.Type != protocol.MsgPong {
+		return 0, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	return time.Since(start), nil
+}
+
+// SetHeartbeat makes ReadMessages and ReadScreenUpdates ping the daemon
+// every interval, so that a daemon gone silent is detected without waiting
+// for the next write: they fail with ErrDaemonUnresponsive after 3
+// intervals without any message. The daemon in turn drops the connection
+// after 3 intervals without a ping. An interval of 0 disables it.
+//
+// SetHeartbeat checks the daemon supports pings, returning ErrNotSupported
+// otherwise, and must be called before Attach or SubscribeScreen.
+func (c *Client) SetHeartbeat(interval time.Duration) error {
+	if _, err := c.ping(heartbeatMisses * interval); err != nil {
+		return err
+	}
+	c.heartbeat = interval
+	return nil
+}
+
+// heartbeatTimeout returns the idle timeout of the heartbeat, 0 when it is
+// disabled
+func (c *Client) heartbeatTimeout() time.Duration {
+	return heartbeatMisses * c.heartbeat
+}
+
+// startHeartbeat pings the daemon every heartbeat interval while a read
+// loop runs, returning the function stopping it
+func (c *Client) startHeartbeat() (stop func()) {
+	if c.heartbeat <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Whole messages are written at once, this does not
+				// interleave with the writes of other goroutines
+				if err := protocol.WritePing(c.conn, c.heartbeatTimeout()); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// readStreamed reads the next message of a read loop, failing with
+// ErrDaemonUnresponsive when the heartbeat gets no answer
+func (c *Client) readStreamed() (*protocol.Message, error) {
+	if c.heartbeat > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.heartbeatTimeout()))
+	}
+	msg, err := c.readMessage()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, ErrDaemonUnresponsive
+	}
+	return msg, err
+}
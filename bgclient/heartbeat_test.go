@@ -0,0 +1,125 @@
+package bgclient
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestPing(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	latency, err := c.Ping()
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if latency <= 0 || latency > time.Second {
+		t.Errorf("Expected a short positive latency, got %s", latency)
+	}
+
+	// With an idle timeout, the daemon drops the connection once the client
+	// goes silent
+	if _, err := c.ping(time.Second); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := protocol.ReadMessage(c.conn); !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected the connection to be dropped after a second, took %s", elapsed)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	config := &daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdinMode:  daemon.StdinNull,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+	}
+	_, socketPath := setupDaemon(t, config)
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.SetHeartbeat(20 * time.Millisecond); err != nil {
+		t.Fatalf("SetHeartbeat failed: %v", err)
+	}
+	if err := c.Attach(protocol.StreamBoth); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+
+	// A quiet process does not make the daemon look unresponsive, the pongs
+	// keep the connection alive
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.ReadMessages(nil, nil)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("Expected ReadMessages to keep running, got %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatUnresponsive(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	// A daemon answering the first ping, then wedged
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := protocol.ReadMessage(conn); err == nil {
+			protocol.WriteMessage(conn, protocol.MsgPong, nil)
+		}
+		time.Sleep(time.Second)
+	}()
+
+	c, err := Connect(socketPath)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.SetHeartbeat(20 * time.Millisecond); err != nil {
+		t.Fatalf("SetHeartbeat failed: %v", err)
+	}
+	start := time.Now()
+	if err := c.ReadMessages(nil, nil); !errors.Is(err, ErrDaemonUnresponsive) {
+		t.Fatalf("Expected ErrDaemonUnresponsive, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the daemon to be given up after 3 intervals, took %s", elapsed)
+	}
+}
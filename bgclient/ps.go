@@ -0,0 +1,117 @@
+package bgclient
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// States of a probed session
+const (
+	SessionRunning      = "running"      // the daemon answered, its process runs
+	SessionPaused       = "paused"       // the process group is stopped
+	SessionExited       = "exited"       // the daemon answered, its process exited
+	SessionZombie       = "zombie"       // the daemon is gone, its status.json is left to reap
+	SessionFailed       = "failed"       // the process could not be started
+	SessionUnresponsive = "unresponsive" // the control socket exists but the daemon did not answer
+	SessionDead         = "dead"         // the daemon died without leaving a status
+)
+
+// DefaultProbeTimeout is how long ProbeSessions waits for each daemon
+const DefaultProbeTimeout = 2 * time.Second
+
+// Session is a daemon listed by ProbeSessions, with the status its daemon
+// reported or the one it left
+type Session struct {
+	DaemonInfo
+	Name       string        `json:"name"`            // base name of the program
+	State      string        `json:"state"`           // see the Session constants
+	ProcessPID int           `json:"process_pid"`     // PID of the process run by the daemon
+	StartedAt  time.Time     `json:"started_at"`      // when the process started, zero if unknown
+	Uptime     time.Duration `json:"uptime"`          // time the process ran for
+	ExitCode   *int          `json:"exit_code"`       // exit code of a process that exited
+	Error      string        `json:"error,omitempty"` // why the daemon could not be probed or the process started
+}
+
+// ProbeSessions lists the daemons of the current user like ListDaemons and
+// asks each one for its status, in parallel, waiting at most timeout for
+// each. Terminated daemons are reported from the status they left and
+// flagged as zombies until reaped.
+func ProbeSessions(timeout time.Duration) ([]Session, error) {
+	daemons, err := ListDaemons()
+	if err != nil {
+		return nil, err
+	}
+	return Probe(daemons, timeout), nil
+}
+
+// Probe asks the daemons for their status like ProbeSessions, such as
+// those listed by ListAllDaemons
+func Probe(daemons []DaemonInfo, timeout time.Duration) []Session {
+	sessions := make([]Session, len(daemons))
+	var wg sync.WaitGroup
+	for i, info := range daemons {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions[i] = probe(info, timeout)
+		}()
+	}
+	wg.Wait()
+	return sessions
+}
+
+// probe gets the status of a daemon
+func probe(info DaemonInfo, timeout time.Duration) Session {
+	s := Session{DaemonInfo: info}
+	if len(info.Command) > 0 {
+		s.Name = filepath.Base(info.Command[0])
+	}
+
+	c, err := Open(info)
+	if err != nil {
+		s.State, s.Error = SessionDead, err.Error()
+		if info.Running {
+			s.State = SessionUnresponsive
+		}
+		return s
+	}
+	defer c.Close()
+	if c.conn != nil {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		s.State, s.Error = SessionUnresponsive, err.Error()
+		return s
+	}
+
+	s.ProcessPID = status.PID
+	s.ExitCode = status.ExitCode
+	s.Uptime = time.Duration(status.UptimeSecs) * time.Second
+	if t, err := time.Parse(time.RFC3339, status.StartedAt); err == nil {
+		s.StartedAt = t
+		if status.EndedAt != nil {
+			if end, err := time.Parse(time.RFC3339, *status.EndedAt); err == nil {
+				s.Uptime = end.Sub(t)
+			}
+		}
+	}
+
+	switch {
+	case status.State == protocol.StateFailedToStart:
+		s.State, s.Error = SessionFailed, status.StartError
+	case c.isZombie:
+		s.State = SessionZombie
+	case status.Paused:
+		s.State = SessionPaused
+	case status.Running:
+		s.State = SessionRunning
+	default:
+		s.State = SessionExited
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package bgclient
+
+import (
+	"errors"
+	"math/rand/v2"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy bounds the connection attempts of NewWithRetry. The delay
+// between attempts doubles from InitialDelay up to MaxDelay, with random
+// jitter so that many clients started together do not retry in lockstep.
+type RetryPolicy struct {
+	Attempts     int           // Total number of attempts, including the first
+	InitialDelay time.Duration // Delay before the second attempt
+	MaxDelay     time.Duration // Upper bound of the delay between attempts
+}
+
+// DefaultRetryPolicy waits up to about 3 seconds, which covers the startup
+// of a daemon launched with -background
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     12,
+	InitialDelay: 10 * time.Millisecond,
+	MaxDelay:     500 * time.Millisecond,
+}
+
+// NewWithRetry is like New but retries transient failures: ErrNotReady, and
+// ErrNoSuchDaemon while a process with that PID exists, since a daemon that
+// was just started may not have created its runtime directory yet. Other
+// errors are returned immediately. After the last attempt, the error of that
+// attempt is returned.
+func NewWithRetry(pid int, policy RetryPolicy) (*Client, error) {
+	transient := func(err error) bool {
+		if errors.Is(err, ErrNoSuchDaemon) {
+			return processExists(pid)
+		}
+		return errors.Is(err, ErrNotReady)
+	}
+	return retryConnect(policy, transient, func() (*Client, error) {
+		return New(pid)
+	})
+}
+
+// retryConnect calls connect until it succeeds, fails with an error that is
+// not transient or the policy is exhausted
+func retryConnect(policy RetryPolicy, transient func(error) bool, connect func() (*Client, error)) (*Client, error) {
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		c, err := connect()
+		if err == nil {
+			return c, nil
+		}
+		if attempt >= policy.Attempts || !transient(err) {
+			return nil, err
+		}
+
+		time.Sleep(jitter(delay))
+		delay = min(delay*2, policy.MaxDelay)
+	}
+}
+
+// processExists reports whether a process with the given PID is alive
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + rand.N(d-half)
+}
@@ -0,0 +1,81 @@
+package bgclient
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConnectErrors(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	if _, err := New(999999); !errors.Is(err, ErrNoSuchDaemon) {
+		t.Errorf("Expected ErrNoSuchDaemon, got %v", err)
+	}
+
+	// A runtime directory without socket nor status is a starting daemon
+	if _, err := NewFromRuntimeDir(t.TempDir()); !errors.Is(err, ErrNotReady) {
+		t.Errorf("Expected ErrNotReady, got %v", err)
+	}
+}
+
+func TestNewWithRetry(t *testing.T) {
+	xdgDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", xdgDir)
+
+	// The retried PID must be alive, as a freshly started daemon would be
+	pid := os.Getpid()
+	runtimeDir := filepath.Join(xdgDir, "bgrun", strconv.Itoa(pid))
+
+	// Simulate a daemon that creates its runtime directory, then its socket
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+			t.Errorf("Failed to create runtime dir: %v", err)
+			close(listening)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("unix", filepath.Join(runtimeDir, "control.sock"))
+		if err != nil {
+			t.Errorf("Failed to listen: %v", err)
+			close(listening)
+			return
+		}
+		listening <- l
+	}()
+
+	c, err := NewWithRetry(pid, DefaultRetryPolicy)
+	if err != nil {
+		t.Fatalf("NewWithRetry failed: %v", err)
+	}
+	c.Close()
+
+	if l := <-listening; l != nil {
+		l.Close()
+	}
+
+	// Retries are bounded
+	start := time.Now()
+	policy := RetryPolicy{Attempts: 3, InitialDelay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond}
+	if _, err := NewWithRetry(os.Getppid(), policy); !errors.Is(err, ErrNoSuchDaemon) {
+		t.Errorf("Expected ErrNoSuchDaemon, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 2 bounded retries, took %v", elapsed)
+	}
+
+	// A PID without process is not retried
+	start = time.Now()
+	if _, err := NewWithRetry(999997, policy); !errors.Is(err, ErrNoSuchDaemon) {
+		t.Errorf("Expected ErrNoSuchDaemon, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("Expected no retry for a dead PID, took %v", elapsed)
+	}
+}
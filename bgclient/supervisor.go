@@ -0,0 +1,84 @@
+package bgclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// SupervisorSocket returns the control socket of a bgrund supervisor run
+// with the default runtime directory
+func SupervisorSocket() string {
+	return filepath.Join(runtimeRoots()[0], "bgrund", "control.sock")
+}
+
+// JobControl sends req to the supervisor listening on socketPath, returning
+// the state of the jobs concerned once the action is done
+func JobControl(socketPath string, req *protocol.JobRequest) ([]protocol.JobState, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to supervisor: %w", err)
+	}
+	defer conn.Close()
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.WriteMessage(conn, protocol.MsgJobControl, payload); err != nil {
+		return nil, fmt.Errorf("failed to send job request: %w", err)
+	}
+	return readJobResponse(conn)
+}
+
+// ConnectJob connects to the daemon of a job of the supervisor listening
+// on socketPath. The client works as one connected to the control socket of
+// the daemon; the process of a job that exited is reached through the
+// daemon of its last run, kept until the job is started again.
+func ConnectJob(socketPath, name string) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to supervisor: %w", err)
+	}
+
+	if err := protocol.WriteMessage(conn, protocol.MsgSelectJob, []byte(name)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to select job: %w", err)
+	}
+	jobs, err := readJobResponse(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(jobs) != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected job response for %s", name)
+	}
+
+	return &Client{conn: conn, pid: jobs[0].PID, runtimeDir: jobs[0].RuntimeDir, storage: runStorage(jobs[0].RuntimeDir)}, nil
+}
+
+// readJobResponse reads the JOB_RESPONSE answering a supervisor request
+func readJobResponse(conn net.Conn) ([]protocol.JobState, error) {
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	switch msg.Type {
+	case protocol.MsgJobResponse:
+	case protocol.MsgError:
+		return nil, fmt.Errorf("supervisor error: %s", string(msg.Payload))
+	default:
+		return nil, fmt.Errorf("unexpected response type: 0x%02X", msg.Type)
+	}
+
+	var resp protocol.JobResponse
+	if err := json.Unmarshal(msg.Payload, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse job response: %w", err)
+	}
+	return resp.Jobs, nil
+}
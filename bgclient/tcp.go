@@ -0,0 +1,47 @@
+package bgclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// DialTCP connects over TLS to a daemon listening on TCP (see
+// daemon.Config.ListenTCP). config must hold the client certificate the
+// daemon requires and, unless a system CA signed the certificate of the
+// daemon, its CA in RootCAs.
+func DialTCP(addr string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	return &Client{conn: conn}, nil
+}
+
+// LoadTLSConfig builds a configuration for DialTCP from PEM files: the
+// client certificate and its key, and the CA the certificate of the daemon
+// is checked against (the system CAs if caFile is empty)
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	return config, nil
+}
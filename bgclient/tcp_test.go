@@ -0,0 +1,147 @@
+package bgclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+)
+
+// testCA issues the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.issue(t, "ca", nil)
+	return ca
+}
+
+// issue writes name.pem and name.key, a certificate signed by the CA (self
+// signed for the CA itself when ca.cert is nil)
+func (ca *testCA) issue(t *testing.T, name string, ips []net.IP) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  ips,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca.cert == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(ca.dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(ca.dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key
+}
+
+func TestDialTCP(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	ca.issue(t, "daemon", []net.IP{net.IPv4(127, 0, 0, 1)})
+	ca.issue(t, "alice", nil)
+	rogue := newTestCA(t, t.TempDir())
+	rogue.issue(t, "mallory", nil)
+
+	config := &daemon.Config{
+		Command:         []string{"sleep", "5"},
+		StdoutMode:      daemon.IOModeLog,
+		StderrMode:      daemon.IOModeLog,
+		ListenTCP:       "127.0.0.1:0",
+		TLSCertFile:     filepath.Join(dir, "daemon.pem"),
+		TLSKeyFile:      filepath.Join(dir, "daemon.key"),
+		TLSClientCAFile: filepath.Join(dir, "ca.pem"),
+		Permissions:     daemon.PermObserve,
+	}
+	d, socketPath := setupDaemon(t, config)
+	defer func() {
+		if local, err := Connect(socketPath); err == nil {
+			local.SendSignal(syscall.SIGKILL)
+			local.Close()
+		}
+		d.Wait()
+	}()
+	addr := d.TCPAddr().String()
+
+	tlsConfig, err := LoadTLSConfig(filepath.Join(dir, "alice.pem"), filepath.Join(dir, "alice.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+	c, err := DialTCP(addr, tlsConfig)
+	if err != nil {
+		t.Fatalf("DialTCP failed: %v", err)
+	}
+	defer c.Close()
+
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if !status.Running || len(status.Clients) != 1 || !strings.HasPrefix(status.Clients[0].Remote, "alice@127.0.0.1:") {
+		t.Errorf("Expected the status to list the client as alice, got %+v", status.Clients)
+	}
+
+	// Remote clients get the permissions of other users
+	if err := c.SendSignal(syscall.SIGTERM); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected the signal to be denied, got %v", err)
+	}
+
+	// A certificate of another CA is refused
+	rogueConfig, err := LoadTLSConfig(filepath.Join(rogue.dir, "mallory.pem"), filepath.Join(rogue.dir, "mallory.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("LoadTLSConfig failed: %v", err)
+	}
+	if rc, err := DialTCP(addr, rogueConfig); err == nil {
+		_, err = rc.GetStatus()
+		rc.Close()
+		if err == nil {
+			t.Error("Expected a client certificate of another CA to be refused")
+		}
+	}
+
+	// So is a client without certificate
+	tlsConfig.Certificates = nil
+	if rc, err := DialTCP(addr, tlsConfig); err == nil {
+		_, err = rc.GetStatus()
+		rc.Close()
+		if err == nil {
+			t.Error("Expected a client without certificate to be refused")
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Command bgrpc is a gateway serving the gRPC Control service (see
+// bgrpc/control.proto) for the bgrun daemons of the current user, so that
+// programs in any language can drive them:
+//
+//	bgrpc -listen unix:$XDG_RUNTIME_DIR/bgrpc.sock
+//
+// Over TCP it requires mutual TLS, as the daemons themselves do, and its
+// callers may only observe the daemons unless -permissions grants more.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/KarpelesLab/bgrun/bgrpc"
+	"github.com/KarpelesLab/bgrun/control"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
+)
+
+var (
+	listenFlag = flag.String("listen", "", "address to serve on: unix:<path>, or host:port with TLS")
+	pidFlag    = flag.Int("pid", 0, "PID of the daemon of requests without a target")
+	nameFlag   = flag.String("name", "", "command name of the daemon of requests without a target")
+	socketFlag = flag.String("socket", "", "control socket of the daemon of requests without a target")
+	certFlag   = flag.String("tls-cert", "", "PEM server certificate, for a TCP address")
+	keyFlag    = flag.String("tls-key", "", "PEM private key of the server certificate")
+	caFlag     = flag.String("tls-client-ca", "", "PEM CA the client certificates must be signed by")
+	permsFlag  = flag.String("permissions", "", "what callers may do: comma-separated observe, stdin, signal, shutdown or all (default: all on a Unix socket, observe over TCP)")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bgrpc -listen <unix:path | host:port> [options]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Serves the gRPC Control service for the bgrun daemons of the current user.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	flag.PrintDefaults()
+}
+
+func run() error {
+	if *listenFlag == "" {
+		return errors.New("-listen is required")
+	}
+
+	var opts []grpc.ServerOption
+	var ln net.Listener
+	var perms daemon.Permissions
+	var err error
+	if *permsFlag != "" {
+		if perms, err = daemon.ParsePermissions(*permsFlag); err != nil {
+			return err
+		}
+	}
+	if path, ok := strings.CutPrefix(*listenFlag, "unix:"); ok {
+		os.Remove(path)
+		ln, err = net.Listen("unix", path)
+		if err == nil {
+			// Only the user may drive their daemons
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		var tlsConfig *tls.Config
+		tlsConfig, err = loadTLSConfig()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		// The daemons see the gateway as their own user, so the callers
+		// are restricted here
+		if perms == 0 {
+			perms = daemon.PermObserve
+		}
+		ln, err = net.Listen("tcp", *listenFlag)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", *listenFlag, err)
+	}
+
+	server := grpc.NewServer(opts...)
+	bgrpc.RegisterControlServer(server, &bgrpc.Server{
+		Default:     control.Target{PID: *pidFlag, Name: *nameFlag, Socket: *socketFlag},
+		Permissions: perms,
+	})
+	// Let tools such as grpcurl discover the service
+	reflection.Register(server)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		server.GracefulStop()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving gRPC on %s\n", ln.Addr())
+	return server.Serve(ln)
+}
+
+// loadTLSConfig loads the server certificate and the CA of the clients;
+// TCP clients must present a certificate
+func loadTLSConfig() (*tls.Config, error) {
+	if *certFlag == "" || *keyFlag == "" || *caFlag == "" {
+		return nil, errors.New("a TCP address requires -tls-cert, -tls-key and -tls-client-ca")
+	}
+	cert, err := tls.LoadX509KeyPair(*certFlag, *keyFlag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	pem, err := os.ReadFile(*caFlag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", *caFlag)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,1236 @@
+// Control service of bgrun, for programs in any language. It maps to the
+// control protocol of the daemon (see PROTOCOL.md), the cmd/bgrpc gateway
+// translating calls to it.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: control.proto
+
+package bgrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Stream int32
+
+const (
+	Stream_STREAM_BOTH   Stream = 0 // both streams, when streaming output
+	Stream_STREAM_STDOUT Stream = 1
+	Stream_STREAM_STDERR Stream = 2
+)
+
+// Enum value maps for Stream.
+var (
+	Stream_name = map[int32]string{
+		0: "STREAM_BOTH",
+		1: "STREAM_STDOUT",
+		2: "STREAM_STDERR",
+	}
+	Stream_value = map[string]int32{
+		"STREAM_BOTH":   0,
+		"STREAM_STDOUT": 1,
+		"STREAM_STDERR": 2,
+	}
+)
+
+func (x Stream) Enum() *Stream {
+	p := new(Stream)
+	*p = x
+	return p
+}
+
+func (x Stream) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Stream) Descriptor() protoreflect.EnumDescriptor {
+	return file_control_proto_enumTypes[0].Descriptor()
+}
+
+func (Stream) Type() protoreflect.EnumType {
+	return &file_control_proto_enumTypes[0]
+}
+
+func (x Stream) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Stream.Descriptor instead.
+func (Stream) EnumDescriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{0}
+}
+
+type WaitType int32
+
+const (
+	WaitType_WAIT_TYPE_EXIT          WaitType = 0
+	WaitType_WAIT_TYPE_FOREGROUND    WaitType = 1
+	WaitType_WAIT_TYPE_PATTERN       WaitType = 2
+	WaitType_WAIT_TYPE_OUTPUT_IDLE   WaitType = 3
+	WaitType_WAIT_TYPE_SCREEN_STABLE WaitType = 4
+)
+
+// Enum value maps for WaitType.
+var (
+	WaitType_name = map[int32]string{
+		0: "WAIT_TYPE_EXIT",
+		1: "WAIT_TYPE_FOREGROUND",
+		2: "WAIT_TYPE_PATTERN",
+		3: "WAIT_TYPE_OUTPUT_IDLE",
+		4: "WAIT_TYPE_SCREEN_STABLE",
+	}
+	WaitType_value = map[string]int32{
+		"WAIT_TYPE_EXIT":          0,
+		"WAIT_TYPE_FOREGROUND":    1,
+		"WAIT_TYPE_PATTERN":       2,
+		"WAIT_TYPE_OUTPUT_IDLE":   3,
+		"WAIT_TYPE_SCREEN_STABLE": 4,
+	}
+)
+
+func (x WaitType) Enum() *WaitType {
+	p := new(WaitType)
+	*p = x
+	return p
+}
+
+func (x WaitType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (WaitType) Descriptor() protoreflect.EnumDescriptor {
+	return file_control_proto_enumTypes[1].Descriptor()
+}
+
+func (WaitType) Type() protoreflect.EnumType {
+	return &file_control_proto_enumTypes[1]
+}
+
+func (x WaitType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use WaitType.Descriptor instead.
+func (WaitType) EnumDescriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{1}
+}
+
+type WaitStatus int32
+
+const (
+	WaitStatus_WAIT_STATUS_COMPLETED      WaitStatus = 0
+	WaitStatus_WAIT_STATUS_TIMEOUT        WaitStatus = 1
+	WaitStatus_WAIT_STATUS_NOT_APPLICABLE WaitStatus = 2
+)
+
+// Enum value maps for WaitStatus.
+var (
+	WaitStatus_name = map[int32]string{
+		0: "WAIT_STATUS_COMPLETED",
+		1: "WAIT_STATUS_TIMEOUT",
+		2: "WAIT_STATUS_NOT_APPLICABLE",
+	}
+	WaitStatus_value = map[string]int32{
+		"WAIT_STATUS_COMPLETED":      0,
+		"WAIT_STATUS_TIMEOUT":        1,
+		"WAIT_STATUS_NOT_APPLICABLE": 2,
+	}
+)
+
+func (x WaitStatus) Enum() *WaitStatus {
+	p := new(WaitStatus)
+	*p = x
+	return p
+}
+
+func (x WaitStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (WaitStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_control_proto_enumTypes[2].Descriptor()
+}
+
+func (WaitStatus) Type() protoreflect.EnumType {
+	return &file_control_proto_enumTypes[2]
+}
+
+func (x WaitStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use WaitStatus.Descriptor instead.
+func (WaitStatus) EnumDescriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{2}
+}
+
+type ExportFormat int32
+
+const (
+	ExportFormat_EXPORT_FORMAT_TEXT     ExportFormat = 0
+	ExportFormat_EXPORT_FORMAT_MARKDOWN ExportFormat = 1
+	ExportFormat_EXPORT_FORMAT_HTML     ExportFormat = 2
+	ExportFormat_EXPORT_FORMAT_ANSI     ExportFormat = 3
+)
+
+// Enum value maps for ExportFormat.
+var (
+	ExportFormat_name = map[int32]string{
+		0: "EXPORT_FORMAT_TEXT",
+		1: "EXPORT_FORMAT_MARKDOWN",
+		2: "EXPORT_FORMAT_HTML",
+		3: "EXPORT_FORMAT_ANSI",
+	}
+	ExportFormat_value = map[string]int32{
+		"EXPORT_FORMAT_TEXT":     0,
+		"EXPORT_FORMAT_MARKDOWN": 1,
+		"EXPORT_FORMAT_HTML":     2,
+		"EXPORT_FORMAT_ANSI":     3,
+	}
+)
+
+func (x ExportFormat) Enum() *ExportFormat {
+	p := new(ExportFormat)
+	*p = x
+	return p
+}
+
+func (x ExportFormat) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ExportFormat) Descriptor() protoreflect.EnumDescriptor {
+	return file_control_proto_enumTypes[3].Descriptor()
+}
+
+func (ExportFormat) Type() protoreflect.EnumType {
+	return &file_control_proto_enumTypes[3]
+}
+
+func (x ExportFormat) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ExportFormat.Descriptor instead.
+func (ExportFormat) EnumDescriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{3}
+}
+
+// Target designates the daemon. When unset, the daemon the gateway was
+// started for is used.
+type Target struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Daemon:
+	//
+	//	*Target_Pid
+	//	*Target_Name
+	//	*Target_Socket
+	Daemon        isTarget_Daemon `protobuf_oneof:"daemon"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Target) Reset() {
+	*x = Target{}
+	mi := &file_control_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Target) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Target) ProtoMessage() {}
+
+func (x *Target) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Target.ProtoReflect.Descriptor instead.
+func (*Target) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Target) GetDaemon() isTarget_Daemon {
+	if x != nil {
+		return x.Daemon
+	}
+	return nil
+}
+
+func (x *Target) GetPid() int32 {
+	if x != nil {
+		if x, ok := x.Daemon.(*Target_Pid); ok {
+			return x.Pid
+		}
+	}
+	return 0
+}
+
+func (x *Target) GetName() string {
+	if x != nil {
+		if x, ok := x.Daemon.(*Target_Name); ok {
+			return x.Name
+		}
+	}
+	return ""
+}
+
+func (x *Target) GetSocket() string {
+	if x != nil {
+		if x, ok := x.Daemon.(*Target_Socket); ok {
+			return x.Socket
+		}
+	}
+	return ""
+}
+
+type isTarget_Daemon interface {
+	isTarget_Daemon()
+}
+
+type Target_Pid struct {
+	Pid int32 `protobuf:"varint,1,opt,name=pid,proto3,oneof"` // PID of the daemon
+}
+
+type Target_Name struct {
+	Name string `protobuf:"bytes,2,opt,name=name,proto3,oneof"` // command of the daemon, as listed by bgctl list
+}
+
+type Target_Socket struct {
+	Socket string `protobuf:"bytes,3,opt,name=socket,proto3,oneof"` // path of the control socket
+}
+
+func (*Target_Pid) isTarget_Daemon() {}
+
+func (*Target_Name) isTarget_Daemon() {}
+
+func (*Target_Socket) isTarget_Daemon() {}
+
+type StatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusRequest) Reset() {
+	*x = StatusRequest{}
+	mi := &file_control_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusRequest) ProtoMessage() {}
+
+func (x *StatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusRequest.ProtoReflect.Descriptor instead.
+func (*StatusRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StatusRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+type StatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Pid           int32                  `protobuf:"varint,1,opt,name=pid,proto3" json:"pid,omitempty"`
+	State         string                 `protobuf:"bytes,2,opt,name=state,proto3" json:"state,omitempty"` // running, exited or failed_to_start
+	Running       bool                   `protobuf:"varint,3,opt,name=running,proto3" json:"running,omitempty"`
+	ExitCode      *int32                 `protobuf:"varint,4,opt,name=exit_code,json=exitCode,proto3,oneof" json:"exit_code,omitempty"`
+	StartedAt     string                 `protobuf:"bytes,5,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"` // RFC 3339
+	EndedAt       *string                `protobuf:"bytes,6,opt,name=ended_at,json=endedAt,proto3,oneof" json:"ended_at,omitempty"`
+	Command       []string               `protobuf:"bytes,7,rep,name=command,proto3" json:"command,omitempty"`
+	HasVty        bool                   `protobuf:"varint,8,opt,name=has_vty,json=hasVty,proto3" json:"has_vty,omitempty"`
+	Paused        bool                   `protobuf:"varint,9,opt,name=paused,proto3" json:"paused,omitempty"`
+	Title         string                 `protobuf:"bytes,10,opt,name=title,proto3" json:"title,omitempty"`
+	StartError    string                 `protobuf:"bytes,11,opt,name=start_error,json=startError,proto3" json:"start_error,omitempty"`
+	UptimeSecs    int64                  `protobuf:"varint,12,opt,name=uptime_secs,json=uptimeSecs,proto3" json:"uptime_secs,omitempty"`
+	OutputBytes   uint64                 `protobuf:"varint,13,opt,name=output_bytes,json=outputBytes,proto3" json:"output_bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusResponse) Reset() {
+	*x = StatusResponse{}
+	mi := &file_control_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusResponse) ProtoMessage() {}
+
+func (x *StatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusResponse.ProtoReflect.Descriptor instead.
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StatusResponse) GetPid() int32 {
+	if x != nil {
+		return x.Pid
+	}
+	return 0
+}
+
+func (x *StatusResponse) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetRunning() bool {
+	if x != nil {
+		return x.Running
+	}
+	return false
+}
+
+func (x *StatusResponse) GetExitCode() int32 {
+	if x != nil && x.ExitCode != nil {
+		return *x.ExitCode
+	}
+	return 0
+}
+
+func (x *StatusResponse) GetStartedAt() string {
+	if x != nil {
+		return x.StartedAt
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetEndedAt() string {
+	if x != nil && x.EndedAt != nil {
+		return *x.EndedAt
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetCommand() []string {
+	if x != nil {
+		return x.Command
+	}
+	return nil
+}
+
+func (x *StatusResponse) GetHasVty() bool {
+	if x != nil {
+		return x.HasVty
+	}
+	return false
+}
+
+func (x *StatusResponse) GetPaused() bool {
+	if x != nil {
+		return x.Paused
+	}
+	return false
+}
+
+func (x *StatusResponse) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetStartError() string {
+	if x != nil {
+		return x.StartError
+	}
+	return ""
+}
+
+func (x *StatusResponse) GetUptimeSecs() int64 {
+	if x != nil {
+		return x.UptimeSecs
+	}
+	return 0
+}
+
+func (x *StatusResponse) GetOutputBytes() uint64 {
+	if x != nil {
+		return x.OutputBytes
+	}
+	return 0
+}
+
+type StreamOutputRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Streams       Stream                 `protobuf:"varint,2,opt,name=streams,proto3,enum=bgrun.v1.Stream" json:"streams,omitempty"`
+	Offset        uint64                 `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"` // output offset to resume from, 0 for all the output kept
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamOutputRequest) Reset() {
+	*x = StreamOutputRequest{}
+	mi := &file_control_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamOutputRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamOutputRequest) ProtoMessage() {}
+
+func (x *StreamOutputRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamOutputRequest.ProtoReflect.Descriptor instead.
+func (*StreamOutputRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StreamOutputRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *StreamOutputRequest) GetStreams() Stream {
+	if x != nil {
+		return x.Streams
+	}
+	return Stream_STREAM_BOTH
+}
+
+func (x *StreamOutputRequest) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+type OutputChunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Stream        Stream                 `protobuf:"varint,1,opt,name=stream,proto3,enum=bgrun.v1.Stream" json:"stream,omitempty"`
+	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	ExitCode      *int32                 `protobuf:"varint,3,opt,name=exit_code,json=exitCode,proto3,oneof" json:"exit_code,omitempty"` // set on the last message, without data
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OutputChunk) Reset() {
+	*x = OutputChunk{}
+	mi := &file_control_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OutputChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OutputChunk) ProtoMessage() {}
+
+func (x *OutputChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OutputChunk.ProtoReflect.Descriptor instead.
+func (*OutputChunk) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *OutputChunk) GetStream() Stream {
+	if x != nil {
+		return x.Stream
+	}
+	return Stream_STREAM_BOTH
+}
+
+func (x *OutputChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *OutputChunk) GetExitCode() int32 {
+	if x != nil && x.ExitCode != nil {
+		return *x.ExitCode
+	}
+	return 0
+}
+
+type WriteStdinRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Data          []byte                 `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Close         bool                   `protobuf:"varint,3,opt,name=close,proto3" json:"close,omitempty"` // close stdin after writing data
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WriteStdinRequest) Reset() {
+	*x = WriteStdinRequest{}
+	mi := &file_control_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WriteStdinRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteStdinRequest) ProtoMessage() {}
+
+func (x *WriteStdinRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteStdinRequest.ProtoReflect.Descriptor instead.
+func (*WriteStdinRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *WriteStdinRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *WriteStdinRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *WriteStdinRequest) GetClose() bool {
+	if x != nil {
+		return x.Close
+	}
+	return false
+}
+
+type WriteStdinResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WriteStdinResponse) Reset() {
+	*x = WriteStdinResponse{}
+	mi := &file_control_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WriteStdinResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteStdinResponse) ProtoMessage() {}
+
+func (x *WriteStdinResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteStdinResponse.ProtoReflect.Descriptor instead.
+func (*WriteStdinResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{6}
+}
+
+type SignalRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Signal        int32                  `protobuf:"varint,2,opt,name=signal,proto3" json:"signal,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalRequest) Reset() {
+	*x = SignalRequest{}
+	mi := &file_control_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalRequest) ProtoMessage() {}
+
+func (x *SignalRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalRequest.ProtoReflect.Descriptor instead.
+func (*SignalRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SignalRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *SignalRequest) GetSignal() int32 {
+	if x != nil {
+		return x.Signal
+	}
+	return 0
+}
+
+type SignalResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SignalResponse) Reset() {
+	*x = SignalResponse{}
+	mi := &file_control_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SignalResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SignalResponse) ProtoMessage() {}
+
+func (x *SignalResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SignalResponse.ProtoReflect.Descriptor instead.
+func (*SignalResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{8}
+}
+
+type WaitRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Type          WaitType               `protobuf:"varint,2,opt,name=type,proto3,enum=bgrun.v1.WaitType" json:"type,omitempty"`
+	TimeoutSecs   uint32                 `protobuf:"varint,3,opt,name=timeout_secs,json=timeoutSecs,proto3" json:"timeout_secs,omitempty"` // 0 waits forever
+	Pattern       string                 `protobuf:"bytes,4,opt,name=pattern,proto3" json:"pattern,omitempty"`                             // regular expression (RE2), for WAIT_TYPE_PATTERN
+	QuietMs       uint32                 `protobuf:"varint,5,opt,name=quiet_ms,json=quietMs,proto3" json:"quiet_ms,omitempty"`             // quiet period, for the idle and stable types
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WaitRequest) Reset() {
+	*x = WaitRequest{}
+	mi := &file_control_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WaitRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WaitRequest) ProtoMessage() {}
+
+func (x *WaitRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WaitRequest.ProtoReflect.Descriptor instead.
+func (*WaitRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *WaitRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *WaitRequest) GetType() WaitType {
+	if x != nil {
+		return x.Type
+	}
+	return WaitType_WAIT_TYPE_EXIT
+}
+
+func (x *WaitRequest) GetTimeoutSecs() uint32 {
+	if x != nil {
+		return x.TimeoutSecs
+	}
+	return 0
+}
+
+func (x *WaitRequest) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *WaitRequest) GetQuietMs() uint32 {
+	if x != nil {
+		return x.QuietMs
+	}
+	return 0
+}
+
+type WaitResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        WaitStatus             `protobuf:"varint,1,opt,name=status,proto3,enum=bgrun.v1.WaitStatus" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WaitResponse) Reset() {
+	*x = WaitResponse{}
+	mi := &file_control_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WaitResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WaitResponse) ProtoMessage() {}
+
+func (x *WaitResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WaitResponse.ProtoReflect.Descriptor instead.
+func (*WaitResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *WaitResponse) GetStatus() WaitStatus {
+	if x != nil {
+		return x.Status
+	}
+	return WaitStatus_WAIT_STATUS_COMPLETED
+}
+
+type ExportRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Target        *Target                `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Format        ExportFormat           `protobuf:"varint,2,opt,name=format,proto3,enum=bgrun.v1.ExportFormat" json:"format,omitempty"`
+	Scrollback    bool                   `protobuf:"varint,3,opt,name=scrollback,proto3" json:"scrollback,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExportRequest) Reset() {
+	*x = ExportRequest{}
+	mi := &file_control_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExportRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportRequest) ProtoMessage() {}
+
+func (x *ExportRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportRequest.ProtoReflect.Descriptor instead.
+func (*ExportRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ExportRequest) GetTarget() *Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *ExportRequest) GetFormat() ExportFormat {
+	if x != nil {
+		return x.Format
+	}
+	return ExportFormat_EXPORT_FORMAT_TEXT
+}
+
+func (x *ExportRequest) GetScrollback() bool {
+	if x != nil {
+		return x.Scrollback
+	}
+	return false
+}
+
+type ExportResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Content       string                 `protobuf:"bytes,1,opt,name=content,proto3" json:"content,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExportResponse) Reset() {
+	*x = ExportResponse{}
+	mi := &file_control_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExportResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportResponse) ProtoMessage() {}
+
+func (x *ExportResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportResponse.ProtoReflect.Descriptor instead.
+func (*ExportResponse) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ExportResponse) GetContent() string {
+	if x != nil {
+		return x.Content
+	}
+	return ""
+}
+
+var File_control_proto protoreflect.FileDescriptor
+
+const file_control_proto_rawDesc = "" +
+	"\n" +
+	"\rcontrol.proto\x12\bbgrun.v1\"V\n" +
+	"\x06Target\x12\x12\n" +
+	"\x03pid\x18\x01 \x01(\x05H\x00R\x03pid\x12\x14\n" +
+	"\x04name\x18\x02 \x01(\tH\x00R\x04name\x12\x18\n" +
+	"\x06socket\x18\x03 \x01(\tH\x00R\x06socketB\b\n" +
+	"\x06daemon\"9\n" +
+	"\rStatusRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\"\x94\x03\n" +
+	"\x0eStatusResponse\x12\x10\n" +
+	"\x03pid\x18\x01 \x01(\x05R\x03pid\x12\x14\n" +
+	"\x05state\x18\x02 \x01(\tR\x05state\x12\x18\n" +
+	"\arunning\x18\x03 \x01(\bR\arunning\x12 \n" +
+	"\texit_code\x18\x04 \x01(\x05H\x00R\bexitCode\x88\x01\x01\x12\x1d\n" +
+	"\n" +
+	"started_at\x18\x05 \x01(\tR\tstartedAt\x12\x1e\n" +
+	"\bended_at\x18\x06 \x01(\tH\x01R\aendedAt\x88\x01\x01\x12\x18\n" +
+	"\acommand\x18\a \x03(\tR\acommand\x12\x17\n" +
+	"\ahas_vty\x18\b \x01(\bR\x06hasVty\x12\x16\n" +
+	"\x06paused\x18\t \x01(\bR\x06paused\x12\x14\n" +
+	"\x05title\x18\n" +
+	" \x01(\tR\x05title\x12\x1f\n" +
+	"\vstart_error\x18\v \x01(\tR\n" +
+	"startError\x12\x1f\n" +
+	"\vuptime_secs\x18\f \x01(\x03R\n" +
+	"uptimeSecs\x12!\n" +
+	"\foutput_bytes\x18\r \x01(\x04R\voutputBytesB\f\n" +
+	"\n" +
+	"_exit_codeB\v\n" +
+	"\t_ended_at\"\x83\x01\n" +
+	"\x13StreamOutputRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\x12*\n" +
+	"\astreams\x18\x02 \x01(\x0e2\x10.bgrun.v1.StreamR\astreams\x12\x16\n" +
+	"\x06offset\x18\x03 \x01(\x04R\x06offset\"{\n" +
+	"\vOutputChunk\x12(\n" +
+	"\x06stream\x18\x01 \x01(\x0e2\x10.bgrun.v1.StreamR\x06stream\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\x12 \n" +
+	"\texit_code\x18\x03 \x01(\x05H\x00R\bexitCode\x88\x01\x01B\f\n" +
+	"\n" +
+	"_exit_code\"g\n" +
+	"\x11WriteStdinRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\x12\x12\n" +
+	"\x04data\x18\x02 \x01(\fR\x04data\x12\x14\n" +
+	"\x05close\x18\x03 \x01(\bR\x05close\"\x14\n" +
+	"\x12WriteStdinResponse\"Q\n" +
+	"\rSignalRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\x12\x16\n" +
+	"\x06signal\x18\x02 \x01(\x05R\x06signal\"\x10\n" +
+	"\x0eSignalResponse\"\xb7\x01\n" +
+	"\vWaitRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\x12&\n" +
+	"\x04type\x18\x02 \x01(\x0e2\x12.bgrun.v1.WaitTypeR\x04type\x12!\n" +
+	"\ftimeout_secs\x18\x03 \x01(\rR\vtimeoutSecs\x12\x18\n" +
+	"\apattern\x18\x04 \x01(\tR\apattern\x12\x19\n" +
+	"\bquiet_ms\x18\x05 \x01(\rR\aquietMs\"<\n" +
+	"\fWaitResponse\x12,\n" +
+	"\x06status\x18\x01 \x01(\x0e2\x14.bgrun.v1.WaitStatusR\x06status\"\x89\x01\n" +
+	"\rExportRequest\x12(\n" +
+	"\x06target\x18\x01 \x01(\v2\x10.bgrun.v1.TargetR\x06target\x12.\n" +
+	"\x06format\x18\x02 \x01(\x0e2\x16.bgrun.v1.ExportFormatR\x06format\x12\x1e\n" +
+	"\n" +
+	"scrollback\x18\x03 \x01(\bR\n" +
+	"scrollback\"*\n" +
+	"\x0eExportResponse\x12\x18\n" +
+	"\acontent\x18\x01 \x01(\tR\acontent*?\n" +
+	"\x06Stream\x12\x0f\n" +
+	"\vSTREAM_BOTH\x10\x00\x12\x11\n" +
+	"\rSTREAM_STDOUT\x10\x01\x12\x11\n" +
+	"\rSTREAM_STDERR\x10\x02*\x87\x01\n" +
+	"\bWaitType\x12\x12\n" +
+	"\x0eWAIT_TYPE_EXIT\x10\x00\x12\x18\n" +
+	"\x14WAIT_TYPE_FOREGROUND\x10\x01\x12\x15\n" +
+	"\x11WAIT_TYPE_PATTERN\x10\x02\x12\x19\n" +
+	"\x15WAIT_TYPE_OUTPUT_IDLE\x10\x03\x12\x1b\n" +
+	"\x17WAIT_TYPE_SCREEN_STABLE\x10\x04*`\n" +
+	"\n" +
+	"WaitStatus\x12\x19\n" +
+	"\x15WAIT_STATUS_COMPLETED\x10\x00\x12\x17\n" +
+	"\x13WAIT_STATUS_TIMEOUT\x10\x01\x12\x1e\n" +
+	"\x1aWAIT_STATUS_NOT_APPLICABLE\x10\x02*r\n" +
+	"\fExportFormat\x12\x16\n" +
+	"\x12EXPORT_FORMAT_TEXT\x10\x00\x12\x1a\n" +
+	"\x16EXPORT_FORMAT_MARKDOWN\x10\x01\x12\x16\n" +
+	"\x12EXPORT_FORMAT_HTML\x10\x02\x12\x16\n" +
+	"\x12EXPORT_FORMAT_ANSI\x10\x032\x88\x03\n" +
+	"\aControl\x12;\n" +
+	"\x06Status\x12\x17.bgrun.v1.StatusRequest\x1a\x18.bgrun.v1.StatusResponse\x12F\n" +
+	"\fStreamOutput\x12\x1d.bgrun.v1.StreamOutputRequest\x1a\x15.bgrun.v1.OutputChunk0\x01\x12G\n" +
+	"\n" +
+	"WriteStdin\x12\x1b.bgrun.v1.WriteStdinRequest\x1a\x1c.bgrun.v1.WriteStdinResponse\x12;\n" +
+	"\x06Signal\x12\x17.bgrun.v1.SignalRequest\x1a\x18.bgrun.v1.SignalResponse\x125\n" +
+	"\x04Wait\x12\x15.bgrun.v1.WaitRequest\x1a\x16.bgrun.v1.WaitResponse\x12;\n" +
+	"\x06Export\x12\x17.bgrun.v1.ExportRequest\x1a\x18.bgrun.v1.ExportResponseB$Z\"github.com/KarpelesLab/bgrun/bgrpcb\x06proto3"
+
+var (
+	file_control_proto_rawDescOnce sync.Once
+	file_control_proto_rawDescData []byte
+)
+
+func file_control_proto_rawDescGZIP() []byte {
+	file_control_proto_rawDescOnce.Do(func() {
+		file_control_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)))
+	})
+	return file_control_proto_rawDescData
+}
+
+var file_control_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_control_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_control_proto_goTypes = []any{
+	(Stream)(0),                 // 0: bgrun.v1.Stream
+	(WaitType)(0),               // 1: bgrun.v1.WaitType
+	(WaitStatus)(0),             // 2: bgrun.v1.WaitStatus
+	(ExportFormat)(0),           // 3: bgrun.v1.ExportFormat
+	(*Target)(nil),              // 4: bgrun.v1.Target
+	(*StatusRequest)(nil),       // 5: bgrun.v1.StatusRequest
+	(*StatusResponse)(nil),      // 6: bgrun.v1.StatusResponse
+	(*StreamOutputRequest)(nil), // 7: bgrun.v1.StreamOutputRequest
+	(*OutputChunk)(nil),         // 8: bgrun.v1.OutputChunk
+	(*WriteStdinRequest)(nil),   // 9: bgrun.v1.WriteStdinRequest
+	(*WriteStdinResponse)(nil),  // 10: bgrun.v1.WriteStdinResponse
+	(*SignalRequest)(nil),       // 11: bgrun.v1.SignalRequest
+	(*SignalResponse)(nil),      // 12: bgrun.v1.SignalResponse
+	(*WaitRequest)(nil),         // 13: bgrun.v1.WaitRequest
+	(*WaitResponse)(nil),        // 14: bgrun.v1.WaitResponse
+	(*ExportRequest)(nil),       // 15: bgrun.v1.ExportRequest
+	(*ExportResponse)(nil),      // 16: bgrun.v1.ExportResponse
+}
+var file_control_proto_depIdxs = []int32{
+	4,  // 0: bgrun.v1.StatusRequest.target:type_name -> bgrun.v1.Target
+	4,  // 1: bgrun.v1.StreamOutputRequest.target:type_name -> bgrun.v1.Target
+	0,  // 2: bgrun.v1.StreamOutputRequest.streams:type_name -> bgrun.v1.Stream
+	0,  // 3: bgrun.v1.OutputChunk.stream:type_name -> bgrun.v1.Stream
+	4,  // 4: bgrun.v1.WriteStdinRequest.target:type_name -> bgrun.v1.Target
+	4,  // 5: bgrun.v1.SignalRequest.target:type_name -> bgrun.v1.Target
+	4,  // 6: bgrun.v1.WaitRequest.target:type_name -> bgrun.v1.Target
+	1,  // 7: bgrun.v1.WaitRequest.type:type_name -> bgrun.v1.WaitType
+	2,  // 8: bgrun.v1.WaitResponse.status:type_name -> bgrun.v1.WaitStatus
+	4,  // 9: bgrun.v1.ExportRequest.target:type_name -> bgrun.v1.Target
+	3,  // 10: bgrun.v1.ExportRequest.format:type_name -> bgrun.v1.ExportFormat
+	5,  // 11: bgrun.v1.Control.Status:input_type -> bgrun.v1.StatusRequest
+	7,  // 12: bgrun.v1.Control.StreamOutput:input_type -> bgrun.v1.StreamOutputRequest
+	9,  // 13: bgrun.v1.Control.WriteStdin:input_type -> bgrun.v1.WriteStdinRequest
+	11, // 14: bgrun.v1.Control.Signal:input_type -> bgrun.v1.SignalRequest
+	13, // 15: bgrun.v1.Control.Wait:input_type -> bgrun.v1.WaitRequest
+	15, // 16: bgrun.v1.Control.Export:input_type -> bgrun.v1.ExportRequest
+	6,  // 17: bgrun.v1.Control.Status:output_type -> bgrun.v1.StatusResponse
+	8,  // 18: bgrun.v1.Control.StreamOutput:output_type -> bgrun.v1.OutputChunk
+	10, // 19: bgrun.v1.Control.WriteStdin:output_type -> bgrun.v1.WriteStdinResponse
+	12, // 20: bgrun.v1.Control.Signal:output_type -> bgrun.v1.SignalResponse
+	14, // 21: bgrun.v1.Control.Wait:output_type -> bgrun.v1.WaitResponse
+	16, // 22: bgrun.v1.Control.Export:output_type -> bgrun.v1.ExportResponse
+	17, // [17:23] is the sub-list for method output_type
+	11, // [11:17] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
+}
+
+func init() { file_control_proto_init() }
+func file_control_proto_init() {
+	if File_control_proto != nil {
+		return
+	}
+	file_control_proto_msgTypes[0].OneofWrappers = []any{
+		(*Target_Pid)(nil),
+		(*Target_Name)(nil),
+		(*Target_Socket)(nil),
+	}
+	file_control_proto_msgTypes[2].OneofWrappers = []any{}
+	file_control_proto_msgTypes[4].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)),
+			NumEnums:      4,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_control_proto_goTypes,
+		DependencyIndexes: file_control_proto_depIdxs,
+		EnumInfos:         file_control_proto_enumTypes,
+		MessageInfos:      file_control_proto_msgTypes,
+	}.Build()
+	File_control_proto = out.File
+	file_control_proto_goTypes = nil
+	file_control_proto_depIdxs = nil
+}
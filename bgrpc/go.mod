@@ -0,0 +1,21 @@
+module github.com/KarpelesLab/bgrun/bgrpc
+
+go 1.24.6
+
+require (
+	github.com/KarpelesLab/bgrun v0.0.0
+	google.golang.org/grpc v1.72.0
+	google.golang.org/protobuf v1.36.6
+)
+
+require (
+	github.com/creack/pty v1.1.24 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/term v0.36.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250218202821-56aae31c358a // indirect
+)
+
+// The gateway always builds against the bgrun source tree it ships with
+replace github.com/KarpelesLab/bgrun => ../
@@ -0,0 +1,321 @@
+// Package bgrpc provides the gRPC service of bgrun, generated from
+// control.proto, and a server implementing it on top of the client package,
+// so that programs in any language can control daemons. The cmd/bgrpc
+// gateway serves it. It is a module of its own, so that the gRPC
+// dependencies stay out of the programs importing bgrun.
+package bgrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/control"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements ControlServer, each call connecting to the daemon of
+// its target
+type Server struct {
+	UnimplementedControlServer
+
+	// Default is the daemon of requests without a target
+	Default control.Target
+
+	// Permissions is what the callers may do, as the -permissions of a
+	// daemon for its other users; zero grants everything. The daemons see
+	// the user running the gateway, so they cannot restrict its callers
+	// themselves.
+	Permissions daemon.Permissions
+}
+
+// allow checks that the callers may make a call requiring perm
+func (s *Server) allow(call string, perm daemon.Permissions) error {
+	if s.Permissions == 0 || s.Permissions&perm == perm {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "permission denied: %s requires the %s permission", call, perm)
+}
+
+// connect connects to the daemon designated by t, or the default one
+func (s *Server) connect(t *Target) (*bgclient.Client, error) {
+	target := s.Default
+	switch d := t.GetDaemon().(type) {
+	case *Target_Pid:
+		target = control.Target{PID: int(d.Pid)}
+	case *Target_Name:
+		target = control.Target{Name: d.Name}
+	case *Target_Socket:
+		if !discovered(d.Socket) {
+			return nil, status.Errorf(codes.NotFound, "%s is not the control socket of a daemon", d.Socket)
+		}
+		target = control.Target{Socket: d.Socket}
+	}
+	c, err := control.Connect(target)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return c, nil
+}
+
+// discovered tells whether path is the control socket of one of the daemons
+// of the user, so that callers cannot have the gateway dial any socket
+func discovered(path string) bool {
+	want, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	daemons, err := bgclient.ListDaemons()
+	if err != nil {
+		return false
+	}
+	for _, d := range daemons {
+		got, err := filepath.EvalSymlinks(filepath.Join(d.RuntimeDir, "control.sock"))
+		if err == nil && got == want {
+			return true
+		}
+	}
+	return false
+}
+
+// statusError maps the errors of the client to gRPC status codes
+func statusError(err error) error {
+	var quota *protocol.QuotaExceeded
+	switch {
+	case errors.Is(err, bgclient.ErrNoSuchDaemon):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, bgclient.ErrAmbiguousName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, bgclient.ErrNotReady):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, bgclient.ErrProcessTerminated):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, bgclient.ErrUnauthorized), strings.Contains(err.Error(), "permission denied"):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, bgclient.ErrNotSupported):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.As(err, &quota):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case strings.HasPrefix(err.Error(), "server error: "):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// Status returns the status of the process, live or from the status file of
+// a terminated one
+func (s *Server) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	st, err := c.GetStatus()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &StatusResponse{
+		Pid:         int32(st.PID),
+		State:       st.State,
+		Running:     st.Running,
+		StartedAt:   st.StartedAt,
+		EndedAt:     st.EndedAt,
+		Command:     st.Command,
+		HasVty:      st.HasVTY,
+		Paused:      st.Paused,
+		Title:       st.Title,
+		StartError:  st.StartError,
+		UptimeSecs:  st.UptimeSecs,
+		OutputBytes: st.OutputBytes,
+	}
+	if st.ExitCode != nil {
+		code := int32(*st.ExitCode)
+		resp.ExitCode = &code
+	}
+	return resp, nil
+}
+
+// StreamOutput streams the output from the requested offset until the
+// process exits or the call is canceled. For a terminated process the
+// output log is sent.
+func (s *Server) StreamOutput(req *StreamOutputRequest, stream Control_StreamOutputServer) error {
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if c.IsZombie() {
+		return s.streamStored(c, req, stream)
+	}
+
+	streams := byte(req.GetStreams())
+	if streams == 0 {
+		streams = protocol.StreamBoth
+	}
+	if err := c.AttachFrom(streams, req.GetOffset()); err != nil {
+		return statusError(err)
+	}
+
+	// Unblock the read loop when the caller goes away
+	stop := context.AfterFunc(stream.Context(), func() { c.Close() })
+	defer stop()
+
+	var exitCode *int32
+	err = c.ReadMessages(func(s byte, data []byte) error {
+		return stream.Send(&OutputChunk{Stream: Stream(s), Data: data})
+	}, func(code int) {
+		exitCode = new(int32)
+		*exitCode = int32(code)
+	})
+	if ctxErr := stream.Context().Err(); ctxErr != nil {
+		return status.FromContextError(ctxErr).Err()
+	}
+	if err != nil {
+		return statusError(err)
+	}
+	if exitCode != nil {
+		return stream.Send(&OutputChunk{ExitCode: exitCode})
+	}
+	return nil
+}
+
+// streamStored sends the output log of a terminated process, which does
+// not tell the streams apart, then its exit code
+func (s *Server) streamStored(c *bgclient.Client, req *StreamOutputRequest, stream Control_StreamOutputServer) error {
+	data, err := c.ReadOutput()
+	if err != nil {
+		return statusError(err)
+	}
+	if offset := req.GetOffset(); offset < uint64(len(data)) {
+		if err := stream.Send(&OutputChunk{Stream: Stream_STREAM_BOTH, Data: data[offset:]}); err != nil {
+			return err
+		}
+	}
+
+	st, err := c.GetStatus()
+	if err != nil {
+		return statusError(err)
+	}
+	if st.ExitCode == nil {
+		return nil
+	}
+	code := int32(*st.ExitCode)
+	return stream.Send(&OutputChunk{ExitCode: &code})
+}
+
+// WriteStdin writes to stdin, then pings the daemon so that a refused
+// write is reported to the caller
+func (s *Server) WriteStdin(ctx context.Context, req *WriteStdinRequest) (*WriteStdinResponse, error) {
+	if err := s.allow("WriteStdin", daemon.PermStdin); err != nil {
+		return nil, err
+	}
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if len(req.GetData()) > 0 {
+		if err := c.WriteStdin(req.GetData()); err != nil {
+			return nil, statusError(err)
+		}
+	}
+	if req.GetClose() {
+		if err := c.CloseStdin(); err != nil {
+			return nil, statusError(err)
+		}
+	}
+	if _, err := c.Ping(); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return nil, statusError(err)
+	}
+	return &WriteStdinResponse{}, nil
+}
+
+// Signal sends a signal to the process
+func (s *Server) Signal(ctx context.Context, req *SignalRequest) (*SignalResponse, error) {
+	if err := s.allow("Signal", daemon.PermSignal); err != nil {
+		return nil, err
+	}
+	if req.GetSignal() <= 0 || req.GetSignal() > 255 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid signal %d", req.GetSignal())
+	}
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.SendSignal(syscall.Signal(req.GetSignal())); err != nil {
+		return nil, statusError(err)
+	}
+	return &SignalResponse{}, nil
+}
+
+// Wait waits for a condition; canceling the call abandons the wait
+func (s *Server) Wait(ctx context.Context, req *WaitRequest) (*WaitResponse, error) {
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	timeout := req.GetTimeoutSecs()
+	quiet := time.Duration(req.GetQuietMs()) * time.Millisecond
+	var result byte
+	switch req.GetType() {
+	case WaitType_WAIT_TYPE_EXIT:
+		result, err = c.Wait(timeout, protocol.WaitTypeExit)
+	case WaitType_WAIT_TYPE_FOREGROUND:
+		result, err = c.Wait(timeout, protocol.WaitTypeForeground)
+	case WaitType_WAIT_TYPE_PATTERN:
+		result, err = c.WaitForPattern(timeout, req.GetPattern())
+	case WaitType_WAIT_TYPE_OUTPUT_IDLE:
+		result, err = c.WaitForOutputIdle(timeout, quiet)
+	case WaitType_WAIT_TYPE_SCREEN_STABLE:
+		result, err = c.WaitForScreenStable(timeout, quiet)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown wait type %d", req.GetType())
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, status.FromContextError(ctxErr).Err()
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &WaitResponse{Status: WaitStatus(result)}, nil
+}
+
+// Export exports the terminal content (VTY only)
+func (s *Server) Export(ctx context.Context, req *ExportRequest) (*ExportResponse, error) {
+	if req.GetFormat() < ExportFormat_EXPORT_FORMAT_TEXT || req.GetFormat() > ExportFormat_EXPORT_FORMAT_ANSI {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown export format %d", req.GetFormat())
+	}
+	c, err := s.connect(req.GetTarget())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := c.Export(&protocol.ExportRequest{
+		Format:            protocol.ExportFormat(req.GetFormat()),
+		IncludeScrollback: req.GetScrollback(),
+		EndLine:           -1,
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &ExportResponse{Content: resp.Content}, nil
+}
@@ -0,0 +1,118 @@
+package bgrpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/control"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"bash", "-c", "echo ready; read line; echo \"got $line\"; exit 4"},
+		StdinMode:  daemon.StdinStream,
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		RuntimeDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Wait()
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "grpc.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	RegisterControlServer(server, &Server{Default: control.Target{Socket: d.SocketPath()}})
+	go server.Serve(ln)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("unix://"+ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := NewControlClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	st, err := client.Status(ctx, &StatusRequest{})
+	if err != nil || !st.Running || st.ExitCode != nil {
+		t.Fatalf("Expected the status of the running process, got %v, %v", st, err)
+	}
+
+	wait, err := client.Wait(ctx, &WaitRequest{Type: WaitType_WAIT_TYPE_PATTERN, TimeoutSecs: 5, Pattern: "^ready$"})
+	if err != nil || wait.Status != WaitStatus_WAIT_STATUS_COMPLETED {
+		t.Fatalf("Expected the pattern wait to complete, got %v, %v", wait, err)
+	}
+
+	if _, err := client.Export(ctx, &ExportRequest{Format: ExportFormat_EXPORT_FORMAT_HTML}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected the export to fail without VTY, got %v", err)
+	}
+	if _, err := client.Signal(ctx, &SignalRequest{Signal: 0}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected signal 0 to be refused, got %v", err)
+	}
+	if _, err := client.Status(ctx, &StatusRequest{Target: &Target{Daemon: &Target_Socket{Socket: filepath.Join(dir, "none.sock")}}}); err == nil {
+		t.Error("Expected a missing daemon to fail")
+	}
+	if _, err := client.Status(ctx, &StatusRequest{Target: &Target{Daemon: &Target_Socket{Socket: ln.Addr().String()}}}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected a socket other than a daemon's to be refused, got %v", err)
+	}
+
+	observer := &Server{Default: control.Target{Socket: d.SocketPath()}, Permissions: daemon.PermObserve}
+	if _, err := observer.Status(ctx, &StatusRequest{}); err != nil {
+		t.Errorf("Expected an observer to get the status, got %v", err)
+	}
+	if _, err := observer.Signal(ctx, &SignalRequest{Signal: 15}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected an observer to be refused signals, got %v", err)
+	}
+	if _, err := observer.WriteStdin(ctx, &WriteStdinRequest{Data: []byte("x\n")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected an observer to be refused stdin, got %v", err)
+	}
+
+	stream, err := client.StreamOutput(ctx, &StreamOutputRequest{})
+	if err != nil {
+		t.Fatalf("StreamOutput failed: %v", err)
+	}
+	if _, err := client.WriteStdin(ctx, &WriteStdinRequest{Data: []byte("hello\n")}); err != nil {
+		t.Fatalf("WriteStdin failed: %v", err)
+	}
+
+	var output strings.Builder
+	var exitCode *int32
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to receive output: %v (got %q)", err, output.String())
+		}
+		output.Write(chunk.Data)
+		if chunk.ExitCode != nil {
+			exitCode = chunk.ExitCode
+		}
+	}
+	if output.String() != "ready\ngot hello\n" {
+		t.Errorf("Expected the whole output, got %q", output.String())
+	}
+	if exitCode == nil || *exitCode != 4 {
+		t.Errorf("Expected exit code 4, got %v", exitCode)
+	}
+}
@@ -0,0 +1,270 @@
+// Command bgctl controls bgrun daemons. It only contains the client side of
+// bgrun, which makes it a small static binary that can be shipped on its own
+// to hosts or containers where jobs are inspected but not started.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/control"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+var (
+	pidFlag    = flag.Int("pid", 0, "PID of the bgrun daemon")
+	nameFlag   = flag.String("name", "", "command name of the bgrun daemon (see the list command)")
+	socketFlag = flag.String("socket", "", "path of the daemon control socket")
+	addrFlag   = flag.String("addr", "", "TCP address of a daemon listening over TLS")
+	certFlag   = flag.String("tls-cert", "", "PEM client certificate for -addr")
+	keyFlag    = flag.String("tls-key", "", "PEM private key of the client certificate")
+	caFlag     = flag.String("tls-ca", "", "PEM CA of the daemon certificate (default: system CAs)")
+	jobFlag    = flag.String("job", "", "job of the bgrund supervisor at -socket (default: the socket of bgrund)")
+	jsonFlag   = flag.Bool("json", false, "write results as JSON")
+	allFlag    = flag.Bool("all-users", false, "list and select the daemons of every user (root only, audited)")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	if err := run(args[0], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bgctl [-pid <pid> | -name <name> | -socket <path> | -addr <host:port> | -job <name>] [-all-users] [-json] <command> [args...]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  list                List the daemons of the current user")
+	fmt.Fprintln(os.Stderr, "  ps                  List the daemons with their live state, uptime and zombies")
+	fmt.Fprintln(os.Stderr, "  job <list|status|start|stop|restart> [name]")
+	fmt.Fprintln(os.Stderr, "                      List or drive the jobs of the bgrund supervisor")
+	fmt.Fprintln(os.Stderr, "  status              Show process status")
+	fmt.Fprintln(os.Stderr, "  attach [-d] [-forward-signals]")
+	fmt.Fprintln(os.Stderr, "                      Attach to process output; -d detaches the other clients, -forward-signals")
+	fmt.Fprintln(os.Stderr, "                      sends Ctrl+C to the process without VTY, pressed twice to detach")
+	fmt.Fprintln(os.Stderr, "  wait <type> <secs>  Wait for condition (type: exit|foreground)")
+	fmt.Fprintln(os.Stderr, "  wait pattern <secs> <re>")
+	fmt.Fprintln(os.Stderr, "                      Wait for a regular expression in the output or screen")
+	fmt.Fprintln(os.Stderr, "  wait <idle|stable> <secs> <ms>")
+	fmt.Fprintln(os.Stderr, "                      Wait for no output, or no screen change, for <ms>")
+	fmt.Fprintln(os.Stderr, "  signal <signum>     Send signal to process")
+	fmt.Fprintln(os.Stderr, "  stop                Pause the process group (SIGSTOP)")
+	fmt.Fprintln(os.Stderr, "  cont                Resume the paused process group (SIGCONT)")
+	fmt.Fprintln(os.Stderr, "  shutdown            Shutdown the daemon")
+	fmt.Fprintln(os.Stderr, "  runs                List the run history of a retried job")
+	fmt.Fprintln(os.Stderr, "  commands            List the commands run in the terminal's shell (VTY only)")
+	fmt.Fprintln(os.Stderr, "  command-output [n]  Show the output of command n (default: the last one)")
+	fmt.Fprintln(os.Stderr, "  search [-i] <re>    Find a regular expression in the screen and scrollback (VTY only)")
+	fmt.Fprintln(os.Stderr, "  record <start|stop> Start or stop recording the session (VTY only)")
+	fmt.Fprintln(os.Stderr, "  recording           Write the asciinema recording of the session to stdout")
+	fmt.Fprintln(os.Stderr, "  timeline            Write the timeline of input, output and events of the recording")
+	fmt.Fprintln(os.Stderr, "  replay [speed]      Play the recording back with its original timing (default speed: 1)")
+	fmt.Fprintln(os.Stderr, "  capabilities        List the messages, formats and features the daemon supports")
+	fmt.Fprintln(os.Stderr, "  health              Check the daemon itself: state lock, goroutines, log, output readers")
+	fmt.Fprintln(os.Stderr, "  ping                Measure the round trip time to the daemon")
+	fmt.Fprintln(os.Stderr, "  events              Stream lifecycle events: exit, resize, title, foreground, clients, pause, health")
+	fmt.Fprintln(os.Stderr, "  expect <re> <input>...")
+	fmt.Fprintln(os.Stderr, "                      Send input whenever the output matches, until the process exits")
+	fmt.Fprintln(os.Stderr, "  send-file [-close] <path>")
+	fmt.Fprintln(os.Stderr, "                      Have the daemon write a file to stdin, closing it after with -close")
+	fmt.Fprintln(os.Stderr, "  log-level [level]   Show or set the level of the daemon log (debug|info|warn|error)")
+	fmt.Fprintln(os.Stderr, "  checkpoint [-leave-running]")
+	fmt.Fprintln(os.Stderr, "                      Checkpoint the process with CRIU, to restore it with bgrun -restore (experimental)")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	flag.PrintDefaults()
+}
+
+func run(command string, args []string) error {
+	switch command {
+	case "list":
+		return control.List(os.Stdout, *jsonFlag, *allFlag)
+	case "ps":
+		return control.Ps(os.Stdout, *jsonFlag, *allFlag)
+	case "job":
+		return job(args)
+	}
+
+	target := control.Target{PID: *pidFlag, Name: *nameFlag, Socket: *socketFlag, Addr: *addrFlag, Job: *jobFlag, AllUsers: *allFlag, Action: command}
+	if target.Addr != "" {
+		tlsConfig, err := bgclient.LoadTLSConfig(*certFlag, *keyFlag, *caFlag)
+		if err != nil {
+			return err
+		}
+		target.TLS = tlsConfig
+	}
+
+	c, err := control.Connect(target)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer c.Close()
+
+	ctl := &control.Controller{Client: c, Out: os.Stdout, Err: os.Stderr, JSON: *jsonFlag}
+
+	switch command {
+	case "status":
+		return ctl.Status()
+
+	case "attach":
+		opts, err := control.ParseAttach(args)
+		if err != nil {
+			return err
+		}
+		return ctl.AttachTerminal(func() (*bgclient.Client, error) { return control.Connect(target) }, opts)
+
+	case "wait":
+		if len(args) < 2 || (slices.Contains([]string{"pattern", "idle", "stable"}, args[0]) && len(args) < 3) {
+			return errors.New("wait type and timeout required (wait <exit|foreground> <seconds>, wait pattern <seconds> <regexp>, or wait <idle|stable> <seconds> <milliseconds>)")
+		}
+		timeout, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+		switch args[0] {
+		case "pattern":
+			return ctl.WaitPattern(args[2], uint32(timeout))
+		case "idle", "stable":
+			quiet, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid quiet period: %w", err)
+			}
+			return ctl.WaitQuiet(args[0], time.Duration(quiet)*time.Millisecond, uint32(timeout))
+		}
+		return ctl.Wait(args[0], uint32(timeout))
+
+	case "signal":
+		if len(args) < 1 {
+			return errors.New("signal number required")
+		}
+		signum, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid signal number: %w", err)
+		}
+		return ctl.Signal(syscall.Signal(signum))
+
+	case "stop", "cont":
+		return ctl.Pause(command == "stop")
+
+	case "shutdown":
+		return ctl.Shutdown()
+
+	case "runs":
+		return ctl.Runs()
+
+	case "commands":
+		return ctl.Commands()
+
+	case "command-output":
+		index := -1
+		if len(args) >= 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid command index: %w", err)
+			}
+			index = n
+		}
+		return ctl.CommandOutput(index)
+
+	case "search":
+		pattern, ignoreCase, err := control.ParseSearch(args)
+		if err != nil {
+			return err
+		}
+		return ctl.Search(pattern, ignoreCase)
+
+	case "record":
+		if len(args) < 1 || (args[0] != "start" && args[0] != "stop") {
+			return errors.New("record action required (record <start|stop>)")
+		}
+		return ctl.Record(args[0] == "start")
+
+	case "recording":
+		return ctl.Recording()
+
+	case "timeline":
+		return ctl.Timeline()
+
+	case "replay":
+		speed, err := control.ParseSpeed(args)
+		if err != nil {
+			return err
+		}
+		return ctl.Replay(speed)
+
+	case "capabilities":
+		return ctl.Capabilities()
+
+	case "health":
+		return ctl.Health()
+
+	case "ping":
+		return ctl.Ping()
+
+	case "events":
+		return ctl.Events()
+
+	case "expect":
+		rules, err := control.ParseExpectRules(args)
+		if err != nil {
+			return err
+		}
+		return ctl.Expect(rules)
+
+	case "log-level":
+		level := ""
+		if len(args) > 0 {
+			level = args[0]
+		}
+		return ctl.LogLevel(level)
+
+	case "checkpoint":
+		leaveRunning, err := control.ParseCheckpoint(args)
+		if err != nil {
+			return err
+		}
+		return ctl.Checkpoint(leaveRunning)
+
+	case "send-file":
+		path, closeStdin, err := control.ParseSendFile(args)
+		if err != nil {
+			return err
+		}
+		return ctl.SendFile(path, closeStdin)
+	}
+
+	return fmt.Errorf("unknown command: %s", command)
+}
+
+// job runs the job command against the supervisor
+func job(args []string) error {
+	if len(args) < 1 {
+		return errors.New("job action required (job <list|status|start|stop|restart> [name])")
+	}
+	req := &protocol.JobRequest{Action: args[0]}
+	switch {
+	case req.Action == protocol.JobList:
+	case len(args) < 2:
+		return fmt.Errorf("job name required (job %s <name>)", req.Action)
+	default:
+		req.Name = args[1]
+	}
+	return control.Jobs(os.Stdout, *socketFlag, req, *jsonFlag)
+}
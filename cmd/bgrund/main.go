@@ -0,0 +1,74 @@
+// Command bgrund supervises the jobs listed in a JSON file, each run by a
+// bgrun daemon, behind a single control socket:
+//
+//	bgrund ~/.config/bgrund.json
+//	bgctl job list
+//	bgctl -job web attach
+//
+// It stops the jobs when it receives SIGINT or SIGTERM.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/KarpelesLab/bgrun/supervisor"
+)
+
+var runtimeDirFlag = flag.String("runtime-dir", "", "directory of the control socket and the jobs (default: runtime_dir of the file, or $XDG_RUNTIME_DIR/bgrun/bgrund)")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bgrund [options] <jobs.json>")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Runs the jobs of the file and serves their control socket, driven with")
+	fmt.Fprintln(os.Stderr, "bgctl job <list|status|start|stop|restart> [name], and bgctl -job <name>.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	flag.PrintDefaults()
+}
+
+func run(path string) error {
+	config, err := supervisor.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if *runtimeDirFlag != "" {
+		config.RuntimeDir = *runtimeDirFlag
+	}
+
+	s, err := supervisor.New(config)
+	if err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	log.Printf("Supervising %d jobs, control socket: %s", len(config.Jobs), s.SocketPath())
+
+	<-sigCh
+	log.Println("Received signal, stopping the jobs...")
+	s.Close()
+	return nil
+}
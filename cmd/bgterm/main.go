@@ -0,0 +1,132 @@
+// Command bgterm runs terminal output through the bgrun terminal emulator and
+// exports the resulting screen. It reads ANSI text from a file or stdin, so
+// the emulator and its exporters can be used in pipelines without a daemon:
+//
+//	ls --color=always | bgterm -format html > ls.html
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+// formats are the export formats by name
+var formats = map[string]termemu.ExportFormat{
+	"text":     termemu.FormatPlainText,
+	"markdown": termemu.FormatMarkdown,
+	"html":     termemu.FormatHTML,
+	"ansi":     termemu.FormatANSI,
+	"svg":      termemu.FormatSVG,
+	"json":     termemu.FormatJSON,
+}
+
+var (
+	formatFlag     = flag.String("format", "text", "export format: text, markdown, html, ansi, svg or json")
+	rowsFlag       = flag.Int("rows", 24, "terminal height")
+	colsFlag       = flag.Int("cols", 80, "terminal width")
+	scrollbackFlag = flag.Bool("scrollback", true, "include the lines scrolled off the screen")
+	startFlag      = flag.Int("start", 0, "first line to export")
+	endFlag        = flag.Int("end", -1, "last line to export (-1: last line)")
+	trailingFlag   = flag.Bool("preserve-trailing-spaces", false, "keep the spaces at the end of lines")
+	trimFlag       = flag.Bool("trim", true, "leave out the empty lines at the bottom of the screen (without -end)")
+	rawFlag        = flag.Bool("raw", false, "input is raw PTY output: do not translate LF to CR LF")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bgterm [options] [file]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Feeds the file (default: stdin) to a terminal emulator and writes the")
+	fmt.Fprintln(os.Stderr, "resulting screen to stdout.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	flag.PrintDefaults()
+}
+
+func run(args []string) error {
+	format, ok := formats[*formatFlag]
+	if !ok {
+		return fmt.Errorf("unknown format %q (expected %s)", *formatFlag, strings.Join(slices.Sorted(maps.Keys(formats)), ", "))
+	}
+	if *rowsFlag <= 0 || *colsFlag <= 0 {
+		return fmt.Errorf("invalid terminal size %dx%d", *colsFlag, *rowsFlag)
+	}
+
+	var in io.Reader = os.Stdin
+	switch len(args) {
+	case 0:
+	case 1:
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	default:
+		return fmt.Errorf("expected at most one file, got %d", len(args))
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	// A terminal driver turns the LF written by programs into CR LF
+	// (ONLCR), which captured output no longer carries
+	if !*rawFlag {
+		data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	}
+
+	term := termemu.NewTerminal(*rowsFlag, *colsFlag)
+	term.Write(data)
+
+	end := *endFlag
+	if end < 0 && *trimFlag {
+		end = lastLine(term, *scrollbackFlag)
+	}
+
+	_, err = io.WriteString(os.Stdout, term.Export(termemu.ExportOptions{
+		Format:                 format,
+		IncludeScrollback:      *scrollbackFlag,
+		StartLine:              *startFlag,
+		EndLine:                end,
+		PreserveTrailingSpaces: *trailingFlag,
+	}))
+	return err
+}
+
+// lastLine returns the export line number of the last screen row holding
+// something, the first row when the screen is empty
+func lastLine(term *termemu.Terminal, includeScrollback bool) int {
+	offset := 0
+	if includeScrollback {
+		offset = len(term.GetScrollback())
+	}
+
+	screen := term.GetScreen()
+	for row := len(screen) - 1; row > 0; row-- {
+		for _, cell := range screen[row] {
+			if cell.Char != 0 && (cell.Char != ' ' || cell.Attr.Bg != termemu.ColorDefault || cell.Attr.Reverse) {
+				return offset + row
+			}
+		}
+	}
+	return offset
+}
@@ -0,0 +1,80 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgattach"
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/terminal"
+)
+
+// AttachTerminal connects the terminal to a VTY process, and streams the
+// output of other processes, with JSON or when stdin is not a terminal, as
+// Attach. connect opens another connection to the daemon, for copy mode.
+func (ctl *Controller) AttachTerminal(connect func() (*bgclient.Client, error), opts AttachOptions) error {
+	if ctl.JSON || ctl.Client.IsZombie() || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return ctl.Attach(opts)
+	}
+
+	status, err := ctl.Client.GetStatus()
+	if err != nil {
+		return err
+	}
+	if !status.HasVTY {
+		return ctl.Attach(opts)
+	}
+
+	// Ctrl+C reaches the process as input in raw mode, no need to forward
+	// signals
+	session := &bgattach.Session{Client: ctl.Client, Connect: connect, Out: ctl.Out, Exclusive: opts.Exclusive}
+	return session.Run()
+}
+
+// doublePress is how soon a second Ctrl+C detaches when forwarding signals
+const doublePress = time.Second
+
+// forwardSignals sends the SIGINT and SIGQUIT received to the process until
+// stopped. Two of them within doublePress close the connection instead,
+// ending ReadMessages, and set detached.
+func (ctl *Controller) forwardSignals() (detached *atomic.Bool, stop func()) {
+	detached = new(atomic.Bool)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGQUIT)
+	done := make(chan struct{})
+
+	msgs := ctl.Err
+	if msgs == nil {
+		msgs = ctl.Out
+	}
+	go func() {
+		var last time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigCh:
+				if time.Since(last) < doublePress {
+					detached.Store(true)
+					ctl.Client.Close()
+					return
+				}
+				last = time.Now()
+				if err := ctl.Client.PostSignal(sig.(syscall.Signal)); err != nil {
+					fmt.Fprintf(msgs, "\nFailed to send %v: %v\n", sig, err)
+					continue
+				}
+				fmt.Fprintf(msgs, "\nSent %v to the process (press again within a second to detach)\n", sig)
+			}
+		}
+	}()
+
+	return detached, func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
@@ -0,0 +1,48 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+)
+
+// AuditWriter receives the audit log of the operations on the daemons of
+// other users. When nil, the log goes to syslog with the authpriv facility,
+// or to stderr if syslog cannot be reached.
+var AuditWriter io.Writer
+
+// audit records an operation done with AllUsers: who ran it, as the user
+// who logged in and the one sudo was run by, and on which daemon
+func audit(action string, d *bgclient.DaemonInfo) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "uid=%d", os.Getuid())
+	if data, err := os.ReadFile("/proc/self/loginuid"); err == nil {
+		// 4294967295 is an unset login UID
+		if uid := strings.TrimSpace(string(data)); uid != "4294967295" {
+			fmt.Fprintf(&b, " loginuid=%s", uid)
+		}
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		fmt.Fprintf(&b, " sudo_user=%s", sudoUser)
+	}
+	fmt.Fprintf(&b, " action=%s", action)
+	if d != nil {
+		fmt.Fprintf(&b, " pid=%d user=%s command=%q", d.PID, d.User, strings.Join(d.Command, " "))
+	}
+
+	if AuditWriter != nil {
+		fmt.Fprintln(AuditWriter, b.String())
+		return
+	}
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "bgrun")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bgrun audit: %s\n", b.String())
+		return
+	}
+	defer w.Close()
+	w.Notice(b.String())
+}
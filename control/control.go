@@ -0,0 +1,1180 @@
+// Package control implements the control commands shared by the bgrun and
+// bgctl command line tools: locating a daemon and querying or driving it,
+// with human readable or JSON output. It only depends on the client side
+// packages, so controllers built on it do not embed the daemon.
+package control
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+// Target designates the daemon to control. Exactly one field should be set.
+type Target struct {
+	PID    int    // PID of the daemon
+	Name   string // Command of the daemon, see bgclient.FindByName
+	Socket string // Path of the control socket
+
+	// Addr is the TCP address of a daemon listening over TLS, and TLS the
+	// configuration holding the client certificate (see bgclient.DialTCP)
+	Addr string
+	TLS  *tls.Config
+
+	// Job is the name of a job of the bgrund supervisor listening on Socket,
+	// or on bgclient.SupervisorSocket if Socket is empty
+	Job string
+
+	// AllUsers looks the daemon up by PID or name among those of every
+	// user, as root; the connection is recorded in the audit log with
+	// Action, the command it is for
+	AllUsers bool
+	Action   string
+}
+
+// Connect connects to the daemon designated by t. Daemons found by PID or
+// name that have terminated are opened as zombies, and a daemon that was
+// just started is waited for.
+func Connect(t Target) (*bgclient.Client, error) {
+	switch {
+	case t.AllUsers:
+		return connectAnyUser(t)
+	case t.Job != "":
+		return bgclient.ConnectJob(supervisorSocket(t.Socket), t.Job)
+	case t.Socket != "":
+		return bgclient.Connect(t.Socket)
+	case t.Addr != "":
+		return bgclient.DialTCP(t.Addr, t.TLS)
+	case t.Name != "":
+		pid, err := bgclient.FindByName(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		return bgclient.NewWithRetry(pid, bgclient.DefaultRetryPolicy)
+	case t.PID > 0:
+		return bgclient.NewWithRetry(t.PID, bgclient.DefaultRetryPolicy)
+	}
+	return nil, errors.New("no daemon specified (use a PID, a name, a socket path or an address)")
+}
+
+// connectAnyUser connects to a daemon of any user designated by PID or name
+func connectAnyUser(t Target) (*bgclient.Client, error) {
+	if t.Job != "" || t.Socket != "" || t.Addr != "" {
+		return nil, errors.New("daemons of all users are designated by PID or name")
+	}
+	daemons, err := bgclient.ListAllDaemons()
+	if err != nil {
+		return nil, err
+	}
+
+	var d bgclient.DaemonInfo
+	switch {
+	case t.Name != "":
+		if d, err = bgclient.FindDaemon(daemons, t.Name); err != nil {
+			return nil, err
+		}
+	case t.PID > 0:
+		i := slices.IndexFunc(daemons, func(d bgclient.DaemonInfo) bool { return d.PID == t.PID })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: PID %d", bgclient.ErrNoSuchDaemon, t.PID)
+		}
+		d = daemons[i]
+	default:
+		return nil, errors.New("no daemon specified (use a PID or a name)")
+	}
+
+	audit(t.Action, &d)
+	return bgclient.Open(d)
+}
+
+// limit formats a cgroup limit, zero being none
+func limit(n int64) string {
+	if n == 0 {
+		return "none"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// Controller runs control commands against one daemon
+type Controller struct {
+	Client *bgclient.Client
+	Out    io.Writer // results and process stdout
+	Err    io.Writer // process stderr when attached
+	JSON   bool      // write results as JSON instead of text
+}
+
+// writeJSON writes v as indented JSON
+func (ctl *Controller) writeJSON(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = ctl.Out.Write(append(data, '\n'))
+	return err
+}
+
+// Status shows the process status
+func (ctl *Controller) Status() error {
+	status, err := ctl.Client.GetStatus()
+	if err != nil {
+		return err
+	}
+	if ctl.JSON {
+		return ctl.writeJSON(status)
+	}
+
+	w := ctl.Out
+	fmt.Fprintf(w, "PID: %d\n", status.PID)
+	fmt.Fprintf(w, "Running: %v\n", status.Running)
+	if status.State != "" {
+		fmt.Fprintf(w, "State: %s\n", status.State)
+	}
+	if status.ScheduledAt != "" {
+		fmt.Fprintf(w, "Scheduled: %s\n", status.ScheduledAt)
+	}
+	if status.StartError != "" {
+		fmt.Fprintf(w, "Start Error: %s\n", status.StartError)
+	}
+	if status.Paused {
+		fmt.Fprintln(w, "Paused: yes")
+	}
+	if status.Health != "" {
+		fmt.Fprintf(w, "Health: %s\n", status.Health)
+	}
+	if status.HealthError != "" {
+		fmt.Fprintf(w, "Health Error: %s\n", status.HealthError)
+	}
+	if status.ExitCode != nil {
+		fmt.Fprintf(w, "Exit Code: %d\n", *status.ExitCode)
+	}
+	if status.StartedAt != "" {
+		fmt.Fprintf(w, "Started: %s\n", status.StartedAt)
+	}
+	if status.EndedAt != nil {
+		fmt.Fprintf(w, "Ended: %s\n", *status.EndedAt)
+	}
+	if status.UptimeSecs > 0 {
+		fmt.Fprintf(w, "Uptime: %s\n", time.Duration(status.UptimeSecs)*time.Second)
+	}
+	if status.OutputBytes > 0 {
+		fmt.Fprintf(w, "Output: %d bytes\n", status.OutputBytes)
+	}
+	if status.Running && ctl.Client.IsZombie() {
+		// The daemon died while the process ran
+		fmt.Fprintf(w, "Daemon Lost: status last written %s\n", status.UpdatedAt)
+	}
+	fmt.Fprintf(w, "Command: %v\n", status.Command)
+	fmt.Fprintf(w, "Has VTY: %v\n", status.HasVTY)
+	if cg := status.Cgroup; cg != nil {
+		fmt.Fprintf(w, "Cgroup: %s\n", cg.Path)
+		fmt.Fprintf(w, "CPU Time: %s (user %s, system %s)\n", time.Duration(cg.CPUUsageUsec)*time.Microsecond,
+			time.Duration(cg.CPUUserUsec)*time.Microsecond, time.Duration(cg.CPUSystemUsec)*time.Microsecond)
+		if cg.MemoryCurrent > 0 || cg.MemoryMax > 0 {
+			fmt.Fprintf(w, "Memory: %d bytes (peak %d, max %s)\n", cg.MemoryCurrent, cg.MemoryPeak, limit(cg.MemoryMax))
+		}
+		if cg.OOMKills > 0 {
+			fmt.Fprintf(w, "OOM Kills: %d\n", cg.OOMKills)
+		}
+		if cg.PidsCurrent > 0 || cg.PidsMax > 0 {
+			fmt.Fprintf(w, "Processes: %d (max %s)\n", cg.PidsCurrent, limit(cg.PidsMax))
+		}
+	}
+	if status.Title != "" {
+		fmt.Fprintf(w, "Title: %s\n", status.Title)
+	}
+	if status.Recording {
+		fmt.Fprintln(w, "Recording: yes")
+	}
+	if fg := status.Foreground; fg != nil {
+		switch {
+		case len(fg.Command) > 0:
+			fmt.Fprintf(w, "Foreground: %s (pid %d)\n", strings.Join(fg.Command, " "), fg.PID)
+		case fg.Name != "":
+			fmt.Fprintf(w, "Foreground: %s (pid %d)\n", fg.Name, fg.PID)
+		default:
+			fmt.Fprintf(w, "Foreground: pid %d\n", fg.PID)
+		}
+	}
+	if len(status.UnsupportedSequences) > 0 {
+		fmt.Fprintf(w, "Unsupported Sequences: %s\n", termemu.UnsupportedSummary(status.UnsupportedSequences))
+	}
+	if len(status.Clients) > 0 {
+		fmt.Fprintf(w, "Clients: %d\n", len(status.Clients))
+		for _, client := range status.Clients {
+			peer := ""
+			if client.PeerUID != nil {
+				peer = fmt.Sprintf(" pid=%d uid=%d", client.PeerPID, *client.PeerUID)
+			} else if client.Remote != "" {
+				peer = " remote=" + client.Remote
+			}
+			if client.Exclusive {
+				peer += " exclusive"
+			}
+			fmt.Fprintf(w, "  #%d%s attached=%v in=%d out=%d queue=%d dropped=%d\n", client.ID, peer,
+				client.Attached, client.BytesIn, client.BytesOut, client.QueueDepth, client.Dropped)
+		}
+	}
+	if status.Panic != "" {
+		fmt.Fprintf(w, "Daemon Panic: %s\n", status.Panic)
+	}
+	if status.PreviousRun != "" {
+		fmt.Fprintf(w, "Previous Run: %s\n", status.PreviousRun)
+	}
+	if status.NextRun != "" {
+		fmt.Fprintf(w, "Next Run: %s\n", status.NextRun)
+	}
+	if status.Checkpoint != "" {
+		fmt.Fprintf(w, "Checkpoint: %s\n", status.Checkpoint)
+	}
+	if status.RestoredFrom != "" {
+		fmt.Fprintf(w, "Restored From: %s\n", status.RestoredFrom)
+	}
+
+	return nil
+}
+
+// Capabilities shows what the daemon supports
+func (ctl *Controller) Capabilities() error {
+	caps, err := ctl.Client.GetCapabilities()
+	if err != nil {
+		return err
+	}
+	if ctl.JSON {
+		return ctl.writeJSON(caps)
+	}
+
+	w := ctl.Out
+	fmt.Fprintf(w, "Protocol Version: %d\n", caps.Version)
+	fmt.Fprintf(w, "Messages: %s\n", strings.Join(caps.Messages, ", "))
+	fmt.Fprintf(w, "Export Formats: %s\n", strings.Join(caps.ExportFormats, ", "))
+	fmt.Fprintf(w, "Wait Types: %s\n", strings.Join(caps.WaitTypes, ", "))
+	fmt.Fprintf(w, "Features: %s\n", strings.Join(caps.Features, ", "))
+	if len(caps.Permissions) > 0 {
+		fmt.Fprintf(w, "Permissions: %s\n", strings.Join(caps.Permissions, ", "))
+	}
+	return nil
+}
+
+// ErrUnhealthy is returned by Health when a check failed, so that
+// supervisors can test the daemon through the exit status
+var ErrUnhealthy = errors.New("daemon is unhealthy")
+
+// Health shows the internal health of the daemon, one check per line
+func (ctl *Controller) Health() error {
+	health, err := ctl.Client.Health()
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		if err := ctl.writeJSON(health); err != nil {
+			return err
+		}
+	} else {
+		w := ctl.Out
+		if health.Healthy {
+			fmt.Fprintln(w, "Daemon: healthy")
+		} else {
+			fmt.Fprintln(w, "Daemon: unhealthy")
+		}
+		for _, check := range health.Checks {
+			result := "ok"
+			if !check.OK {
+				result = "FAILED"
+			}
+			if check.Detail != "" {
+				result += " (" + check.Detail + ")"
+			}
+			fmt.Fprintf(w, "  %s: %s\n", check.Name, result)
+		}
+	}
+	if !health.Healthy {
+		return ErrUnhealthy
+	}
+	return nil
+}
+
+// Ping measures the round trip time to the daemon
+func (ctl *Controller) Ping() error {
+	latency, err := ctl.Client.Ping()
+	if err != nil {
+		return err
+	}
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]float64{"latency_ms": float64(latency) / float64(time.Millisecond)})
+	}
+	fmt.Fprintf(ctl.Out, "Pong from daemon in %s\n", latency)
+	return nil
+}
+
+// Events streams the lifecycle events of the daemon until the process
+// exits, one per line, as JSON lines with JSON
+func (ctl *Controller) Events() error {
+	if err := ctl.Client.SetHeartbeat(bgclient.DefaultHeartbeatInterval); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return err
+	}
+	events, err := ctl.Client.Subscribe()
+	if err != nil {
+		return err
+	}
+
+	for ev := range events {
+		if ctl.JSON {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if _, err := ctl.Out.Write(append(data, '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(ctl.Out, "%s %s\n", ev.Time.Local().Format("15:04:05.000"), describeEvent(ev))
+	}
+	return nil
+}
+
+// Expect sets rules answering the output matching each pattern with its
+// input, and shows the matches until the process exits. With JSON, each
+// match is written as one JSON object per line.
+func (ctl *Controller) Expect(rules []protocol.ExpectRule) error {
+	if err := ctl.Client.SetHeartbeat(bgclient.DefaultHeartbeatInterval); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return err
+	}
+	matches, err := ctl.Client.Expect(rules)
+	if err != nil {
+		return err
+	}
+
+	for match := range matches {
+		if ctl.JSON {
+			data, err := json.Marshal(match)
+			if err != nil {
+				return err
+			}
+			if _, err := ctl.Out.Write(append(data, '\n')); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(ctl.Out, "%s matched %q, sent %q\n", match.Time.Local().Format("15:04:05.000"), match.Text, rules[match.Rule].Send)
+	}
+	return nil
+}
+
+// ParseExpectRules returns the rules given as pattern and input pairs on
+// the command line. The input may hold Go escape sequences, such as \n or
+// \x03.
+func ParseExpectRules(args []string) ([]protocol.ExpectRule, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("expect needs pairs of pattern and input")
+	}
+	var rules []protocol.ExpectRule
+	for i := 0; i < len(args); i += 2 {
+		send, err := strconv.Unquote(`"` + strings.ReplaceAll(args[i+1], `"`, `\"`) + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input %q: %w", args[i+1], err)
+		}
+		rules = append(rules, protocol.ExpectRule{Pattern: args[i], Send: send})
+	}
+	return rules, nil
+}
+
+// describeEvent returns the text shown for an event
+func describeEvent(ev *protocol.Event) string {
+	switch ev.Type {
+	case protocol.EventStarted:
+		return fmt.Sprintf("started, pid %d", ev.PID)
+	case protocol.EventExited:
+		if ev.ExitCode != nil {
+			return fmt.Sprintf("exited with code %d", *ev.ExitCode)
+		}
+		return "exited"
+	case protocol.EventResized:
+		return fmt.Sprintf("resized to %dx%d", ev.Cols, ev.Rows)
+	case protocol.EventTitle:
+		return fmt.Sprintf("title set to %q", ev.Title)
+	case protocol.EventForeground:
+		return fmt.Sprintf("process group %d in the foreground", ev.Pgrp)
+	case protocol.EventAttached:
+		return fmt.Sprintf("client %d attached", ev.Client)
+	case protocol.EventDetached:
+		return fmt.Sprintf("client %d detached", ev.Client)
+	case protocol.EventPaused:
+		return "paused"
+	case protocol.EventResumed:
+		return "resumed"
+	case protocol.EventHealth:
+		if ev.Error != "" {
+			return fmt.Sprintf("%s: %s", ev.Health, ev.Error)
+		}
+		return ev.Health
+	case protocol.EventThrottled:
+		return fmt.Sprintf("output throttled to %d bytes/s", ev.Rate)
+	default:
+		return ev.Type
+	}
+}
+
+// SendFile has the daemon write a file to the process stdin, closing it
+// afterwards with closeStdin, and shows the progress. With JSON, each
+// progress report is written as one JSON object per line, the last one
+// being done.
+func (ctl *Controller) SendFile(path string, closeStdin bool) error {
+	sent, err := ctl.Client.WriteStdinFile(path, closeStdin, func(p *protocol.StdinFileProgress) {
+		switch {
+		case ctl.JSON:
+			if data, err := json.Marshal(p); err == nil {
+				ctl.Out.Write(append(data, '\n'))
+			}
+		case p.Done:
+		case p.Size > 0:
+			fmt.Fprintf(ctl.Out, "Sent %d of %d bytes (%d%%)\n", p.Sent, p.Size, p.Sent*100/p.Size)
+		default:
+			fmt.Fprintf(ctl.Out, "Sent %d bytes\n", p.Sent)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ctl.JSON {
+		fmt.Fprintf(ctl.Out, "Sent %s to stdin (%d bytes)\n", path, sent)
+	}
+	return nil
+}
+
+// ParseSendFile parses the arguments of the send-file command: an optional
+// -close to close stdin after the file, and the path
+func ParseSendFile(args []string) (path string, closeStdin bool, err error) {
+	if len(args) > 0 && args[0] == "-close" {
+		closeStdin = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return "", false, errors.New("file path required (send-file [-close] <path>)")
+	}
+	return args[0], closeStdin, nil
+}
+
+// Checkpoint checkpoints the process with CRIU and shows the directory of
+// the checkpoint
+func (ctl *Controller) Checkpoint(leaveRunning bool) error {
+	dir, err := ctl.Client.Checkpoint(leaveRunning)
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(protocol.CheckpointResponse{Dir: dir})
+	}
+	fmt.Fprintf(ctl.Out, "Checkpointed to %s\n", dir)
+	return nil
+}
+
+// ParseAttach parses the arguments of the attach command: -d to detach the
+// other clients, as tmux attach -d, and -forward-signals to send Ctrl+C to
+// the process
+func ParseAttach(args []string) (opts AttachOptions, err error) {
+	for _, arg := range args {
+		switch arg {
+		case "-d":
+			opts.Exclusive = true
+		case "-forward-signals":
+			opts.ForwardSignals = true
+		default:
+			return AttachOptions{}, fmt.Errorf("unexpected argument %q (attach [-d] [-forward-signals])", arg)
+		}
+	}
+	return opts, nil
+}
+
+// ParseCheckpoint parses the arguments of the checkpoint command: an
+// optional -leave-running to keep the process running
+func ParseCheckpoint(args []string) (leaveRunning bool, err error) {
+	for _, arg := range args {
+		if arg != "-leave-running" {
+			return false, fmt.Errorf("unexpected argument %q (checkpoint [-leave-running])", arg)
+		}
+		leaveRunning = true
+	}
+	return leaveRunning, nil
+}
+
+// LogLevel shows the level of the daemon log, after changing it to level
+// if not empty
+func (ctl *Controller) LogLevel(level string) error {
+	current, err := ctl.Client.SetLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]string{"log_level": current})
+	}
+	fmt.Fprintf(ctl.Out, "Log level: %s\n", current)
+	return nil
+}
+
+// Signal sends sig to the process
+func (ctl *Controller) Signal(sig syscall.Signal) error {
+	if err := ctl.Client.SendSignal(sig); err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]int{"signal": int(sig)})
+	}
+	fmt.Fprintf(ctl.Out, "Signal %d sent successfully\n", sig)
+	return nil
+}
+
+// Pause stops the process group, or continues it when pause is false
+func (ctl *Controller) Pause(pause bool) error {
+	action, state := ctl.Client.Resume, "resumed"
+	if pause {
+		action, state = ctl.Client.Pause, "paused"
+	}
+	if err := action(); err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]string{"result": state})
+	}
+	fmt.Fprintf(ctl.Out, "Process %s\n", state)
+	return nil
+}
+
+// waitResults names the wait statuses in JSON output
+var waitResults = map[byte]string{
+	protocol.WaitStatusCompleted:     "completed",
+	protocol.WaitStatusTimeout:       "timeout",
+	protocol.WaitStatusNotApplicable: "not_applicable",
+}
+
+// Wait waits for the process to exit or, with "foreground", for the
+// program to wait for input
+func (ctl *Controller) Wait(waitTypeStr string, timeoutSecs uint32) error {
+	var waitType byte
+	switch waitTypeStr {
+	case "exit":
+		waitType = protocol.WaitTypeExit
+	case "foreground":
+		waitType = protocol.WaitTypeForeground
+	default:
+		return fmt.Errorf("invalid wait type: %s (must be 'exit' or 'foreground')", waitTypeStr)
+	}
+
+	if !ctl.JSON {
+		fmt.Fprintf(ctl.Out, "Waiting for %s (%s)...\n", waitTypeStr, describeTimeout(timeoutSecs))
+	}
+
+	status, err := ctl.Client.Wait(timeoutSecs, waitType)
+	if err != nil {
+		return err
+	}
+
+	return ctl.waitResult(status, "Wait type not applicable (e.g., foreground wait on non-VTY process)")
+}
+
+// WaitPattern waits for a regular expression to appear in the output, or
+// the screen of a VTY process. Like Search, it returns ErrNoMatch when the
+// wait did not complete, so that scripts can test it through the exit
+// status.
+func (ctl *Controller) WaitPattern(pattern string, timeoutSecs uint32) error {
+	if !ctl.JSON {
+		fmt.Fprintf(ctl.Out, "Waiting for %q (%s)...\n", pattern, describeTimeout(timeoutSecs))
+	}
+
+	status, err := ctl.Client.WaitForPattern(timeoutSecs, pattern)
+	if err != nil {
+		return err
+	}
+
+	if err := ctl.waitResult(status, "Process exited without printing the pattern"); err != nil {
+		return err
+	}
+	if status != protocol.WaitStatusCompleted {
+		return ErrNoMatch
+	}
+	return nil
+}
+
+// WaitQuiet waits for the output to stay idle, with "idle", or the screen
+// of a VTY process to stay unchanged, with "stable", for the quiet period,
+// so that automation knows when a program is done updating
+func (ctl *Controller) WaitQuiet(waitTypeStr string, quiet time.Duration, timeoutSecs uint32) error {
+	var wait func(uint32, time.Duration) (byte, error)
+	switch waitTypeStr {
+	case "idle":
+		wait = ctl.Client.WaitForOutputIdle
+	case "stable":
+		wait = ctl.Client.WaitForScreenStable
+	default:
+		return fmt.Errorf("invalid wait type: %s (must be 'idle' or 'stable')", waitTypeStr)
+	}
+
+	if !ctl.JSON {
+		fmt.Fprintf(ctl.Out, "Waiting for %s for %v (%s)...\n", waitTypeStr, quiet, describeTimeout(timeoutSecs))
+	}
+
+	status, err := wait(timeoutSecs, quiet)
+	if err != nil {
+		return err
+	}
+
+	return ctl.waitResult(status, "Wait type not applicable (e.g., stable wait on non-VTY process)")
+}
+
+// describeTimeout describes the timeout of a wait, 0 waiting forever
+func describeTimeout(timeoutSecs uint32) string {
+	if timeoutSecs == 0 {
+		return "no timeout"
+	}
+	return fmt.Sprintf("timeout: %d seconds", timeoutSecs)
+}
+
+// waitResult shows the status of a wait, with the message given for
+// WaitStatusNotApplicable
+func (ctl *Controller) waitResult(status byte, notApplicable string) error {
+	if ctl.JSON {
+		result, ok := waitResults[status]
+		if !ok {
+			result = fmt.Sprintf("unknown (%d)", status)
+		}
+		return ctl.writeJSON(map[string]string{"result": result})
+	}
+
+	switch status {
+	case protocol.WaitStatusCompleted:
+		fmt.Fprintln(ctl.Out, "Wait completed successfully")
+	case protocol.WaitStatusTimeout:
+		fmt.Fprintln(ctl.Out, "Wait timed out")
+	case protocol.WaitStatusNotApplicable:
+		fmt.Fprintln(ctl.Out, notApplicable)
+	default:
+		fmt.Fprintf(ctl.Out, "Unknown wait status: %d\n", status)
+	}
+
+	return nil
+}
+
+// Shutdown stops the daemon
+func (ctl *Controller) Shutdown() error {
+	if err := ctl.Client.Shutdown(); err != nil {
+		// Connection might close before we get a response, which is OK
+		if err != io.EOF {
+			return err
+		}
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]bool{"shutdown": true})
+	}
+	fmt.Fprintln(ctl.Out, "Shutdown request sent")
+	return nil
+}
+
+// Commands lists the commands run at the shell prompt of the terminal
+func (ctl *Controller) Commands() error {
+	commands, err := ctl.Client.GetCommands()
+	if err != nil {
+		return err
+	}
+	if ctl.JSON {
+		if commands == nil {
+			commands = []protocol.CommandInfo{}
+		}
+		return ctl.writeJSON(commands)
+	}
+
+	if len(commands) == 0 {
+		fmt.Fprintln(ctl.Out, "No commands recorded (the shell must emit OSC 133 marks)")
+		return nil
+	}
+
+	for _, cmd := range commands {
+		status := "running"
+		if cmd.FinishedAt != nil {
+			status = "done"
+			if cmd.ExitCode != nil {
+				status = fmt.Sprintf("exit %d", *cmd.ExitCode)
+			}
+		}
+		fmt.Fprintf(ctl.Out, "%4d  %-20s  %-8s  %s\n", cmd.Index, cmd.StartedAt, status, cmd.Command)
+	}
+	return nil
+}
+
+// CommandOutput shows the output of a command, negative indexes counting
+// from the last one
+func (ctl *Controller) CommandOutput(index int) error {
+	output, err := ctl.Client.GetCommandOutput(index, protocol.ExportFormatPlainText)
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]any{"index": index, "output": output})
+	}
+	_, err = io.WriteString(ctl.Out, output)
+	return err
+}
+
+// ErrNoMatch is returned by Search when the pattern was not found, and by
+// WaitPattern when it did not appear, so that scripts can test it like grep
+// through the exit status
+var ErrNoMatch = errors.New("no match")
+
+// Search shows the matches of a regular expression in the screen and
+// scrollback, as row:col: text lines. Scrollback rows are negative.
+func (ctl *Controller) Search(pattern string, ignoreCase bool) error {
+	matches, err := ctl.Client.Search(&protocol.SearchRequest{
+		Pattern:           pattern,
+		IncludeScrollback: true,
+		IgnoreCase:        ignoreCase,
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		if err := ctl.writeJSON(protocol.SearchResponse{Matches: matches}); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range matches {
+			fmt.Fprintf(ctl.Out, "%d:%d: %s\n", m.Row, m.Col, m.Text)
+		}
+	}
+	if len(matches) == 0 {
+		return ErrNoMatch
+	}
+	return nil
+}
+
+// ParseSearch parses the arguments of the search command: an optional -i
+// for a case-insensitive search, and the pattern
+func ParseSearch(args []string) (pattern string, ignoreCase bool, err error) {
+	if len(args) > 0 && args[0] == "-i" {
+		ignoreCase = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return "", false, errors.New("search pattern required (search [-i] <pattern>)")
+	}
+	return args[0], ignoreCase, nil
+}
+
+// Record starts or stops recording the session
+func (ctl *Controller) Record(start bool) error {
+	var err error
+	if start {
+		err = ctl.Client.StartRecording()
+	} else {
+		err = ctl.Client.StopRecording()
+	}
+	if err != nil {
+		return err
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(map[string]bool{"recording": start})
+	}
+	if !start {
+		fmt.Fprintln(ctl.Out, "Recording stopped")
+		return nil
+	}
+	fmt.Fprintf(ctl.Out, "Recording to %s\n", filepath.Join(ctl.Client.RuntimeDir(), "session.cast"))
+	return nil
+}
+
+// Recording writes the asciinema recording of the session. It is JSON
+// lines already, so it is written as is in both modes.
+func (ctl *Controller) Recording() error {
+	data, err := ctl.Client.GetRecording()
+	if err != nil {
+		return err
+	}
+
+	_, err = ctl.Out.Write(data)
+	return err
+}
+
+// Timeline writes the timeline of the recorded session, JSON lines written
+// as is in both modes
+func (ctl *Controller) Timeline() error {
+	data, err := ctl.Client.GetTimeline()
+	if err != nil {
+		return err
+	}
+
+	_, err = ctl.Out.Write(data)
+	return err
+}
+
+// Replay plays the recording of the session back at speed times its
+// original pace. The output is written as is in both modes.
+func (ctl *Controller) Replay(speed float64) error {
+	return ctl.Client.Replay(speed, func(data []byte) error {
+		_, err := ctl.Out.Write(data)
+		return err
+	})
+}
+
+// AttachOptions are the options of the attach commands
+type AttachOptions struct {
+	// Exclusive detaches the other clients and refuses their input while
+	// attached, as tmux attach -d
+	Exclusive bool
+
+	// ForwardSignals sends the SIGINT and SIGQUIT received, from Ctrl+C and
+	// Ctrl+\, to the process instead of exiting, when the terminal is not
+	// attached to a VTY process. Two within a second detach.
+	ForwardSignals bool
+}
+
+// Attach streams the process output until it exits, as one AttachRecord
+// per line with JSON
+func (ctl *Controller) Attach(opts AttachOptions) (err error) {
+	if err := ctl.Client.SetHeartbeat(bgclient.DefaultHeartbeatInterval); err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+		return err
+	}
+	enc := json.NewEncoder(ctl.Out)
+	if ctl.JSON {
+		// Other clients attaching, detaching and resizing the terminal are
+		// recorded too, older daemons do without
+		err := ctl.Client.SetNoticeHandler(func(ev *protocol.Event) {
+			enc.Encode(AttachRecord{Time: ev.Time.UTC(), Event: ev})
+		})
+		if err != nil && !errors.Is(err, bgclient.ErrNotSupported) {
+			return err
+		}
+	}
+	attach := ctl.Client.Attach
+	if opts.Exclusive {
+		attach = ctl.Client.AttachExclusive
+	}
+	if err := attach(protocol.StreamBoth); err != nil {
+		return err
+	}
+	if opts.ForwardSignals {
+		detached, stop := ctl.forwardSignals()
+		defer func() {
+			stop()
+			if detached.Load() {
+				err = nil
+				if !ctl.JSON {
+					fmt.Fprintln(ctl.Out, "\n---\nDetached")
+				}
+			}
+		}()
+	}
+
+	if ctl.JSON {
+		return ctl.attachJSON(enc)
+	}
+
+	if opts.ForwardSignals {
+		fmt.Fprintln(ctl.Out, "Attached to process output (Ctrl+C is sent to the process, press it twice to detach)")
+	} else {
+		fmt.Fprintln(ctl.Out, "Attached to process output (press Ctrl+C to detach)")
+	}
+	fmt.Fprintln(ctl.Out, "---")
+
+	return ctl.Client.ReadMessages(
+		func(stream byte, data []byte) error {
+			if stream == protocol.StreamStderr && ctl.Err != nil {
+				ctl.Err.Write(data)
+			} else {
+				ctl.Out.Write(data)
+			}
+			return nil
+		},
+		func(exitCode int) {
+			fmt.Fprintf(ctl.Out, "\n---\nProcess exited with code %d\n", exitCode)
+		},
+	)
+}
+
+// AttachRecord is one line of the output of attach with JSON: a chunk of
+// output, another client attaching, detaching or resizing the terminal, or
+// the exit of the process
+type AttachRecord struct {
+	Time     time.Time       `json:"ts"`
+	Stream   string          `json:"stream,omitempty"` // stdout or stderr
+	Data     []byte          `json:"data,omitempty"`   // base64 encoded
+	Event    *protocol.Event `json:"event,omitempty"`
+	ExitCode *int            `json:"exit_code,omitempty"`
+}
+
+// attachJSON streams the output as one AttachRecord per line to enc, stdout
+// and stderr both
+func (ctl *Controller) attachJSON(enc *json.Encoder) error {
+	return ctl.Client.ReadMessages(
+		func(stream byte, data []byte) error {
+			rec := AttachRecord{Time: time.Now().UTC(), Stream: "stdout", Data: data}
+			if stream == protocol.StreamStderr {
+				rec.Stream = "stderr"
+			}
+			return enc.Encode(rec)
+		},
+		func(exitCode int) {
+			enc.Encode(AttachRecord{Time: time.Now().UTC(), ExitCode: &exitCode})
+		},
+	)
+}
+
+// Run is one run in a job's retry history
+type Run struct {
+	Run        int                      `json:"run"`
+	Current    bool                     `json:"current"`
+	RuntimeDir string                   `json:"runtime_dir"`
+	Status     *protocol.StatusResponse `json:"status"` // nil if the run is gone
+}
+
+// Runs lists the run history of a retried job
+func (ctl *Controller) Runs() error {
+	status, err := ctl.Client.GetStatus()
+	if err != nil {
+		return err
+	}
+
+	current := ctl.Client.RuntimeDir()
+	runs := []Run{{RuntimeDir: current, Current: true, Status: status}}
+	seen := map[string]bool{current: true}
+
+	// Walk back through previous runs, then forward through next runs
+	for dir := status.PreviousRun; dir != "" && !seen[dir]; {
+		seen[dir] = true
+		run := Run{RuntimeDir: dir, Status: loadRunStatus(dir)}
+		runs = append([]Run{run}, runs...)
+		if run.Status == nil {
+			break
+		}
+		dir = run.Status.PreviousRun
+	}
+	for dir := status.NextRun; dir != "" && !seen[dir]; {
+		seen[dir] = true
+		run := Run{RuntimeDir: dir, Status: loadRunStatus(dir)}
+		runs = append(runs, run)
+		if run.Status == nil {
+			break
+		}
+		dir = run.Status.NextRun
+	}
+	for i := range runs {
+		runs[i].Run = i + 1
+	}
+
+	if ctl.JSON {
+		return ctl.writeJSON(runs)
+	}
+
+	w := tabwriter.NewWriter(ctl.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tSTATE\tSTARTED\tRUNTIME DIR")
+	for _, run := range runs {
+		marker := " "
+		if run.Current {
+			marker = "*"
+		}
+		state, started := "unavailable", "-"
+		if run.Status != nil {
+			started = run.Status.StartedAt
+			switch {
+			case run.Status.Running:
+				state = "running"
+			case run.Status.ExitCode != nil:
+				state = fmt.Sprintf("exited (%d)", *run.Status.ExitCode)
+			default:
+				state = "stopped"
+			}
+		}
+		fmt.Fprintf(w, "%s%d\t%s\t%s\t%s\n", marker, run.Run, state, started, run.RuntimeDir)
+	}
+	return w.Flush()
+}
+
+// loadRunStatus returns the status of the run in dir, or nil if it is gone
+func loadRunStatus(dir string) *protocol.StatusResponse {
+	c, err := bgclient.NewFromRuntimeDir(dir)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+
+	status, err := c.GetStatus()
+	if err != nil {
+		return nil
+	}
+	return status
+}
+
+// ParseSpeed parses the optional speed argument of the replay command
+func ParseSpeed(args []string) (float64, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	speed, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed: %s", args[0])
+	}
+	return speed, nil
+}
+
+// listDaemons lists the daemons of the user, or of all users as root
+func listDaemons(action string, allUsers bool) ([]bgclient.DaemonInfo, error) {
+	if !allUsers {
+		return bgclient.ListDaemons()
+	}
+	daemons, err := bgclient.ListAllDaemons()
+	if err == nil {
+		audit(action, nil)
+	}
+	return daemons, err
+}
+
+// List shows the daemons found in the runtime roots, those of every user
+// with allUsers
+func List(out io.Writer, asJSON, allUsers bool) error {
+	daemons, err := listDaemons("list", allUsers)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		if daemons == nil {
+			daemons = []bgclient.DaemonInfo{}
+		}
+		data, err := json.MarshalIndent(daemons, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if allUsers {
+		fmt.Fprint(w, "USER\t")
+	}
+	fmt.Fprintln(w, "PID\tSTATE\tCOMMAND")
+	for _, d := range daemons {
+		state := "terminated"
+		if d.Running {
+			state = "running"
+		}
+		if allUsers {
+			fmt.Fprintf(w, "%s\t", d.User)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%v\n", d.PID, state, d.Command)
+	}
+	return w.Flush()
+}
+
+// Ps shows the daemons found in the runtime roots with the status each
+// one reports, flagging the zombies left to reap; those of every user with
+// allUsers
+func Ps(out io.Writer, asJSON, allUsers bool) error {
+	daemons, err := listDaemons("ps", allUsers)
+	if err != nil {
+		return err
+	}
+	sessions := bgclient.Probe(daemons, bgclient.DefaultProbeTimeout)
+
+	if asJSON {
+		if sessions == nil {
+			sessions = []bgclient.Session{}
+		}
+		data, err := json.MarshalIndent(sessions, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if allUsers {
+		fmt.Fprint(w, "USER\t")
+	}
+	fmt.Fprintln(w, "NAME\tPID\tSTATE\tUPTIME\tCOMMAND")
+	for _, s := range sessions {
+		if allUsers {
+			fmt.Fprintf(w, "%s\t", s.User)
+		}
+		state := s.State
+		if s.ExitCode != nil && (s.State == bgclient.SessionZombie || s.State == bgclient.SessionExited) {
+			state += fmt.Sprintf(" (%d)", *s.ExitCode)
+		}
+		uptime := "-"
+		if !s.StartedAt.IsZero() {
+			uptime = s.Uptime.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", s.Name, s.PID, state, uptime, strings.Join(s.Command, " "))
+	}
+	return w.Flush()
+}
+
+// supervisorSocket returns socket, or the default socket of bgrund if empty
+func supervisorSocket(socket string) string {
+	if socket == "" {
+		return bgclient.SupervisorSocket()
+	}
+	return socket
+}
+
+// Jobs runs a job action on the bgrund supervisor listening on socket (the
+// default socket if empty), showing the jobs concerned
+func Jobs(out io.Writer, socket string, req *protocol.JobRequest, asJSON bool) error {
+	jobs, err := bgclient.JobControl(supervisorSocket(socket), req)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(jobs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tREADY\tHEALTH\tPID\tRESTARTS\tEXIT")
+	for _, job := range jobs {
+		pid, exit, ready, health := "-", "-", "no", "-"
+		if job.Ready {
+			ready = "yes"
+		}
+		if job.PID > 0 && job.State != protocol.JobFailed {
+			pid = strconv.Itoa(job.PID)
+		}
+		if job.Health != "" {
+			health = job.Health
+		}
+		if job.ExitCode != nil {
+			exit = strconv.Itoa(*job.ExitCode)
+		}
+		if job.Error != "" {
+			exit = job.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", job.Name, job.State, ready, health, pid, job.Restarts, exit)
+	}
+	return w.Flush()
+}
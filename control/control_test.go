@@ -0,0 +1,262 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestControllerJSON(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: daemon.IOModeNull,
+		StderrMode: daemon.IOModeNull,
+		RuntimeDir: filepath.Join(t.TempDir(), "job"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+
+	if _, err := Connect(Target{}); err == nil {
+		t.Error("Expected an error without a target")
+	}
+
+	// Daemons of other tests running in parallel may share the runtime
+	// root, so target this one by PID
+	c, err := Connect(Target{PID: os.Getpid()})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	var out bytes.Buffer
+	ctl := &Controller{Client: c, Out: &out, JSON: true}
+
+	if err := ctl.Status(); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	var status protocol.StatusResponse
+	if err := json.Unmarshal(out.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid status JSON %q: %v", out.String(), err)
+	}
+	if !status.Running || len(status.Command) != 2 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	out.Reset()
+	if err := ctl.Runs(); err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	var runs []Run
+	if err := json.Unmarshal(out.Bytes(), &runs); err != nil {
+		t.Fatalf("Invalid runs JSON %q: %v", out.String(), err)
+	}
+	if len(runs) != 1 || !runs[0].Current || runs[0].RuntimeDir != c.RuntimeDir() {
+		t.Errorf("Unexpected runs %+v", runs)
+	}
+
+	out.Reset()
+	if err := List(&out, true, false); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var daemons []struct {
+		PID int `json:"pid"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &daemons); err != nil {
+		t.Fatalf("Invalid list JSON %q: %v", out.String(), err)
+	}
+	found := 0
+	for _, info := range daemons {
+		if info.PID == os.Getpid() {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("Expected this daemon to be listed once, got %+v", daemons)
+	}
+
+	// As root, the daemons of every user are reachable, and audited
+	if os.Geteuid() == 0 {
+		var auditLog bytes.Buffer
+		AuditWriter = &auditLog
+		defer func() { AuditWriter = nil }()
+
+		out.Reset()
+		if err := List(&out, false, true); err != nil {
+			t.Fatalf("List of all users failed: %v", err)
+		}
+		if !strings.HasPrefix(out.String(), "USER") || !strings.Contains(out.String(), "root") {
+			t.Errorf("Expected the owners to be listed, got %q", out.String())
+		}
+		other, err := Connect(Target{PID: os.Getpid(), AllUsers: true, Action: "status"})
+		if err != nil {
+			t.Fatalf("Connect among all users failed: %v", err)
+		}
+		other.Close()
+		if got := auditLog.String(); !strings.Contains(got, "action=list") || !strings.Contains(got, fmt.Sprintf("action=status pid=%d user=root", os.Getpid())) {
+			t.Errorf("Unexpected audit log %q", got)
+		}
+	}
+
+	out.Reset()
+	if err := ctl.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if out.String() != "{\n  \"shutdown\": true\n}\n" {
+		t.Errorf("Unexpected shutdown output %q", out.String())
+	}
+}
+
+func TestAttachJSON(t *testing.T) {
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"sh", "-c", "sleep 0.2; echo out; sleep 0.1; echo err >&2; exit 3"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		RuntimeDir: filepath.Join(t.TempDir(), "job"),
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	c, err := Connect(Target{Socket: d.SocketPath()})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	var out bytes.Buffer
+	ctl := &Controller{Client: c, Out: &out, JSON: true}
+	if err := ctl.Attach(AttachOptions{}); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+
+	var records []AttachRecord
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var rec AttachRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Invalid record %q: %v", line, err)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("Record %q has no time", line)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %q", out.String())
+	}
+	if records[0].Stream != "stdout" || string(records[0].Data) != "out\n" {
+		t.Errorf("Unexpected stdout record %+v", records[0])
+	}
+	if records[1].Stream != "stderr" || string(records[1].Data) != "err\n" {
+		t.Errorf("Unexpected stderr record %+v", records[1])
+	}
+	if records[2].ExitCode == nil || *records[2].ExitCode != 3 || records[2].Stream != "" {
+		t.Errorf("Unexpected exit record %+v", records[2])
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitOutput waits for out to hold s
+func waitOutput(t *testing.T, out *syncBuffer, s string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q in the output, got %q", s, out.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAttachForwardSignals(t *testing.T) {
+	d, err := daemon.New(&daemon.Config{
+		Command:    []string{"sh", "-c", "trap 'echo got INT' INT; while :; do sleep 0.05; done"},
+		StdoutMode: daemon.IOModeLog,
+		StderrMode: daemon.IOModeLog,
+		RuntimeDir: filepath.Join(t.TempDir(), "job"),
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	c, err := Connect(Target{Socket: d.SocketPath()})
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	var out, msgs syncBuffer
+	ctl := &Controller{Client: c, Out: &out, Err: &msgs}
+	errCh := make(chan error, 1)
+	go func() { errCh <- ctl.Attach(AttachOptions{ForwardSignals: true}) }()
+
+	// SIGINT kills the test unless forwarded, so wait for the attachment
+	waitOutput(t, &out, "press it twice to detach")
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	waitOutput(t, &out, "got INT")
+	waitOutput(t, &msgs, "press again within a second to detach")
+
+	// Pressed twice, the client detaches and the process keeps running
+	time.Sleep(doublePress)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Attach failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a double press to detach")
+	}
+	if !strings.HasSuffix(out.String(), "Detached\n") {
+		t.Errorf("Expected the client to be detached, got %q", out.String())
+	}
+	select {
+	case <-d.Done():
+		t.Error("Expected the process to keep running")
+	default:
+	}
+}
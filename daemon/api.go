@@ -0,0 +1,444 @@
+package daemon
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// apiConnKey holds the connection of an HTTP request in its context, for
+// the peer credentials of Unix socket clients
+type apiConnKey struct{}
+
+// apiPermsKey holds what the client of an HTTP request may do in its
+// context
+type apiPermsKey struct{}
+
+// apiWaitTypes names the wait types of POST /wait, as the wait command does
+var apiWaitTypes = map[string]byte{
+	"exit":       protocol.WaitTypeExit,
+	"foreground": protocol.WaitTypeForeground,
+	"pattern":    protocol.WaitTypePattern,
+	"idle":       protocol.WaitTypeOutputIdle,
+	"stable":     protocol.WaitTypeScreenStable,
+}
+
+// waitResultNames names the wait statuses in the answers of POST /wait
+var waitResultNames = map[byte]string{
+	protocol.WaitStatusCompleted:     "completed",
+	protocol.WaitStatusTimeout:       "timeout",
+	protocol.WaitStatusNotApplicable: "not_applicable",
+}
+
+// APIWaitRequest is the body of POST /wait. Timeout is in seconds, 0
+// waiting forever; Pattern is for the pattern type, QuietMillis for idle
+// and stable.
+type APIWaitRequest struct {
+	Type        string `json:"type"`
+	Timeout     uint32 `json:"timeout"`
+	Pattern     string `json:"pattern,omitempty"`
+	QuietMillis uint32 `json:"quiet_ms,omitempty"`
+}
+
+// APISignalRequest is the body of POST /signal
+type APISignalRequest struct {
+	Signal int `json:"signal"`
+}
+
+// apiError is an error answered with its HTTP status
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// startAPIServer starts the listener of the REST API, if configured: a
+// Unix socket for "unix:/path", TCP otherwise
+func (d *Daemon) startAPIServer() error {
+	addr := d.config.ListenAPI
+	if addr == "" {
+		return nil
+	}
+
+	var listener net.Listener
+	var err error
+	path, unix := strings.CutPrefix(addr, "unix:")
+	if unix {
+		listener, err = d.listenAPISocket(path)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create API listener: %w", err)
+	}
+	if !unix && d.tlsConfig != nil {
+		listener = tls.NewListener(listener, d.tlsConfig)
+	}
+
+	d.listenerMu.Lock()
+	d.apiListener = listener
+	d.listenerMu.Unlock()
+
+	srv := &http.Server{
+		Handler: d.apiHandler(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, apiConnKey{}, c)
+		},
+	}
+	go srv.Serve(listener)
+
+	d.infof("REST API listening on %s", addr)
+
+	return nil
+}
+
+// listenAPISocket creates the Unix socket of the REST API, with the mode and
+// group of the control socket
+func (d *Daemon) listenAPISocket(path string) (net.Listener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.chmodSocket(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// APIAddr returns the address of the REST API, nil without ListenAPI
+func (d *Daemon) APIAddr() net.Addr {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	if d.apiListener == nil {
+		return nil
+	}
+	return d.apiListener.Addr()
+}
+
+// apiHandler routes the requests of the REST API. Its clients are checked
+// as those of the control socket, with the same permissions, once
+// authenticated.
+func (d *Daemon) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", d.apiStatus)
+	mux.HandleFunc("POST /wait", d.apiWait)
+	mux.HandleFunc("POST /signal", d.apiSignal)
+	mux.HandleFunc("GET /screen", d.apiScreen)
+	mux.HandleFunc("GET /export", d.apiExport)
+	mux.HandleFunc("GET /logs", d.apiLogs)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := apiPeer(r)
+		perms, err := d.apiPermissions(r, peer)
+		if err != nil {
+			from := r.RemoteAddr
+			if peer.known {
+				from = fmt.Sprintf("pid %d uid %d", peer.pid, peer.uid)
+			}
+			d.warnf("Rejected API request from %s: %v", from, err)
+			writeAPIError(w, err)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiPermsKey{}, perms)))
+	})
+}
+
+// apiPeer identifies the client of an HTTP request
+func apiPeer(r *http.Request) peerCred {
+	switch conn := r.Context().Value(apiConnKey{}).(type) {
+	case *net.UnixConn:
+		return peerCredentials(conn)
+	case *tls.Conn:
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return peerCred{remote: certs[0].Subject.CommonName + "@" + r.RemoteAddr}
+		}
+	}
+	return peerCred{remote: "http@" + r.RemoteAddr}
+}
+
+// apiPermissions returns what the client of an HTTP request may do. Unix
+// socket clients are checked as those of the control socket. TCP clients
+// authenticated by their certificate or the bearer token are other users,
+// while the others only observe when neither is configured, as
+// AllowAnonymous lets them.
+func (d *Daemon) apiPermissions(r *http.Request, peer peerCred) (Permissions, error) {
+	switch r.Context().Value(apiConnKey{}).(type) {
+	case *net.UnixConn:
+		if err := d.authorize(peer); err != nil {
+			return 0, &apiError{http.StatusForbidden, err.Error()}
+		}
+		return d.permissionsOf(peer), nil
+	case *tls.Conn:
+		// The certificate was verified by the handshake
+		return d.permissionsOf(peer), nil
+	}
+
+	if d.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !d.validToken(token) {
+			return 0, &apiError{http.StatusUnauthorized, "missing or invalid bearer token"}
+		}
+		return d.permissionsOf(peer), nil
+	}
+	if err := d.authorize(peer); err != nil {
+		return 0, &apiError{http.StatusForbidden, err.Error()}
+	}
+	return PermObserve, nil
+}
+
+// apiCall sends the request written by send to the daemon, as a client of
+// its own with the permissions of the HTTP client, and returns the answer.
+// Errors of the daemon are returned as *apiError.
+func (d *Daemon) apiCall(r *http.Request, send func(w io.Writer) error) (*protocol.Message, error) {
+	perms, _ := r.Context().Value(apiPermsKey{}).(Permissions)
+	bridge, conn := net.Pipe()
+	defer bridge.Close()
+	d.addClient(conn, apiPeer(r), perms)
+
+	// A wait ends with the request
+	stop := context.AfterFunc(r.Context(), func() { bridge.Close() })
+	defer stop()
+
+	if err := send(bridge); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := protocol.ReadMessage(bridge)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.Type {
+		case protocol.MsgProcessExit, protocol.MsgOutput:
+			// Sent to every client, whatever it asked
+			continue
+		case protocol.MsgError:
+			status := http.StatusBadRequest
+			if strings.HasPrefix(string(msg.Payload), "permission denied") {
+				status = http.StatusForbidden
+			}
+			return nil, &apiError{status, string(msg.Payload)}
+		case protocol.MsgQuotaExceeded:
+			return nil, &apiError{http.StatusTooManyRequests, string(msg.Payload)}
+		}
+		return msg, nil
+	}
+}
+
+// apiSimpleCall is apiCall for a request of msgType with payload
+func (d *Daemon) apiSimpleCall(r *http.Request, msgType protocol.MessageType, payload []byte) (*protocol.Message, error) {
+	return d.apiCall(r, func(w io.Writer) error {
+		return protocol.WriteMessage(w, msgType, payload)
+	})
+}
+
+// writeAPIError answers err as {"error": "..."}
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var ae *apiError
+	if errors.As(err, &ae) {
+		status = ae.status
+	}
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIPayload answers the JSON payload of a message as is
+func writeAPIPayload(w http.ResponseWriter, msg *protocol.Message) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msg.Payload)
+}
+
+// readAPIBody decodes the JSON body of a request into v. Other content
+// types are refused, as those a page may post to another site without
+// asking.
+func readAPIBody(r *http.Request, v any) error {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return &apiError{http.StatusUnsupportedMediaType, "the request body must be application/json"}
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+// apiStatus answers GET /status with the status of the process
+func (d *Daemon) apiStatus(w http.ResponseWriter, r *http.Request) {
+	msg, err := d.apiSimpleCall(r, protocol.MsgStatus, nil)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIPayload(w, msg)
+}
+
+// apiWait answers POST /wait once the condition of its body is met, with
+// {"result": "completed"}, "timeout" or "not_applicable"
+func (d *Daemon) apiWait(w http.ResponseWriter, r *http.Request) {
+	var body APIWaitRequest
+	if err := readAPIBody(r, &body); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	waitType, ok := apiWaitTypes[body.Type]
+	if !ok {
+		writeAPIError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("unknown wait type %q (exit, foreground, pattern, idle or stable)", body.Type)})
+		return
+	}
+
+	req := &protocol.WaitRequest{
+		TimeoutSecs: body.Timeout,
+		Type:        waitType,
+		Pattern:     body.Pattern,
+		QuietMillis: body.QuietMillis,
+	}
+	msg, err := d.apiCall(r, func(w io.Writer) error { return protocol.WriteWait(w, req) })
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	status, err := protocol.ParseWaitResponse(msg.Payload)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"result": waitResultNames[status]})
+}
+
+// apiSignal answers POST /signal once the signal of its body is sent
+func (d *Daemon) apiSignal(w http.ResponseWriter, r *http.Request) {
+	var body APISignalRequest
+	if err := readAPIBody(r, &body); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if body.Signal <= 0 || body.Signal > 255 {
+		writeAPIError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid signal %d", body.Signal)})
+		return
+	}
+
+	if _, err := d.apiSimpleCall(r, protocol.MsgSignal, []byte{byte(body.Signal)}); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]int{"signal": body.Signal})
+}
+
+// apiScreen answers GET /screen with the screen and cursor (VTY only)
+func (d *Daemon) apiScreen(w http.ResponseWriter, r *http.Request) {
+	msg, err := d.apiSimpleCall(r, protocol.MsgGetScreen, nil)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIPayload(w, msg)
+}
+
+// apiExport answers GET /export with the screen, and the scrollback with
+// scrollback=true, in the format given by the format parameter: text (the
+// default), markdown, html or ansi (VTY only)
+func (d *Daemon) apiExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := &protocol.ExportRequest{EndLine: -1}
+	if name := query.Get("format"); name != "" {
+		format, err := parseExportFormat(name)
+		if err != nil {
+			writeAPIError(w, &apiError{http.StatusBadRequest, err.Error()})
+			return
+		}
+		req.Format = format
+	}
+	if s := query.Get("scrollback"); s != "" {
+		scrollback, err := strconv.ParseBool(s)
+		if err != nil {
+			writeAPIError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid scrollback %q", s)})
+			return
+		}
+		req.IncludeScrollback = scrollback
+	}
+
+	msg, err := d.apiCall(r, func(w io.Writer) error { return protocol.WriteExportRequest(w, req) })
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	resp, err := protocol.ParseExportResponse(msg.Payload)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	switch req.Format {
+	case protocol.ExportFormatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case protocol.ExportFormatMarkdown:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	io.WriteString(w, resp.Content)
+}
+
+// parseExportFormat returns the export format of the given name
+func parseExportFormat(name string) (protocol.ExportFormat, error) {
+	for _, format := range []protocol.ExportFormat{protocol.ExportFormatPlainText, protocol.ExportFormatMarkdown, protocol.ExportFormatHTML, protocol.ExportFormatANSI} {
+		if format.String() == name {
+			return format, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown export format %q (text, markdown, html or ansi)", name)
+}
+
+// apiLogs answers GET /logs with the output log, from the byte given by the
+// offset parameter if any
+func (d *Daemon) apiLogs(w http.ResponseWriter, r *http.Request) {
+	var offset int64
+	if s := r.URL.Query().Get("offset"); s != "" {
+		var err error
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			writeAPIError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid offset %q", s)})
+			return
+		}
+	}
+
+	f, err := d.storage.Open(LogFileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = &apiError{http.StatusNotFound, "no output log"}
+		}
+		writeAPIError(w, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
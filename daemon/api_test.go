@@ -0,0 +1,169 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestAPI(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(tmpDir, "api.sock")
+	config := &Config{
+		Command:     []string{"bash", "-c", "echo hello; sleep 10"},
+		StdinMode:   StdinNull,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  tmpDir,
+		ListenAPI:   "unix:" + socketPath,
+		Permissions: PermObserve,
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	// The user running the daemon may do anything over the Unix socket
+	local := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	call := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://bgrun"+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := local.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := call("GET", "/status", "")
+	var status protocol.StatusResponse
+	if err := json.Unmarshal([]byte(body), &status); code != http.StatusOK || err != nil || !status.Running {
+		t.Errorf("Expected the status of the running process, got %d %q", code, body)
+	}
+
+	if code, body := call("POST", "/wait", `{"type": "pattern", "timeout": 5, "pattern": "hel+o"}`); code != http.StatusOK || !strings.Contains(body, `"completed"`) {
+		t.Errorf("Expected the pattern wait to complete, got %d %q", code, body)
+	}
+	if code, body := call("GET", "/logs", ""); code != http.StatusOK || body != "hello\n" {
+		t.Errorf("Expected the output log, got %d %q", code, body)
+	}
+	if code, body := call("GET", "/logs?offset=2", ""); code != http.StatusOK || body != "llo\n" {
+		t.Errorf("Expected the output log from offset 2, got %d %q", code, body)
+	}
+	if code, body := call("GET", "/export?format=html", ""); code != http.StatusBadRequest || !strings.Contains(body, "VTY is not enabled") {
+		t.Errorf("Expected the export to fail without VTY, got %d %q", code, body)
+	}
+	if code, body := call("POST", "/wait", `{"type": "forever"}`); code != http.StatusBadRequest || !strings.Contains(body, "unknown wait type") {
+		t.Errorf("Expected an unknown wait type to be refused, got %d %q", code, body)
+	}
+
+	// Pages may post text/plain to any site, JSON must be declared
+	resp, err := local.Post("http://bgrun/signal", "text/plain", strings.NewReader(`{"signal": 15}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a text/plain body to be refused, got %d", resp.StatusCode)
+	}
+
+	if code, body := call("POST", "/signal", `{"signal": 15}`); code != http.StatusOK {
+		t.Errorf("Expected the signal to be sent, got %d %q", code, body)
+	}
+	if code, body := call("POST", "/wait", `{"type": "exit", "timeout": 5}`); code != http.StatusOK || !strings.Contains(body, `"completed"`) {
+		t.Errorf("Expected the exit wait to complete, got %d %q", code, body)
+	}
+}
+
+func TestAPIOverTCP(t *testing.T) {
+	tmpDir := t.TempDir()
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(tokenFile string) string {
+		t.Helper()
+		d, err := New(&Config{
+			Command:    []string{"sleep", "10"},
+			StdinMode:  StdinNull,
+			StdoutMode: IOModeLog,
+			StderrMode: IOModeLog,
+			RuntimeDir: t.TempDir(),
+			ListenAPI:  "127.0.0.1:0",
+			TokenFile:  tokenFile,
+			// Anonymous clients are allowed when there is no token
+			AllowAnonymous: tokenFile == "",
+		})
+		if err != nil {
+			t.Fatalf("Failed to create daemon: %v", err)
+		}
+		if err := d.Start(); err != nil {
+			t.Fatalf("Failed to start daemon: %v", err)
+		}
+		t.Cleanup(d.stop)
+		return "http://" + d.APIAddr().String()
+	}
+	call := func(method, url, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// Without a token or certificates, TCP clients must be allowed
+	if _, err := New(&Config{Command: []string{"true"}, ListenAPI: "127.0.0.1:0"}); err == nil {
+		t.Error("Expected an anonymous API over TCP to be refused without AllowAnonymous")
+	}
+
+	// Anonymous clients only observe
+	url := start("")
+	if code, body := call("GET", url+"/status", "", ""); code != http.StatusOK {
+		t.Fatalf("Expected the status, got %d %q", code, body)
+	}
+	if code, body := call("POST", url+"/signal", "", `{"signal": 9}`); code != http.StatusForbidden || !strings.Contains(body, "permission denied") {
+		t.Errorf("Expected the signal to be denied, got %d %q", code, body)
+	}
+
+	// With a token, they must present it and are then other users
+	url = start(tokenFile)
+	if code, body := call("GET", url+"/status", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the token to be refused, got %d %q", code, body)
+	}
+	if code, body := call("GET", url+"/status", "guess", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d %q", code, body)
+	}
+	if code, body := call("POST", url+"/signal", "s3cret", `{"signal": 15}`); code != http.StatusOK {
+		t.Errorf("Expected the signal to be sent, got %d %q", code, body)
+	}
+}
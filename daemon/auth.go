@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// rejectLinger is how long a rejected connection is kept open, so that the
+// client reads why instead of failing to write its first request
+const rejectLinger = time.Second
+
+// authorize checks the peer of a connection against the allowlists of the
+// configuration
+func (d *Daemon) authorize(peer peerCred) error {
+	uids, gids := d.config.AllowedUIDs, d.config.AllowedGIDs
+	if len(uids) == 0 && len(gids) == 0 {
+		return nil
+	}
+	if !peer.known {
+		return fmt.Errorf("peer credentials unavailable")
+	}
+	if peer.uid == os.Getuid() || slices.Contains(uids, peer.uid) || slices.Contains(gids, peer.gid) {
+		return nil
+	}
+	// Root reads the runtime directory anyway, and inspects the daemons of
+	// all users with -all-users; -permissions still applies
+	if peer.uid == 0 {
+		return nil
+	}
+
+	// Peer credentials only hold the primary group of the process
+	if len(gids) > 0 {
+		if u, err := user.LookupId(strconv.Itoa(peer.uid)); err == nil {
+			groups, _ := u.GroupIds()
+			for _, group := range groups {
+				if gid, err := strconv.Atoi(group); err == nil && slices.Contains(gids, gid) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("uid %d is not allowed to control this daemon", peer.uid)
+}
+
+// reject tells a client that it is not allowed to connect, and closes the
+// connection once the client did, or after rejectLinger
+func (d *Daemon) reject(conn net.Conn, peer peerCred, reason error) {
+	defer conn.Close()
+
+	d.warnf("Rejected connection from pid %d uid %d: %v", peer.pid, peer.uid, reason)
+	conn.SetDeadline(time.Now().Add(rejectLinger))
+	if err := protocol.WriteMessage(conn, protocol.MsgUnauthorized, []byte(reason.Error())); err != nil {
+		return
+	}
+	io.Copy(io.Discard, conn)
+}
+
+// Permissions is the set of what a client connection may do
+type Permissions uint8
+
+const (
+	PermObserve  Permissions = 1 << iota // status, output, screen, waits and events; always granted
+	PermStdin                            // stdin, expect rules, terminal resizes, blocking flow control and exclusive attachments
+	PermSignal                           // signals, pause and resume
+	PermShutdown                         // shutdown, and changes to the recording and log level
+
+	AllPermissions = PermObserve | PermStdin | PermSignal | PermShutdown
+)
+
+var permissionNames = []struct {
+	perm Permissions
+	name string
+}{
+	{PermObserve, "observe"},
+	{PermStdin, "stdin"},
+	{PermSignal, "signal"},
+	{PermShutdown, "shutdown"},
+}
+
+// Names lists the permissions of the set
+func (p Permissions) Names() []string {
+	var names []string
+	for _, pn := range permissionNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+// String returns the permissions of the set, comma-separated
+func (p Permissions) String() string {
+	return strings.Join(p.Names(), ",")
+}
+
+// ParsePermissions parses a comma-separated list of permissions: observe,
+// stdin, signal and shutdown, or all. Observe is always included.
+func ParsePermissions(list string) (Permissions, error) {
+	perms := PermObserve
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			perms |= AllPermissions
+			continue
+		}
+		known := false
+		for _, pn := range permissionNames {
+			if pn.name == name {
+				perms |= pn.perm
+				known = true
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("unknown permission %q (observe, stdin, signal, shutdown or all)", name)
+		}
+	}
+	return perms, nil
+}
+
+// MarshalText records the permissions by name in config.json
+func (p Permissions) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText reads permissions recorded by MarshalText
+func (p *Permissions) UnmarshalText(text []byte) error {
+	perms, err := ParsePermissions(string(text))
+	if err != nil {
+		return err
+	}
+	*p = perms
+	return nil
+}
+
+// permissionsOf returns what the client identified by peer may do: the user
+// running the daemon may do anything, other users what the configuration
+// grants them. Without peer credentials, every client is another user.
+func (d *Daemon) permissionsOf(peer peerCred) Permissions {
+	if peer.known && peer.uid == os.Getuid() {
+		return AllPermissions
+	}
+	if d.config.Permissions == 0 {
+		return AllPermissions
+	}
+	return d.config.Permissions | PermObserve
+}
+
+// ClientPermissions checks the peer of conn against the allowlists of
+// config and returns what it may do, as for a client of the control socket.
+// It is for programs acting on behalf of the clients of a daemon, such as a
+// supervisor starting and stopping its job.
+func ClientPermissions(config *Config, conn net.Conn) (Permissions, error) {
+	d := &Daemon{config: config}
+	peer := peerCredentials(conn)
+	if err := d.authorize(peer); err != nil {
+		return 0, err
+	}
+	return d.permissionsOf(peer), nil
+}
+
+// requiredPermission returns the permission a client needs to send msg
+func requiredPermission(msg *protocol.Message) Permissions {
+	switch msg.Type {
+	case protocol.MsgStdin, protocol.MsgCloseStdin, protocol.MsgStdinFile, protocol.MsgExpect, protocol.MsgResize:
+		return PermStdin
+	case protocol.MsgSignal, protocol.MsgPause, protocol.MsgResume:
+		return PermSignal
+	case protocol.MsgShutdown, protocol.MsgRecord, protocol.MsgCheckpoint:
+		return PermShutdown
+	case protocol.MsgSetLogLevel:
+		if len(msg.Payload) > 0 {
+			return PermShutdown
+		}
+	case protocol.MsgAttach:
+		// Blocking flow control holds the program up for every client, and
+		// an exclusive attachment detaches them and takes stdin over
+		if req, err := protocol.ParseAttach(msg.Payload); err == nil && (req.Flow == protocol.FlowBlock || req.Exclusive) {
+			return PermStdin
+		}
+	}
+	return PermObserve
+}
+
+// permitted checks that client c may send msg
+func permitted(c *client, msg *protocol.Message) error {
+	if c == nil {
+		return nil
+	}
+	need := requiredPermission(msg)
+	if c.perms&need == 0 {
+		return fmt.Errorf("permission denied: %s requires the %s permission", msg.Type.Name(), need)
+	}
+	return nil
+}
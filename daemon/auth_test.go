@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestAuthorize(t *testing.T) {
+	d := &Daemon{config: &Config{}}
+	stranger := peerCred{pid: 1, uid: 54321, gid: 54321, known: true}
+	if err := d.authorize(stranger); err != nil {
+		t.Errorf("Expected anyone to be allowed without allowlists, got %v", err)
+	}
+
+	d.config.AllowedUIDs = []int{1001}
+	d.config.AllowedGIDs = []int{2002}
+	for _, tc := range []struct {
+		peer    peerCred
+		allowed bool
+	}{
+		{peerCred{uid: os.Getuid(), gid: 54321, known: true}, true},
+		{peerCred{uid: 1001, gid: 54321, known: true}, true},
+		{peerCred{uid: 0, gid: 54321, known: true}, true},
+		{peerCred{uid: 54321, gid: 2002, known: true}, true},
+		{stranger, false},
+		{peerCred{}, false},
+	} {
+		if err := d.authorize(tc.peer); (err == nil) != tc.allowed {
+			t.Errorf("Expected %+v to be allowed: %v, got %v", tc.peer, tc.allowed, err)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	perms, err := ParsePermissions("stdin, signal")
+	if err != nil || perms != PermObserve|PermStdin|PermSignal {
+		t.Fatalf("Expected observe, stdin and signal, got %v, %v", perms, err)
+	}
+	if perms.String() != "observe,stdin,signal" {
+		t.Errorf("Unexpected names %q", perms.String())
+	}
+	if all, err := ParsePermissions("all"); err != nil || all != AllPermissions {
+		t.Errorf("Expected all permissions, got %v, %v", all, err)
+	}
+	if _, err := ParsePermissions("observe,kill"); err == nil {
+		t.Error("Expected an unknown permission to be rejected")
+	}
+
+	d := &Daemon{config: &Config{Permissions: PermObserve}}
+	if p := d.permissionsOf(peerCred{uid: os.Getuid(), known: true}); p != AllPermissions {
+		t.Errorf("Expected the daemon's user to have all permissions, got %v", p)
+	}
+	observer := &client{perms: d.permissionsOf(peerCred{uid: 54321, known: true})}
+	for _, tc := range []struct {
+		msg     protocol.Message
+		allowed bool
+	}{
+		{protocol.Message{Type: protocol.MsgStatus}, true},
+		{protocol.Message{Type: protocol.MsgAttach}, true},
+		{*attachMessage(t, &protocol.AttachRequest{Flow: protocol.FlowPause, Window: 4096}), true},
+		{*attachMessage(t, &protocol.AttachRequest{Flow: protocol.FlowBlock}), false},
+		{*attachMessage(t, &protocol.AttachRequest{Exclusive: true}), false},
+		{protocol.Message{Type: protocol.MsgSetLogLevel}, true},
+		{protocol.Message{Type: protocol.MsgSetLogLevel, Payload: []byte("debug")}, false},
+		{protocol.Message{Type: protocol.MsgStdin, Payload: []byte("rm -rf ~\n")}, false},
+		{protocol.Message{Type: protocol.MsgSignal}, false},
+		{protocol.Message{Type: protocol.MsgShutdown}, false},
+		{protocol.Message{Type: protocol.MsgCheckpoint}, false},
+	} {
+		if err := permitted(observer, &tc.msg); (err == nil) != tc.allowed {
+			t.Errorf("Expected %s to be allowed: %v, got %v", tc.msg.Type.Name(), tc.allowed, err)
+		}
+	}
+
+	d.config.Permissions = 0
+	if p := d.permissionsOf(peerCred{uid: 54321, known: true}); p != AllPermissions {
+		t.Errorf("Expected all permissions by default, got %v", p)
+	}
+}
+
+// attachMessage returns the ATTACH message of req
+func attachMessage(t *testing.T, req *protocol.AttachRequest) *protocol.Message {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := protocol.WriteAttach(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
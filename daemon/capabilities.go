@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"io"
+	"net"
+	"slices"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// supportedMessages are the client requests handled by handleMessage. It is
+// reported to clients by CAPABILITIES, so every new request must be added.
+var supportedMessages = []protocol.MessageType{
+	protocol.MsgStatus,
+	protocol.MsgStdin,
+	protocol.MsgSignal,
+	protocol.MsgResize,
+	protocol.MsgAttach,
+	protocol.MsgDetach,
+	protocol.MsgCloseStdin,
+	protocol.MsgWait,
+	protocol.MsgGetScreen,
+	protocol.MsgExport,
+	protocol.MsgGetTitle,
+	protocol.MsgGetCommands,
+	protocol.MsgGetCommandOutput,
+	protocol.MsgRecord,
+	protocol.MsgGetRecording,
+	protocol.MsgShutdown,
+	protocol.MsgCapabilities,
+	protocol.MsgReplay,
+	protocol.MsgSearch,
+	protocol.MsgSubscribeScreen,
+	protocol.MsgGetTimeline,
+	protocol.MsgGetScreenCells,
+	protocol.MsgHealth,
+	protocol.MsgPing,
+	protocol.MsgCredit,
+	protocol.MsgSubscribe,
+	protocol.MsgExpect,
+	protocol.MsgPause,
+	protocol.MsgResume,
+	protocol.MsgStdinFile,
+	protocol.MsgSetLogLevel,
+	protocol.MsgCheckpoint,
+	protocol.MsgGetScrollback,
+}
+
+// supportedExportFormats are the formats accepted by EXPORT
+var supportedExportFormats = []protocol.ExportFormat{
+	protocol.ExportFormatPlainText,
+	protocol.ExportFormatMarkdown,
+	protocol.ExportFormatHTML,
+	protocol.ExportFormatANSI,
+}
+
+// supportedFeatures names the optional features of the daemon that are not
+// tied to a single request
+var supportedFeatures = []string{
+	"vty",            // terminal emulation (Config.UseVTY)
+	"strict_vty",     // Config.StrictVTY
+	"record",         // asciinema recording (Config.Record)
+	"shell_commands", // OSC 133 command tracking
+	"quotas",         // per-client quotas (Config.Quotas)
+	"log_encryption", // encrypted output.log (Config.LogKeyFile)
+	"signing",        // signed artifacts (Config.SigningKeyFile)
+	"retry",          // run history (Config.PreviousRun)
+	"resume",         // ATTACH from an output offset
+	"flow_control",   // ATTACH with a credit window and CREDIT
+	"exclusive",      // exclusive ATTACH, detaching the other clients
+	"notices",        // ATTACH with notices of the other clients
+	"compression",    // COMPRESSED output and exports, asked for in CAPABILITIES
+	"utf8_chunks",    // output messages holding whole runes (Config.UTF8Chunks)
+}
+
+// capabilities returns what the daemon supports
+func capabilities() *protocol.Capabilities {
+	caps := &protocol.Capabilities{
+		Version:  protocol.Version,
+		Features: supportedFeatures,
+	}
+	for _, t := range supportedMessages {
+		caps.Messages = append(caps.Messages, t.Name())
+	}
+	for _, f := range supportedExportFormats {
+		caps.ExportFormats = append(caps.ExportFormats, f.String())
+	}
+	caps.WaitTypes = []string{"exit", "foreground", "pattern", "output_idle", "screen_stable"}
+	return caps
+}
+
+// supportedCompressions are the compression algorithms a client may ask for
+var supportedCompressions = []byte{protocol.CompressionGzip}
+
+// handleCapabilities sends the capabilities of the daemon. The payload lists
+// the compression algorithms the client accepts, in order of preference:
+// the first one supported is used for the large messages sent to the client
+// from then on.
+func (d *Daemon) handleCapabilities(conn net.Conn, payload []byte) error {
+	caps := capabilities()
+	algorithm := protocol.CompressionNone
+	for _, a := range payload {
+		if slices.Contains(supportedCompressions, a) {
+			algorithm = a
+			break
+		}
+	}
+	caps.Compression = protocol.CompressionName(algorithm)
+
+	d.mu.RLock()
+	c := d.clients[conn]
+	d.mu.RUnlock()
+	if c != nil {
+		caps.Permissions = c.perms.Names()
+	}
+
+	if err := protocol.WriteCapabilities(conn, caps); err != nil {
+		return err
+	}
+	if len(payload) > 0 && c != nil {
+		c.compression.Store(uint32(algorithm))
+	}
+	return nil
+}
+
+// writer returns the writer for the large messages sent to c, compressing
+// them if c asked for it
+func (c *client) writer() io.Writer {
+	if algorithm := byte(c.compression.Load()); algorithm != protocol.CompressionNone {
+		return &protocol.Compressor{W: c.conn, Algorithm: algorithm}
+	}
+	return c.conn
+}
+
+// writerFor returns the writer for the large messages sent on conn
+func (d *Daemon) writerFor(conn net.Conn) io.Writer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if c, ok := d.clients[conn]; ok {
+		return c.writer()
+	}
+	return conn
+}
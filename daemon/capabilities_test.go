@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestCapabilities(t *testing.T) {
+	d, err := New(&Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	c, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := protocol.WriteMessage(c, protocol.MsgCapabilities, nil); err != nil {
+		t.Fatalf("Failed to send capabilities request: %v", err)
+	}
+	msg, err := protocol.ReadMessage(c)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if msg.Type != protocol.MsgCapabilitiesResponse {
+		t.Fatalf("Expected MsgCapabilitiesResponse, got 0x%02X", msg.Type)
+	}
+	caps, err := protocol.ParseCapabilities(msg.Payload)
+	if err != nil {
+		t.Fatalf("Failed to parse capabilities: %v", err)
+	}
+
+	if caps.Version != protocol.Version {
+		t.Errorf("Expected version %d, got %d", protocol.Version, caps.Version)
+	}
+	if !caps.HasMessage(protocol.MsgGetRecording) || !caps.HasMessage(protocol.MsgCapabilities) {
+		t.Errorf("Missing messages in %v", caps.Messages)
+	}
+	if !slices.Contains(caps.ExportFormats, "ansi") || !caps.HasFeature("record") {
+		t.Errorf("Unexpected capabilities %+v", caps)
+	}
+
+	// Every request handled by the daemon must be listed: anything else is
+	// answered as unknown
+	for typ := protocol.MessageType(0x01); typ < 0x80; typ++ {
+		if slices.Contains(supportedMessages, typ) {
+			continue
+		}
+		if err := protocol.WriteMessage(c, typ, nil); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		msg, err := protocol.ReadMessage(c)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if msg.Type != protocol.MsgError || !strings.HasPrefix(string(msg.Payload), "unknown message type") {
+			t.Errorf("Message 0x%02X is handled but not listed in supportedMessages", byte(typ))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// CgroupConfig places the process in a cgroup v2 of its own, created when
+// it starts and removed once it exited, with resource limits
+type CgroupConfig struct {
+	// Parent is the cgroup the one of the process is created in, as a
+	// path in the cgroup2 mount (default: the cgroup of the daemon). It
+	// must be writable, such as one delegated to the user by systemd, and
+	// hold no process itself when limits are set.
+	Parent string `json:"parent,omitempty"`
+
+	CPUWeight int   `json:"cpu_weight,omitempty"` // cpu.weight, from 1 to 10000 (default: 100)
+	MemoryMax int64 `json:"memory_max,omitempty"` // memory.max in bytes, zero for no limit
+	PidsMax   int64 `json:"pids_max,omitempty"`   // pids.max, zero for no limit
+}
+
+// controllers returns the controllers the limits need
+func (c *CgroupConfig) controllers() []string {
+	var controllers []string
+	if c.CPUWeight != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if c.MemoryMax != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if c.PidsMax != 0 {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// validate checks the limits
+func (c *CgroupConfig) validate() error {
+	if !cgroupSupported {
+		return errors.New("cgroups are only supported on Linux")
+	}
+	if c.CPUWeight < 0 || c.CPUWeight > 10000 {
+		return fmt.Errorf("invalid CPU weight %d: must be from 1 to 10000", c.CPUWeight)
+	}
+	if c.MemoryMax < 0 {
+		return fmt.Errorf("invalid memory limit %d", c.MemoryMax)
+	}
+	if c.PidsMax < 0 {
+		return fmt.Errorf("invalid process limit %d", c.PidsMax)
+	}
+	return nil
+}
+
+// setupCgroup creates the cgroup of the process and has the command started
+// in it
+func (d *Daemon) setupCgroup() error {
+	if d.config.Cgroup == nil {
+		return nil
+	}
+	cg, err := createCgroup(d.config.Cgroup)
+	if err != nil {
+		return err
+	}
+	if d.cmd.SysProcAttr == nil {
+		d.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cg.attach(d.cmd.SysProcAttr)
+	d.cgroup = cg
+	return nil
+}
+
+// cgroupStarted is called once the process was started, or failed to be
+func (d *Daemon) cgroupStarted(err error) {
+	if d.cgroup == nil {
+		return
+	}
+	d.cgroup.started()
+	if err != nil {
+		d.cgroup.remove()
+		d.cgroup = nil
+	}
+}
+
+// releaseCgroup records the final usage of the cgroup of the process that
+// exited, and removes it
+func (d *Daemon) releaseCgroup() {
+	if d.cgroup == nil {
+		return
+	}
+	stats := d.cgroup.stats()
+	d.mu.Lock()
+	d.cgroupStats = stats
+	d.mu.Unlock()
+
+	if err := d.cgroup.remove(); err != nil {
+		d.warnf("Failed to remove cgroup %s: %v", stats.Path, err)
+	}
+}
+
+// cgroupStatusLocked returns the usage of the cgroup of the process, d.mu
+// being held
+func (d *Daemon) cgroupStatusLocked() *protocol.CgroupStats {
+	switch {
+	case d.cgroupStats != nil:
+		return d.cgroupStats
+	case d.cgroup != nil && d.running:
+		return d.cgroup.stats()
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// cgroupSupported tells whether processes can be placed in a cgroup
+const cgroupSupported = true
+
+// cgroup is the cgroup v2 created for the process
+type cgroup struct {
+	mount string   // mount point of the cgroup2 hierarchy
+	path  string   // path of the cgroup in the hierarchy
+	dir   *os.File // open until the process is started in it
+}
+
+// createCgroup creates a cgroup for the process under the parent of the
+// configuration, with its limits
+func createCgroup(config *CgroupConfig) (*cgroup, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+	parent := config.Parent
+	if parent == "" {
+		if parent, err = ownCgroup(); err != nil {
+			return nil, err
+		}
+	}
+	parentDir := filepath.Join(mount, parent)
+
+	// The controllers of the limits must be enabled for the children of the
+	// parent, which cannot hold processes itself then
+	if controllers := config.controllers(); len(controllers) > 0 {
+		data, err := os.ReadFile(filepath.Join(parentDir, "cgroup.controllers"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the controllers of cgroup %s: %w", parent, err)
+		}
+		available := strings.Fields(string(data))
+		var enable []string
+		for _, c := range controllers {
+			if !slices.Contains(available, c) {
+				return nil, fmt.Errorf("cgroup controller %s is not available in %s", c, parent)
+			}
+			enable = append(enable, "+"+c)
+		}
+		err = os.WriteFile(filepath.Join(parentDir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0)
+		if errors.Is(err, syscall.EBUSY) {
+			return nil, fmt.Errorf("cannot enable cgroup controllers in %s, which holds processes: use a cgroup parent delegated to bgrun", parent)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable cgroup controllers in %s: %w", parent, err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(parentDir, "bgrun-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	cg := &cgroup{mount: mount, path: strings.TrimPrefix(dir, mount)}
+
+	limits := []struct {
+		file  string
+		value int64
+	}{
+		{"cpu.weight", int64(config.CPUWeight)},
+		{"memory.max", config.MemoryMax},
+		{"pids.max", config.PidsMax},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, limit.file), []byte(strconv.FormatInt(limit.value, 10)), 0); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", limit.file, err)
+		}
+	}
+
+	if cg.dir, err = os.Open(dir); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return cg, nil
+}
+
+// cgroup2Mount returns the mount point of the cgroup2 hierarchy, which is
+// /sys/fs/cgroup/unified on hybrid systems
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Optional fields end with a "-" before the filesystem type
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok || !strings.HasPrefix(post, "cgroup2 ") {
+			continue
+		}
+		if fields := strings.Fields(pre); len(fields) >= 5 {
+			return fields[4], nil
+		}
+	}
+	return "", errors.New("no cgroup2 hierarchy is mounted")
+}
+
+// ownCgroup returns the path of the cgroup v2 of the daemon
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", errors.New("the daemon is not in a cgroup v2")
+}
+
+// attach has the process started in the cgroup
+func (cg *cgroup) attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+}
+
+// started releases what attach needed
+func (cg *cgroup) started() {
+	cg.dir.Close()
+}
+
+// stats reads the usage and limits of the cgroup
+func (cg *cgroup) stats() *protocol.CgroupStats {
+	dir := filepath.Join(cg.mount, cg.path)
+	stats := &protocol.CgroupStats{Path: cg.path}
+
+	keyed := func(file string, fn func(key string, value uint64)) {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+				fn(key, n)
+			}
+		}
+	}
+	single := func(file string) (int64, bool) {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// "max" is no limit
+		return n, err == nil
+	}
+
+	keyed("cpu.stat", func(key string, value uint64) {
+		switch key {
+		case "usage_usec":
+			stats.CPUUsageUsec = value
+		case "user_usec":
+			stats.CPUUserUsec = value
+		case "system_usec":
+			stats.CPUSystemUsec = value
+		}
+	})
+	keyed("memory.events", func(key string, value uint64) {
+		if key == "oom_kill" {
+			stats.OOMKills = value
+		}
+	})
+	if n, ok := single("cpu.weight"); ok {
+		stats.CPUWeight = int(n)
+	}
+	if n, ok := single("memory.current"); ok {
+		stats.MemoryCurrent = uint64(n)
+	}
+	if n, ok := single("memory.peak"); ok {
+		stats.MemoryPeak = uint64(n)
+	}
+	stats.MemoryMax, _ = single("memory.max")
+	if n, ok := single("pids.current"); ok {
+		stats.PidsCurrent = uint64(n)
+	}
+	stats.PidsMax, _ = single("pids.max")
+	return stats
+}
+
+// remove deletes the cgroup, which fails while processes the process left
+// behind still run in it
+func (cg *cgroup) remove() error {
+	return os.Remove(filepath.Join(cg.mount, cg.path))
+}
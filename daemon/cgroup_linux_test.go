@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCgroup(t *testing.T) {
+	cg, err := createCgroup(&CgroupConfig{})
+	if err != nil {
+		t.Skipf("Cannot create cgroups here: %v", err)
+	}
+	cg.started()
+	cg.remove()
+
+	d, err := New(&Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		Cgroup:     &CgroupConfig{},
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	status := d.GetStatus()
+	if status.Cgroup == nil || !strings.Contains(status.Cgroup.Path, "bgrun-") {
+		t.Fatalf("Expected the cgroup in the status, got %+v", status.Cgroup)
+	}
+	path := status.Cgroup.Path
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(status.PID) + "/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "0::"+path+"\n") {
+		t.Errorf("Expected the process in %s, got %q", path, data)
+	}
+
+	d.Signal(syscall.SIGKILL)
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+	if status := d.GetStatus(); status.Cgroup == nil || status.Cgroup.Path != path {
+		t.Errorf("Expected the usage to be kept, got %+v", status.Cgroup)
+	}
+	if _, err := os.Stat(filepath.Join(cg.mount, path)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cgroup to be removed, got %v", err)
+	}
+}
+
+func TestCgroupValidation(t *testing.T) {
+	for _, cg := range []*CgroupConfig{{CPUWeight: 10001}, {MemoryMax: -1}, {PidsMax: -1}} {
+		if _, err := New(&Config{Command: []string{"true"}, Cgroup: cg}); err == nil {
+			t.Errorf("Expected %+v to be refused", cg)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package daemon
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// cgroupSupported tells whether processes can be placed in a cgroup
+const cgroupSupported = false
+
+// cgroup is only implemented on Linux
+type cgroup struct{}
+
+func createCgroup(config *CgroupConfig) (*cgroup, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (cg *cgroup) attach(attr *syscall.SysProcAttr) {}
+
+func (cg *cgroup) started() {}
+
+func (cg *cgroup) stats() *protocol.CgroupStats { return nil }
+
+func (cg *cgroup) remove() error { return nil }
@@ -0,0 +1,247 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// CheckpointDirName is the directory of the runtime directory the process is
+// checkpointed to, replaced by each checkpoint
+const CheckpointDirName = "checkpoint"
+
+// CheckpointFileName describes a checkpoint, next to the CRIU images
+const CheckpointFileName = "checkpoint.json"
+
+// restoredPIDFileName is where CRIU writes the PID of the restored process,
+// in the runtime directory
+const restoredPIDFileName = "restored.pid"
+
+// restorePIDTimeout bounds how long the PID of a restored process is
+// waited for
+const restorePIDTimeout = 30 * time.Second
+
+// Checkpoint describes a checkpoint of a process taken with CRIU, which a
+// daemon with Config.RestoreFrom restores (experimental)
+type Checkpoint struct {
+	PID       int       `json:"pid"`
+	Config    *Config   `json:"config"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Files are the CRIU keys of the pipes and terminal the standard
+	// files of the process were, by descriptor, replaced by those of the
+	// restoring daemon
+	Files map[int]string `json:"files,omitempty"`
+}
+
+// LoadCheckpoint reads the description of the checkpoint in dir
+func LoadCheckpoint(dir string) (*Checkpoint, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CheckpointFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+	if cp.Config == nil {
+		return nil, errors.New("checkpoint has no configuration")
+	}
+	return &cp, nil
+}
+
+// criuPath returns the path of the criu binary
+func criuPath() (string, error) {
+	path, err := exec.LookPath("criu")
+	if err != nil {
+		return "", fmt.Errorf("checkpoints require CRIU: %w", err)
+	}
+	return path, nil
+}
+
+// Checkpoint dumps the process tree with CRIU to the checkpoint directory
+// of the runtime directory, which it returns. Unless leaveRunning, CRIU
+// kills the process once dumped, which the daemon reports as its exit.
+func (d *Daemon) Checkpoint(leaveRunning bool) (string, error) {
+	criu, err := criuPath()
+	if err != nil {
+		return "", err
+	}
+
+	d.checkpointMu.Lock()
+	defer d.checkpointMu.Unlock()
+
+	d.mu.RLock()
+	pid := d.pid
+	running := d.running
+	d.mu.RUnlock()
+	if !running {
+		return "", fmt.Errorf("process is not running")
+	}
+
+	dir := filepath.Join(d.runtimeDir, CheckpointDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("failed to remove previous checkpoint: %w", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+
+	cp := Checkpoint{PID: pid, Config: d.config, CreatedAt: time.Now(), Files: stdFileKeys(pid)}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, CheckpointFileName), data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	// The process is in a process group, or a session with its terminal,
+	// of the daemon: a shell job whose terminal is external to the tree
+	args := []string{"dump", "--tree", strconv.Itoa(pid), "--images-dir", dir, "--log-file", "dump.log", "--shell-job"}
+	var externals []string
+	for _, key := range cp.Files {
+		if strings.HasPrefix(key, "tty[") && !slices.Contains(externals, key) {
+			externals = append(externals, key)
+			args = append(args, "--external", key)
+		}
+	}
+	if leaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if out, err := exec.Command(criu, args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("criu dump failed: %v: %s (see %s)", err, strings.TrimSpace(string(out)), filepath.Join(dir, "dump.log"))
+	}
+
+	d.mu.Lock()
+	d.checkpointDir = dir
+	d.mu.Unlock()
+	d.infof("Checkpointed process %d to %s", pid, dir)
+	d.updateStatus()
+	return dir, nil
+}
+
+// stdFileKeys returns the CRIU keys of the standard files of process pid
+// that are pipes or terminals, which cannot be reopened on restore
+func stdFileKeys(pid int) map[int]string {
+	keys := make(map[int]string)
+	for fd := 0; fd <= 2; fd++ {
+		path := fmt.Sprintf("/proc/%d/fd/%d", pid, fd)
+		link, err := os.Readlink(path)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(link, "pipe:[") {
+			keys[fd] = link
+			continue
+		}
+		if !strings.HasPrefix(link, "/dev/pts/") {
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err == nil {
+			keys[fd] = fmt.Sprintf("tty[%x:%x]", st.Rdev, st.Dev)
+		}
+	}
+	return keys
+}
+
+// restoreCommand returns the command restoring the checkpoint, the standard
+// files of CRIU replacing those of the checkpointed process
+func (d *Daemon) restoreCommand() *exec.Cmd {
+	args := []string{"restore", "--images-dir", d.config.RestoreFrom,
+		"--work-dir", d.runtimeDir, "--log-file", "restore.log",
+		"--shell-job", "--pidfile", filepath.Join(d.runtimeDir, restoredPIDFileName)}
+	for fd, key := range d.restore.Files {
+		args = append(args, "--inherit-fd", fmt.Sprintf("fd[%d]:%s", fd, key))
+	}
+	return exec.Command(d.criu, args...)
+}
+
+// command returns the command starting the process: the one configured, or
+// CRIU restoring it
+func (d *Daemon) command() *exec.Cmd {
+	if d.restore != nil {
+		return d.restoreCommand()
+	}
+	cmd := exec.Command(d.config.Command[0], d.config.Command[1:]...)
+	if len(d.env) > 0 {
+		cmd.Env = append(os.Environ(), d.env...)
+	}
+	return cmd
+}
+
+// restoreStarted follows CRIU restoring the process, which stays its
+// parent: the PID of the daemon becomes the one of the restored process
+// once known, for signals to reach it
+func (d *Daemon) restoreStarted() {
+	if d.restore == nil {
+		return
+	}
+	pidFile := filepath.Join(d.runtimeDir, restoredPIDFileName)
+	go func() {
+		defer d.recoverPanic("restore watcher", nil)
+
+		for deadline := time.Now().Add(restorePIDTimeout); time.Now().Before(deadline); {
+			select {
+			case <-d.reaped:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				continue
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				continue
+			}
+			d.mu.Lock()
+			d.pid = pid
+			d.mu.Unlock()
+			d.infof("Restored process %d from %s", pid, d.config.RestoreFrom)
+			d.updateStatus()
+			return
+		}
+		d.warnf("Restored process did not report its PID, see %s", filepath.Join(d.runtimeDir, "restore.log"))
+	}()
+}
+
+// processGroup returns the process group of the process: CRIU restores a
+// shell job in its own
+func (d *Daemon) processGroup(pid int) int {
+	if d.restore != nil {
+		return d.cmd.Process.Pid
+	}
+	return pid
+}
+
+// handleCheckpoint checkpoints the process with CRIU
+func (d *Daemon) handleCheckpoint(conn net.Conn, payload []byte) error {
+	var req protocol.CheckpointRequest
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("invalid checkpoint request: %w", err)
+		}
+	}
+	dir, err := d.Checkpoint(req.LeaveRunning)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(protocol.CheckpointResponse{Dir: dir})
+	if err != nil {
+		return err
+	}
+	return protocol.WriteMessage(conn, protocol.MsgCheckpointResponse, data)
+}
@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCRIU puts a criu in the PATH that logs its arguments to the returned
+// file and, to restore, writes its PID to the pidfile and sleeps
+func fakeCRIU(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := `#!/bin/sh
+echo "$@" >> ` + argsFile + `
+if [ "$1" = restore ]; then
+	while [ $# -gt 0 ]; do
+		[ "$1" = --pidfile ] && echo $$ > "$2"
+		shift
+	done
+	exec sleep 10
+fi
+`
+	if err := os.WriteFile(filepath.Join(dir, "criu"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("No /proc here")
+	}
+	argsFile := fakeCRIU(t)
+
+	d, err := New(&Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer killDaemon(t, d)
+
+	dir, err := d.Checkpoint(true)
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if d.GetStatus().Checkpoint != dir {
+		t.Errorf("Expected the status to report checkpoint %s", dir)
+	}
+	cp, err := LoadCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := d.GetStatus().PID
+	if cp.PID != pid || cp.Config.Command[0] != "sleep" || !strings.HasPrefix(cp.Files[1], "pipe:[") {
+		t.Errorf("Unexpected checkpoint %+v", cp)
+	}
+	args, _ := os.ReadFile(argsFile)
+	if !strings.Contains(string(args), "dump --tree "+strconv.Itoa(pid)+" --images-dir "+dir) || !strings.Contains(string(args), "--leave-running") {
+		t.Errorf("Unexpected dump arguments %q", args)
+	}
+
+	config := cp.Config
+	config.RuntimeDir = t.TempDir()
+	config.RestoreFrom = dir
+	restored, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create restoring daemon: %v", err)
+	}
+	if err := restored.Start(); err != nil {
+		t.Fatalf("Failed to start restoring daemon: %v", err)
+	}
+	defer killDaemon(t, restored)
+
+	pidFile := filepath.Join(config.RuntimeDir, restoredPIDFileName)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(pidFile)
+		if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(restored.GetStatus().PID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The restored PID was not reported: %q, %v", data, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := restored.GetStatus(); status.RestoredFrom != dir || status.Command[0] != "sleep" {
+		t.Errorf("Unexpected status of the restored process %+v", status)
+	}
+	args, _ = os.ReadFile(argsFile)
+	if !strings.Contains(string(args), "restore --images-dir "+dir) || !strings.Contains(string(args), "--inherit-fd fd[1]:"+cp.Files[1]) {
+		t.Errorf("Unexpected restore arguments %q", args)
+	}
+}
+
+func TestCheckpointNotRunning(t *testing.T) {
+	fakeCRIU(t)
+	d, err := New(&Config{Command: []string{"true"}, RuntimeDir: t.TempDir(), Embedded: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Checkpoint(false); err == nil {
+		t.Error("Expected a process never started not to be checkpointed")
+	}
+	if _, err := New(&Config{Command: []string{"true"}, RestoreFrom: t.TempDir()}); err == nil {
+		t.Error("Expected a directory without checkpoint to be refused")
+	}
+}
+
+// killDaemon kills the process of d and closes it once it exited
+func killDaemon(t *testing.T, d *Daemon) {
+	t.Helper()
+	d.Signal(syscall.SIGKILL)
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Process did not exit")
+	}
+	d.Close()
+}
@@ -1,19 +1,25 @@
 package daemon
 
 import (
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/storage"
 	"github.com/KarpelesLab/bgrun/termemu"
 )
 
@@ -22,46 +28,399 @@ type StdinMode int
 
 const (
 	StdinNull   StdinMode = iota // /dev/null
-	StdinFile                    // read from file
-	StdinStream                  // stream from socket
+	StdinFile                    // read from file or named pipe
+	StdinStream                  // stream from socket, and StdinPath if set
 )
 
 // IOMode defines how stdout/stderr should be handled
 type IOMode int
 
 const (
-	IOModeNull IOMode = iota // /dev/null
-	IOModeFile               // write to file
-	IOModeLog                // write to output.log
+	IOModeNull    IOMode = iota // /dev/null
+	IOModeFile                  // write to file
+	IOModeLog                   // write to output.log
+	IOModeSyslog                // forward lines to syslog
+	IOModeJournal               // forward lines to journald, with structured fields
+	IOModeFilter                // pipe through a command, whose output is logged
 )
 
+// ParseIOMode parses an output mode as given on the command line: null,
+// log, syslog, journal, "|command" for IOModeFilter or a file path. The
+// file path or command is returned with the mode.
+func ParseIOMode(mode string) (IOMode, string, error) {
+	if command, ok := strings.CutPrefix(mode, "|"); ok {
+		if strings.TrimSpace(command) == "" {
+			return 0, "", errors.New("filter command required after |")
+		}
+		return IOModeFilter, command, nil
+	}
+	switch mode {
+	case "null":
+		return IOModeNull, "", nil
+	case "log":
+		return IOModeLog, "", nil
+	case "syslog":
+		return IOModeSyslog, "", nil
+	case "journal":
+		return IOModeJournal, "", nil
+	default:
+		// Treat as file path
+		return IOModeFile, mode, nil
+	}
+}
+
 // Config holds the daemon configuration
 type Config struct {
-	Command    []string
-	StdinMode  StdinMode
-	StdinPath  string // for StdinFile mode
-	StdoutMode IOMode
-	StdoutPath string // for IOModeFile
-	StderrMode IOMode
-	StderrPath string // for IOModeFile
-	UseVTY     bool
-	RuntimeDir string // if empty, will be auto-determined
+	Command    []string  `json:"command"`
+	StdinMode  StdinMode `json:"stdin_mode"`
+	StdinPath  string    `json:"stdin_path,omitempty"` // for StdinFile mode, or fed to StdinStream
+	StdoutMode IOMode    `json:"stdout_mode"`
+	StdoutPath string    `json:"stdout_path,omitempty"` // for IOModeFile
+	StderrMode IOMode    `json:"stderr_mode"`
+	StderrPath string    `json:"stderr_path,omitempty"` // for IOModeFile
+	UseVTY     bool      `json:"use_vty"`
+	Dir        string    `json:"dir,omitempty"`         // working directory, inherited if empty
+	RuntimeDir string    `json:"runtime_dir,omitempty"` // if empty, will be auto-determined
+
+	// Env holds KEY=value variables added to the environment the process
+	// inherits from the daemon, replacing those of the same name
+	Env []string `json:"env,omitempty"`
+
+	// EnvFiles are dotenv files whose variables are added to the
+	// environment before Env, a later file replacing the variables of an
+	// earlier one. They are read when the daemon is created.
+	EnvFiles []string `json:"env_files,omitempty"`
+
+	// Destination of the streams in IOModeSyslog and IOModeJournal: the
+	// syslog facility (default: user) and the tag, or SYSLOG_IDENTIFIER,
+	// of the messages (default: base name of the program). KeepLog writes
+	// the forwarded output to output.log as well.
+	SyslogFacility string `json:"syslog_facility,omitempty"`
+	SyslogTag      string `json:"syslog_tag,omitempty"`
+	KeepLog        bool   `json:"keep_log,omitempty"`
+
+	// StdoutFilter and StderrFilter are the shell commands the streams in
+	// IOModeFilter are piped through, such as "ts" or a log shipper. What
+	// they print is logged and broadcast in place of the output, and they
+	// are restarted when they fail while the program runs.
+	StdoutFilter string `json:"stdout_filter,omitempty"`
+	StderrFilter string `json:"stderr_filter,omitempty"`
+
+	// StdoutTee and StderrTee are files the streams are appended to as
+	// well, whatever their mode: output can be logged, or forwarded, and
+	// kept in files of the user. A stream in IOModeNull or IOModeFile with
+	// tee files goes through the daemon, and is broadcast to clients.
+	StdoutTee []string `json:"stdout_tee,omitempty"`
+	StderrTee []string `json:"stderr_tee,omitempty"`
+
+	// PreviousRun is the runtime directory of the run this one replaces
+	// (e.g. when retrying a failed job). A "previous" symlink pointing to it
+	// is created in the new runtime directory.
+	PreviousRun string `json:"previous_run,omitempty"`
+
+	// LogKeyFile holds the key output.log is encrypted with. If empty, the
+	// key is taken from the BGRUN_LOG_KEY environment variable, which is
+	// then removed from the environment so that the process, hooks and
+	// filters do not inherit it; the log is written in the clear when
+	// neither is set.
+	LogKeyFile string `json:"log_key_file,omitempty"`
+
+	// SigningKeyFile is a PEM private key used to sign the digests of
+	// status.json and output.log when the final status is written
+	SigningKeyFile string `json:"signing_key_file,omitempty"`
+
+	// StrictVTY makes screen and export requests fail once the program has
+	// used a sequence the terminal emulator cannot reproduce (alternate
+	// screen, scrolling regions, ...) instead of returning a screen that
+	// may not match what a real terminal would show
+	StrictVTY bool `json:"strict_vty,omitempty"`
+
+	// Record writes the terminal session as an asciinema v2 recording
+	// (session.cast) from the start (VTY only). Recording can also be
+	// started and stopped at runtime through the control socket.
+	Record bool `json:"record,omitempty"`
+
+	// UTF8Chunks holds back an incomplete UTF-8 sequence ending a read of
+	// the output until the rest of it is read, so that every output message
+	// holds whole runes. Output that is not UTF-8 is sent as is.
+	UTF8Chunks bool `json:"utf8_chunks,omitempty"`
+
+	// LogLevel is the lowest severity of the messages the daemon logs about
+	// itself to stderr and daemon.log. It can be changed at runtime with
+	// SET_LOG_LEVEL.
+	LogLevel LogLevel `json:"log_level,omitempty"`
+
+	// LogMaxSize is the size daemon.log is rotated to daemon.log.1 at
+	// (DefaultLogMaxSize if zero)
+	LogMaxSize int64 `json:"log_max_size,omitempty"`
+
+	// MaxLogBytes caps the output written to output.log (unlimited if
+	// zero). Beyond it, only the end of the output is kept, written when
+	// the process exits after a marker telling how many bytes were
+	// dropped, so that a runaway process cannot fill the filesystem.
+	MaxLogBytes int64 `json:"max_log_bytes,omitempty"`
+
+	// ReplayScreen lets a process without VTY answer GET_SCREEN and EXPORT
+	// by replaying the end of output.log through a terminal emulator, so
+	// that the colors and progress bars it writes can still be rendered.
+	// Terminated runs are replayed by bgclient the same way.
+	ReplayScreen bool `json:"replay_screen,omitempty"`
+
+	// SizePolicy decides the size of the terminal when several clients
+	// resize it (VTY only), SizeLatest if empty. With SizeFixed the
+	// terminal is FixedRows x FixedCols from the start.
+	SizePolicy SizePolicy `json:"size_policy,omitempty"`
+	FixedRows  uint16     `json:"fixed_rows,omitempty"`
+	FixedCols  uint16     `json:"fixed_cols,omitempty"`
+
+	// MaxOutputRate bounds the output read from the process, in bytes per
+	// second over its streams (unlimited if zero). Beyond it the daemon
+	// reads more slowly, blocking the process once the pipe or PTY buffer
+	// is full, and reports it with a throttled event.
+	MaxOutputRate int64 `json:"max_output_rate,omitempty"`
+
+	// SocketPath places the control socket outside the runtime directory,
+	// which only its owner can enter, so that other users or a sidecar can
+	// reach it. The runtime directory then holds a control.sock symlink to
+	// it for the clients finding the daemon by PID.
+	SocketPath string `json:"socket_path,omitempty"`
+
+	// SocketMode is the permissions of the control socket (0600 if zero).
+	// Connecting requires write permission, 0660 granting it to the group.
+	SocketMode os.FileMode `json:"socket_mode,omitempty"`
+
+	// SocketGroup is the name or ID of the group the control socket is
+	// given to. The user running the daemon must be a member.
+	SocketGroup string `json:"socket_group,omitempty"`
+
+	// AllowedUIDs and AllowedGIDs restrict the clients of the control
+	// socket to these users and the members of these groups, identified by
+	// the credentials of the connection (Linux only). The user running the
+	// daemon is always allowed. Empty lists allow anyone able to connect.
+	AllowedUIDs []int `json:"allowed_uids,omitempty"`
+	AllowedGIDs []int `json:"allowed_gids,omitempty"`
+
+	// Permissions is what the clients of users other than the one running
+	// the daemon may do (AllPermissions if zero), such as PermObserve alone
+	// for a monitoring dashboard. Refused requests get an ERROR.
+	Permissions Permissions `json:"permissions,omitempty"`
+
+	// ListenTCP is the address of a TCP listener serving the control
+	// protocol over TLS in addition to the Unix socket, for clients on
+	// other hosts (see bgclient.DialTCP). Clients must present a
+	// certificate signed by TLSClientCAFile, which replaces the filesystem
+	// permissions of the socket; they get Permissions like other users.
+	ListenTCP       string `json:"listen_tcp,omitempty"`
+	TLSCertFile     string `json:"tls_cert_file,omitempty"` // PEM certificate of the listener
+	TLSKeyFile      string `json:"tls_key_file,omitempty"`  // PEM private key of the listener
+	TLSClientCAFile string `json:"tls_client_ca_file,omitempty"`
+
+	// TokenFile holds the bearer token that clients of the REST API and
+	// of the WebSocket bridge must present over TCP, when they do not
+	// authenticate with a certificate
+	TokenFile string `json:"token_file,omitempty"`
+
+	// ListenWebSocket is the address of an HTTP listener bridging
+	// WebSocket connections to the process, for web terminals such as
+	// xterm.js: the output is sent as binary frames, the input received as
+	// binary frames, and resizes and the exit of the process go as JSON
+	// text frames (see WebControl). Only pages of the same host or of
+	// WebSocketOrigins may connect. Browsers authenticated by a certificate
+	// signed by TLSClientCAFile when TLSCertFile is set, or by the token of
+	// TokenFile, connect as other users, with Permissions; without either,
+	// they only observe, if AllowAnonymous is set.
+	ListenWebSocket  string   `json:"listen_websocket,omitempty"`
+	WebSocketOrigins []string `json:"websocket_origins,omitempty"`
+
+	// ListenWebUI is the address of an HTTP listener serving a built-in web
+	// page that shows the live terminal and the status of the process, with
+	// links to export the session. Its visitors only observe, so sharing
+	// its URL shares the session read-only.
+	ListenWebUI string `json:"listen_web_ui,omitempty"`
+
+	// ListenAPI is the address of a REST API with JSON bodies driving the
+	// process, for tools that would rather not speak the binary protocol:
+	// "unix:/path" for a Unix socket, with the mode and group of the
+	// control socket, or a TCP address. Its clients are checked and limited
+	// as those of the control socket. Over TCP they are other users,
+	// authenticated by a certificate signed by TLSClientCAFile when
+	// TLSCertFile is set, or by the token of TokenFile; without either,
+	// they only observe, if AllowAnonymous is set.
+	ListenAPI string `json:"listen_api,omitempty"`
+
+	// AllowAnonymous lets anyone reaching ListenWebSocket, or ListenAPI over
+	// TCP, observe the process without a certificate or token. Without it,
+	// these listeners require TLSCertFile or TokenFile.
+	AllowAnonymous bool `json:"allow_anonymous,omitempty"`
+
+	// Quotas limits what each client connection may consume
+	Quotas Quotas `json:"quotas"`
+
+	// Cgroup places the process in a cgroup v2 of its own with resource
+	// limits, its usage being reported in the status (Linux only)
+	Cgroup *CgroupConfig `json:"cgroup,omitempty"`
+
+	// Rlimits are resource limits set on the process before it executes
+	// the command, with setrlimit(2) in the daemon binary it is started as
+	// (Linux only)
+	Rlimits []Rlimit `json:"rlimits,omitempty"`
+
+	// Nice is the niceness of the process, from -20 to 19, so that batch
+	// jobs do not starve interactive workloads (default: the one of the
+	// daemon). Only root may lower it. As with Rlimits, it is set by the
+	// daemon binary the process is started as, in MaybeExecSetup, and so
+	// are IONice and OOMScoreAdj.
+	Nice *int `json:"nice,omitempty"`
+
+	// IONice is the I/O scheduling class of the process with its level from
+	// 0 (highest) to 7: "realtime:N" (root only), "best-effort:N" or "idle"
+	IONice string `json:"ionice,omitempty"`
+
+	// OOMScoreAdj makes the process more (up to 1000) or less (down to
+	// -1000, never) likely to be killed when the system runs out of memory.
+	// Only root may lower it.
+	OOMScoreAdj *int `json:"oom_score_adj,omitempty"`
+
+	// NoNewPrivs keeps the process from gaining privileges through setuid
+	// binaries or file capabilities (Linux only)
+	NoNewPrivs bool `json:"no_new_privs,omitempty"`
+
+	// SeccompProfile is the path of a JSON SeccompProfile restricting the
+	// system calls of the process, which implies NoNewPrivs (Linux on amd64
+	// and arm64 only)
+	SeccompProfile string `json:"seccomp_profile,omitempty"`
+
+	// RestoreFrom is the directory of a checkpoint CRIU restores the
+	// process from, instead of running the command, which stays the one of
+	// the checkpointed process (experimental, see Daemon.Checkpoint)
+	RestoreFrom string `json:"restore_from,omitempty"`
+
+	// HealthCheck checks on an interval that the process works, its health
+	// being reported in the status and by health events
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// Webhooks are HTTP URLs an ExitNotification is POSTed to once the
+	// process exited or failed to start, with the last WebhookLines lines
+	// of output (DefaultWebhookLines if zero, none if negative). Failed
+	// deliveries are retried; the daemon waits for them before exiting.
+	Webhooks     []string `json:"webhooks,omitempty"`
+	WebhookLines int      `json:"webhook_lines,omitempty"`
+
+	// Hooks are shell commands run before the process starts, once it
+	// started and once it exited, and when the run replaces a previous one
+	Hooks Hooks `json:"hooks,omitzero"`
+
+	// Storage receives the run artifacts (output log, config, status).
+	// Defaults to the runtime directory; the control socket is always local.
+	Storage storage.Storage `json:"-"`
+
+	// OnSlowConsumer is called when a client falls behind on its output. It
+	// runs on the output path and must not block.
+	OnSlowConsumer func(SlowConsumerEvent) `json:"-"`
+
+	// OnPanic is called when the daemon recovered from a panic in one of its
+	// goroutines, after the stack trace was written to crash.log
+	OnPanic func(PanicEvent) `json:"-"`
+
+	// Embedded is set by programs running several daemons, such as bgrund:
+	// the runtime directory is not indexed under the PID they share, and
+	// systemd is left to the program
+	Embedded bool `json:"-"`
+
+	// StartDelay is how many seconds the process waits before it is
+	// started, StartAt when it is started, and Schedule a cron expression
+	// (minute hour day-of-month month day-of-week) it is started at the
+	// next match of. Meanwhile the daemon serves its clients and reports
+	// the process scheduled. They are exclusive.
+	StartDelay int        `json:"start_delay,omitempty"`
+	StartAt    *time.Time `json:"start_at,omitempty"`
+	Schedule   string     `json:"schedule,omitempty"`
+
+	// LingerAfterExit is how many seconds the daemon keeps serving clients
+	// once the process exited, for them to inspect its status and output,
+	// before removing the runtime directory. Without it, the control socket
+	// is removed at exit and the runtime directory left behind. Done is
+	// closed once the daemon stopped lingering.
+	LingerAfterExit int `json:"linger_after_exit,omitempty"`
+
+	// Restarted is set by supervisors starting a job that ran before, for
+	// the OnRestart hook
+	Restarted bool `json:"-"`
 }
 
+// ConfigFileName is the name of the file the daemon records its
+// configuration to in the runtime directory
+const ConfigFileName = "config.json"
+
+// PreviousRunLink is the name of the symlink pointing to the previous run
+const PreviousRunLink = "previous"
+
+// NextRunLink is the name of the symlink a retry leaves in the runtime
+// directory of the run it replaces, pointing to the new run. status.json
+// is left as it was, so that its signature still holds.
+const NextRunLink = "next"
+
+// StatusFileName is the name of the file holding the final process status
+const StatusFileName = "status.json"
+
+// SocketFileName is the name of the control socket in the runtime directory
+const SocketFileName = "control.sock"
+
+// LogFileName is the name of the file output is logged to in IOModeLog
+const LogFileName = "output.log"
+
 // Daemon represents a background process manager
 type Daemon struct {
 	config     *Config
 	runtimeDir string
 	socketPath string
-	logPath    string
+	socketGID  int // group of the socket, -1 to leave it as created
+	storage    storage.Storage
+	signer     crypto.Signer // signs the final artifacts, if configured
+	logger     *daemonLog    // the daemon's own log
 
-	cmd       *exec.Cmd
+	cmd *exec.Cmd
+
+	// Process state, protected by mu
 	pid       int
 	running   bool
 	exitCode  *int
 	startedAt time.Time
 	endedAt   *time.Time
-
+	paused    bool  // process group stopped by PAUSE or SIGSTOP
+	startErr  error // why the process could not be started
+
+	// cgroup of the process, set before it starts, and its usage read once
+	// it exited, under mu
+	cgroup      *cgroup
+	cgroupStats *protocol.CgroupStats
+
+	// seccomp is the filter of Config.SeccompProfile, loaded by New
+	seccomp *seccompFilter
+
+	// restore is the checkpoint of Config.RestoreFrom, restored with the
+	// criu binary; checkpointDir is the last checkpoint taken, under mu
+	restore       *Checkpoint
+	criu          string
+	checkpointMu  sync.Mutex
+	checkpointDir string
+
+	// healthCheck runs Config.HealthCheck; processHealth and healthError
+	// are its last result, under mu
+	healthCheck   *healthChecker
+	processHealth string
+	healthError   string
+
+	// env is added to the environment of the process: the variables of
+	// Config.EnvFiles, then Config.Env
+	env []string
+
+	// scheduledAt is when the process is started, under mu until it is;
+	// schedule is the parsed Config.Schedule
+	scheduledAt time.Time
+	schedule    *cronSchedule
+
+	// Set under mu when the process starts; handlers go through stdin()
 	stdinPipe   io.WriteCloser
 	stdinClosed bool // tracks if stdin has been closed
 	stdoutPipe  io.ReadCloser
@@ -72,27 +431,153 @@ type Daemon struct {
 	stdoutFile *os.File
 	stderrFile *os.File
 
+	// Child ends of the output pipes, closed in the parent once started
+	childWriters []*os.File
+	outputWg     sync.WaitGroup // tracks output readers until they drain
+
+	// Set under mu when a VTY process starts; use pty() and terminal()
 	vtyPty     *os.File          // PTY for VTY mode
 	vtyTermemu *termemu.Terminal // Terminal emulator for VTY mode
 
-	logFile *os.File
+	logFile io.WriteCloser
+	logCap  *logCap // bounds logFile to Config.MaxLogBytes, if set
+
+	// limiter bounds the output to Config.MaxOutputRate, if set
+	limiter *outputLimiter
+
+	recordMu sync.Mutex // serializes emulator updates with the recording
+	recorder *recorder  // asciinema recording in progress, if any
+
+	screenMu     sync.Mutex // orders screen updates, see pushScreenUpdate
+	screenCursor [2]int     // cursor position sent in the last screen update
 
-	listener   net.Listener
-	listenerMu sync.Mutex
+	expectCh chan expectInput // input of matched expect rules, see sendExpected
 
-	mu      sync.RWMutex
-	clients map[net.Conn]*client
+	foreground foregroundState // foreground process group, for foreground waits
+
+	eventMu sync.Mutex // orders lifecycle events, see emitEvent
+	title   string     // window title last reported, owned by the PTY reader
+
+	statusMu    sync.Mutex // serializes the writes of status.json
+	statusFinal bool       // the final status was written, see WriteStatus
+	removed     bool       // the runtime directory was removed, see linger
+
+	snapshotStale atomic.Bool  // emulator changed since the last saved snapshot
+	lastOutput    atomic.Int64 // time of the last output, in Unix nanoseconds
+
+	// First panic recovered from, see recoverPanic. Not under mu, which the
+	// panicking goroutine may hold.
+	panicked atomic.Pointer[string]
+
+	health daemonHealth // internal state reported by HEALTH
+
+	history outputHistory // numbered recent output, for resuming clients
+
+	listener    net.Listener
+	tcpListener net.Listener // TLS listener of ListenTCP, if any
+	wsListener  net.Listener // HTTP listener of ListenWebSocket, if any
+	webListener net.Listener // HTTP listener of ListenWebUI, if any
+	apiListener net.Listener // HTTP listener of ListenAPI, if any
+	listenerMu  sync.Mutex
+	tlsConfig   *tls.Config
+	token       string // bearer token of TokenFile, if any
+
+	// Forwarders of the streams in IOModeSyslog or IOModeJournal, indexed
+	// by stream - 1
+	forward [2]*forwarder
+
+	// Files the streams are copied to, indexed by stream - 1, owned by
+	// their reader
+	tee [2][]*teeFile
+
+	systemd         systemd // environment of the service manager, see systemdFromEnv
+	socketActivated bool    // the control socket was passed by systemd
+
+	mu           sync.RWMutex
+	clients      map[net.Conn]*client
+	lastClientID uint64  // protected by mu
+	exclusive    *client // client attached exclusively, protected by mu
 
 	closeCh  chan struct{}
+	exited   chan struct{} // closed by waitForProcess once running is cleared
+	reaped   chan struct{} // closed by waitForProcess once the process is waited for, before draining its output
 	doneCh   chan struct{}
+	doneOnce sync.Once // closes doneCh, see exitAfterPanic
 	stopOnce sync.Once
 }
 
 type client struct {
+	id       uint64
+	peer     peerCred
+	perms    Permissions // what the client may do
 	conn     net.Conn
+	queue    *clientQueue // output pending delivery
 	attached bool
-	streams  byte // which streams to send (StreamStdout, StreamStderr, StreamBoth)
-	writeMu  sync.Mutex // protects writes to conn
+	streams  byte        // which streams to send (StreamStdout, StreamStderr, StreamBoth)
+	outputAt atomic.Bool // output is sent as OUTPUT_AT, with its offset
+	writeMu  sync.Mutex  // protects writes to conn
+
+	// compression is the algorithm compressing large messages to the
+	// client, asked for in CAPABILITIES
+	compression atomic.Uint32
+
+	// hasTerminal is set once the client reports a terminal size, meaning a
+	// real terminal displays the output and answers queries itself; rows
+	// and cols are that size, protected by Daemon.mu
+	hasTerminal bool
+	rows, cols  uint16
+
+	// screenSubscribed is set while the client receives screen updates;
+	// screenStale when it needs the whole screen, having just subscribed or
+	// missed an update
+	screenSubscribed bool
+	screenStale      atomic.Bool
+
+	// eventsSubscribed is set while the client receives lifecycle events;
+	// notify while attached, for the events of other clients only
+	eventsSubscribed bool
+	notify           bool
+
+	// expect holds the expect rules of the client, if any. It is set
+	// holding both Daemon.history.mu and Daemon.mu.
+	expect *expecter
+
+	usage clientUsage // quota consumption, protected by Daemon.mu
+
+	// idleTimeout is how long the client may stay silent before its
+	// connection is dropped, set by PING; 0 for no limit
+	idleTimeout time.Duration
+
+	// Flow control of the output, protected by Daemon.history.mu: the
+	// policy, the bytes of output the client may still receive and, while
+	// paused, the offset of the first output held back
+	flow     byte
+	credit   int64
+	paused   bool
+	resumeAt uint64
+}
+
+// envLogKey is the key taken out of storage.KeyEnv, for the daemons created
+// later in the same process
+var (
+	envLogKeyMu sync.Mutex
+	envLogKey   []byte
+)
+
+// loadLogKey returns the key of the output log as storage.LoadKey does, but
+// removes storage.KeyEnv from the environment once read, so that the
+// process, hooks and filters do not inherit it
+func loadLogKey(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return storage.LoadKey(keyFile)
+	}
+	envLogKeyMu.Lock()
+	defer envLogKeyMu.Unlock()
+	if _, ok := os.LookupEnv(storage.KeyEnv); ok {
+		envLogKey, _ = storage.LoadKey("")
+		os.Unsetenv(storage.KeyEnv)
+	}
+	return envLogKey, nil
 }
 
 // New creates a new daemon instance
@@ -100,6 +585,111 @@ func New(config *Config) (*Daemon, error) {
 	if len(config.Command) == 0 {
 		return nil, fmt.Errorf("command is required")
 	}
+	if config.Record && !config.UseVTY {
+		return nil, fmt.Errorf("recording requires VTY mode")
+	}
+	if config.UseVTY && (config.StdoutMode >= IOModeSyslog || config.StderrMode >= IOModeSyslog) {
+		return nil, fmt.Errorf("syslog, journal and filter output require pipes, not VTY mode")
+	}
+	if (config.StdoutMode == IOModeFilter && config.StdoutFilter == "") || (config.StderrMode == IOModeFilter && config.StderrFilter == "") {
+		return nil, fmt.Errorf("filter output requires a command")
+	}
+	if config.UseVTY && len(config.StderrTee) > 0 {
+		return nil, fmt.Errorf("stderr tee files require pipes, not VTY mode")
+	}
+	if _, err := parseSyslogFacility(config.SyslogFacility); err != nil {
+		return nil, err
+	}
+	if config.SocketMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid socket mode %v", config.SocketMode)
+	}
+	if (len(config.AllowedUIDs) > 0 || len(config.AllowedGIDs) > 0) && !peerCredSupported {
+		return nil, fmt.Errorf("client allowlists require peer credentials, which are not supported on this system")
+	}
+	if config.Cgroup != nil {
+		if err := config.Cgroup.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Rlimits) > 0 {
+		if err := validateRlimits(config.Rlimits); err != nil {
+			return nil, err
+		}
+	}
+	if err := validatePriorities(config); err != nil {
+		return nil, err
+	}
+	if config.NoNewPrivs && !execSetupSupported {
+		return nil, fmt.Errorf("no new privileges is only supported on Linux")
+	}
+	seccomp, err := loadSeccompFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	var restore *Checkpoint
+	var criu string
+	if config.RestoreFrom != "" {
+		if restore, err = LoadCheckpoint(config.RestoreFrom); err != nil {
+			return nil, err
+		}
+		if criu, err = criuPath(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateWebhooks(config.Webhooks); err != nil {
+		return nil, err
+	}
+	if anonymousListener(config) && config.TLSCertFile == "" && config.TokenFile == "" && !config.AllowAnonymous {
+		return nil, fmt.Errorf("the WebSocket bridge and the REST API over TCP require TLS or a token, unless anonymous access is allowed")
+	}
+	if config.LingerAfterExit < 0 {
+		return nil, fmt.Errorf("invalid linger time: %d", config.LingerAfterExit)
+	}
+	if config.MaxLogBytes < 0 {
+		return nil, fmt.Errorf("invalid output log cap: %d", config.MaxLogBytes)
+	}
+	if config.MaxOutputRate < 0 {
+		return nil, fmt.Errorf("invalid output rate: %d", config.MaxOutputRate)
+	}
+	if err := validateSizePolicy(config); err != nil {
+		return nil, err
+	}
+	var env []string
+	for _, path := range config.EnvFiles {
+		vars, err := loadEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, vars...)
+	}
+	for _, kv := range config.Env {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			return nil, fmt.Errorf("invalid environment variable %q: KEY=value required", kv)
+		}
+	}
+	env = append(env, config.Env...)
+	schedule, err := validateStart(config)
+	if err != nil {
+		return nil, err
+	}
+	var healthCheck *healthChecker
+	if config.HealthCheck != nil {
+		if healthCheck, err = config.HealthCheck.checker(); err != nil {
+			return nil, err
+		}
+	}
+	socketGID, err := lookupGroup(config.SocketGroup)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := loadTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	token, err := loadToken(config)
+	if err != nil {
+		return nil, err
+	}
 
 	// Determine runtime directory
 	runtimeDir := config.RuntimeDir
@@ -111,14 +701,64 @@ func New(config *Config) (*Daemon, error) {
 		}
 	}
 
+	store := config.Storage
+	if store == nil {
+		store = storage.Dir(runtimeDir)
+	}
+
+	// Encrypt the output log at rest if a key is configured
+	key, err := loadLogKey(config.LogKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if store, err = storage.NewEncrypted(store, key, LogFileName, RecordingFileName, TimelineFileName, SnapshotFileName); err != nil {
+			return nil, fmt.Errorf("failed to set up log encryption: %w", err)
+		}
+	}
+
+	var signer crypto.Signer
+	if config.SigningKeyFile != "" {
+		if signer, err = LoadSigningKey(config.SigningKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	socketPath := config.SocketPath
+	if socketPath == "" {
+		socketPath = filepath.Join(runtimeDir, SocketFileName)
+	}
+
 	d := &Daemon{
 		config:     config,
 		runtimeDir: runtimeDir,
-		socketPath: filepath.Join(runtimeDir, "control.sock"),
-		logPath:    filepath.Join(runtimeDir, "output.log"),
+		socketPath: socketPath,
+		socketGID:  socketGID,
+		tlsConfig:  tlsConfig,
+		token:      token,
+		seccomp:    seccomp,
+		restore:    restore,
+		criu:       criu,
+		schedule:   schedule,
+		env:        env,
+		storage:    store,
+		signer:     signer,
+		logger:     newDaemonLog(config.LogLevel, config.LogMaxSize),
+		logCap:     newLogCap(config.MaxLogBytes),
+		limiter:    newOutputLimiter(config.MaxOutputRate),
 		clients:    make(map[net.Conn]*client),
 		closeCh:    make(chan struct{}),
+		exited:     make(chan struct{}),
+		reaped:     make(chan struct{}),
 		doneCh:     make(chan struct{}),
+		expectCh:   make(chan expectInput, expectQueueSize),
+	}
+	if healthCheck != nil {
+		d.healthCheck = healthCheck
+		d.processHealth = protocol.HealthStarting
+	}
+	if !config.Embedded {
+		d.systemd = systemdFromEnv()
 	}
 
 	return d, nil
@@ -126,16 +766,7 @@ func New(config *Config) (*Daemon, error) {
 
 // getRuntimeDir determines the runtime directory path
 func getRuntimeDir() (string, error) {
-	// Try XDG_RUNTIME_DIR first
-	if xdgRuntime := os.Getenv("XDG_RUNTIME_DIR"); xdgRuntime != "" {
-		dir := filepath.Join(xdgRuntime, "bgrun", strconv.Itoa(os.Getpid()))
-		return dir, nil
-	}
-
-	// Fall back to /tmp/.bgrun-<uid>/<pid>
-	uid := os.Getuid()
-	dir := filepath.Join("/tmp", ".bgrun-"+strconv.Itoa(uid), strconv.Itoa(os.Getpid()))
-	return dir, nil
+	return filepath.Join(RuntimeRoot(), strconv.Itoa(os.Getpid())), nil
 }
 
 // RuntimeDir returns the runtime directory path
@@ -143,11 +774,21 @@ func (d *Daemon) RuntimeDir() string {
 	return d.runtimeDir
 }
 
+// Storage returns the storage holding the run artifacts
+func (d *Daemon) Storage() storage.Storage {
+	return d.storage
+}
+
 // SocketPath returns the control socket path
 func (d *Daemon) SocketPath() string {
 	return d.socketPath
 }
 
+// PID returns the PID of the process, 0 until it started
+func (d *Daemon) PID() int {
+	return d.childPID()
+}
+
 // Done returns a channel that is closed when the process exits
 func (d *Daemon) Done() <-chan struct{} {
 	return d.doneCh
@@ -158,24 +799,79 @@ func (d *Daemon) Wait() {
 	<-d.doneCh
 }
 
+// stdin returns the pipe to the process stdin, or nil if stdin is not
+// streamed or has been closed
+func (d *Daemon) stdin() io.WriteCloser {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.stdinClosed {
+		return nil
+	}
+	return d.stdinPipe
+}
+
+// pty returns the PTY of a VTY process, or nil
+func (d *Daemon) pty() *os.File {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.vtyPty
+}
+
+// terminal returns the terminal emulator of a VTY process, or nil
+func (d *Daemon) terminal() *termemu.Terminal {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.vtyTermemu
+}
+
 // Start starts the daemon and the managed process
 func (d *Daemon) Start() error {
+	// Make a custom runtime directory discoverable by PID
+	if !d.config.Embedded {
+		d.indexRuntimeDir()
+	}
+
 	// Create runtime directory
 	if err := os.MkdirAll(d.runtimeDir, 0700); err != nil {
 		return fmt.Errorf("failed to create runtime directory: %w", err)
 	}
+	d.logger.open(d.runtimeDir)
+
+	// Record configuration so the job can be retried later
+	if err := d.writeConfig(); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	// List the daemon before its exit can be recorded
+	if !d.config.Embedded {
+		d.register()
+	}
+
+	// Link to the previous run if this is a retry
+	if d.config.PreviousRun != "" {
+		d.linkPreviousRun()
+	}
 
 	// Open log file
 	var err error
-	d.logFile, err = os.OpenFile(d.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	d.logFile, err = d.storage.Append(LogFileName)
 	if err != nil {
 		return fmt.Errorf("failed to open log file: %w", err)
 	}
 
-	// Start the process
-	if err := d.startProcess(); err != nil {
-		d.logFile.Close()
-		return fmt.Errorf("failed to start process: %w", err)
+	// A scheduled process starts later, the daemon serving its clients
+	// meanwhile
+	at := d.startTime(time.Now())
+	if at.IsZero() {
+		if err := d.launch(); err != nil {
+			d.logFile.Close()
+			return err
+		}
+	} else {
+		d.mu.Lock()
+		d.scheduledAt = at
+		d.mu.Unlock()
+		d.infof("Process scheduled to start at %s", at.Format(time.RFC3339))
 	}
 
 	// Start socket server
@@ -183,29 +879,162 @@ func (d *Daemon) Start() error {
 		d.stop()
 		return fmt.Errorf("failed to start socket server: %w", err)
 	}
+	if err := d.startTCPServer(); err != nil {
+		d.stop()
+		return fmt.Errorf("failed to start TCP server: %w", err)
+	}
+	if err := d.startWebSocketServer(); err != nil {
+		d.stop()
+		return fmt.Errorf("failed to start WebSocket bridge: %w", err)
+	}
+	if err := d.startWebUIServer(); err != nil {
+		d.stop()
+		return fmt.Errorf("failed to start web UI: %w", err)
+	}
+	if err := d.startAPIServer(); err != nil {
+		d.stop()
+		return fmt.Errorf("failed to start REST API: %w", err)
+	}
 
+	if at.IsZero() {
+		d.startHandlers()
+	} else {
+		go d.startScheduled(at)
+	}
+	if d.systemd.watchdog > 0 {
+		go d.watchdogLoop()
+	}
+
+	d.updateStatus()
+	d.notifyReady()
+	if at.IsZero() {
+		d.runPostStartHook()
+	}
+	return nil
+}
+
+// launch runs the start hooks and starts the process, recording why it
+// could not be started
+func (d *Daemon) launch() error {
+	if err := d.runStartHooks(); err != nil {
+		d.startFailed(err)
+		d.notifyExit(0)
+		return err
+	}
+
+	// Start the process
+	if err := d.startProcess(); err != nil {
+		err = fmt.Errorf("failed to start process: %w", err)
+		d.startFailed(err)
+		d.notifyExit(0)
+		return err
+	}
+
+	if d.config.Record {
+		if err := d.startRecording(); err != nil {
+			d.warnf("Failed to start recording: %v", err)
+		}
+	}
+	return nil
+}
+
+// startHandlers starts the goroutines handling the process once started
+func (d *Daemon) startHandlers() {
 	// Start output handlers
 	if d.config.UseVTY {
+		d.outputWg.Add(1)
 		go d.handleVTYOutput()
+		go d.snapshotLoop()
+		go d.watchForeground()
 	} else {
+		d.outputWg.Add(2)
 		go d.handleStdout()
 		go d.handleStderr()
+		if d.config.StdinMode == StdinStream && d.stdinFile != nil {
+			go d.feedStdin(d.stdinFile)
+		}
 	}
+	go d.sendExpected()
+	go d.statusLoop()
 	go d.waitForProcess()
+	if d.healthCheck != nil {
+		go d.healthCheckLoop()
+	}
+}
+
+// writeConfig records the daemon configuration in the run storage
+func (d *Daemon) writeConfig() error {
+	data, err := json.MarshalIndent(d.config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return d.storage.WriteFile(ConfigFileName, data)
+}
 
+// WriteStatus records the final process status in the run storage, where
+// clients find it once the daemon has exited. With a signing key configured
+// the digests of status.json and output.log are signed as well. The status
+// is no longer updated afterwards, see updateStatus.
+func (d *Daemon) WriteStatus() error {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	if d.removed {
+		return nil
+	}
+	d.statusFinal = true
+	if err := d.writeStatusFile(); err != nil {
+		return err
+	}
+
+	if d.signer != nil {
+		if err := d.signArtifacts(); err != nil {
+			return fmt.Errorf("failed to write signature: %w", err)
+		}
+	}
 	return nil
 }
 
+// linkPreviousRun links this run and the one it replaces in both directions
+func (d *Daemon) linkPreviousRun() {
+	link := filepath.Join(d.runtimeDir, PreviousRunLink)
+	os.Remove(link)
+	if err := os.Symlink(d.config.PreviousRun, link); err != nil {
+		d.warnf("Failed to link previous run: %v", err)
+	}
+
+	link = filepath.Join(d.config.PreviousRun, NextRunLink)
+	os.Remove(link)
+	if err := os.Symlink(d.runtimeDir, link); err != nil {
+		d.warnf("Failed to link next run: %v", err)
+	}
+}
+
+// LoadConfig reads the configuration recorded by a daemon in its runtime directory
+func LoadConfig(runtimeDir string) (*Config, error) {
+	data, err := storage.Dir(runtimeDir).ReadFile(ConfigFileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return &config, nil
+}
+
 // startProcess starts the managed process
 func (d *Daemon) startProcess() error {
 	// Use VTY mode if enabled
 	if d.config.UseVTY {
-		d.startedAt = time.Now()
 		return d.startProcessVTY()
 	}
 
 	// Standard mode
-	d.cmd = exec.Command(d.config.Command[0], d.config.Command[1:]...)
+	d.cmd = d.command()
+	d.cmd.Dir = d.config.Dir
 
 	// Setup stdin
 	if err := d.setupStdin(); err != nil {
@@ -226,18 +1055,35 @@ func (d *Daemon) startProcess() error {
 	d.cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 	}
+	if err := d.setupExec(); err != nil {
+		return err
+	}
+	if err := d.setupCgroup(); err != nil {
+		return err
+	}
 
-	d.startedAt = time.Now()
-	if err := d.cmd.Start(); err != nil {
+	startedAt := time.Now()
+	err := d.cmd.Start()
+	d.cgroupStarted(err)
+
+	// The child has its own copies of the pipe write ends now
+	for _, f := range d.childWriters {
+		f.Close()
+	}
+	d.childWriters = nil
+
+	if err != nil {
 		return fmt.Errorf("failed to start command: %w", err)
 	}
 
 	d.mu.Lock()
 	d.pid = d.cmd.Process.Pid
 	d.running = true
+	d.startedAt = startedAt
 	d.mu.Unlock()
 
-	log.Printf("Started process %d: %v", d.pid, d.config.Command)
+	d.infof("Started process %d: %v", d.cmd.Process.Pid, d.config.Command)
+	d.restoreStarted()
 
 	return nil
 }
@@ -254,7 +1100,7 @@ func (d *Daemon) setupStdin() error {
 		d.cmd.Stdin = devNull
 
 	case StdinFile:
-		f, err := os.Open(d.config.StdinPath)
+		f, err := openStdin(d.config.StdinPath)
 		if err != nil {
 			return err
 		}
@@ -262,11 +1108,21 @@ func (d *Daemon) setupStdin() error {
 		d.cmd.Stdin = f
 
 	case StdinStream:
+		if d.config.StdinPath != "" {
+			// Fed to the pipe by feedStdin once started
+			f, err := openStdin(d.config.StdinPath)
+			if err != nil {
+				return err
+			}
+			d.stdinFile = f
+		}
 		pipe, err := d.cmd.StdinPipe()
 		if err != nil {
 			return err
 		}
+		d.mu.Lock()
 		d.stdinPipe = pipe
+		d.mu.Unlock()
 	}
 
 	return nil
@@ -274,6 +1130,17 @@ func (d *Daemon) setupStdin() error {
 
 // setupStdout configures stdout for the process
 func (d *Daemon) setupStdout() error {
+	if len(d.config.StdoutTee) > 0 {
+		w, err := d.setupTee(protocol.StreamStdout, d.config.StdoutMode, d.config.StdoutPath, d.config.StdoutTee)
+		if err != nil {
+			return err
+		}
+		if w != nil {
+			d.cmd.Stdout = w
+			return nil
+		}
+	}
+
 	switch d.config.StdoutMode {
 	case IOModeNull:
 		devNull, err := os.OpenFile("/dev/null", os.O_WRONLY, 0)
@@ -291,12 +1158,31 @@ func (d *Daemon) setupStdout() error {
 		d.stdoutFile = f
 		d.cmd.Stdout = f
 
-	case IOModeLog:
-		pipe, err := d.cmd.StdoutPipe()
+	case IOModeLog, IOModeSyslog, IOModeJournal:
+		forward, err := d.newForwarder(d.config.StdoutMode, protocol.StreamStdout)
+		if err != nil {
+			return err
+		}
+		d.forward[protocol.StreamStdout-1] = forward
+
+		// Use a plain pipe rather than cmd.StdoutPipe so that cmd.Wait does
+		// not close the read end before all output has been consumed
+		r, w, err := os.Pipe()
 		if err != nil {
 			return err
 		}
-		d.stdoutPipe = pipe
+		d.stdoutPipe = r
+		d.cmd.Stdout = w
+		d.childWriters = append(d.childWriters, w)
+
+	case IOModeFilter:
+		w, r, err := d.setupFilter("stdout", d.config.StdoutFilter)
+		if err != nil {
+			return fmt.Errorf("failed to start the stdout filter: %w", err)
+		}
+		d.stdoutPipe = r
+		d.cmd.Stdout = w
+		d.childWriters = append(d.childWriters, w)
 	}
 
 	return nil
@@ -304,6 +1190,17 @@ func (d *Daemon) setupStdout() error {
 
 // setupStderr configures stderr for the process
 func (d *Daemon) setupStderr() error {
+	if len(d.config.StderrTee) > 0 {
+		w, err := d.setupTee(protocol.StreamStderr, d.config.StderrMode, d.config.StderrPath, d.config.StderrTee)
+		if err != nil {
+			return err
+		}
+		if w != nil {
+			d.cmd.Stderr = w
+			return nil
+		}
+	}
+
 	switch d.config.StderrMode {
 	case IOModeNull:
 		devNull, err := os.OpenFile("/dev/null", os.O_WRONLY, 0)
@@ -321,12 +1218,31 @@ func (d *Daemon) setupStderr() error {
 		d.stderrFile = f
 		d.cmd.Stderr = f
 
-	case IOModeLog:
-		pipe, err := d.cmd.StderrPipe()
+	case IOModeLog, IOModeSyslog, IOModeJournal:
+		forward, err := d.newForwarder(d.config.StderrMode, protocol.StreamStderr)
+		if err != nil {
+			return err
+		}
+		d.forward[protocol.StreamStderr-1] = forward
+
+		// Use a plain pipe rather than cmd.StderrPipe so that cmd.Wait does
+		// not close the read end before all output has been consumed
+		r, w, err := os.Pipe()
 		if err != nil {
 			return err
 		}
-		d.stderrPipe = pipe
+		d.stderrPipe = r
+		d.cmd.Stderr = w
+		d.childWriters = append(d.childWriters, w)
+
+	case IOModeFilter:
+		w, r, err := d.setupFilter("stderr", d.config.StderrFilter)
+		if err != nil {
+			return fmt.Errorf("failed to start the stderr filter: %w", err)
+		}
+		d.stderrPipe = r
+		d.cmd.Stderr = w
+		d.childWriters = append(d.childWriters, w)
 	}
 
 	return nil
@@ -334,16 +1250,62 @@ func (d *Daemon) setupStderr() error {
 
 // GetStatus returns the current process status
 func (d *Daemon) GetStatus() *protocol.StatusResponse {
+	// The output path holds the recording lock while answering terminal
+	// queries under d.mu, so take it first
+	recording := d.isRecording()
+
+	d.history.mu.Lock()
+	outputBytes := d.history.next
+	d.history.mu.Unlock()
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
+	now := time.Now()
 	status := &protocol.StatusResponse{
-		PID:       d.pid,
-		Running:   d.running,
-		ExitCode:  d.exitCode,
-		StartedAt: d.startedAt.Format(time.RFC3339),
-		Command:   d.config.Command,
-		HasVTY:    d.config.UseVTY,
+		PID:         d.pid,
+		Running:     d.running,
+		ExitCode:    d.exitCode,
+		Command:     d.config.Command,
+		HasVTY:      d.config.UseVTY,
+		UpdatedAt:   now.Format(time.RFC3339),
+		OutputBytes: outputBytes,
+
+		PreviousRun: d.config.PreviousRun,
+	}
+	if d.endedAt != nil {
+		now = *d.endedAt
+	}
+	if !d.startedAt.IsZero() {
+		status.StartedAt = d.startedAt.Format(time.RFC3339)
+		status.UptimeSecs = int64(now.Sub(d.startedAt) / time.Second)
+	}
+	switch {
+	case d.startErr != nil:
+		status.State = protocol.StateFailedToStart
+		status.StartError = d.startErr.Error()
+	case !d.scheduledAt.IsZero():
+		status.State = protocol.StateScheduled
+		status.ScheduledAt = d.scheduledAt.Format(time.RFC3339)
+	case d.running:
+		status.State = protocol.StateRunning
+	case d.exitCode != nil:
+		status.State = protocol.StateExited
+	}
+	if p := d.panicked.Load(); p != nil {
+		status.Panic = *p
+	}
+	status.Cgroup = d.cgroupStatusLocked()
+	status.Checkpoint = d.checkpointDir
+	status.RestoredFrom = d.config.RestoreFrom
+	status.Health = d.processHealth
+	status.HealthError = d.healthError
+	if d.running {
+		// A stop signal may come from elsewhere, /proc knows when it did
+		status.Paused = d.paused
+		if stopped, ok := processStopped(d.pid); ok {
+			status.Paused = stopped
+		}
 	}
 
 	if d.endedAt != nil {
@@ -351,9 +1313,43 @@ func (d *Daemon) GetStatus() *protocol.StatusResponse {
 		status.EndedAt = &endedStr
 	}
 
+	if d.vtyTermemu != nil {
+		status.Title = d.vtyTermemu.Title()
+		status.UnsupportedSequences = d.vtyTermemu.UnsupportedSequences()
+		status.Recording = recording
+	}
+
 	return status
 }
 
+// Close stops the daemon as SHUTDOWN does: the listeners and client
+// connections are closed, and so are the pipes of a process still running
+func (d *Daemon) Close() {
+	d.stop()
+}
+
+// Signal sends sig to the process, failing once it exited
+func (d *Daemon) Signal(sig syscall.Signal) error {
+	d.mu.RLock()
+	pid := d.pid
+	running := d.running
+	d.mu.RUnlock()
+
+	if !running {
+		return fmt.Errorf("process is not running")
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("failed to send signal: %w", err)
+	}
+	switch sig {
+	case syscall.SIGSTOP:
+		d.setPaused(true)
+	case syscall.SIGCONT:
+		d.setPaused(false)
+	}
+	return nil
+}
+
 // Stop stops the daemon and cleans up resources
 func (d *Daemon) stop() {
 	d.stopOnce.Do(func() {
@@ -361,9 +1357,12 @@ func (d *Daemon) stop() {
 
 		// Close listener to unblock Accept()
 		d.listenerMu.Lock()
-		if d.listener != nil {
-			if err := d.listener.Close(); err != nil {
-				log.Printf("Error closing listener: %v", err)
+		for _, l := range []net.Listener{d.listener, d.tcpListener, d.wsListener, d.webListener, d.apiListener} {
+			if l == nil {
+				continue
+			}
+			if err := l.Close(); err != nil {
+				d.errorf("Error closing listener: %v", err)
 			}
 		}
 		d.listenerMu.Unlock()
@@ -378,101 +1377,145 @@ func (d *Daemon) stop() {
 
 		for _, conn := range conns {
 			if err := conn.Close(); err != nil {
-				log.Printf("Error closing client connection: %v", err)
+				d.errorf("Error closing client connection: %v", err)
 			}
 		}
 
 		// Close pipes
-		if d.stdinPipe != nil {
-			if err := d.stdinPipe.Close(); err != nil {
-				log.Printf("Error closing stdin pipe: %v", err)
+		if stdin := d.stdin(); stdin != nil {
+			if err := stdin.Close(); err != nil {
+				d.errorf("Error closing stdin pipe: %v", err)
 			}
 		}
 		if d.stdoutPipe != nil {
-			if err := d.stdoutPipe.Close(); err != nil {
-				log.Printf("Error closing stdout pipe: %v", err)
+			if err := d.stdoutPipe.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+				d.errorf("Error closing stdout pipe: %v", err)
 			}
 		}
 		if d.stderrPipe != nil {
-			if err := d.stderrPipe.Close(); err != nil {
-				log.Printf("Error closing stderr pipe: %v", err)
+			if err := d.stderrPipe.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+				d.errorf("Error closing stderr pipe: %v", err)
 			}
 		}
 
 		// Close file descriptors
 		if d.stdinFile != nil {
 			if err := d.stdinFile.Close(); err != nil {
-				log.Printf("Error closing stdin file: %v", err)
+				d.errorf("Error closing stdin file: %v", err)
 			}
 		}
 		if d.stdoutFile != nil {
 			if err := d.stdoutFile.Close(); err != nil {
-				log.Printf("Error closing stdout file: %v", err)
+				d.errorf("Error closing stdout file: %v", err)
 			}
 		}
 		if d.stderrFile != nil {
 			if err := d.stderrFile.Close(); err != nil {
-				log.Printf("Error closing stderr file: %v", err)
+				d.errorf("Error closing stderr file: %v", err)
 			}
 		}
 
 		// Close log file
+		d.flushLogTail()
 		if d.logFile != nil {
 			if err := d.logFile.Close(); err != nil {
-				log.Printf("Error closing log file: %v", err)
+				d.errorf("Error closing log file: %v", err)
 			}
 		}
 
+		if err := d.stopRecording(); err != nil {
+			d.errorf("Error closing recording: %v", err)
+		}
+
 		// Close VTY PTY
-		if d.vtyPty != nil {
-			if err := d.vtyPty.Close(); err != nil {
-				log.Printf("Error closing VTY PTY: %v", err)
+		if ptmx := d.pty(); ptmx != nil {
+			if err := ptmx.Close(); err != nil {
+				d.errorf("Error closing VTY PTY: %v", err)
 			}
 		}
 
 		// Clean up socket file
-		if d.socketPath != "" {
-			os.Remove(d.socketPath)
-		}
+		d.removeSocket()
 	})
 }
 
+// outputDrainTimeout bounds how long process exit reporting waits for the
+// output readers, since background children may keep the pipes open
+const outputDrainTimeout = 2 * time.Second
+
 // waitForProcess waits for the process to exit
 func (d *Daemon) waitForProcess() {
-	err := d.cmd.Wait()
+	defer d.recoverPanic("process waiter", d.exitAfterPanic)
 
-	d.mu.Lock()
-	d.running = false
-	now := time.Now()
-	d.endedAt = &now
+	err := d.cmd.Wait()
+	close(d.reaped)
+
+	// Let the readers consume what the process wrote before exiting so the
+	// log is complete by the time the exit is reported
+	drained := make(chan struct{})
+	go func() {
+		d.outputWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTimeout):
+	}
+	d.flushLogTail()
 
+	exitCode := -1
 	if exitErr, ok := err.(*exec.ExitError); ok {
-		code := exitErr.ExitCode()
-		d.exitCode = &code
+		exitCode = exitErr.ExitCode()
 	} else if err == nil {
-		code := 0
-		d.exitCode = &code
-	} else {
-		code := -1
-		d.exitCode = &code
+		exitCode = 0
+	}
+
+	d.releaseCgroup()
+
+	// The recording and screen are complete once the output is drained
+	d.recordExit(exitCode)
+	if err := d.stopRecording(); err != nil {
+		d.errorf("Error closing recording: %v", err)
+	}
+	if d.config.UseVTY {
+		if err := d.saveSnapshot(); err != nil {
+			d.errorf("Error saving terminal state: %v", err)
+		}
 	}
 
-	exitCode := *d.exitCode
+	d.mu.Lock()
+	d.running = false
+	d.paused = false
+	now := time.Now()
+	d.endedAt = &now
+	d.exitCode = &exitCode
 	d.mu.Unlock()
+	close(d.exited)
 
-	log.Printf("Process %d exited with code %d", d.pid, exitCode)
+	d.infof("Process %d exited with code %d", d.pid, exitCode)
+
+	d.updateStatus()
 
 	// Notify all clients of process exit
+	d.emitEvent(protocol.Event{Type: protocol.EventExited, Time: now, ExitCode: &exitCode})
 	d.broadcastProcessExit(exitCode)
 
 	// Remove the socket file to indicate daemon is shutting down
 	// Leave status.json for zombie process handling
-	if d.socketPath != "" {
-		os.Remove(d.socketPath)
+	if d.config.LingerAfterExit == 0 {
+		d.removeSocket()
+	}
+	if !d.config.Embedded {
+		d.registerExit(exitCode)
+	}
+	d.notifyExit(exitSignal(err))
+	d.runPostExitHook(d.childPID(), exitCode)
+	if d.config.LingerAfterExit > 0 {
+		d.linger()
 	}
 
 	// Signal that the process has exited
-	close(d.doneCh)
+	d.doneOnce.Do(func() { close(d.doneCh) })
 }
 
 // broadcastProcessExit sends process exit notification to all clients
@@ -485,9 +1528,13 @@ func (d *Daemon) broadcastProcessExit(exitCode int) {
 	d.mu.RUnlock()
 
 	for _, client := range clients {
+		// Deliver the queued output first, the exit notification is the
+		// last message a client expects
+		client.flush(exitFlushTimeout)
+
 		client.writeMu.Lock()
 		if err := protocol.WriteProcessExit(client.conn, exitCode); err != nil {
-			log.Printf("Error broadcasting exit to client: %v", err)
+			d.errorf("Error broadcasting exit to client: %v", err)
 		}
 		client.writeMu.Unlock()
 	}
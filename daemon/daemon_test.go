@@ -1,11 +1,19 @@
 package daemon
 
 import (
+	"bytes"
+	"encoding/json"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/storage"
 )
 
 func TestDaemonBasic(t *testing.T) {
@@ -210,6 +218,85 @@ func TestOutputLogging(t *testing.T) {
 	}
 }
 
+func TestDaemonEnv(t *testing.T) {
+	t.Setenv("BGRUN_TEST_INHERITED", "inherited")
+	t.Setenv("BGRUN_TEST_REPLACED", "old")
+	tmpDir := t.TempDir()
+
+	d, err := New(&Config{
+		Command:    []string{"sh", "-c", "echo $BGRUN_TEST_INHERITED $BGRUN_TEST_REPLACED $BGRUN_TEST_ADDED"},
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		Env:        []string{"BGRUN_TEST_REPLACED=new", "BGRUN_TEST_ADDED=a=b"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+	d.Wait()
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if got := strings.TrimSpace(string(content)); got != "inherited new a=b" {
+		t.Errorf("Unexpected environment %q", got)
+	}
+
+	if _, err := New(&Config{Command: []string{"true"}, Env: []string{"NOVALUE"}}); err == nil {
+		t.Error("Expected a variable without = to be refused")
+	}
+}
+
+func TestDaemonLogKeyNotInherited(t *testing.T) {
+	t.Setenv(storage.KeyEnv, "secret passphrase")
+	t.Cleanup(func() { envLogKey = nil })
+	tmpDir := t.TempDir()
+
+	d, err := New(&Config{
+		Command:    []string{"sh", "-c", "echo \"key=$BGRUN_LOG_KEY\""},
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if _, ok := os.LookupEnv(storage.KeyEnv); ok {
+		t.Errorf("Expected %s to be removed from the environment", storage.KeyEnv)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+	d.Wait()
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if !storage.IsEncrypted(content) {
+		t.Fatal("Expected the log to be encrypted with the key of the environment")
+	}
+	store, err := storage.NewEncrypted(storage.Dir(tmpDir), []byte("secret passphrase"), LogFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := store.ReadFile(LogFileName)
+	if err != nil || string(output) != "key=\n" {
+		t.Errorf("Expected the process not to inherit the key, got %q (err=%v)", output, err)
+	}
+
+	// Later daemons of the process still encrypt their log
+	if key, _ := loadLogKey(""); string(key) != "secret passphrase" {
+		t.Errorf("Expected the key to be kept for later daemons, got %q", key)
+	}
+}
+
 func TestStdinStream(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -341,3 +428,316 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestDaemonRecordsConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	previousDir := t.TempDir()
+
+	config := &Config{
+		Command:     []string{"echo", "hello"},
+		StdinMode:   StdinNull,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeFile,
+		StderrPath:  filepath.Join(tmpDir, "stderr.txt"),
+		RuntimeDir:  tmpDir,
+		PreviousRun: previousDir,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+	d.Wait()
+
+	loaded, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if len(loaded.Command) != 2 || loaded.Command[0] != "echo" || loaded.Command[1] != "hello" {
+		t.Errorf("Unexpected command: %v", loaded.Command)
+	}
+	if loaded.StderrMode != IOModeFile || loaded.StderrPath != config.StderrPath {
+		t.Errorf("Stderr config not preserved: mode=%d path=%q", loaded.StderrMode, loaded.StderrPath)
+	}
+	if loaded.PreviousRun != previousDir {
+		t.Errorf("Expected previous run %q, got %q", previousDir, loaded.PreviousRun)
+	}
+
+	target, err := os.Readlink(filepath.Join(tmpDir, PreviousRunLink))
+	if err != nil {
+		t.Fatalf("Previous run link missing: %v", err)
+	}
+	if target != previousDir {
+		t.Errorf("Expected link to %q, got %q", previousDir, target)
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	if _, err := LoadConfig(t.TempDir()); err == nil {
+		t.Error("Expected error loading config from empty directory")
+	}
+}
+
+func TestDaemonLinksPreviousRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	previousDir := t.TempDir()
+
+	// Leave a terminated run behind
+	code := 1
+	previous := protocol.StatusResponse{
+		PID:       1234,
+		ExitCode:  &code,
+		StartedAt: "2025-01-01T00:00:00Z",
+		Command:   []string{"false"},
+	}
+	data, err := json.Marshal(&previous)
+	if err != nil {
+		t.Fatalf("Failed to marshal status: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(previousDir, StatusFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	d, err := New(&Config{
+		Command:     []string{"true"},
+		StdinMode:   StdinNull,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  tmpDir,
+		PreviousRun: previousDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	if got := d.GetStatus().PreviousRun; got != previousDir {
+		t.Errorf("Expected previous run %q, got %q", previousDir, got)
+	}
+
+	if next, err := os.Readlink(filepath.Join(previousDir, NextRunLink)); err != nil || next != tmpDir {
+		t.Errorf("Expected next run link to %q, got %q (err=%v)", tmpDir, next, err)
+	}
+
+	// The previous status.json, which may be signed, is left untouched
+	if after, err := os.ReadFile(filepath.Join(previousDir, StatusFileName)); err != nil || !bytes.Equal(after, data) {
+		t.Errorf("Expected the previous status unchanged, got %q (err=%v)", after, err)
+	}
+}
+
+func TestDaemonCustomStorage(t *testing.T) {
+	tmpDir := t.TempDir()
+	storeDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"echo", "stored elsewhere"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		Storage:    storage.Dir(storeDir),
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+
+	// Artifacts go to the storage, not the runtime directory
+	for _, name := range []string{LogFileName, ConfigFileName, StatusFileName} {
+		if _, err := os.Stat(filepath.Join(storeDir, name)); err != nil {
+			t.Errorf("Expected %s in storage: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s in runtime directory", name)
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(storeDir, LogFileName))
+	if err != nil || !contains(string(content), "stored elsewhere") {
+		t.Errorf("Expected output in stored log, got %q (err=%v)", content, err)
+	}
+}
+
+func TestDaemonLiveStatus(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"sh", "-c", "echo ready; read line"},
+		StdinMode:  StdinStream,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	readStatus := func() protocol.StatusResponse {
+		t.Helper()
+		var status protocol.StatusResponse
+		data, err := os.ReadFile(filepath.Join(tmpDir, StatusFileName))
+		if err == nil {
+			err = json.Unmarshal(data, &status)
+		}
+		if err != nil {
+			t.Fatalf("Failed to read status: %v", err)
+		}
+		return status
+	}
+
+	// Written on start, while the process runs
+	if status := readStatus(); !status.Running || status.State != protocol.StateRunning || status.PID != d.pid || status.UpdatedAt == "" {
+		t.Errorf("Expected the running process in status.json, got %+v", status)
+	}
+
+	// and on exit, without WriteStatus
+	d.handleStdin([]byte("\n"))
+	d.Wait()
+	status := readStatus()
+	if status.Running || status.State != protocol.StateExited || status.ExitCode == nil || status.OutputBytes != 6 {
+		t.Errorf("Expected the exited process with 6 bytes of output in status.json, got %+v", status)
+	}
+
+	// Nothing is written after the final status
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+	os.Remove(filepath.Join(tmpDir, StatusFileName))
+	d.updateStatus()
+	if _, err := os.Stat(filepath.Join(tmpDir, StatusFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no status update after the final status, got %v", err)
+	}
+}
+
+func TestDaemonStartFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"/nonexistent/command"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	startErr := d.Start()
+	if startErr == nil {
+		d.stop()
+		t.Fatal("Expected the start to fail")
+	}
+
+	var status protocol.StatusResponse
+	data, err := os.ReadFile(filepath.Join(tmpDir, StatusFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	if err != nil {
+		t.Fatalf("Failed to read status: %v", err)
+	}
+	if status.State != protocol.StateFailedToStart || status.Running || status.ExitCode != nil {
+		t.Errorf("Expected a failed start in status.json, got %+v", status)
+	}
+	if status.StartError != startErr.Error() || !strings.Contains(status.StartError, "no such file") {
+		t.Errorf("Expected the exec error %q in status.json, got %q", startErr, status.StartError)
+	}
+	if status.StartedAt != "" {
+		t.Errorf("Expected no start time, got %q", status.StartedAt)
+	}
+}
+
+func TestDaemonSocketPermissions(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(t.TempDir(), "shared.sock")
+
+	config := &Config{
+		Command:     []string{"sleep", "10"},
+		StdinMode:   StdinNull,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  tmpDir,
+		SocketPath:  socketPath,
+		SocketMode:  0660,
+		SocketGroup: strconv.Itoa(os.Getgid()),
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Expected the socket at %s: %v", socketPath, err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("Expected mode 0660, got %v", fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Gid) != os.Getgid() {
+		t.Errorf("Expected group %d, got %d", os.Getgid(), st.Gid)
+	}
+
+	// Clients finding the daemon by PID go through the link
+	link := filepath.Join(tmpDir, SocketFileName)
+	if target, err := os.Readlink(link); err != nil || target != socketPath {
+		t.Errorf("Expected %s to link to the socket, got %q, %v", link, target, err)
+	}
+	if conn, err := net.Dial("unix", link); err != nil {
+		t.Errorf("Failed to connect through the link: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	d.stop()
+	for _, path := range []string{socketPath, link} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestDaemonInvalidSocketConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{Command: []string{"true"}, SocketMode: os.ModeSetuid | 0600},
+		{Command: []string{"true"}, SocketGroup: "no-such-group-for-bgrun"},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected New to reject %+v", config)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := `# Database
+DB_HOST=localhost
+export DB_PORT = 5432
+DB_NAME=app # inline comment
+EMPTY=
+
+SINGLE='no $expansion # here'
+DOUBLE="line\nbreak \"quoted\""
+URL=postgres://u:p@h/db?a=b
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := loadEnvFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load env file: %v", err)
+	}
+	expected := []string{
+		"DB_HOST=localhost",
+		"DB_PORT=5432",
+		"DB_NAME=app",
+		"EMPTY=",
+		"SINGLE=no $expansion # here",
+		"DOUBLE=line\nbreak \"quoted\"",
+		"URL=postgres://u:p@h/db?a=b",
+	}
+	if !slices.Equal(env, expected) {
+		t.Errorf("Expected %q, got %q", expected, env)
+	}
+
+	for _, content := range []string{"NOVALUE\n", "=value\n", "A B=c\n", "A='open\n", "A=\"open\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadEnvFile(path); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestEnvFilesOrder(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.env"), filepath.Join(dir, "second.env")
+	os.WriteFile(first, []byte("A=1\nB=1\n"), 0600)
+	os.WriteFile(second, []byte("B=2\nC=2\n"), 0600)
+
+	d, err := New(&Config{Command: []string{"true"}, EnvFiles: []string{first, second}, Env: []string{"C=3"}})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	// The environment of exec.Cmd keeps the last value of each variable
+	if !slices.Equal(d.env, []string{"A=1", "B=1", "B=2", "C=2", "C=3"}) {
+		t.Errorf("Unexpected environment %q", d.env)
+	}
+
+	if _, err := New(&Config{Command: []string{"true"}, EnvFiles: []string{filepath.Join(dir, "missing.env")}}); err == nil {
+		t.Error("Expected a missing env file to be refused")
+	}
+}
@@ -0,0 +1,215 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// foregroundPollInterval is how often the foreground process group of the
+// PTY is checked while clients are subscribed to events or waiting for it
+const foregroundPollInterval = 100 * time.Millisecond
+
+// foregroundState is the foreground process group of the PTY as last seen
+// by watchForeground, for foreground waits
+type foregroundState struct {
+	mu      sync.Mutex
+	pgrp    int           // 0 when not watched
+	changed chan struct{} // closed and replaced when pgrp changes
+	waiters int
+}
+
+// addWaiter counts a foreground wait starting, or ending with -1
+func (f *foregroundState) addWaiter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waiters += n
+}
+
+// get returns the foreground process group, and a channel closed when it
+// changes
+func (f *foregroundState) get() (int, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.changed == nil {
+		f.changed = make(chan struct{})
+	}
+	return f.pgrp, f.changed
+}
+
+// watched reports whether foreground waits are running. Without any, the
+// process group is forgotten, since it is no longer kept up to date.
+func (f *foregroundState) watched() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.waiters == 0 {
+		f.pgrp = 0
+	}
+	return f.waiters > 0
+}
+
+// set records the foreground process group, waking the waits if it changed
+func (f *foregroundState) set(pgrp int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pgrp == f.pgrp {
+		return
+	}
+	f.pgrp = pgrp
+	if f.changed != nil {
+		close(f.changed)
+		f.changed = nil
+	}
+}
+
+// handleSubscribe starts or stops sending lifecycle events to the client.
+// The first events, describing the process, are the acknowledgement.
+func (d *Daemon) handleSubscribe(conn net.Conn, payload []byte) error {
+	if len(payload) != 1 {
+		return fmt.Errorf("invalid subscribe payload length")
+	}
+
+	action := payload[0]
+	if action != protocol.EventsSubscribe && action != protocol.EventsUnsubscribe {
+		return fmt.Errorf("invalid subscribe action: 0x%02X", action)
+	}
+
+	d.eventMu.Lock()
+	defer d.eventMu.Unlock()
+
+	d.mu.Lock()
+	c, ok := d.clients[conn]
+	if ok {
+		c.eventsSubscribed = action == protocol.EventsSubscribe
+	}
+	// A scheduled process gets its started event once it starts
+	var events []*protocol.Event
+	if d.pid != 0 {
+		events = append(events, &protocol.Event{Type: protocol.EventStarted, Time: d.startedAt, PID: d.pid})
+	}
+	if !d.running && d.exitCode != nil {
+		events = append(events, &protocol.Event{Type: protocol.EventExited, Time: *d.endedAt, ExitCode: d.exitCode})
+	}
+	d.mu.Unlock()
+
+	if ok && action == protocol.EventsSubscribe {
+		for _, ev := range events {
+			d.enqueueEvent(c, ev)
+		}
+	}
+	return nil
+}
+
+// emitEvent sends ev to the clients subscribed to events. eventMu makes
+// sure events are queued in the order they happened.
+func (d *Daemon) emitEvent(ev protocol.Event) {
+	d.eventMu.Lock()
+	defer d.eventMu.Unlock()
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	d.notifyEvent(ev)
+
+	d.mu.RLock()
+	var subscribers []*client
+	for _, c := range d.clients {
+		if c.eventsSubscribed || c.notify && c.attached && isNotice(&ev, c) {
+			subscribers = append(subscribers, c)
+		}
+	}
+	d.mu.RUnlock()
+
+	for _, c := range subscribers {
+		d.enqueueEvent(c, &ev)
+	}
+}
+
+// isNotice reports whether ev is sent to c as attached with notify: another
+// client attached, detached or resized the terminal
+func isNotice(ev *protocol.Event, c *client) bool {
+	switch ev.Type {
+	case protocol.EventAttached, protocol.EventDetached, protocol.EventResized:
+		return ev.Client != c.id
+	}
+	return false
+}
+
+// enqueueEvent queues ev for c, with the output so that it arrives in order
+// with it
+func (d *Daemon) enqueueEvent(c *client, ev *protocol.Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		d.errorf("Failed to marshal %s event: %v", ev.Type, err)
+		return
+	}
+	d.enqueueMessage(c, protocol.Message{Type: protocol.MsgEvent, Payload: data})
+}
+
+// hasEventSubscribers reports whether any client is subscribed to events
+func (d *Daemon) hasEventSubscribers() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, c := range d.clients {
+		if c.eventsSubscribed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTitle emits a title event when the program changed the window
+// title. It is called by the PTY reader, which owns d.title.
+func (d *Daemon) checkTitle() {
+	term := d.terminal()
+	if term == nil {
+		return
+	}
+	if title := term.Title(); title != d.title {
+		d.title = title
+		d.emitEvent(protocol.Event{Type: protocol.EventTitle, Title: title})
+	}
+}
+
+// watchForeground emits a foreground event when another process group
+// takes the terminal, and keeps d.foreground up to date for the foreground
+// waits. It polls while clients are subscribed to events or waiting.
+func (d *Daemon) watchForeground() {
+	defer d.recoverPanic("foreground watcher", nil)
+
+	ticker := time.NewTicker(foregroundPollInterval)
+	defer ticker.Stop()
+
+	d.mu.RLock()
+	last := d.pid
+	d.mu.RUnlock()
+
+	for {
+		select {
+		case <-ticker.C:
+			waiting, subscribed := d.foreground.watched(), d.hasEventSubscribers()
+			if !waiting && !subscribed {
+				continue
+			}
+			pgrp, err := d.getForegroundPgrp()
+			if err != nil || pgrp <= 0 {
+				continue
+			}
+			if waiting {
+				d.foreground.set(pgrp)
+			}
+			if subscribed && pgrp != last {
+				last = pgrp
+				d.emitEvent(protocol.Event{Type: protocol.EventForeground, Pgrp: pgrp})
+			}
+		case <-d.doneCh:
+			return
+		case <-d.closeCh:
+			return
+		}
+	}
+}
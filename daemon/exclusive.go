@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// takeOver attaches c exclusively, like tmux attach -d: the other clients
+// are detached, and their input is refused until c detaches. It is called
+// holding both Daemon.history.mu and Daemon.mu, and returns the clients
+// detached, to notify with notifyDetached.
+func (d *Daemon) takeOver(c *client) []*client {
+	d.exclusive = c
+	var detached []*client
+	for _, other := range d.clients {
+		if other != c && other.attached {
+			other.attached = false
+			detached = append(detached, other)
+		}
+	}
+	return detached
+}
+
+// notifyDetached tells the clients detached by c that they were
+func (d *Daemon) notifyDetached(c *client, detached []*client) {
+	d.infof("%s attached exclusively, detaching %d other clients", c, len(detached))
+	for _, other := range detached {
+		other.writeMu.Lock()
+		err := protocol.WriteDetached(other.conn, c.id)
+		other.writeMu.Unlock()
+		if err != nil {
+			d.debugf("Failed to notify %s of its detachment: %v", other, err)
+		}
+		d.emitEvent(protocol.Event{Type: protocol.EventDetached, Client: other.id})
+	}
+}
+
+// releaseExclusive ends the exclusive attachment of c, if it has one. It is
+// called holding Daemon.mu.
+func (d *Daemon) releaseExclusive(c *client) {
+	if d.exclusive == c {
+		d.exclusive = nil
+	}
+}
+
+// checkInput refuses the input of the client on conn while another client
+// is attached exclusively
+func (d *Daemon) checkInput(conn net.Conn) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.exclusive == nil || d.exclusive.conn == conn {
+		return nil
+	}
+	return fmt.Errorf("stdin is held by client %d, attached exclusively", d.exclusive.id)
+}
@@ -0,0 +1,145 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"syscall"
+)
+
+// execSetupEnv carries an execSetup to the daemon binary the process is
+// started as, which applies it and executes the command
+const execSetupEnv = "BGRUN_EXEC_SETUP"
+
+// execSetup is what is set on the process before it executes the command
+type execSetup struct {
+	Path        string   `json:"path"`
+	Rlimits     []Rlimit `json:"rlimits,omitempty"`
+	Nice        *int     `json:"nice,omitempty"`
+	IOPriority  int      `json:"ioprio,omitempty"`
+	OOMScoreAdj *int     `json:"oom_score_adj,omitempty"`
+
+	NoNewPrivs bool           `json:"no_new_privs,omitempty"`
+	Seccomp    *seccompFilter `json:"seccomp,omitempty"`
+}
+
+// setupExec has the command started through the daemon binary when the
+// process needs resource limits, priorities or restrictions, which it sets
+// between fork and exec as Go cannot, in MaybeExecSetup
+func (d *Daemon) setupExec() error {
+	c := d.config
+	if len(c.Rlimits) == 0 && c.Nice == nil && c.IONice == "" && c.OOMScoreAdj == nil && !c.NoNewPrivs && d.seccomp == nil {
+		return nil
+	}
+	if d.cmd.Err != nil || d.restore != nil {
+		// A command that was not found fails to start as is, and CRIU
+		// restores a process as it was
+		return nil
+	}
+	setup := execSetup{
+		Path:        d.cmd.Path,
+		Rlimits:     c.Rlimits,
+		Nice:        c.Nice,
+		OOMScoreAdj: c.OOMScoreAdj,
+		// Unprivileged processes need no new privileges for seccomp
+		NoNewPrivs: c.NoNewPrivs || d.seccomp != nil,
+		Seccomp:    d.seccomp,
+	}
+	if c.IONice != "" {
+		var err error
+		if setup.IOPriority, err = parseIONice(c.IONice); err != nil {
+			return err
+		}
+	}
+	self, err := selfExecutable()
+	if err != nil {
+		return fmt.Errorf("failed to find the daemon binary to set up the process: %w", err)
+	}
+	spec, err := json.Marshal(setup)
+	if err != nil {
+		return err
+	}
+	env := d.cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	d.cmd.Env = append(slices.Clip(env), execSetupEnv+"="+string(spec))
+	d.cmd.Path = self
+	return nil
+}
+
+// MaybeExecSetup sets up a process the daemon started as its own binary
+// and executes its command, never returning; in any other process it
+// returns at once. Programs embedding the daemon must call it first thing
+// in main, before starting goroutines or changing the state of the process,
+// which the command would inherit.
+func MaybeExecSetup() {
+	if spec, ok := os.LookupEnv(execSetupEnv); ok {
+		os.Unsetenv(execSetupEnv)
+		execWithSetup(spec)
+	}
+}
+
+// execWithSetup sets up the process as spec says and executes its command,
+// keeping the arguments, environment and file descriptors
+func execWithSetup(spec string) {
+	// Priorities and restrictions are set on the calling thread, which must
+	// be the one executing the command
+	runtime.LockOSThread()
+
+	var setup execSetup
+	err := json.Unmarshal([]byte(spec), &setup)
+	if err == nil && setup.OOMScoreAdj != nil {
+		if err = setOOMScoreAdj(*setup.OOMScoreAdj); err != nil {
+			err = fmt.Errorf("failed to set the OOM score adjustment: %w", err)
+		}
+	}
+	if err == nil && setup.Nice != nil {
+		if err = setNice(*setup.Nice); err != nil {
+			err = fmt.Errorf("failed to set the niceness: %w", err)
+		}
+	}
+	if err == nil && setup.IOPriority != 0 {
+		if err = setIOPriority(setup.IOPriority); err != nil {
+			err = fmt.Errorf("failed to set the I/O priority: %w", err)
+		}
+	}
+	for _, r := range setup.Rlimits {
+		if err != nil {
+			break
+		}
+		if err = setRlimit(r); err != nil {
+			err = fmt.Errorf("failed to set %s: %w", r, err)
+		}
+	}
+	if err == nil && setup.NoNewPrivs {
+		if err = setNoNewPrivs(); err != nil {
+			err = fmt.Errorf("failed to set no new privileges: %w", err)
+		}
+	}
+	// The filter is installed last, as it may deny what comes before
+	env := os.Environ()
+	if err == nil && setup.Seccomp != nil {
+		// Setting the limit of open files keeps syscall.Exec from restoring
+		// the one the Go runtime raised at startup, with a system call the
+		// filter may deny; the process keeps the raised one
+		var nofile syscall.Rlimit
+		if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile); err == nil {
+			err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &nofile)
+		}
+		if err == nil {
+			err = installSeccomp(setup.Seccomp)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to install seccomp filter: %w", err)
+		}
+	}
+	if err == nil {
+		err = syscall.Exec(setup.Path, os.Args, env)
+	}
+	fmt.Fprintf(os.Stderr, "bgrun: %v\n", err)
+	// The status of a command that cannot be executed
+	os.Exit(127)
+}
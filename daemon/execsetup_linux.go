@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// execSetupSupported tells whether the process can be set up between fork
+// and exec, with resource limits and priorities
+const execSetupSupported = true
+
+// rlimitResources are the resources that can be limited, by name
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// hardRlimit returns the hard limit of resource of the daemon
+func hardRlimit(resource int) (uint64, error) {
+	var current unix.Rlimit
+	if err := unix.Getrlimit(resource, &current); err != nil {
+		return 0, err
+	}
+	return current.Max, nil
+}
+
+// setRlimit sets the limit r of the calling process
+func setRlimit(r Rlimit) error {
+	return unix.Setrlimit(rlimitResources[r.Resource], &unix.Rlimit{Cur: r.Soft, Max: r.Hard})
+}
+
+// selfExecutable returns the path the daemon binary can be executed from,
+// even once replaced on disk
+func selfExecutable() (string, error) {
+	return "/proc/self/exe", nil
+}
+
+// setNice sets the niceness of the calling thread, which is the one of the
+// process once it executed the command
+func setNice(nice int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, nice)
+}
+
+// ioprioWhoProcess is IOPRIO_WHO_PROCESS of ioprio_set(2)
+const ioprioWhoProcess = 1
+
+// setIOPriority sets the I/O priority of the calling thread, as encoded by
+// IONice.ioprio
+func setIOPriority(ioprio int) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setOOMScoreAdj sets how likely the process is to be killed when the
+// system is out of memory
+func setOOMScoreAdj(adj int) error {
+	return os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0)
+}
+
+// setNoNewPrivs keeps the calling thread and what it executes from gaining
+// privileges, through setuid binaries or file capabilities
+func setNoNewPrivs() error {
+	return unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package daemon
+
+import "errors"
+
+// execSetupSupported tells whether the process can be set up between fork
+// and exec, with resource limits and priorities
+const execSetupSupported = false
+
+// rlimitResources is only filled on Linux
+var rlimitResources = map[string]int{}
+
+var errExecSetupUnsupported = errors.New("resource limits and priorities are only supported on Linux")
+
+func hardRlimit(resource int) (uint64, error) { return 0, errExecSetupUnsupported }
+
+func setRlimit(r Rlimit) error { return errExecSetupUnsupported }
+
+func selfExecutable() (string, error) { return "", errExecSetupUnsupported }
+
+func setNice(nice int) error { return errExecSetupUnsupported }
+
+func setIOPriority(ioprio int) error { return errExecSetupUnsupported }
+
+func setOOMScoreAdj(adj int) error { return errExecSetupUnsupported }
+
+func setNoNewPrivs() error { return errExecSetupUnsupported }
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// maxExpectRules bounds the rules a client may set
+const maxExpectRules = 64
+
+// expectQueueSize is the number of inputs of matched rules waiting to be
+// written to the process
+const expectQueueSize = 64
+
+// expecter matches the expect rules of a client against the output, as it
+// is numbered under Daemon.history.mu which protects it
+type expecter struct {
+	rules []*expectRule
+	buf   []byte // output not consumed by a match yet
+}
+
+// expectRule is a compiled protocol.ExpectRule
+type expectRule struct {
+	index int // in the request, reported in matches
+	re    *regexp.Regexp
+	send  []byte
+	once  bool
+}
+
+// expectInput is the input of a matched rule, written by sendExpected
+type expectInput struct {
+	conn net.Conn
+	data []byte
+}
+
+// handleExpect sets the expect rules of the client. Output printed before
+// the request only counts for the current line, so that a prompt already
+// displayed is answered.
+func (d *Daemon) handleExpect(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseExpectRequest(payload)
+	if err != nil {
+		return err
+	}
+	if !d.config.UseVTY && d.config.StdinMode != StdinStream {
+		return fmt.Errorf("stdin is not available for streaming")
+	}
+	if len(req.Rules) > maxExpectRules {
+		return fmt.Errorf("too many expect rules: %d (max %d)", len(req.Rules), maxExpectRules)
+	}
+
+	var e *expecter
+	if len(req.Rules) > 0 {
+		e = &expecter{}
+		for i, rule := range req.Rules {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", rule.Pattern, err)
+			}
+			if re.MatchString("") {
+				return fmt.Errorf("invalid pattern %q: matches empty output", rule.Pattern)
+			}
+			e.rules = append(e.rules, &expectRule{index: i, re: re, send: []byte(rule.Send), once: rule.Once})
+		}
+	}
+
+	d.debugf("Expect request: %d rules", len(req.Rules))
+
+	// The response is queued like the matches, which it must precede
+	d.history.mu.Lock()
+	defer d.history.mu.Unlock()
+
+	d.mu.Lock()
+	c, ok := d.clients[conn]
+	if ok {
+		c.expect = e
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	d.enqueueMessage(c, protocol.Message{Type: protocol.MsgExpectResponse})
+	if e != nil {
+		e.buf = d.history.lastLine()
+		d.matchExpect(c, e)
+	}
+	return nil
+}
+
+// expectOutput matches chunk against the expect rules of the clients.
+// Called with history.mu held.
+func (d *Daemon) expectOutput(chunk *outputChunk) {
+	d.mu.RLock()
+	var clients []*client
+	for _, c := range d.clients {
+		if c.expect != nil {
+			clients = append(clients, c)
+		}
+	}
+	d.mu.RUnlock()
+
+	for _, c := range clients {
+		e := c.expect
+		e.buf = append(e.buf, chunk.data...)
+		d.matchExpect(c, e)
+	}
+}
+
+// matchExpect applies the rules of e to its buffered output, earliest match
+// first. Each match consumes the output up to its end, the rest of the
+// buffer being kept up to maxPartialLine for patterns spanning chunks.
+// Called with history.mu held.
+func (d *Daemon) matchExpect(c *client, e *expecter) {
+	for len(e.rules) > 0 {
+		var rule *expectRule
+		var loc []int
+		for _, r := range e.rules {
+			if l := r.re.FindIndex(e.buf); l != nil && (loc == nil || l[0] < loc[0]) {
+				rule, loc = r, l
+			}
+		}
+		if rule == nil {
+			break
+		}
+
+		select {
+		case d.expectCh <- expectInput{conn: c.conn, data: rule.send}:
+		default:
+			d.warnf("Expect input queue full, dropping the input of rule %d for client %d", rule.index, c.id)
+		}
+
+		data, err := json.Marshal(&protocol.ExpectMatch{Rule: rule.index, Text: string(e.buf[loc[0]:loc[1]]), Time: time.Now()})
+		if err == nil {
+			d.enqueueMessage(c, protocol.Message{Type: protocol.MsgExpectMatch, Payload: data})
+		}
+
+		e.buf = e.buf[loc[1]:]
+		if rule.once {
+			e.rules = slices.DeleteFunc(e.rules, func(r *expectRule) bool { return r == rule })
+		}
+	}
+	if len(e.buf) > maxPartialLine {
+		e.buf = e.buf[len(e.buf)-maxPartialLine:]
+	}
+}
+
+// sendExpected writes the input of matched rules to the process, in the
+// order of the matches, as if the client sent it
+func (d *Daemon) sendExpected() {
+	defer d.recoverPanic("expect sender", nil)
+
+	for {
+		select {
+		case in := <-d.expectCh:
+			if err := d.chargeStdin(in.conn, len(in.data)); err != nil {
+				d.warnf("Expect input not sent: %v", err)
+				continue
+			}
+			d.recordClientEvent(in.conn, protocol.TimelineEvent{Type: protocol.TimelineInput, Data: string(in.data)})
+			if err := d.handleStdin(in.data); err != nil {
+				d.warnf("Expect input not sent: %v", err)
+			}
+		case <-d.doneCh:
+			return
+		case <-d.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// filterRestartDelay is how long a filter that failed waits to be
+// restarted, so that a broken command does not spin
+const filterRestartDelay = time.Second
+
+// outputFilter is the command the output of a stream in IOModeFilter is
+// piped through. The daemon keeps both ends of its pipes open, so that it
+// can be restarted without the program noticing.
+type outputFilter struct {
+	name    string   // stream, for the daemon log
+	command string   // shell command line
+	in      *os.File // read end of the program's output
+	out     *os.File // write end of the pipe read by the daemon
+}
+
+// setupFilter pipes the output of the program through the filter of the
+// stream, returning the end the program writes to and the one the daemon
+// reads from
+func (d *Daemon) setupFilter(name, command string) (childOut, filtered *os.File, err error) {
+	in, childOut, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	filtered, out, err := os.Pipe()
+	if err != nil {
+		in.Close()
+		childOut.Close()
+		return nil, nil, err
+	}
+
+	f := &outputFilter{name: name, command: command, in: in, out: out}
+	cmd, err := d.startFilter(f)
+	if err != nil {
+		for _, p := range []*os.File{in, childOut, filtered, out} {
+			p.Close()
+		}
+		return nil, nil, err
+	}
+	go d.superviseFilter(f, cmd)
+	return childOut, filtered, nil
+}
+
+// startFilter runs the filter command in a process group of its own, so
+// that the signals sent to the program do not reach it. What it writes to
+// stderr goes to the daemon log.
+func (d *Daemon) startFilter(f *outputFilter) (*exec.Cmd, error) {
+	cmd := exec.Command("/bin/sh", "-c", f.command)
+	cmd.Dir = d.config.Dir
+	cmd.Stdin = f.in
+	cmd.Stdout = f.out
+	cmd.Stderr = &filterLog{d: d, name: f.name}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	d.infof("Started %s filter %d: %s", f.name, cmd.Process.Pid, f.command)
+	return cmd, nil
+}
+
+// superviseFilter restarts the filter when it fails while the program
+// runs. Once the filter exited, successfully at the end of the output or
+// failing after the program, the daemon closes its pipes so that the stream
+// ends.
+func (d *Daemon) superviseFilter(f *outputFilter, cmd *exec.Cmd) {
+	defer d.recoverPanic(f.name+" filter", nil)
+	defer f.out.Close()
+	defer f.in.Close()
+
+	for {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-d.closeCh:
+			cmd.Process.Kill()
+			<-done
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-d.reaped:
+			d.warnf("The %s filter exited: %v", f.name, err)
+			return
+		default:
+		}
+		d.warnf("The %s filter exited: %v, restarting it", f.name, err)
+
+		select {
+		case <-time.After(filterRestartDelay):
+		case <-d.closeCh:
+			return
+		}
+		if cmd, err = d.startFilter(f); err != nil {
+			d.errorf("Failed to restart the %s filter: %v", f.name, err)
+			return
+		}
+	}
+}
+
+// filterLog writes the stderr of a filter to the daemon log, line by line
+type filterLog struct {
+	d       *Daemon
+	name    string
+	partial []byte
+}
+
+func (l *filterLog) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.d.warnf("%s filter: %s", l.name, l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	l.partial = append([]byte(nil), l.partial...)
+	return len(p), nil
+}
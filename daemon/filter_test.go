@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputFilter(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		Command:      []string{"bash", "-c", "echo one; echo oops >&2; sleep 1.5; echo two"},
+		StdinMode:    StdinNull,
+		StdoutMode:   IOModeFilter,
+		StdoutFilter: "sed -u 's/^/out: /'",
+		StderrMode:   IOModeFilter,
+		// Fails at the first line, to be restarted
+		StderrFilter: "read line; echo \"err: $line\"; exit 1",
+		RuntimeDir:   tmpDir,
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	select {
+	case <-d.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the process")
+	}
+
+	data, _ := d.storage.ReadFile(LogFileName)
+	log := string(data)
+	for _, line := range []string{"out: one\n", "out: two\n", "err: oops\n"} {
+		if !strings.Contains(log, line) {
+			t.Errorf("Expected the log to hold the filtered %q, got %q", line, log)
+		}
+	}
+	if daemonLog, _ := os.ReadFile(filepath.Join(tmpDir, DaemonLogFileName)); !strings.Contains(string(daemonLog), "stderr filter exited") {
+		t.Errorf("Expected the failed filter to be logged, got %q", daemonLog)
+	}
+
+	config = &Config{Command: []string{"true"}, StdoutMode: IOModeFilter}
+	if _, err := New(config); err == nil {
+		t.Error("Expected a filter without command to be refused")
+	}
+}
@@ -0,0 +1,415 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// journalSocket is where journald receives native protocol messages
+var journalSocket = "/run/systemd/journal/socket"
+
+// maxForwardLine bounds the lines forwarded to syslog or journald, longer
+// ones being split
+const maxForwardLine = 4096
+
+// syslogFacilities are the facilities accepted in Config.SyslogFacility
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// parseSyslogFacility returns the facility of Config.SyslogFacility
+func parseSyslogFacility(name string) (syslog.Priority, error) {
+	if name == "" {
+		return syslog.LOG_USER, nil
+	}
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return facility, nil
+}
+
+// Output forwarded to syslog or journald goes through a spool in the
+// runtime directory, named after its stream with forwardSpoolSuffix, and
+// the offset of the spool shipped up to is checkpointed in a file with
+// forwardCheckpointSuffix, so that a sink outage or a daemon restarting on
+// the same runtime directory neither loses nor repeats lines.
+const (
+	forwardSpoolSuffix      = ".spool"
+	forwardCheckpointSuffix = ".shipped"
+)
+
+// forwardSpoolCompact is the size the spool is emptied at once shipped
+const forwardSpoolCompact = 1 << 20
+
+// Delays between attempts to reach a sink that failed, doubling up to
+// forwardRetryMax
+const (
+	forwardRetryMin = 100 * time.Millisecond
+	forwardRetryMax = 30 * time.Second
+)
+
+// forwardFinishTimeout bounds how long the end of a stream waits for its
+// output to be shipped, the rest staying in the spool for the next daemon
+const forwardFinishTimeout = 5 * time.Second
+
+// forwarder sends the output of a stream to syslog or journald line by
+// line, from its spool
+type forwarder struct {
+	// connect connects to the sink, returning how to send it a line and
+	// to disconnect
+	connect func() (send func(line []byte) error, close func() error, err error)
+
+	// Connection to the sink, nil while disconnected, owned by run
+	send  func(line []byte) error
+	close func() error
+
+	spool      *os.File
+	checkpoint *os.File
+	offset     int64 // of the spool shipped up to, owned by run
+	failed     bool  // a send failed, reported once per outage
+
+	mu    sync.Mutex
+	size  int64 // of the spool
+	last  byte  // last byte written to the spool
+	ended bool  // the stream ended, see finish
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newForwarder connects the output of stream to its IOModeSyslog or
+// IOModeJournal destination. Output goes at the info level, errors at the
+// err level.
+func (d *Daemon) newForwarder(mode IOMode, stream byte) (*forwarder, error) {
+	facility, err := parseSyslogFacility(d.config.SyslogFacility)
+	if err != nil {
+		return nil, err
+	}
+	tag := d.config.SyslogTag
+	if tag == "" {
+		tag = filepath.Base(d.config.Command[0])
+	}
+	severity, name := syslog.LOG_INFO, "stdout"
+	if stream == protocol.StreamStderr {
+		severity, name = syslog.LOG_ERR, "stderr"
+	}
+
+	var connect func() (func([]byte) error, func() error, error)
+	switch mode {
+	case IOModeSyslog:
+		connect = func() (func([]byte) error, func() error, error) {
+			w, err := syslog.New(facility|severity, tag)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+			}
+			send := func(line []byte) error {
+				_, err := w.Write(line)
+				return err
+			}
+			return send, w.Close, nil
+		}
+
+	case IOModeJournal:
+		connect = func() (func([]byte) error, func() error, error) {
+			conn, err := net.Dial("unixgram", journalSocket)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to connect to journald: %w", err)
+			}
+			var buf bytes.Buffer
+			send := func(line []byte) error {
+				buf.Reset()
+				journalField(&buf, "MESSAGE", line)
+				journalField(&buf, "PRIORITY", []byte(strconv.Itoa(int(severity))))
+				journalField(&buf, "SYSLOG_FACILITY", []byte(strconv.Itoa(int(facility>>3))))
+				journalField(&buf, "SYSLOG_IDENTIFIER", []byte(tag))
+				journalField(&buf, "BGRUN_STREAM", []byte(name))
+				journalField(&buf, "BGRUN_PID", []byte(strconv.Itoa(d.childPID())))
+				journalField(&buf, "BGRUN_RUNTIME_DIR", []byte(d.runtimeDir))
+				_, err := conn.Write(buf.Bytes())
+				return err
+			}
+			return send, conn.Close, nil
+		}
+
+	default:
+		return nil, nil
+	}
+	return d.openForwarder(filepath.Join(d.runtimeDir, name), connect)
+}
+
+// openForwarder opens the spool and checkpoint at path and connects to the
+// sink, then ships what the spool holds past the checkpoint
+func (d *Daemon) openForwarder(path string, connect func() (func([]byte) error, func() error, error)) (*forwarder, error) {
+	f := &forwarder{
+		connect: connect,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var err error
+	if f.spool, err = os.OpenFile(path+forwardSpoolSuffix, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("failed to open the output spool: %w", err)
+	}
+	if f.checkpoint, err = os.OpenFile(path+forwardCheckpointSuffix, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		f.spool.Close()
+		return nil, fmt.Errorf("failed to open the output checkpoint: %w", err)
+	}
+	if f.send, f.close, err = connect(); err != nil {
+		f.spool.Close()
+		f.checkpoint.Close()
+		return nil, err
+	}
+
+	if info, err := f.spool.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	var checkpoint [21]byte
+	n, _ := f.checkpoint.ReadAt(checkpoint[:], 0)
+	f.offset, _ = strconv.ParseInt(strings.TrimSpace(string(checkpoint[:n])), 10, 64)
+	if f.offset < 0 || f.offset > f.size {
+		// The spool was emptied before the checkpoint was updated
+		f.offset = 0
+	}
+	if f.size > 0 {
+		// A line left unterminated by the previous daemon has ended
+		f.spool.ReadAt(checkpoint[:1], f.size-1)
+		if checkpoint[0] != '\n' {
+			f.appendSpool(d, []byte{'\n'})
+		}
+		f.last = '\n'
+	}
+
+	go f.run(d)
+	return f, nil
+}
+
+// write spools data, shipped in the background line by line
+func (f *forwarder) write(d *Daemon, data []byte) {
+	f.mu.Lock()
+	f.appendSpool(d, data)
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// appendSpool appends data to the spool, f.mu held
+func (f *forwarder) appendSpool(d *Daemon, data []byte) {
+	n, err := f.spool.Write(data)
+	f.size += int64(n)
+	if n > 0 {
+		f.last = data[n-1]
+	}
+	if err != nil {
+		d.errorf("Error spooling output to forward: %v", err)
+	}
+}
+
+// run ships the spool until the stream ended and all of it was shipped, or
+// finish gave up, reconnecting to the sink when it fails
+func (f *forwarder) run(d *Daemon) {
+	defer close(f.done)
+	delay := forwardRetryMin
+	for {
+		err := f.ship(d)
+		if err == nil {
+			if f.failed {
+				f.failed = false
+				d.infof("Forwarding output again")
+			}
+			delay = forwardRetryMin
+
+			f.mu.Lock()
+			shipped := f.ended && f.offset == f.size
+			f.mu.Unlock()
+			if shipped {
+				return
+			}
+			select {
+			case <-f.wake:
+			case <-f.stop:
+				return
+			}
+			continue
+		}
+
+		if !f.failed {
+			f.failed = true
+			d.errorf("Error forwarding output, retrying: %v", err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-f.stop:
+			return
+		}
+		delay = min(2*delay, forwardRetryMax)
+	}
+}
+
+// ship sends the complete lines of the spool past the checkpoint, moving
+// the checkpoint past each line sent
+func (f *forwarder) ship(d *Daemon) error {
+	if f.send == nil {
+		send, close, err := f.connect()
+		if err != nil {
+			return err
+		}
+		f.send, f.close = send, close
+	}
+
+	buf := make([]byte, 16*maxForwardLine)
+	for {
+		f.mu.Lock()
+		size := f.size
+		f.mu.Unlock()
+		if f.offset >= size {
+			break
+		}
+
+		n, err := f.spool.ReadAt(buf[:min(int64(len(buf)), size-f.offset)], f.offset)
+		if n == 0 {
+			return fmt.Errorf("failed to read the output spool: %w", err)
+		}
+		rest := buf[:n]
+		for {
+			// Lines are split beyond maxForwardLine
+			var line []byte
+			var next int
+			if i := bytes.IndexByte(rest, '\n'); i >= 0 && i <= maxForwardLine {
+				line, next = rest[:i], i+1
+			} else if len(rest) >= maxForwardLine {
+				line, next = rest[:maxForwardLine], maxForwardLine
+			} else {
+				break
+			}
+			if err := f.send(bytes.TrimSuffix(line, []byte("\r"))); err != nil {
+				f.close()
+				f.send, f.close = nil, nil
+				return err
+			}
+			rest = rest[next:]
+			f.offset += int64(next)
+			f.saveCheckpoint(d)
+		}
+		if len(rest) == n {
+			// Only the start of a line
+			break
+		}
+	}
+
+	// Empty the spool once shipped, writes waiting meanwhile
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.offset == f.size && (f.size >= forwardSpoolCompact || f.ended && f.size > 0) {
+		if err := f.spool.Truncate(0); err != nil {
+			d.errorf("Error emptying the output spool: %v", err)
+			return nil
+		}
+		f.offset, f.size = 0, 0
+		f.saveCheckpoint(d)
+	}
+	return nil
+}
+
+// saveCheckpoint records the offset shipped up to
+func (f *forwarder) saveCheckpoint(d *Daemon) {
+	if _, err := f.checkpoint.WriteAt(fmt.Appendf(nil, "%020d\n", f.offset), 0); err != nil && !f.failed {
+		d.errorf("Error writing the output checkpoint: %v", err)
+	}
+}
+
+// finish terminates the last line and waits for the spool to be shipped,
+// then disconnects. What could not be shipped in time stays in the spool.
+func (f *forwarder) finish(d *Daemon) {
+	f.mu.Lock()
+	if f.size > 0 && f.last != '\n' {
+		f.appendSpool(d, []byte{'\n'})
+	}
+	f.ended = true
+	f.mu.Unlock()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-f.done:
+	case <-time.After(forwardFinishTimeout):
+		close(f.stop)
+		<-f.done
+		d.warnf("Output left to forward in %s", f.spool.Name())
+	}
+
+	if f.close != nil {
+		if err := f.close(); err != nil {
+			d.errorf("Error closing the output forwarder: %v", err)
+		}
+	}
+	f.spool.Close()
+	f.checkpoint.Close()
+}
+
+// journalField appends a field in the journald native protocol, values
+// holding a newline being length prefixed
+func journalField(buf *bytes.Buffer, name string, value []byte) {
+	buf.WriteString(name)
+	if bytes.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
+
+// childPID returns the PID of the process
+func (d *Daemon) childPID() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.pid
+}
+
+// logOutput writes output of stream to output.log, or forwards it when the
+// stream goes to syslog or journald, and copies it to its tee files
+func (d *Daemon) logOutput(stream byte, data []byte) {
+	d.teeOutput(stream, data)
+	if f := d.forward[stream-1]; f != nil {
+		f.write(d, data)
+		if !d.config.KeepLog {
+			return
+		}
+	}
+	mode := d.config.StdoutMode
+	if stream == protocol.StreamStderr {
+		mode = d.config.StderrMode
+	}
+	if mode == IOModeNull || mode == IOModeFile {
+		// Read for its tee files only
+		return
+	}
+	d.writeLog(data)
+}
@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForwardJournal(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(tmpDir, "journal.sock")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	oldSocket := journalSocket
+	journalSocket = socketPath
+	defer func() { journalSocket = oldSocket }()
+
+	config := &Config{
+		Command:    []string{"bash", "-c", "printf 'one\\r\\ntwo\\nthree'; echo oops >&2"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeJournal,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		SyslogTag:  "nightly",
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	var messages []string
+	buf := make([]byte, 65536)
+	journal.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(messages) < 3 {
+		n, err := journal.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read journal entries: %v (got %q)", err, messages)
+		}
+		messages = append(messages, string(buf[:n]))
+	}
+	for i, want := range []string{"one", "two", "three"} {
+		if !strings.HasPrefix(messages[i], "MESSAGE="+want+"\n") {
+			t.Errorf("Expected entry %d to be %q, got %q", i, want, messages[i])
+		}
+	}
+	for _, field := range []string{"PRIORITY=6\n", "SYSLOG_FACILITY=1\n", "SYSLOG_IDENTIFIER=nightly\n", "BGRUN_STREAM=stdout\n", "BGRUN_PID="} {
+		if !strings.Contains(messages[0], field) {
+			t.Errorf("Expected the entry to hold %q, got %q", field, messages[0])
+		}
+	}
+
+	// Only stderr is logged
+	d.Wait()
+	if data, _ := d.storage.ReadFile(LogFileName); string(data) != "oops\n" {
+		t.Errorf("Expected only stderr in the output log, got %q", data)
+	}
+}
+
+func TestForwardModes(t *testing.T) {
+	config := &Config{Command: []string{"true"}, StdoutMode: IOModeSyslog, UseVTY: true}
+	if _, err := New(config); err == nil {
+		t.Error("Expected syslog output to be refused in VTY mode")
+	}
+	config = &Config{Command: []string{"true"}, StdoutMode: IOModeSyslog, SyslogFacility: "local9"}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "local9") {
+		t.Errorf("Expected an unknown facility to be refused, got %v", err)
+	}
+}
+
+// fakeSink records the lines forwarded to it, failing while down
+type fakeSink struct {
+	mu    sync.Mutex
+	lines []string
+	down  bool
+}
+
+func (s *fakeSink) connect() (func([]byte) error, func() error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return nil, nil, errors.New("sink down")
+	}
+	send := func(line []byte) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.down {
+			return errors.New("sink down")
+		}
+		s.lines = append(s.lines, string(line))
+		return nil
+	}
+	return send, func() error { return nil }, nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *fakeSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.lines)
+}
+
+func TestForwarderLines(t *testing.T) {
+	sink := &fakeSink{}
+	d := &Daemon{}
+	f, err := d.openForwarder(filepath.Join(t.TempDir(), "stdout"), sink.connect)
+	if err != nil {
+		t.Fatalf("openForwarder failed: %v", err)
+	}
+
+	f.write(d, []byte("a\r\nb"))
+	f.write(d, []byte("c\n"+strings.Repeat("x", maxForwardLine+10)))
+	f.finish(d)
+	lines := sink.received()
+	if len(lines) != 4 || lines[0] != "a" || lines[1] != "bc" || len(lines[2]) != maxForwardLine || len(lines[3]) != 10 {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+}
+
+func TestForwarderCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+	sink := &fakeSink{}
+	d := &Daemon{}
+	f, err := d.openForwarder(path, sink.connect)
+	if err != nil {
+		t.Fatalf("openForwarder failed: %v", err)
+	}
+
+	// Lines written while the sink is down are shipped once it is back
+	f.write(d, []byte("one\n"))
+	waitFor(t, func() bool { return len(sink.received()) == 1 })
+	sink.setDown(true)
+	f.write(d, []byte("two\nthree\n"))
+	time.Sleep(2 * forwardRetryMin)
+	sink.setDown(false)
+	waitFor(t, func() bool { return len(sink.received()) == 3 })
+
+	// A daemon stopping with the sink down leaves the rest to the next one
+	sink.setDown(true)
+	f.write(d, []byte("four\nfi"))
+	close(f.stop)
+	<-f.done
+	f.spool.Close()
+	f.checkpoint.Close()
+
+	sink.setDown(false)
+	f, err = d.openForwarder(path, sink.connect)
+	if err != nil {
+		t.Fatalf("openForwarder failed: %v", err)
+	}
+	f.write(d, []byte("six\n"))
+	f.finish(d)
+	if lines := sink.received(); !slices.Equal(lines, []string{"one", "two", "three", "four", "fi", "six"}) {
+		t.Errorf("Expected every line once, got %q", lines)
+	}
+	if info, err := os.Stat(path + forwardSpoolSuffix); err != nil || info.Size() != 0 {
+		t.Errorf("Expected the spool emptied once shipped, got %v (err=%v)", info, err)
+	}
+}
+
+// waitFor waits for cond to hold
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+const (
+	// healthLockTimeout is how long HEALTH waits for the state lock before
+	// reporting the daemon as wedged
+	healthLockTimeout = time.Second
+
+	// healthStallTimeout is how long an output reader may spend on a chunk,
+	// or be gone while the process runs, before it is reported
+	healthStallTimeout = 10 * time.Second
+
+	// Bound of runtime.NumGoroutine() beyond which goroutines are reported
+	// as leaking: a base for the daemon and the program embedding it, plus
+	// the goroutines serving each client
+	healthBaseGoroutines      = 1000
+	healthGoroutinesPerClient = 4
+)
+
+// daemonHealth tracks the internal state reported by HEALTH
+type daemonHealth struct {
+	logErr atomic.Pointer[error] // error of the last log write, nil once one succeeds
+
+	outputReaders atomic.Int32 // output readers running
+	outputEnded   atomic.Int64 // when the last output reader exited (Unix ns)
+
+	// When the chunk each output reader processes was read (Unix ns), 0
+	// while it waits for output; indexed by stream, stdout then stderr
+	busySince [2]atomic.Int64
+}
+
+// readerStarted and readerStopped track the lifetime of an output reader
+func (h *daemonHealth) readerStarted() {
+	h.outputReaders.Add(1)
+}
+
+func (h *daemonHealth) readerStopped() {
+	if h.outputReaders.Add(-1) == 0 {
+		h.outputEnded.Store(time.Now().UnixNano())
+	}
+}
+
+// busy and idle delimit the processing of a chunk of output
+func (h *daemonHealth) busy(stream byte) {
+	h.busySince[stream-1].Store(time.Now().UnixNano())
+}
+
+func (h *daemonHealth) idle(stream byte) {
+	h.busySince[stream-1].Store(0)
+}
+
+// writeLog appends output to the log file, up to its cap
+func (d *Daemon) writeLog(data []byte) {
+	if d.logFile == nil {
+		return
+	}
+	if d.logCap != nil {
+		if data = d.logCap.write(data); len(data) == 0 {
+			return
+		}
+	}
+	d.writeLogFile(data)
+}
+
+// writeLogFile writes to the log file, keeping track of failures
+func (d *Daemon) writeLogFile(data []byte) {
+	if _, err := d.logFile.Write(data); err != nil {
+		if d.health.logErr.Swap(&err) == nil {
+			d.errorf("Error writing log: %v", err)
+		}
+		return
+	}
+	d.health.logErr.Store(nil)
+}
+
+// handleHealth reports the internal health of the daemon, as opposed to the
+// state of the process it runs
+func (d *Daemon) handleHealth(conn net.Conn) error {
+	return protocol.WriteHealthResponse(conn, d.checkHealth())
+}
+
+// checkHealth runs the health checks. It must not block on a lock itself:
+// a daemon wedged on one is what it is meant to detect.
+func (d *Daemon) checkHealth() *protocol.HealthResponse {
+	resp := &protocol.HealthResponse{Healthy: true, Checks: []protocol.HealthCheck{}}
+	check := func(name string, ok bool, detail string) {
+		resp.Checks = append(resp.Checks, protocol.HealthCheck{Name: name, OK: ok, Detail: detail})
+		resp.Healthy = resp.Healthy && ok
+	}
+
+	type state struct {
+		running bool
+		clients int
+	}
+	states := make(chan state, 1)
+	go func() {
+		d.mu.RLock()
+		states <- state{running: d.running, clients: len(d.clients)}
+		d.mu.RUnlock()
+	}()
+
+	var st state
+	select {
+	case st = <-states:
+		check("state_lock", true, "")
+	case <-time.After(healthLockTimeout):
+		check("state_lock", false, fmt.Sprintf("state lock not acquired within %v", healthLockTimeout))
+		return resp
+	}
+
+	goroutines := runtime.NumGoroutine()
+	limit := healthBaseGoroutines + healthGoroutinesPerClient*st.clients
+	check("goroutines", goroutines <= limit, fmt.Sprintf("%d of at most %d", goroutines, limit))
+
+	if errp := d.health.logErr.Load(); errp != nil {
+		check("log_writer", false, (*errp).Error())
+	} else {
+		check("log_writer", true, "")
+	}
+
+	now := time.Now()
+	ok, detail := true, ""
+	for i := range d.health.busySince {
+		if start := d.health.busySince[i].Load(); start != 0 && now.Sub(time.Unix(0, start)) > healthStallTimeout {
+			ok, detail = false, fmt.Sprintf("output reader stuck on a chunk for %v", now.Sub(time.Unix(0, start)).Round(time.Second))
+		}
+	}
+	// The PTY is only closed by the program exiting, while pipes may be
+	// closed early by a program that does not write anything
+	if ok && d.config.UseVTY && st.running && d.health.outputReaders.Load() == 0 {
+		if ended := d.health.outputEnded.Load(); ended != 0 && now.Sub(time.Unix(0, ended)) > healthStallTimeout {
+			ok, detail = false, "PTY reader exited while the process runs"
+		}
+	}
+	check("output_reader", ok, detail)
+
+	return resp
+}
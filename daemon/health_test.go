@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// failingWriter is a log file whose writes fail while err is set
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func (w *failingWriter) Close() error {
+	return nil
+}
+
+// healthCheck returns the named check of a health response
+func healthCheck(t *testing.T, resp *protocol.HealthResponse, name string) protocol.HealthCheck {
+	t.Helper()
+	for _, check := range resp.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("Check %s missing from %+v", name, resp.Checks)
+	return protocol.HealthCheck{}
+}
+
+func TestCheckHealth(t *testing.T) {
+	logFile := &failingWriter{}
+	d := &Daemon{
+		config:  &Config{UseVTY: true},
+		clients: make(map[net.Conn]*client),
+		logFile: logFile,
+		running: true,
+	}
+
+	d.health.readerStarted()
+	d.writeLog([]byte("ok"))
+	if resp := d.checkHealth(); !resp.Healthy || len(resp.Checks) != 4 {
+		t.Fatalf("Expected 4 passing checks, got %+v", resp)
+	}
+
+	// A failing log writer is reported until a write succeeds again
+	logFile.err = errors.New("no space left on device")
+	d.writeLog([]byte("lost"))
+	resp := d.checkHealth()
+	if check := healthCheck(t, resp, "log_writer"); resp.Healthy || check.OK || check.Detail != "no space left on device" {
+		t.Errorf("Expected the log writer to fail, got %+v", resp)
+	}
+	logFile.err = nil
+	d.writeLog([]byte("ok"))
+	if resp := d.checkHealth(); !resp.Healthy {
+		t.Errorf("Expected the log writer to recover, got %+v", resp)
+	}
+
+	// An output reader stuck on a chunk
+	d.health.busySince[0].Store(time.Now().Add(-time.Minute).UnixNano())
+	if check := healthCheck(t, d.checkHealth(), "output_reader"); check.OK {
+		t.Errorf("Expected a stuck output reader to fail, got %+v", check)
+	}
+	d.health.idle(protocol.StreamStdout)
+
+	// The PTY reader gone while the process runs
+	d.health.readerStopped()
+	if check := healthCheck(t, d.checkHealth(), "output_reader"); !check.OK {
+		t.Errorf("Expected a grace period after the PTY reader exited, got %+v", check)
+	}
+	d.health.outputEnded.Store(time.Now().Add(-time.Minute).UnixNano())
+	if check := healthCheck(t, d.checkHealth(), "output_reader"); check.OK {
+		t.Errorf("Expected a missing PTY reader to fail, got %+v", check)
+	}
+	d.running = false
+	if check := healthCheck(t, d.checkHealth(), "output_reader"); !check.OK {
+		t.Errorf("Expected the PTY reader to be done once the process exited, got %+v", check)
+	}
+
+	// A wedged state lock
+	d.mu.Lock()
+	resp = d.checkHealth()
+	d.mu.Unlock()
+	if check := healthCheck(t, resp, "state_lock"); resp.Healthy || check.OK || len(resp.Checks) != 1 {
+		t.Errorf("Expected only the state lock check to fail, got %+v", resp)
+	}
+}
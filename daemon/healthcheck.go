@@ -0,0 +1,291 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// Defaults of HealthCheck
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultHealthTimeout  = 10 * time.Second
+	DefaultHealthRetries  = 3
+)
+
+// healthKillTimeout is how long a process killed for being unhealthy has to
+// exit after SIGTERM before it gets SIGKILL
+var healthKillTimeout = 10 * time.Second
+
+// maxHealthErrorLength bounds the output of a failed check command kept as
+// the health error
+const maxHealthErrorLength = 256
+
+// HealthCheck checks on an interval that the process works, as opposed to
+// HEALTH reporting on the daemon itself. Exactly one of Command, TCP, HTTP
+// and Pattern is set.
+type HealthCheck struct {
+	Command string `json:"command,omitempty"` // shell command exiting with code 0, run in the working directory of the process
+	TCP     string `json:"tcp,omitempty"`     // TCP address accepting connections, such as localhost:5432
+	HTTP    string `json:"http,omitempty"`    // URL answering GET with a 2xx or 3xx status
+	Pattern string `json:"pattern,omitempty"` // regular expression (RE2 syntax) matching the output printed since the previous check, such as a heartbeat
+
+	Interval int `json:"interval,omitempty"` // seconds between checks, the first one included (DefaultHealthInterval if zero)
+	Timeout  int `json:"timeout,omitempty"`  // seconds a check may take (DefaultHealthTimeout if zero)
+	Retries  int `json:"retries,omitempty"`  // failures in a row making the process unhealthy (DefaultHealthRetries if zero)
+
+	// Restart kills the process once unhealthy, so that the restart policy
+	// of the supervisor job it runs as restarts it. Without a supervisor,
+	// the daemon exits with the process.
+	Restart bool `json:"restart,omitempty"`
+}
+
+// interval returns the time between checks
+func (c *HealthCheck) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return DefaultHealthInterval
+}
+
+// timeout returns how long a check may take
+func (c *HealthCheck) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return DefaultHealthTimeout
+}
+
+// retries returns how many checks in a row must fail for the process to be
+// unhealthy
+func (c *HealthCheck) retries() int {
+	if c.Retries > 0 {
+		return c.Retries
+	}
+	return DefaultHealthRetries
+}
+
+// checker validates the check, returning the state running it
+func (c *HealthCheck) checker() (*healthChecker, error) {
+	if c.Interval < 0 || c.Timeout < 0 || c.Retries < 0 {
+		return nil, errors.New("invalid health check: negative interval, timeout or retries")
+	}
+	h := &healthChecker{check: c}
+	n := 0
+	if c.Command != "" {
+		n++
+	}
+	if c.TCP != "" {
+		if _, _, err := net.SplitHostPort(c.TCP); err != nil {
+			return nil, fmt.Errorf("invalid health check address: %w", err)
+		}
+		n++
+	}
+	if c.HTTP != "" {
+		u, err := url.Parse(c.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid health check URL %q: http or https required", c.HTTP)
+		}
+		n++
+	}
+	if c.Pattern != "" {
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check pattern: %w", err)
+		}
+		h.re = re
+		n++
+	}
+	if n != 1 {
+		return nil, errors.New("health check needs one of command, tcp, http and pattern")
+	}
+	return h, nil
+}
+
+// healthChecker runs the health check of the daemon
+type healthChecker struct {
+	check *HealthCheck
+	re    *regexp.Regexp // Pattern
+
+	// Output not matched by the pattern yet, and whether it matched since
+	// the previous check, under Daemon.history.mu
+	buf     []byte
+	matched bool
+}
+
+// healthCheckLoop runs the health check on its interval while the process
+// runs, reporting the health of the process. Checks that fail once do not
+// change it, only Retries of them in a row do.
+func (d *Daemon) healthCheckLoop() {
+	defer d.recoverPanic("health checker", nil)
+
+	check := d.healthCheck.check
+	ticker := time.NewTicker(check.interval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.doneCh:
+			return
+		case <-d.closeCh:
+			return
+		}
+
+		err := d.runHealthCheck()
+		if err == nil {
+			failures = 0
+			d.setHealth(protocol.HealthHealthy, "")
+			continue
+		}
+		failures++
+		d.debugf("Health check failed (%d/%d): %v", failures, check.retries(), err)
+		if failures < check.retries() {
+			continue
+		}
+		if d.setHealth(protocol.HealthUnhealthy, err.Error()) && check.Restart {
+			d.killUnhealthy()
+		}
+	}
+}
+
+// runHealthCheck runs the health check once
+func (d *Daemon) runHealthCheck() error {
+	check := d.healthCheck.check
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeout())
+	defer cancel()
+
+	switch {
+	case check.Command != "":
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", check.Command)
+		cmd.Dir = d.config.Dir
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("command timed out after %v", check.timeout())
+		}
+		msg := strings.TrimSpace(string(out))
+		if len(msg) > maxHealthErrorLength {
+			msg = msg[:maxHealthErrorLength] + "..."
+		}
+		if msg == "" {
+			return fmt.Errorf("command failed: %v", err)
+		}
+		return fmt.Errorf("command failed: %v: %s", err, msg)
+	case check.TCP != "":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.TCP)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case check.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		// Redirects are not followed, a 3xx status being healthy
+		client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("%s answered %s", check.HTTP, resp.Status)
+		}
+		return nil
+	default:
+		d.history.mu.Lock()
+		matched := d.healthCheck.matched
+		d.healthCheck.matched = false
+		d.history.mu.Unlock()
+		if !matched {
+			return fmt.Errorf("no output matching %q since the previous check", check.Pattern)
+		}
+		return nil
+	}
+}
+
+// healthOutput matches chunk against the pattern of the health check.
+// Called with history.mu held.
+func (d *Daemon) healthOutput(chunk *outputChunk) {
+	h := d.healthCheck
+	if h == nil || h.re == nil {
+		return
+	}
+	h.buf = append(h.buf, chunk.data...)
+	if h.re.Match(h.buf) {
+		h.matched = true
+		h.buf = h.buf[:0]
+		return
+	}
+	if len(h.buf) > maxPartialLine {
+		h.buf = h.buf[len(h.buf)-maxPartialLine:]
+	}
+}
+
+// setHealth records the health of the process and why the last check
+// failed, emitting an event when the health changed, which it reports
+func (d *Daemon) setHealth(health, reason string) bool {
+	d.mu.Lock()
+	changed := health != d.processHealth
+	d.processHealth, d.healthError = health, reason
+	d.mu.Unlock()
+	if !changed {
+		return false
+	}
+
+	if health == protocol.HealthUnhealthy {
+		d.warnf("Process is unhealthy: %s", reason)
+	} else {
+		d.infof("Process is %s", health)
+	}
+	d.emitEvent(protocol.Event{Type: protocol.EventHealth, Health: health, Error: reason})
+	d.updateStatus()
+	return true
+}
+
+// killUnhealthy terminates the unhealthy process, killing it if it does not
+// exit in time
+func (d *Daemon) killUnhealthy() {
+	d.warnf("Terminating the unhealthy process")
+	if err := d.Signal(syscall.SIGTERM); err != nil {
+		return
+	}
+	select {
+	case <-d.doneCh:
+	case <-d.closeCh:
+	case <-time.After(healthKillTimeout):
+		if err := d.Signal(syscall.SIGKILL); err == nil {
+			d.warnf("Unhealthy process did not exit after %v, killed it", healthKillTimeout)
+		}
+	}
+}
+
+// Health returns the health of the process as last checked, empty without
+// a health check
+func (d *Daemon) Health() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.processHealth
+}
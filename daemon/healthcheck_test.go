@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestHealthCheckValidation(t *testing.T) {
+	for _, check := range []*HealthCheck{
+		{},
+		{Command: "true", TCP: "localhost:80"},
+		{TCP: "localhost"},
+		{HTTP: "ftp://localhost/"},
+		{Pattern: "("},
+		{Command: "true", Interval: -1},
+	} {
+		if _, err := New(&Config{Command: []string{"true"}, HealthCheck: check}); err == nil {
+			t.Errorf("Expected %+v to be refused", check)
+		}
+	}
+}
+
+// startHealthChecked starts a daemon running command with check
+func startHealthChecked(t *testing.T, command []string, check *HealthCheck) *Daemon {
+	t.Helper()
+	d, err := New(&Config{
+		Command:     command,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  t.TempDir(),
+		HealthCheck: check,
+		Embedded:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	return d
+}
+
+// waitHealth waits for the process of d to have health
+func waitHealth(t *testing.T, d *Daemon, health string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Health() != health {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the process to be %s, got %+v", health, d.GetStatus())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckCommand(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "healthy")
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := startHealthChecked(t, []string{"sleep", "60"}, &HealthCheck{Command: "test -f " + marker, Interval: 1, Retries: 2})
+	defer killDaemon(t, d)
+
+	conn, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if err := protocol.WriteSubscribe(conn, protocol.EventsSubscribe); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	if status := d.GetStatus(); status.Health != protocol.HealthStarting {
+		t.Errorf("Expected the process to be starting, got %q", status.Health)
+	}
+	waitHealth(t, d, protocol.HealthHealthy)
+
+	os.Remove(marker)
+	waitHealth(t, d, protocol.HealthUnhealthy)
+	if status := d.GetStatus(); status.HealthError == "" || !status.Running {
+		t.Errorf("Expected the running process to be unhealthy with an error, got %+v", status)
+	}
+
+	var transitions []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(transitions) < 2 {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Expected health events, got %v (%v)", transitions, err)
+		}
+		if msg.Type != protocol.MsgEvent {
+			continue
+		}
+		if ev, err := protocol.ParseEvent(msg.Payload); err == nil && ev.Type == protocol.EventHealth {
+			transitions = append(transitions, ev.Health)
+		}
+	}
+	if transitions[0] != protocol.HealthHealthy || transitions[1] != protocol.HealthUnhealthy {
+		t.Errorf("Expected healthy then unhealthy, got %v", transitions)
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	var code atomic.Int32
+	code.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(code.Load()))
+	}))
+	defer server.Close()
+
+	d := startHealthChecked(t, []string{"sleep", "60"}, &HealthCheck{HTTP: server.URL, Interval: 1, Retries: 1})
+	defer killDaemon(t, d)
+	waitHealth(t, d, protocol.HealthHealthy)
+
+	code.Store(http.StatusServiceUnavailable)
+	waitHealth(t, d, protocol.HealthUnhealthy)
+}
+
+func TestHealthCheckPattern(t *testing.T) {
+	d := startHealthChecked(t, []string{"bash", "-c", "while :; do echo tick; sleep 0.2; done"}, &HealthCheck{Pattern: "tick", Interval: 1})
+	defer killDaemon(t, d)
+	waitHealth(t, d, protocol.HealthHealthy)
+}
+
+func TestHealthCheckRestart(t *testing.T) {
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := startHealthChecked(t, []string{"sleep", "60"}, &HealthCheck{TCP: addr, Interval: 1, Retries: 1, Restart: true})
+	defer d.Close()
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the unhealthy process to be killed")
+	}
+	if status := d.GetStatus(); status.Health != protocol.HealthUnhealthy {
+		t.Errorf("Expected the process to have exited unhealthy, got %+v", status)
+	}
+}
@@ -0,0 +1,234 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+const (
+	// outputHistorySize is the amount of recent output kept for the clients
+	// resuming an attachment from an offset
+	outputHistorySize = 1 << 20
+
+	// replayMessageSize bounds the output of the OUTPUT_AT messages
+	// replaying the history
+	replayMessageSize = 64 << 10
+)
+
+// outputHistory numbers the process output and keeps its most recent part.
+// Offsets count the bytes of both streams in the order they were read.
+type outputHistory struct {
+	// mu is held while a chunk is numbered and queued for the attached
+	// clients, so that a resuming client goes from the history to the live
+	// output without missing or repeating any
+	mu     sync.Mutex
+	next   uint64         // offset of the next output byte
+	chunks []historyChunk // oldest first
+	size   int            // bytes of output held by chunks
+
+	credited *sync.Cond // signaled when a client gets credit or goes away
+}
+
+// historyChunk is a copy of a chunk of output kept in the history
+type historyChunk struct {
+	stream byte
+	offset uint64
+	data   []byte
+}
+
+// add numbers chunk and keeps a copy of it, dropping the oldest output
+// beyond outputHistorySize. Called with h.mu held.
+func (h *outputHistory) add(chunk *outputChunk) {
+	chunk.offset = h.next
+	h.next += uint64(len(chunk.data))
+	h.chunks = append(h.chunks, historyChunk{stream: chunk.stream, offset: chunk.offset, data: bytes.Clone(chunk.data)})
+	h.size += len(chunk.data)
+
+	drop := 0
+	for h.size > outputHistorySize {
+		h.size -= len(h.chunks[drop].data)
+		drop++
+	}
+	clear(h.chunks[:drop])
+	h.chunks = h.chunks[drop:]
+}
+
+// earliest returns the offset of the oldest output held. Called with h.mu
+// held.
+func (h *outputHistory) earliest() uint64 {
+	if len(h.chunks) == 0 {
+		return h.next
+	}
+	return h.chunks[0].offset
+}
+
+// lastLine returns a copy of the output held after the last newline, up to
+// maxPartialLine bytes. Called with h.mu held.
+func (h *outputHistory) lastLine() []byte {
+	var line []byte
+	for i := len(h.chunks) - 1; i >= 0 && len(line) < maxPartialLine; i-- {
+		data := h.chunks[i].data
+		if nl := bytes.LastIndexByte(data, '\n'); nl >= 0 {
+			return append(bytes.Clone(data[nl+1:]), line...)
+		}
+		line = append(bytes.Clone(data), line...)
+	}
+	return line[max(0, len(line)-maxPartialLine):]
+}
+
+// tail returns a copy of the last n lines of output held, the last one
+// possibly not ended yet. Called with h.mu held.
+func (h *outputHistory) tail(n int) []byte {
+	var data []byte
+	for i := len(h.chunks) - 1; i >= 0; i-- {
+		data = append(bytes.Clone(h.chunks[i].data), data...)
+		// The newline ending the last line does not count
+		if bytes.Count(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) >= n {
+			break
+		}
+	}
+	end := len(bytes.TrimSuffix(data, []byte("\n")))
+	for start := end; start > 0; start-- {
+		if data[start-1] == '\n' {
+			if n--; n == 0 {
+				return data[start:]
+			}
+		}
+	}
+	return data
+}
+
+// wait waits for wake, the output readers waiting for credit. Called with
+// h.mu held.
+func (h *outputHistory) wait() {
+	if h.credited == nil {
+		h.credited = sync.NewCond(&h.mu)
+	}
+	h.credited.Wait()
+}
+
+// wake wakes the output readers waiting for credit. Called with h.mu held.
+func (h *outputHistory) wake() {
+	if h.credited != nil {
+		h.credited.Broadcast()
+	}
+}
+
+// since returns the output of streams held from offset on, as OUTPUT_AT
+// messages merging the consecutive chunks of a stream. When the output at
+// offset is no longer held, it starts with the oldest output held, which
+// handleAttach only lets happen from offset 0. Called with h.mu held.
+func (h *outputHistory) since(offset uint64, streams byte) []protocol.Message {
+	var msgs []protocol.Message
+	var payload []byte // of the message being merged
+	var end uint64     // offset following its output
+	for _, chunk := range h.chunks {
+		if chunk.stream&streams == 0 || chunk.offset+uint64(len(chunk.data)) <= offset {
+			continue
+		}
+		data, start := chunk.data, chunk.offset
+		if start < offset {
+			data, start = data[offset-start:], offset
+		}
+
+		if payload != nil && payload[0] == chunk.stream && start == end && len(payload)-9+len(data) <= replayMessageSize {
+			payload = append(payload, data...)
+		} else {
+			if payload != nil {
+				msgs = append(msgs, protocol.Message{Type: protocol.MsgOutputAt, Payload: payload})
+			}
+			payload = binary.BigEndian.AppendUint64([]byte{chunk.stream}, start)
+			payload = append(payload, data...)
+		}
+		end = start + uint64(len(data))
+	}
+	if payload != nil {
+		msgs = append(msgs, protocol.Message{Type: protocol.MsgOutputAt, Payload: payload})
+	}
+	return msgs
+}
+
+// creditBlocked reports whether output of stream must wait for a FlowBlock
+// client to get credit. Called with d.history.mu held.
+func (d *Daemon) creditBlocked(stream byte) bool {
+	select {
+	case <-d.closeCh:
+		return false
+	default:
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, c := range d.clients {
+		if c.attached && c.streams&stream != 0 && c.flow == protocol.FlowBlock && c.credit <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// takeCredit reports whether chunk may be sent to c, charging it to its
+// credit with flow control. A FlowPause client without credit is paused
+// until it gets more. Called with d.history.mu held.
+func (c *client) takeCredit(chunk *outputChunk) bool {
+	switch {
+	case c.flow == protocol.FlowNone:
+		return true
+	case c.paused:
+		return false
+	case c.credit <= 0:
+		c.paused, c.resumeAt = true, chunk.offset
+		return false
+	}
+	c.credit -= int64(len(chunk.data))
+	return true
+}
+
+// catchUp queues for c the output held in the history from offset on,
+// within its credit with flow control, pausing it at the output left. It
+// returns the number of messages queued. Called with d.history.mu held.
+func (d *Daemon) catchUp(c *client, offset uint64) int {
+	c.paused = false
+	queued := 0
+	for _, msg := range d.history.since(offset, c.streams) {
+		if c.flow != protocol.FlowNone && c.credit <= 0 {
+			c.paused, c.resumeAt = true, binary.BigEndian.Uint64(msg.Payload[1:9])
+			break
+		}
+		d.enqueueMessage(c, msg)
+		c.credit -= int64(len(msg.Payload) - 9)
+		queued++
+	}
+	return queued
+}
+
+// handleCredit adds to the credit of a client attached with flow control,
+// sending the output held back meanwhile
+func (d *Daemon) handleCredit(conn net.Conn, payload []byte) error {
+	n, err := protocol.ParseCredit(payload)
+	if err != nil {
+		return err
+	}
+
+	d.history.mu.Lock()
+	defer d.history.mu.Unlock()
+
+	d.mu.RLock()
+	c, ok := d.clients[conn]
+	d.mu.RUnlock()
+	if !ok || !c.attached || c.flow == protocol.FlowNone {
+		return fmt.Errorf("not attached with flow control")
+	}
+
+	c.credit += int64(n)
+	if c.paused {
+		d.catchUp(c, c.resumeAt)
+	}
+	d.history.wake()
+	return nil
+}
@@ -0,0 +1,192 @@
+package daemon
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestOutputHistory(t *testing.T) {
+	var h outputHistory
+	add := func(stream byte, data string) {
+		chunk := getOutputChunk(stream)
+		chunk.data = append(chunk.buf[:0], data...)
+		h.add(chunk)
+		chunk.release()
+	}
+	add(protocol.StreamStdout, "hello ")
+	add(protocol.StreamStdout, "world\n")
+	add(protocol.StreamStderr, "oops\n")
+	add(protocol.StreamStdout, "done\n")
+
+	type output struct {
+		stream byte
+		offset uint64
+		data   string
+	}
+	since := func(offset uint64, streams byte) []output {
+		var outputs []output
+		for _, msg := range h.since(offset, streams) {
+			stream, offset, data, err := protocol.ParseOutputAt(msg.Payload)
+			if err != nil {
+				t.Fatalf("Invalid OUTPUT_AT message: %v", err)
+			}
+			outputs = append(outputs, output{stream, offset, string(data)})
+		}
+		return outputs
+	}
+
+	// Consecutive chunks of a stream are merged, offsets count both streams
+	got := since(0, protocol.StreamBoth)
+	want := []output{{protocol.StreamStdout, 0, "hello world\n"}, {protocol.StreamStderr, 12, "oops\n"}, {protocol.StreamStdout, 17, "done\n"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Resuming inside a chunk, for one stream
+	got = since(8, protocol.StreamStdout)
+	want = []output{{protocol.StreamStdout, 8, "rld\n"}, {protocol.StreamStdout, 17, "done\n"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := since(22, protocol.StreamBoth); len(got) != 0 {
+		t.Errorf("Expected nothing after the last output, got %v", got)
+	}
+
+	// Older output is dropped, resuming starts with the oldest output held
+	big := string(bytes.Repeat([]byte("x"), outputChunkSize))
+	for range outputHistorySize / outputChunkSize {
+		add(protocol.StreamStdout, big)
+	}
+	if h.size > outputHistorySize {
+		t.Errorf("Expected at most %d bytes held, got %d", outputHistorySize, h.size)
+	}
+	got = since(0, protocol.StreamBoth)
+	if len(got) == 0 || got[0].offset != 22 {
+		t.Fatalf("Expected the replay to start with the oldest chunk held, got %d messages", len(got))
+	}
+	total := 0
+	for _, out := range got {
+		if len(out.data) > replayMessageSize {
+			t.Errorf("Expected messages of at most %d bytes, got %d", replayMessageSize, len(out.data))
+		}
+		total += len(out.data)
+	}
+	if total != h.size {
+		t.Errorf("Expected the %d bytes held, got %d", h.size, total)
+	}
+}
+
+func TestOutputHistoryLastLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"complete line", []string{"hello\n"}, ""},
+		{"prompt", []string{"hello\n", "Pass", "word: "}, "Password: "},
+		{"no newline", []string{"a", "b"}, "ab"},
+	}
+	for _, tt := range tests {
+		var h outputHistory
+		for _, data := range tt.chunks {
+			chunk := getOutputChunk(protocol.StreamStdout)
+			chunk.data = append(chunk.buf[:0], data...)
+			h.add(chunk)
+			chunk.release()
+		}
+		if got := string(h.lastLine()); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy byte
+	}{
+		{"pause", protocol.FlowPause},
+		{"block", protocol.FlowBlock},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// More output than the pipe holds, then a marker once the
+			// program got through
+			tmpDir := t.TempDir()
+			marker := filepath.Join(tmpDir, "done")
+			config := &Config{
+				Command:    []string{"sh", "-c", "sleep 0.2; head -c 524288 /dev/zero; touch " + marker + "; sleep 10"},
+				StdinMode:  StdinNull,
+				StdoutMode: IOModeLog,
+				StderrMode: IOModeLog,
+				RuntimeDir: tmpDir,
+			}
+			d, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed to create daemon: %v", err)
+			}
+			if err := d.Start(); err != nil {
+				t.Fatalf("Failed to start daemon: %v", err)
+			}
+			defer d.stop()
+
+			conn, err := net.Dial("unix", d.SocketPath())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			req := &protocol.AttachRequest{Streams: protocol.StreamBoth, Flow: tt.policy, Window: 8192}
+			if err := protocol.WriteAttach(conn, req); err != nil {
+				t.Fatalf("Failed to attach: %v", err)
+			}
+
+			// read receives output until it has n bytes, checking the
+			// offsets follow each other
+			var received uint64
+			read := func(n uint64) {
+				t.Helper()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				for received < n {
+					msg, err := protocol.ReadMessage(conn)
+					if err != nil {
+						t.Fatalf("Failed to read output after %d bytes: %v", received, err)
+					}
+					if msg.Type != protocol.MsgOutputAt {
+						continue
+					}
+					_, offset, data, _ := protocol.ParseOutputAt(msg.Payload)
+					if offset != received {
+						t.Fatalf("Expected output at offset %d, got %d", received, offset)
+					}
+					received += uint64(len(data))
+				}
+			}
+
+			// The credit is used up, nothing more comes
+			read(8192)
+			time.Sleep(300 * time.Millisecond)
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := protocol.ReadMessage(conn); err == nil {
+				t.Fatal("Expected the output to stop without credit")
+			}
+
+			// The program keeps running with FlowPause and waits with FlowBlock
+			_, err = os.Stat(marker)
+			if blocked := err != nil; blocked != (tt.policy == protocol.FlowBlock) {
+				t.Errorf("Expected the program blocked: %v, got %v", tt.policy == protocol.FlowBlock, blocked)
+			}
+
+			// More credit brings the rest, without gaps
+			if err := protocol.WriteCredit(conn, 1<<20); err != nil {
+				t.Fatalf("Failed to grant credit: %v", err)
+			}
+			read(524288)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// hookTimeout bounds how long a hook may run before it is killed
+var hookTimeout = time.Minute
+
+// Hooks are shell commands run on lifecycle events of the process, for
+// notifications and cleanup, with /bin/sh -c in the working directory of
+// the process. Besides the environment of the daemon they get
+// BGRUN_RUNTIME_DIR and BGRUN_HOOK (pre_start, post_start, post_exit or
+// on_restart), BGRUN_PID once the process started, and BGRUN_EXIT_CODE once
+// it exited. What they print goes to the daemon log, and they are killed
+// after a minute.
+type Hooks struct {
+	// PreStart runs before the process starts, which fails when it does
+	PreStart string `json:"pre_start,omitempty"`
+
+	// PostStart runs once the process started, alongside it
+	PostStart string `json:"post_start,omitempty"`
+
+	// PostExit runs once the process exited, before the daemon reports it
+	// done
+	PostExit string `json:"post_exit,omitempty"`
+
+	// OnRestart runs before PreStart when the run replaces a previous one:
+	// retried (BGRUN_PREVIOUS_RUN being Config.PreviousRun), or restarted
+	// by a supervisor
+	OnRestart string `json:"on_restart,omitempty"`
+}
+
+// Hook names, given in BGRUN_HOOK
+const (
+	hookPreStart  = "pre_start"
+	hookPostStart = "post_start"
+	hookPostExit  = "post_exit"
+	hookOnRestart = "on_restart"
+)
+
+// runHook runs a hook to completion, with env added to its environment
+func (d *Daemon) runHook(name, command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Dir = d.config.Dir
+	cmd.Env = append(os.Environ(), "BGRUN_HOOK="+name, "BGRUN_RUNTIME_DIR="+d.runtimeDir)
+	cmd.Env = append(cmd.Env, env...)
+	// Its own process group, so that the signals sent to the program do not
+	// reach it, and a background child does not hold the daemon
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = time.Second
+
+	d.debugf("Running %s hook: %s", name, command)
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			d.infof("%s hook: %s", name, line)
+		}
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", hookTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// runStartHooks runs the hooks preceding the start of the process, the
+// start being aborted when PreStart fails
+func (d *Daemon) runStartHooks() error {
+	hooks := d.config.Hooks
+	if d.config.PreviousRun != "" || d.config.Restarted {
+		var env []string
+		if d.config.PreviousRun != "" {
+			env = append(env, "BGRUN_PREVIOUS_RUN="+d.config.PreviousRun)
+		}
+		if err := d.runHook(hookOnRestart, hooks.OnRestart, env...); err != nil {
+			d.warnf("%v", err)
+		}
+	}
+	return d.runHook(hookPreStart, hooks.PreStart)
+}
+
+// runPostStartHook runs PostStart alongside the process
+func (d *Daemon) runPostStartHook() {
+	if d.config.Hooks.PostStart == "" {
+		return
+	}
+	pid := d.childPID()
+	go func() {
+		defer d.recoverPanic("post-start hook", nil)
+		if err := d.runHook(hookPostStart, d.config.Hooks.PostStart, "BGRUN_PID="+strconv.Itoa(pid)); err != nil {
+			d.warnf("%v", err)
+		}
+	}()
+}
+
+// runPostExitHook runs PostExit once the process exited with exitCode
+func (d *Daemon) runPostExitHook(pid, exitCode int) {
+	err := d.runHook(hookPostExit, d.config.Hooks.PostExit, "BGRUN_PID="+strconv.Itoa(pid), "BGRUN_EXIT_CODE="+strconv.Itoa(exitCode))
+	if err != nil {
+		d.warnf("%v", err)
+	}
+}
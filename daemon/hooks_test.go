@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// readHookFile waits for a hook to have written path, returning its content
+func readHookFile(t *testing.T, path string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(path); err == nil && strings.HasSuffix(string(data), "\n") {
+			return strings.TrimSpace(string(data))
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a hook to write %s", path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	out := t.TempDir()
+	runtimeDir := t.TempDir()
+	previous := t.TempDir()
+	d, err := New(&Config{
+		Command:     []string{"sh", "-c", "sleep 0.2; exit 3"},
+		StdoutMode:  IOModeNull,
+		StderrMode:  IOModeNull,
+		RuntimeDir:  runtimeDir,
+		PreviousRun: previous,
+		Hooks: Hooks{
+			PreStart:  "echo $BGRUN_HOOK $BGRUN_RUNTIME_DIR > pre",
+			PostStart: "echo $BGRUN_HOOK $BGRUN_PID > post_start",
+			PostExit:  "echo $BGRUN_HOOK $BGRUN_PID $BGRUN_EXIT_CODE > post_exit",
+			OnRestart: "echo $BGRUN_HOOK $BGRUN_PREVIOUS_RUN > restart; test -f pre || echo first >> restart",
+		},
+		Dir:      out,
+		Embedded: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	pid := strconv.Itoa(d.GetStatus().PID)
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+
+	for file, expected := range map[string]string{
+		"restart":    "on_restart " + previous + "\nfirst",
+		"pre":        "pre_start " + runtimeDir,
+		"post_start": "post_start " + pid,
+		"post_exit":  "post_exit " + pid + " 3",
+	} {
+		if got := readHookFile(t, filepath.Join(out, file)); got != expected {
+			t.Errorf("Expected %s to hold %q, got %q", file, expected, got)
+		}
+	}
+}
+
+func TestPreStartHookFailure(t *testing.T) {
+	d, err := New(&Config{
+		Command:    []string{"true"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		Hooks:      Hooks{PreStart: "echo not ready; exit 1"},
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.Start(); err == nil || !strings.Contains(err.Error(), "pre_start hook failed") {
+		t.Fatalf("Expected the start to fail with the hook, got %v", err)
+	}
+	if status := d.GetStatus(); status.State != protocol.StateFailedToStart || status.PID != 0 {
+		t.Errorf("Expected the process not to start, got %+v", status)
+	}
+}
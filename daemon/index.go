@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/registry"
+)
+
+// RuntimeRoot returns the directory holding the runtime directories of the
+// user's daemons, named after their PID: $XDG_RUNTIME_DIR/bgrun if set,
+// /tmp/.bgrun-<uid> otherwise. Daemons using a custom runtime directory
+// register a symlink to it there, so the root indexes every daemon.
+func RuntimeRoot() string {
+	if xdgRuntime := os.Getenv("XDG_RUNTIME_DIR"); xdgRuntime != "" {
+		return filepath.Join(xdgRuntime, "bgrun")
+	}
+	return filepath.Join("/tmp", ".bgrun-"+strconv.Itoa(os.Getuid()))
+}
+
+// register records the daemon in the registry of the runtime root, where
+// clients list the daemons without scanning directories
+func (d *Daemon) register() {
+	dir, err := filepath.Abs(d.runtimeDir)
+	if err != nil {
+		dir = d.runtimeDir
+	}
+	err = registry.Open(RuntimeRoot()).Register(registry.Entry{
+		PID:        os.Getpid(),
+		RuntimeDir: dir,
+		Command:    d.config.Command,
+		StartedAt:  time.Now(),
+		Running:    true,
+	})
+	if err != nil {
+		d.warnf("Failed to register daemon: %v", err)
+	}
+}
+
+// registerExit records the exit of the process in the registry
+func (d *Daemon) registerExit(exitCode int) {
+	dir, err := filepath.Abs(d.runtimeDir)
+	if err != nil {
+		dir = d.runtimeDir
+	}
+	if err := registry.Open(RuntimeRoot()).SetExited(os.Getpid(), dir, exitCode); err != nil {
+		d.warnf("Failed to update registry: %v", err)
+	}
+}
+
+// indexRuntimeDir makes the runtime directory reachable as RuntimeRoot()/<pid>.
+// A symlink left there by a previous daemon with the same PID is replaced.
+func (d *Daemon) indexRuntimeDir() {
+	link := filepath.Join(RuntimeRoot(), strconv.Itoa(os.Getpid()))
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(link)
+	}
+
+	dir, err := filepath.Abs(d.runtimeDir)
+	if err != nil || dir == link {
+		// The default location needs no index entry
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+		d.warnf("Failed to create runtime root: %v", err)
+		return
+	}
+	if err := os.Symlink(dir, link); err != nil {
+		d.warnf("Failed to index runtime directory: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestIndexRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	link := filepath.Join(RuntimeRoot(), strconv.Itoa(os.Getpid()))
+
+	// A stale entry left by a previous daemon with the same PID
+	if err := os.MkdirAll(RuntimeRoot(), 0700); err != nil {
+		t.Fatalf("Failed to create runtime root: %v", err)
+	}
+	if err := os.Symlink("/nonexistent", link); err != nil {
+		t.Fatalf("Failed to create stale link: %v", err)
+	}
+
+	runtimeDir := filepath.Join(t.TempDir(), "custom")
+	d, err := New(&Config{
+		Command:    []string{"true"},
+		RuntimeDir: runtimeDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	d.Wait()
+	d.stop()
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatalf("Expected an index entry: %v", err)
+	}
+	if target != runtimeDir {
+		t.Errorf("Expected index entry to point to %s, got %s", runtimeDir, target)
+	}
+}
+
+func TestIndexDefaultRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	dir := filepath.Join(RuntimeRoot(), strconv.Itoa(os.Getpid()))
+
+	// A stale entry must not prevent using the default location
+	if err := os.MkdirAll(RuntimeRoot(), 0700); err != nil {
+		t.Fatalf("Failed to create runtime root: %v", err)
+	}
+	if err := os.Symlink("/nonexistent", dir); err != nil {
+		t.Fatalf("Failed to create stale link: %v", err)
+	}
+
+	d, err := New(&Config{Command: []string{"true"}})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	d.Wait()
+	d.stop()
+
+	if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+		t.Errorf("Expected the runtime directory at %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/registry"
+)
+
+// linger keeps serving clients for Config.LingerAfterExit seconds once the
+// process exited, or until the daemon is shut down, then stops the daemon
+// and removes the runtime directory
+func (d *Daemon) linger() {
+	linger := time.Duration(d.config.LingerAfterExit) * time.Second
+	d.infof("Lingering for %v before cleaning up", linger)
+	select {
+	case <-time.After(linger):
+	case <-d.closeCh:
+	}
+	d.stop()
+	d.removeRuntimeDir()
+}
+
+// removeRuntimeDir removes the run artifacts and the runtime directory,
+// with its index and registry entries
+func (d *Daemon) removeRuntimeDir() {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+	d.statusFinal, d.removed = true, true
+
+	if err := d.storage.RemoveAll(); err != nil {
+		d.warnf("Failed to remove the run artifacts: %v", err)
+	}
+	dir, err := filepath.Abs(d.runtimeDir)
+	if err != nil {
+		dir = d.runtimeDir
+	}
+	if !d.config.Embedded {
+		link := filepath.Join(RuntimeRoot(), strconv.Itoa(os.Getpid()))
+		if target, err := os.Readlink(link); err == nil && target == dir {
+			os.Remove(link)
+		}
+		if err := registry.Open(RuntimeRoot()).Remove(os.Getpid(), dir); err != nil {
+			d.warnf("Failed to update registry: %v", err)
+		}
+	}
+	if err := os.RemoveAll(d.runtimeDir); err != nil {
+		d.warnf("Failed to remove runtime directory: %v", err)
+		return
+	}
+	d.infof("Removed runtime directory %s", d.runtimeDir)
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestLingerAfterExit(t *testing.T) {
+	runtimeDir := filepath.Join(t.TempDir(), "run")
+	d, err := New(&Config{
+		Command:         []string{"sh", "-c", "echo done; exit 2"},
+		StdoutMode:      IOModeLog,
+		StderrMode:      IOModeLog,
+		RuntimeDir:      runtimeDir,
+		LingerAfterExit: 1,
+		Embedded:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	select {
+	case <-d.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+
+	// The exited process can still be inspected over the socket
+	conn, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Expected the socket to linger: %v", err)
+	}
+	defer conn.Close()
+	if err := protocol.WriteMessage(conn, protocol.MsgStatus, nil); err != nil {
+		t.Fatalf("Failed to request status: %v", err)
+	}
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil || msg.Type != protocol.MsgStatusResponse {
+		t.Fatalf("Expected a status, got %+v (%v)", msg, err)
+	}
+	status, err := protocol.ParseStatusResponse(msg.Payload)
+	if err != nil || status.State != protocol.StateExited || status.ExitCode == nil || *status.ExitCode != 2 {
+		t.Errorf("Expected the exit status, got %+v (%v)", status, err)
+	}
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop lingering")
+	}
+	if _, err := os.Stat(runtimeDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the runtime directory to be removed, got %v", err)
+	}
+	if err := d.WriteStatus(); err != nil {
+		t.Errorf("Expected no status to write once removed, got %v", err)
+	}
+}
+
+func TestLingerShutdown(t *testing.T) {
+	runtimeDir := filepath.Join(t.TempDir(), "run")
+	d, err := New(&Config{
+		Command:         []string{"true"},
+		StdoutMode:      IOModeNull,
+		StderrMode:      IOModeNull,
+		RuntimeDir:      runtimeDir,
+		LingerAfterExit: 3600,
+		Embedded:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	<-d.exited
+
+	// Shutting down ends the wait
+	d.Close()
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop lingering")
+	}
+	if _, err := os.Stat(runtimeDir); !os.IsNotExist(err) {
+		t.Errorf("Expected the runtime directory to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxLogTail bounds the end of the output kept in memory for a capped
+// output.log
+const maxLogTail = 64 * 1024
+
+// logCap bounds output.log to Config.MaxLogBytes: the head of the output
+// is written as it comes, its tail kept in memory until the output ends,
+// and what lies in between dropped, leaving a marker in its place
+type logCap struct {
+	mu       sync.Mutex
+	head     int64 // bytes written as they come
+	tailSize int   // bytes of the tail kept
+	written  int64
+	tail     []byte
+	dropped  int64
+}
+
+// newLogCap returns the cap of an output.log of size bytes, nil for none
+func newLogCap(size int64) *logCap {
+	if size <= 0 {
+		return nil
+	}
+	tailSize := int(min(size/2, maxLogTail))
+	return &logCap{head: size - int64(tailSize), tailSize: tailSize}
+}
+
+// write returns the part of data to write to the log now, keeping the
+// rest for the tail
+func (c *logCap) write(data []byte) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := int(min(int64(len(data)), max(c.head-c.written, 0)))
+	c.written += int64(n)
+	c.tail = append(c.tail, data[n:]...)
+	// Trim the tail when it doubled, so that it is not copied at each write
+	if len(c.tail) > 2*c.tailSize {
+		c.trim()
+	}
+	return data[:n]
+}
+
+// trim drops the output beyond the tail. Called with c.mu held.
+func (c *logCap) trim() {
+	if extra := len(c.tail) - c.tailSize; extra > 0 {
+		c.dropped += int64(extra)
+		c.tail = c.tail[:copy(c.tail, c.tail[extra:])]
+	}
+}
+
+// flush returns the tail, after a marker if output was dropped, to be
+// written once the output ends
+func (c *logCap) flush() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.trim()
+	var data []byte
+	if c.dropped > 0 {
+		data = fmt.Appendf(nil, "\n[bgrun: output truncated, %d bytes dropped]\n", c.dropped)
+	}
+	data = append(data, c.tail...)
+	c.written += int64(len(c.tail))
+	c.tail, c.dropped = nil, 0
+	return data
+}
+
+// flushLogTail writes the tail of a capped output.log, once the output
+// ended
+func (d *Daemon) flushLogTail() {
+	if d.logCap == nil || d.logFile == nil {
+		return
+	}
+	if data := d.logCap.flush(); len(data) > 0 {
+		d.writeLogFile(data)
+	}
+}
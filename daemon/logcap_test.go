@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogCap(t *testing.T) {
+	c := newLogCap(20)
+	var log []byte
+	for _, data := range []string{"0123456789", "abcdefghij", "ABCDEFGHIJ", "klmnopqrst"} {
+		log = append(log, c.write([]byte(data))...)
+	}
+	log = append(log, c.flush()...)
+
+	expected := "0123456789\n[bgrun: output truncated, 20 bytes dropped]\nklmnopqrst"
+	if string(log) != expected {
+		t.Errorf("Expected the head and tail of the output, got %q", log)
+	}
+	if newLogCap(0) != nil {
+		t.Error("Expected no cap without a size")
+	}
+}
+
+func TestMaxLogBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	d, err := New(&Config{
+		Command:     []string{"sh", "-c", "echo first; seq 100000; echo last"},
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  tmpDir,
+		MaxLogBytes: 4096,
+		Embedded:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	d.Wait()
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	log := string(content)
+	if !strings.HasPrefix(log, "first\n") || !strings.HasSuffix(log, "100000\nlast\n") || !strings.Contains(log, "bytes dropped]") {
+		t.Errorf("Expected the start and end of the output around a marker, got %d bytes", len(log))
+	}
+	if len(log) > 4096+64 {
+		t.Errorf("Expected output.log to be capped, got %d bytes", len(log))
+	}
+}
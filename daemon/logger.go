@@ -0,0 +1,196 @@
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// DaemonLogFileName is the name of the file the daemon logs its own activity
+// to. It is always kept in the local runtime directory, as the socket.
+const DaemonLogFileName = "daemon.log"
+
+// DefaultLogMaxSize is the size daemon.log is rotated at, unless configured
+const DefaultLogMaxSize = 1 << 20
+
+// LogLevel is the severity of a message of the daemon log
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota - 1 // client connections and requests
+	LogInfo                      // process lifecycle (default)
+	LogWarn                      // degraded operation
+	LogError                     // failures
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+// String returns the name of the level, as accepted by ParseLogLevel
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLogLevel returns the level with the given name: debug, info, warn or
+// error
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (debug, info, warn or error)", name)
+}
+
+// MarshalText records the level by name in config.json
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText reads a level recorded by MarshalText
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := ParseLogLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// daemonLog writes the messages of the daemon at or above its level to
+// stderr and, once the runtime directory exists, to daemon.log, which is
+// rotated to daemon.log.1 when it would grow past maxSize. Without -background
+// stderr is enough, but a background daemon has nowhere else to log to.
+type daemonLog struct {
+	level   atomic.Int32
+	maxSize int64
+
+	mu   sync.Mutex
+	path string // empty until open
+	size int64
+}
+
+func newDaemonLog(level LogLevel, maxSize int64) *daemonLog {
+	if maxSize <= 0 {
+		maxSize = DefaultLogMaxSize
+	}
+	l := &daemonLog{maxSize: maxSize}
+	l.level.Store(int32(level))
+	return l
+}
+
+// open starts writing to daemon.log in dir, after what previous runs of the
+// daemon in the same directory wrote
+func (l *daemonLog) open(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.path = filepath.Join(dir, DaemonLogFileName)
+	if fi, err := os.Stat(l.path); err == nil {
+		l.size = fi.Size()
+	}
+}
+
+func (l *daemonLog) getLevel() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
+func (l *daemonLog) setLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// logf logs a message of the given level. A nil daemonLog, as in daemons not
+// made by New, logs info and above to stderr only.
+func (l *daemonLog) logf(level LogLevel, format string, args ...any) {
+	if l == nil {
+		if level >= LogInfo {
+			log.Printf(format, args...)
+		}
+		return
+	}
+	if level < l.getLevel() {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	tag := strings.ToUpper(level.String())
+	log.Printf("%s %s", tag, msg)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return
+	}
+	line := fmt.Sprintf("%s %-5s %s\n", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), tag, msg)
+	if err := l.write(line); err != nil {
+		log.Printf("Error writing %s: %v", DaemonLogFileName, err)
+	}
+}
+
+// write appends a line to daemon.log, rotating it first if needed. It is
+// called holding mu.
+func (l *daemonLog) write(line string) error {
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := os.Rename(l.path, l.path+".1"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate: %w", err)
+		}
+		l.size = 0
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := f.WriteString(line)
+	l.size += int64(n)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *Daemon) debugf(format string, args ...any) {
+	d.logger.logf(LogDebug, format, args...)
+}
+
+func (d *Daemon) infof(format string, args ...any) {
+	d.logger.logf(LogInfo, format, args...)
+}
+
+func (d *Daemon) warnf(format string, args ...any) {
+	d.logger.logf(LogWarn, format, args...)
+}
+
+func (d *Daemon) errorf(format string, args ...any) {
+	d.logger.logf(LogError, format, args...)
+}
+
+// handleSetLogLevel changes the level of the daemon log, and answers with the
+// level in effect. An empty payload only asks for it.
+func (d *Daemon) handleSetLogLevel(conn net.Conn, payload []byte) error {
+	if len(payload) > 0 {
+		level, err := ParseLogLevel(string(payload))
+		if err != nil {
+			return err
+		}
+		d.logger.setLevel(level)
+		d.infof("Log level set to %s", level)
+	}
+
+	return protocol.WriteMessage(conn, protocol.MsgLogLevel, []byte(d.logger.getLevel().String()))
+}
@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDaemonLog(t *testing.T) {
+	dir := t.TempDir()
+	l := newDaemonLog(LogWarn, 200)
+
+	// Nothing is written before the runtime directory is opened
+	l.logf(LogError, "before open")
+	l.open(dir)
+
+	l.logf(LogInfo, "below the level")
+	l.logf(LogWarn, "first warning")
+	l.logf(LogError, "first error")
+
+	path := filepath.Join(dir, DaemonLogFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " WARN  first warning") || !strings.HasSuffix(lines[1], " ERROR first error") {
+		t.Errorf("Expected the warning and the error, got %q", lines)
+	}
+
+	// Past maxSize the log is rotated
+	l.setLevel(LogDebug)
+	l.logf(LogDebug, "%s", strings.Repeat("x", 100))
+	rotated, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("Expected a rotated log: %v", err)
+	}
+	if string(rotated) != string(data) {
+		t.Errorf("Expected the rotated log to hold the previous lines, got %q", rotated)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), " DEBUG xxx") || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("Expected the new log to hold the last line, got %q", data)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogDebug, LogInfo, LogWarn, LogError} {
+		parsed, err := ParseLogLevel(level.String())
+		if err != nil || parsed != level {
+			t.Errorf("Expected %s to parse back, got %v, %v", level, parsed, err)
+		}
+	}
+	if level, err := ParseLogLevel("WARN"); err != nil || level != LogWarn {
+		t.Errorf("Expected level names to be case insensitive, got %v, %v", level, err)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
@@ -0,0 +1,60 @@
+//go:build ignore
+
+// mksyscalls writes the tables of the numbers of the system calls seccomp
+// profiles name, from those of golang.org/x/sys/unix for each architecture
+// given as argument.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var sysnum = regexp.MustCompile(`^\s*SYS_(\w+)\s*=\s*(\d+)$`)
+
+func main() {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("failed to locate golang.org/x/sys: %v", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), "unix")
+
+	for _, arch := range os.Args[1:] {
+		f, err := os.Open(filepath.Join(dir, "zsysnum_linux_"+arch+".go"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "// Code generated by go run mksyscalls.go %s; DO NOT EDIT.\n\n", strings.Join(os.Args[1:], " "))
+		fmt.Fprintf(&buf, "package daemon\n\n")
+		fmt.Fprintf(&buf, "// syscallNumbers are the numbers of the system calls on %s, by name\n", arch)
+		fmt.Fprintf(&buf, "var syscallNumbers = map[string]uint32{\n")
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if m := sysnum.FindStringSubmatch(scanner.Text()); m != nil {
+				fmt.Fprintf(&buf, "\t%q: %s,\n", strings.ToLower(m[1]), m[2])
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(&buf, "}\n")
+
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile("zsyscalls_linux_"+arch+".go", src, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
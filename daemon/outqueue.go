@@ -0,0 +1,281 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+const (
+	// outputQueueSize is the number of output messages buffered per client.
+	// Output for a client whose queue is full is dropped so that a slow
+	// consumer never stalls the process or the other clients.
+	outputQueueSize = 256
+
+	// outputHighWater is the queue depth at which a client is reported as
+	// a slow consumer
+	outputHighWater = outputQueueSize * 3 / 4
+
+	// outputLowWater is the depth a slow consumer must drain back to before
+	// it can be reported again
+	outputLowWater = outputQueueSize / 4
+
+	// exitFlushTimeout bounds the wait for a client to receive its queued
+	// output before the exit notification
+	exitFlushTimeout = 2 * time.Second
+
+	// outputChunkSize is the size of the reads of the output loops
+	outputChunkSize = 4096
+)
+
+// SlowConsumerEvent is emitted when a client's output queue reaches the
+// high-water mark
+type SlowConsumerEvent struct {
+	Time          time.Time `json:"time"`
+	ClientID      uint64    `json:"client_id"`
+	PeerPID       int       `json:"peer_pid,omitempty"` // 0 if unknown
+	PeerUID       int       `json:"peer_uid"`           // -1 if unknown
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	Dropped       uint64    `json:"dropped"` // output messages dropped so far
+}
+
+// peerCred identifies the process on the other end of a client connection,
+// or for TCP clients the subject of their certificate
+type peerCred struct {
+	pid, uid, gid int
+	known         bool
+	remote        string // "subject@address" of a TCP client
+}
+
+// queuedMessage is an entry of a client output queue: a chunk of output,
+// or another message when chunk is nil. A message with a flushed channel is
+// a marker closed once everything before it is written.
+type queuedMessage struct {
+	chunk   *outputChunk
+	msg     protocol.Message
+	flushed chan struct{}
+}
+
+// outputChunks recycles the buffers the output loops read into
+var outputChunks = sync.Pool{
+	New: func() any {
+		return &outputChunk{buf: make([]byte, outputChunkSize)}
+	},
+}
+
+// outputChunk is one read of process output. It is shared, without copies,
+// by the queues of all the clients it is sent to, and returns to the pool
+// once the reader and every one of them are done with it. Chunks still
+// queued for a client that disconnects are left to the garbage collector.
+type outputChunk struct {
+	buf    []byte
+	data   []byte // the part of buf holding output
+	stream byte
+	offset uint64 // of the first byte of data in the process output
+	refs   atomic.Int32
+}
+
+// getOutputChunk returns a chunk for stream, referenced by the caller
+func getOutputChunk(stream byte) *outputChunk {
+	c := outputChunks.Get().(*outputChunk)
+	c.data = nil
+	c.stream = stream
+	c.refs.Store(1)
+	return c
+}
+
+// chunkReader reads the output of a stream into chunks. With wholeRunes, an
+// incomplete UTF-8 sequence ending a read is held back and starts the next
+// chunk, so that clients decoding each message get whole runes.
+type chunkReader struct {
+	r          io.Reader
+	wholeRunes bool
+	carry      [utf8.UTFMax]byte
+	carried    int
+}
+
+// newChunkReader returns the reader of the output of r, keeping runes whole
+// with Config.UTF8Chunks
+func (d *Daemon) newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{r: r, wholeRunes: d.config.UTF8Chunks}
+}
+
+// read reads from the stream into chunk.buf, after the bytes held back from
+// the previous read. They are all returned once the stream fails.
+func (cr *chunkReader) read(chunk *outputChunk) (int, error) {
+	n := copy(chunk.buf, cr.carry[:cr.carried])
+	cr.carried = 0
+	m, err := cr.r.Read(chunk.buf[n:])
+	n += m
+	if err == nil && cr.wholeRunes {
+		cr.carried = copy(cr.carry[:], chunk.buf[n-incompleteRune(chunk.buf[:n]):n])
+		n -= cr.carried
+	}
+	return n, err
+}
+
+// incompleteRune returns the length of the incomplete UTF-8 sequence ending
+// p, 0 if p ends with a whole rune or an invalid sequence
+func incompleteRune(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// retain adds a reference to c
+func (c *outputChunk) retain() {
+	c.refs.Add(1)
+}
+
+// release drops a reference to c, recycling it after the last one
+func (c *outputChunk) release() {
+	if c.refs.Add(-1) == 0 {
+		outputChunks.Put(c)
+	}
+}
+
+// clientQueue holds the output pending delivery to a client
+type clientQueue struct {
+	ch      chan queuedMessage
+	done    chan struct{} // closed when the client disconnects
+	dropped atomic.Uint64
+	slow    atomic.Bool // reported as a slow consumer, until drained
+}
+
+func newClientQueue() *clientQueue {
+	return &clientQueue{
+		ch:   make(chan queuedMessage, outputQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// String identifies the client in log entries
+func (c *client) String() string {
+	if c.peer.remote != "" {
+		return fmt.Sprintf("client %d (%s)", c.id, c.peer.remote)
+	}
+	if !c.peer.known {
+		return fmt.Sprintf("client %d", c.id)
+	}
+	return fmt.Sprintf("client %d (pid %d, uid %d)", c.id, c.peer.pid, c.peer.uid)
+}
+
+// writeQueued delivers the queued output of c until it disconnects
+func (d *Daemon) writeQueued(c *client) {
+	for {
+		select {
+		case <-c.queue.done:
+			return
+		case item := <-c.queue.ch:
+			if item.flushed != nil {
+				close(item.flushed)
+				continue
+			}
+			var err error
+			w := c.writer()
+			c.writeMu.Lock()
+			if item.chunk != nil && c.outputAt.Load() {
+				err = protocol.WriteOutputAtTo(w, item.chunk.stream, item.chunk.offset, item.chunk.data)
+			} else if item.chunk != nil {
+				err = protocol.WriteOutputTo(w, item.chunk.stream, item.chunk.data)
+			} else {
+				err = protocol.WriteMessage(w, item.msg.Type, item.msg.Payload)
+			}
+			c.writeMu.Unlock()
+			if item.chunk != nil {
+				item.chunk.release()
+			}
+			if err != nil && !isNormalDisconnect(err) {
+				d.errorf("Error writing output to %s: %v", c, err)
+			}
+			if len(c.queue.ch) <= outputLowWater {
+				c.queue.slow.Store(false)
+			}
+		}
+	}
+}
+
+// enqueueOutput queues chunk for c without blocking, dropping it if the
+// queue is full. The queue holds its own reference to chunk.
+func (d *Daemon) enqueueOutput(c *client, chunk *outputChunk) {
+	chunk.retain()
+	if !d.enqueue(c, queuedMessage{chunk: chunk}) {
+		chunk.release()
+	}
+}
+
+// enqueueMessage queues msg for c without blocking. It reports false if msg
+// was dropped because the queue is full.
+func (d *Daemon) enqueueMessage(c *client, msg protocol.Message) bool {
+	return d.enqueue(c, queuedMessage{msg: msg})
+}
+
+// enqueue queues item for c, or drops it if the queue is full
+func (d *Daemon) enqueue(c *client, item queuedMessage) bool {
+	queued := true
+	select {
+	case c.queue.ch <- item:
+	default:
+		c.queue.dropped.Add(1)
+		queued = false
+	}
+
+	if depth := len(c.queue.ch); depth >= outputHighWater && c.queue.slow.CompareAndSwap(false, true) {
+		d.reportSlowConsumer(c, depth)
+	}
+	return queued
+}
+
+// reportSlowConsumer logs and emits a SlowConsumerEvent for c
+func (d *Daemon) reportSlowConsumer(c *client, depth int) {
+	ev := SlowConsumerEvent{
+		Time:          time.Now(),
+		ClientID:      c.id,
+		PeerUID:       -1,
+		QueueDepth:    depth,
+		QueueCapacity: outputQueueSize,
+		Dropped:       c.queue.dropped.Load(),
+	}
+	if c.peer.known {
+		ev.PeerPID = c.peer.pid
+		ev.PeerUID = c.peer.uid
+	}
+
+	d.warnf("Slow consumer: %s output queue at %d/%d messages, %d dropped", c, depth, outputQueueSize, ev.Dropped)
+	if d.config.OnSlowConsumer != nil {
+		d.config.OnSlowConsumer(ev)
+	}
+}
+
+// flush waits until the output queued for c so far has been written
+func (c *client) flush(timeout time.Duration) {
+	marker := queuedMessage{flushed: make(chan struct{})}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.queue.ch <- marker:
+	case <-c.queue.done:
+		return
+	case <-timer.C:
+		return
+	}
+
+	select {
+	case <-marker.flushed:
+	case <-c.queue.done:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestSlowConsumerEvent(t *testing.T) {
+	tmpDir := t.TempDir()
+	events := make(chan SlowConsumerEvent, 1)
+
+	config := &Config{
+		Command:    []string{"sh", "-c", "sleep 0.2; head -c 4000000 /dev/zero; sleep 10"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		OnSlowConsumer: func(ev SlowConsumerEvent) {
+			select {
+			case events <- ev:
+			default:
+			}
+		},
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	// Attach and never read the output
+	c, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	if err := protocol.WriteMessage(c, protocol.MsgAttach, []byte{protocol.StreamBoth}); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+
+	var ev SlowConsumerEvent
+	select {
+	case ev = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the slow consumer event")
+	}
+
+	if ev.ClientID == 0 || ev.QueueDepth < outputHighWater || ev.QueueCapacity != outputQueueSize {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	if runtime.GOOS == "linux" && (ev.PeerPID != os.Getpid() || ev.PeerUID != os.Getuid()) {
+		t.Errorf("Expected the test process as peer, got pid %d uid %d", ev.PeerPID, ev.PeerUID)
+	}
+
+	// The stats of the slow client show the backlog
+	var stats protocol.ClientStats
+	for _, s := range d.clientStats() {
+		if s.ID == ev.ClientID {
+			stats = s
+		}
+	}
+	if stats.ID == 0 || !stats.Attached || stats.QueueDepth == 0 {
+		t.Errorf("Unexpected stats for the slow client: %+v", stats)
+	}
+}
+
+// BenchmarkBroadcastOutput measures the delivery of 4 KiB output chunks to
+// four attached clients over unix sockets
+// readsReader returns one of its reads per Read call
+type readsReader struct {
+	reads []string
+}
+
+func (r *readsReader) Read(p []byte) (int, error) {
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.reads[0])
+	r.reads = r.reads[1:]
+	return n, nil
+}
+
+func TestChunkReader(t *testing.T) {
+	reads := []string{"a\xe2\x82", "\xac b", "\xff", "\xf0\x9f", "\x98", "\x80\xf0\x9f"}
+	tests := []struct {
+		name       string
+		wholeRunes bool
+		chunks     []string
+	}{
+		{"split", false, append(slices.Clone(reads), "")},
+		// An invalid byte is not held back, an incomplete rune is at the end
+		{"whole runes", true, []string{"a", "\xe2\x82\xac b", "\xff", "", "", "\xf0\x9f\x98\x80", "\xf0\x9f"}},
+	}
+	for _, tt := range tests {
+		cr := &chunkReader{r: &readsReader{reads: slices.Clone(reads)}, wholeRunes: tt.wholeRunes}
+		var chunks []string
+		for {
+			chunk := getOutputChunk(protocol.StreamStdout)
+			n, err := cr.read(chunk)
+			chunks = append(chunks, string(chunk.buf[:n]))
+			chunk.release()
+			if err != nil {
+				break
+			}
+		}
+		if !slices.Equal(chunks, tt.chunks) {
+			t.Errorf("%s: expected chunks %q, got %q", tt.name, tt.chunks, chunks)
+		}
+	}
+}
+
+func BenchmarkBroadcastOutput(b *testing.B) {
+	l, err := net.Listen("unix", filepath.Join(b.TempDir(), "bench.sock"))
+	if err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	d := &Daemon{clients: make(map[net.Conn]*client)}
+	var clients []*client
+	for i := range 4 {
+		peer, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			b.Fatalf("Dial failed: %v", err)
+		}
+		defer peer.Close()
+		go io.Copy(io.Discard, peer)
+
+		conn, err := l.Accept()
+		if err != nil {
+			b.Fatalf("Accept failed: %v", err)
+		}
+		defer conn.Close()
+
+		counted := &countingConn{Conn: conn}
+		c := &client{
+			id:       uint64(i + 1),
+			conn:     counted,
+			queue:    newClientQueue(),
+			attached: true,
+			streams:  protocol.StreamBoth,
+		}
+		defer close(c.queue.done)
+		go d.writeQueued(c)
+		d.clients[counted] = c
+		clients = append(clients, c)
+	}
+
+	b.SetBytes(outputChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		chunk := getOutputChunk(protocol.StreamStdout)
+		chunk.data = chunk.buf
+		d.broadcastOutput(chunk)
+		chunk.release()
+
+		// Let the clients catch up so that nothing is dropped
+		if i%(outputQueueSize/2) == 0 {
+			for _, c := range clients {
+				c.flush(exitFlushTimeout)
+			}
+		}
+	}
+	for _, c := range clients {
+		c.flush(exitFlushTimeout)
+	}
+	b.StopTimer()
+
+	for _, c := range clients {
+		if n := c.queue.dropped.Load(); n > 0 {
+			b.Fatalf("%s dropped %d messages", c, n)
+		}
+	}
+}
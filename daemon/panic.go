@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// CrashLogFileName is the name of the file the stack traces of the panics
+// the daemon recovered from are appended to
+const CrashLogFileName = "crash.log"
+
+// PanicEvent is emitted when the daemon recovers from a panic in one of its
+// goroutines
+type PanicEvent struct {
+	Time      time.Time `json:"time"`
+	Goroutine string    `json:"goroutine"` // e.g. "client 3", "PTY reader"
+	Value     string    `json:"value"`     // value passed to panic
+	Stack     string    `json:"stack"`
+
+	// Fatal is set when the daemon could not go on without the goroutine
+	// and killed the process; its exit is reported and the status written
+	// as usual
+	Fatal bool `json:"fatal"`
+}
+
+// recoverPanic is deferred by the daemon goroutines. A panic is logged with
+// its stack trace, appended to crash.log and emitted as a PanicEvent; then
+// fail, if not nil, deals with the loss of the goroutine. Without fail, the
+// rest of the daemon keeps running.
+func (d *Daemon) recoverPanic(goroutine string, fail func()) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	ev := PanicEvent{
+		Time:      time.Now(),
+		Goroutine: goroutine,
+		Value:     fmt.Sprint(value),
+		Stack:     string(debug.Stack()),
+		Fatal:     fail != nil,
+	}
+	d.errorf("Panic in %s: %s\n%s", goroutine, ev.Value, ev.Stack)
+
+	summary := fmt.Sprintf("%s: %s", goroutine, ev.Value)
+	d.panicked.CompareAndSwap(nil, &summary)
+
+	if err := d.writeCrashLog(&ev); err != nil {
+		d.errorf("Error writing crash log: %v", err)
+	}
+	if d.config.OnPanic != nil {
+		d.config.OnPanic(ev)
+	}
+	if fail != nil {
+		fail()
+	}
+}
+
+// writeCrashLog appends a panic report to crash.log
+func (d *Daemon) writeCrashLog(ev *PanicEvent) error {
+	f, err := d.storage.Append(CrashLogFileName)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s panic in %s: %s\n%s\n", ev.Time.Format(time.RFC3339), ev.Goroutine, ev.Value, ev.Stack)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// abort ends the run when a goroutine the daemon cannot do without
+// panicked: the process is killed, so that its exit is reported and the
+// status written by waitForProcess
+func (d *Daemon) abort() {
+	if d.cmd != nil && d.cmd.Process != nil {
+		if err := d.cmd.Process.Kill(); err != nil {
+			d.errorf("Error killing process %d: %v", d.pid, err)
+		}
+	}
+}
+
+// exitAfterPanic reports the end of the process when waitForProcess itself
+// panicked, so that the status is still written
+func (d *Daemon) exitAfterPanic() {
+	d.abort()
+
+	d.mu.Lock()
+	if d.running {
+		d.running = false
+		now := time.Now()
+		d.endedAt = &now
+		exitCode := -1
+		d.exitCode = &exitCode
+	}
+	d.mu.Unlock()
+
+	d.doneOnce.Do(func() { close(d.doneCh) })
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/storage"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	dir := t.TempDir()
+	events := make(chan PanicEvent, 2)
+	d := &Daemon{
+		config:  &Config{OnPanic: func(ev PanicEvent) { events <- ev }},
+		storage: storage.Dir(dir),
+		clients: make(map[net.Conn]*client),
+		running: true,
+		doneCh:  make(chan struct{}),
+	}
+
+	// A goroutine that can be lost leaves the daemon running
+	func() {
+		defer d.recoverPanic("client handler", nil)
+		panic("boom")
+	}()
+
+	ev := <-events
+	if ev.Goroutine != "client handler" || ev.Value != "boom" || ev.Fatal || !strings.Contains(ev.Stack, "TestRecoverPanic") {
+		t.Errorf("Unexpected event %+v", ev)
+	}
+	if status := d.GetStatus(); !status.Running || status.Panic != "client handler: boom" {
+		t.Errorf("Expected a running process with the panic in its status, got %+v", status)
+	}
+
+	// Without the process waiter, the exit is reported by the recovery
+	func() {
+		defer d.recoverPanic("process waiter", d.exitAfterPanic)
+		var m map[string]int
+		m["x"]++
+	}()
+
+	if ev := <-events; !ev.Fatal {
+		t.Errorf("Expected a fatal panic, got %+v", ev)
+	}
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the daemon to be done")
+	}
+	status := d.GetStatus()
+	if status.Running || status.ExitCode == nil || *status.ExitCode != -1 {
+		t.Errorf("Expected the process to be reported as ended, got %+v", status)
+	}
+	if status.Panic != "client handler: boom" {
+		t.Errorf("Expected the first panic to be kept, got %q", status.Panic)
+	}
+
+	data, err := d.storage.ReadFile(CrashLogFileName)
+	if err != nil {
+		t.Fatalf("Failed to read crash log: %v", err)
+	}
+	log := string(data)
+	if !strings.Contains(log, "panic in client handler: boom") || !strings.Contains(log, "panic in process waiter: assignment to entry in nil map") {
+		t.Errorf("Expected both panics in the crash log, got %s", log)
+	}
+}
@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredSupported tells whether peerCredentials identifies the peers
+const peerCredSupported = true
+
+// peerCredentials returns the process and user on the other end of a unix
+// socket connection
+func peerCredentials(conn net.Conn) peerCred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCred{}
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCred{}
+	}
+
+	var peer peerCred
+	raw.Control(func(fd uintptr) {
+		cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if err == nil {
+			peer = peerCred{pid: int(cred.Pid), uid: int(cred.Uid), gid: int(cred.Gid), known: true}
+		}
+	})
+	return peer
+}
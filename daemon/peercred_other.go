@@ -0,0 +1,13 @@
+//go:build !linux
+
+package daemon
+
+import "net"
+
+// peerCredSupported tells whether peerCredentials identifies the peers
+const peerCredSupported = false
+
+// peerCredentials is only implemented on Linux
+func peerCredentials(conn net.Conn) peerCred {
+	return peerCred{}
+}
@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes of ioprio_set(2), shifted in an I/O priority above
+// the level
+const (
+	ioprioClassRealtime   = 1
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+	ioprioClassShift      = 13
+)
+
+// parseIONice returns the I/O priority of an I/O scheduling class with its
+// level, from 0 (highest) to 7: "realtime:N", "best-effort:N" (the level
+// defaulting to 4) or "idle"
+func parseIONice(ionice string) (int, error) {
+	name, levelStr, hasLevel := strings.Cut(ionice, ":")
+	var class int
+	switch name {
+	case "realtime":
+		class = ioprioClassRealtime
+	case "best-effort":
+		class = ioprioClassBestEffort
+	case "idle":
+		if hasLevel {
+			return 0, fmt.Errorf("invalid I/O priority %q: the idle class has no level", ionice)
+		}
+		return ioprioClassIdle << ioprioClassShift, nil
+	default:
+		return 0, fmt.Errorf("invalid I/O priority %q (realtime:N, best-effort:N or idle)", ionice)
+	}
+	level := 4
+	if hasLevel {
+		var err error
+		if level, err = strconv.Atoi(levelStr); err != nil || level < 0 || level > 7 {
+			return 0, fmt.Errorf("invalid I/O priority level %q: must be from 0 to 7", levelStr)
+		}
+	}
+	return class<<ioprioClassShift | level, nil
+}
+
+// validatePriorities checks the CPU and I/O priorities and the OOM score
+// adjustment of the configuration
+func validatePriorities(config *Config) error {
+	if config.Nice == nil && config.IONice == "" && config.OOMScoreAdj == nil {
+		return nil
+	}
+	if !execSetupSupported {
+		return errors.New("process priorities are only supported on Linux")
+	}
+	if n := config.Nice; n != nil && (*n < -20 || *n > 19) {
+		return fmt.Errorf("invalid niceness %d: must be from -20 to 19", *n)
+	}
+	if config.IONice != "" {
+		if _, err := parseIONice(config.IONice); err != nil {
+			return err
+		}
+	}
+	if adj := config.OOMScoreAdj; adj != nil && (*adj < -1000 || *adj > 1000) {
+		return fmt.Errorf("invalid OOM score adjustment %d: must be from -1000 to 1000", *adj)
+	}
+	return nil
+}
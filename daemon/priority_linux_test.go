@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseIONice(t *testing.T) {
+	for ionice, expected := range map[string]int{
+		"idle":          3 << 13,
+		"best-effort":   2<<13 | 4,
+		"best-effort:7": 2<<13 | 7,
+		"realtime:0":    1 << 13,
+	} {
+		if ioprio, err := parseIONice(ionice); err != nil || ioprio != expected {
+			t.Errorf("Expected %s to be %#x, got %#x (%v)", ionice, expected, ioprio, err)
+		}
+	}
+	for _, ionice := range []string{"", "fast", "idle:1", "best-effort:8", "realtime:x"} {
+		if _, err := parseIONice(ionice); err == nil {
+			t.Errorf("Expected %q to be refused", ionice)
+		}
+	}
+}
+
+func TestPriorityValidation(t *testing.T) {
+	low, high := -21, 1001
+	for _, config := range []*Config{
+		{Nice: &low},
+		{IONice: "fast"},
+		{OOMScoreAdj: &high},
+	} {
+		config.Command = []string{"true"}
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected %+v to be refused", config)
+		}
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	if !execSetupSupported {
+		t.Skip("Process priorities are not supported here")
+	}
+
+	nice, oomScoreAdj := 7, 500
+	d, err := New(&Config{
+		Command:     []string{"sleep", "10"},
+		StdoutMode:  IOModeNull,
+		StderrMode:  IOModeNull,
+		RuntimeDir:  t.TempDir(),
+		Nice:        &nice,
+		IONice:      "idle",
+		OOMScoreAdj: &oomScoreAdj,
+		Embedded:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	pid := waitExecuted(t, d, "sleep")
+	n, _ := strconv.Atoi(pid)
+	if prio, err := unix.Getpriority(unix.PRIO_PROCESS, n); err != nil || 20-prio != nice {
+		t.Errorf("Expected niceness %d, got %d (%v)", nice, 20-prio, err)
+	}
+	if ioprio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(n), 0); errno != 0 || ioprio>>ioprioClassShift != ioprioClassIdle {
+		t.Errorf("Expected the idle I/O class, got %#x (%v)", ioprio, errno)
+	}
+	data, err := os.ReadFile("/proc/" + pid + "/oom_score_adj")
+	if err != nil || strings.TrimSpace(string(data)) != "500" {
+		t.Errorf("Expected OOM score adjustment 500, got %q (%v)", data, err)
+	}
+
+	d.Signal(syscall.SIGKILL)
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+}
@@ -0,0 +1,137 @@
+package daemon
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// Quotas limits what a single client connection may consume, protecting a
+// shared daemon from a misbehaving controller. Zero means unlimited.
+type Quotas struct {
+	// MaxStdinBytes is the total amount of stdin data a client may send
+	MaxStdinBytes int64 `json:"max_stdin_bytes,omitempty"`
+
+	// MaxExportBytesPerMinute bounds the size of the screen and export
+	// responses a client may request within a minute
+	MaxExportBytesPerMinute int64 `json:"max_export_bytes_per_minute,omitempty"`
+}
+
+// exportWindow is the period MaxExportBytesPerMinute applies to
+const exportWindow = time.Minute
+
+// countingConn counts the bytes read from and written to a client
+type countingConn struct {
+	net.Conn
+	in, out atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(uint64(n))
+	return n, err
+}
+
+// WriteBuffers lets protocol.WriteOutputTo use the writev support of the
+// underlying connection
+func (c *countingConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	n, err := bufs.WriteTo(c.Conn)
+	c.out.Add(uint64(n))
+	return n, err
+}
+
+// clientUsage tracks the quota consumption of a client, protected by d.mu
+type clientUsage struct {
+	stdinBytes  int64
+	exportStart time.Time // start of the current export window
+	exportBytes int64     // export bytes sent in the current window
+}
+
+// chargeStdin accounts n stdin bytes to the client on conn, or rejects them
+// if that would exceed the stdin quota
+func (d *Daemon) chargeStdin(conn net.Conn, n int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.clients[conn]
+	if !ok {
+		return nil
+	}
+
+	limit := d.config.Quotas.MaxStdinBytes
+	if limit > 0 && c.usage.stdinBytes+int64(n) > limit {
+		return &protocol.QuotaExceeded{
+			Quota: protocol.QuotaStdinBytes,
+			Limit: limit,
+			Used:  c.usage.stdinBytes,
+		}
+	}
+	c.usage.stdinBytes += int64(n)
+	return nil
+}
+
+// chargeExport accounts n bytes of screen or export content to the client
+// on conn, or rejects them if that would exceed the export quota
+func (d *Daemon) chargeExport(conn net.Conn, n int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.clients[conn]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(c.usage.exportStart) >= exportWindow {
+		c.usage.exportStart = now
+		c.usage.exportBytes = 0
+	}
+
+	limit := d.config.Quotas.MaxExportBytesPerMinute
+	if limit > 0 && c.usage.exportBytes+int64(n) > limit {
+		return &protocol.QuotaExceeded{
+			Quota: protocol.QuotaExportBytesPerMinute,
+			Limit: limit,
+			Used:  c.usage.exportBytes,
+		}
+	}
+	c.usage.exportBytes += int64(n)
+	return nil
+}
+
+// clientStats returns the traffic of every connected client
+func (d *Daemon) clientStats() []protocol.ClientStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	stats := make([]protocol.ClientStats, 0, len(d.clients))
+	for _, c := range d.clients {
+		s := protocol.ClientStats{
+			ID:         c.id,
+			Attached:   c.attached,
+			Exclusive:  d.exclusive == c,
+			QueueDepth: len(c.queue.ch),
+			Dropped:    c.queue.dropped.Load(),
+		}
+		if c.peer.known {
+			uid := c.peer.uid
+			s.PeerPID = c.peer.pid
+			s.PeerUID = &uid
+		}
+		s.Remote = c.peer.remote
+		if cc, ok := c.conn.(*countingConn); ok {
+			s.BytesIn = cc.in.Load()
+			s.BytesOut = cc.out.Load()
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
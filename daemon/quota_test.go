@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestStdinQuota(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"cat"},
+		StdinMode:  StdinStream,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		Quotas:     Quotas{MaxStdinBytes: 10},
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	c, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	// Within the quota, no response is sent
+	if err := protocol.WriteMessage(c, protocol.MsgStdin, []byte("12345678")); err != nil {
+		t.Fatalf("Failed to send stdin: %v", err)
+	}
+
+	// This one would exceed it
+	if err := protocol.WriteMessage(c, protocol.MsgStdin, []byte("abc")); err != nil {
+		t.Fatalf("Failed to send stdin: %v", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := protocol.ReadMessage(c)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if msg.Type != protocol.MsgQuotaExceeded {
+		t.Fatalf("Expected MsgQuotaExceeded, got 0x%02X", msg.Type)
+	}
+
+	q, err := protocol.ParseQuotaExceeded(msg.Payload)
+	if err != nil {
+		t.Fatalf("Failed to parse quota error: %v", err)
+	}
+	if q.Quota != protocol.QuotaStdinBytes || q.Limit != 10 || q.Used != 8 {
+		t.Errorf("Unexpected quota error: %+v", q)
+	}
+
+	// A new connection gets its own quota
+	c2, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c2.Close()
+	if err := protocol.WriteMessage(c2, protocol.MsgStdin, []byte("abc")); err != nil {
+		t.Fatalf("Failed to send stdin: %v", err)
+	}
+	if err := protocol.WriteMessage(c2, protocol.MsgStatus, nil); err != nil {
+		t.Fatalf("Failed to send status: %v", err)
+	}
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err = protocol.ReadMessage(c2)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if msg.Type != protocol.MsgStatusResponse {
+		t.Fatalf("Expected MsgStatusResponse, got 0x%02X", msg.Type)
+	}
+
+	// Both clients are listed with their traffic
+	status, err := protocol.ParseStatusResponse(msg.Payload)
+	if err != nil {
+		t.Fatalf("Failed to parse status: %v", err)
+	}
+	if len(status.Clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(status.Clients))
+	}
+	for _, client := range status.Clients {
+		if client.BytesIn == 0 {
+			t.Errorf("Expected inbound traffic to be counted: %+v", client)
+		}
+	}
+}
+
+func TestExportQuota(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"sleep", "10"},
+		UseVTY:     true,
+		RuntimeDir: tmpDir,
+		Quotas:     Quotas{MaxExportBytesPerMinute: 3000},
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	c, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	// A 24x80 screen is 1920 bytes: the first request fits, the second not
+	expected := []protocol.MessageType{protocol.MsgScreenResponse, protocol.MsgQuotaExceeded}
+	for i, want := range expected {
+		if err := protocol.WriteMessage(c, protocol.MsgGetScreen, nil); err != nil {
+			t.Fatalf("Failed to send GetScreen: %v", err)
+		}
+		msg, err := protocol.ReadMessage(c)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if msg.Type != want {
+			t.Errorf("Request %d: expected 0x%02X, got 0x%02X", i+1, want, msg.Type)
+		}
+	}
+}
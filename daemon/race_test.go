@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// These tests are meant to be run with -race: they exercise the daemon from
+// many goroutines at once, the way embedders and busy clients do.
+
+// stressClient sends a mix of requests on its own connection until stop is
+// closed, reading and discarding everything the daemon sends back
+func stressClient(t *testing.T, socketPath string, vty bool, stop <-chan struct{}) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Errorf("Failed to connect: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		for {
+			if _, err := protocol.ReadMessage(conn); err != nil {
+				return
+			}
+		}
+	}()
+
+	resize := make([]byte, 4)
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		var err error
+		switch i % 7 {
+		case 0:
+			err = protocol.WriteMessage(conn, protocol.MsgAttach, []byte{protocol.StreamBoth})
+		case 1:
+			err = protocol.WriteMessage(conn, protocol.MsgStdin, []byte("hello\n"))
+		case 2:
+			binary.BigEndian.PutUint16(resize[0:2], uint16(20+i%10))
+			binary.BigEndian.PutUint16(resize[2:4], uint16(70+i%20))
+			err = protocol.WriteMessage(conn, protocol.MsgResize, resize)
+		case 3:
+			err = protocol.WriteExportRequest(conn, &protocol.ExportRequest{IncludeScrollback: true, EndLine: -1})
+		case 4:
+			err = protocol.WriteMessage(conn, protocol.MsgStatus, nil)
+		case 5:
+			if vty {
+				err = protocol.WriteMessage(conn, protocol.MsgGetScreen, nil)
+			}
+			if err == nil && vty {
+				err = protocol.WriteSubscribeScreen(conn, byte(i/7%2))
+			}
+		case 6:
+			err = protocol.WriteMessage(conn, protocol.MsgDetach, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func testConcurrentClients(t *testing.T, config *Config) {
+	config.RuntimeDir = t.TempDir()
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	// Embedders may poll the status while the daemon starts
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			d.GetStatus()
+		}
+	}()
+
+	if err := d.Start(); err != nil {
+		close(stop)
+		wg.Wait()
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stressClient(t, d.SocketPath(), config.UseVTY, stop)
+		}()
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// Stop while requests are in flight
+	d.stop()
+	close(stop)
+	wg.Wait()
+}
+
+func TestConcurrentClients(t *testing.T) {
+	testConcurrentClients(t, &Config{
+		Command:    []string{"cat"},
+		StdinMode:  StdinStream,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+	})
+}
+
+func TestConcurrentClientsVTY(t *testing.T) {
+	testConcurrentClients(t, &Config{
+		Command:    []string{"cat"},
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		UseVTY:     true,
+		Record:     true,
+	})
+}
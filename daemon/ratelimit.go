@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// outputLimiter bounds the rate the output of the process is read at, as a
+// token bucket holding a second of output shared by its streams. A reader
+// over the rate waits, and the process blocks once the pipe or PTY buffer
+// is full, rather than having the daemon spin copying and broadcasting.
+type outputLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // bytes per second
+	tokens    float64
+	last      time.Time
+	throttled bool // waited since the bucket was last full
+}
+
+// newOutputLimiter returns the limiter of rate bytes per second, nil for
+// none
+func newOutputLimiter(rate int64) *outputLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &outputLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// take accounts for n bytes of output read at now, returning how long the
+// reader waits before reading more, and whether throttling starts
+func (l *outputLimiter) take(n int, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens == l.rate {
+		// The output stayed under the rate for a while
+		l.throttled = false
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, false
+	}
+	start := !l.throttled
+	l.throttled = true
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), start
+}
+
+// throttleOutput waits for the rate limit after n bytes of output were
+// handled, reporting when throttling starts. The output left once the
+// process exited is drained at full speed.
+func (d *Daemon) throttleOutput(n int) {
+	if d.limiter == nil {
+		return
+	}
+	select {
+	case <-d.reaped:
+		return
+	default:
+	}
+	wait, start := d.limiter.take(n, time.Now())
+	if start {
+		d.warnf("Output over %d bytes/s, throttling", d.config.MaxOutputRate)
+		d.emitEvent(protocol.Event{Type: protocol.EventThrottled, Rate: d.config.MaxOutputRate})
+	}
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.reaped:
+	case <-d.closeCh:
+	}
+}
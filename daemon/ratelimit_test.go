@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestOutputLimiter(t *testing.T) {
+	l := newOutputLimiter(1000)
+	now := time.Now()
+
+	// A second of output passes at once
+	if wait, start := l.take(1000, now); wait != 0 || start {
+		t.Errorf("Expected the burst to pass, got %v, %v", wait, start)
+	}
+	if wait, start := l.take(500, now); wait != 500*time.Millisecond || !start {
+		t.Errorf("Expected to wait 500ms and throttling to start, got %v, %v", wait, start)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if wait, start := l.take(500, now); wait != 500*time.Millisecond || start {
+		t.Errorf("Expected to wait 500ms while throttled, got %v, %v", wait, start)
+	}
+
+	// Once the bucket is full again, throttling is reported anew
+	now = now.Add(2 * time.Second)
+	if wait, _ := l.take(1000, now); wait != 0 {
+		t.Errorf("Expected the burst to pass, got %v", wait)
+	}
+	if _, start := l.take(1, now); !start {
+		t.Error("Expected throttling to start again")
+	}
+
+	if newOutputLimiter(0) != nil {
+		t.Error("Expected no limiter without a rate")
+	}
+}
+
+func TestMaxOutputRate(t *testing.T) {
+	d, err := New(&Config{
+		Command:       []string{"sh", "-c", "sleep 0.2; head -c 20000 /dev/zero; sleep 5"},
+		StdoutMode:    IOModeLog,
+		StderrMode:    IOModeLog,
+		RuntimeDir:    t.TempDir(),
+		MaxOutputRate: 4096,
+		Embedded:      true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	conn, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if err := protocol.WriteSubscribe(conn, protocol.EventsSubscribe); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Expected a throttled event: %v", err)
+		}
+		if msg.Type != protocol.MsgEvent {
+			continue
+		}
+		ev, err := protocol.ParseEvent(msg.Payload)
+		if err == nil && ev.Type == protocol.EventThrottled {
+			if ev.Rate != 4096 {
+				t.Errorf("Expected the rate limit in the event, got %d", ev.Rate)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+// RecordingFileName is the name of the asciinema v2 recording of the
+// terminal session
+const RecordingFileName = "session.cast"
+
+// TimelineFileName is the name of the timeline written along with the
+// recording: one JSON event per line interleaving the output with the input,
+// resizes, signals and shell marks, for a complete audit of the session
+const TimelineFileName = "timeline.jsonl"
+
+// castHeader is the first line of an asciinema v2 file
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the PTY output as asciinema v2 events, one JSON line per
+// chunk of output or resize, and the timeline of the session
+type recorder struct {
+	w        io.WriteCloser
+	timeline io.WriteCloser
+	start    time.Time
+	pending  []byte // incomplete UTF-8 sequence at the end of the last chunk
+}
+
+// newRecorder writes the header of a recording of a rows x cols terminal and
+// the start event of its timeline
+func newRecorder(w, timeline io.WriteCloser, rows, cols int, command []string) (*recorder, error) {
+	r := &recorder{w: w, timeline: timeline, start: time.Now()}
+
+	header := castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Command:   strings.Join(command, " "),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		header.Env["SHELL"] = shell
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	err = r.timelineEvent(protocol.TimelineEvent{
+		Type:      protocol.TimelineStart,
+		Rows:      rows,
+		Cols:      cols,
+		Timestamp: header.Timestamp,
+		Command:   header.Command,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write timeline: %w", err)
+	}
+	return r, nil
+}
+
+// event writes an event of the given type ("o" for output, "r" for resize)
+func (r *recorder) event(kind, data string) error {
+	line, err := json.Marshal([]any{time.Since(r.start).Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(line, '\n'))
+	return err
+}
+
+// timelineEvent writes an event to the timeline, timestamped like the
+// recording events
+func (r *recorder) timelineEvent(ev protocol.TimelineEvent) error {
+	ev.Time = time.Since(r.start).Seconds()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = r.timeline.Write(append(line, '\n'))
+	return err
+}
+
+// output records a chunk of output. Event data must be valid UTF-8, so a
+// character split across two reads is held back until it is complete.
+func (r *recorder) output(data []byte) error {
+	if len(r.pending) > 0 {
+		data = append(r.pending, data...)
+		r.pending = nil
+	}
+
+	// Look for an incomplete sequence in the last 3 bytes
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				r.pending = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+	if err := r.event("o", string(data)); err != nil {
+		return err
+	}
+	return r.timelineEvent(protocol.TimelineEvent{Type: protocol.TimelineOutput, Data: string(data)})
+}
+
+// resize records a terminal size change
+func (r *recorder) resize(rows, cols int) error {
+	if err := r.event("r", fmt.Sprintf("%dx%d", cols, rows)); err != nil {
+		return err
+	}
+	return r.timelineEvent(protocol.TimelineEvent{Type: protocol.TimelineResize, Rows: rows, Cols: cols})
+}
+
+// Close flushes any held back bytes and closes the recording and timeline
+func (r *recorder) Close() error {
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.timelineEvent(protocol.TimelineEvent{Type: protocol.TimelineOutput, Data: string(r.pending)})
+		r.pending = nil
+	}
+	return errors.Join(r.w.Close(), r.timeline.Close())
+}
+
+// screenSnapshot returns the output redrawing the current screen, so that a
+// recording started mid-session begins with what was already displayed. It
+// returns an empty string while nothing was displayed.
+func screenSnapshot(t *termemu.Terminal) string {
+	row, col := t.GetCursor()
+	if row == 0 && col == 0 && strings.TrimSpace(t.ExportCurrentScreen(termemu.FormatPlainText)) == "" {
+		return ""
+	}
+
+	screen := strings.TrimSuffix(t.ExportCurrentScreen(termemu.FormatANSI), "\n")
+	return "\x1b[H\x1b[2J" + strings.ReplaceAll(screen, "\n", "\r\n") + fmt.Sprintf("\x1b[%d;%dH", row+1, col+1)
+}
+
+// startRecording starts writing the session to RecordingFileName and
+// TimelineFileName, replacing any previous recording. It does nothing if a
+// recording is in progress.
+func (d *Daemon) startRecording() error {
+	term := d.terminal()
+	if !d.config.UseVTY || term == nil {
+		return fmt.Errorf("recording requires VTY mode")
+	}
+
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if d.recorder != nil {
+		return nil
+	}
+
+	if err := d.storage.WriteFile(RecordingFileName, nil); err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+	if err := d.storage.WriteFile(TimelineFileName, nil); err != nil {
+		return fmt.Errorf("failed to create timeline: %w", err)
+	}
+	w, err := d.storage.Append(RecordingFileName)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	timeline, err := d.storage.Append(TimelineFileName)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to open timeline: %w", err)
+	}
+
+	rows, cols := term.Size()
+	rec, err := newRecorder(w, timeline, rows, cols, d.config.Command)
+	if err != nil {
+		w.Close()
+		timeline.Close()
+		return err
+	}
+
+	// Output fed to the emulator so far is only visible in its screen
+	if snapshot := screenSnapshot(term); snapshot != "" {
+		if err := rec.output([]byte(snapshot)); err != nil {
+			rec.Close()
+			return fmt.Errorf("failed to write recording: %w", err)
+		}
+	}
+
+	d.recorder = rec
+	d.infof("Recording session to %s", RecordingFileName)
+	return nil
+}
+
+// stopRecording closes the recording in progress, if any
+func (d *Daemon) stopRecording() error {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if d.recorder == nil {
+		return nil
+	}
+	err := d.recorder.Close()
+	d.recorder = nil
+	return err
+}
+
+// isRecording reports whether the session is being recorded
+func (d *Daemon) isRecording() bool {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+	return d.recorder != nil
+}
+
+// recordOutput feeds PTY output to the emulator and the recording together,
+// so that a recording starting in between sees each byte exactly once. The
+// output is recorded first so that it precedes the shell marks it holds in
+// the timeline.
+func (d *Daemon) recordOutput(data []byte) {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if d.recorder != nil {
+		if err := d.recorder.output(data); err != nil {
+			d.errorf("Error writing recording, stopping: %v", err)
+			d.recorder.Close()
+			d.recorder = nil
+		}
+	}
+	if term := d.terminal(); term != nil {
+		term.Write(data)
+		d.snapshotStale.Store(true)
+	}
+}
+
+// recordEvent adds an event to the timeline of the recording in progress,
+// if any. The caller holds recordMu.
+func (d *Daemon) recordEvent(ev protocol.TimelineEvent) {
+	if d.recorder == nil {
+		return
+	}
+	if err := d.recorder.timelineEvent(ev); err != nil {
+		d.errorf("Error writing timeline: %v", err)
+	}
+}
+
+// recordClientEvent adds an event caused by the client on conn to the
+// timeline
+func (d *Daemon) recordClientEvent(conn net.Conn, ev protocol.TimelineEvent) {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if d.recorder == nil {
+		return
+	}
+	d.mu.RLock()
+	if c, ok := d.clients[conn]; ok {
+		ev.Client = c.id
+	}
+	d.mu.RUnlock()
+	d.recordEvent(ev)
+}
+
+// recordMark adds a shell integration mark to the timeline. The emulator
+// calls it while processing output, from recordOutput which holds recordMu.
+func (d *Daemon) recordMark(mark string) {
+	d.recordEvent(protocol.TimelineEvent{Type: protocol.TimelineMark, Data: mark})
+}
+
+// recordExit adds the exit of the process to the timeline
+func (d *Daemon) recordExit(code int) {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+	d.recordEvent(protocol.TimelineEvent{Type: protocol.TimelineExit, ExitCode: &code})
+}
+
+// recordResize resizes the emulator and records the new size
+func (d *Daemon) recordResize(rows, cols int) {
+	d.recordMu.Lock()
+	defer d.recordMu.Unlock()
+
+	if term := d.terminal(); term != nil {
+		term.Resize(rows, cols)
+		d.snapshotStale.Store(true)
+	}
+	if d.recorder != nil {
+		if err := d.recorder.resize(rows, cols); err != nil {
+			d.errorf("Error writing recording: %v", err)
+		}
+	}
+}
+
+// handleReplay streams the recording back to the client as OUTPUT messages
+// with its original timing, scaled by the requested speed, then sends
+// REPLAY_END. It works whether or not the process is still running; the
+// connection serves nothing else until the replay is over.
+func (d *Daemon) handleReplay(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseReplayRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	c, ok := d.clients[conn]
+	attached := ok && c.attached
+	d.mu.RUnlock()
+	if attached {
+		return fmt.Errorf("cannot replay while attached to the live output")
+	}
+
+	data, err := d.storage.ReadFile(RecordingFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("session has not been recorded")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+	if err := d.chargeExport(conn, len(data)); err != nil {
+		return err
+	}
+
+	events, err := protocol.ParseRecording(data)
+	if err != nil {
+		return err
+	}
+
+	var last float64
+	for _, ev := range events {
+		if ev.Type != "o" {
+			continue
+		}
+		if delay := time.Duration((ev.Time - last) / req.Speed * float64(time.Second)); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-d.closeCh:
+				return nil
+			}
+		}
+		last = ev.Time
+		if err := protocol.WriteOutputTo(conn, protocol.StreamStdout, []byte(ev.Data)); err != nil {
+			return err
+		}
+	}
+
+	return protocol.WriteMessage(conn, protocol.MsgReplayEnd, nil)
+}
@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+func TestRecorder(t *testing.T) {
+	var buf, timeline bufferCloser
+	r, err := newRecorder(&buf, &timeline, 24, 80, []string{"vim", "main.go"})
+	if err != nil {
+		t.Fatalf("newRecorder failed: %v", err)
+	}
+
+	// "é" split across two reads must not be recorded as invalid UTF-8
+	if err := r.output([]byte("caf\xc3")); err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if err := r.output([]byte("\xa9\r\n")); err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if err := r.resize(30, 100); err != nil {
+		t.Fatalf("resize failed: %v", err)
+	}
+	if err := r.timelineEvent(protocol.TimelineEvent{Type: protocol.TimelineInput, Data: ":q\r", Client: 2}); err != nil {
+		t.Fatalf("timelineEvent failed: %v", err)
+	}
+	r.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and 3 events, got %q", lines)
+	}
+
+	var header castHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Command != "vim main.go" {
+		t.Errorf("Unexpected header %+v", header)
+	}
+
+	expected := []struct{ kind, data string }{{"o", "caf"}, {"o", "é\r\n"}, {"r", "100x30"}}
+	for i, want := range expected {
+		var event []any
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil {
+			t.Fatalf("Failed to parse event %d: %v", i, err)
+		}
+		if len(event) != 3 || event[1] != want.kind || event[2] != want.data {
+			t.Errorf("Event %d: expected [_, %q, %q], got %v", i, want.kind, want.data, event)
+		}
+	}
+
+	events, err := protocol.ParseTimeline(timeline.Bytes())
+	if err != nil {
+		t.Fatalf("ParseTimeline failed: %v", err)
+	}
+	expectedTimeline := []protocol.TimelineEvent{
+		{Type: protocol.TimelineStart, Rows: 24, Cols: 80, Command: "vim main.go"},
+		{Type: protocol.TimelineOutput, Data: "caf"},
+		{Type: protocol.TimelineOutput, Data: "é\r\n"},
+		{Type: protocol.TimelineResize, Rows: 30, Cols: 100},
+		{Type: protocol.TimelineInput, Data: ":q\r", Client: 2},
+	}
+	if len(events) != len(expectedTimeline) {
+		t.Fatalf("Expected %d timeline events, got %+v", len(expectedTimeline), events)
+	}
+	for i, want := range expectedTimeline {
+		got := events[i]
+		got.Time, got.Timestamp = 0, 0
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Timeline event %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+}
+
+func TestRecordSession(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:    []string{"sh", "-c", "printf 'recorded output'"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		UseVTY:     true,
+		Record:     true,
+		RuntimeDir: tmpDir,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	d.Wait()
+
+	f, err := os.Open(filepath.Join(tmpDir, RecordingFileName))
+	if err != nil {
+		t.Fatalf("Failed to open recording: %v", err)
+	}
+	defer f.Close()
+
+	var output strings.Builder
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Failed to parse event: %v", err)
+		}
+		if event[1] == "o" {
+			output.WriteString(event[2].(string))
+		}
+	}
+	if output.String() != "recorded output" {
+		t.Errorf("Expected recorded output, got %q", output.String())
+	}
+}
+
+func TestRecordRequiresVTY(t *testing.T) {
+	_, err := New(&Config{Command: []string{"true"}, Record: true, RuntimeDir: t.TempDir()})
+	if err == nil {
+		t.Error("Expected recording without VTY to be rejected")
+	}
+}
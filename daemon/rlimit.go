@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RlimitInfinity is the value of a resource limit that does not limit
+const RlimitInfinity = ^uint64(0)
+
+// Rlimit is a resource limit of the process, as set by setrlimit(2)
+type Rlimit struct {
+	Resource string `json:"resource"` // nofile, core, cpu, as, nproc...
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+// String returns the limit as parsed by ParseRlimits
+func (r Rlimit) String() string {
+	if r.Soft == r.Hard {
+		return r.Resource + "=" + formatRlimit(r.Soft)
+	}
+	return r.Resource + "=" + formatRlimit(r.Soft) + ":" + formatRlimit(r.Hard)
+}
+
+func formatRlimit(value uint64) string {
+	if value == RlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+func parseRlimit(value string) (uint64, error) {
+	if value == "unlimited" {
+		return RlimitInfinity, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// ParseRlimits parses a comma-separated list of resource limits, each as
+// resource=soft:hard, or resource=value for both, a value being a number or
+// "unlimited": "nofile=1024:4096,core=0"
+func ParseRlimits(list string) ([]Rlimit, error) {
+	var rlimits []Rlimit
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid resource limit %q: expected resource=soft:hard", item)
+		}
+		soft, hard, ok := strings.Cut(value, ":")
+		if !ok {
+			hard = soft
+		}
+		r := Rlimit{Resource: strings.TrimSpace(name)}
+		var err error
+		if r.Soft, err = parseRlimit(soft); err != nil {
+			return nil, fmt.Errorf("invalid soft limit of %s: %q", r.Resource, soft)
+		}
+		if r.Hard, err = parseRlimit(hard); err != nil {
+			return nil, fmt.Errorf("invalid hard limit of %s: %q", r.Resource, hard)
+		}
+		rlimits = append(rlimits, r)
+	}
+	return rlimits, nil
+}
+
+// validateRlimits checks the resource limits, which may only be raised above
+// the hard limits of the daemon by root
+func validateRlimits(rlimits []Rlimit) error {
+	if !execSetupSupported {
+		return errors.New("resource limits are only supported on Linux")
+	}
+	for i, r := range rlimits {
+		resource, ok := rlimitResources[r.Resource]
+		if !ok {
+			return fmt.Errorf("unknown resource %q (%s)", r.Resource, strings.Join(rlimitNames(), ", "))
+		}
+		if slices.ContainsFunc(rlimits[:i], func(o Rlimit) bool { return o.Resource == r.Resource }) {
+			return fmt.Errorf("resource %s is limited twice", r.Resource)
+		}
+		if r.Soft > r.Hard {
+			return fmt.Errorf("soft limit of %s is above its hard limit", r.Resource)
+		}
+		max, err := hardRlimit(resource)
+		if err != nil {
+			return fmt.Errorf("failed to get limit of %s: %w", r.Resource, err)
+		}
+		if r.Hard > max && os.Geteuid() != 0 {
+			return fmt.Errorf("hard limit of %s cannot be raised above %s", r.Resource, formatRlimit(max))
+		}
+	}
+	return nil
+}
+
+// rlimitNames returns the names of the resources that can be limited
+func rlimitNames() []string {
+	var names []string
+	for name := range rlimitResources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
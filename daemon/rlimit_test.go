@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The processes with resource limits are started as the test binary
+	MaybeExecSetup()
+	os.Exit(m.Run())
+}
+
+func TestParseRlimits(t *testing.T) {
+	rlimits, err := ParseRlimits("nofile=1024:4096, core=0,stack=8388608:unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Rlimit{
+		{Resource: "nofile", Soft: 1024, Hard: 4096},
+		{Resource: "core", Soft: 0, Hard: 0},
+		{Resource: "stack", Soft: 8388608, Hard: RlimitInfinity},
+	}
+	if !reflect.DeepEqual(rlimits, expected) {
+		t.Errorf("Expected %v, got %v", expected, rlimits)
+	}
+	if s := rlimits[2].String(); s != "stack=8388608:unlimited" {
+		t.Errorf("Unexpected string %q", s)
+	}
+
+	for _, list := range []string{"nofile", "nofile=lots", "nofile=1:x"} {
+		if _, err := ParseRlimits(list); err == nil {
+			t.Errorf("Expected %q to be refused", list)
+		}
+	}
+}
+
+func TestRlimitValidation(t *testing.T) {
+	if !execSetupSupported {
+		t.Skip("Resource limits are not supported here")
+	}
+	for _, rlimits := range [][]Rlimit{
+		{{Resource: "bogus"}},
+		{{Resource: "nofile", Soft: 10, Hard: 5}},
+		{{Resource: "core"}, {Resource: "core"}},
+	} {
+		if _, err := New(&Config{Command: []string{"true"}, Rlimits: rlimits}); err == nil {
+			t.Errorf("Expected %v to be refused", rlimits)
+		}
+	}
+}
+
+func TestRlimits(t *testing.T) {
+	if !execSetupSupported {
+		t.Skip("Resource limits are not supported here")
+	}
+
+	d, err := New(&Config{
+		Command:    []string{"sleep", "10"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		Rlimits:    []Rlimit{{Resource: "nofile", Soft: 64, Hard: 128}, {Resource: "core", Soft: 0, Hard: 0}},
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	limits, err := os.ReadFile("/proc/" + waitExecuted(t, d, "sleep") + "/limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Max open files", "Max core file size"} {
+		found := false
+		for _, line := range strings.Split(string(limits), "\n") {
+			if !strings.HasPrefix(line, expected) {
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(line, expected))
+			found = true
+			want := []string{"64", "128"}
+			if expected == "Max core file size" {
+				want = []string{"0", "0"}
+			}
+			if len(fields) < 2 || fields[0] != want[0] || fields[1] != want[1] {
+				t.Errorf("Expected %s %v, got %q", expected, want, line)
+			}
+		}
+		if !found {
+			t.Errorf("No %s in the limits of the process: %q", expected, limits)
+		}
+	}
+
+	d.Signal(syscall.SIGKILL)
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+}
+
+// waitExecuted waits for the process of d to have executed comm after being
+// set up by the daemon binary, and returns its PID
+func waitExecuted(t *testing.T, d *Daemon, comm string) string {
+	t.Helper()
+	pid := strconv.Itoa(d.GetStatus().PID)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile("/proc/" + pid + "/comm")
+		if strings.TrimSpace(string(data)) == comm {
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Process %s did not execute %s", pid, comm)
+	return ""
+}
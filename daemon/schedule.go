@@ -0,0 +1,245 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// cronSchedule is a parsed cron expression, as the sets of minutes, hours,
+// days of the month, months and days of the week it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// A day matches either of dom and dow when both are restricted, as
+	// with cron
+	domAny, dowAny bool
+}
+
+// cronFields are the fields of a cron expression, with their range
+var cronFields = [5]struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule parses a cron expression of 5 fields (minute, hour, day of
+// month, month, day of week), each a list of values, ranges such as 1-5 and
+// steps such as */15, Sunday being 0 or 7
+func parseSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: 5 fields required (minute hour day-of-month month day-of-week)", expr)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s: %w", expr, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	s := &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never matches", expr)
+	}
+	return s, nil
+}
+
+// parseCronField parses a field of a cron expression into the set of the
+// values it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepStr, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			switch {
+			case isRange:
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			case !hasStep:
+				// A step from a single value goes up to max
+				hi = lo
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is out of range %d-%d", values, min, max)
+			}
+		}
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first minute after t the schedule matches, zero if it
+// does not within 5 years, such as on February 30
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay tells whether the schedule matches the day of t
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// validateStart checks the start options of config, returning its parsed
+// Schedule if any
+func validateStart(config *Config) (*cronSchedule, error) {
+	set := 0
+	if config.StartDelay != 0 {
+		set++
+	}
+	if config.StartAt != nil {
+		set++
+	}
+	if config.Schedule != "" {
+		set++
+	}
+	switch {
+	case config.StartDelay < 0:
+		return nil, fmt.Errorf("invalid start delay: %d", config.StartDelay)
+	case set > 1:
+		return nil, errors.New("start delay, start time and schedule are exclusive")
+	case config.Schedule != "":
+		return parseSchedule(config.Schedule)
+	}
+	return nil, nil
+}
+
+// startTime returns when the process is to be started, zero for now
+func (d *Daemon) startTime(now time.Time) time.Time {
+	switch {
+	case d.config.StartDelay > 0:
+		return now.Add(time.Duration(d.config.StartDelay) * time.Second)
+	case d.config.StartAt != nil && d.config.StartAt.After(now):
+		return *d.config.StartAt
+	case d.schedule != nil:
+		return d.schedule.next(now)
+	}
+	return time.Time{}
+}
+
+// startScheduled starts the process at the time it is scheduled at, unless
+// the daemon is stopped or the start cancelled first
+func (d *Daemon) startScheduled(at time.Time) {
+	defer d.recoverPanic("scheduled start", d.exitAfterPanic)
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.closeCh:
+	}
+
+	d.mu.Lock()
+	launch := !d.scheduledAt.IsZero()
+	select {
+	case <-d.closeCh:
+		launch = false
+	default:
+	}
+	d.scheduledAt = time.Time{}
+	d.mu.Unlock()
+
+	if !launch {
+		d.infof("Scheduled start cancelled")
+		d.startFailed(errors.New("start cancelled"))
+		d.finishUnstarted()
+		return
+	}
+	if err := d.launch(); err != nil {
+		d.errorf("%v", err)
+		d.finishUnstarted()
+		return
+	}
+	d.emitEvent(protocol.Event{Type: protocol.EventStarted, PID: d.childPID()})
+	d.startHandlers()
+	d.updateStatus()
+	d.runPostStartHook()
+}
+
+// finishUnstarted ends the daemon of a process that will not start
+func (d *Daemon) finishUnstarted() {
+	close(d.exited)
+	d.removeSocket()
+	d.doneOnce.Do(func() { close(d.doneCh) })
+}
+
+// ScheduledAt returns when the process is to be started, zero once it was
+// or is not scheduled
+func (d *Daemon) ScheduledAt() time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.scheduledAt
+}
+
+// CancelStart cancels the start of a process still waiting for the time it
+// is scheduled at, stopping the daemon. It returns false once the process
+// started, or if it was not scheduled.
+func (d *Daemon) CancelStart() bool {
+	d.mu.Lock()
+	scheduled := !d.scheduledAt.IsZero()
+	d.scheduledAt = time.Time{}
+	d.mu.Unlock()
+	if scheduled {
+		d.stop()
+	}
+	return scheduled
+}
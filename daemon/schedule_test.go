@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"0 0 30 2 *",
+	} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("Expected %q to be refused", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2025, 1, 15, 10, 30, 20, 0, time.UTC)
+	for expr, expected := range map[string]time.Time{
+		"* * * * *":      time.Date(2025, 1, 15, 10, 31, 0, 0, time.UTC),
+		"*/15 * * * *":   time.Date(2025, 1, 15, 10, 45, 0, 0, time.UTC),
+		"0 3 * * *":      time.Date(2025, 1, 16, 3, 0, 0, 0, time.UTC),
+		"30 10 * * *":    time.Date(2025, 1, 16, 10, 30, 0, 0, time.UTC),
+		"0 9-17/4 * * *": time.Date(2025, 1, 15, 13, 0, 0, 0, time.UTC),
+		"0 0 * * 7":      time.Date(2025, 1, 19, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * 1,5":    time.Date(2025, 1, 17, 0, 0, 0, 0, time.UTC),
+		"0 0 1 3 *":      time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":     time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+	} {
+		s, err := parseSchedule(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", expr, err)
+			continue
+		}
+		if next := s.next(now); !next.Equal(expected) {
+			t.Errorf("Expected %q to match next at %v, got %v", expr, expected, next)
+		}
+	}
+}
+
+func TestStartValidation(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	for _, config := range []*Config{
+		{Command: []string{"true"}, StartDelay: -1},
+		{Command: []string{"true"}, StartDelay: 10, StartAt: &at},
+		{Command: []string{"true"}, StartDelay: 10, Schedule: "* * * * *"},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected %+v to be refused", config)
+		}
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	d, err := New(&Config{
+		Command:    []string{"sh", "-c", "exit 4"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		StartDelay: 1,
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	// The socket serves clients before the process starts
+	conn, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if err := protocol.WriteSubscribe(conn, protocol.EventsSubscribe); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	status := d.GetStatus()
+	if status.State != protocol.StateScheduled || status.ScheduledAt == "" || status.PID != 0 || status.Running {
+		t.Errorf("Expected the process to be scheduled, got %+v", status)
+	}
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not start and exit")
+	}
+	status = d.GetStatus()
+	if status.State != protocol.StateExited || status.ExitCode == nil || *status.ExitCode != 4 || status.ScheduledAt != "" {
+		t.Errorf("Expected the process to have run, got %+v", status)
+	}
+
+	var events []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(events) < 2 {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Expected the started and exited events, got %v (%v)", events, err)
+		}
+		if msg.Type != protocol.MsgEvent {
+			continue
+		}
+		if ev, err := protocol.ParseEvent(msg.Payload); err == nil {
+			events = append(events, ev.Type)
+		}
+	}
+	if events[0] != protocol.EventStarted || events[1] != protocol.EventExited {
+		t.Errorf("Expected started then exited, got %v", events)
+	}
+}
+
+func TestCancelStart(t *testing.T) {
+	at := time.Now().Add(time.Hour)
+	d, err := New(&Config{
+		Command:    []string{"true"},
+		StdoutMode: IOModeNull,
+		StderrMode: IOModeNull,
+		RuntimeDir: t.TempDir(),
+		StartAt:    &at,
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	if got := d.ScheduledAt(); !got.Equal(at) {
+		t.Errorf("Expected the process to be scheduled at %v, got %v", at, got)
+	}
+
+	if !d.CancelStart() {
+		t.Fatal("Expected the scheduled start to be cancelled")
+	}
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop")
+	}
+	if status := d.GetStatus(); status.State != protocol.StateFailedToStart || status.PID != 0 {
+		t.Errorf("Expected the process never to start, got %+v", status)
+	}
+	if d.CancelStart() {
+		t.Error("Expected nothing left to cancel")
+	}
+}
@@ -0,0 +1,283 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+// handleSubscribeScreen starts or stops pushing screen updates to the client
+func (d *Daemon) handleSubscribeScreen(conn net.Conn, payload []byte) error {
+	if len(payload) != 1 {
+		return fmt.Errorf("invalid subscribe payload length")
+	}
+
+	action := payload[0]
+	if action != protocol.ScreenSubscribe && action != protocol.ScreenUnsubscribe {
+		return fmt.Errorf("invalid subscribe action: 0x%02X", action)
+	}
+
+	if !d.config.UseVTY {
+		return fmt.Errorf("VTY is not enabled")
+	}
+
+	if action == protocol.ScreenSubscribe {
+		if err := d.checkStrictVTY(); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	c, ok := d.clients[conn]
+	if ok {
+		c.screenSubscribed = action == protocol.ScreenSubscribe
+		c.screenStale.Store(c.screenSubscribed)
+	}
+	d.mu.Unlock()
+
+	// The first update, holding the whole screen, is the acknowledgement
+	if ok && action == protocol.ScreenSubscribe {
+		d.pushScreenUpdate()
+	}
+	return nil
+}
+
+// Size of the terminal the output log is replayed through with
+// Config.ReplayScreen
+const (
+	replayRows = 24
+	replayCols = 80
+)
+
+// screenTerminal returns the terminal emulator of a VTY process, or one the
+// output log was just replayed through with Config.ReplayScreen
+func (d *Daemon) screenTerminal() (*termemu.Terminal, error) {
+	if !d.config.UseVTY {
+		if !d.config.ReplayScreen {
+			return nil, fmt.Errorf("VTY is not enabled")
+		}
+		f, err := d.storage.Open(LogFileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output log: %w", err)
+		}
+		defer f.Close()
+		return termemu.ReplayLog(f, replayRows, replayCols)
+	}
+
+	term := d.terminal()
+	if term == nil {
+		return nil, fmt.Errorf("terminal emulator is not available")
+	}
+	if err := d.checkStrictVTY(); err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+// handleGetScreenCells sends the screen with the attributes of its cells
+func (d *Daemon) handleGetScreenCells(conn net.Conn) error {
+	term, err := d.screenTerminal()
+	if err != nil {
+		return err
+	}
+
+	screen := term.GetScreen()
+	cursorRow, cursorCol := term.GetCursor()
+	if len(screen) == 0 {
+		return fmt.Errorf("screen buffer is empty")
+	}
+
+	lines := screenLines(screen)
+	size := 0
+	for _, line := range lines {
+		for _, span := range line.Spans {
+			size += len(span.Text)
+		}
+	}
+	if err := d.chargeExport(conn, size); err != nil {
+		return err
+	}
+
+	return protocol.WriteScreenCellsResponse(conn, &protocol.ScreenCellsResponse{
+		Rows:       len(screen),
+		Cols:       len(screen[0]),
+		CursorRow:  cursorRow,
+		CursorCol:  cursorCol,
+		Lines:      lines,
+		InputModes: inputModes(term),
+	})
+}
+
+// pushScreenUpdate sends the screen rows changed since the previous update
+// to the subscribed clients, and the whole screen to those that need it.
+// It is called after each change of the emulator; screenMu makes sure that
+// updates are queued in the order their damage was taken.
+func (d *Daemon) pushScreenUpdate() {
+	term := d.terminal()
+	if term == nil {
+		return
+	}
+
+	d.screenMu.Lock()
+	defer d.screenMu.Unlock()
+
+	d.mu.RLock()
+	var subscribers []*client
+	for _, c := range d.clients {
+		if c.screenSubscribed {
+			subscribers = append(subscribers, c)
+		}
+	}
+	d.mu.RUnlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	damage := term.TakeDamage()
+	rows, cols := term.Size()
+	cursorRow, cursorCol := term.GetCursor()
+	cursorMoved := d.screenCursor != [2]int{cursorRow, cursorCol}
+	d.screenCursor = [2]int{cursorRow, cursorCol}
+
+	var delta, full []byte
+	for _, c := range subscribers {
+		var payload []byte
+		switch {
+		case c.screenStale.Load():
+			if full == nil {
+				full = d.screenUpdatePayload(&protocol.ScreenUpdate{
+					Full:      true,
+					Rows:      rows,
+					Cols:      cols,
+					CursorRow: cursorRow,
+					CursorCol: cursorCol,
+					Lines:     screenLines(term.GetScreen()),
+				})
+			}
+			payload = full
+		case len(damage) > 0 || cursorMoved:
+			if delta == nil {
+				update := &protocol.ScreenUpdate{
+					Rows:      rows,
+					Cols:      cols,
+					CursorRow: cursorRow,
+					CursorCol: cursorCol,
+					Lines:     make([]protocol.ScreenLine, 0, len(damage)),
+				}
+				for _, r := range damage {
+					update.Lines = append(update.Lines, screenLine(r.Row, r.Cells))
+				}
+				delta = d.screenUpdatePayload(update)
+			}
+			payload = delta
+		default:
+			continue
+		}
+
+		// A client missing an update gets the whole screen with the next one
+		queued := d.enqueueMessage(c, protocol.Message{Type: protocol.MsgScreenUpdate, Payload: payload})
+		c.screenStale.Store(!queued)
+	}
+}
+
+// screenUpdatePayload encodes a screen update
+func (d *Daemon) screenUpdatePayload(update *protocol.ScreenUpdate) []byte {
+	data, err := json.Marshal(update)
+	if err != nil {
+		d.errorf("Failed to marshal screen update: %v", err)
+	}
+	return data
+}
+
+// handleGetScrollback sends a page of the scrollback with the attributes of
+// its cells
+func (d *Daemon) handleGetScrollback(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseScrollbackRequest(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse scrollback request: %w", err)
+	}
+
+	term, err := d.screenTerminal()
+	if err != nil {
+		return err
+	}
+
+	rows, offset, total := term.ScrollbackLines(req.Offset, req.Limit)
+	lines := make([]protocol.ScreenLine, len(rows))
+	size := 0
+	for i, cells := range rows {
+		lines[i] = screenLine(offset+i, cells)
+		for _, span := range lines[i].Spans {
+			size += len(span.Text)
+		}
+	}
+	if err := d.chargeExport(conn, size); err != nil {
+		return err
+	}
+
+	return protocol.WriteScrollbackResponse(d.writerFor(conn), &protocol.ScrollbackResponse{
+		Total:  total,
+		Offset: offset,
+		Lines:  lines,
+	})
+}
+
+// screenLines converts the rows of a whole screen to screen update lines
+func screenLines(rows [][]termemu.Cell) []protocol.ScreenLine {
+	lines := make([]protocol.ScreenLine, len(rows))
+	for i, cells := range rows {
+		lines[i] = screenLine(i, cells)
+	}
+	return lines
+}
+
+// screenLine converts a row of cells to runs of cells sharing the same
+// attributes. Trailing blanks are left out unless they show a background.
+func screenLine(row int, cells []termemu.Cell) protocol.ScreenLine {
+	blank := termemu.Cell{Char: ' ', Attr: termemu.Attributes{Fg: termemu.ColorDefault, Bg: termemu.ColorDefault}}
+	normalized := make([]termemu.Cell, len(cells))
+	for i, cell := range cells {
+		if cell.Char == 0 {
+			// Never written, shown as a blank with the default attributes
+			cell = blank
+		}
+		normalized[i] = cell
+	}
+
+	end := len(normalized)
+	for end > 0 {
+		cell := normalized[end-1]
+		if cell.Char != ' ' || cell.Attr.Bg != termemu.ColorDefault || cell.Attr.Reverse || cell.HyperlinkURL != "" {
+			break
+		}
+		end--
+	}
+
+	line := protocol.ScreenLine{Row: row, Spans: []protocol.ScreenSpan{}}
+	for i := 0; i < end; {
+		attr, link := normalized[i].Attr, normalized[i].HyperlinkURL
+		var text []rune
+		for ; i < end && normalized[i].Attr == attr && normalized[i].HyperlinkURL == link; i++ {
+			text = append(text, normalized[i].Char)
+		}
+		line.Spans = append(line.Spans, protocol.ScreenSpan{
+			Text:      string(text),
+			Fg:        int(attr.Fg),
+			Bg:        int(attr.Bg),
+			Bold:      attr.Bold,
+			Dim:       attr.Dim,
+			Italic:    attr.Italic,
+			Underline: attr.Underline,
+			Blink:     attr.Blink,
+			Reverse:   attr.Reverse,
+			Hidden:    attr.Hidden,
+			Strike:    attr.Strike,
+			Link:      link,
+		})
+	}
+	return line
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+func TestScreenLine(t *testing.T) {
+	term := termemu.NewTerminal(2, 20)
+	term.Write([]byte("a \x1b[1;32mok\x1b[0m \x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\\x1b[44m  \x1b[0m   \r\n   "))
+	screen := term.GetScreen()
+
+	expected := protocol.ScreenLine{Row: 0, Spans: []protocol.ScreenSpan{
+		{Text: "a ", Fg: -1, Bg: -1},
+		{Text: "ok", Fg: 2, Bg: -1, Bold: true},
+		{Text: " ", Fg: -1, Bg: -1},
+		{Text: "link", Fg: -1, Bg: -1, Link: "https://example.com"},
+		{Text: "  ", Fg: -1, Bg: 4},
+	}}
+	if line := screenLine(0, screen[0]); !reflect.DeepEqual(line, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, line)
+	}
+
+	// Blank rows have no spans
+	if line := screenLine(1, screen[1]); line.Row != 1 || len(line.Spans) != 0 {
+		t.Errorf("Expected an empty line, got %+v", line)
+	}
+}
+
+func TestReplayScreen(t *testing.T) {
+	d, err := New(&Config{
+		Command:      []string{"printf", `\033[31mred\033[0m\nprogress 10%%\rprogress 100%%\n`},
+		StdoutMode:   IOModeLog,
+		StderrMode:   IOModeLog,
+		RuntimeDir:   t.TempDir(),
+		ReplayScreen: true,
+		Embedded:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	d.Wait()
+
+	term, err := d.screenTerminal()
+	if err != nil {
+		t.Fatalf("Failed to replay the output: %v", err)
+	}
+	expected := "red\nprogress 100%"
+	if output := term.ExportCurrentScreen(termemu.FormatPlainText); !strings.HasPrefix(output, expected) {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+	if html := term.ExportCurrentScreen(termemu.FormatHTML); !strings.Contains(html, "red</span>") {
+		t.Errorf("Expected the colors in the HTML export, got %q", html)
+	}
+
+	d.config.ReplayScreen = false
+	if _, err := d.screenTerminal(); err == nil {
+		t.Error("Expected no screen without VTY or replay")
+	}
+}
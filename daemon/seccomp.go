@@ -0,0 +1,91 @@
+package daemon
+
+//go:generate go run mksyscalls.go amd64 arm64
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// SeccompProfile restricts the system calls the process can make. It is
+// read from the JSON file of Config.SeccompProfile.
+type SeccompProfile struct {
+	// Mode is "deny" for the system calls to be denied, or "allow" for
+	// only them to be allowed, which must include execve
+	Mode     string   `json:"mode"`
+	Syscalls []string `json:"syscalls"`
+
+	// Action is what a denied system call does: "errno" to fail with EPERM
+	// (default), or "kill" to kill the process
+	Action string `json:"action,omitempty"`
+}
+
+// seccompFilter is a profile with the numbers of its system calls, which
+// execWithSetup compiles to a BPF program
+type seccompFilter struct {
+	Allow    bool     `json:"allow,omitempty"`
+	Kill     bool     `json:"kill,omitempty"`
+	Syscalls []uint32 `json:"syscalls"`
+}
+
+// LoadSeccompProfile reads a seccomp profile from a JSON file
+func LoadSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %w", err)
+	}
+	var profile SeccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+// filter checks the profile and resolves its system calls for the
+// architecture of the daemon
+func (p *SeccompProfile) filter() (*seccompFilter, error) {
+	if !seccompSupported {
+		return nil, errors.New("seccomp profiles are only supported on Linux on amd64 and arm64")
+	}
+	f := &seccompFilter{}
+	switch p.Mode {
+	case "deny":
+	case "allow":
+		f.Allow = true
+		if !slices.Contains(p.Syscalls, "execve") {
+			return nil, errors.New("seccomp allow-list must include execve for the command to be executed")
+		}
+	default:
+		return nil, fmt.Errorf("invalid seccomp mode %q (deny or allow)", p.Mode)
+	}
+	switch p.Action {
+	case "", "errno":
+	case "kill":
+		f.Kill = true
+	default:
+		return nil, fmt.Errorf("invalid seccomp action %q (errno or kill)", p.Action)
+	}
+	for _, name := range p.Syscalls {
+		nr, ok := syscallNumbers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown system call %q in seccomp profile", name)
+		}
+		f.Syscalls = append(f.Syscalls, nr)
+	}
+	return f, nil
+}
+
+// loadSeccompFilter loads the seccomp profile of the configuration, if any
+func loadSeccompFilter(config *Config) (*seccompFilter, error) {
+	if config.SeccompProfile == "" {
+		return nil, nil
+	}
+	profile, err := LoadSeccompProfile(config.SeccompProfile)
+	if err != nil {
+		return nil, err
+	}
+	return profile.filter()
+}
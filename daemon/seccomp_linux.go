@@ -0,0 +1,66 @@
+//go:build linux && (amd64 || arm64)
+
+package daemon
+
+import (
+	"errors"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompSupported tells whether seccomp profiles can be applied
+const seccompSupported = true
+
+// x32SyscallBit marks the system calls of the x32 ABI on amd64, which
+// would bypass a deny-list
+const x32SyscallBit = 0x40000000
+
+// installSeccomp applies the filter to the calling thread, which must have
+// no new privileges
+func installSeccomp(f *seccompFilter) error {
+	arch := uint32(unix.AUDIT_ARCH_X86_64)
+	if runtime.GOARCH == "arm64" {
+		arch = unix.AUDIT_ARCH_AARCH64
+	}
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	if f.Kill {
+		deny = unix.SECCOMP_RET_KILL_PROCESS
+	}
+	listed, others := deny, uint32(unix.SECCOMP_RET_ALLOW)
+	if f.Allow {
+		listed, others = others, listed
+	}
+
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jeq := func(k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+
+	// seccomp_data holds the system call number at offset 0 and the
+	// architecture at offset 4
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		jeq(arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: x32SyscallBit},
+			stmt(unix.BPF_RET|unix.BPF_K, deny))
+	}
+	for _, nr := range f.Syscalls {
+		prog = append(prog, jeq(nr, 0, 1), stmt(unix.BPF_RET|unix.BPF_K, listed))
+	}
+	prog = append(prog, stmt(unix.BPF_RET|unix.BPF_K, others))
+	if len(prog) > unix.BPF_MAXINSNS {
+		return errors.New("seccomp profile lists too many system calls")
+	}
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0)
+}
@@ -0,0 +1,74 @@
+//go:build linux && (amd64 || arm64)
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeccompProfile(t *testing.T) {
+	for _, profile := range []*SeccompProfile{
+		{Mode: "block", Syscalls: []string{"ptrace"}},
+		{Mode: "deny", Syscalls: []string{"no_such_call"}},
+		{Mode: "deny", Syscalls: []string{"ptrace"}, Action: "trap"},
+		{Mode: "allow", Syscalls: []string{"read", "write"}},
+	} {
+		if _, err := profile.filter(); err == nil {
+			t.Errorf("Expected %+v to be refused", profile)
+		}
+	}
+
+	f, err := (&SeccompProfile{Mode: "allow", Syscalls: []string{"execve", "read"}, Action: "kill"}).filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allow || !f.Kill || len(f.Syscalls) != 2 || f.Syscalls[0] != syscallNumbers["execve"] {
+		t.Errorf("Unexpected filter %+v", f)
+	}
+}
+
+func TestSeccomp(t *testing.T) {
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "seccomp.json")
+	if err := os.WriteFile(profile, []byte(`{"mode": "deny", "syscalls": ["mkdir", "mkdirat"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+
+	d, err := New(&Config{
+		Command:        []string{"sh", "-c", "grep NoNewPrivs /proc/self/status; mkdir " + filepath.Join(dir, "sub")},
+		StdoutMode:     IOModeFile,
+		StdoutPath:     out,
+		StderrMode:     IOModeNull,
+		RuntimeDir:     filepath.Join(dir, "run"),
+		SeccompProfile: profile,
+		Embedded:       true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+	if code := d.GetStatus().ExitCode; code == nil || *code == 0 {
+		t.Errorf("Expected mkdir to fail, got exit code %v", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory not to be created, got %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	if !strings.Contains(string(data), "NoNewPrivs:\t1") {
+		t.Errorf("Expected no new privileges, got %q", data)
+	}
+}
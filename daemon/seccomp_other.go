@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package daemon
+
+import "errors"
+
+// seccompSupported tells whether seccomp profiles can be applied
+const seccompSupported = false
+
+// syscallNumbers is only filled on Linux on amd64 and arm64
+var syscallNumbers = map[string]uint32{}
+
+func installSeccomp(f *seccompFilter) error {
+	return errors.New("seccomp profiles are not supported on this system")
+}
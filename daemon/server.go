@@ -1,15 +1,21 @@
 package daemon
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"net"
 	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/KarpelesLab/bgrun/protocol"
 	"github.com/KarpelesLab/bgrun/termemu"
@@ -17,18 +23,33 @@ import (
 
 // startSocketServer starts the Unix socket server
 func (d *Daemon) startSocketServer() error {
-	// Remove existing socket if present
-	os.Remove(d.socketPath)
-
-	listener, err := net.Listen("unix", d.socketPath)
+	listener, err := d.systemd.activatedListener()
 	if err != nil {
-		return fmt.Errorf("failed to create socket listener: %w", err)
+		return err
 	}
+	if listener != nil {
+		// systemd owns the socket and its permissions, it is only linked
+		// from the runtime directory
+		d.socketPath = listener.Addr().String()
+		d.socketActivated = true
+		if err := d.linkSocket(); err != nil {
+			listener.Close()
+			return err
+		}
+	} else {
+		// Remove existing socket if present
+		os.Remove(d.socketPath)
 
-	// Set socket permissions
-	if err := os.Chmod(d.socketPath, 0600); err != nil {
-		listener.Close()
-		return fmt.Errorf("failed to set socket permissions: %w", err)
+		listener, err = net.Listen("unix", d.socketPath)
+		if err != nil {
+			return fmt.Errorf("failed to create socket listener: %w", err)
+		}
+
+		// Set socket permissions
+		if err := d.setSocketPermissions(); err != nil {
+			listener.Close()
+			return err
+		}
 	}
 
 	// Store listener for cleanup
@@ -38,14 +59,82 @@ func (d *Daemon) startSocketServer() error {
 
 	go d.acceptConnections(listener)
 
-	log.Printf("Socket server listening on %s", d.socketPath)
+	d.infof("Socket server listening on %s", d.socketPath)
+
+	return nil
+}
+
+// setSocketPermissions applies the configured mode and group to the socket,
+// and links it from the runtime directory when it lives elsewhere
+func (d *Daemon) setSocketPermissions() error {
+	if err := d.chmodSocket(d.socketPath); err != nil {
+		return err
+	}
+	return d.linkSocket()
+}
 
+// linkSocket links the socket from the runtime directory when it lives
+// elsewhere
+func (d *Daemon) linkSocket() error {
+	if link := filepath.Join(d.runtimeDir, SocketFileName); link != d.socketPath {
+		os.Remove(link)
+		if err := os.Symlink(d.socketPath, link); err != nil {
+			return fmt.Errorf("failed to link socket: %w", err)
+		}
+	}
+	return nil
+}
+
+// chmodSocket applies the configured mode and group to a socket
+func (d *Daemon) chmodSocket(path string) error {
+	mode := d.config.SocketMode
+	if mode == 0 {
+		mode = 0600
+	}
+	if d.socketGID >= 0 {
+		if err := os.Chown(path, -1, d.socketGID); err != nil {
+			return fmt.Errorf("failed to set socket group: %w", err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
 	return nil
 }
 
+// removeSocket removes the socket, and its link in the runtime directory
+func (d *Daemon) removeSocket() {
+	if d.socketPath == "" {
+		return
+	}
+	if !d.socketActivated {
+		os.Remove(d.socketPath)
+	}
+	if link := filepath.Join(d.runtimeDir, SocketFileName); link != d.socketPath {
+		os.Remove(link)
+	}
+}
+
+// lookupGroup returns the ID of the group with the given name or ID, or -1
+// when name is empty
+func lookupGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket group: %w", err)
+	}
+	return strconv.Atoi(group.Gid)
+}
+
 // acceptConnections accepts incoming client connections
 func (d *Daemon) acceptConnections(listener net.Listener) {
 	defer listener.Close()
+	defer d.recoverPanic("accept loop", d.abort)
 
 	for {
 		select {
@@ -60,20 +149,66 @@ func (d *Daemon) acceptConnections(listener net.Listener) {
 			case <-d.closeCh:
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				d.errorf("Accept error: %v", err)
 				continue
 			}
 		}
 
-		d.mu.Lock()
-		d.clients[conn] = &client{
-			conn:     conn,
-			attached: false,
+		if tc, ok := conn.(*tls.Conn); ok {
+			// Handshake without holding up the other clients
+			go d.acceptTLS(tc)
+			continue
 		}
-		d.mu.Unlock()
 
-		go d.handleClient(conn)
+		d.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a connection accepted by another program, such as a
+// supervisor handing the connections selecting a job over to its daemon,
+// as if it was accepted on the control socket. The connection is closed
+// if the daemon is.
+func (d *Daemon) ServeConn(conn net.Conn) {
+	select {
+	case <-d.closeCh:
+		conn.Close()
+		return
+	default:
+	}
+
+	peer := peerCredentials(conn)
+	if err := d.authorize(peer); err != nil {
+		go d.reject(conn, peer, err)
+		return
 	}
+	d.addClient(conn, peer, d.permissionsOf(peer))
+}
+
+// addClient serves a new client connection, which may do perms
+func (d *Daemon) addClient(conn net.Conn, peer peerCred, perms Permissions) {
+	// Count the client traffic for stats
+	counted := &countingConn{Conn: conn}
+
+	c := &client{
+		peer:     peer,
+		perms:    perms,
+		conn:     counted,
+		queue:    newClientQueue(),
+		attached: false,
+	}
+
+	d.mu.Lock()
+	d.lastClientID++
+	c.id = d.lastClientID
+	d.clients[counted] = c
+	d.mu.Unlock()
+
+	go func() {
+		// handleClient cleans up once the connection is closed
+		defer d.recoverPanic(fmt.Sprintf("client %d writer", c.id), func() { c.conn.Close() })
+		d.writeQueued(c)
+	}()
+	go d.handleClient(counted)
 }
 
 // isNormalDisconnect checks if an error is a normal client disconnect
@@ -81,6 +216,10 @@ func isNormalDisconnect(err error) bool {
 	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 		return true
 	}
+	// Check for a client gone while being written to (EPIPE)
+	if errors.Is(err, syscall.EPIPE) {
+		return true
+	}
 	// Check for connection reset by peer (ECONNRESET)
 	if strings.Contains(err.Error(), "connection reset by peer") {
 		return true
@@ -97,22 +236,69 @@ func (d *Daemon) handleClient(conn net.Conn) {
 	defer func() {
 		conn.Close()
 		d.mu.Lock()
+		c, ok := d.clients[conn]
 		delete(d.clients, conn)
+		if ok {
+			d.releaseExclusive(c)
+		}
 		d.mu.Unlock()
+
+		if !ok {
+			return
+		}
+		close(c.queue.done)
+		if c.attached {
+			d.emitEvent(protocol.Event{Type: protocol.EventDetached, Client: c.id})
+			d.refitTerminal()
+		}
+
+		// The output may have been waiting for this client's credit
+		d.history.mu.Lock()
+		d.history.wake()
+		d.history.mu.Unlock()
+
+		if cc, ok := conn.(*countingConn); ok {
+			d.debugf("Client %d disconnected (%d bytes in, %d bytes out, %d output messages dropped)",
+				c.id, cc.in.Load(), cc.out.Load(), c.queue.dropped.Load())
+		}
 	}()
+	defer d.recoverPanic("client handler", nil)
+
+	d.mu.RLock()
+	c := d.clients[conn]
+	d.mu.RUnlock()
 
 	for {
+		if c != nil && c.idleTimeout > 0 {
+			// Renewed with every message, see handlePing
+			conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
 		msg, err := protocol.ReadMessage(conn)
 		if err != nil {
-			if !isNormalDisconnect(err) {
-				log.Printf("Read error from client: %v", err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				d.infof("Dropping %s, silent for %s", c, c.idleTimeout)
+			} else if !isNormalDisconnect(err) {
+				d.warnf("Read error from client: %v", err)
 			}
 			return
 		}
 
-		if err := d.handleMessage(conn, msg); err != nil {
-			log.Printf("Error handling message: %v", err)
-			protocol.WriteError(conn, err)
+		err = permitted(c, msg)
+		if err == nil {
+			err = d.handleMessage(conn, msg)
+		}
+		if err != nil {
+			if isNormalDisconnect(err) {
+				// The client left before reading the answer
+				return
+			}
+			d.errorf("Error handling message: %v", err)
+			var quotaErr *protocol.QuotaExceeded
+			if errors.As(err, &quotaErr) {
+				protocol.WriteQuotaExceeded(conn, quotaErr)
+			} else {
+				protocol.WriteError(conn, err)
+			}
 			if err == errShutdown {
 				return
 			}
@@ -129,11 +315,27 @@ func (d *Daemon) handleMessage(conn net.Conn, msg *protocol.Message) error {
 		return d.handleStatus(conn)
 
 	case protocol.MsgStdin:
+		if err := d.checkInput(conn); err != nil {
+			return err
+		}
+		if err := d.chargeStdin(conn, len(msg.Payload)); err != nil {
+			return err
+		}
+		d.recordClientEvent(conn, protocol.TimelineEvent{Type: protocol.TimelineInput, Data: string(msg.Payload)})
 		return d.handleStdin(msg.Payload)
 
 	case protocol.MsgSignal:
 		return d.handleSignal(conn, msg.Payload)
 
+	case protocol.MsgPause:
+		return d.handlePause(conn, true)
+
+	case protocol.MsgResume:
+		return d.handlePause(conn, false)
+
+	case protocol.MsgCheckpoint:
+		return d.handleCheckpoint(conn, msg.Payload)
+
 	case protocol.MsgResize:
 		return d.handleResize(conn, msg.Payload)
 
@@ -144,6 +346,9 @@ func (d *Daemon) handleMessage(conn net.Conn, msg *protocol.Message) error {
 		return d.handleDetach(conn)
 
 	case protocol.MsgCloseStdin:
+		if err := d.checkInput(conn); err != nil {
+			return err
+		}
 		return d.handleCloseStdin(conn)
 
 	case protocol.MsgWait:
@@ -155,9 +360,69 @@ func (d *Daemon) handleMessage(conn net.Conn, msg *protocol.Message) error {
 	case protocol.MsgExport:
 		return d.handleExport(conn, msg.Payload)
 
+	case protocol.MsgGetTitle:
+		return d.handleGetTitle(conn)
+
+	case protocol.MsgGetCommands:
+		return d.handleGetCommands(conn)
+
+	case protocol.MsgGetCommandOutput:
+		return d.handleGetCommandOutput(conn, msg.Payload)
+
+	case protocol.MsgRecord:
+		return d.handleRecord(conn, msg.Payload)
+
+	case protocol.MsgGetRecording:
+		return d.handleGetRecording(conn)
+
 	case protocol.MsgShutdown:
 		return d.handleShutdown(conn)
 
+	case protocol.MsgCapabilities:
+		return d.handleCapabilities(conn, msg.Payload)
+
+	case protocol.MsgReplay:
+		return d.handleReplay(conn, msg.Payload)
+
+	case protocol.MsgSearch:
+		return d.handleSearch(conn, msg.Payload)
+
+	case protocol.MsgSubscribeScreen:
+		return d.handleSubscribeScreen(conn, msg.Payload)
+
+	case protocol.MsgGetTimeline:
+		return d.handleGetTimeline(conn)
+
+	case protocol.MsgGetScreenCells:
+		return d.handleGetScreenCells(conn)
+
+	case protocol.MsgGetScrollback:
+		return d.handleGetScrollback(conn, msg.Payload)
+
+	case protocol.MsgHealth:
+		return d.handleHealth(conn)
+
+	case protocol.MsgPing:
+		return d.handlePing(conn, msg.Payload)
+
+	case protocol.MsgCredit:
+		return d.handleCredit(conn, msg.Payload)
+
+	case protocol.MsgSubscribe:
+		return d.handleSubscribe(conn, msg.Payload)
+
+	case protocol.MsgExpect:
+		return d.handleExpect(conn, msg.Payload)
+
+	case protocol.MsgStdinFile:
+		if err := d.checkInput(conn); err != nil {
+			return err
+		}
+		return d.handleStdinFile(conn, msg.Payload)
+
+	case protocol.MsgSetLogLevel:
+		return d.handleSetLogLevel(conn, msg.Payload)
+
 	default:
 		return fmt.Errorf("unknown message type: 0x%02X", msg.Type)
 	}
@@ -166,6 +431,8 @@ func (d *Daemon) handleMessage(conn net.Conn, msg *protocol.Message) error {
 // handleStatus sends the current process status
 func (d *Daemon) handleStatus(conn net.Conn) error {
 	status := d.GetStatus()
+	status.Foreground = d.foregroundProcess()
+	status.Clients = d.clientStats()
 	return protocol.WriteStatusResponse(conn, status)
 }
 
@@ -177,11 +444,12 @@ func (d *Daemon) handleStdin(data []byte) error {
 	}
 
 	// Standard mode
-	if d.stdinPipe == nil {
+	stdin := d.stdin()
+	if stdin == nil {
 		return fmt.Errorf("stdin is not available for streaming")
 	}
 
-	if _, err := d.stdinPipe.Write(data); err != nil {
+	if _, err := stdin.Write(data); err != nil {
 		return fmt.Errorf("failed to write to stdin: %w", err)
 	}
 
@@ -195,6 +463,26 @@ func (d *Daemon) handleSignal(conn net.Conn, payload []byte) error {
 	}
 
 	sigNum := syscall.Signal(payload[0])
+	if err := d.Signal(sigNum); err != nil {
+		return err
+	}
+	d.recordClientEvent(conn, protocol.TimelineEvent{Type: protocol.TimelineSignal, Signal: int(sigNum)})
+
+	// Send acknowledgment
+	return protocol.WriteMessage(conn, protocol.MsgSignalResponse, nil)
+}
+
+// pauseSettleTimeout bounds how long PAUSE and RESUME wait for the process
+// to reach the new state before answering
+const pauseSettleTimeout = time.Second
+
+// handlePause stops the process group with SIGSTOP, or continues it with
+// SIGCONT
+func (d *Daemon) handlePause(conn net.Conn, pause bool) error {
+	sig := syscall.SIGCONT
+	if pause {
+		sig = syscall.SIGSTOP
+	}
 
 	d.mu.RLock()
 	pid := d.pid
@@ -205,13 +493,42 @@ func (d *Daemon) handleSignal(conn net.Conn, payload []byte) error {
 		return fmt.Errorf("process is not running")
 	}
 
-	// Send signal to the process
-	if err := syscall.Kill(pid, sigNum); err != nil {
+	if err := syscall.Kill(-d.processGroup(pid), sig); err != nil {
 		return fmt.Errorf("failed to send signal: %w", err)
 	}
+	d.recordClientEvent(conn, protocol.TimelineEvent{Type: protocol.TimelineSignal, Signal: int(sig)})
+	d.setPaused(pause)
 
-	// Send acknowledgment
-	return protocol.WriteMessage(conn, protocol.MsgSignalResponse, nil)
+	// Signals are delivered asynchronously: answer once the status agrees
+	for deadline := time.Now().Add(pauseSettleTimeout); time.Now().Before(deadline); {
+		if stopped, ok := processStopped(pid); !ok || stopped == pause {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return protocol.WriteMessage(conn, protocol.MsgPauseResponse, nil)
+}
+
+// setPaused records whether the process group is stopped, emitting an event
+// when that changes
+func (d *Daemon) setPaused(paused bool) {
+	d.mu.Lock()
+	changed := d.running && d.paused != paused
+	if changed {
+		d.paused = paused
+	}
+	d.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	d.updateStatus()
+	if paused {
+		d.emitEvent(protocol.Event{Type: protocol.EventPaused})
+	} else {
+		d.emitEvent(protocol.Event{Type: protocol.EventResumed})
+	}
 }
 
 // handleResize resizes the VTY
@@ -228,57 +545,150 @@ func (d *Daemon) handleResize(conn net.Conn, payload []byte) error {
 	cols := binary.BigEndian.Uint16(payload[2:4])
 
 	// Validate terminal size
-	if rows == 0 || cols == 0 || rows > 500 || cols > 500 {
+	if !validSize(rows, cols) {
 		return fmt.Errorf("invalid terminal size: %dx%d", rows, cols)
 	}
 
-	// Resize the PTY
-	if err := d.resizeVTY(rows, cols); err != nil {
-		return err
+	d.mu.RLock()
+	c := d.clients[conn]
+	d.mu.RUnlock()
+	var by uint64
+	if c != nil {
+		by = c.id
+	}
+
+	// Resize the PTY to the size the policy gives
+	if rows, cols, ok := d.terminalSize(c, rows, cols); ok {
+		if err := d.resizeVTY(rows, cols, by); err != nil {
+			return err
+		}
 	}
 
+	d.mu.Lock()
+	if c != nil {
+		c.hasTerminal = true
+	}
+	d.mu.Unlock()
+
 	// Send acknowledgment
 	return protocol.WriteMessage(conn, protocol.MsgResizeResponse, nil)
 }
 
 // handleAttach attaches the client to output streams
 func (d *Daemon) handleAttach(conn net.Conn, payload []byte) error {
-	if len(payload) != 1 {
-		return fmt.Errorf("invalid attach payload length")
+	req, err := protocol.ParseAttach(payload)
+	if err != nil {
+		return err
 	}
-
-	streams := payload[0]
-	if streams == 0 || streams > protocol.StreamBoth {
-		return fmt.Errorf("invalid stream selector: 0x%02X", streams)
+	if req.Streams == 0 || req.Streams > protocol.StreamBoth {
+		return fmt.Errorf("invalid stream selector: 0x%02X", req.Streams)
+	}
+	if req.Flow > protocol.FlowBlock {
+		return fmt.Errorf("invalid flow control policy: 0x%02X", req.Flow)
 	}
 
+	// No output is broadcast until the client is attached and has the
+	// history queued, see outputHistory
+	d.history.mu.Lock()
+	// Only the last outputHistorySize bytes of output are held, offset 0
+	// standing for all of them
+	if earliest := d.history.earliest(); req.Resume && req.Offset != 0 && req.Offset < earliest {
+		d.history.mu.Unlock()
+		return fmt.Errorf("output from offset %d is no longer held, the earliest available is %d", req.Offset, earliest)
+	}
 	d.mu.Lock()
-	if client, ok := d.clients[conn]; ok {
-		client.attached = true
-		client.streams = streams
+	c, ok := d.clients[conn]
+	if ok {
+		c.attached = true
+		c.streams = req.Streams
+		c.outputAt.Store(req.Resume)
+		c.flow, c.credit, c.paused = req.Flow, int64(req.Window), false
+		c.notify = req.Notify
+	}
+	var detached []*client
+	if ok && req.Exclusive {
+		detached = d.takeOver(c)
+	}
+	var exitCode *int
+	if !d.running && d.exitCode != nil {
+		exitCode = d.exitCode
 	}
 	d.mu.Unlock()
+	replayed := 0
+	if ok && req.Resume {
+		replayed = d.catchUp(c, req.Offset)
+	}
+	d.history.wake()
+	d.history.mu.Unlock()
+
+	switch {
+	case req.Flow != protocol.FlowNone:
+		d.debugf("Client attached to streams: 0x%02X, from offset %d, flow control 0x%02X with %d bytes of credit", req.Streams, req.Offset, req.Flow, req.Window)
+	case req.Resume:
+		d.debugf("Client attached to streams: 0x%02X, from offset %d", req.Streams, req.Offset)
+	default:
+		d.debugf("Client attached to streams: 0x%02X", req.Streams)
+	}
+	if ok {
+		d.emitEvent(protocol.Event{Type: protocol.EventAttached, Client: c.id})
+	}
+	if req.Exclusive && ok {
+		d.notifyDetached(c, detached)
+	}
+	d.refitTerminal()
 
-	log.Printf("Client attached to streams: 0x%02X", streams)
+	// The process may have exited before this client connected, in which
+	// case it missed the broadcast; notify it directly, after the output
+	if ok && exitCode != nil {
+		if replayed > 0 {
+			c.flush(exitFlushTimeout)
+		}
+		c.writeMu.Lock()
+		err := protocol.WriteProcessExit(conn, *exitCode)
+		c.writeMu.Unlock()
+		return err
+	}
 
 	return nil
 }
 
 // handleDetach detaches the client from output streams
 func (d *Daemon) handleDetach(conn net.Conn) error {
+	d.history.mu.Lock()
 	d.mu.Lock()
-	if client, ok := d.clients[conn]; ok {
+	client, ok := d.clients[conn]
+	wasAttached := ok && client.attached
+	if ok {
 		client.attached = false
+		d.releaseExclusive(client)
 	}
 	d.mu.Unlock()
+	d.history.wake()
+	d.history.mu.Unlock()
 
-	log.Printf("Client detached from streams")
+	d.debugf("Client detached from streams")
+	if wasAttached {
+		d.emitEvent(protocol.Event{Type: protocol.EventDetached, Client: client.id})
+		d.refitTerminal()
+	}
 
 	return nil
 }
 
 // handleCloseStdin closes the stdin pipe
 func (d *Daemon) handleCloseStdin(conn net.Conn) error {
+	if err := d.closeStdin(); err != nil {
+		return err
+	}
+
+	d.debugf("Stdin closed by client")
+
+	// Send acknowledgment
+	return protocol.WriteMessage(conn, protocol.MsgStatusResponse, []byte(`{"status":"stdin closed"}`))
+}
+
+// closeStdin closes the stdin pipe, the process reading end of file
+func (d *Daemon) closeStdin() error {
 	d.mu.Lock()
 	if d.stdinPipe == nil || d.stdinClosed {
 		d.mu.Unlock()
@@ -291,44 +701,94 @@ func (d *Daemon) handleCloseStdin(conn net.Conn) error {
 	if err := pipe.Close(); err != nil {
 		return fmt.Errorf("failed to close stdin: %w", err)
 	}
-
-	log.Printf("Stdin closed by client")
-
-	// Send acknowledgment
-	return protocol.WriteMessage(conn, protocol.MsgStatusResponse, []byte(`{"status":"stdin closed"}`))
+	return nil
 }
 
 // handleWait waits for a condition with timeout
 func (d *Daemon) handleWait(conn net.Conn, payload []byte) error {
-	timeoutSecs, waitType, err := protocol.ParseWait(payload)
+	req, err := protocol.ParseWaitRequest(payload)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Wait request: timeout=%ds, type=%d", timeoutSecs, waitType)
+	timeout, stop := waitTimeout(req)
+	defer stop()
+
+	var status byte
+	quiet := time.Duration(req.QuietMillis) * time.Millisecond
+	switch req.Type {
+	case protocol.WaitTypePattern:
+		re, err := regexp.Compile(req.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		d.debugf("Wait request: %s, pattern %q", describeWaitTimeout(req), req.Pattern)
+		status = d.waitForPattern(timeout, re)
+	case protocol.WaitTypeOutputIdle:
+		d.debugf("Wait request: %s, output idle for %v", describeWaitTimeout(req), quiet)
+		status = d.waitForQuiet(timeout, quiet, d.lastOutputTime)
+	case protocol.WaitTypeScreenStable:
+		d.debugf("Wait request: %s, screen stable for %v", describeWaitTimeout(req), quiet)
+		term := d.terminal()
+		if term == nil {
+			status = protocol.WaitStatusNotApplicable
+			break
+		}
+		w := &screenWatcher{term: term}
+		status = d.waitForQuiet(timeout, quiet, w.lastChange)
+	default:
+		d.debugf("Wait request: %s, type=%d", describeWaitTimeout(req), req.Type)
 
-	// Execute the wait (this may block)
-	status := d.waitForCondition(timeoutSecs, waitType)
+		// Execute the wait (this may block)
+		status = d.waitForCondition(timeout, req.Type)
+	}
 
-	log.Printf("Wait completed with status: %d", status)
+	d.debugf("Wait completed with status: %d", status)
 
 	// Send response
 	return protocol.WriteWaitResponse(conn, status)
 }
 
-// handleGetScreen returns the current terminal screen state
-func (d *Daemon) handleGetScreen(conn net.Conn) error {
-	if !d.config.UseVTY {
-		return fmt.Errorf("VTY is not enabled")
+// waitTimeout returns a channel receiving when the wait asked for by req
+// times out, at its deadline or after its timeout, and the function stopping
+// its timer. Without either the channel is nil, waiting forever.
+func waitTimeout(req *protocol.WaitRequest) (<-chan time.Time, func() bool) {
+	var timeout time.Duration
+	switch {
+	case !req.Deadline.IsZero():
+		timeout = time.Until(req.Deadline)
+	case req.TimeoutSecs > 0:
+		timeout = time.Duration(req.TimeoutSecs) * time.Second
+	default:
+		return nil, func() bool { return false }
 	}
+	t := time.NewTimer(timeout)
+	return t.C, t.Stop
+}
 
-	if d.vtyTermemu == nil {
-		return fmt.Errorf("terminal emulator is not available")
+// describeWaitTimeout describes when the wait asked for by req times out,
+// for the log
+func describeWaitTimeout(req *protocol.WaitRequest) string {
+	switch {
+	case !req.Deadline.IsZero():
+		return "deadline=" + req.Deadline.Format(time.RFC3339)
+	case req.TimeoutSecs > 0:
+		return fmt.Sprintf("timeout=%ds", req.TimeoutSecs)
+	default:
+		return "no timeout"
+	}
+}
+
+// handleGetScreen returns the current terminal screen state
+func (d *Daemon) handleGetScreen(conn net.Conn) error {
+	term, err := d.screenTerminal()
+	if err != nil {
+		return err
 	}
 
 	// Get the screen buffer
-	screen := d.vtyTermemu.GetScreen()
-	cursorRow, cursorCol := d.vtyTermemu.GetCursor()
+	screen := term.GetScreen()
+	cursorRow, cursorCol := term.GetCursor()
 
 	// Check for empty screen
 	if len(screen) == 0 {
@@ -337,6 +797,7 @@ func (d *Daemon) handleGetScreen(conn net.Conn) error {
 
 	// Convert screen to string lines
 	lines := make([]string, len(screen))
+	size := 0
 	for i, row := range screen {
 		line := make([]rune, len(row))
 		for j, cell := range row {
@@ -347,20 +808,53 @@ func (d *Daemon) handleGetScreen(conn net.Conn) error {
 			}
 		}
 		lines[i] = string(line)
+		size += len(lines[i])
+	}
+
+	if err := d.chargeExport(conn, size); err != nil {
+		return err
 	}
 
 	// Create response
 	response := &protocol.ScreenResponse{
-		Rows:      len(screen),
-		Cols:      len(screen[0]),
-		CursorRow: cursorRow,
-		CursorCol: cursorCol,
-		Lines:     lines,
+		Rows:       len(screen),
+		Cols:       len(screen[0]),
+		CursorRow:  cursorRow,
+		CursorCol:  cursorCol,
+		Lines:      lines,
+		InputModes: inputModes(term),
 	}
 
 	return protocol.WriteScreenResponse(conn, response)
 }
 
+// inputModes returns the input modes set by the program
+func inputModes(term *termemu.Terminal) protocol.InputModes {
+	modes := term.InputModes()
+	return protocol.InputModes{
+		BracketedPaste:    modes.BracketedPaste,
+		ApplicationCursor: modes.ApplicationCursor,
+		ApplicationKeypad: modes.ApplicationKeypad,
+	}
+}
+
+// handleGetTitle returns the window title and icon name set by the program
+func (d *Daemon) handleGetTitle(conn net.Conn) error {
+	if !d.config.UseVTY {
+		return fmt.Errorf("VTY is not enabled")
+	}
+
+	term := d.terminal()
+	if term == nil {
+		return fmt.Errorf("terminal emulator is not available")
+	}
+
+	return protocol.WriteTitleResponse(conn, &protocol.TitleResponse{
+		Title:    term.Title(),
+		IconName: term.IconName(),
+	})
+}
+
 // handleExport exports terminal content in the specified format
 func (d *Daemon) handleExport(conn net.Conn, payload []byte) error {
 	// Parse export request
@@ -369,29 +863,18 @@ func (d *Daemon) handleExport(conn net.Conn, payload []byte) error {
 		return fmt.Errorf("failed to parse export request: %w", err)
 	}
 
-	if !d.config.UseVTY {
-		return fmt.Errorf("VTY is not enabled")
-	}
-
-	if d.vtyTermemu == nil {
-		return fmt.Errorf("terminal emulator is not available")
+	term, err := d.screenTerminal()
+	if err != nil {
+		return err
 	}
 
-	// Convert protocol format to termemu format
-	var format termemu.ExportFormat
-	switch req.Format {
-	case protocol.ExportFormatPlainText:
-		format = termemu.FormatPlainText
-	case protocol.ExportFormatMarkdown:
-		format = termemu.FormatMarkdown
-	case protocol.ExportFormatHTML:
-		format = termemu.FormatHTML
-	default:
-		return fmt.Errorf("unsupported export format: %d", req.Format)
+	format, err := exportFormat(req.Format)
+	if err != nil {
+		return err
 	}
 
 	// Export terminal content
-	content := d.vtyTermemu.Export(termemu.ExportOptions{
+	content := term.Export(termemu.ExportOptions{
 		Format:                 format,
 		IncludeScrollback:      req.IncludeScrollback,
 		StartLine:              req.StartLine,
@@ -399,18 +882,211 @@ func (d *Daemon) handleExport(conn net.Conn, payload []byte) error {
 		PreserveTrailingSpaces: req.PreserveTrailingSpaces,
 	})
 
+	if err := d.chargeExport(conn, len(content)); err != nil {
+		return err
+	}
+
 	// Create and send response
 	response := &protocol.ExportResponse{
 		Content: content,
 		Format:  req.Format,
 	}
 
-	return protocol.WriteExportResponse(conn, response)
+	return protocol.WriteExportResponse(d.writerFor(conn), response)
+}
+
+// exportFormat converts a protocol export format to the termemu format
+func exportFormat(format protocol.ExportFormat) (termemu.ExportFormat, error) {
+	switch format {
+	case protocol.ExportFormatPlainText:
+		return termemu.FormatPlainText, nil
+	case protocol.ExportFormatMarkdown:
+		return termemu.FormatMarkdown, nil
+	case protocol.ExportFormatHTML:
+		return termemu.FormatHTML, nil
+	case protocol.ExportFormatANSI:
+		return termemu.FormatANSI, nil
+	}
+	return 0, fmt.Errorf("unsupported export format: %d", format)
+}
+
+// handleGetCommands lists the commands delimited by shell integration marks
+func (d *Daemon) handleGetCommands(conn net.Conn) error {
+	if !d.config.UseVTY {
+		return fmt.Errorf("VTY is not enabled")
+	}
+
+	term := d.terminal()
+	if term == nil {
+		return fmt.Errorf("terminal emulator is not available")
+	}
+
+	commands := term.Commands()
+	response := &protocol.CommandsResponse{
+		Commands: make([]protocol.CommandInfo, 0, len(commands)),
+	}
+	for i, cmd := range commands {
+		info := protocol.CommandInfo{
+			Index:     i,
+			Command:   cmd.Command,
+			ExitCode:  cmd.ExitCode,
+			StartedAt: cmd.StartedAt.Format(time.RFC3339),
+		}
+		if !cmd.Running() {
+			finished := cmd.FinishedAt.Format(time.RFC3339)
+			info.FinishedAt = &finished
+		}
+		response.Commands = append(response.Commands, info)
+	}
+
+	return protocol.WriteCommandsResponse(conn, response)
+}
+
+// handleGetCommandOutput exports the output of a single command
+func (d *Daemon) handleGetCommandOutput(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseCommandOutputRequest(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse command output request: %w", err)
+	}
+
+	if !d.config.UseVTY {
+		return fmt.Errorf("VTY is not enabled")
+	}
+
+	term := d.terminal()
+	if term == nil {
+		return fmt.Errorf("terminal emulator is not available")
+	}
+
+	if err := d.checkStrictVTY(); err != nil {
+		return err
+	}
+
+	format, err := exportFormat(req.Format)
+	if err != nil {
+		return err
+	}
+
+	content, err := term.ExportCommand(req.Index, format)
+	if err != nil {
+		return fmt.Errorf("command %d: %w", req.Index, err)
+	}
+
+	if err := d.chargeExport(conn, len(content)); err != nil {
+		return err
+	}
+
+	return protocol.WriteExportResponse(d.writerFor(conn), &protocol.ExportResponse{
+		Content: content,
+		Format:  req.Format,
+	})
+}
+
+// handleSearch finds the matches of a regular expression in the screen and
+// scrollback
+func (d *Daemon) handleSearch(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseSearchRequest(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse search request: %w", err)
+	}
+
+	if !d.config.UseVTY {
+		return fmt.Errorf("VTY is not enabled")
+	}
+
+	term := d.terminal()
+	if term == nil {
+		return fmt.Errorf("terminal emulator is not available")
+	}
+
+	if err := d.checkStrictVTY(); err != nil {
+		return err
+	}
+
+	matches, err := term.Search(req.Pattern, termemu.SearchOptions{
+		IncludeScrollback: req.IncludeScrollback,
+		IgnoreCase:        req.IgnoreCase,
+		MaxMatches:        req.MaxMatches,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	resp := &protocol.SearchResponse{Matches: make([]protocol.SearchMatch, len(matches))}
+	size := 0
+	for i, m := range matches {
+		resp.Matches[i] = protocol.SearchMatch{Row: m.Row, Col: m.Col, EndCol: m.EndCol, Text: m.Text}
+		size += len(m.Text)
+	}
+
+	// Matched text is terminal content like an export
+	if err := d.chargeExport(conn, size); err != nil {
+		return err
+	}
+
+	return protocol.WriteSearchResponse(conn, resp)
+}
+
+// handleRecord starts or stops recording the session
+func (d *Daemon) handleRecord(conn net.Conn, payload []byte) error {
+	if len(payload) != 1 {
+		return fmt.Errorf("invalid record payload length")
+	}
+
+	switch payload[0] {
+	case protocol.RecordStart:
+		if err := d.startRecording(); err != nil {
+			return err
+		}
+	case protocol.RecordStop:
+		if err := d.stopRecording(); err != nil {
+			return fmt.Errorf("failed to close recording: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown record action: 0x%02X", payload[0])
+	}
+	d.updateStatus()
+
+	return protocol.WriteRecordResponse(conn, d.isRecording())
+}
+
+// handleGetRecording sends the asciinema recording of the session
+func (d *Daemon) handleGetRecording(conn net.Conn) error {
+	data, err := d.storage.ReadFile(RecordingFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("session has not been recorded")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	if err := d.chargeExport(conn, len(data)); err != nil {
+		return err
+	}
+
+	return protocol.WriteMessage(d.writerFor(conn), protocol.MsgRecording, data)
+}
+
+// handleGetTimeline sends the timeline of the recorded session
+func (d *Daemon) handleGetTimeline(conn net.Conn) error {
+	data, err := d.storage.ReadFile(TimelineFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("session has not been recorded")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read timeline: %w", err)
+	}
+
+	if err := d.chargeExport(conn, len(data)); err != nil {
+		return err
+	}
+
+	return protocol.WriteMessage(conn, protocol.MsgTimeline, data)
 }
 
 // handleShutdown shuts down the daemon
 func (d *Daemon) handleShutdown(conn net.Conn) error {
-	log.Printf("Shutdown requested by client")
+	d.infof("Shutdown requested by client")
 
 	// Send acknowledgment before shutting down
 	protocol.WriteMessage(conn, protocol.MsgStatusResponse, []byte(`{"status":"shutting down"}`))
@@ -421,32 +1097,66 @@ func (d *Daemon) handleShutdown(conn net.Conn) error {
 	return errShutdown
 }
 
+// handlePing answers a ping. An idle timeout in the ping makes the client
+// expect to hear from the daemon regularly, and the daemon in turn drops
+// the connection once the client stays silent for that long.
+func (d *Daemon) handlePing(conn net.Conn, payload []byte) error {
+	timeout, err := protocol.ParsePing(payload)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if c, ok := d.clients[conn]; ok {
+		c.idleTimeout = timeout
+	}
+	d.mu.Unlock()
+	if timeout == 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	return protocol.WriteMessage(conn, protocol.MsgPong, nil)
+}
+
 // handleStdout reads stdout and broadcasts to attached clients
 func (d *Daemon) handleStdout() {
+	defer d.outputWg.Done()
+
 	if d.stdoutPipe == nil {
 		return
 	}
 
 	defer d.stdoutPipe.Close()
+	defer d.recoverPanic("stdout reader", d.abort)
+	if f := d.forward[protocol.StreamStdout-1]; f != nil {
+		defer f.finish(d)
+	}
+	defer d.closeTee(protocol.StreamStdout)
+
+	d.health.readerStarted()
+	defer d.health.readerStopped()
 
-	buf := make([]byte, 4096)
+	reader := d.newChunkReader(d.stdoutPipe)
 	for {
-		n, err := d.stdoutPipe.Read(buf)
+		chunk := getOutputChunk(protocol.StreamStdout)
+		n, err := reader.read(chunk)
 		if n > 0 {
-			data := buf[:n]
+			chunk.data = chunk.buf[:n]
+			d.health.busy(protocol.StreamStdout)
 
 			// Write to log file
-			if d.logFile != nil {
-				d.logFile.Write(data)
-			}
+			d.logOutput(protocol.StreamStdout, chunk.data)
 
 			// Broadcast to attached clients
-			d.broadcastOutput(protocol.StreamStdout, data)
+			d.broadcastOutput(chunk)
+			d.health.idle(protocol.StreamStdout)
+			d.throttleOutput(n)
 		}
+		chunk.release()
 
 		if err != nil {
 			if err != io.EOF && !strings.Contains(err.Error(), "file already closed") {
-				log.Printf("Error reading stdout: %v", err)
+				d.errorf("Error reading stdout: %v", err)
 			}
 			return
 		}
@@ -455,30 +1165,43 @@ func (d *Daemon) handleStdout() {
 
 // handleStderr reads stderr and broadcasts to attached clients
 func (d *Daemon) handleStderr() {
+	defer d.outputWg.Done()
+
 	if d.stderrPipe == nil {
 		return
 	}
 
 	defer d.stderrPipe.Close()
+	defer d.recoverPanic("stderr reader", d.abort)
+	if f := d.forward[protocol.StreamStderr-1]; f != nil {
+		defer f.finish(d)
+	}
+	defer d.closeTee(protocol.StreamStderr)
+
+	d.health.readerStarted()
+	defer d.health.readerStopped()
 
-	buf := make([]byte, 4096)
+	reader := d.newChunkReader(d.stderrPipe)
 	for {
-		n, err := d.stderrPipe.Read(buf)
+		chunk := getOutputChunk(protocol.StreamStderr)
+		n, err := reader.read(chunk)
 		if n > 0 {
-			data := buf[:n]
+			chunk.data = chunk.buf[:n]
+			d.health.busy(protocol.StreamStderr)
 
 			// Write to log file
-			if d.logFile != nil {
-				d.logFile.Write(data)
-			}
+			d.logOutput(protocol.StreamStderr, chunk.data)
 
 			// Broadcast to attached clients
-			d.broadcastOutput(protocol.StreamStderr, data)
+			d.broadcastOutput(chunk)
+			d.health.idle(protocol.StreamStderr)
+			d.throttleOutput(n)
 		}
+		chunk.release()
 
 		if err != nil {
 			if err != io.EOF && !strings.Contains(err.Error(), "file already closed") {
-				log.Printf("Error reading stderr: %v", err)
+				d.errorf("Error reading stderr: %v", err)
 			}
 			return
 		}
@@ -486,34 +1209,37 @@ func (d *Daemon) handleStderr() {
 }
 
 // broadcastOutput sends output to all attached clients
-func (d *Daemon) broadcastOutput(stream byte, data []byte) {
+func (d *Daemon) broadcastOutput(chunk *outputChunk) {
+	d.history.mu.Lock()
+	defer d.history.mu.Unlock()
+
+	// A FlowBlock client without credit holds the output back, and the
+	// program blocks once the pipe or PTY buffer is full
+	if d.creditBlocked(chunk.stream) {
+		d.health.idle(chunk.stream)
+		for d.creditBlocked(chunk.stream) {
+			d.history.wait()
+		}
+		d.health.busy(chunk.stream)
+	}
+	d.history.add(chunk)
+	d.lastOutput.Store(time.Now().UnixNano())
+	d.expectOutput(chunk)
+	d.healthOutput(chunk)
+
+	// Attachment changes under d.mu, so select the recipients while holding it
 	d.mu.RLock()
 	clients := make([]*client, 0, len(d.clients))
 	for _, client := range d.clients {
-		clients = append(clients, client)
+		if client.attached && client.streams&chunk.stream != 0 {
+			clients = append(clients, client)
+		}
 	}
 	d.mu.RUnlock()
 
 	for _, client := range clients {
-		if !client.attached {
-			continue
-		}
-
-		// Check if client wants this stream
-		wantStream := false
-		if stream == protocol.StreamStdout && (client.streams&protocol.StreamStdout) != 0 {
-			wantStream = true
-		}
-		if stream == protocol.StreamStderr && (client.streams&protocol.StreamStderr) != 0 {
-			wantStream = true
-		}
-
-		if wantStream {
-			client.writeMu.Lock()
-			if err := protocol.WriteOutput(client.conn, stream, data); err != nil {
-				log.Printf("Error writing output to client: %v", err)
-			}
-			client.writeMu.Unlock()
+		if client.takeCredit(chunk) {
+			d.enqueueOutput(client, chunk)
 		}
 	}
 }
@@ -0,0 +1,245 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/storage"
+)
+
+// SignatureFileName is the name of the file holding the signed digests of
+// the final artifacts
+const SignatureFileName = "signature.json"
+
+// signaturePayloadVersion prefixes the signed payload so that it can never
+// be mistaken for another kind of signed message
+const signaturePayloadVersion = "bgrun-signature-v1"
+
+// signedArtifacts are the artifacts covered by the signature, when present
+var signedArtifacts = []string{StatusFileName, LogFileName}
+
+// Signature is the signed SHA-256 digest manifest of a run's final artifacts
+type Signature struct {
+	Algorithm string            `json:"algorithm"`
+	Digests   map[string]string `json:"digests"` // artifact name -> hex SHA-256
+	SignedAt  string            `json:"signed_at"`
+	Signature []byte            `json:"signature"`
+}
+
+// payload returns the bytes covered by the signature
+func (s *Signature) payload() []byte {
+	names := make([]string, 0, len(s.Digests))
+	for name := range s.Digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n%s\n%s\n", signaturePayloadVersion, s.Algorithm, s.SignedAt)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", s.Digests[name], name)
+	}
+	return buf.Bytes()
+}
+
+// LoadSigningKey reads a PEM encoded private key (PKCS#8, SEC 1 EC or
+// PKCS#1 RSA). ECDSA P-256/P-384 and RSA keys keep the signature within
+// FIPS 186 approved algorithms; Ed25519 is accepted as well.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key any
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported signing key type %T", key)
+		}
+		return signer, nil
+	}
+
+	return nil, fmt.Errorf("no private key found in %s", path)
+}
+
+// LoadVerifyKey reads a PEM encoded public key, certificate or private key
+// and returns the public key to verify signatures with
+func LoadVerifyKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate: %w", err)
+			}
+			return cert.PublicKey, nil
+		case "PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY":
+			signer, err := LoadSigningKey(path)
+			if err != nil {
+				return nil, err
+			}
+			return signer.Public(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no public key found in %s", path)
+}
+
+// signatureAlgorithm names the algorithm used by key
+func signatureAlgorithm(key crypto.PublicKey) (string, error) {
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		return "ecdsa-sha256", nil
+	case *rsa.PublicKey:
+		return "rsa-pkcs1v15-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// artifactDigests hashes the artifacts that exist in s
+func artifactDigests(s storage.Storage, names []string) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, name := range names {
+		data, err := s.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		sum := sha256.Sum256(data)
+		digests[name] = hex.EncodeToString(sum[:])
+	}
+	return digests, nil
+}
+
+// signArtifacts writes the signed digests of status.json and output.log
+func (d *Daemon) signArtifacts() error {
+	algorithm, err := signatureAlgorithm(d.signer.Public())
+	if err != nil {
+		return err
+	}
+
+	digests, err := artifactDigests(d.storage, signedArtifacts)
+	if err != nil {
+		return err
+	}
+
+	sig := &Signature{
+		Algorithm: algorithm,
+		Digests:   digests,
+		SignedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	payload := sig.payload()
+	if algorithm == "ed25519" {
+		sig.Signature, err = d.signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		sum := sha256.Sum256(payload)
+		sig.Signature, err = d.signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sign artifacts: %w", err)
+	}
+
+	data, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return err
+	}
+	return d.storage.WriteFile(SignatureFileName, append(data, '\n'))
+}
+
+// VerifyArtifacts checks the signature written at exit against the current
+// content of the artifacts in s and returns it when valid
+func VerifyArtifacts(s storage.Storage, key crypto.PublicKey) (*Signature, error) {
+	data, err := s.ReadFile(SignatureFileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	var sig Signature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		return nil, fmt.Errorf("failed to parse signature: %w", err)
+	}
+
+	algorithm, err := signatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Algorithm != algorithm {
+		return nil, fmt.Errorf("signature algorithm %q does not match key (%s)", sig.Algorithm, algorithm)
+	}
+
+	payload := sig.payload()
+	sum := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, sum[:], sig.Signature) {
+			err = errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig.Signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, sig.Signature) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	// The manifest is authentic, now check the artifacts still match it
+	names := make([]string, 0, len(sig.Digests))
+	for name := range sig.Digests {
+		names = append(names, name)
+	}
+	digests, err := artifactDigests(s, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if digests[name] != sig.Digests[name] {
+			return nil, fmt.Errorf("%s has been modified since it was signed", name)
+		}
+	}
+
+	return &sig, nil
+}
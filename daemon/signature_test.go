@@ -0,0 +1,183 @@
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KarpelesLab/bgrun/storage"
+)
+
+// writeKey stores key as a PKCS#8 PEM file and returns its path
+func writeKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "sign.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func runSigned(t *testing.T, keyFile string) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	config := &Config{
+		Command:        []string{"echo", "build artifact"},
+		StdinMode:      StdinNull,
+		StdoutMode:     IOModeLog,
+		StderrMode:     IOModeLog,
+		RuntimeDir:     tmpDir,
+		SigningKeyFile: keyFile,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	d.Wait()
+	if err := d.WriteStatus(); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+	return tmpDir
+}
+
+func TestSignArtifacts(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	keyFile := writeKey(t, key)
+	tmpDir := runSigned(t, keyFile)
+
+	pub, err := LoadVerifyKey(keyFile)
+	if err != nil {
+		t.Fatalf("LoadVerifyKey failed: %v", err)
+	}
+
+	sig, err := VerifyArtifacts(storage.Dir(tmpDir), pub)
+	if err != nil {
+		t.Fatalf("VerifyArtifacts failed: %v", err)
+	}
+	if sig.Algorithm != "ecdsa-sha256" {
+		t.Errorf("Expected ecdsa-sha256, got %s", sig.Algorithm)
+	}
+	if len(sig.Digests) != 2 {
+		t.Errorf("Expected digests of status.json and output.log, got %v", sig.Digests)
+	}
+
+	// Tampering with the output is detected
+	logPath := filepath.Join(tmpDir, LogFileName)
+	if err := os.WriteFile(logPath, []byte("forged\n"), 0600); err != nil {
+		t.Fatalf("Failed to tamper with log: %v", err)
+	}
+	if _, err := VerifyArtifacts(storage.Dir(tmpDir), pub); err == nil {
+		t.Error("Expected verification to fail after tampering")
+	}
+
+	// So is a signature made with another key
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := VerifyArtifacts(storage.Dir(tmpDir), &other.PublicKey); err == nil {
+		t.Error("Expected verification with another key to fail")
+	}
+}
+
+func TestSignArtifactsEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpDir := runSigned(t, writeKey(t, priv))
+
+	if _, err := VerifyArtifacts(storage.Dir(tmpDir), pub); err != nil {
+		t.Errorf("VerifyArtifacts failed: %v", err)
+	}
+}
+
+func TestUnsignedRun(t *testing.T) {
+	tmpDir := runSigned(t, "")
+
+	if _, err := os.Stat(filepath.Join(tmpDir, SignatureFileName)); !os.IsNotExist(err) {
+		t.Error("Expected no signature without a signing key")
+	}
+}
+
+func TestInvalidSigningKey(t *testing.T) {
+	config := &Config{
+		Command:        []string{"true"},
+		RuntimeDir:     t.TempDir(),
+		SigningKeyFile: filepath.Join(t.TempDir(), "missing.pem"),
+	}
+	if _, err := New(config); err == nil {
+		t.Error("Expected error for missing signing key")
+	}
+}
+
+func TestSignStartFailure(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyFile := writeKey(t, key)
+	tmpDir := t.TempDir()
+
+	d, err := New(&Config{
+		Command:        []string{filepath.Join(tmpDir, "missing")},
+		StdinMode:      StdinNull,
+		StdoutMode:     IOModeLog,
+		StderrMode:     IOModeLog,
+		RuntimeDir:     tmpDir,
+		SigningKeyFile: keyFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err == nil {
+		t.Fatal("Expected the start to fail")
+	}
+	defer d.stop()
+
+	if _, err := VerifyArtifacts(storage.Dir(tmpDir), &key.PublicKey); err != nil {
+		t.Errorf("Expected the status of a failed start signed, got %v", err)
+	}
+}
+
+func TestSignedRunRetried(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyFile := writeKey(t, key)
+	previousDir := runSigned(t, keyFile)
+
+	d, err := New(&Config{
+		Command:     []string{"true"},
+		StdinMode:   StdinNull,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		RuntimeDir:  t.TempDir(),
+		PreviousRun: previousDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	// Linking the retry leaves the signed artifacts as they were
+	if _, err := VerifyArtifacts(storage.Dir(previousDir), &key.PublicKey); err != nil {
+		t.Errorf("Expected the retried run to verify, got %v", err)
+	}
+}
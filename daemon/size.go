@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SizePolicy decides the size of the terminal when several clients resize
+// it (VTY only)
+type SizePolicy string
+
+const (
+	SizeLatest   SizePolicy = "latest"   // the last resize applies (default)
+	SizeSmallest SizePolicy = "smallest" // the smallest rows and columns of the attached clients, as tmux
+	SizeFixed    SizePolicy = "fixed"    // Config.FixedRows x FixedCols, resizes being ignored
+)
+
+// maxTerminalSize bounds the rows and columns of the terminal
+const maxTerminalSize = 500
+
+// ParseSizePolicy parses a size policy as given on the command line:
+// latest, smallest or a fixed size as <cols>x<rows>, returned with the
+// policy
+func ParseSizePolicy(s string) (policy SizePolicy, rows, cols uint16, err error) {
+	switch SizePolicy(s) {
+	case "", SizeLatest:
+		return SizeLatest, 0, 0, nil
+	case SizeSmallest:
+		return SizeSmallest, 0, 0, nil
+	}
+	c, r, ok := strings.Cut(s, "x")
+	if ok {
+		c, err1 := strconv.ParseUint(c, 10, 16)
+		r, err2 := strconv.ParseUint(r, 10, 16)
+		if err1 == nil && err2 == nil && validSize(uint16(r), uint16(c)) {
+			return SizeFixed, uint16(r), uint16(c), nil
+		}
+	}
+	return "", 0, 0, fmt.Errorf("invalid size policy %q (latest, smallest or <cols>x<rows>)", s)
+}
+
+// validSize reports whether a terminal can have rows x cols
+func validSize(rows, cols uint16) bool {
+	return rows > 0 && cols > 0 && rows <= maxTerminalSize && cols <= maxTerminalSize
+}
+
+// validateSizePolicy checks the size policy of config
+func validateSizePolicy(config *Config) error {
+	switch config.SizePolicy {
+	case "", SizeLatest, SizeSmallest:
+		return nil
+	case SizeFixed:
+		if !validSize(config.FixedRows, config.FixedCols) {
+			return fmt.Errorf("invalid fixed terminal size: %dx%d", config.FixedCols, config.FixedRows)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown size policy %q", config.SizePolicy)
+	}
+}
+
+// initialSize returns the size the terminal starts with
+func (d *Daemon) initialSize() (rows, cols uint16) {
+	if d.config.SizePolicy == SizeFixed {
+		return d.config.FixedRows, d.config.FixedCols
+	}
+	return 24, 80
+}
+
+// terminalSize returns the size of the terminal under the size policy, once
+// by resized its terminal to rows x cols, and whether the terminal is to be
+// resized. It records the size of by, which may be nil.
+func (d *Daemon) terminalSize(by *client, rows, cols uint16) (uint16, uint16, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if by != nil {
+		by.rows, by.cols = rows, cols
+	}
+
+	switch d.config.SizePolicy {
+	case SizeFixed:
+		return 0, 0, false
+	case SizeSmallest:
+		return d.smallestSize()
+	default:
+		return rows, cols, true
+	}
+}
+
+// smallestSize returns the smallest rows and columns of the attached clients
+// that reported the size of their terminal; a client resizing before it
+// attaches counts once attached. It is called holding Daemon.mu.
+func (d *Daemon) smallestSize() (rows, cols uint16, ok bool) {
+	for _, c := range d.clients {
+		if c.rows == 0 || !c.attached {
+			continue
+		}
+		if !ok || c.rows < rows {
+			rows = c.rows
+		}
+		if !ok || c.cols < cols {
+			cols = c.cols
+		}
+		ok = true
+	}
+	return rows, cols, ok
+}
+
+// refitTerminal resizes the terminal to the smallest attached client with
+// SizeSmallest, once a client attached, detached or disconnected
+func (d *Daemon) refitTerminal() {
+	if d.config.SizePolicy != SizeSmallest || d.pty() == nil {
+		return
+	}
+	d.mu.RLock()
+	rows, cols, ok := d.smallestSize()
+	d.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if term := d.terminal(); term != nil {
+		if r, c := term.Size(); r == int(rows) && c == int(cols) {
+			return
+		}
+	}
+	if err := d.resizeVTY(rows, cols, 0); err != nil {
+		d.debugf("Failed to fit the terminal to the clients: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestParseSizePolicy(t *testing.T) {
+	tests := []struct {
+		in         string
+		policy     SizePolicy
+		rows, cols uint16
+	}{
+		{"", SizeLatest, 0, 0},
+		{"latest", SizeLatest, 0, 0},
+		{"smallest", SizeSmallest, 0, 0},
+		{"120x40", SizeFixed, 40, 120},
+	}
+	for _, tt := range tests {
+		policy, rows, cols, err := ParseSizePolicy(tt.in)
+		if err != nil {
+			t.Errorf("ParseSizePolicy(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if policy != tt.policy || rows != tt.rows || cols != tt.cols {
+			t.Errorf("ParseSizePolicy(%q) = %s %dx%d, expected %s %dx%d", tt.in, policy, cols, rows, tt.policy, tt.cols, tt.rows)
+		}
+	}
+
+	for _, in := range []string{"largest", "120x", "x40", "0x40", "120x600", "120*40"} {
+		if _, _, _, err := ParseSizePolicy(in); err == nil {
+			t.Errorf("Expected ParseSizePolicy(%q) to fail", in)
+		}
+	}
+
+	if _, err := New(&Config{Command: []string{"true"}, UseVTY: true, SizePolicy: SizeFixed}); err == nil {
+		t.Error("Expected a fixed size policy without a size to be rejected")
+	}
+}
+
+// startSizeDaemon starts a VTY daemon with the size policy of config
+func startSizeDaemon(t *testing.T, config *Config) *Daemon {
+	config.Command = []string{"sleep", "10"}
+	config.UseVTY = true
+	config.StdoutMode, config.StderrMode = IOModeLog, IOModeLog
+	config.RuntimeDir = t.TempDir()
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	t.Cleanup(d.stop)
+	return d
+}
+
+// resizeClient connects a client that resizes its terminal to rows x cols,
+// and attaches unless attach is false
+func resizeClient(t *testing.T, d *Daemon, rows, cols uint16, attach bool) net.Conn {
+	c, err := net.Dial("unix", d.SocketPath())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	payload := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, rows), cols)
+	if err := protocol.WriteMessage(c, protocol.MsgResize, payload); err != nil {
+		t.Fatalf("Failed to send resize: %v", err)
+	}
+	if msg, err := protocol.ReadMessage(c); err != nil || msg.Type != protocol.MsgResizeResponse {
+		t.Fatalf("Expected a resize response, got %v (%v)", msg, err)
+	}
+	if attach {
+		if err := protocol.WriteAttach(c, &protocol.AttachRequest{Streams: protocol.StreamBoth}); err != nil {
+			t.Fatalf("Failed to attach: %v", err)
+		}
+	}
+	return c
+}
+
+// waitSize waits for the terminal of d to be rows x cols
+func waitSize(t *testing.T, d *Daemon, rows, cols int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r, c := d.terminal().Size()
+		if r == rows && c == cols {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a %dx%d terminal, got %dx%d", cols, rows, c, r)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSizePolicySmallest(t *testing.T) {
+	d := startSizeDaemon(t, &Config{SizePolicy: SizeSmallest})
+
+	resizeClient(t, d, 40, 120, true)
+	waitSize(t, d, 40, 120)
+
+	// The smallest rows and columns of the attached clients apply
+	small := resizeClient(t, d, 50, 100, true)
+	waitSize(t, d, 40, 100)
+
+	// Clients not attached do not count
+	resizeClient(t, d, 20, 60, false)
+	time.Sleep(50 * time.Millisecond)
+	waitSize(t, d, 40, 100)
+
+	// Nor clients that left
+	small.Close()
+	waitSize(t, d, 40, 120)
+}
+
+func TestSizePolicyFixed(t *testing.T) {
+	d := startSizeDaemon(t, &Config{SizePolicy: SizeFixed, FixedRows: 30, FixedCols: 100})
+
+	waitSize(t, d, 30, 100)
+	resizeClient(t, d, 40, 120, true)
+	time.Sleep(50 * time.Millisecond)
+	waitSize(t, d, 30, 100)
+}
@@ -0,0 +1,55 @@
+package daemon
+
+import (
+	"fmt"
+	"time"
+)
+
+// SnapshotFileName is the name of the file the state of the terminal
+// emulator is saved to in VTY mode, so that the screen outlives the daemon
+const SnapshotFileName = "terminal.json"
+
+// snapshotInterval is how often the terminal state is saved while it changes
+const snapshotInterval = 5 * time.Second
+
+// saveSnapshot writes the state of the terminal emulator to SnapshotFileName
+func (d *Daemon) saveSnapshot() error {
+	term := d.terminal()
+	if term == nil {
+		return nil
+	}
+
+	data, err := term.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot terminal: %w", err)
+	}
+	if err := d.storage.WriteFile(SnapshotFileName, data); err != nil {
+		return fmt.Errorf("failed to write terminal snapshot: %w", err)
+	}
+	return nil
+}
+
+// snapshotLoop saves the terminal state every snapshotInterval while the
+// emulator changes, until the process exits and the final state is saved
+func (d *Daemon) snapshotLoop() {
+	defer d.recoverPanic("snapshot loop", nil)
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !d.snapshotStale.Swap(false) {
+				continue
+			}
+			if err := d.saveSnapshot(); err != nil {
+				d.errorf("Error saving terminal state: %v", err)
+			}
+		case <-d.doneCh:
+			return
+		case <-d.closeCh:
+			return
+		}
+	}
+}
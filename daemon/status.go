@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// statusInterval is how often status.json is rewritten while the process
+// runs, to keep its uptime and statistics current
+const statusInterval = 10 * time.Second
+
+// updateStatus rewrites status.json, so that monitors, and clients once the
+// daemon is gone, see the current state. Called when the state changes;
+// nothing is written after the final status.
+func (d *Daemon) updateStatus() {
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	if d.statusFinal {
+		return
+	}
+	if err := d.writeStatusFile(); err != nil {
+		d.errorf("Error updating status: %v", err)
+	}
+}
+
+// writeStatusFile writes the current status to status.json, atomically
+// replacing it. Called with statusMu held.
+func (d *Daemon) writeStatusFile() error {
+	data, err := json.MarshalIndent(d.GetStatus(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+	if err := d.storage.WriteFile(StatusFileName, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write status: %w", err)
+	}
+	return nil
+}
+
+// startFailed records that the process could not be started, and writes
+// the final status saying so: without it, the runtime directory would not
+// tell why the daemon is gone
+func (d *Daemon) startFailed(err error) {
+	d.mu.Lock()
+	d.startErr = err
+	d.mu.Unlock()
+	d.sdNotify("STATUS=Failed to start: " + err.Error())
+
+	d.statusMu.Lock()
+	defer d.statusMu.Unlock()
+
+	d.statusFinal = true
+	if err := d.writeStatusFile(); err != nil {
+		d.errorf("Error writing status: %v", err)
+		return
+	}
+	if d.signer != nil {
+		if err := d.signArtifacts(); err != nil {
+			d.errorf("Error writing signature: %v", err)
+		}
+	}
+}
+
+// statusLoop rewrites status.json every statusInterval until the process
+// exits
+func (d *Daemon) statusLoop() {
+	defer d.recoverPanic("status writer", nil)
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.updateStatus()
+		case <-d.doneCh:
+			return
+		case <-d.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// openStdin opens the input file of the process. A named pipe is opened for
+// writing as well: opening it does not wait for a producer, and the reader
+// does not reach end of file when one closes it, but waits for the next one
+// as if the pipe was reopened.
+func openStdin(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe != 0 {
+		return os.OpenFile(path, os.O_RDWR, 0)
+	}
+	return os.Open(path)
+}
+
+// feedStdin copies the file of a streamed stdin to the process, between the
+// input of clients. A regular file is copied once, leaving stdin open to the
+// clients, a named pipe until the process exits or stdin is closed.
+func (d *Daemon) feedStdin(f *os.File) {
+	defer d.recoverPanic("stdin feeder", nil)
+
+	buf := make([]byte, stdinFileChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := d.handleStdin(buf[:n]); err != nil {
+				d.debugf("Stdin feed stopped: %v", err)
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			d.debugf("Stdin file %s fed", d.config.StdinPath)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				d.warnf("Failed to read stdin file: %v", err)
+			}
+			return
+		}
+	}
+}
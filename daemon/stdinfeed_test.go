@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForLog waits for the output log of the daemon in dir to contain want
+func waitForLog(t *testing.T, dir, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		content, _ := os.ReadFile(filepath.Join(dir, "output.log"))
+		if strings.Contains(string(content), want) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Log did not contain %q", want)
+}
+
+// writeFIFO writes data to a named pipe as a producer, closing it after
+func writeFIFO(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open named pipe: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("Failed to write named pipe: %v", err)
+	}
+}
+
+func TestStdinFIFO(t *testing.T) {
+	tmpDir := t.TempDir()
+	fifo := filepath.Join(t.TempDir(), "in.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Failed to create named pipe: %v", err)
+	}
+
+	// Starting does not wait for a producer
+	d, err := New(&Config{
+		Command:    []string{"cat"},
+		StdinMode:  StdinFile,
+		StdinPath:  fifo,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	// The process outlives its producers
+	writeFIFO(t, fifo, "first\n")
+	waitForLog(t, tmpDir, "first")
+	writeFIFO(t, fifo, "second\n")
+	waitForLog(t, tmpDir, "second")
+	select {
+	case <-d.exited:
+		t.Error("Expected the process to wait for the next producer")
+	default:
+	}
+}
+
+func TestStdinStreamFeed(t *testing.T) {
+	tmpDir := t.TempDir()
+	fifo := filepath.Join(t.TempDir(), "in.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Failed to create named pipe: %v", err)
+	}
+
+	d, err := New(&Config{
+		Command:    []string{"cat"},
+		StdinMode:  StdinStream,
+		StdinPath:  fifo,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+
+	// Producers and clients both write to stdin
+	writeFIFO(t, fifo, "from producer\n")
+	waitForLog(t, tmpDir, "from producer")
+	if err := d.handleStdin([]byte("from client\n")); err != nil {
+		t.Fatalf("Failed to write stdin: %v", err)
+	}
+	waitForLog(t, tmpDir, "from client")
+	writeFIFO(t, fifo, "from next producer\n")
+	waitForLog(t, tmpDir, "from next producer")
+
+	// Closing stdin ends the process
+	if err := d.closeStdin(); err != nil {
+		t.Fatalf("Failed to close stdin: %v", err)
+	}
+	select {
+	case <-d.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+}
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+const (
+	// stdinFileChunkSize is the size of the reads of a file streamed to
+	// the process input
+	stdinFileChunkSize = 64 * 1024
+
+	// stdinFileProgressInterval is how often the progress of a file
+	// streamed to the process input is reported
+	stdinFileProgressInterval = 500 * time.Millisecond
+)
+
+// handleStdinFile writes a file to the process input, reporting the
+// progress, so that a large input does not go through the socket. The file
+// is read as the process consumes it, the client waiting until it is done.
+func (d *Daemon) handleStdinFile(conn net.Conn, payload []byte) error {
+	req, err := protocol.ParseStdinFileRequest(payload)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(req.Path) {
+		return fmt.Errorf("stdin file path must be absolute: %s", req.Path)
+	}
+	if d.config.UseVTY {
+		if req.Close {
+			return fmt.Errorf("stdin cannot be closed in VTY mode")
+		}
+	} else if d.stdin() == nil {
+		return fmt.Errorf("stdin is not available for streaming")
+	}
+
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open stdin file: %w", err)
+	}
+	defer f.Close()
+
+	progress := protocol.StdinFileProgress{}
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		progress.Size = info.Size()
+	}
+
+	d.debugf("Stdin file request: %s, %d bytes", req.Path, progress.Size)
+
+	buf := make([]byte, stdinFileChunkSize)
+	last := time.Now()
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			data := buf[:n]
+			if err := d.chargeStdin(conn, n); err != nil {
+				return err
+			}
+			d.recordClientEvent(conn, protocol.TimelineEvent{Type: protocol.TimelineInput, Data: string(data)})
+			if err := d.handleStdin(data); err != nil {
+				return err
+			}
+			progress.Sent += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read stdin file: %w", err)
+		}
+
+		if time.Since(last) >= stdinFileProgressInterval {
+			last = time.Now()
+			if err := d.writeStdinFileProgress(conn, &progress); err != nil {
+				return err
+			}
+		}
+	}
+
+	if req.Close {
+		if err := d.closeStdin(); err != nil {
+			return err
+		}
+	}
+
+	d.debugf("Stdin file %s written: %d bytes", req.Path, progress.Sent)
+
+	progress.Done = true
+	return d.writeStdinFileProgress(conn, &progress)
+}
+
+// writeStdinFileProgress sends progress to the client, between the messages
+// of its output queue
+func (d *Daemon) writeStdinFileProgress(conn net.Conn, progress *protocol.StdinFileProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stdin file progress: %w", err)
+	}
+
+	d.mu.RLock()
+	c, ok := d.clients[conn]
+	d.mu.RUnlock()
+	if ok {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+	}
+	return protocol.WriteMessage(conn, protocol.MsgStdinFileProgress, data)
+}
@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// systemdListenFD is the first file descriptor passed by socket activation
+const systemdListenFD = 3
+
+// systemd holds what the service manager passed in the environment of a
+// daemon it started, see sd_notify(3) and sd_listen_fds(3). The variables
+// are removed from the environment so the process does not inherit them.
+type systemd struct {
+	notifySocket string        // NOTIFY_SOCKET, empty when not notifying
+	watchdog     time.Duration // WATCHDOG_USEC, 0 without watchdog
+	listenFDs    int           // LISTEN_FDS, sockets passed by activation
+}
+
+// systemdFromEnv reads and clears the systemd environment. The watchdog and
+// activated sockets only apply when meant for this process.
+func systemdFromEnv() systemd {
+	var sd systemd
+	pid := strconv.Itoa(os.Getpid())
+
+	sd.notifySocket = os.Getenv("NOTIFY_SOCKET")
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if wpid := os.Getenv("WATCHDOG_PID"); wpid == "" || wpid == pid {
+			sd.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	if os.Getenv("LISTEN_PID") == pid {
+		sd.listenFDs, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	}
+
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID", "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	return sd
+}
+
+// activatedListener returns the control socket passed by socket
+// activation, or nil when there is none
+func (sd systemd) activatedListener() (net.Listener, error) {
+	switch {
+	case sd.listenFDs == 0:
+		return nil, nil
+	case sd.listenFDs > 1:
+		return nil, fmt.Errorf("socket activation passed %d sockets, expected one", sd.listenFDs)
+	}
+
+	f := os.NewFile(systemdListenFD, "systemd socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid activated socket: %w", err)
+	}
+	if _, ok := l.(*net.UnixListener); !ok {
+		l.Close()
+		return nil, errors.New("the activated socket is not a Unix stream socket")
+	}
+	return l, nil
+}
+
+// sdNotify sends state to the service manager, if it asked for
+// notifications
+func (d *Daemon) sdNotify(state string) {
+	if d.systemd.notifySocket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", d.systemd.notifySocket)
+	if err != nil {
+		d.warnf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		d.warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// notifyReady tells the service manager the process runs and the control
+// socket is up. MAINPID lets a daemon started with -background, forked
+// from the process systemd started, take over as the main process.
+func (d *Daemon) notifyReady() {
+	if d.systemd.notifySocket == "" {
+		return
+	}
+	d.sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d\nSTATUS=%s", os.Getpid(), d.runningStatus()))
+}
+
+// runningStatus describes the running process for STATUS=
+func (d *Daemon) runningStatus() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return fmt.Sprintf("Running %s (pid %d)", strings.Join(d.config.Command, " "), d.pid)
+}
+
+// notifyEvent forwards the lifecycle events changing the process state to
+// the service manager as STATUS= text
+func (d *Daemon) notifyEvent(ev protocol.Event) {
+	if d.systemd.notifySocket == "" {
+		return
+	}
+	switch ev.Type {
+	case protocol.EventPaused:
+		d.sdNotify("STATUS=Paused")
+	case protocol.EventResumed:
+		d.sdNotify("STATUS=" + d.runningStatus())
+	case protocol.EventTitle:
+		d.sdNotify("STATUS=" + d.runningStatus() + ": " + ev.Title)
+	case protocol.EventExited:
+		d.sdNotify(fmt.Sprintf("STOPPING=1\nSTATUS=Exited with code %d", *ev.ExitCode))
+	}
+}
+
+// watchdogLoop sends keepalives at half the watchdog interval while the
+// daemon is healthy, so that systemd restarts a wedged daemon
+func (d *Daemon) watchdogLoop() {
+	defer d.recoverPanic("systemd watchdog", nil)
+
+	ticker := time.NewTicker(d.systemd.watchdog / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if health := d.checkHealth(); !health.Healthy {
+				d.warnf("Daemon unhealthy, skipping the watchdog keepalive: %+v", health.Checks)
+				continue
+			}
+			d.sdNotify("WATCHDOG=1")
+		case <-d.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	tmpDir := t.TempDir()
+	notifyPath := filepath.Join(tmpDir, "notify.sock")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", notifyPath)
+	t.Setenv("WATCHDOG_USEC", "100000")
+
+	config := &Config{
+		Command:    []string{"bash", "-c", "echo \"notify=$NOTIFY_SOCKET\"; sleep 0.3; exit 2"},
+		StdinMode:  StdinNull,
+		StdoutMode: IOModeLog,
+		StderrMode: IOModeLog,
+		RuntimeDir: tmpDir,
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		t.Error("Expected the systemd environment to be cleared")
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	var states []string
+	buf := make([]byte, 4096)
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, err := notify.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read notifications: %v (got %q)", err, states)
+		}
+		states = append(states, string(buf[:n]))
+		if strings.Contains(states[len(states)-1], "STOPPING=1") {
+			break
+		}
+	}
+
+	if !strings.HasPrefix(states[0], "READY=1\n") || !strings.Contains(states[0], "STATUS=Running bash -c") {
+		t.Errorf("Expected readiness first, got %q", states[0])
+	}
+	if !strings.Contains(strings.Join(states, "|"), "WATCHDOG=1") {
+		t.Errorf("Expected watchdog keepalives, got %q", states)
+	}
+	if last := states[len(states)-1]; !strings.Contains(last, "STATUS=Exited with code 2") {
+		t.Errorf("Expected the exit status last, got %q", last)
+	}
+
+	d.Wait()
+	data, _ := d.storage.ReadFile(LogFileName)
+	if string(data) != "notify=\n" {
+		t.Errorf("Expected the process not to inherit NOTIFY_SOCKET, got %q", data)
+	}
+}
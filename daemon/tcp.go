@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a TCP client
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig loads the certificates of the TCP listener, also used by
+// the REST API over TCP. Clients must authenticate with a certificate
+// signed by the client CA.
+func loadTLSConfig(config *Config) (*tls.Config, error) {
+	if config.ListenTCP == "" && config.TLSCertFile == "" && config.TLSKeyFile == "" && config.TLSClientCAFile == "" {
+		return nil, nil
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" || config.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("TLS requires a certificate, key and client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(config.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", config.TLSClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// anonymousListener tells whether config has listeners whose clients may
+// present neither a certificate nor a token: the WebSocket bridge, and the
+// REST API over TCP
+func anonymousListener(config *Config) bool {
+	return config.ListenWebSocket != "" || (config.ListenAPI != "" && !strings.HasPrefix(config.ListenAPI, "unix:"))
+}
+
+// loadToken reads the bearer token of the REST API and WebSocket bridge
+// over TCP, if configured
+func loadToken(config *Config) (string, error) {
+	if config.TokenFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(config.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("no token found in %s", config.TokenFile)
+	}
+	return token, nil
+}
+
+// validToken tells whether token is the one of TokenFile
+func (d *Daemon) validToken(token string) bool {
+	return d.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+// startTCPServer starts the TLS listener, if configured
+func (d *Daemon) startTCPServer() error {
+	if d.config.ListenTCP == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", d.config.ListenTCP)
+	if err != nil {
+		return fmt.Errorf("failed to create TCP listener: %w", err)
+	}
+	listener = tls.NewListener(listener, d.tlsConfig)
+
+	d.listenerMu.Lock()
+	d.tcpListener = listener
+	d.listenerMu.Unlock()
+
+	go d.acceptConnections(listener)
+
+	d.infof("TLS server listening on %s", listener.Addr())
+
+	return nil
+}
+
+// TCPAddr returns the address of the TLS listener, nil without ListenTCP
+func (d *Daemon) TCPAddr() net.Addr {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	if d.tcpListener == nil {
+		return nil
+	}
+	return d.tcpListener.Addr()
+}
+
+// acceptTLS completes the handshake of a TCP client, verifying its
+// certificate, before serving it
+func (d *Daemon) acceptTLS(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		d.warnf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	remote := conn.RemoteAddr().String()
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		remote = certs[0].Subject.CommonName + "@" + remote
+	}
+	peer := peerCred{remote: remote}
+	d.addClient(conn, peer, d.permissionsOf(peer))
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// teeFile is a file an output stream is copied to, in addition to its
+// destination
+type teeFile struct {
+	file   *os.File
+	failed bool // a write failed, reported once
+}
+
+// setupTee opens the tee files of stream. A stream in IOModeNull or
+// IOModeFile has no pipe to the daemon, which then reads it to copy it to
+// its file and tee files, and broadcast it: the write end of that pipe is
+// returned, nil when the mode of the stream already provides one.
+func (d *Daemon) setupTee(stream byte, mode IOMode, path string, tee []string) (*os.File, error) {
+	if mode == IOModeFile {
+		tee = append([]string{path}, tee...)
+	}
+	for _, p := range tee {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			d.closeTee(stream)
+			return nil, err
+		}
+		d.tee[stream-1] = append(d.tee[stream-1], &teeFile{file: f})
+	}
+	if mode != IOModeNull && mode != IOModeFile {
+		return nil, nil
+	}
+
+	// Use a plain pipe rather than cmd.StdoutPipe so that cmd.Wait does not
+	// close the read end before all output has been consumed
+	r, w, err := os.Pipe()
+	if err != nil {
+		d.closeTee(stream)
+		return nil, err
+	}
+	if stream == protocol.StreamStdout {
+		d.stdoutPipe = r
+	} else {
+		d.stderrPipe = r
+	}
+	d.childWriters = append(d.childWriters, w)
+	return w, nil
+}
+
+// teeOutput copies output of stream to its tee files
+func (d *Daemon) teeOutput(stream byte, data []byte) {
+	for _, t := range d.tee[stream-1] {
+		if _, err := t.file.Write(data); err != nil && !t.failed {
+			t.failed = true
+			d.errorf("Error writing %s: %v", t.file.Name(), err)
+		}
+	}
+}
+
+// closeTee closes the tee files of stream, once its output is read
+func (d *Daemon) closeTee(stream byte) {
+	for _, t := range d.tee[stream-1] {
+		if err := t.file.Close(); err != nil {
+			d.errorf("Error closing %s: %v", t.file.Name(), err)
+		}
+	}
+	d.tee[stream-1] = nil
+}
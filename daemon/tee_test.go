@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTee(t *testing.T) {
+	tmpDir := t.TempDir()
+	outDir := t.TempDir()
+	stdoutTee := filepath.Join(outDir, "out.log")
+	stderrFile := filepath.Join(outDir, "err.log")
+	stderrTee := filepath.Join(outDir, "err-copy.log")
+
+	d, err := New(&Config{
+		Command:    []string{"sh", "-c", "echo to stdout; echo to stderr >&2"},
+		StdoutMode: IOModeLog,
+		StdoutTee:  []string{stdoutTee},
+		StderrMode: IOModeFile,
+		StderrPath: stderrFile,
+		StderrTee:  []string{stderrTee},
+		RuntimeDir: tmpDir,
+		Embedded:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.Close()
+	d.Wait()
+
+	read := func(path string) string {
+		t.Helper()
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		return string(content)
+	}
+
+	// Logged stdout is copied to its tee file
+	if log := read(filepath.Join(tmpDir, "output.log")); !strings.Contains(log, "to stdout") || strings.Contains(log, "to stderr") {
+		t.Errorf("Expected stdout only in output.log, got %q", log)
+	}
+	if out := read(stdoutTee); out != "to stdout\n" {
+		t.Errorf("Expected stdout in its tee file, got %q", out)
+	}
+
+	// Stderr goes to its file and tee file through the daemon
+	for _, path := range []string{stderrFile, stderrTee} {
+		if out := read(path); out != "to stderr\n" {
+			t.Errorf("Expected stderr in %s, got %q", path, out)
+		}
+	}
+	d.history.mu.Lock()
+	history := d.history.tail(2)
+	d.history.mu.Unlock()
+	if !strings.Contains(string(history), "to stderr") {
+		t.Errorf("Expected stderr to be broadcast, got %q", history)
+	}
+}
+
+func TestTeeVTY(t *testing.T) {
+	if _, err := New(&Config{
+		Command:    []string{"true"},
+		UseVTY:     true,
+		StderrTee:  []string{filepath.Join(t.TempDir(), "err.log")},
+		RuntimeDir: t.TempDir(),
+	}); err == nil {
+		t.Error("Expected stderr tee files to be refused in VTY mode")
+	}
+}
@@ -1,111 +1,183 @@
 package daemon
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"log"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/KarpelesLab/bgrun/protocol"
 	"github.com/KarpelesLab/bgrun/termemu"
 	"github.com/creack/pty"
 )
 
 // startProcessVTY starts the process with a PTY
 func (d *Daemon) startProcessVTY() error {
-	d.cmd = exec.Command(d.config.Command[0], d.config.Command[1:]...)
+	d.cmd = d.command()
+	d.cmd.Dir = d.config.Dir
+
+	if err := d.setupExec(); err != nil {
+		return err
+	}
+	if err := d.setupCgroup(); err != nil {
+		return err
+	}
+
+	// The PTY is read by the daemon, which logs it as well
+	if _, err := d.setupTee(protocol.StreamStdout, IOModeLog, "", d.config.StdoutTee); err != nil {
+		return fmt.Errorf("failed to open stdout tee: %w", err)
+	}
 
 	// Start the command with a PTY
+	startedAt := time.Now()
 	ptmx, err := pty.Start(d.cmd)
+	d.cgroupStarted(err)
 	if err != nil {
 		return fmt.Errorf("failed to start command with PTY: %w", err)
 	}
 
-	// Store PTY as both stdin and stdout
-	d.vtyPty = ptmx
-
-	// Set initial PTY size (default to 24x80 if not specified)
-	rows := uint16(24)
-	cols := uint16(80)
+	// Set initial PTY size
+	rows, cols := d.initialSize()
 	if err := pty.Setsize(ptmx, &pty.Winsize{
 		Rows: rows,
 		Cols: cols,
 	}); err != nil {
-		log.Printf("Warning: failed to set initial PTY size: %v", err)
+		d.warnf("Failed to set initial PTY size: %v", err)
 	}
 
 	// Initialize terminal emulator
-	d.vtyTermemu = termemu.NewTerminal(int(rows), int(cols))
-
+	term := termemu.NewTerminal(int(rows), int(cols))
+	term.SetResponseHandler(d.answerTerminalQuery)
+	term.SetUnsupportedHandler(func(seq string) {
+		d.warnf("Terminal emulator does not support %s, the screen may be inaccurate", seq)
+	})
+	term.SetMarkHandler(d.recordMark)
+
+	// The PTY serves as both stdin and stdout
 	d.mu.Lock()
+	d.vtyPty = ptmx
+	d.vtyTermemu = term
 	d.pid = d.cmd.Process.Pid
 	d.running = true
+	d.startedAt = startedAt
 	d.mu.Unlock()
 
-	log.Printf("Started process %d with PTY: %v", d.pid, d.config.Command)
+	d.infof("Started process %d with PTY: %v", d.cmd.Process.Pid, d.config.Command)
+	d.restoreStarted()
 
 	return nil
 }
 
 // handleVTYOutput reads from PTY and broadcasts to clients and log
 func (d *Daemon) handleVTYOutput() {
-	if d.vtyPty == nil {
+	defer d.outputWg.Done()
+
+	ptmx := d.pty()
+	if ptmx == nil {
 		return
 	}
 
-	defer d.vtyPty.Close()
+	defer ptmx.Close()
+	defer d.recoverPanic("PTY reader", d.abort)
+	defer d.closeTee(protocol.StreamStdout)
+
+	d.health.readerStarted()
+	defer d.health.readerStopped()
 
-	buf := make([]byte, 4096)
+	reader := d.newChunkReader(ptmx)
 	for {
-		n, err := d.vtyPty.Read(buf)
+		chunk := getOutputChunk(protocol.StreamStdout)
+		n, err := reader.read(chunk)
 		if n > 0 {
-			data := buf[:n]
+			chunk.data = chunk.buf[:n]
+			d.health.busy(protocol.StreamStdout)
 
-			// Feed to terminal emulator
-			if d.vtyTermemu != nil {
-				d.vtyTermemu.Write(data)
-			}
+			// Feed to terminal emulator and recording
+			d.recordOutput(chunk.data)
+			d.pushScreenUpdate()
+			d.checkTitle()
 
 			// Write to log file
-			if d.logFile != nil {
-				d.logFile.Write(data)
-			}
+			d.writeLog(chunk.data)
+			d.teeOutput(protocol.StreamStdout, chunk.data)
 
 			// Broadcast to attached clients (as stdout stream)
-			d.broadcastOutput(1, data) // 1 = stdout
+			d.broadcastOutput(chunk)
+			d.health.idle(protocol.StreamStdout)
+			d.throttleOutput(n)
 		}
+		chunk.release()
 
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Error reading from PTY: %v", err)
+				d.errorf("Error reading from PTY: %v", err)
 			}
 			return
 		}
 	}
 }
 
+// checkStrictVTY fails in strict mode once the emulated screen may no
+// longer match the program's output
+func (d *Daemon) checkStrictVTY() error {
+	if !d.config.StrictVTY {
+		return nil
+	}
+	if unsupported := d.terminal().UnsupportedSequences(); len(unsupported) > 0 {
+		return fmt.Errorf("screen may be inaccurate, unsupported sequences received: %s", termemu.UnsupportedSummary(unsupported))
+	}
+	return nil
+}
+
+// answerTerminalQuery writes the emulator's reply to a terminal query (DSR,
+// DA, ...) back to the PTY. When an interactive client is attached its own
+// terminal receives the query and answers it, so the emulator stays quiet to
+// avoid a duplicate reply.
+func (d *Daemon) answerTerminalQuery(data []byte) {
+	d.mu.RLock()
+	for _, c := range d.clients {
+		if c.attached && c.hasTerminal {
+			d.mu.RUnlock()
+			return
+		}
+	}
+	d.mu.RUnlock()
+
+	if err := d.writeVTY(data); err != nil {
+		d.errorf("Error answering terminal query: %v", err)
+	}
+}
+
 // writeVTY writes data to the PTY
 func (d *Daemon) writeVTY(data []byte) error {
-	if d.vtyPty == nil {
+	ptmx := d.pty()
+	if ptmx == nil {
 		return fmt.Errorf("VTY is not available")
 	}
 
-	if _, err := d.vtyPty.Write(data); err != nil {
+	if _, err := ptmx.Write(data); err != nil {
 		return fmt.Errorf("failed to write to PTY: %w", err)
 	}
 
 	return nil
 }
 
-// resizeVTY resizes the PTY
-func (d *Daemon) resizeVTY(rows, cols uint16) error {
-	if d.vtyPty == nil {
+// resizeVTY resizes the PTY for the client by, 0 for none
+func (d *Daemon) resizeVTY(rows, cols uint16, by uint64) error {
+	ptmx := d.pty()
+	if ptmx == nil {
 		return fmt.Errorf("VTY is not available")
 	}
 
-	if err := pty.Setsize(d.vtyPty, &pty.Winsize{
+	if err := pty.Setsize(ptmx, &pty.Winsize{
 		Rows: rows,
 		Cols: cols,
 	}); err != nil {
@@ -113,9 +185,9 @@ func (d *Daemon) resizeVTY(rows, cols uint16) error {
 	}
 
 	// Resize terminal emulator
-	if d.vtyTermemu != nil {
-		d.vtyTermemu.Resize(int(rows), int(cols))
-	}
+	d.recordResize(int(rows), int(cols))
+	d.pushScreenUpdate()
+	d.emitEvent(protocol.Event{Type: protocol.EventResized, Rows: int(rows), Cols: int(cols), Client: by})
 
 	// Send SIGWINCH to the foreground process group
 	// pty.Setsize should do this automatically, but let's be explicit
@@ -127,30 +199,43 @@ func (d *Daemon) resizeVTY(rows, cols uint16) error {
 		// Get the actual foreground process group and send to it
 		if pgrp, err := d.getForegroundPgrp(); err == nil && pgrp > 0 {
 			if err := syscall.Kill(-pgrp, syscall.SIGWINCH); err != nil {
-				log.Printf("Warning: failed to send SIGWINCH to pgrp %d: %v", pgrp, err)
+				d.warnf("Failed to send SIGWINCH to pgrp %d: %v", pgrp, err)
 			}
 		}
 	}
 
-	log.Printf("PTY resized to %dx%d", rows, cols)
+	d.debugf("PTY resized to %dx%d", rows, cols)
 
 	return nil
 }
 
 // getForegroundPgrp gets the foreground process group of the PTY
 func (d *Daemon) getForegroundPgrp() (int, error) {
-	if d.vtyPty == nil {
+	ptmx := d.pty()
+	if ptmx == nil {
 		return 0, fmt.Errorf("VTY is not available")
 	}
 
-	// Use TIOCGPGRP ioctl to get the foreground process group
+	// Use TIOCGPGRP ioctl to get the foreground process group. Control
+	// keeps the descriptor from being closed by the PTY reader meanwhile,
+	// which Fd would not.
+	rc, err := ptmx.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get foreground process group: %w", err)
+	}
 	var pgrp int
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		d.vtyPty.Fd(),
-		syscall.TIOCGPGRP,
-		uintptr(unsafe.Pointer(&pgrp)),
-	)
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(
+			syscall.SYS_IOCTL,
+			fd,
+			syscall.TIOCGPGRP,
+			uintptr(unsafe.Pointer(&pgrp)),
+		)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get foreground process group: %w", err)
+	}
 	if errno != 0 {
 		return 0, fmt.Errorf("failed to get foreground process group: %v", errno)
 	}
@@ -158,8 +243,51 @@ func (d *Daemon) getForegroundPgrp() (int, error) {
 	return pgrp, nil
 }
 
-// waitForCondition waits for a specific condition with timeout
-func (d *Daemon) waitForCondition(timeoutSecs uint32, waitType byte) byte {
+// foregroundProcess describes the foreground process group of the PTY from
+// /proc, or returns nil without a running VTY process
+func (d *Daemon) foregroundProcess() *protocol.ForegroundProcess {
+	d.mu.RLock()
+	running := d.running
+	d.mu.RUnlock()
+	if !running || d.pty() == nil {
+		return nil
+	}
+
+	pgrp, err := d.getForegroundPgrp()
+	if err != nil || pgrp <= 0 {
+		return nil
+	}
+
+	fg := &protocol.ForegroundProcess{PID: pgrp}
+	dir := filepath.Join("/proc", strconv.Itoa(pgrp))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		fg.Name = strings.TrimSuffix(string(comm), "\n")
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		fg.Command = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	}
+	return fg
+}
+
+// processStopped reports whether the process is stopped by a signal,
+// according to /proc. ok is false when that cannot be known.
+func processStopped(pid int) (stopped, ok bool) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false, false
+	}
+	// The state follows the executable name, in parentheses which it may
+	// itself contain
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return false, false
+	}
+	return stat[i+2] == 'T', true
+}
+
+// waitForCondition waits for a specific condition until timeout fires, or
+// forever when it is nil
+func (d *Daemon) waitForCondition(timeout <-chan time.Time, waitType byte) byte {
 	// Import protocol package constants
 	const (
 		WaitTypeExit            byte = 0x00
@@ -172,14 +300,14 @@ func (d *Daemon) waitForCondition(timeoutSecs uint32, waitType byte) byte {
 	switch waitType {
 	case WaitTypeExit:
 		// Wait for process to exit
-		return d.waitForExit(timeoutSecs)
+		return d.waitForExit(timeout)
 
 	case WaitTypeForeground:
 		// Wait for foreground control to return to main process
-		if d.vtyPty == nil {
+		if d.pty() == nil {
 			return WaitStatusNotApplicable
 		}
-		return d.waitForForeground(timeoutSecs)
+		return d.waitForForeground(timeout)
 
 	default:
 		return WaitStatusNotApplicable
@@ -187,91 +315,192 @@ func (d *Daemon) waitForCondition(timeoutSecs uint32, waitType byte) byte {
 }
 
 // waitForExit waits for the process to exit
-func (d *Daemon) waitForExit(timeoutSecs uint32) byte {
-	const (
-		WaitStatusCompleted byte = 0x00
-		WaitStatusTimeout   byte = 0x01
-	)
+func (d *Daemon) waitForExit(timeout <-chan time.Time) byte {
+	select {
+	case <-d.exited:
+		return protocol.WaitStatusCompleted
+	case <-timeout:
+		return protocol.WaitStatusTimeout
+	case <-d.closeCh:
+		return protocol.WaitStatusTimeout
+	}
+}
 
-	// Create a channel to signal when process exits
-	done := make(chan struct{})
-	stop := make(chan struct{})
+// waitForForeground waits for the foreground process group to return to
+// the main process, as seen by watchForeground which polls the PTY once for
+// all the waiters
+func (d *Daemon) waitForForeground(timeout <-chan time.Time) byte {
+	d.mu.RLock()
+	targetPid := d.pid
+	d.mu.RUnlock()
 
-	go func() {
-		defer close(done)
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
+	d.foreground.addWaiter(1)
+	defer d.foreground.addWaiter(-1)
 
-		for {
-			select {
-			case <-stop:
-				return
-			case <-ticker.C:
-				d.mu.RLock()
-				running := d.running
-				d.mu.RUnlock()
-
-				if !running {
-					return
-				}
-			}
+	for {
+		pgrp, changed := d.foreground.get()
+		if pgrp == targetPid {
+			return protocol.WaitStatusCompleted
 		}
-	}()
 
-	// Wait for exit or timeout
-	select {
-	case <-done:
-		return WaitStatusCompleted
-	case <-time.After(time.Duration(timeoutSecs) * time.Second):
-		close(stop)
-		return WaitStatusTimeout
+		select {
+		case <-changed:
+		case <-timeout:
+			return protocol.WaitStatusTimeout
+		case <-d.closeCh:
+			return protocol.WaitStatusTimeout
+		}
 	}
 }
 
-// waitForForeground waits for the foreground process group to return to main process
-func (d *Daemon) waitForForeground(timeoutSecs uint32) byte {
-	const (
-		WaitStatusCompleted byte = 0x00
-		WaitStatusTimeout   byte = 0x01
-	)
+// waitPollInterval is how often waitForPattern looks for new output
+const waitPollInterval = 100 * time.Millisecond
 
-	d.mu.RLock()
-	targetPid := d.pid
-	d.mu.RUnlock()
+// waitForPattern waits for re to match a line of the output, or of the
+// screen and scrollback in VTY mode. Output produced before the wait
+// counts, as far as the history or the scrollback still holds it. It is not
+// applicable once the process exited without the pattern appearing.
+func (d *Daemon) waitForPattern(timeout <-chan time.Time, re *regexp.Regexp) byte {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	m := &outputMatcher{re: re}
+	for {
+		// The output is drained before the process is reported as exited,
+		// so a match checked after that is final
+		d.mu.RLock()
+		running := d.running
+		d.mu.RUnlock()
+
+		if d.outputMatches(m) {
+			return protocol.WaitStatusCompleted
+		}
+		if !running {
+			return protocol.WaitStatusNotApplicable
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.exited:
+		case <-timeout:
+			return protocol.WaitStatusTimeout
+		case <-d.closeCh:
+			return protocol.WaitStatusTimeout
+		}
+	}
+}
+
+// outputMatcher matches a pattern against the output line by line, as it
+// is added to the history
+type outputMatcher struct {
+	re      *regexp.Regexp
+	offset  uint64          // of the output not matched yet
+	partial map[byte][]byte // unterminated last line of each stream
+}
+
+// maxPartialLine bounds the unterminated line an outputMatcher keeps
+const maxPartialLine = 64 << 10
 
-	// Create a channel to signal when condition is met
-	done := make(chan struct{})
-	stop := make(chan struct{})
+// outputMatches reports whether the pattern of m appears in the screen and
+// scrollback in VTY mode, or in the output added to the history since the
+// previous call otherwise
+func (d *Daemon) outputMatches(m *outputMatcher) bool {
+	if term := d.terminal(); term != nil {
+		matches, _ := term.Search(m.re.String(), termemu.SearchOptions{IncludeScrollback: true, MaxMatches: 1})
+		return len(matches) > 0
+	}
+
+	if m.partial == nil {
+		m.partial = make(map[byte][]byte)
+	}
 
-	go func() {
-		defer close(done)
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
+	d.history.mu.Lock()
+	defer d.history.mu.Unlock()
 
+	for _, chunk := range d.history.chunks {
+		end := chunk.offset + uint64(len(chunk.data))
+		if end <= m.offset {
+			continue
+		}
+		data := chunk.data
+		if chunk.offset < m.offset {
+			data = data[m.offset-chunk.offset:]
+		}
+		m.offset = end
+
+		text := append(m.partial[chunk.stream], data...)
 		for {
-			select {
-			case <-stop:
-				return
-			case <-ticker.C:
-				pgrp, err := d.getForegroundPgrp()
-				if err != nil {
-					// If we can't get the pgrp, continue polling
-					continue
-				}
-
-				if pgrp == targetPid {
-					return
-				}
+			i := bytes.IndexByte(text, '\n')
+			if i < 0 {
+				break
+			}
+			if m.re.Match(bytes.TrimSuffix(text[:i], []byte("\r"))) {
+				return true
 			}
+			text = text[i+1:]
 		}
-	}()
+		// A prompt has no newline, the line is matched as far as it goes
+		if m.re.Match(text) {
+			return true
+		}
+		m.partial[chunk.stream] = bytes.Clone(text[max(0, len(text)-maxPartialLine):])
+	}
+	return false
+}
 
-	// Wait for foreground control or timeout
-	select {
-	case <-done:
-		return WaitStatusCompleted
-	case <-time.After(time.Duration(timeoutSecs) * time.Second):
-		close(stop)
-		return WaitStatusTimeout
+// waitForQuiet waits for a period of quiet without anything changing, as
+// reported by lastChange, and completes at once when the process exited
+// since nothing changes anymore
+func (d *Daemon) waitForQuiet(timeout <-chan time.Time, quiet time.Duration, lastChange func() time.Time) byte {
+	ticker := time.NewTicker(min(max(quiet/4, 10*time.Millisecond), waitPollInterval))
+	defer ticker.Stop()
+
+	for {
+		d.mu.RLock()
+		running := d.running
+		d.mu.RUnlock()
+
+		if !running || time.Since(lastChange()) >= quiet {
+			return protocol.WaitStatusCompleted
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.exited:
+		case <-timeout:
+			return protocol.WaitStatusTimeout
+		case <-d.closeCh:
+			return protocol.WaitStatusTimeout
+		}
+	}
+}
+
+// lastOutputTime returns when the process last produced output, or when it
+// started if it did not yet
+func (d *Daemon) lastOutputTime() time.Time {
+	if t := d.lastOutput.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.startedAt
+}
+
+// screenWatcher tracks when the screen content or the cursor last changed,
+// comparing snapshots of the emulator taken from the start of a wait
+type screenWatcher struct {
+	term    *termemu.Terminal
+	screen  [][]termemu.Cell
+	cursor  [2]int
+	changed time.Time
+}
+
+// lastChange takes a new snapshot and returns when the screen last changed
+func (w *screenWatcher) lastChange() time.Time {
+	screen := w.term.GetScreen()
+	row, col := w.term.GetCursor()
+	if w.changed.IsZero() || w.cursor != [2]int{row, col} || !slices.EqualFunc(w.screen, screen, slices.Equal) {
+		w.screen, w.cursor, w.changed = screen, [2]int{row, col}, time.Now()
 	}
+	return w.changed
 }
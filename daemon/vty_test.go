@@ -90,12 +90,49 @@ func TestVTYResize(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Test resize
-	if err := d.resizeVTY(40, 100); err != nil {
+	if err := d.resizeVTY(40, 100, 0); err != nil {
 		t.Errorf("Failed to resize VTY: %v", err)
 	}
 
 	// Another resize
-	if err := d.resizeVTY(24, 80); err != nil {
+	if err := d.resizeVTY(24, 80, 0); err != nil {
 		t.Errorf("Failed to resize VTY: %v", err)
 	}
 }
+
+func TestVTYAnswersTerminalQueries(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Ask for the cursor position and wait for the reply, as a real program
+	// would; without an answer read would block until the timeout
+	script := `stty -icanon -echo; printf 'ab\033[6n'; IFS= read -r -t 3 -d R reply; printf '\ngot:%s\n' "${reply#?}"`
+	config := &Config{
+		Command:    []string{"bash", "-c", script},
+		UseVTY:     true,
+		RuntimeDir: tmpDir,
+	}
+
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+
+	if startErr := d.Start(); startErr != nil {
+		t.Fatalf("Failed to start daemon: %v", startErr)
+	}
+	defer d.stop()
+
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if !contains(string(content), "got:[1;3") {
+		t.Errorf("Expected cursor position reply in output, got %q", content)
+	}
+}
@@ -0,0 +1,195 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+// DefaultWebhookLines is how many lines of output exit notifications hold
+// by default
+const DefaultWebhookLines = 20
+
+const (
+	// webhookAttempts bounds the deliveries of a notification to a URL
+	webhookAttempts = 4
+
+	// webhookTimeout bounds each delivery
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookRetryDelay is how long a failed delivery waits to be retried,
+// doubled after each attempt
+var webhookRetryDelay = time.Second
+
+// ExitNotification is the JSON payload POSTed to Config.Webhooks once the
+// process exited, or failed to start
+type ExitNotification struct {
+	State      string   `json:"state"` // protocol.StateExited or protocol.StateFailedToStart
+	Command    []string `json:"command"`
+	PID        int      `json:"pid,omitempty"`
+	ExitCode   *int     `json:"exit_code,omitempty"`
+	Signal     int      `json:"signal,omitempty"`      // signal that killed the process, such as 9 for SIGKILL
+	StartError string   `json:"start_error,omitempty"` // why the process could not be started
+	Hostname   string   `json:"hostname,omitempty"`
+	RuntimeDir string   `json:"runtime_dir"`
+
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	EndedAt      time.Time  `json:"ended_at"`
+	DurationSecs float64    `json:"duration_secs"`
+
+	// Output is the last lines of output, of the screen and its scrollback
+	// in VTY mode (Config.WebhookLines)
+	Output []string `json:"output,omitempty"`
+}
+
+// validateWebhooks checks the webhook URLs
+func validateWebhooks(urls []string) error {
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid webhook URL: %w", err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid webhook URL %q: http or https required", u)
+		}
+	}
+	return nil
+}
+
+// exitSignal returns the signal that killed the process, 0 if it exited
+func exitSignal(err error) int {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return int(ws.Signal())
+	}
+	return 0
+}
+
+// exitNotification describes the end of the process, which exited killed
+// by signal if not zero
+func (d *Daemon) exitNotification(signal int) *ExitNotification {
+	status := d.GetStatus()
+	n := &ExitNotification{
+		State:      status.State,
+		Command:    d.config.Command,
+		PID:        status.PID,
+		ExitCode:   status.ExitCode,
+		Signal:     signal,
+		StartError: status.StartError,
+		RuntimeDir: d.runtimeDir,
+		EndedAt:    time.Now(),
+		Output:     d.lastOutputLines(),
+	}
+	n.Hostname, _ = os.Hostname()
+
+	d.mu.RLock()
+	if !d.startedAt.IsZero() {
+		startedAt := d.startedAt
+		n.StartedAt = &startedAt
+		if d.endedAt != nil {
+			n.EndedAt = *d.endedAt
+		}
+		n.DurationSecs = n.EndedAt.Sub(startedAt).Seconds()
+	}
+	d.mu.RUnlock()
+	return n
+}
+
+// lastOutputLines returns the last Config.WebhookLines lines of output
+func (d *Daemon) lastOutputLines() []string {
+	n := d.config.WebhookLines
+	if n == 0 {
+		n = DefaultWebhookLines
+	}
+	if n < 0 {
+		return nil
+	}
+
+	var text string
+	if term := d.terminal(); term != nil {
+		text = term.ExportWithScrollback(termemu.FormatPlainText)
+	} else {
+		d.history.mu.Lock()
+		text = string(d.history.tail(n))
+		d.history.mu.Unlock()
+	}
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines[max(0, len(lines)-n):]
+}
+
+// notifyExit POSTs the exit notification to the webhooks, retrying the
+// deliveries that failed, and returns once they are done
+func (d *Daemon) notifyExit(signal int) {
+	if len(d.config.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(d.exitNotification(signal))
+	if err != nil {
+		d.errorf("Failed to marshal exit notification: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range d.config.Webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer d.recoverPanic("webhook", nil)
+			if err := d.deliverWebhook(u, body); err != nil {
+				d.warnf("Failed to notify %s of the exit: %v", u, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliverWebhook POSTs body to u, retrying on network errors and server
+// errors
+func (d *Daemon) deliverWebhook(u string, body []byte) error {
+	client := http.Client{Timeout: webhookTimeout}
+	delay := webhookRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(u, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < 300:
+				d.debugf("Notified %s of the exit", u)
+				return nil
+			case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+				// The request itself is refused, retrying would not help
+				return fmt.Errorf("%s answered %s", u, resp.Status)
+			}
+			err = fmt.Errorf("%s answered %s", u, resp.Status)
+		}
+		if attempt == webhookAttempts {
+			return err
+		}
+		d.debugf("Exit notification to %s failed (attempt %d/%d): %v", u, attempt, webhookAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-d.closeCh:
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestOutputHistoryTail(t *testing.T) {
+	var h outputHistory
+	for _, data := range []string{"one\ntwo\n", "three\nfo", "ur"} {
+		h.add(&outputChunk{stream: protocol.StreamStdout, data: []byte(data)})
+	}
+	for n, expected := range map[int]string{
+		1:  "four",
+		2:  "three\nfour",
+		10: "one\ntwo\nthree\nfour",
+	} {
+		if got := string(h.tail(n)); got != expected {
+			t.Errorf("Expected the last %d lines to be %q, got %q", n, expected, got)
+		}
+	}
+}
+
+// webhookReceiver collects the exit notifications POSTed to it, answering
+// the first failures with 503
+type webhookReceiver struct {
+	mu            sync.Mutex
+	failures      int
+	attempts      int
+	notifications []ExitNotification
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n ExitNotification
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil || req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.notifications = append(r.notifications, n)
+}
+
+// runNotified runs command with a webhook to r until the daemon is done
+func runNotified(t *testing.T, r *webhookReceiver, command ...string) {
+	t.Helper()
+	oldDelay := webhookRetryDelay
+	webhookRetryDelay = 10 * time.Millisecond
+	defer func() { webhookRetryDelay = oldDelay }()
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	d, err := New(&Config{
+		Command:      command,
+		StdoutMode:   IOModeLog,
+		StderrMode:   IOModeLog,
+		RuntimeDir:   t.TempDir(),
+		Webhooks:     []string{server.URL},
+		WebhookLines: 2,
+		Embedded:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	defer d.Close()
+	if err := d.Start(); err != nil {
+		// Notified of the failed start already
+		return
+	}
+	select {
+	case <-d.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not exit")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	r := &webhookReceiver{failures: 2}
+	runNotified(t, r, "sh", "-c", "echo one; echo two; echo three; exit 3")
+
+	// The notification is delivered by the time the daemon is done
+	if r.attempts != 3 || len(r.notifications) != 1 {
+		t.Fatalf("Expected one notification after 2 failures, got %d in %d attempts", len(r.notifications), r.attempts)
+	}
+	n := r.notifications[0]
+	if n.State != protocol.StateExited || n.ExitCode == nil || *n.ExitCode != 3 || n.Signal != 0 || n.PID == 0 {
+		t.Errorf("Expected the exit with code 3, got %+v", n)
+	}
+	if n.StartedAt == nil || n.DurationSecs <= 0 || n.EndedAt.Before(*n.StartedAt) || n.RuntimeDir == "" {
+		t.Errorf("Expected the times of the run, got %+v", n)
+	}
+	if !slices.Equal(n.Output, []string{"two", "three"}) {
+		t.Errorf("Expected the last 2 lines of output, got %q", n.Output)
+	}
+}
+
+func TestWebhookCrash(t *testing.T) {
+	r := &webhookReceiver{}
+	runNotified(t, r, "sh", "-c", "kill -9 $$")
+	if len(r.notifications) != 1 || r.notifications[0].Signal != 9 {
+		t.Errorf("Expected a notification of the kill, got %+v", r.notifications)
+	}
+
+	r = &webhookReceiver{}
+	runNotified(t, r, "/nonexistent/command")
+	if len(r.notifications) != 1 || r.notifications[0].State != protocol.StateFailedToStart || r.notifications[0].StartError == "" {
+		t.Errorf("Expected a notification of the failed start, got %+v", r.notifications)
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	if _, err := New(&Config{Command: []string{"true"}, Webhooks: []string{"ftp://example.com/"}}); err == nil {
+		t.Error("Expected a webhook that is not HTTP to be refused")
+	}
+}
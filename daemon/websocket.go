@@ -0,0 +1,434 @@
+package daemon
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// WebSocket opcodes, see RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsMaxMessage bounds the messages of the browser, which only sends input
+// and control frames
+const wsMaxMessage = 1 << 20
+
+// wsAcceptGUID is appended to the key of the handshake, see RFC 6455
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebControl is a JSON control frame of the WebSocket bridge. The browser
+// sends "resize" with Rows and Cols, and "stdin" with Data for input typed
+// as text; the bridge sends "exit" with Code, and "error" with Message.
+type WebControl struct {
+	Type    string `json:"type"`
+	Rows    uint16 `json:"rows,omitempty"`
+	Cols    uint16 `json:"cols,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Code    *int   `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// startWebSocketServer starts the HTTP listener of the WebSocket bridge, if
+// configured
+func (d *Daemon) startWebSocketServer() error {
+	if d.config.ListenWebSocket == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", d.config.ListenWebSocket)
+	if err != nil {
+		return fmt.Errorf("failed to create WebSocket listener: %w", err)
+	}
+	if d.tlsConfig != nil {
+		listener = tls.NewListener(listener, d.tlsConfig)
+	}
+
+	d.listenerMu.Lock()
+	d.wsListener = listener
+	d.listenerMu.Unlock()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perms, err := d.webSocketPermissions(r)
+		if err != nil {
+			d.warnf("Rejected WebSocket connection from %s: %v", r.RemoteAddr, err)
+			writeAPIError(w, err)
+			return
+		}
+		d.serveWebSocket(w, r, perms)
+	})}
+	go srv.Serve(listener)
+
+	d.infof("WebSocket bridge listening on %s", listener.Addr())
+
+	return nil
+}
+
+// WebSocketAddr returns the address of the WebSocket bridge, nil without
+// ListenWebSocket
+func (d *Daemon) WebSocketAddr() net.Addr {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	if d.wsListener == nil {
+		return nil
+	}
+	return d.wsListener.Addr()
+}
+
+// webSocketPermissions returns what a client of the WebSocket bridge may
+// do: those authenticated by their certificate or the token are other
+// users, the others only observe, as AllowAnonymous lets them. Browsers cannot set the headers of a
+// WebSocket request, so the token may also be given as the token query
+// parameter.
+func (d *Daemon) webSocketPermissions(r *http.Request) (Permissions, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		// The certificate was verified by the handshake
+		return d.permissionsOf(peerCred{}), nil
+	}
+	if d.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+		if !d.validToken(token) {
+			return 0, &apiError{http.StatusUnauthorized, "missing or invalid token"}
+		}
+		return d.permissionsOf(peerCred{}), nil
+	}
+	if err := d.authorize(peerCred{}); err != nil {
+		return 0, &apiError{http.StatusForbidden, err.Error()}
+	}
+	return PermObserve, nil
+}
+
+// allowedOrigin tells whether a page of origin may connect: pages served
+// by the same host as the bridge and those configured. Browsers always send
+// the origin of a WebSocket request, so requests without one are refused.
+func (d *Daemon) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	if slices.Contains(d.config.WebSocketOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// serveWebSocket bridges a WebSocket connection to the process. It is a
+// client like any other, which may do perms, attached to both streams from
+// the start of the output history so that the terminal of the browser draws
+// the screen.
+func (d *Daemon) serveWebSocket(w http.ResponseWriter, r *http.Request, perms Permissions) {
+	if !d.allowedOrigin(r) {
+		d.warnf("Rejected WebSocket connection from %s: origin %s not allowed", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	bridge, conn := net.Pipe()
+	defer bridge.Close()
+	d.addClient(conn, peerCred{remote: "websocket@" + r.RemoteAddr}, perms)
+
+	if err := protocol.WriteAttach(bridge, &protocol.AttachRequest{Streams: protocol.StreamBoth, Resume: true}); err != nil {
+		return
+	}
+	go d.forwardToWebSocket(bridge, ws)
+
+	for {
+		op, data, err := ws.readMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !isNormalDisconnect(err) {
+				d.debugf("WebSocket read error from %s: %v", r.RemoteAddr, err)
+			}
+			return
+		}
+		if op == wsBinary {
+			err = protocol.WriteMessage(bridge, protocol.MsgStdin, data)
+		} else {
+			err = d.webControl(bridge, data)
+		}
+		if err != nil {
+			ws.writeJSON(&WebControl{Type: "error", Message: err.Error()})
+		}
+	}
+}
+
+// webControl handles a JSON control frame of the browser
+func (d *Daemon) webControl(bridge net.Conn, data []byte) error {
+	var ctl WebControl
+	if err := json.Unmarshal(data, &ctl); err != nil {
+		return fmt.Errorf("invalid control frame: %w", err)
+	}
+	switch ctl.Type {
+	case "resize":
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint16(payload[0:2], ctl.Rows)
+		binary.BigEndian.PutUint16(payload[2:4], ctl.Cols)
+		return protocol.WriteMessage(bridge, protocol.MsgResize, payload)
+	case "stdin":
+		return protocol.WriteMessage(bridge, protocol.MsgStdin, []byte(ctl.Data))
+	}
+	return fmt.Errorf("unknown control frame type %q", ctl.Type)
+}
+
+// forwardToWebSocket sends the output of the process to the browser as
+// binary frames, and the exit of the process and the errors of the daemon
+// as control frames
+func (d *Daemon) forwardToWebSocket(bridge net.Conn, ws *wsConn) {
+	defer ws.Close()
+
+	for {
+		msg, err := protocol.ReadMessage(bridge)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgOutputAt:
+			_, _, data, err := protocol.ParseOutputAt(msg.Payload)
+			if err == nil {
+				err = ws.writeFrame(wsBinary, data)
+			}
+		case protocol.MsgOutput:
+			_, data, err := protocol.ParseOutput(msg.Payload)
+			if err == nil {
+				err = ws.writeFrame(wsBinary, data)
+			}
+		case protocol.MsgProcessExit:
+			code, perr := protocol.ParseProcessExit(msg.Payload)
+			if perr != nil {
+				return
+			}
+			ws.writeJSON(&WebControl{Type: "exit", Code: &code})
+			ws.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000, normal closure
+			return
+		case protocol.MsgError, protocol.MsgQuotaExceeded:
+			err = ws.writeJSON(&WebControl{Type: "error", Message: string(msg.Payload)})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wsConn is the server side of a WebSocket connection
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// upgradeWebSocket completes the WebSocket handshake of r, or answers it
+// with an error
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerHasToken(r.Header, "Connection", "upgrade") {
+		http.Error(w, "WebSocket connections only", http.StatusUpgradeRequired)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// headerHasToken tells whether a comma-separated header holds token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering pings on
+// the way. It returns io.EOF once the browser closed the connection.
+func (ws *wsConn) readMessage() (byte, []byte, error) {
+	var op byte
+	var msg []byte
+	for {
+		fin, frameOp, data, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOp {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			ws.writeFrame(wsClose, data)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if op == 0 {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if op != 0 {
+				return 0, nil, errors.New("unfinished fragmented message")
+			}
+			op = frameOp
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode 0x%X", frameOp)
+		}
+
+		if len(msg)+len(data) > wsMaxMessage {
+			return 0, nil, fmt.Errorf("message larger than %d bytes", wsMaxMessage)
+		}
+		msg = append(msg, data...)
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// readFrame reads a frame of the browser, which must be masked
+func (ws *wsConn) readFrame() (fin bool, op byte, data []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0F
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("reserved bits set")
+	}
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, fmt.Errorf("frame larger than %d bytes", wsMaxMessage)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	data = make([]byte, length)
+	if _, err := io.ReadFull(ws.r, data); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	return fin, op, data, nil
+}
+
+// writeFrame sends a whole message in a single unmasked frame
+func (ws *wsConn) writeFrame(op byte, data []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op
+	switch {
+	case len(data) < 126:
+		hdr[1] = byte(len(data))
+	case len(data) <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(data)))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(data)))
+	}
+
+	bufs := net.Buffers{hdr, data}
+	_, err := bufs.WriteTo(ws.conn)
+	if op == wsClose {
+		ws.closed = true
+	}
+	return err
+}
+
+// writeJSON sends a control frame
+func (ws *wsConn) writeJSON(ctl *WebControl) error {
+	data, err := json.Marshal(ctl)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, data)
+}
+
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens a WebSocket connection to path as a browser on origin
+// would
+func dialWebSocket(t *testing.T, addr, path, origin string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nOrigin: %s\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", path, addr, origin)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Failed to read the handshake: %v", err)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols && resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected Sec-WebSocket-Accept %q", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return conn, r, resp.StatusCode
+}
+
+// writeClientFrame sends a masked frame, as browsers do
+func writeClientFrame(conn net.Conn, op byte, data []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(data))}
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// readServerFrame reads an unmasked frame of the bridge
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return hdr[0] & 0x0F, data, err
+}
+
+func TestWebSocketBridge(t *testing.T) {
+	tmpDir := t.TempDir()
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Command:          []string{"bash", "-c", "read line; echo \"got $line\"; read line; exit 3"},
+		StdinMode:        StdinStream,
+		StdoutMode:       IOModeLog,
+		StderrMode:       IOModeLog,
+		RuntimeDir:       tmpDir,
+		ListenWebSocket:  "127.0.0.1:0",
+		WebSocketOrigins: []string{"https://term.example"},
+		TokenFile:        tokenFile,
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	addr := d.WebSocketAddr().String()
+
+	// Pages of other sites may not drive the process, nor clients without
+	// an origin or the token
+	for _, tc := range []struct {
+		path, origin string
+		status       int
+	}{
+		{"/term?token=s3cret", "https://evil.example", http.StatusForbidden},
+		{"/term?token=s3cret", "", http.StatusForbidden},
+		{"/term", "https://term.example", http.StatusUnauthorized},
+		{"/term?token=guess", "https://term.example", http.StatusUnauthorized},
+	} {
+		conn, _, status := dialWebSocket(t, addr, tc.path, tc.origin)
+		conn.Close()
+		if status != tc.status {
+			t.Errorf("Expected %s from %q to be refused with %d, got status %d", tc.path, tc.origin, tc.status, status)
+		}
+	}
+
+	conn, r, status := dialWebSocket(t, addr, "/term?token=s3cret", "https://term.example")
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the handshake to succeed, got status %d", status)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Input as a binary frame, and as a control frame
+	if err := writeClientFrame(conn, wsBinary, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeClientFrame(conn, wsText, []byte(`{"type":"resize","rows":24,"cols":80}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the process answered and the resize failed, end it with more
+	// input, which comes in any order with the output
+	var output strings.Builder
+	var controls []WebControl
+	sent := false
+	for {
+		op, data, err := readServerFrame(r)
+		if err != nil {
+			t.Fatalf("Failed to read a frame: %v (output %q, controls %+v)", err, output.String(), controls)
+		}
+		if op == wsClose {
+			break
+		}
+		if op == wsBinary {
+			output.Write(data)
+		} else {
+			var ctl WebControl
+			if err := json.Unmarshal(data, &ctl); err != nil {
+				t.Fatalf("Invalid control frame %q: %v", data, err)
+			}
+			controls = append(controls, ctl)
+		}
+		if !sent && strings.Contains(output.String(), "got hello") && len(controls) > 0 {
+			writeClientFrame(conn, wsText, []byte(`{"type":"stdin","data":"bye\n"}`))
+			sent = true
+		}
+	}
+
+	if !strings.Contains(output.String(), "got hello") {
+		t.Errorf("Expected the output of the process, got %q", output.String())
+	}
+	if len(controls) != 2 || controls[0].Type != "error" || !strings.Contains(controls[0].Message, "VTY") {
+		t.Errorf("Expected the resize to fail without VTY, got %+v", controls)
+	}
+	if last := controls[len(controls)-1]; last.Type != "exit" || last.Code == nil || *last.Code != 3 {
+		t.Errorf("Expected the exit code of the process, got %+v", last)
+	}
+}
+
+func TestWebSocketObserveOnly(t *testing.T) {
+	config := &Config{
+		Command:         []string{"bash", "-c", "echo ready; read line; echo \"got $line\"; sleep 10"},
+		StdinMode:       StdinStream,
+		StdoutMode:      IOModeLog,
+		StderrMode:      IOModeLog,
+		RuntimeDir:      t.TempDir(),
+		ListenWebSocket: "127.0.0.1:0",
+	}
+	if _, err := New(config); err == nil {
+		t.Fatal("Expected an anonymous WebSocket bridge to be refused without AllowAnonymous")
+	}
+	config.AllowAnonymous = true
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+
+	// Without a token or certificates, browsers see the output but may not
+	// type into the process
+	conn, r, status := dialWebSocket(t, d.WebSocketAddr().String(), "/term", "http://"+d.WebSocketAddr().String())
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the handshake to succeed, got status %d", status)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := writeClientFrame(conn, wsBinary, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	var output strings.Builder
+	for {
+		op, data, err := readServerFrame(r)
+		if err != nil {
+			t.Fatalf("Failed to read a frame: %v (output %q)", err, output.String())
+		}
+		if op == wsBinary {
+			output.Write(data)
+			continue
+		}
+		var ctl WebControl
+		if err := json.Unmarshal(data, &ctl); err != nil {
+			t.Fatalf("Invalid control frame %q: %v", data, err)
+		}
+		if ctl.Type != "error" || !strings.Contains(ctl.Message, "permission denied") {
+			t.Errorf("Expected the input to be denied, got %+v", ctl)
+		}
+		break
+	}
+	if strings.Contains(output.String(), "got hello") {
+		t.Errorf("Expected the input not to reach the process, got %q", output.String())
+	}
+}
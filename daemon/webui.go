@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+
+	"github.com/KarpelesLab/bgrun/termemu"
+)
+
+//go:embed webui
+var webUIAssets embed.FS
+
+// webExportFormats maps the formats of the export links of the web UI to
+// the formats of the emulator, with the extension of the download
+var webExportFormats = map[string]struct {
+	format     termemu.ExportFormat
+	ext, ctype string
+}{
+	"text":     {termemu.FormatPlainText, "txt", "text/plain; charset=utf-8"},
+	"markdown": {termemu.FormatMarkdown, "md", "text/markdown; charset=utf-8"},
+	"html":     {termemu.FormatHTML, "html", "text/html; charset=utf-8"},
+	"ansi":     {termemu.FormatANSI, "ans", "text/plain; charset=utf-8"},
+}
+
+// startWebUIServer starts the HTTP listener of the web UI, if configured
+func (d *Daemon) startWebUIServer() error {
+	if d.config.ListenWebUI == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", d.config.ListenWebUI)
+	if err != nil {
+		return fmt.Errorf("failed to create web UI listener: %w", err)
+	}
+
+	d.listenerMu.Lock()
+	d.webListener = listener
+	d.listenerMu.Unlock()
+
+	srv := &http.Server{Handler: d.webUIHandler()}
+	go srv.Serve(listener)
+
+	d.infof("Web UI listening on http://%s/", listener.Addr())
+
+	return nil
+}
+
+// WebUIAddr returns the address of the web UI, nil without ListenWebUI
+func (d *Daemon) WebUIAddr() net.Addr {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	if d.webListener == nil {
+		return nil
+	}
+	return d.webListener.Addr()
+}
+
+// webUIHandler serves the page of the web UI and what it asks for. Its
+// visitors only observe: the live view goes through the WebSocket bridge
+// with no other permission.
+func (d *Daemon) webUIHandler() http.Handler {
+	assets, _ := fs.Sub(webUIAssets, "webui")
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(assets))
+	mux.HandleFunc("GET /status", d.serveWebStatus)
+	mux.HandleFunc("GET /screen", d.serveWebScreen)
+	mux.HandleFunc("GET /export", d.serveWebExport)
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+		d.serveWebSocket(w, r, PermObserve)
+	})
+	return mux
+}
+
+// serveWebStatus answers the status of the process, as STATUS does but for
+// the clients, which are none of the business of the visitors
+func (d *Daemon) serveWebStatus(w http.ResponseWriter, r *http.Request) {
+	status := d.GetStatus()
+	status.Clients = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveWebScreen answers the screen as an HTML page, which the live view
+// reloads whenever the process prints (VTY only)
+func (d *Daemon) serveWebScreen(w http.ResponseWriter, r *http.Request) {
+	content, err := d.webExport(termemu.ExportOptions{Format: termemu.FormatHTML, EndLine: -1})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(content))
+}
+
+// serveWebExport downloads the screen and scrollback in the format given by
+// the format parameter: text, markdown, html or ansi (VTY only)
+func (d *Daemon) serveWebExport(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("format")
+	format, ok := webExportFormats[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown export format %q", name), http.StatusBadRequest)
+		return
+	}
+	content, err := d.webExport(termemu.ExportOptions{Format: format.format, IncludeScrollback: true, EndLine: -1})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", format.ctype)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "session."+format.ext))
+	w.Write([]byte(content))
+}
+
+// webExport exports the terminal as EXPORT does
+func (d *Daemon) webExport(opts termemu.ExportOptions) (string, error) {
+	term, err := d.screenTerminal()
+	if err != nil {
+		return "", err
+	}
+	return term.Export(opts), nil
+}
@@ -0,0 +1,106 @@
+// Live view of a bgrun session. The output comes from the WebSocket bridge:
+// in VTY mode it only tells that the screen changed, which the daemon
+// renders, otherwise it is shown as is.
+(function () {
+  "use strict";
+
+  var screen = document.getElementById("screen");
+  var message = document.getElementById("message");
+  var stateEl = document.getElementById("state");
+  var vty = false;
+  var decoder = new TextDecoder();
+  var maxText = 1 << 20;
+
+  function setState(state, label) {
+    stateEl.textContent = label || state.replace(/_/g, " ");
+    stateEl.className = "state " + state;
+  }
+
+  function showStatus(status) {
+    document.getElementById("command").textContent = status.command.join(" ");
+    document.getElementById("title").textContent = status.title || "";
+    var state = status.state || (status.running ? "running" : "exited");
+    if (status.paused) {
+      setState(state, "paused");
+    } else if (state === "exited" && status.exit_code !== null) {
+      setState(state, "exited (" + status.exit_code + ")");
+    } else {
+      setState(state);
+    }
+    if (status.start_error) {
+      message.textContent = status.start_error;
+    }
+    vty = status.has_vty;
+    document.getElementById("exports").hidden = !vty;
+    document.getElementById("download").hidden = vty;
+  }
+
+  function refreshStatus() {
+    return fetch("status").then(function (r) { return r.json(); }).then(showStatus);
+  }
+
+  // Screen reloads are spaced out, a busy program printing continuously
+  var screenTimer = null;
+  function scheduleScreen() {
+    if (screenTimer === null) {
+      screenTimer = setTimeout(function () {
+        screenTimer = null;
+        fetch("screen").then(function (r) { return r.text(); }).then(function (html) {
+          var doc = new DOMParser().parseFromString(html, "text/html");
+          var pre = doc.querySelector("pre");
+          if (pre) {
+            screen.innerHTML = pre.innerHTML;
+          }
+        });
+      }, 100);
+    }
+  }
+
+  function appendText(data) {
+    var text = decoder.decode(data, { stream: true });
+    // Escape sequences of programs not run in a terminal are dropped
+    text = text.replace(/\x1b\[[0-9;?]*[ -\/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\r(?!\n)/g, "");
+    var atBottom = window.innerHeight + window.scrollY >= document.body.scrollHeight - 2;
+    screen.textContent = (screen.textContent + text).slice(-maxText);
+    if (atBottom) {
+      window.scrollTo(0, document.body.scrollHeight);
+    }
+  }
+
+  document.getElementById("save").addEventListener("click", function (e) {
+    e.target.href = URL.createObjectURL(new Blob([screen.textContent], { type: "text/plain" }));
+    e.target.download = "output.txt";
+  });
+
+  function connect() {
+    var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + location.pathname.replace(/[^\/]*$/, "") + "ws");
+    ws.binaryType = "arraybuffer";
+    ws.onmessage = function (e) {
+      if (typeof e.data !== "string") {
+        if (vty) {
+          scheduleScreen();
+        } else {
+          appendText(e.data);
+        }
+        return;
+      }
+      var ctl = JSON.parse(e.data);
+      if (ctl.type === "exit") {
+        refreshStatus();
+      } else if (ctl.type === "error") {
+        message.textContent = ctl.message;
+      }
+    };
+    ws.onclose = function () {
+      refreshStatus().catch(function () { setState("disconnected"); });
+    };
+  }
+
+  refreshStatus().then(function () {
+    if (vty) {
+      scheduleScreen();
+    }
+    connect();
+  }).catch(function () { setState("disconnected"); });
+  setInterval(function () { refreshStatus().catch(function () { setState("disconnected"); }); }, 5000);
+})();
@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestWebUI(t *testing.T) {
+	config := &Config{
+		Command:     []string{"bash", "-c", "printf 'hello from the web\\n'; sleep 10"},
+		StdinMode:   StdinStream,
+		StdoutMode:  IOModeLog,
+		StderrMode:  IOModeLog,
+		UseVTY:      true,
+		RuntimeDir:  t.TempDir(),
+		ListenWebUI: "127.0.0.1:0",
+	}
+	d, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer d.stop()
+	addr := d.WebUIAddr().String()
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	if resp, body := get("/"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "app.js") {
+		t.Errorf("Expected the page, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := get("/app.js"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the script, got %d", resp.StatusCode)
+	}
+
+	var status protocol.StatusResponse
+	_, body := get("/status")
+	if err := json.Unmarshal([]byte(body), &status); err != nil || !status.Running || !status.HasVTY {
+		t.Errorf("Expected the status of the running process, got %q, %v", body, err)
+	}
+
+	// The screen is rendered once the program printed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, body := get("/screen")
+		if strings.Contains(body, "hello from the web") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the screen, got %q", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	resp, body := get("/export?format=text")
+	if !strings.Contains(body, "hello from the web") || !strings.Contains(resp.Header.Get("Content-Disposition"), "session.txt") {
+		t.Errorf("Expected a text export to download, got %q with %v", body, resp.Header)
+	}
+	if resp, _ := get("/export?format=pdf"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown format to be refused, got %d", resp.StatusCode)
+	}
+
+	// Visitors only observe
+	conn, r, code := dialWebSocket(t, addr, "/ws", "http://"+addr)
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the handshake to succeed, got status %d", code)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeClientFrame(conn, wsBinary, []byte("exit\n"))
+	for {
+		op, data, err := readServerFrame(r)
+		if err != nil {
+			t.Fatalf("Expected stdin to be refused: %v", err)
+		}
+		if op == wsText {
+			if !strings.Contains(string(data), "permission denied") {
+				t.Errorf("Expected stdin to be refused, got %s", data)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/storage"
+	"github.com/KarpelesLab/bgrun/terminal"
+)
+
+var (
+	// ansiPattern matches CSI, OSC and two-byte escape sequences
+	ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+	// timestampPattern matches ISO 8601 style date/times, dates and times of day
+	timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?|\b\d{2}:\d{2}:\d{2}(?:[.,]\d+)?\b`)
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// maxDiffCells bounds the LCS table; larger inputs fall back to a coarse diff
+const maxDiffCells = 16 << 20
+
+// diffOp is a single line of a line-based diff
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+func cmdDiffOutput(pidA, pidB int) (bool, error) {
+	a, err := runOutput(pidA)
+	if err != nil {
+		return false, fmt.Errorf("run %d: %w", pidA, err)
+	}
+	b, err := runOutput(pidB)
+	if err != nil {
+		return false, fmt.Errorf("run %d: %w", pidB, err)
+	}
+
+	ops := diffLines(normalizeOutput(a), normalizeOutput(b))
+	color := terminal.IsTerminal(int(os.Stdout.Fd()))
+	return writeUnifiedDiff(os.Stdout, fmt.Sprintf("run %d", pidA), fmt.Sprintf("run %d", pidB), ops, color), nil
+}
+
+// runOutput returns the output of a run: the terminal export for live VTY
+// jobs, output.log otherwise
+func runOutput(pid int) ([]byte, error) {
+	c, err := bgclient.New(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if c.IsZombie() {
+		return c.ReadOutput()
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	if status.HasVTY {
+		text, err := c.ExportPlainText(true)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	}
+
+	data, err := c.Storage().ReadFile(daemon.LogFileName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read output log: %w", err)
+	}
+	if storage.IsEncrypted(data) {
+		return nil, storage.ErrEncrypted
+	}
+	return data, nil
+}
+
+// normalizeOutput strips escape sequences, resolves carriage-return
+// overwrites and replaces timestamps so that two runs can be compared
+func normalizeOutput(data []byte) []string {
+	text := ansiPattern.ReplaceAllString(string(data), "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return nil
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		// Keep what would remain visible after a progress-style rewrite
+		if idx := strings.LastIndexByte(line, '\r'); idx >= 0 {
+			line = line[idx+1:]
+		}
+		line = timestampPattern.ReplaceAllString(line, "<TIMESTAMP>")
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return lines
+}
+
+// diffLines computes a line diff of a and b using a longest common
+// subsequence over the lines between their common prefix and suffix
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(ma)+1)*(len(mb)+1) > maxDiffCells {
+		for _, line := range ma {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range mb {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of ma[i:] and mb[j:]
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(ma) && j < len(mb) {
+			switch {
+			case ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, diffOp{'-', ma[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j]})
+				j++
+			}
+		}
+		for ; i < len(ma); i++ {
+			ops = append(ops, diffOp{'-', ma[i]})
+		}
+		for ; j < len(mb); j++ {
+			ops = append(ops, diffOp{'+', mb[j]})
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes ops as a unified diff and reports whether there
+// were any differences
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, ops []diffOp, color bool) bool {
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// Line numbers in a and b at the start of each op
+	lineA, lineB := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		lineA[i+1], lineB[i+1] = lineA[i], lineB[i]
+		if op.kind != '+' {
+			lineA[i+1]++
+		}
+		if op.kind != '-' {
+			lineB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk while changes are within 2*diffContext of each other
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = next
+		}
+
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n",
+			lineA[start]+1, lineA[end]-lineA[start], lineB[start]+1, lineB[end]-lineB[start])
+		for _, op := range ops[start:end] {
+			switch {
+			case color && op.kind == '-':
+				fmt.Fprintf(w, "\x1b[31m-%s\x1b[0m\n", op.text)
+			case color && op.kind == '+':
+				fmt.Fprintf(w, "\x1b[32m+%s\x1b[0m\n", op.text)
+			default:
+				fmt.Fprintf(w, "%c%s\n", op.kind, op.text)
+			}
+		}
+		i = end
+	}
+	return true
+}
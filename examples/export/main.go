@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/KarpelesLab/bgrun/internal/demo"
 	"github.com/KarpelesLab/bgrun/termemu"
 )
 
@@ -33,38 +34,32 @@ func main() {
 	fmt.Println("=== EXPORT EXAMPLES ===")
 
 	// Example 1: Export current screen as plain text
-	fmt.Println("1. Plain Text Export (Current Screen):")
-	fmt.Println("---------------------------------------")
+	demo.Heading("1. Plain Text Export (Current Screen):")
 	plainText := term.ExportCurrentScreen(termemu.FormatPlainText)
 	fmt.Println(plainText)
 
 	// Example 2: Export as Markdown
-	fmt.Println("\n2. Markdown Export (Current Screen):")
-	fmt.Println("-------------------------------------")
+	demo.Heading("2. Markdown Export (Current Screen):")
 	markdown := term.ExportCurrentScreen(termemu.FormatMarkdown)
 	fmt.Println(markdown)
 
 	// Example 3: Export specific range
-	fmt.Println("\n3. Range Export (Lines 0-2):")
-	fmt.Println("-----------------------------")
+	demo.Heading("3. Range Export (Lines 0-2):")
 	rangeExport := term.ExportRange(termemu.FormatPlainText, 0, 2, false)
 	fmt.Println(rangeExport)
 
 	// Example 4: Export with scrollback
-	fmt.Println("\n4. Export with Scrollback (first 5 lines):")
-	fmt.Println("-------------------------------------------")
+	demo.Heading("4. Export with Scrollback (first 5 lines):")
 	withScrollback := term.ExportRange(termemu.FormatPlainText, 0, 4, true)
 	fmt.Println(withScrollback)
 
 	// Example 5: Export as HTML
-	fmt.Println("\n5. HTML Export:")
-	fmt.Println("---------------")
+	demo.Heading("5. HTML Export:")
 	html := term.ExportCurrentScreen(termemu.FormatHTML)
 	fmt.Println(html)
 
 	// Example 6: Custom export with options
-	fmt.Println("\n6. Custom Export with Options:")
-	fmt.Println("-------------------------------")
+	demo.Heading("6. Custom Export with Options:")
 	customExport := term.Export(termemu.ExportOptions{
 		Format:                 termemu.FormatMarkdown,
 		IncludeScrollback:      false,
@@ -74,11 +69,12 @@ func main() {
 	})
 	fmt.Println(customExport)
 
-	fmt.Println("\n=== EXPORT FEATURES ===")
-	fmt.Println("✓ Plain Text - Clean text output")
-	fmt.Println("✓ Markdown - With clickable hyperlinks preserved")
-	fmt.Println("✓ HTML - Styled output with hyperlinks and proper escaping")
-	fmt.Println("✓ Range Selection - Export specific line ranges")
-	fmt.Println("✓ Scrollback Support - Include or exclude scrollback buffer")
-	fmt.Println("✓ Trailing Space Control - Preserve or trim trailing spaces")
+	demo.Features("EXPORT FEATURES",
+		"Plain Text - Clean text output",
+		"Markdown - With clickable hyperlinks preserved",
+		"HTML - Styled output with hyperlinks and proper escaping",
+		"Range Selection - Export specific line ranges",
+		"Scrollback Support - Include or exclude scrollback buffer",
+		"Trailing Space Control - Preserve or trim trailing spaces",
+	)
 }
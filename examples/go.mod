@@ -0,0 +1,13 @@
+module github.com/KarpelesLab/bgrun/examples
+
+go 1.24.6
+
+require github.com/KarpelesLab/bgrun v0.0.0
+
+require (
+	github.com/creack/pty v1.1.24 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+)
+
+// The examples always build against the bgrun source tree they ship with
+replace github.com/KarpelesLab/bgrun => ../
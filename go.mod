@@ -3,7 +3,7 @@ module github.com/KarpelesLab/bgrun
 go 1.24.6
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	golang.org/x/sys v0.37.0 // indirect
-	golang.org/x/term v0.36.0 // indirect
+	github.com/creack/pty v1.1.24
+	golang.org/x/sys v0.37.0
+	golang.org/x/term v0.36.0
 )
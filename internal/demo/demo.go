@@ -0,0 +1,72 @@
+// Package demo holds the helpers shared by the programs in examples/. It is
+// internal so that the demo code never becomes part of the public API, and
+// the examples live in their own module so that building or installing
+// bgrun does not compile them.
+package demo
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+)
+
+// Heading prints title underlined with dashes, after a blank line
+func Heading(title string) {
+	fmt.Println()
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("-", utf8.RuneCountInString(title)))
+}
+
+// Features prints a list of features under a banner
+func Features(title string, features ...string) {
+	fmt.Printf("\n=== %s ===\n", title)
+	for _, feature := range features {
+		fmt.Println("✓ " + feature)
+	}
+}
+
+// StartDaemon runs config in a daemon using a temporary runtime directory and
+// returns a client connected to it. The returned function closes the client
+// and removes the runtime directory.
+func StartDaemon(config *daemon.Config) (*bgclient.Client, func(), error) {
+	tmpDir, err := os.MkdirTemp("", "bgrun-demo-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	config.RuntimeDir = tmpDir
+
+	d, err := daemon.New(config)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, fmt.Errorf("failed to create daemon: %w", err)
+	}
+	if err := d.Start(); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	// Wait for the socket to be ready
+	socketPath := d.SocketPath()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := bgclient.Connect(socketPath)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	return c, func() {
+		c.Close()
+		os.RemoveAll(tmpDir)
+	}, nil
+}
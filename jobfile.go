@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// listFlag is a flag that may be repeated, collecting its values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// jobFileExcluded are the flags a job file may not set, not being daemon
+// options
+var jobFileExcluded = []string{"background", "c", "config", "ctl", "pid", "json", "all-users", "help", "restore"}
+
+// loadJobFile applies a JSON job file to the flags of fs not set on the
+// command line, and returns its command. The file is an object whose
+// "command" is the command and "env" an object of the variables added to
+// the environment, the other keys being daemon flags without their dash,
+// such as {"vty": true, "stdout": "/tmp/out.log", "rlimit": ["nofile=1024"]}:
+// lists give the comma-separated values of a flag, or the values of a
+// repeatable one. The command and shell of the file are ignored when the
+// command line gives one, the values of repeatable flags coming first.
+func loadJobFile(path string, fs *flag.FlagSet, hasCommand bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job map[string]json.RawMessage
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var command []string
+	for name, raw := range job {
+		switch {
+		case name == "command":
+			if hasCommand {
+				continue
+			}
+			if err := json.Unmarshal(raw, &command); err != nil {
+				return nil, fmt.Errorf("%s: command: a list of strings is required", path)
+			}
+		case name == "env":
+			var env map[string]string
+			if err := json.Unmarshal(raw, &env); err != nil {
+				return nil, fmt.Errorf("%s: env: an object of strings is required", path)
+			}
+			keys := make([]string, 0, len(env))
+			for k := range env {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			// Flags come after the file, replacing its variables
+			vars := make([]string, 0, len(keys))
+			for _, k := range keys {
+				vars = append(vars, k+"="+env[k])
+			}
+			envFlag = append(vars, envFlag...)
+		case name == "shell" && hasCommand:
+			// Overridden by the command line
+		default:
+			f := fs.Lookup(name)
+			if f == nil || slices.Contains(jobFileExcluded, name) {
+				return nil, fmt.Errorf("%s: unknown option %q", path, name)
+			}
+			if list, ok := f.Value.(*listFlag); ok {
+				// Repeated flags come after the values of the file
+				var values []string
+				if err := json.Unmarshal(raw, &values); err != nil {
+					return nil, fmt.Errorf("%s: %s: a list of strings is required", path, name)
+				}
+				*list = append(values, *list...)
+				continue
+			}
+			if set[name] {
+				// Overridden by the command line
+				continue
+			}
+			value, err := jobFileValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+			if err := f.Value.Set(value); err != nil {
+				return nil, fmt.Errorf("%s: invalid %s: %w", path, name, err)
+			}
+		}
+	}
+	return command, nil
+}
+
+// jobFileValue returns the flag value of a JSON value of a job file
+func jobFileValue(raw json.RawMessage) (string, error) {
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("a list of strings is required")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("a string, number, boolean or list is required")
+}
@@ -2,39 +2,125 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/control"
 	"github.com/KarpelesLab/bgrun/daemon"
-	"github.com/KarpelesLab/bgrun/protocol"
-	"github.com/KarpelesLab/bgrun/terminal"
 )
 
 var (
 	// Daemon mode flags
-	stdinFlag      = flag.String("stdin", "null", "stdin mode: null, stream, or file path")
-	stdoutFlag     = flag.String("stdout", "log", "stdout mode: null, log, or file path")
-	stderrFlag     = flag.String("stderr", "log", "stderr mode: null, log, or file path")
+	stdinFlag      = flag.String("stdin", "null", "stdin mode: null, stream, stream:<path>, or file path")
+	stdoutFlag     = flag.String("stdout", "log", "stdout mode: null, log, syslog, journal, |command, or file path")
+	stderrFlag     = flag.String("stderr", "log", "stderr mode: null, log, syslog, journal, |command, or file path")
 	vtyFlag        = flag.Bool("vty", false, "run in VTY mode")
+	recordFlag     = flag.Bool("record", false, "record the terminal session as an asciinema v2 file (VTY mode)")
+	strictFlag     = flag.Bool("strict", false, "fail screen/export requests once the program used escape sequences the emulator does not support (VTY mode)")
+	sizeFlag       = flag.String("size-policy", "latest", "terminal size when several clients resize it: latest, smallest, or a fixed <cols>x<rows> (VTY mode)")
+	utf8Flag       = flag.Bool("utf8-chunks", false, "never split a UTF-8 sequence across output messages")
+	replayFlag     = flag.Bool("replay-screen", false, "answer screen/export requests without VTY by replaying output.log through a terminal emulator")
 	backgroundFlag = flag.Bool("background", false, "run daemon in background")
+	shellFlag      = flag.String("shell", "", "shell command line to run with $SHELL -c, instead of a command")
+	dirFlag        = flag.String("dir", "", "working directory for the command (default: current directory)")
+	previousFlag   = flag.String("previous-run", "", "runtime directory of the run this one replaces")
+	logKeyFlag     = flag.String("log-key-file", "", "file holding the key to encrypt output.log with (default: $BGRUN_LOG_KEY)")
+	signKeyFlag    = flag.String("sign-key", "", "PEM private key to sign status.json and output.log digests with at exit")
+	quotaStdinFlag = flag.Int64("quota-stdin", 0, "maximum stdin bytes a single client may send (0: unlimited)")
+	quotaExpFlag   = flag.Int64("quota-export", 0, "maximum screen/export bytes a single client may request per minute (0: unlimited)")
+	logLevelFlag   = flag.String("log-level", "info", "level of the daemon log: debug, info, warn or error")
+	logMaxFlag     = flag.Int64("log-max-size", 0, "size daemon.log is rotated at (0: 1 MiB)")
+	outputMaxFlag  = flag.Int64("output-max-size", 0, "bytes of output written to output.log, keeping its start and end (0: unlimited)")
+	outputRateFlag = flag.Int64("output-rate", 0, "bytes of output per second read from the process, throttling it beyond (0: unlimited)")
+	socketFlag     = flag.String("socket", "", "path of the control socket, linked from the runtime directory")
+	sockModeFlag   = flag.String("socket-mode", "", "permissions of the control socket, in octal (default: 0600)")
+	sockGroupFlag  = flag.String("socket-group", "", "group of the control socket")
+	allowUIDFlag   = flag.String("allow-uid", "", "comma-separated users allowed to connect, by name or ID (default: anyone able to)")
+	allowGIDFlag   = flag.String("allow-gid", "", "comma-separated groups whose members may connect, by name or ID")
+	permsFlag      = flag.String("permissions", "", "what clients of other users may do: comma-separated observe, stdin, signal, shutdown (default: all)")
+	listenFlag     = flag.String("listen", "", "TCP address to also serve the control protocol on, over TLS")
+	tlsCertFlag    = flag.String("tls-cert", "", "PEM certificate of the TLS listener")
+	tlsKeyFlag     = flag.String("tls-key", "", "PEM private key of the TLS listener")
+	tlsCAFlag      = flag.String("tls-client-ca", "", "PEM CA the certificates of TLS clients must be signed by")
+	tokenFileFlag  = flag.String("token-file", "", "file holding the bearer token of the REST API and WebSocket bridge over TCP")
+	listenWSFlag   = flag.String("listen-ws", "", "HTTP address to serve a WebSocket bridge for web terminals on")
+	wsOriginFlag   = flag.String("ws-origin", "", "comma-separated origins of the pages allowed to use the WebSocket bridge, besides its own host")
+	listenWebFlag  = flag.String("listen-web", "", "HTTP address to serve a read-only web view of the session on")
+	apiFlag        = flag.String("api", "", "address of a REST API: unix:/path or host:port")
+	anonymousFlag  = flag.Bool("allow-anonymous", false, "let clients of -listen-ws and of -api over TCP observe without a certificate or token")
+	facilityFlag   = flag.String("syslog-facility", "", "syslog facility of syslog and journal output (default: user)")
+	tagFlag        = flag.String("syslog-tag", "", "tag of syslog and journal output (default: program name)")
+	keepLogFlag    = flag.Bool("keep-log", false, "also write syslog and journal output to output.log")
+	cgroupFlag     = flag.Bool("cgroup", false, "run the process in a cgroup v2 of its own, implied by the limits (Linux only)")
+	cgParentFlag   = flag.String("cgroup-parent", "", "cgroup to create the one of the process in (default: the cgroup of the daemon)")
+	cpuWeightFlag  = flag.Int("cpu-weight", 0, "cpu.weight of the cgroup of the process, from 1 to 10000 (default: 100)")
+	memoryMaxFlag  = flag.Int64("memory-max", 0, "memory.max of the cgroup of the process, in bytes (0: unlimited)")
+	pidsMaxFlag    = flag.Int64("pids-max", 0, "pids.max of the cgroup of the process (0: unlimited)")
+	rlimitFlag     = flag.String("rlimit", "", "comma-separated resource limits of the process, as resource=soft:hard (Linux only)")
+	niceFlag       = flag.String("nice", "", "niceness of the process, from -20 to 19 (default: the one of the daemon)")
+	ioniceFlag     = flag.String("ionice", "", "I/O scheduling class of the process: realtime:N, best-effort:N or idle")
+	oomAdjFlag     = flag.String("oom-score-adj", "", "OOM score adjustment of the process, from -1000 to 1000")
+	noNewPrivsFlag = flag.Bool("no-new-privs", false, "keep the process from gaining privileges through setuid binaries (Linux only)")
+	seccompFlag    = flag.String("seccomp", "", "JSON seccomp profile restricting the system calls of the process, implying -no-new-privs")
+	healthCmdFlag  = flag.String("health-cmd", "", "shell command checking the health of the process, exiting with code 0 when healthy")
+	healthTCPFlag  = flag.String("health-tcp", "", "TCP address the process must accept connections on to be healthy")
+	healthHTTPFlag = flag.String("health-http", "", "URL the process must answer GET on with a 2xx or 3xx status to be healthy")
+	healthPatFlag  = flag.String("health-pattern", "", "regular expression the output must match between health checks")
+	healthIntFlag  = flag.Int("health-interval", 0, "seconds between health checks (0: 30)")
+	healthTOFlag   = flag.Int("health-timeout", 0, "seconds a health check may take (0: 10)")
+	healthRetFlag  = flag.Int("health-retries", 0, "failed health checks in a row making the process unhealthy (0: 3)")
+	healthRstFlag  = flag.Bool("health-restart", false, "kill the process once unhealthy, for its supervisor to restart it")
+	preStartFlag   = flag.String("pre-start", "", "shell command run before the process starts, which fails when it does")
+	postStartFlag  = flag.String("post-start", "", "shell command run once the process started")
+	postExitFlag   = flag.String("post-exit", "", "shell command run once the process exited, with $BGRUN_EXIT_CODE")
+	onRestartFlag  = flag.String("on-restart", "", "shell command run before a retried or restarted run starts")
+	webhookFlag    = flag.String("webhook", "", "comma-separated URLs to POST a JSON notification to once the process exited")
+	webhookLnFlag  = flag.Int("webhook-lines", 0, "lines of output in exit notifications (0: 20, -1: none)")
+	startDelayFlag = flag.Int("start-delay", 0, "seconds to wait before starting the process, reported scheduled meanwhile")
+	startAtFlag    = flag.String("start-at", "", "time to start the process at, as RFC 3339 or HH:MM")
+	scheduleFlag   = flag.String("schedule", "", "cron expression to start the process at the next match of")
+	lingerFlag     = flag.Int("linger", 0, "seconds to keep serving clients after the process exited, then remove the runtime directory")
+	configFlag     = flag.String("config", "", "JSON job file giving the command and daemon options, which flags override")
+	restoreFlag    = flag.String("restore", "", "restore the process from a CRIU checkpoint directory instead of running a command (experimental)")
 
 	// Control mode flags
-	ctlFlag = flag.Bool("ctl", false, "run in control mode")
-	pidFlag = flag.Int("pid", 0, "PID of bgrun daemon (for control mode)")
+	ctlFlag  = flag.Bool("ctl", false, "run in control mode")
+	pidFlag  = flag.Int("pid", 0, "PID of bgrun daemon (for control mode)")
+	jsonFlag = flag.Bool("json", false, "write control command results as JSON")
+	allFlag  = flag.Bool("all-users", false, "find the daemon among those of every user (root only, audited)")
 
 	helpFlag = flag.Bool("help", false, "show help message")
 )
 
+// envFlag and envFileFlag collect the values of repeated -env and
+// -env-file flags, stdoutTeeFlag and stderrTeeFlag those of -stdout-tee and
+// -stderr-tee
+var envFlag, envFileFlag, stdoutTeeFlag, stderrTeeFlag listFlag
+
+func init() {
+	flag.StringVar(shellFlag, "c", "", "shorthand for -shell")
+	flag.Var(&envFlag, "env", "KEY=value variable to add to the environment of the process (repeatable)")
+	flag.Var(&envFileFlag, "env-file", "dotenv file of variables to add to the environment of the process (repeatable, later files win)")
+	flag.Var(&stdoutTeeFlag, "stdout-tee", "file stdout is appended to as well, whatever its mode (repeatable)")
+	flag.Var(&stderrTeeFlag, "stderr-tee", "file stderr is appended to as well, whatever its mode (repeatable)")
+}
+
 func main() {
+	// The processes the daemon sets up are started as this binary
+	daemon.MaybeExecSetup()
+
 	flag.Parse()
 
 	if *helpFlag {
@@ -83,36 +169,76 @@ func runInBackground() {
 		newArgs = append(newArgs, arg)
 	}
 
-	// Create command to run in background
-	cmd := exec.Command(os.Args[0], newArgs...)
-	cmd.Stdin = nil
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-
-	// Start the process
-	if err := cmd.Start(); err != nil {
+	pid, err := spawnBackground(os.Args[0], newArgs)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to start background process: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Output the PID for control operations
-	fmt.Println(cmd.Process.Pid)
+	fmt.Println(pid)
 
 	// Exit parent process
 	os.Exit(0)
 }
 
 func runControlMode() {
+	// diff-output compares two runs and takes both PIDs as arguments
+	if args := flag.Args(); len(args) > 0 && args[0] == "diff-output" {
+		runDiffOutput(args[1:])
+		return
+	}
+	// ps lists every daemon of the user
+	if args := flag.Args(); len(args) > 0 && args[0] == "ps" {
+		if err := control.Ps(os.Stdout, *jsonFlag, *allFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *pidFlag == 0 {
 		fmt.Fprintln(os.Stderr, "Error: -pid flag is required for control mode")
 		fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl -pid <pid> <command> [args...]")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Commands:")
 		fmt.Fprintln(os.Stderr, "  status              Show process status")
-		fmt.Fprintln(os.Stderr, "  attach              Attach to process output")
+		fmt.Fprintln(os.Stderr, "  attach [-d] [-forward-signals]")
+		fmt.Fprintln(os.Stderr, "                      Attach to process output; -d detaches the other clients, -forward-signals")
+		fmt.Fprintln(os.Stderr, "                      sends Ctrl+C to the process without VTY, pressed twice to detach")
 		fmt.Fprintln(os.Stderr, "  wait <type> <secs>  Wait for condition (type: exit|foreground)")
+		fmt.Fprintln(os.Stderr, "  wait pattern <secs> <re>")
+		fmt.Fprintln(os.Stderr, "                      Wait for a regular expression in the output or screen")
+		fmt.Fprintln(os.Stderr, "  wait <idle|stable> <secs> <ms>")
+		fmt.Fprintln(os.Stderr, "                      Wait for no output, or no screen change, for <ms>")
 		fmt.Fprintln(os.Stderr, "  signal <signum>     Send signal to process")
+		fmt.Fprintln(os.Stderr, "  stop                Pause the process group (SIGSTOP)")
+		fmt.Fprintln(os.Stderr, "  cont                Resume the paused process group (SIGCONT)")
 		fmt.Fprintln(os.Stderr, "  shutdown            Shutdown the daemon")
+		fmt.Fprintln(os.Stderr, "  retry               Relaunch a terminated job with the same configuration")
+		fmt.Fprintln(os.Stderr, "  runs                List the run history of a retried job")
+		fmt.Fprintln(os.Stderr, "  verify <pubkey>     Verify the signature of a terminated job's artifacts")
+		fmt.Fprintln(os.Stderr, "  commands            List the commands run in the terminal's shell (VTY only)")
+		fmt.Fprintln(os.Stderr, "  command-output [n]  Show the output of command n (default: the last one)")
+		fmt.Fprintln(os.Stderr, "  search [-i] <re>    Find a regular expression in the screen and scrollback (VTY only)")
+		fmt.Fprintln(os.Stderr, "  record <start|stop> Start or stop recording the session (VTY only)")
+		fmt.Fprintln(os.Stderr, "  recording           Write the asciinema recording of the session to stdout")
+		fmt.Fprintln(os.Stderr, "  timeline            Write the timeline of input, output and events of the recording")
+		fmt.Fprintln(os.Stderr, "  replay [speed]      Play the recording back with its original timing (default speed: 1)")
+		fmt.Fprintln(os.Stderr, "  capabilities        List the messages, formats and features the daemon supports")
+		fmt.Fprintln(os.Stderr, "  health              Check the daemon itself: state lock, goroutines, log, output readers")
+		fmt.Fprintln(os.Stderr, "  ping                Measure the round trip time to the daemon")
+		fmt.Fprintln(os.Stderr, "  events              Stream lifecycle events: exit, resize, title, foreground, clients, pause, health")
+		fmt.Fprintln(os.Stderr, "  expect <re> <input>...")
+		fmt.Fprintln(os.Stderr, "                      Send input whenever the output matches, until the process exits")
+		fmt.Fprintln(os.Stderr, "  send-file [-close] <path>")
+		fmt.Fprintln(os.Stderr, "                      Have the daemon write a file to stdin, closing it after with -close")
+		fmt.Fprintln(os.Stderr, "  log-level [level]   Show or set the level of the daemon log (debug|info|warn|error)")
+		fmt.Fprintln(os.Stderr, "  checkpoint [-leave-running]")
+		fmt.Fprintln(os.Stderr, "                      Checkpoint the process with CRIU, to restore it with -restore (experimental)")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl diff-output <pidA> <pidB>")
+		fmt.Fprintln(os.Stderr, "       bgrun -ctl [-all-users] [-json] ps")
 		os.Exit(1)
 	}
 
@@ -125,30 +251,46 @@ func runControlMode() {
 	command := args[0]
 
 	// Connect to daemon by PID
-	c, err := bgclient.New(*pidFlag)
+	var c *bgclient.Client
+	var err error
+	if *allFlag {
+		c, err = control.Connect(control.Target{PID: *pidFlag, AllUsers: true, Action: command})
+	} else {
+		c, err = bgclient.NewWithRetry(*pidFlag, bgclient.DefaultRetryPolicy)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to connect to PID %d: %v\n", *pidFlag, err)
 		os.Exit(1)
 	}
 	defer c.Close()
 
+	ctl := &control.Controller{Client: c, Out: os.Stdout, Err: os.Stderr, JSON: *jsonFlag}
+
 	switch command {
 	case "status":
-		if err := cmdStatus(c); err != nil {
+		if err := ctl.Status(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "attach":
-		if err := cmdAttach(c); err != nil {
+		opts, err := control.ParseAttach(args[1:])
+		if err == nil {
+			err = ctl.AttachTerminal(func() (*bgclient.Client, error) {
+				return bgclient.NewFromRuntimeDir(c.RuntimeDir())
+			}, opts)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "wait":
-		if len(args) < 3 {
+		if len(args) < 3 || (slices.Contains([]string{"pattern", "idle", "stable"}, args[1]) && len(args) < 4) {
 			fmt.Fprintln(os.Stderr, "Error: wait type and timeout required")
 			fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl -pid <pid> wait <exit|foreground> <seconds>")
+			fmt.Fprintln(os.Stderr, "       bgrun -ctl -pid <pid> wait pattern <seconds> <regexp>")
+			fmt.Fprintln(os.Stderr, "       bgrun -ctl -pid <pid> wait <idle|stable> <seconds> <milliseconds>")
 			os.Exit(1)
 		}
 		waitTypeStr := args[1]
@@ -158,7 +300,20 @@ func runControlMode() {
 			os.Exit(1)
 		}
 		timeoutSecs := uint32(timeout)
-		if err := cmdWait(c, waitTypeStr, timeoutSecs); err != nil {
+		switch waitTypeStr {
+		case "pattern":
+			err = ctl.WaitPattern(args[3], timeoutSecs)
+		case "idle", "stable":
+			quiet, perr := strconv.ParseUint(args[3], 10, 32)
+			if perr != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid quiet period: %v\n", perr)
+				os.Exit(1)
+			}
+			err = ctl.WaitQuiet(waitTypeStr, time.Duration(quiet)*time.Millisecond, timeoutSecs)
+		default:
+			err = ctl.Wait(waitTypeStr, timeoutSecs)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -173,13 +328,172 @@ func runControlMode() {
 			fmt.Fprintf(os.Stderr, "Error: invalid signal number: %v\n", err)
 			os.Exit(1)
 		}
-		if err := cmdSignal(c, syscall.Signal(signum)); err != nil {
+		if err := ctl.Signal(syscall.Signal(signum)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "stop", "cont":
+		if err := ctl.Pause(command == "stop"); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
 	case "shutdown":
-		if err := cmdShutdown(c); err != nil {
+		if err := ctl.Shutdown(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "retry":
+		if err := cmdRetry(c); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "runs":
+		if err := ctl.Runs(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "verify":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Error: public key file required")
+			fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl -pid <pid> verify <pubkey.pem>")
+			os.Exit(1)
+		}
+		if err := cmdVerify(c, args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "commands":
+		if err := ctl.Commands(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "command-output":
+		index := -1
+		if len(args) >= 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: invalid command index: %v\n", err)
+				os.Exit(1)
+			}
+			index = n
+		}
+		if err := ctl.CommandOutput(index); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "search":
+		pattern, ignoreCase, err := control.ParseSearch(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := ctl.Search(pattern, ignoreCase); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "record":
+		if len(args) < 2 || (args[1] != "start" && args[1] != "stop") {
+			fmt.Fprintln(os.Stderr, "Error: record action required")
+			fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl -pid <pid> record <start|stop>")
+			os.Exit(1)
+		}
+		if err := ctl.Record(args[1] == "start"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "recording":
+		if err := ctl.Recording(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "timeline":
+		if err := ctl.Timeline(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "replay":
+		speed, err := control.ParseSpeed(args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := ctl.Replay(speed); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "capabilities":
+		if err := ctl.Capabilities(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "health":
+		if err := ctl.Health(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "ping":
+		if err := ctl.Ping(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "events":
+		if err := ctl.Events(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "expect":
+		rules, err := control.ParseExpectRules(args[1:])
+		if err == nil {
+			err = ctl.Expect(rules)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "log-level":
+		level := ""
+		if len(args) > 1 {
+			level = args[1]
+		}
+		if err := ctl.LogLevel(level); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "checkpoint":
+		leaveRunning, err := control.ParseCheckpoint(args[1:])
+		if err == nil {
+			err = ctl.Checkpoint(leaveRunning)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "send-file":
+		path, closeStdin, err := control.ParseSendFile(args[1:])
+		if err == nil {
+			err = ctl.SendFile(path, closeStdin)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
@@ -190,18 +504,70 @@ func runControlMode() {
 	}
 }
 
+func runDiffOutput(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Error: two PIDs required")
+		fmt.Fprintln(os.Stderr, "Usage: bgrun -ctl diff-output <pidA> <pidB>")
+		os.Exit(2)
+	}
+
+	var pids [2]int
+	for i, arg := range args {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid PID: %s\n", arg)
+			os.Exit(2)
+		}
+		pids[i] = pid
+	}
+
+	changed, err := cmdDiffOutput(pids[0], pids[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if changed {
+		// Same convention as diff(1)
+		os.Exit(1)
+	}
+}
+
 func runDaemonMode() {
+	openReadyFile()
+
 	args := flag.Args()
-	if len(args) == 0 {
+	if *configFlag != "" {
+		command, err := loadJobFile(*configFlag, flag.CommandLine, len(args) > 0 || *shellFlag != "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			notifyReady(err)
+			os.Exit(1)
+		}
+		if len(command) > 0 {
+			args = command
+		}
+	}
+	if *shellFlag != "" {
+		args = shellCommand(*shellFlag, args)
+	}
+	if len(args) == 0 && *restoreFlag == "" {
 		fmt.Fprintln(os.Stderr, "Error: no command specified")
 		fmt.Fprintln(os.Stderr, "Use -help for usage information")
+		notifyReady(errors.New("no command specified"))
 		os.Exit(1)
 	}
 
-	// Parse configuration
-	config, err := parseConfig(args)
+	// Parse configuration, or take the one of the checkpoint to restore
+	var config *daemon.Config
+	var err error
+	if *restoreFlag != "" {
+		config, err = restoreConfig(*restoreFlag)
+	} else {
+		config, err = parseConfig(args)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		notifyReady(err)
 		os.Exit(1)
 	}
 
@@ -209,15 +575,21 @@ func runDaemonMode() {
 	d, err := daemon.New(config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create daemon: %v\n", err)
+		notifyReady(err)
 		os.Exit(1)
 	}
 
 	// Start daemon
 	if err := d.Start(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to start daemon: %v\n", err)
+		notifyReady(err)
 		os.Exit(1)
 	}
 
+	// The control socket listens: a bgrun started with -background can
+	// print the PID
+	notifyReady(nil)
+
 	// Print runtime information
 	fmt.Printf("Process started successfully\n")
 	fmt.Printf("Runtime directory: %s\n", d.RuntimeDir())
@@ -236,23 +608,194 @@ func runDaemonMode() {
 	}
 
 	// Write final status to JSON file
-	if err := writeFinalStatus(d); err != nil {
+	if err := d.WriteStatus(); err != nil {
 		log.Printf("Warning: failed to write final status: %v", err)
 	}
 }
 
+// shellCommand returns the command running script with $SHELL (/bin/sh if
+// unset), args becoming its $0, $1 and so on
+func shellCommand(script string, args []string) []string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return append([]string{shell, "-c", script}, args...)
+}
+
 func parseConfig(command []string) (*daemon.Config, error) {
 	config := &daemon.Config{
-		Command: command,
-		UseVTY:  *vtyFlag,
+		Command:      command,
+		UseVTY:       *vtyFlag,
+		StrictVTY:    *strictFlag,
+		Record:       *recordFlag,
+		UTF8Chunks:   *utf8Flag,
+		ReplayScreen: *replayFlag,
+		Dir:          *dirFlag,
+		PreviousRun:  *previousFlag,
+		LogKeyFile:   *logKeyFlag,
+
+		SigningKeyFile: *signKeyFlag,
+		LogMaxSize:     *logMaxFlag,
+		MaxLogBytes:    *outputMaxFlag,
+		MaxOutputRate:  *outputRateFlag,
+		SocketPath:     *socketFlag,
+		SocketGroup:    *sockGroupFlag,
+
+		ListenTCP:       *listenFlag,
+		TLSCertFile:     *tlsCertFlag,
+		TLSKeyFile:      *tlsKeyFlag,
+		TLSClientCAFile: *tlsCAFlag,
+		TokenFile:       *tokenFileFlag,
+		ListenWebSocket: *listenWSFlag,
+		ListenWebUI:     *listenWebFlag,
+		ListenAPI:       *apiFlag,
+		AllowAnonymous:  *anonymousFlag,
+		SyslogFacility:  *facilityFlag,
+		SyslogTag:       *tagFlag,
+		KeepLog:         *keepLogFlag,
+		Quotas: daemon.Quotas{
+			MaxStdinBytes:           *quotaStdinFlag,
+			MaxExportBytesPerMinute: *quotaExpFlag,
+		},
+	}
+
+	// Record the working directory so retries run in the same place
+	if config.Dir == "" {
+		if wd, err := os.Getwd(); err == nil {
+			config.Dir = wd
+		}
+	}
+
+	var err error
+	if config.LogLevel, err = daemon.ParseLogLevel(*logLevelFlag); err != nil {
+		return nil, err
+	}
+	if config.SizePolicy, config.FixedRows, config.FixedCols, err = daemon.ParseSizePolicy(*sizeFlag); err != nil {
+		return nil, err
+	}
+
+	if *sockModeFlag != "" {
+		mode, err := strconv.ParseUint(*sockModeFlag, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mode: %w", err)
+		}
+		config.SocketMode = os.FileMode(mode)
+	}
+
+	if config.AllowedUIDs, err = parseIDs(*allowUIDFlag, lookupUID); err != nil {
+		return nil, fmt.Errorf("invalid -allow-uid: %w", err)
+	}
+	if config.AllowedGIDs, err = parseIDs(*allowGIDFlag, lookupGID); err != nil {
+		return nil, fmt.Errorf("invalid -allow-gid: %w", err)
+	}
+
+	if *wsOriginFlag != "" {
+		config.WebSocketOrigins = strings.Split(*wsOriginFlag, ",")
+	}
+
+	if *permsFlag != "" {
+		if config.Permissions, err = daemon.ParsePermissions(*permsFlag); err != nil {
+			return nil, err
+		}
+	}
+
+	if *cgroupFlag || *cgParentFlag != "" || *cpuWeightFlag != 0 || *memoryMaxFlag != 0 || *pidsMaxFlag != 0 {
+		config.Cgroup = &daemon.CgroupConfig{
+			Parent:    *cgParentFlag,
+			CPUWeight: *cpuWeightFlag,
+			MemoryMax: *memoryMaxFlag,
+			PidsMax:   *pidsMaxFlag,
+		}
+	}
+
+	if config.Rlimits, err = daemon.ParseRlimits(*rlimitFlag); err != nil {
+		return nil, fmt.Errorf("invalid -rlimit: %w", err)
+	}
+	if *niceFlag != "" {
+		nice, err := strconv.Atoi(*niceFlag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -nice: %w", err)
+		}
+		config.Nice = &nice
+	}
+	config.IONice = *ioniceFlag
+	if *oomAdjFlag != "" {
+		adj, err := strconv.Atoi(*oomAdjFlag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -oom-score-adj: %w", err)
+		}
+		config.OOMScoreAdj = &adj
+	}
+	config.NoNewPrivs = *noNewPrivsFlag
+	config.SeccompProfile = *seccompFlag
+
+	config.Hooks = daemon.Hooks{
+		PreStart:  *preStartFlag,
+		PostStart: *postStartFlag,
+		PostExit:  *postExitFlag,
+		OnRestart: *onRestartFlag,
+	}
+
+	config.StartDelay = *startDelayFlag
+	if *startAtFlag != "" {
+		at, err := parseStartAt(*startAtFlag, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		config.StartAt = &at
+	}
+	config.Schedule = *scheduleFlag
+	config.Env = slices.Clone([]string(envFlag))
+	// Retries pass the variables of the process in the environment rather
+	// than on the command line, where ps shows them
+	if vars, ok := os.LookupEnv(envVarsEnv); ok {
+		os.Unsetenv(envVarsEnv)
+		var env []string
+		if err := json.Unmarshal([]byte(vars), &env); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envVarsEnv, err)
+		}
+		config.Env = append(env, config.Env...)
+	}
+	for _, path := range envFileFlag {
+		// Retries may run elsewhere
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		config.EnvFiles = append(config.EnvFiles, abs)
+	}
+	config.LingerAfterExit = *lingerFlag
+
+	if *webhookFlag != "" {
+		config.Webhooks = strings.Split(*webhookFlag, ",")
+	}
+	config.WebhookLines = *webhookLnFlag
+
+	if *healthCmdFlag != "" || *healthTCPFlag != "" || *healthHTTPFlag != "" || *healthPatFlag != "" ||
+		*healthIntFlag != 0 || *healthTOFlag != 0 || *healthRetFlag != 0 || *healthRstFlag {
+		config.HealthCheck = &daemon.HealthCheck{
+			Command:  *healthCmdFlag,
+			TCP:      *healthTCPFlag,
+			HTTP:     *healthHTTPFlag,
+			Pattern:  *healthPatFlag,
+			Interval: *healthIntFlag,
+			Timeout:  *healthTOFlag,
+			Retries:  *healthRetFlag,
+			Restart:  *healthRstFlag,
+		}
 	}
 
 	// Parse stdin mode
-	switch *stdinFlag {
-	case "null":
+	switch {
+	case *stdinFlag == "null":
 		config.StdinMode = daemon.StdinNull
-	case "stream":
+	case *stdinFlag == "stream":
 		config.StdinMode = daemon.StdinStream
+	case strings.HasPrefix(*stdinFlag, "stream:"):
+		// Streamed, fed with a file or named pipe as well
+		config.StdinMode = daemon.StdinStream
+		config.StdinPath = strings.TrimPrefix(*stdinFlag, "stream:")
 	default:
 		// Treat as file path
 		config.StdinMode = daemon.StdinFile
@@ -260,30 +803,385 @@ func parseConfig(command []string) (*daemon.Config, error) {
 	}
 
 	// Parse stdout mode
-	var err error
-	config.StdoutMode, config.StdoutPath, err = parseIOMode(*stdoutFlag)
+	config.StdoutMode, config.StdoutPath, err = daemon.ParseIOMode(*stdoutFlag)
 	if err != nil {
 		return nil, fmt.Errorf("invalid stdout mode: %w", err)
 	}
+	if config.StdoutMode == daemon.IOModeFilter {
+		config.StdoutFilter, config.StdoutPath = config.StdoutPath, ""
+	}
 
 	// Parse stderr mode
-	config.StderrMode, config.StderrPath, err = parseIOMode(*stderrFlag)
+	config.StderrMode, config.StderrPath, err = daemon.ParseIOMode(*stderrFlag)
 	if err != nil {
 		return nil, fmt.Errorf("invalid stderr mode: %w", err)
 	}
+	if config.StderrMode == daemon.IOModeFilter {
+		config.StderrFilter, config.StderrPath = config.StderrPath, ""
+	}
+
+	config.StdoutTee = slices.Clone([]string(stdoutTeeFlag))
+	config.StderrTee = slices.Clone([]string(stderrTeeFlag))
+
+	// Make file paths absolute so the recorded config can be retried from anywhere
+	paths := []*string{&config.StdinPath, &config.StdoutPath, &config.StderrPath, &config.LogKeyFile, &config.SigningKeyFile, &config.SocketPath, &config.SeccompProfile}
+	for i := range config.StdoutTee {
+		paths = append(paths, &config.StdoutTee[i])
+	}
+	for i := range config.StderrTee {
+		paths = append(paths, &config.StderrTee[i])
+	}
+	for _, path := range paths {
+		if *path != "" {
+			if abs, err := filepath.Abs(*path); err == nil {
+				*path = abs
+			}
+		}
+	}
 
 	return config, nil
 }
 
-func parseIOMode(mode string) (daemon.IOMode, string, error) {
+// parseStartAt parses the time of -start-at, RFC 3339 or HH:MM for the next
+// time of day it is after now
+func parseStartAt(value string, now time.Time) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	clock, err := time.ParseInLocation("15:04", value, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -start-at %q: RFC 3339 time or HH:MM required", value)
+	}
+	at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at, nil
+}
+
+// restoreConfig returns the configuration of the process checkpointed in
+// dir, to be restored by a daemon of its own
+func restoreConfig(dir string) (*daemon.Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	cp, err := daemon.LoadCheckpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+	config := cp.Config
+	config.RuntimeDir = ""
+	config.RestoreFrom = dir
+	return config, nil
+}
+
+// parseIDs parses a comma-separated list of user or group IDs, looking up
+// the names with lookup
+func parseIDs(list string, lookup func(string) (string, error)) ([]int, error) {
+	var ids []int
+	for _, name := range strings.Split(list, ",") {
+		if name == "" {
+			continue
+		}
+		if id, err := strconv.Atoi(name); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+		idStr, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// joinIDs formats IDs as parsed by parseIDs
+func joinIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// envVarsEnv names the environment variable a retried daemon gets the
+// variables of its process in, as a JSON array of KEY=value strings
+const envVarsEnv = "BGRUN_ENV"
+
+// configEnv returns the environment passing the variables of config to the
+// daemon configArgs starts, which leaves them out of its command line
+func configEnv(config *daemon.Config) []string {
+	if len(config.Env) == 0 {
+		return nil
+	}
+	vars, _ := json.Marshal(config.Env)
+	return []string{envVarsEnv + "=" + string(vars)}
+}
+
+// configArgs converts a daemon configuration back into command line
+// arguments, but for the variables of the process given by configEnv
+func configArgs(config *daemon.Config) []string {
+	var args []string
+
+	switch config.StdinMode {
+	case daemon.StdinNull:
+		args = append(args, "-stdin", "null")
+	case daemon.StdinStream:
+		if config.StdinPath != "" {
+			args = append(args, "-stdin", "stream:"+config.StdinPath)
+		} else {
+			args = append(args, "-stdin", "stream")
+		}
+	case daemon.StdinFile:
+		args = append(args, "-stdin", config.StdinPath)
+	}
+
+	args = append(args, "-stdout", ioModeArg(config.StdoutMode, config.StdoutPath, config.StdoutFilter))
+	for _, path := range config.StdoutTee {
+		args = append(args, "-stdout-tee", path)
+	}
+	args = append(args, "-stderr", ioModeArg(config.StderrMode, config.StderrPath, config.StderrFilter))
+	for _, path := range config.StderrTee {
+		args = append(args, "-stderr-tee", path)
+	}
+
+	if config.UseVTY {
+		args = append(args, "-vty")
+	}
+	if config.StrictVTY {
+		args = append(args, "-strict")
+	}
+	if config.Record {
+		args = append(args, "-record")
+	}
+	switch config.SizePolicy {
+	case daemon.SizeSmallest:
+		args = append(args, "-size-policy", string(config.SizePolicy))
+	case daemon.SizeFixed:
+		args = append(args, "-size-policy", fmt.Sprintf("%dx%d", config.FixedCols, config.FixedRows))
+	}
+	if config.UTF8Chunks {
+		args = append(args, "-utf8-chunks")
+	}
+	if config.ReplayScreen {
+		args = append(args, "-replay-screen")
+	}
+	if config.Dir != "" {
+		args = append(args, "-dir", config.Dir)
+	}
+	if config.PreviousRun != "" {
+		args = append(args, "-previous-run", config.PreviousRun)
+	}
+	if config.LogKeyFile != "" {
+		args = append(args, "-log-key-file", config.LogKeyFile)
+	}
+	if config.SigningKeyFile != "" {
+		args = append(args, "-sign-key", config.SigningKeyFile)
+	}
+	if config.Quotas.MaxStdinBytes != 0 {
+		args = append(args, "-quota-stdin", strconv.FormatInt(config.Quotas.MaxStdinBytes, 10))
+	}
+	if config.Quotas.MaxExportBytesPerMinute != 0 {
+		args = append(args, "-quota-export", strconv.FormatInt(config.Quotas.MaxExportBytesPerMinute, 10))
+	}
+
+	if config.LogLevel != daemon.LogInfo {
+		args = append(args, "-log-level", config.LogLevel.String())
+	}
+	if config.LogMaxSize != 0 {
+		args = append(args, "-log-max-size", strconv.FormatInt(config.LogMaxSize, 10))
+	}
+	if config.MaxLogBytes != 0 {
+		args = append(args, "-output-max-size", strconv.FormatInt(config.MaxLogBytes, 10))
+	}
+	if config.MaxOutputRate != 0 {
+		args = append(args, "-output-rate", strconv.FormatInt(config.MaxOutputRate, 10))
+	}
+	if config.SocketPath != "" {
+		args = append(args, "-socket", config.SocketPath)
+	}
+	if config.SocketMode != 0 {
+		args = append(args, "-socket-mode", fmt.Sprintf("%04o", config.SocketMode))
+	}
+	if config.SocketGroup != "" {
+		args = append(args, "-socket-group", config.SocketGroup)
+	}
+	if len(config.AllowedUIDs) > 0 {
+		args = append(args, "-allow-uid", joinIDs(config.AllowedUIDs))
+	}
+	if len(config.AllowedGIDs) > 0 {
+		args = append(args, "-allow-gid", joinIDs(config.AllowedGIDs))
+	}
+	if config.Permissions != 0 {
+		args = append(args, "-permissions", config.Permissions.String())
+	}
+	if config.ListenTCP != "" {
+		args = append(args, "-listen", config.ListenTCP)
+	}
+	if config.TLSCertFile != "" {
+		args = append(args, "-tls-cert", config.TLSCertFile, "-tls-key", config.TLSKeyFile,
+			"-tls-client-ca", config.TLSClientCAFile)
+	}
+	if config.TokenFile != "" {
+		args = append(args, "-token-file", config.TokenFile)
+	}
+	if config.ListenWebSocket != "" {
+		args = append(args, "-listen-ws", config.ListenWebSocket)
+	}
+	if len(config.WebSocketOrigins) > 0 {
+		args = append(args, "-ws-origin", strings.Join(config.WebSocketOrigins, ","))
+	}
+	if config.ListenWebUI != "" {
+		args = append(args, "-listen-web", config.ListenWebUI)
+	}
+	if config.ListenAPI != "" {
+		args = append(args, "-api", config.ListenAPI)
+	}
+	if config.AllowAnonymous {
+		args = append(args, "-allow-anonymous")
+	}
+	if config.SyslogFacility != "" {
+		args = append(args, "-syslog-facility", config.SyslogFacility)
+	}
+	if config.SyslogTag != "" {
+		args = append(args, "-syslog-tag", config.SyslogTag)
+	}
+	if config.KeepLog {
+		args = append(args, "-keep-log")
+	}
+	if cg := config.Cgroup; cg != nil {
+		args = append(args, "-cgroup")
+		if cg.Parent != "" {
+			args = append(args, "-cgroup-parent", cg.Parent)
+		}
+		if cg.CPUWeight != 0 {
+			args = append(args, "-cpu-weight", strconv.Itoa(cg.CPUWeight))
+		}
+		if cg.MemoryMax != 0 {
+			args = append(args, "-memory-max", strconv.FormatInt(cg.MemoryMax, 10))
+		}
+		if cg.PidsMax != 0 {
+			args = append(args, "-pids-max", strconv.FormatInt(cg.PidsMax, 10))
+		}
+	}
+	if len(config.Rlimits) > 0 {
+		limits := make([]string, len(config.Rlimits))
+		for i, r := range config.Rlimits {
+			limits[i] = r.String()
+		}
+		args = append(args, "-rlimit", strings.Join(limits, ","))
+	}
+	if config.Nice != nil {
+		args = append(args, "-nice", strconv.Itoa(*config.Nice))
+	}
+	if config.IONice != "" {
+		args = append(args, "-ionice", config.IONice)
+	}
+	if config.OOMScoreAdj != nil {
+		args = append(args, "-oom-score-adj", strconv.Itoa(*config.OOMScoreAdj))
+	}
+	if config.NoNewPrivs {
+		args = append(args, "-no-new-privs")
+	}
+	if config.SeccompProfile != "" {
+		args = append(args, "-seccomp", config.SeccompProfile)
+	}
+	if hc := config.HealthCheck; hc != nil {
+		for _, arg := range []struct{ name, value string }{
+			{"-health-cmd", hc.Command},
+			{"-health-tcp", hc.TCP},
+			{"-health-http", hc.HTTP},
+			{"-health-pattern", hc.Pattern},
+		} {
+			if arg.value != "" {
+				args = append(args, arg.name, arg.value)
+			}
+		}
+		if hc.Interval != 0 {
+			args = append(args, "-health-interval", strconv.Itoa(hc.Interval))
+		}
+		if hc.Timeout != 0 {
+			args = append(args, "-health-timeout", strconv.Itoa(hc.Timeout))
+		}
+		if hc.Retries != 0 {
+			args = append(args, "-health-retries", strconv.Itoa(hc.Retries))
+		}
+		if hc.Restart {
+			args = append(args, "-health-restart")
+		}
+	}
+	if config.StartDelay != 0 {
+		args = append(args, "-start-delay", strconv.Itoa(config.StartDelay))
+	}
+	if config.StartAt != nil {
+		args = append(args, "-start-at", config.StartAt.Format(time.RFC3339))
+	}
+	if config.Schedule != "" {
+		args = append(args, "-schedule", config.Schedule)
+	}
+	for _, path := range config.EnvFiles {
+		args = append(args, "-env-file", path)
+	}
+	if config.LingerAfterExit != 0 {
+		args = append(args, "-linger", strconv.Itoa(config.LingerAfterExit))
+	}
+	if len(config.Webhooks) > 0 {
+		args = append(args, "-webhook", strings.Join(config.Webhooks, ","))
+	}
+	if config.WebhookLines != 0 {
+		args = append(args, "-webhook-lines", strconv.Itoa(config.WebhookLines))
+	}
+	for _, arg := range []struct{ name, value string }{
+		{"-pre-start", config.Hooks.PreStart},
+		{"-post-start", config.Hooks.PostStart},
+		{"-post-exit", config.Hooks.PostExit},
+		{"-on-restart", config.Hooks.OnRestart},
+	} {
+		if arg.value != "" {
+			args = append(args, arg.name, arg.value)
+		}
+	}
+
+	args = append(args, "--")
+	return append(args, config.Command...)
+}
+
+func ioModeArg(mode daemon.IOMode, path, filter string) string {
 	switch mode {
-	case "null":
-		return daemon.IOModeNull, "", nil
-	case "log":
-		return daemon.IOModeLog, "", nil
+	case daemon.IOModeFilter:
+		return "|" + filter
+	case daemon.IOModeNull:
+		return "null"
+	case daemon.IOModeLog:
+		return "log"
+	case daemon.IOModeSyslog:
+		return "syslog"
+	case daemon.IOModeJournal:
+		return "journal"
 	default:
-		// Treat as file path
-		return daemon.IOModeFile, mode, nil
+		return path
 	}
 }
 
@@ -292,25 +1190,164 @@ func showHelp() {
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("  bgrun [daemon-options] <command> [args...]    Run daemon mode")
+	fmt.Println("  bgrun [daemon-options] -shell '<command line>' Run a shell command line in daemon mode")
 	fmt.Println("  bgrun -ctl -pid <pid> <command> [args...]     Run control mode")
+	fmt.Println("  bgrun [-background] -restore <dir>            Restore a checkpointed process")
 	fmt.Println()
 	fmt.Println("Daemon Options:")
-	fmt.Println("  -stdin <mode>   stdin mode: null, stream, or file path (default: null)")
-	fmt.Println("  -stdout <mode>  stdout mode: null, log, or file path (default: log)")
-	fmt.Println("  -stderr <mode>  stderr mode: null, log, or file path (default: log)")
+	fmt.Println("  -stdin <mode>   stdin mode: null, stream, stream:<path>, or file path (default: null)")
+	fmt.Println("                  a named pipe stays open across its writers; stream:<path> also feeds")
+	fmt.Println("                  the file or named pipe to the streamed stdin")
+	fmt.Println("  -stdout <mode>  stdout mode: null, log, syslog, journal, |command, or file path (default: log)")
+	fmt.Println("  -stderr <mode>  stderr mode: null, log, syslog, journal, |command, or file path (default: log)")
+	fmt.Println("  -stdout-tee <path>, -stderr-tee <path>")
+	fmt.Println("                  also append stdout or stderr to this file, whatever its mode (repeatable)")
 	fmt.Println("  -vty            run in VTY mode")
+	fmt.Println("  -strict         fail screen/export requests after unsupported escape sequences (VTY mode)")
+	fmt.Println("  -record         record the session to session.cast in asciinema v2 format (VTY mode)")
+	fmt.Println("  -size-policy <latest|smallest|COLSxROWS>")
+	fmt.Println("                  terminal size when several clients resize it: the last resize (default), the")
+	fmt.Println("                  smallest attached client, or a fixed size (VTY mode)")
 	fmt.Println("  -background     run daemon in background and output PID")
+	fmt.Println("  -utf8-chunks    never split a UTF-8 sequence across output messages")
+	fmt.Println("  -replay-screen  answer screen and export requests without VTY by replaying output.log")
+	fmt.Println("  -shell <line>, -c <line>")
+	fmt.Println("                  run a shell command line with $SHELL -c (default: /bin/sh), arguments being its $0, $1...")
+	fmt.Println("  -config <file>  JSON job file giving the command and options, flags overriding it")
+	fmt.Println("  -env <KEY=value>")
+	fmt.Println("                  add a variable to the environment of the process (repeatable)")
+	fmt.Println("  -env-file <path>")
+	fmt.Println("                  add the variables of a dotenv file to the environment (repeatable, later files")
+	fmt.Println("                  and -env winning)")
+	fmt.Println("  -dir <path>     working directory for the command (default: current directory)")
+	fmt.Println("  -log-key-file <path>")
+	fmt.Println("                  encrypt output.log with the key in this file (default: $BGRUN_LOG_KEY)")
+	fmt.Println("  -sign-key <path>")
+	fmt.Println("                  sign status.json and output.log digests at exit with this PEM private key")
+	fmt.Println("  -quota-stdin <bytes>")
+	fmt.Println("                  maximum stdin bytes a single client may send (default: unlimited)")
+	fmt.Println("  -quota-export <bytes>")
+	fmt.Println("                  maximum screen/export bytes a client may request per minute (default: unlimited)")
+	fmt.Println("  -log-level <level>")
+	fmt.Println("                  level of daemon.log: debug, info, warn or error (default: info)")
+	fmt.Println("  -log-max-size <bytes>")
+	fmt.Println("                  size daemon.log is rotated to daemon.log.1 at (default: 1 MiB)")
+	fmt.Println("  -output-max-size <bytes>")
+	fmt.Println("                  cap output.log, dropping the middle of the output beyond it (default: unlimited)")
+	fmt.Println("  -output-rate <bytes>")
+	fmt.Println("                  read at most this much output per second, throttling the process (default: unlimited)")
+	fmt.Println("  -socket <path>  place the control socket here, for other users (linked from the runtime directory)")
+	fmt.Println("  -socket-mode <mode>")
+	fmt.Println("                  permissions of the control socket, such as 0660 (default: 0600)")
+	fmt.Println("  -socket-group <group>")
+	fmt.Println("                  group of the control socket, by name or ID")
+	fmt.Println("  -allow-uid <users>")
+	fmt.Println("                  only let these users connect, comma-separated names or IDs (Linux)")
+	fmt.Println("  -allow-gid <groups>")
+	fmt.Println("                  only let the members of these groups connect (Linux)")
+	fmt.Println("  -permissions <perms>")
+	fmt.Println("                  what clients of other users may do: observe, stdin, signal, shutdown (default: all)")
+	fmt.Println("  -listen <addr>  also serve the control protocol over TLS on this TCP address")
+	fmt.Println("  -tls-cert <path>, -tls-key <path>")
+	fmt.Println("                  PEM certificate and private key of the TLS listener, the REST API and the WebSocket bridge")
+	fmt.Println("  -tls-client-ca <path>")
+	fmt.Println("                  PEM CA that must have signed the certificates of TLS clients")
+	fmt.Println("  -token-file <path>")
+	fmt.Println("                  file holding the bearer token clients of the REST API and WebSocket bridge must present")
+	fmt.Println("  -listen-ws <addr>")
+	fmt.Println("                  serve a WebSocket bridge for web terminals on this HTTP address")
+	fmt.Println("  -ws-origin <origins>")
+	fmt.Println("                  also let pages of these comma-separated origins use the WebSocket bridge")
+	fmt.Println("  -listen-web <addr>")
+	fmt.Println("                  serve a read-only web view of the session on this HTTP address")
+	fmt.Println("  -api <addr>     serve a REST API on unix:/path or a TCP address")
+	fmt.Println("  -allow-anonymous")
+	fmt.Println("                  let clients of -listen-ws and of -api over TCP observe without a certificate or token")
+	fmt.Println("  -syslog-facility <facility>, -syslog-tag <tag>")
+	fmt.Println("                  facility and tag of syslog and journal output (default: user, program name)")
+	fmt.Println("  -keep-log       also write syslog and journal output to output.log")
+	fmt.Println("  -cgroup         run the process in a cgroup v2 of its own (Linux only)")
+	fmt.Println("  -cgroup-parent <path>")
+	fmt.Println("                  cgroup to create it in (default: the cgroup of the daemon)")
+	fmt.Println("  -cpu-weight <n>, -memory-max <bytes>, -pids-max <n>")
+	fmt.Println("                  limits of the cgroup, implying -cgroup")
+	fmt.Println("  -rlimit <limits>")
+	fmt.Println("                  resource limits of the process, as nofile=1024:4096,core=0 (Linux only)")
+	fmt.Println("  -nice <n>       niceness of the process, from -20 to 19 (Linux only)")
+	fmt.Println("  -ionice <class> I/O scheduling class of the process: realtime:N, best-effort:N or idle")
+	fmt.Println("  -oom-score-adj <n>")
+	fmt.Println("                  OOM score adjustment of the process, from -1000 to 1000")
+	fmt.Println("  -no-new-privs   keep the process from gaining privileges through setuid binaries")
+	fmt.Println("  -seccomp <path> JSON seccomp profile restricting the system calls of the process")
+	fmt.Println("  -health-cmd <command>, -health-tcp <addr>, -health-http <url>, -health-pattern <re>")
+	fmt.Println("                  check the health of the process with a command, a connection, a GET or its output")
+	fmt.Println("  -health-interval <secs>, -health-timeout <secs>, -health-retries <n>")
+	fmt.Println("                  time between checks and allowed to each, failures making it unhealthy (default: 30, 10, 3)")
+	fmt.Println("  -health-restart kill the process once unhealthy, for its supervisor to restart it")
+	fmt.Println("  -pre-start <command>, -post-start <command>, -post-exit <command>")
+	fmt.Println("                  shell commands run before the process starts, once it started and once it exited")
+	fmt.Println("  -on-restart <command>")
+	fmt.Println("                  shell command run before a retried or restarted run starts")
+	fmt.Println("  -webhook <urls> POST a JSON notification with the last lines of output to these URLs at exit")
+	fmt.Println("  -webhook-lines <n>")
+	fmt.Println("                  lines of output in exit notifications (default: 20, -1: none)")
+	fmt.Println("  -start-delay <secs>, -start-at <time>, -schedule <cron>")
+	fmt.Println("                  start the process later: after a delay, at a time (RFC 3339 or HH:MM),")
+	fmt.Println("                  or at the next match of a cron expression such as '0 3 * * *'")
+	fmt.Println("  -linger <secs>  keep serving clients after the process exited, then remove the runtime directory")
+	fmt.Println("  -restore <dir>  restore the process from a CRIU checkpoint, with its configuration (experimental)")
 	fmt.Println()
 	fmt.Println("Control Options:")
 	fmt.Println("  -ctl         enable control mode")
 	fmt.Println("  -pid <pid>   PID of bgrun daemon to control")
+	fmt.Println("  -json        write results as JSON")
 	fmt.Println()
 	fmt.Println("Control Commands:")
 	fmt.Println("  status              Show process status")
-	fmt.Println("  attach              Attach to process output")
+	fmt.Println("  attach [-d] [-forward-signals]")
+	fmt.Println("                      Attach to process output; -d detaches the other clients, -forward-signals")
+	fmt.Println("                      sends Ctrl+C to the process without VTY, pressed twice to detach")
 	fmt.Println("  wait <type> <secs>  Wait for condition (type: exit|foreground)")
+	fmt.Println("  wait pattern <secs> <re>")
+	fmt.Println("                      Wait for a regular expression in the output or screen")
+	fmt.Println("  wait <idle|stable> <secs> <ms>")
+	fmt.Println("                      Wait for no output, or no screen change, for <ms>")
 	fmt.Println("  signal <signum>     Send signal to process")
+	fmt.Println("  stop                Pause the process group (SIGSTOP)")
+	fmt.Println("  cont                Resume the paused process group (SIGCONT)")
 	fmt.Println("  shutdown            Shutdown the daemon")
+	fmt.Println("  retry               Relaunch a terminated job with the same configuration")
+	fmt.Println("  runs                List the run history of a retried job")
+	fmt.Println("  verify <pubkey>     Verify the signature of a terminated job's artifacts")
+	fmt.Println("  commands            List the commands run in the terminal's shell (VTY only)")
+	fmt.Println("  command-output [n]  Show the output of command n (default: the last one)")
+	fmt.Println("  search [-i] <re>    Find a regular expression in the screen and scrollback (VTY only)")
+	fmt.Println("  record <start|stop> Start or stop recording the session (VTY only)")
+	fmt.Println("  recording           Write the asciinema recording of the session to stdout")
+	fmt.Println("  timeline            Write the timeline of input, output and events of the recording")
+	fmt.Println("  replay [speed]      Play the recording back with its original timing (default speed: 1)")
+	fmt.Println("  capabilities        List the messages, formats and features the daemon supports")
+	fmt.Println("  health              Check the daemon itself: state lock, goroutines, log, output readers")
+	fmt.Println("  ping                Measure the round trip time to the daemon")
+	fmt.Println("  events              Stream lifecycle events: exit, resize, title, foreground, clients, pause, health")
+	fmt.Println("  expect <re> <input>...")
+	fmt.Println("                      Send input whenever the output matches, until the process exits")
+	fmt.Println("  send-file [-close] <path>")
+	fmt.Println("                      Have the daemon write a file to stdin, closing it after with -close")
+	fmt.Println("  log-level [level]   Show or set the level of the daemon log (debug|info|warn|error)")
+	fmt.Println("  checkpoint [-leave-running]")
+	fmt.Println("                      Checkpoint the process with CRIU, to restore it with -restore (experimental)")
+	fmt.Println()
+	fmt.Println("Comparing Runs:")
+	fmt.Println("  bgrun -ctl diff-output <pidA> <pidB>")
+	fmt.Println("    Diff the output of two runs with escape sequences stripped and")
+	fmt.Println("    timestamps normalized. Exits 1 when the outputs differ.")
+	fmt.Println()
+	fmt.Println("Listing Daemons:")
+	fmt.Println("  bgrun -ctl [-all-users] [-json] ps")
+	fmt.Println("    List the daemons of the user with their live state and uptime,")
+	fmt.Println("    flagging the zombies left to reap. As root, -all-users lists those")
+	fmt.Println("    of every user, and selects the daemon of -pid among them.")
 	fmt.Println()
 	fmt.Println("General Options:")
 	fmt.Println("  -help           show this help message")
@@ -322,7 +1359,13 @@ func showHelp() {
 	fmt.Println("In the runtime directory:")
 	fmt.Println("  control.sock - Unix socket for control API")
 	fmt.Println("  output.log   - Process output (when using 'log' mode)")
-	fmt.Println("  status.json  - Final process status (written on exit)")
+	fmt.Println("  config.json  - Daemon configuration (used by retry)")
+	fmt.Println("  status.json  - Process status (kept current, final on exit)")
+	fmt.Println("  signature.json - Signed artifact digests (with -sign-key)")
+	fmt.Println("  session.cast - asciinema recording (with -record or 'record start')")
+	fmt.Println("  timeline.jsonl - input, output and events of the recording")
+	fmt.Println("  terminal.json - terminal emulator state (VTY mode)")
+	fmt.Println("  crash.log    - stack traces of the panics the daemon recovered from")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  # Daemon mode:")
@@ -338,318 +1381,54 @@ func showHelp() {
 
 // Control command functions
 
-func cmdStatus(c *bgclient.Client) error {
-	status, err := c.GetStatus()
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("PID: %d\n", status.PID)
-	fmt.Printf("Running: %v\n", status.Running)
-	if status.ExitCode != nil {
-		fmt.Printf("Exit Code: %d\n", *status.ExitCode)
-	}
-	fmt.Printf("Started: %s\n", status.StartedAt)
-	if status.EndedAt != nil {
-		fmt.Printf("Ended: %s\n", *status.EndedAt)
-	}
-	fmt.Printf("Command: %v\n", status.Command)
-	fmt.Printf("Has VTY: %v\n", status.HasVTY)
-
-	return nil
-}
-
-func cmdAttach(c *bgclient.Client) error {
-	// Check if we're running in a terminal
-	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
-		return cmdAttachNonInteractive(c)
+func cmdRetry(c *bgclient.Client) error {
+	if !c.IsZombie() {
+		return fmt.Errorf("process is still running, only terminated jobs can be retried")
 	}
 
-	// Get process status to check if it's VTY mode
-	status, err := c.GetStatus()
+	config, err := daemon.LoadConfig(c.RuntimeDir())
 	if err != nil {
 		return err
 	}
 
-	if status.HasVTY {
-		// Interactive VTY mode
-		return cmdAttachInteractive(c)
-	}
-
-	// Non-VTY mode (just display output)
-	return cmdAttachNonInteractive(c)
-}
-
-func trimTrailingSpaces(s string) string {
-	i := len(s) - 1
-	for i >= 0 && s[i] == ' ' {
-		i--
-	}
-	return s[:i+1]
-}
-
-func cmdAttachNonInteractive(c *bgclient.Client) error {
-	// Attach to both stdout and stderr
-	if err := c.Attach(protocol.StreamBoth); err != nil {
-		return err
-	}
-
-	fmt.Println("Attached to process output (press Ctrl+C to detach)")
-	fmt.Println("---")
+	// The new run gets its own runtime directory and links back to this one
+	config.RuntimeDir = ""
+	config.PreviousRun = c.RuntimeDir()
 
-	// Read and display output
-	return c.ReadMessages(
-		func(stream byte, data []byte) error {
-			if stream == protocol.StreamStderr {
-				os.Stderr.Write(data)
-			} else {
-				os.Stdout.Write(data)
-			}
-			return nil
-		},
-		func(exitCode int) {
-			fmt.Printf("\n---\nProcess exited with code %d\n", exitCode)
-		},
-	)
-}
-
-func cmdAttachInteractive(c *bgclient.Client) error {
-	// Put terminal in raw mode
-	fd := int(os.Stdin.Fd())
-	state, err := terminal.MakeRaw(fd)
-	if err != nil {
-		return fmt.Errorf("failed to make terminal raw: %w", err)
-	}
-	defer state.Restore()
-
-	// Get current terminal size
-	rows, cols, err := terminal.GetSize(fd)
+	executable, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("failed to get terminal size: %w", err)
-	}
-
-	// Send initial resize before getting screen (ensures screen is sized correctly)
-	if err := c.Resize(uint16(rows), uint16(cols)); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to resize terminal: %v\n", err)
+		return fmt.Errorf("failed to locate bgrun executable: %w", err)
 	}
 
-	// Get and display current screen state
-	screen, err := c.GetScreen()
+	pid, err := spawnBackground(executable, configArgs(config), configEnv(config)...)
 	if err != nil {
-		// Non-fatal - just warn and continue
-		fmt.Fprintf(os.Stderr, "Warning: failed to get screen state: %v\r\n", err)
-	} else {
-		// Clear screen and move to top-left
-		fmt.Print("\x1b[2J\x1b[H")
-
-		// Display the current screen
-		// Trim trailing spaces from each line for better display
-		for i, line := range screen.Lines {
-			trimmed := trimTrailingSpaces(line)
-			fmt.Print(trimmed)
-			// Add newline unless it's the last line (to preserve cursor position)
-			if i < len(screen.Lines)-1 {
-				fmt.Print("\r\n")
-			}
-		}
-
-		// Move cursor to the reported position
-		if screen.CursorRow >= 0 && screen.CursorCol >= 0 {
-			// ANSI escape: CSI row ; col H (positions are 1-indexed)
-			fmt.Printf("\r\n\x1b[%d;%dH", screen.CursorRow+1, screen.CursorCol+1)
-		}
-	}
-
-	// Attach to output
-	if err := c.Attach(protocol.StreamBoth); err != nil {
-		return err
-	}
-
-	// Watch for resize signals
-	resizeCh := terminal.WatchResize()
-	defer terminal.StopWatchingResize(resizeCh)
-
-	// Channel for errors
-	errCh := make(chan error, 2)
-	doneCh := make(chan struct{})
-
-	// Goroutine to read from stdin and send to server
-	// Implements SSH-style escape sequences:
-	//   <Enter>~.  -> detach
-	//   <Enter>~~  -> send literal ~ (escape the escape)
-	detachCh := make(chan struct{})
-	go func() {
-		buf := make([]byte, 1024)
-		var lastByte byte // Track last byte for escape sequence detection
-
-		for {
-			n, err := os.Stdin.Read(buf)
-			if n > 0 {
-				data := buf[:n]
-				output := make([]byte, 0, len(data))
-
-				// Process data looking for escape sequences
-				for i := 0; i < len(data); i++ {
-					// Check for escape sequence starting at position i
-					// Pattern: previous byte was newline, current is ~
-					if (lastByte == '\r' || lastByte == '\n') && data[i] == '~' {
-						// Check what follows the ~
-						if i+1 < len(data) {
-							switch data[i+1] {
-							case '.':
-								// Detach sequence: ~.
-								// Send accumulated output (not including the ~.)
-								if len(output) > 0 {
-									c.WriteStdin(output)
-								}
-								close(detachCh)
-								return
-
-							case '~':
-								// Escape sequence: ~~ means literal ~
-								// Add everything up to first ~, then add single ~, skip second ~
-								output = append(output, '~')
-								i++ // Skip the second ~
-								lastByte = '~'
-								continue
-							}
-						}
-					}
-
-					output = append(output, data[i])
-					lastByte = data[i]
-				}
-
-				// Send processed data
-				if len(output) > 0 {
-					if writeErr := c.WriteStdin(output); writeErr != nil {
-						errCh <- fmt.Errorf("failed to write stdin: %w", writeErr)
-						return
-					}
-				}
-			}
-			if err != nil {
-				if err != io.EOF {
-					errCh <- fmt.Errorf("failed to read stdin: %w", err)
-				}
-				return
-			}
-		}
-	}()
-
-	// Goroutine to read from server and write to stdout
-	go func() {
-		err := c.ReadMessages(
-			func(stream byte, data []byte) error {
-				os.Stdout.Write(data)
-				return nil
-			},
-			func(exitCode int) {
-				close(doneCh)
-			},
-		)
-		if err != nil && err != io.EOF {
-			errCh <- err
-		}
-	}()
-
-	// Main loop: handle resize events and detach signal
-	for {
-		select {
-		case <-resizeCh:
-			rows, cols, err := terminal.GetSize(fd)
-			if err == nil {
-				c.Resize(uint16(rows), uint16(cols))
-			}
-
-		case <-detachCh:
-			// User pressed <Enter>~. to detach
-			c.Detach()
-			state.Restore()
-			fmt.Println("\r\n[Detached]")
-			return nil
-
-		case err := <-errCh:
-			state.Restore()
-			return err
-
-		case <-doneCh:
-			state.Restore()
-			fmt.Println("\r\n[Process exited]")
-			return nil
-		}
-	}
-}
-
-func cmdSignal(c *bgclient.Client, sig syscall.Signal) error {
-	if err := c.SendSignal(sig); err != nil {
-		return err
+		return fmt.Errorf("failed to start new run: %w", err)
 	}
 
-	fmt.Printf("Signal %d sent successfully\n", sig)
+	fmt.Println(pid)
 	return nil
 }
 
-func cmdWait(c *bgclient.Client, waitTypeStr string, timeoutSecs uint32) error {
-	var waitType byte
-	switch waitTypeStr {
-	case "exit":
-		waitType = protocol.WaitTypeExit
-	case "foreground":
-		waitType = protocol.WaitTypeForeground
-	default:
-		return fmt.Errorf("invalid wait type: %s (must be 'exit' or 'foreground')", waitTypeStr)
+func cmdVerify(c *bgclient.Client, keyFile string) error {
+	if !c.IsZombie() {
+		return fmt.Errorf("process is still running, artifacts are signed when it exits")
 	}
 
-	fmt.Printf("Waiting for %s (timeout: %d seconds)...\n", waitTypeStr, timeoutSecs)
-
-	status, err := c.Wait(timeoutSecs, waitType)
+	key, err := daemon.LoadVerifyKey(keyFile)
 	if err != nil {
 		return err
 	}
 
-	switch status {
-	case protocol.WaitStatusCompleted:
-		fmt.Println("Wait completed successfully")
-	case protocol.WaitStatusTimeout:
-		fmt.Println("Wait timed out")
-	case protocol.WaitStatusNotApplicable:
-		fmt.Println("Wait type not applicable (e.g., foreground wait on non-VTY process)")
-	default:
-		fmt.Printf("Unknown wait status: %d\n", status)
-	}
-
-	return nil
-}
-
-func cmdShutdown(c *bgclient.Client) error {
-	if err := c.Shutdown(); err != nil {
-		// Connection might close before we get a response, which is OK
-		if err != io.EOF {
-			return err
-		}
-	}
-
-	fmt.Println("Shutdown request sent")
-	return nil
-}
-
-func writeFinalStatus(d *daemon.Daemon) error {
-	status := d.GetStatus()
-
-	// Write status to JSON file in runtime directory
-	statusPath := filepath.Join(d.RuntimeDir(), "status.json")
-	f, err := os.Create(statusPath)
+	sig, err := daemon.VerifyArtifacts(c.Storage(), key)
 	if err != nil {
-		return fmt.Errorf("failed to create status file: %w", err)
+		return err
 	}
-	defer f.Close()
 
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(status); err != nil {
-		return fmt.Errorf("failed to encode status: %w", err)
+	fmt.Printf("Signature OK (%s, signed %s)\n", sig.Algorithm, sig.SignedAt)
+	for _, name := range []string{daemon.StatusFileName, daemon.LogFileName} {
+		if digest, ok := sig.Digests[name]; ok {
+			fmt.Printf("  sha256:%s  %s\n", digest, name)
+		}
 	}
-
 	return nil
 }
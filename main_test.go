@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgattach"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestConfigArgsRoundTrip(t *testing.T) {
+	nice, oomScoreAdj := 10, 500
+	startAt := time.Date(2030, 1, 15, 3, 0, 0, 0, time.UTC)
+	original := &daemon.Config{
+		Command:      []string{"-weird", "arg", "--flag"},
+		StdinMode:    daemon.StdinStream,
+		StdinPath:    "/run/app/jobs.fifo",
+		StdoutMode:   daemon.IOModeFile,
+		StdoutPath:   "/tmp/out.log",
+		StderrMode:   daemon.IOModeNull,
+		StdoutTee:    []string{"/var/log/app/out.log", "/srv/archive/out.log"},
+		UseVTY:       true,
+		StrictVTY:    true,
+		Record:       true,
+		UTF8Chunks:   true,
+		ReplayScreen: true,
+		SizePolicy:   daemon.SizeFixed,
+		FixedRows:    40,
+		FixedCols:    120,
+		Dir:          "/tmp",
+		PreviousRun:  "/run/user/1000/bgrun/1234",
+		LogKeyFile:   "/etc/bgrun/log.key",
+
+		SigningKeyFile: "/etc/bgrun/sign.pem",
+		Quotas:         daemon.Quotas{MaxStdinBytes: 1 << 20, MaxExportBytesPerMinute: 4096},
+		LogLevel:       daemon.LogDebug,
+		LogMaxSize:     4096,
+		MaxLogBytes:    1 << 30,
+		MaxOutputRate:  1 << 20,
+		SocketPath:     "/run/bgrun/team.sock",
+		SocketMode:     0660,
+		SocketGroup:    "wheel",
+		AllowedUIDs:    []int{1000, 1001},
+		AllowedGIDs:    []int{2000},
+		Permissions:    daemon.PermObserve | daemon.PermSignal,
+
+		ListenTCP:       ":7420",
+		TLSCertFile:     "/etc/bgrun/daemon.pem",
+		TLSKeyFile:      "/etc/bgrun/daemon.key",
+		TLSClientCAFile: "/etc/bgrun/clients.pem",
+
+		ListenWebSocket:  "127.0.0.1:7421",
+		WebSocketOrigins: []string{"https://ops.example", "https://term.example"},
+		ListenWebUI:      ":8080",
+		ListenAPI:        "unix:/run/bgrun/api.sock",
+		AllowAnonymous:   true,
+
+		SyslogFacility: "local3",
+		SyslogTag:      "nightly",
+		KeepLog:        true,
+
+		Cgroup: &daemon.CgroupConfig{Parent: "/user.slice/bgrun", CPUWeight: 50, MemoryMax: 1 << 30, PidsMax: 64},
+		Rlimits: []daemon.Rlimit{
+			{Resource: "nofile", Soft: 1024, Hard: 4096},
+			{Resource: "core", Soft: 0, Hard: 0},
+			{Resource: "stack", Soft: 8 << 20, Hard: daemon.RlimitInfinity},
+		},
+		Nice:           &nice,
+		IONice:         "best-effort:6",
+		OOMScoreAdj:    &oomScoreAdj,
+		NoNewPrivs:     true,
+		SeccompProfile: "/etc/bgrun/seccomp.json",
+
+		HealthCheck:  &daemon.HealthCheck{HTTP: "http://localhost:8080/healthz", Interval: 5, Timeout: 2, Retries: 4, Restart: true},
+		Webhooks:     []string{"https://ci.example/hooks/bgrun", "http://localhost:9000/notify"},
+		WebhookLines: 50,
+		StartAt:      &startAt,
+		Hooks: daemon.Hooks{
+			PreStart:  "mkdir -p /tmp/build",
+			PostStart: "echo started $BGRUN_PID",
+			PostExit:  "notify-send build exited $BGRUN_EXIT_CODE",
+			OnRestart: "rm -rf /tmp/build",
+		},
+		LingerAfterExit: 30,
+		Env:             []string{"GOFLAGS=-mod=mod", "EMPTY="},
+		EnvFiles:        []string{"/etc/app/defaults.env", "/etc/app/prod.env"},
+	}
+
+	fs := flag.NewFlagSet("bgrun", flag.ContinueOnError)
+	oldCommandLine := flag.CommandLine
+	flag.CommandLine = fs
+	defer func() { flag.CommandLine = oldCommandLine }()
+
+	*stdinFlag, *stdoutFlag, *stderrFlag = "null", "log", "log"
+	*vtyFlag, *dirFlag, *previousFlag, *logKeyFlag, *signKeyFlag = false, "", "", "", ""
+	fs.StringVar(stdinFlag, "stdin", "null", "")
+	fs.StringVar(stdoutFlag, "stdout", "log", "")
+	fs.StringVar(stderrFlag, "stderr", "log", "")
+	fs.BoolVar(vtyFlag, "vty", false, "")
+	*strictFlag, *recordFlag, *utf8Flag, *replayFlag = false, false, false, false
+	fs.BoolVar(strictFlag, "strict", false, "")
+	fs.BoolVar(recordFlag, "record", false, "")
+	fs.BoolVar(utf8Flag, "utf8-chunks", false, "")
+	fs.BoolVar(replayFlag, "replay-screen", false, "")
+	*sizeFlag = "latest"
+	fs.StringVar(sizeFlag, "size-policy", "latest", "")
+	fs.StringVar(dirFlag, "dir", "", "")
+	fs.StringVar(previousFlag, "previous-run", "", "")
+	fs.StringVar(logKeyFlag, "log-key-file", "", "")
+	fs.StringVar(signKeyFlag, "sign-key", "", "")
+	*quotaStdinFlag, *quotaExpFlag = 0, 0
+	fs.Int64Var(quotaStdinFlag, "quota-stdin", 0, "")
+	fs.Int64Var(quotaExpFlag, "quota-export", 0, "")
+	*logLevelFlag, *logMaxFlag, *outputMaxFlag, *outputRateFlag = "info", 0, 0, 0
+	fs.StringVar(logLevelFlag, "log-level", "info", "")
+	fs.Int64Var(logMaxFlag, "log-max-size", 0, "")
+	fs.Int64Var(outputMaxFlag, "output-max-size", 0, "")
+	fs.Int64Var(outputRateFlag, "output-rate", 0, "")
+	*socketFlag, *sockModeFlag, *sockGroupFlag = "", "", ""
+	fs.StringVar(socketFlag, "socket", "", "")
+	fs.StringVar(sockModeFlag, "socket-mode", "", "")
+	fs.StringVar(sockGroupFlag, "socket-group", "", "")
+	*allowUIDFlag, *allowGIDFlag = "", ""
+	fs.StringVar(allowUIDFlag, "allow-uid", "", "")
+	fs.StringVar(allowGIDFlag, "allow-gid", "", "")
+	*permsFlag = ""
+	fs.StringVar(permsFlag, "permissions", "", "")
+	*listenFlag, *tlsCertFlag, *tlsKeyFlag, *tlsCAFlag = "", "", "", ""
+	fs.StringVar(listenFlag, "listen", "", "")
+	fs.StringVar(tlsCertFlag, "tls-cert", "", "")
+	fs.StringVar(tlsKeyFlag, "tls-key", "", "")
+	fs.StringVar(tlsCAFlag, "tls-client-ca", "", "")
+	*listenWSFlag, *wsOriginFlag = "", ""
+	fs.StringVar(listenWSFlag, "listen-ws", "", "")
+	fs.StringVar(wsOriginFlag, "ws-origin", "", "")
+	*listenWebFlag = ""
+	fs.StringVar(listenWebFlag, "listen-web", "", "")
+	*apiFlag, *anonymousFlag = "", false
+	fs.StringVar(apiFlag, "api", "", "")
+	fs.BoolVar(anonymousFlag, "allow-anonymous", false, "")
+	*facilityFlag, *tagFlag, *keepLogFlag = "", "", false
+	fs.StringVar(facilityFlag, "syslog-facility", "", "")
+	fs.StringVar(tagFlag, "syslog-tag", "", "")
+	fs.BoolVar(keepLogFlag, "keep-log", false, "")
+	*cgroupFlag, *cgParentFlag, *cpuWeightFlag, *memoryMaxFlag, *pidsMaxFlag = false, "", 0, 0, 0
+	fs.BoolVar(cgroupFlag, "cgroup", false, "")
+	fs.StringVar(cgParentFlag, "cgroup-parent", "", "")
+	fs.IntVar(cpuWeightFlag, "cpu-weight", 0, "")
+	fs.Int64Var(memoryMaxFlag, "memory-max", 0, "")
+	fs.Int64Var(pidsMaxFlag, "pids-max", 0, "")
+	*rlimitFlag = ""
+	fs.StringVar(rlimitFlag, "rlimit", "", "")
+	*niceFlag, *ioniceFlag, *oomAdjFlag = "", "", ""
+	fs.StringVar(niceFlag, "nice", "", "")
+	fs.StringVar(ioniceFlag, "ionice", "", "")
+	fs.StringVar(oomAdjFlag, "oom-score-adj", "", "")
+	*noNewPrivsFlag, *seccompFlag = false, ""
+	fs.BoolVar(noNewPrivsFlag, "no-new-privs", false, "")
+	fs.StringVar(seccompFlag, "seccomp", "", "")
+	*healthCmdFlag, *healthTCPFlag, *healthHTTPFlag, *healthPatFlag = "", "", "", ""
+	*healthIntFlag, *healthTOFlag, *healthRetFlag, *healthRstFlag = 0, 0, 0, false
+	fs.StringVar(healthCmdFlag, "health-cmd", "", "")
+	fs.StringVar(healthTCPFlag, "health-tcp", "", "")
+	fs.StringVar(healthHTTPFlag, "health-http", "", "")
+	fs.StringVar(healthPatFlag, "health-pattern", "", "")
+	fs.IntVar(healthIntFlag, "health-interval", 0, "")
+	fs.IntVar(healthTOFlag, "health-timeout", 0, "")
+	fs.IntVar(healthRetFlag, "health-retries", 0, "")
+	fs.BoolVar(healthRstFlag, "health-restart", false, "")
+	*webhookFlag, *webhookLnFlag = "", 0
+	fs.StringVar(webhookFlag, "webhook", "", "")
+	fs.IntVar(webhookLnFlag, "webhook-lines", 0, "")
+	envFlag, envFileFlag = nil, nil
+	fs.Var(&envFlag, "env", "")
+	fs.Var(&envFileFlag, "env-file", "")
+	stdoutTeeFlag, stderrTeeFlag = nil, nil
+	fs.Var(&stdoutTeeFlag, "stdout-tee", "")
+	fs.Var(&stderrTeeFlag, "stderr-tee", "")
+	*lingerFlag = 0
+	fs.IntVar(lingerFlag, "linger", 0, "")
+	*startDelayFlag, *startAtFlag, *scheduleFlag = 0, "", ""
+	fs.IntVar(startDelayFlag, "start-delay", 0, "")
+	fs.StringVar(startAtFlag, "start-at", "", "")
+	fs.StringVar(scheduleFlag, "schedule", "", "")
+	*preStartFlag, *postStartFlag, *postExitFlag, *onRestartFlag = "", "", "", ""
+	fs.StringVar(preStartFlag, "pre-start", "", "")
+	fs.StringVar(postStartFlag, "post-start", "", "")
+	fs.StringVar(postExitFlag, "post-exit", "", "")
+	fs.StringVar(onRestartFlag, "on-restart", "", "")
+
+	args := configArgs(original)
+	if slices.Contains(args, "-env") {
+		t.Errorf("Expected the variables of the process out of the command line, got %q", args)
+	}
+	for _, kv := range configEnv(original) {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Failed to parse generated args: %v", err)
+	}
+
+	parsed, err := parseConfig(fs.Args())
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("Config did not round-trip:\n got  %+v\n want %+v", parsed, original)
+	}
+}
+
+func TestLoadJobFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.json")
+	job := `{
+		"command": ["make", "build"],
+		"env": {"CC": "clang", "CFLAGS": "-O2"},
+		"vty": true,
+		"stdout": "/tmp/build.log",
+		"webhook-lines": 50,
+		"rlimit": ["nofile=1024:4096", "core=0"],
+		"env-file": ["defaults.env", "local.env"]
+	}`
+	if err := os.WriteFile(path, []byte(job), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newFlags := func() (*flag.FlagSet, *bool, *string, *int, *string) {
+		envFileFlag = nil
+		fs := flag.NewFlagSet("bgrun", flag.ContinueOnError)
+		fs.Var(&envFileFlag, "env-file", "")
+		return fs, fs.Bool("vty", false, ""), fs.String("stdout", "log", ""), fs.Int("webhook-lines", 0, ""), fs.String("rlimit", "", "")
+	}
+	defer func() { envFlag, envFileFlag = nil, nil }()
+
+	fs, vty, stdout, lines, rlimit := newFlags()
+	envFlag = nil
+	command, err := loadJobFile(path, fs, false)
+	if err != nil {
+		t.Fatalf("Failed to load job file: %v", err)
+	}
+	if !slices.Equal(command, []string{"make", "build"}) || !*vty || *stdout != "/tmp/build.log" || *lines != 50 || *rlimit != "nofile=1024:4096,core=0" {
+		t.Errorf("Unexpected options %q %v %q %d %q", command, *vty, *stdout, *lines, *rlimit)
+	}
+	if !slices.Equal(envFlag, []string{"CC=clang", "CFLAGS=-O2"}) || !slices.Equal(envFileFlag, []string{"defaults.env", "local.env"}) {
+		t.Errorf("Unexpected environment %q %q", envFlag, envFileFlag)
+	}
+
+	// The command line overrides the file
+	fs, vty, stdout, _, _ = newFlags()
+	envFlag = nil
+	fs.Var(&envFlag, "env", "")
+	if err := fs.Parse([]string{"-stdout", "null", "-env", "CC=gcc", "-env-file", "ci.env", "true"}); err != nil {
+		t.Fatal(err)
+	}
+	command, err = loadJobFile(path, fs, true)
+	if err != nil {
+		t.Fatalf("Failed to load job file: %v", err)
+	}
+	if command != nil || !*vty || *stdout != "null" {
+		t.Errorf("Expected the command line to win, got %q %v %q", command, *vty, *stdout)
+	}
+	if !slices.Equal(envFlag, []string{"CC=clang", "CFLAGS=-O2", "CC=gcc"}) || !slices.Equal(envFileFlag, []string{"defaults.env", "local.env", "ci.env"}) {
+		t.Errorf("Expected the variables of the command line last, got %q %q", envFlag, envFileFlag)
+	}
+
+	for _, job := range []string{`{"nope": 1}`, `{"ctl": true}`, `{"command": "make"}`, `{"vty": {}}`, `[]`} {
+		if err := os.WriteFile(path, []byte(job), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _, _ := newFlags()
+		fs.Bool("ctl", false, "")
+		if _, err := loadJobFile(path, fs, false); err == nil {
+			t.Errorf("Expected %s to be refused", job)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	t.Setenv("SHELL", "/bin/bash")
+	if got := shellCommand("make && make test", []string{"build", "x"}); !reflect.DeepEqual(got, []string{"/bin/bash", "-c", "make && make test", "build", "x"}) {
+		t.Errorf("Unexpected shell command %q", got)
+	}
+	t.Setenv("SHELL", "")
+	if got := shellCommand("echo $1", nil); !reflect.DeepEqual(got, []string{"/bin/sh", "-c", "echo $1"}) {
+		t.Errorf("Expected /bin/sh without $SHELL, got %q", got)
+	}
+}
+
+func TestParseStartAt(t *testing.T) {
+	now := time.Date(2030, 1, 15, 12, 30, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Time{
+		"2030-02-01T08:00:00Z": time.Date(2030, 2, 1, 8, 0, 0, 0, time.UTC),
+		"18:00":                time.Date(2030, 1, 15, 18, 0, 0, 0, time.UTC),
+		"12:30":                time.Date(2030, 1, 16, 12, 30, 0, 0, time.UTC),
+	} {
+		at, err := parseStartAt(value, now)
+		if err != nil || !at.Equal(expected) {
+			t.Errorf("Expected %q to be %v, got %v (%v)", value, expected, at, err)
+		}
+	}
+	if _, err := parseStartAt("tomorrow", now); err == nil {
+		t.Error("Expected an invalid time to be refused")
+	}
+}
+
+func TestIOModeArgs(t *testing.T) {
+	for _, arg := range []string{"null", "log", "syslog", "journal", "|ts -s '%H:%M:%S'", "/tmp/out.log"} {
+		mode, value, err := daemon.ParseIOMode(arg)
+		if err != nil {
+			t.Errorf("ParseIOMode(%q) failed: %v", arg, err)
+			continue
+		}
+		path, filter := value, ""
+		if mode == daemon.IOModeFilter {
+			path, filter = "", value
+		}
+		if got := ioModeArg(mode, path, filter); got != arg {
+			t.Errorf("Expected %q to round-trip, got %q", arg, got)
+		}
+	}
+	if _, _, err := daemon.ParseIOMode("| "); err == nil {
+		t.Error("Expected an empty filter command to be refused")
+	}
+}
+
+func TestSpawnBackground(t *testing.T) {
+	// The daemon reports on the file descriptor named by the environment
+	pid, err := spawnBackground("sh", []string{"-c", `[ "$` + readyFDEnv + `" = 3 ] && echo ready >&3; exec 3>&-; sleep 1`})
+	if err != nil {
+		t.Fatalf("spawnBackground failed: %v", err)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Errorf("Expected the daemon %d to run: %v", pid, err)
+	}
+
+	if _, err := spawnBackground("sh", []string{"-c", `printf 'failed to start process' >&3; exit 1`}); err == nil || err.Error() != "failed to start process" {
+		t.Errorf("Expected the error reported by the daemon, got %v", err)
+	}
+	if _, err := spawnBackground("sh", []string{"-c", "exit 2"}); err == nil || !strings.Contains(err.Error(), "exit status 2") {
+		t.Errorf("Expected the exit status of the daemon, got %v", err)
+	}
+}
+
+func TestNormalizeOutput(t *testing.T) {
+	data := []byte("\x1b[32mok\x1b[0m  \r\n" +
+		"progress 10%\rprogress 100%\n" +
+		"\x1b]0;title\x07started at 2026-01-02T15:04:05.123Z\n" +
+		"[12:30:01] done\n")
+
+	expected := []string{
+		"ok",
+		"progress 100%",
+		"started at <TIMESTAMP>",
+		"[<TIMESTAMP>] done",
+	}
+	if lines := normalizeOutput(data); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, strconv.Itoa(i))
+		b = append(b, strconv.Itoa(i))
+	}
+	b[4] = "five"
+	b = append(b, "21")
+
+	var buf bytes.Buffer
+	if !writeUnifiedDiff(&buf, "a", "b", diffLines(a, b), false) {
+		t.Fatal("Expected differences to be reported")
+	}
+
+	expected := "--- a\n+++ b\n" +
+		"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n" +
+		"@@ -18,3 +18,4 @@\n 18\n 19\n 20\n+21\n"
+	if buf.String() != expected {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if writeUnifiedDiff(&buf, "a", "b", diffLines(a, a), false) || buf.Len() != 0 {
+		t.Errorf("Expected no output for identical input, got %q", buf.String())
+	}
+}
+
+func TestInputModesSequence(t *testing.T) {
+	modes := protocol.InputModes{BracketedPaste: true, ApplicationKeypad: true}
+	if seq := bgattach.InputModesSequence(modes); seq != "\x1b[?2004h\x1b[?1l\x1b=" {
+		t.Errorf("Unexpected sequence %q", seq)
+	}
+	if seq := bgattach.InputModesSequence(protocol.InputModes{}); seq != "\x1b[?2004l\x1b[?1l\x1b>" {
+		t.Errorf("Unexpected reset sequence %q", seq)
+	}
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression algorithms, requested by the client in the CAPABILITIES
+// payload
+const (
+	CompressionNone byte = 0x00
+	CompressionGzip byte = 0x01
+)
+
+// CompressMinSize is the payload size from which a Compressor compresses
+// messages; smaller ones are not worth it
+const CompressMinSize = 1024
+
+// maxMessageLength is the largest message length accepted, compressed
+// messages included once decompressed
+const maxMessageLength = 10 * 1024 * 1024
+
+// CompressionName returns the name of a compression algorithm, as reported
+// in Capabilities.Compression, or "" if it is unknown
+func CompressionName(algorithm byte) string {
+	switch algorithm {
+	case CompressionGzip:
+		return "gzip"
+	default:
+		return ""
+	}
+}
+
+// MessageWriter is implemented by writers that handle whole messages, such
+// as Compressor. WriteMessage and the other Write functions hand their
+// message to it instead of writing the bytes.
+type MessageWriter interface {
+	WriteMessage(msgType MessageType, payload []byte) error
+}
+
+// Compressor writes messages to W, sending those with a payload of at least
+// CompressMinSize as COMPRESSED messages when that makes them smaller. The
+// reader must have asked for the compression, ReadMessage decompressing
+// them transparently.
+type Compressor struct {
+	W         io.Writer
+	Algorithm byte
+}
+
+// gzipWriters are reused across messages, their state being large
+var gzipWriters = sync.Pool{
+	New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return zw
+	},
+}
+
+// Write writes p to the underlying writer as is
+func (c *Compressor) Write(p []byte) (int, error) {
+	return c.W.Write(p)
+}
+
+// WriteMessage writes a message, compressed if it is large enough
+func (c *Compressor) WriteMessage(msgType MessageType, payload []byte) error {
+	if c.Algorithm != CompressionGzip || len(payload) < CompressMinSize {
+		return WriteMessage(c.W, msgType, payload)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{c.Algorithm, byte(msgType)})
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(&buf)
+	_, err := zw.Write(payload)
+	if err == nil {
+		err = zw.Close()
+	}
+	gzipWriters.Put(zw)
+	if err != nil {
+		return fmt.Errorf("failed to compress message: %w", err)
+	}
+
+	// Incompressible data goes as is
+	if buf.Len() >= len(payload) {
+		return WriteMessage(c.W, msgType, payload)
+	}
+	return WriteMessage(c.W, MsgCompressed, buf.Bytes())
+}
+
+// decompress returns the message held by a COMPRESSED payload
+func decompress(payload []byte) (*Message, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("invalid compressed payload length")
+	}
+	if payload[0] != CompressionGzip {
+		return nil, fmt.Errorf("unknown compression algorithm: 0x%02X", payload[0])
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload[2:]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, maxMessageLength))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	if len(data) >= maxMessageLength {
+		return nil, fmt.Errorf("invalid decompressed message length")
+	}
+	return &Message{Type: MessageType(payload[1]), Payload: data}, nil
+}
+
+// writeOutputMessage hands an output message to a MessageWriter, which
+// needs the payload in one buffer
+func writeOutputMessage(mw MessageWriter, msgType MessageType, header, data []byte) error {
+	payload := make([]byte, 0, len(header)+len(data))
+	payload = append(append(payload, header...), data...)
+	return mw.WriteMessage(msgType, payload)
+}
+
+// WriteCompressionRequest writes a capabilities request asking for the
+// compression algorithms given in order of preference
+func WriteCompressionRequest(w io.Writer, algorithms ...byte) error {
+	return WriteMessage(w, MsgCapabilities, algorithms)
+}
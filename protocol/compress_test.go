@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	large := []byte(strings.Repeat("building target\n", 1000))
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		compressed bool
+	}{
+		{"small", []byte("short"), false},
+		{"large", large, true},
+		{"incompressible", random, false},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteMessage(&Compressor{W: &buf, Algorithm: CompressionGzip}, MsgExportResponse, tt.payload); err != nil {
+			t.Fatalf("%s: WriteMessage failed: %v", tt.name, err)
+		}
+		if wire := MessageType(buf.Bytes()[4]); (wire == MsgCompressed) != tt.compressed {
+			t.Errorf("%s: unexpected message type %s on the wire", tt.name, wire.Name())
+		}
+
+		msg, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("%s: ReadMessage failed: %v", tt.name, err)
+		}
+		if msg.Type != MsgExportResponse || !bytes.Equal(msg.Payload, tt.payload) {
+			t.Errorf("%s: expected the original message back, got %s with %d bytes", tt.name, msg.Type.Name(), len(msg.Payload))
+		}
+	}
+}
+
+func TestCompressorOutput(t *testing.T) {
+	data := []byte(strings.Repeat("warning: unused variable\n", 200))
+
+	var buf bytes.Buffer
+	w := &Compressor{W: &buf, Algorithm: CompressionGzip}
+	if err := WriteOutputAtTo(w, StreamStderr, 1234, data); err != nil {
+		t.Fatalf("WriteOutputAtTo failed: %v", err)
+	}
+	if buf.Len() >= len(data) {
+		t.Errorf("Expected the output to be compressed, got %d bytes", buf.Len())
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	stream, offset, got, err := ParseOutputAt(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseOutputAt failed: %v", err)
+	}
+	if stream != StreamStderr || offset != 1234 || !bytes.Equal(got, data) {
+		t.Errorf("Expected the output back, got stream %d offset %d and %d bytes", stream, offset, len(got))
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	for _, payload := range [][]byte{
+		{CompressionGzip},
+		{0x7F, byte(MsgOutput), 0x00},
+		{CompressionGzip, byte(MsgOutput), 0x1F, 0x8B, 0x00},
+	} {
+		var buf bytes.Buffer
+		WriteMessage(&buf, MsgCompressed, payload)
+		if _, err := ReadMessage(&buf); err == nil {
+			t.Errorf("Expected compressed payload %x to be rejected", payload)
+		}
+	}
+}
@@ -1,43 +1,185 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
+	"time"
 )
 
+// Version is the protocol version reported in Capabilities. It is bumped
+// when existing messages change in incompatible ways; new messages are
+// detected through Capabilities.Messages instead.
+const Version = 1
+
 // MessageType represents the type of protocol message
 type MessageType byte
 
 // Client → Server message types
 const (
-	MsgStatus     MessageType = 0x01
-	MsgStdin      MessageType = 0x02
-	MsgSignal     MessageType = 0x03
-	MsgResize     MessageType = 0x04
-	MsgAttach     MessageType = 0x05
-	MsgDetach     MessageType = 0x06
-	MsgCloseStdin MessageType = 0x07
-	MsgWait       MessageType = 0x08
-	MsgGetScreen  MessageType = 0x09
-	MsgExport     MessageType = 0x0A
-	MsgShutdown   MessageType = 0x10
+	MsgStatus           MessageType = 0x01
+	MsgStdin            MessageType = 0x02
+	MsgSignal           MessageType = 0x03
+	MsgResize           MessageType = 0x04
+	MsgAttach           MessageType = 0x05
+	MsgDetach           MessageType = 0x06
+	MsgCloseStdin       MessageType = 0x07
+	MsgWait             MessageType = 0x08
+	MsgGetScreen        MessageType = 0x09
+	MsgExport           MessageType = 0x0A
+	MsgGetTitle         MessageType = 0x0B
+	MsgGetCommands      MessageType = 0x0C
+	MsgGetCommandOutput MessageType = 0x0D
+	MsgRecord           MessageType = 0x0E
+	MsgGetRecording     MessageType = 0x0F
+	MsgShutdown         MessageType = 0x10
+	MsgCapabilities     MessageType = 0x11
+	MsgReplay           MessageType = 0x12
+	MsgSearch           MessageType = 0x13
+	MsgSubscribeScreen  MessageType = 0x14
+	MsgGetTimeline      MessageType = 0x15
+	MsgGetScreenCells   MessageType = 0x16
+	MsgHealth           MessageType = 0x17
+	MsgPing             MessageType = 0x18
+	MsgCredit           MessageType = 0x19
+	MsgSubscribe        MessageType = 0x1A
+	MsgExpect           MessageType = 0x1B
+	MsgPause            MessageType = 0x1C
+	MsgResume           MessageType = 0x1D
+	MsgStdinFile        MessageType = 0x1E
+	MsgSetLogLevel      MessageType = 0x1F
+	MsgJobControl       MessageType = 0x20
+	MsgSelectJob        MessageType = 0x21
+	MsgCheckpoint       MessageType = 0x22
+	MsgGetScrollback    MessageType = 0x23
 )
 
 // Server → Client message types
 const (
-	MsgStatusResponse MessageType = 0x80
-	MsgOutput         MessageType = 0x81
-	MsgSignalResponse MessageType = 0x82
-	MsgResizeResponse MessageType = 0x83
-	MsgWaitResponse   MessageType = 0x88
-	MsgScreenResponse MessageType = 0x89
-	MsgExportResponse MessageType = 0x8A
-	MsgError          MessageType = 0x8F
-	MsgProcessExit    MessageType = 0x90
+	MsgStatusResponse       MessageType = 0x80
+	MsgOutput               MessageType = 0x81
+	MsgSignalResponse       MessageType = 0x82
+	MsgResizeResponse       MessageType = 0x83
+	MsgRecordResponse       MessageType = 0x84
+	MsgRecording            MessageType = 0x85
+	MsgCapabilitiesResponse MessageType = 0x86
+	MsgReplayEnd            MessageType = 0x87
+	MsgWaitResponse         MessageType = 0x88
+	MsgScreenResponse       MessageType = 0x89
+	MsgExportResponse       MessageType = 0x8A
+	MsgTitleResponse        MessageType = 0x8B
+	MsgCommandsResponse     MessageType = 0x8C
+	MsgSearchResponse       MessageType = 0x8D
+	MsgQuotaExceeded        MessageType = 0x8E
+	MsgError                MessageType = 0x8F
+	MsgProcessExit          MessageType = 0x90
+	MsgScreenUpdate         MessageType = 0x91
+	MsgTimeline             MessageType = 0x92
+	MsgScreenCellsResponse  MessageType = 0x93
+	MsgHealthResponse       MessageType = 0x94
+	MsgPong                 MessageType = 0x95
+	MsgOutputAt             MessageType = 0x96
+	MsgCompressed           MessageType = 0x97
+	MsgEvent                MessageType = 0x98
+	MsgExpectResponse       MessageType = 0x99
+	MsgExpectMatch          MessageType = 0x9A
+	MsgPauseResponse        MessageType = 0x9B
+	MsgStdinFileProgress    MessageType = 0x9C
+	MsgLogLevel             MessageType = 0x9D
+	MsgUnauthorized         MessageType = 0x9E
+	MsgJobResponse          MessageType = 0x9F
+	MsgCheckpointResponse   MessageType = 0xA0
+	MsgScrollbackResponse   MessageType = 0xA1
+	MsgDetached             MessageType = 0xA2
 )
 
+// messageNames are the names of the message types, as used in PROTOCOL.md
+var messageNames = map[MessageType]string{
+	MsgStatus:               "STATUS",
+	MsgStdin:                "STDIN",
+	MsgSignal:               "SIGNAL",
+	MsgResize:               "RESIZE",
+	MsgAttach:               "ATTACH",
+	MsgDetach:               "DETACH",
+	MsgCloseStdin:           "CLOSE_STDIN",
+	MsgWait:                 "WAIT",
+	MsgGetScreen:            "GET_SCREEN",
+	MsgExport:               "EXPORT",
+	MsgGetTitle:             "GET_TITLE",
+	MsgGetCommands:          "GET_COMMANDS",
+	MsgGetCommandOutput:     "GET_COMMAND_OUTPUT",
+	MsgRecord:               "RECORD",
+	MsgGetRecording:         "GET_RECORDING",
+	MsgShutdown:             "SHUTDOWN",
+	MsgCapabilities:         "CAPABILITIES",
+	MsgReplay:               "REPLAY",
+	MsgSearch:               "SEARCH",
+	MsgSubscribeScreen:      "SUBSCRIBE_SCREEN",
+	MsgGetTimeline:          "GET_TIMELINE",
+	MsgGetScreenCells:       "GET_SCREEN_CELLS",
+	MsgHealth:               "HEALTH",
+	MsgPing:                 "PING",
+	MsgCredit:               "CREDIT",
+	MsgSubscribe:            "SUBSCRIBE",
+	MsgExpect:               "EXPECT",
+	MsgPause:                "PAUSE",
+	MsgResume:               "RESUME",
+	MsgStdinFile:            "STDIN_FILE",
+	MsgSetLogLevel:          "SET_LOG_LEVEL",
+	MsgJobControl:           "JOB_CONTROL",
+	MsgSelectJob:            "SELECT_JOB",
+	MsgCheckpoint:           "CHECKPOINT",
+	MsgGetScrollback:        "GET_SCROLLBACK",
+	MsgStatusResponse:       "STATUS_RESPONSE",
+	MsgOutput:               "OUTPUT",
+	MsgSignalResponse:       "SIGNAL_RESPONSE",
+	MsgResizeResponse:       "RESIZE_RESPONSE",
+	MsgRecordResponse:       "RECORD_RESPONSE",
+	MsgRecording:            "RECORDING",
+	MsgCapabilitiesResponse: "CAPABILITIES_RESPONSE",
+	MsgReplayEnd:            "REPLAY_END",
+	MsgWaitResponse:         "WAIT_RESPONSE",
+	MsgScreenResponse:       "SCREEN_RESPONSE",
+	MsgExportResponse:       "EXPORT_RESPONSE",
+	MsgTitleResponse:        "TITLE_RESPONSE",
+	MsgCommandsResponse:     "COMMANDS_RESPONSE",
+	MsgSearchResponse:       "SEARCH_RESPONSE",
+	MsgQuotaExceeded:        "QUOTA_EXCEEDED",
+	MsgError:                "ERROR",
+	MsgProcessExit:          "PROCESS_EXIT",
+	MsgScreenUpdate:         "SCREEN_UPDATE",
+	MsgTimeline:             "TIMELINE",
+	MsgScreenCellsResponse:  "SCREEN_CELLS_RESPONSE",
+	MsgHealthResponse:       "HEALTH_RESPONSE",
+	MsgPong:                 "PONG",
+	MsgOutputAt:             "OUTPUT_AT",
+	MsgCompressed:           "COMPRESSED",
+	MsgEvent:                "EVENT",
+	MsgExpectResponse:       "EXPECT_RESPONSE",
+	MsgExpectMatch:          "EXPECT_MATCH",
+	MsgPauseResponse:        "PAUSE_RESPONSE",
+	MsgStdinFileProgress:    "STDIN_FILE_PROGRESS",
+	MsgLogLevel:             "LOG_LEVEL",
+	MsgUnauthorized:         "UNAUTHORIZED",
+	MsgJobResponse:          "JOB_RESPONSE",
+	MsgCheckpointResponse:   "CHECKPOINT_RESPONSE",
+	MsgScrollbackResponse:   "SCROLLBACK_RESPONSE",
+	MsgDetached:             "DETACHED",
+}
+
+// Name returns the protocol name of the message type
+func (t MessageType) Name() string {
+	if name, ok := messageNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", byte(t))
+}
+
 // Stream identifiers for output
 const (
 	StreamStdout byte = 0x01
@@ -47,8 +189,11 @@ const (
 
 // Wait types
 const (
-	WaitTypeExit       byte = 0x00 // Wait for process to exit
-	WaitTypeForeground byte = 0x01 // Wait for foreground control (VTY only)
+	WaitTypeExit         byte = 0x00 // Wait for process to exit
+	WaitTypeForeground   byte = 0x01 // Wait for foreground control (VTY only)
+	WaitTypePattern      byte = 0x02 // Wait for a regular expression to appear in the output (the screen in VTY mode)
+	WaitTypeOutputIdle   byte = 0x03 // Wait for a period without output
+	WaitTypeScreenStable byte = 0x04 // Wait for a period without screen change (VTY only)
 )
 
 // Wait result status
@@ -58,6 +203,39 @@ const (
 	WaitStatusNotApplicable byte = 0x02 // Wait type not applicable (e.g., foreground wait on non-VTY)
 )
 
+// Recording actions
+const (
+	RecordStop  byte = 0x00 // Stop recording the session
+	RecordStart byte = 0x01 // Start recording the session
+)
+
+// Screen subscription actions
+const (
+	ScreenUnsubscribe byte = 0x00 // Stop receiving screen updates
+	ScreenSubscribe   byte = 0x01 // Receive screen updates
+)
+
+// Event subscription actions
+const (
+	EventsUnsubscribe byte = 0x00 // Stop receiving events
+	EventsSubscribe   byte = 0x01 // Receive lifecycle events
+)
+
+// Flow control policies of an attachment, applied once the client used up
+// its credit
+const (
+	FlowNone  byte = 0x00 // No flow control: output is queued, and dropped when the queue is full
+	FlowPause byte = 0x01 // Stop sending, resuming from the output history with more credit
+	FlowBlock byte = 0x02 // Stop reading the program's output until there is more credit
+)
+
+// Flags of an attachment
+const (
+	AttachExclusive byte = 0x01 // Detach the other clients and hold stdin until detached
+	AttachResume    byte = 0x02 // Send OUTPUT_AT messages, starting from the offset
+	AttachNotify    byte = 0x04 // Send the events of other clients attaching, detaching and resizing
+)
+
 // Message represents a protocol message
 type Message struct {
 	Type    MessageType
@@ -67,12 +245,124 @@ type Message struct {
 // StatusResponse contains process status information
 type StatusResponse struct {
 	PID       int      `json:"pid"`
+	State     string   `json:"state,omitempty"` // StateScheduled, StateRunning, StateExited or StateFailedToStart
 	Running   bool     `json:"running"`
 	ExitCode  *int     `json:"exit_code"`
 	StartedAt string   `json:"started_at"`
 	EndedAt   *string  `json:"ended_at,omitempty"`
 	Command   []string `json:"command"`
 	HasVTY    bool     `json:"has_vty"`
+	Paused    bool     `json:"paused,omitempty"`    // Process group stopped, while still running
+	Title     string   `json:"title,omitempty"`     // Window title set by the program (VTY only)
+	Recording bool     `json:"recording,omitempty"` // Session is being recorded to session.cast (VTY only)
+
+	// StartError is why the process could not be started, such as the
+	// command not being found, with StateFailedToStart
+	StartError string `json:"start_error,omitempty"`
+
+	// ScheduledAt is when the process is to be started, with StateScheduled
+	ScheduledAt string `json:"scheduled_at,omitempty"`
+
+	// UpdatedAt is when the status was taken; status.json is rewritten
+	// while the process runs, so monitors can tell how fresh it is
+	UpdatedAt   string `json:"updated_at,omitempty"`
+	UptimeSecs  int64  `json:"uptime_secs,omitempty"`  // Time the process ran for so far
+	OutputBytes uint64 `json:"output_bytes,omitempty"` // Output read from the process, both streams
+
+	// UnsupportedSequences counts the escape sequences received that the
+	// terminal emulator could not reproduce (VTY only)
+	UnsupportedSequences map[string]int `json:"unsupported_sequences,omitempty"`
+
+	// Run history: runtime directories of the run this one was retried
+	// from and of the run that replaced it
+	PreviousRun string `json:"previous_run,omitempty"`
+	NextRun     string `json:"next_run,omitempty"`
+
+	// Panic is the first panic the daemon recovered from, as the goroutine
+	// and the panic value; its stack trace is in crash.log
+	Panic string `json:"panic,omitempty"`
+
+	// Foreground is the process group in the foreground of the terminal,
+	// such as a command run from a shell (live status of a running VTY
+	// process only)
+	Foreground *ForegroundProcess `json:"foreground,omitempty"`
+
+	// Clients lists the connected clients with their traffic (live status only)
+	Clients []ClientStats `json:"clients,omitempty"`
+
+	// Cgroup is the resource usage of the cgroup the process runs in, when
+	// the daemon placed it in one, as last read once the process exited
+	Cgroup *CgroupStats `json:"cgroup,omitempty"`
+
+	// Checkpoint is the directory of the last checkpoint of the process,
+	// and RestoredFrom the one it was restored from (experimental)
+	Checkpoint   string `json:"checkpoint,omitempty"`
+	RestoredFrom string `json:"restored_from,omitempty"`
+
+	// Health is the health of the process as last checked by the daemon
+	// (HealthStarting, HealthHealthy or HealthUnhealthy) when configured
+	// with a health check, and HealthError why the last check failed while
+	// unhealthy
+	Health      string `json:"health,omitempty"`
+	HealthError string `json:"health_error,omitempty"`
+}
+
+// Process states, reported in StatusResponse.State
+const (
+	StateScheduled     = "scheduled"       // the process waits for the time it is started at
+	StateRunning       = "running"         // the process runs, paused or not
+	StateExited        = "exited"          // the process ran and exited
+	StateFailedToStart = "failed_to_start" // the process never ran, see StartError
+)
+
+// Process health, reported in StatusResponse.Health and health events
+const (
+	HealthStarting  = "starting"  // no check passed or failed enough times yet
+	HealthHealthy   = "healthy"   // the last check passed
+	HealthUnhealthy = "unhealthy" // the checks failed the configured number of times in a row
+)
+
+// ForegroundProcess describes the leader of the foreground process group.
+// Name and Command are empty when it cannot be inspected, having exited or
+// on systems without /proc.
+type ForegroundProcess struct {
+	PID     int      `json:"pid"`
+	Name    string   `json:"name,omitempty"`    // executable name
+	Command []string `json:"command,omitempty"` // command line
+}
+
+// CgroupStats reports the usage and limits of the cgroup v2 of a process.
+// The counters of a controller not enabled in the cgroup are zero.
+type CgroupStats struct {
+	Path          string `json:"path"` // relative to the cgroup2 mount
+	CPUUsageUsec  uint64 `json:"cpu_usage_usec"`
+	CPUUserUsec   uint64 `json:"cpu_user_usec"`
+	CPUSystemUsec uint64 `json:"cpu_system_usec"`
+	CPUWeight     int    `json:"cpu_weight,omitempty"`
+	MemoryCurrent uint64 `json:"memory_current,omitempty"`
+	MemoryPeak    uint64 `json:"memory_peak,omitempty"`
+	MemoryMax     int64  `json:"memory_max,omitempty"` // zero without limit
+	OOMKills      uint64 `json:"oom_kills,omitempty"`
+	PidsCurrent   uint64 `json:"pids_current,omitempty"`
+	PidsMax       int64  `json:"pids_max,omitempty"` // zero without limit
+}
+
+// ClientStats reports the protocol traffic of one connected client, counting
+// whole messages including their 5 byte header
+type ClientStats struct {
+	ID        uint64 `json:"id"`
+	PeerPID   int    `json:"peer_pid,omitempty"` // process on the other end, when known
+	PeerUID   *int   `json:"peer_uid,omitempty"`
+	Remote    string `json:"remote,omitempty"` // certificate subject and address of a TCP client
+	Attached  bool   `json:"attached"`
+	Exclusive bool   `json:"exclusive,omitempty"` // attached with AttachExclusive, holding stdin
+	BytesIn   uint64 `json:"bytes_in"`
+	BytesOut  uint64 `json:"bytes_out"`
+
+	// Output queue of the client: messages pending delivery, and messages
+	// dropped because the client did not keep up
+	QueueDepth int    `json:"queue_depth"`
+	Dropped    uint64 `json:"dropped,omitempty"`
 }
 
 // ScreenResponse contains terminal screen state
@@ -82,6 +372,412 @@ type ScreenResponse struct {
 	CursorRow int      `json:"cursor_row"`
 	CursorCol int      `json:"cursor_col"`
 	Lines     []string `json:"lines"` // Each line as a string
+
+	// InputModes lets an attaching client set its own terminal up the way
+	// the program expects its input
+	InputModes InputModes `json:"input_modes"`
+}
+
+// ScreenCellsResponse is the screen state with the attributes and
+// hyperlinks of the cells, for clients rendering a styled screen
+type ScreenCellsResponse struct {
+	Rows      int          `json:"rows"`
+	Cols      int          `json:"cols"`
+	CursorRow int          `json:"cursor_row"`
+	CursorCol int          `json:"cursor_col"`
+	Lines     []ScreenLine `json:"lines"` // One per row, top to bottom
+
+	InputModes InputModes `json:"input_modes"`
+}
+
+// ScrollbackRequest asks for a page of the scrollback: up to Limit lines
+// from Offset, the oldest line being 0. A negative Offset counts from the
+// end of the scrollback, and a Limit of 0 asks for the lines up to the end.
+type ScrollbackRequest struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// ScrollbackResponse is a page of the scrollback, styled as the lines of
+// ScreenCellsResponse, their Row being their index in the scrollback. Total
+// is the number of lines in the scrollback, Offset the index of the first
+// line returned.
+type ScrollbackResponse struct {
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Lines  []ScreenLine `json:"lines"`
+}
+
+// HealthResponse is the internal health of the daemon, as opposed to the
+// state of the process it runs
+type HealthResponse struct {
+	Healthy bool          `json:"healthy"` // all checks passed
+	Checks  []HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of one health check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// InputModes are the terminal modes set by the program that change how
+// keyboard input and pasted text must be encoded
+type InputModes struct {
+	BracketedPaste    bool `json:"bracketed_paste"`    // mode 2004
+	ApplicationCursor bool `json:"application_cursor"` // DECCKM
+	ApplicationKeypad bool `json:"application_keypad"` // DECKPAM
+}
+
+// ScreenUpdate is pushed to the clients subscribed to the screen: the rows
+// that changed since the previous update. A change of size comes with every
+// row.
+type ScreenUpdate struct {
+	Full      bool         `json:"full"` // Lines holds the whole screen, replacing what the client has
+	Rows      int          `json:"rows"`
+	Cols      int          `json:"cols"`
+	CursorRow int          `json:"cursor_row"`
+	CursorCol int          `json:"cursor_col"`
+	Lines     []ScreenLine `json:"lines"`
+}
+
+// ScreenLine is the content of a screen row, as runs of cells sharing the
+// same attributes. Cells after the last span are blank.
+type ScreenLine struct {
+	Row   int          `json:"row"`
+	Spans []ScreenSpan `json:"spans"`
+}
+
+// ScreenSpan is a run of cells with the same attributes. Colors are -1 for
+// the default color, 0-15 for the base colors and up to 255 for the
+// extended palette.
+type ScreenSpan struct {
+	Text      string `json:"text"`
+	Fg        int    `json:"fg"`
+	Bg        int    `json:"bg"`
+	Bold      bool   `json:"bold,omitempty"`
+	Dim       bool   `json:"dim,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Blink     bool   `json:"blink,omitempty"`
+	Reverse   bool   `json:"reverse,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"`
+	Strike    bool   `json:"strike,omitempty"`
+	Link      string `json:"link,omitempty"` // OSC 8 hyperlink URL
+}
+
+// Quota names reported in QuotaExceeded
+const (
+	QuotaStdinBytes           = "stdin_bytes"             // total stdin bytes per client
+	QuotaExportBytesPerMinute = "export_bytes_per_minute" // screen/export bytes per client per minute
+)
+
+// QuotaExceeded is sent instead of MsgError when a request is rejected
+// because the client exceeded one of the daemon quotas. It implements error
+// so clients can return it as is.
+type QuotaExceeded struct {
+	Quota string `json:"quota"` // one of the Quota* names
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"` // amount already consumed, excluding the rejected request
+}
+
+func (q *QuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded: %s (used %d of %d)", q.Quota, q.Used, q.Limit)
+}
+
+// TitleResponse contains the window title and icon name set by the program
+// through OSC 0/1/2
+type TitleResponse struct {
+	Title    string `json:"title"`
+	IconName string `json:"icon_name"`
+}
+
+// CommandInfo describes a command executed at a shell prompt, as delimited
+// by the shell integration marks (OSC 133)
+type CommandInfo struct {
+	Index      int     `json:"index"`
+	Command    string  `json:"command"`
+	ExitCode   *int    `json:"exit_code"`
+	StartedAt  string  `json:"started_at"`
+	FinishedAt *string `json:"finished_at,omitempty"` // nil while running
+}
+
+// CommandsResponse lists the commands executed in the terminal, oldest first
+type CommandsResponse struct {
+	Commands []CommandInfo `json:"commands"`
+}
+
+// Capabilities describes what a daemon supports, so that clients can check
+// for a feature before using it against an older daemon
+type Capabilities struct {
+	Version       int      `json:"version"`        // protocol version
+	Messages      []string `json:"messages"`       // client requests handled, e.g. "GET_SCREEN"
+	ExportFormats []string `json:"export_formats"` // formats accepted by EXPORT, e.g. "html"
+	WaitTypes     []string `json:"wait_types"`     // "exit", "foreground", "pattern", "output_idle", "screen_stable"
+	Features      []string `json:"features"`       // optional features built into the daemon
+
+	// Compression is the algorithm the daemon picked among those the
+	// client asked for, "" if none
+	Compression string `json:"compression,omitempty"`
+
+	// Permissions lists what the connection may do: "observe", "stdin",
+	// "signal" and "shutdown"
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// HasMessage reports whether the daemon handles the client request t
+func (c *Capabilities) HasMessage(t MessageType) bool {
+	return slices.Contains(c.Messages, t.Name())
+}
+
+// HasFeature reports whether the daemon supports the named feature
+func (c *Capabilities) HasFeature(name string) bool {
+	return slices.Contains(c.Features, name)
+}
+
+// ReplayRequest asks the daemon to stream the recording of the session back
+// with its original timing
+type ReplayRequest struct {
+	Speed float64 `json:"speed"` // playback speed multiplier, 0 meaning 1
+}
+
+// RecordingEvent is an event of an asciinema v2 recording
+type RecordingEvent struct {
+	Time float64 // seconds since the start of the recording
+	Type string  // "o" for output, "r" for resize ("COLSxROWS")
+	Data string
+}
+
+// ParseRecording returns the events of an asciinema v2 recording, as sent
+// in MsgRecording. A truncated last line, as left by a daemon that died
+// while recording, is ignored.
+func ParseRecording(data []byte) ([]RecordingEvent, error) {
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		return nil, fmt.Errorf("failed to parse recording header: %w", err)
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("unsupported recording version %d", header.Version)
+	}
+
+	events := make([]RecordingEvent, 0, len(lines)-1)
+	for i, line := range lines[1:] {
+		if len(line) == 0 {
+			continue
+		}
+		var fields []json.RawMessage
+		var ev RecordingEvent
+		err := json.Unmarshal(line, &fields)
+		if err == nil && len(fields) != 3 {
+			err = fmt.Errorf("expected 3 fields, got %d", len(fields))
+		}
+		if err == nil {
+			err = errors.Join(json.Unmarshal(fields[0], &ev.Time), json.Unmarshal(fields[1], &ev.Type), json.Unmarshal(fields[2], &ev.Data))
+		}
+		if err != nil {
+			if i == len(lines)-2 {
+				break
+			}
+			return nil, fmt.Errorf("failed to parse recording event on line %d: %w", i+2, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// Timeline event types
+const (
+	TimelineStart  = "start"  // recording started, with the terminal size and command
+	TimelineOutput = "output" // output of the program
+	TimelineInput  = "input"  // input sent by a client
+	TimelineResize = "resize" // terminal resized
+	TimelineSignal = "signal" // signal sent by a client
+	TimelineMark   = "mark"   // shell integration mark (OSC 133)
+	TimelineExit   = "exit"   // process exited
+)
+
+// TimelineEvent is a line of timeline.jsonl, which interleaves everything
+// that happened in a recorded session
+type TimelineEvent struct {
+	Time      float64 `json:"time"` // seconds since the start of the recording
+	Type      string  `json:"type"`
+	Data      string  `json:"data,omitempty"`      // output or input, or the mark such as "D;0"
+	Client    uint64  `json:"client,omitempty"`    // client that sent the input or signal
+	Rows      int     `json:"rows,omitempty"`      // terminal size, for start and resize
+	Cols      int     `json:"cols,omitempty"`      // terminal size, for start and resize
+	Signal    int     `json:"signal,omitempty"`    // signal number
+	ExitCode  *int    `json:"exit_code,omitempty"` // exit code of the process
+	Timestamp int64   `json:"timestamp,omitempty"` // Unix time of the start
+	Command   string  `json:"command,omitempty"`   // command line, for start
+}
+
+// Lifecycle event types
+const (
+	EventStarted    = "started"    // process running, with its PID
+	EventExited     = "exited"     // process exited, with its exit code
+	EventResized    = "resized"    // terminal resized
+	EventTitle      = "title"      // window title set by the program
+	EventForeground = "foreground" // another process group took the terminal
+	EventAttached   = "attached"   // a client attached to the output
+	EventDetached   = "detached"   // a client detached from the output, or disconnected while attached
+	EventPaused     = "paused"     // process group stopped with PAUSE or SIGSTOP
+	EventResumed    = "resumed"    // process group continued with RESUME or SIGCONT
+	EventHealth     = "health"     // health of the process changed
+	EventThrottled  = "throttled"  // output went over the rate limit, and is read more slowly
+)
+
+// Event is a lifecycle event of the daemon, sent in MsgEvent to the clients
+// that subscribed
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	PID      int       `json:"pid,omitempty"`       // process, for started
+	ExitCode *int      `json:"exit_code,omitempty"` // exit code, for exited
+	Rows     int       `json:"rows,omitempty"`      // terminal size, for resized
+	Cols     int       `json:"cols,omitempty"`      // terminal size, for resized
+	Title    string    `json:"title,omitempty"`     // new title, for title
+	Pgrp     int       `json:"pgrp,omitempty"`      // foreground process group, for foreground
+	Client   uint64    `json:"client,omitempty"`    // client, for attached, detached and resized
+	Health   string    `json:"health,omitempty"`    // new health, for health
+	Error    string    `json:"error,omitempty"`     // failure of the last check, for health
+	Rate     int64     `json:"rate,omitempty"`      // rate limit in bytes per second, for throttled
+}
+
+// ExpectRule answers the output matching Pattern (RE2 syntax) with Send,
+// written to the process input by the daemon. A Once rule is dropped after
+// its first match.
+type ExpectRule struct {
+	Pattern string `json:"pattern"`
+	Send    string `json:"send"`
+	Once    bool   `json:"once,omitempty"`
+}
+
+// ExpectRequest sets the expect rules of the client, replacing those it set
+// before; no rules clears them
+type ExpectRequest struct {
+	Rules []ExpectRule `json:"rules"`
+}
+
+// ExpectMatch reports that a rule matched the output, sent in
+// MsgExpectMatch once its input was queued
+type ExpectMatch struct {
+	Rule int       `json:"rule"` // index of the rule in the request
+	Text string    `json:"text"` // output matched
+	Time time.Time `json:"time"`
+}
+
+// StdinFileRequest asks the daemon to write the file at Path, which must be
+// absolute, to the process input. With Close, the input is closed after it.
+type StdinFileRequest struct {
+	Path  string `json:"path"`
+	Close bool   `json:"close,omitempty"`
+}
+
+// StdinFileProgress reports the bytes of a file written to the process
+// input, sent in MsgStdinFileProgress while it is written and once more,
+// with Done, when it all was
+type StdinFileProgress struct {
+	Sent int64 `json:"sent"`
+	Size int64 `json:"size,omitempty"` // 0 when the file is not a regular file
+	Done bool  `json:"done,omitempty"`
+}
+
+// JobRequest is sent in MsgJobControl to the socket of a supervisor (see
+// bgrund) to act on one of its jobs. The list action needs no Name.
+type JobRequest struct {
+	Action string `json:"action"` // JobList, JobStart, JobStop, JobRestart or JobStatus
+	Name   string `json:"name,omitempty"`
+}
+
+// Job actions, sent in JobRequest.Action
+const (
+	JobList    = "list"
+	JobStatus  = "status"
+	JobStart   = "start"
+	JobStop    = "stop"
+	JobRestart = "restart"
+)
+
+// JobResponse answers MsgJobControl and MsgSelectJob with the state of the
+// jobs concerned, every job for JobList
+type JobResponse struct {
+	Jobs []JobState `json:"jobs"`
+}
+
+// JobState describes a job of a supervisor. PID, StartedAt and ExitCode
+// are those of its last run.
+type JobState struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"`           // JobStopped, JobStarting, JobScheduled, JobRunning, JobExited, JobRestarting or JobFailed
+	Ready      bool       `json:"ready,omitempty"` // the last run passed the ready check of the job
+	PID        int        `json:"pid,omitempty"`
+	RuntimeDir string     `json:"runtime_dir"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Restarts   int        `json:"restarts"`         // automatic restarts since the job was started
+	Error      string     `json:"error,omitempty"`  // why the last start failed, or the last run did not get ready
+	Health     string     `json:"health,omitempty"` // health of the last run, for jobs with a health check
+
+	// ScheduledAt is when the process of a JobScheduled job is started
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+}
+
+// Job states, reported in JobState.State
+const (
+	JobStopped    = "stopped"    // never started, or stopped on request
+	JobStarting   = "starting"   // waiting for the jobs it depends on to be ready
+	JobScheduled  = "scheduled"  // waiting for the time the process is started at
+	JobRunning    = "running"    // the process runs
+	JobExited     = "exited"     // the process exited and is not restarted
+	JobRestarting = "restarting" // the process exited and is restarted shortly
+	JobFailed     = "failed"     // the process could not be started
+)
+
+// CheckpointRequest asks the daemon to checkpoint the process tree with
+// CRIU. Unless LeaveRunning, the process is killed once checkpointed.
+type CheckpointRequest struct {
+	LeaveRunning bool `json:"leave_running,omitempty"`
+}
+
+// CheckpointResponse answers MsgCheckpoint with the directory the
+// checkpoint was written to
+type CheckpointResponse struct {
+	Dir string `json:"dir"`
+}
+
+// ParseTimeline returns the events of a session timeline, as sent in
+// MsgTimeline. A truncated last line, as left by a daemon that died while
+// recording, is ignored.
+func ParseTimeline(data []byte) ([]TimelineEvent, error) {
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+
+	events := make([]TimelineEvent, 0, len(lines))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var ev TimelineEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("failed to parse timeline event on line %d: %w", i+1, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// CommandOutputRequest asks for the output of one command. Negative indexes
+// count from the end, -1 being the last command.
+type CommandOutputRequest struct {
+	Index  int          `json:"index"`
+	Format ExportFormat `json:"format"`
 }
 
 // ExportFormat represents the export output format
@@ -94,8 +790,25 @@ const (
 	ExportFormatMarkdown ExportFormat = 1
 	// ExportFormatHTML exports as HTML with hyperlinks and styling
 	ExportFormatHTML ExportFormat = 2
+	// ExportFormatANSI exports as text with SGR and OSC 8 escape sequences
+	ExportFormatANSI ExportFormat = 3
 )
 
+// String returns the name of the export format
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportFormatPlainText:
+		return "text"
+	case ExportFormatMarkdown:
+		return "markdown"
+	case ExportFormatHTML:
+		return "html"
+	case ExportFormatANSI:
+		return "ansi"
+	}
+	return fmt.Sprintf("format(%d)", int(f))
+}
+
 // ExportRequest contains export parameters
 type ExportRequest struct {
 	Format                 ExportFormat `json:"format"`
@@ -107,11 +820,36 @@ type ExportRequest struct {
 
 // ExportResponse contains the exported content
 type ExportResponse struct {
-	Content string `json:"content"`
+	Content string       `json:"content"`
 	Format  ExportFormat `json:"format"`
 }
 
-// ReadMessage reads a message from the reader
+// SearchRequest asks for the matches of a regular expression (RE2 syntax)
+// in the terminal content
+type SearchRequest struct {
+	Pattern           string `json:"pattern"`
+	IncludeScrollback bool   `json:"include_scrollback"`
+	IgnoreCase        bool   `json:"ignore_case"`
+	MaxMatches        int    `json:"max_matches,omitempty"` // 0 means no limit
+}
+
+// SearchMatch is an occurrence of a search pattern. Rows count from the top
+// of the screen, scrollback lines having negative rows (-1 is the most
+// recent). EndCol is the column following the match.
+type SearchMatch struct {
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	EndCol int    `json:"end_col"`
+	Text   string `json:"text"`
+}
+
+// SearchResponse contains the matches of a search, top to bottom
+type SearchResponse struct {
+	Matches []SearchMatch `json:"matches"`
+}
+
+// ReadMessage reads a message from the reader. A COMPRESSED message is
+// returned as the message it holds, decompressed.
 func ReadMessage(r io.Reader) (*Message, error) {
 	// Read length (4 bytes, big-endian)
 	var length uint32
@@ -120,7 +858,7 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	}
 
 	// Sanity check on length (max 10MB)
-	if length < 1 || length > 10*1024*1024 {
+	if length < 1 || length > maxMessageLength {
 		return nil, fmt.Errorf("invalid message length: %d", length)
 	}
 
@@ -139,37 +877,51 @@ func ReadMessage(r io.Reader) (*Message, error) {
 		}
 	}
 
+	if msgType == MsgCompressed {
+		return decompress(payload)
+	}
+
 	return &Message{
 		Type:    msgType,
 		Payload: payload,
 	}, nil
 }
 
-// WriteMessage writes a message to the writer
+// WriteMessage writes a message to the writer. The header and payload are
+// sent with one writev call when w is a net.Conn or a BuffersWriter, so
+// messages written concurrently on a connection do not interleave.
 func WriteMessage(w io.Writer, msgType MessageType, payload []byte) error {
-	// Calculate total length (type + payload)
-	length := uint32(1 + len(payload))
-
-	// Write length
-	if err := binary.Write(w, binary.BigEndian, length); err != nil {
-		return fmt.Errorf("failed to write length: %w", err)
+	if mw, ok := w.(MessageWriter); ok {
+		return mw.WriteMessage(msgType, payload)
 	}
 
-	// Write message type
-	if err := binary.Write(w, binary.BigEndian, msgType); err != nil {
-		return fmt.Errorf("failed to write message type: %w", err)
-	}
+	// Length (type + payload) and message type
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(1+len(payload)))
+	header[4] = byte(msgType)
 
-	// Write payload
+	bufs := net.Buffers{header[:]}
 	if len(payload) > 0 {
-		if _, err := w.Write(payload); err != nil {
-			return fmt.Errorf("failed to write payload: %w", err)
-		}
+		bufs = append(bufs, payload)
+	}
+	if err := writeBuffers(w, bufs); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
 	}
-
 	return nil
 }
 
+// writeBuffers writes bufs with one writev call when w is a net.Conn or a
+// BuffersWriter
+func writeBuffers(w io.Writer, bufs net.Buffers) error {
+	var err error
+	if bw, ok := w.(BuffersWriter); ok {
+		_, err = bw.WriteBuffers(&bufs)
+	} else {
+		_, err = bufs.WriteTo(w)
+	}
+	return err
+}
+
 // WriteError writes an error message
 func WriteError(w io.Writer, err error) error {
 	return WriteMessage(w, MsgError, []byte(err.Error()))
@@ -186,8 +938,50 @@ func WriteStatusResponse(w io.Writer, status *StatusResponse) error {
 
 // WriteOutput writes an output message
 func WriteOutput(w io.Writer, stream byte, data []byte) error {
-	payload := append([]byte{stream}, data...)
-	return WriteMessage(w, MsgOutput, payload)
+	return WriteOutputTo(w, stream, data)
+}
+
+// BuffersWriter is implemented by connection wrappers that pass several
+// buffers to the underlying connection at once, so that WriteOutputTo can
+// still use a single writev call through them
+type BuffersWriter interface {
+	WriteBuffers(bufs *net.Buffers) (int64, error)
+}
+
+// WriteOutputTo writes an output message without copying data into a
+// payload. The header and data are sent with one writev call when w is a
+// net.Conn or a BuffersWriter, and with two writes otherwise.
+func WriteOutputTo(w io.Writer, stream byte, data []byte) error {
+	var header [6]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(2+len(data)))
+	header[4] = byte(MsgOutput)
+	header[5] = stream
+
+	if mw, ok := w.(MessageWriter); ok {
+		return writeOutputMessage(mw, MsgOutput, header[5:], data)
+	}
+	if err := writeBuffers(w, net.Buffers{header[:], data}); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// WriteOutputAtTo writes an OUTPUT_AT message, output tagged with the
+// offset of its first byte, without copying data into a payload
+func WriteOutputAtTo(w io.Writer, stream byte, offset uint64, data []byte) error {
+	var header [14]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(10+len(data)))
+	header[4] = byte(MsgOutputAt)
+	header[5] = stream
+	binary.BigEndian.PutUint64(header[6:], offset)
+
+	if mw, ok := w.(MessageWriter); ok {
+		return writeOutputMessage(mw, MsgOutputAt, header[5:], data)
+	}
+	if err := writeBuffers(w, net.Buffers{header[:], data}); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
 }
 
 // WriteProcessExit writes a process exit message
@@ -214,6 +1008,119 @@ func ParseOutput(payload []byte) (stream byte, data []byte, err error) {
 	return payload[0], payload[1:], nil
 }
 
+// ParseOutputAt parses an OUTPUT_AT payload
+func ParseOutputAt(payload []byte) (stream byte, offset uint64, data []byte, err error) {
+	if len(payload) < 9 {
+		return 0, 0, nil, fmt.Errorf("output payload too short")
+	}
+	return payload[0], binary.BigEndian.Uint64(payload[1:9]), payload[9:], nil
+}
+
+// AttachRequest is the payload of an attach message
+type AttachRequest struct {
+	Streams byte   // StreamStdout, StreamStderr or StreamBoth
+	Resume  bool   // send OUTPUT_AT messages, starting from Offset
+	Offset  uint64 // output offset to resume from
+	Flow    byte   // flow control policy, implying Resume unless FlowNone
+	Window  uint32 // initial credit with flow control, in bytes of output
+
+	// Exclusive detaches the other clients and refuses their input until
+	// this client detaches
+	Exclusive bool
+
+	// Notify has the daemon send EVENT messages when another client
+	// attaches, detaches or resizes the terminal
+	Notify bool
+}
+
+// WriteAttach writes an attach message. With Resume, the output is sent as
+// OUTPUT_AT messages, starting with the output the daemon still holds from
+// Offset on.
+func WriteAttach(w io.Writer, req *AttachRequest) error {
+	flagged := req.Exclusive || req.Notify
+	payload := []byte{req.Streams}
+	if req.Resume || req.Flow != FlowNone || flagged {
+		payload = binary.BigEndian.AppendUint64(payload, req.Offset)
+	}
+	if req.Flow != FlowNone || flagged {
+		payload = append(payload, req.Flow)
+		payload = binary.BigEndian.AppendUint32(payload, req.Window)
+	}
+	if flagged {
+		var flags byte
+		if req.Exclusive {
+			flags |= AttachExclusive
+		}
+		if req.Resume || req.Flow != FlowNone {
+			flags |= AttachResume
+		}
+		if req.Notify {
+			flags |= AttachNotify
+		}
+		payload = append(payload, flags)
+	}
+	return WriteMessage(w, MsgAttach, payload)
+}
+
+// ParseAttach parses an attach payload
+func ParseAttach(payload []byte) (*AttachRequest, error) {
+	switch len(payload) {
+	case 1:
+		return &AttachRequest{Streams: payload[0]}, nil
+	case 9:
+		return &AttachRequest{Streams: payload[0], Resume: true, Offset: binary.BigEndian.Uint64(payload[1:])}, nil
+	case 14:
+		return &AttachRequest{
+			Streams: payload[0],
+			Resume:  true,
+			Offset:  binary.BigEndian.Uint64(payload[1:9]),
+			Flow:    payload[9],
+			Window:  binary.BigEndian.Uint32(payload[10:]),
+		}, nil
+	case 15:
+		flags := payload[14]
+		return &AttachRequest{
+			Streams:   payload[0],
+			Resume:    flags&AttachResume != 0 || payload[9] != FlowNone,
+			Offset:    binary.BigEndian.Uint64(payload[1:9]),
+			Flow:      payload[9],
+			Window:    binary.BigEndian.Uint32(payload[10:14]),
+			Exclusive: flags&AttachExclusive != 0,
+			Notify:    flags&AttachNotify != 0,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid attach payload length")
+	}
+}
+
+// WriteCredit writes a credit message granting n more bytes of output
+func WriteCredit(w io.Writer, n uint32) error {
+	return WriteMessage(w, MsgCredit, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// ParseCredit parses a credit payload
+func ParseCredit(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("invalid credit payload length: expected 4, got %d", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// WriteDetached writes a detached message, telling an attached client that
+// the client by attached exclusively
+func WriteDetached(w io.Writer, by uint64) error {
+	return WriteMessage(w, MsgDetached, binary.BigEndian.AppendUint64(nil, by))
+}
+
+// ParseDetached parses a detached payload, returning the client that took
+// over
+func ParseDetached(payload []byte) (uint64, error) {
+	if len(payload) != 8 {
+		return 0, fmt.Errorf("invalid detached payload length")
+	}
+	return binary.BigEndian.Uint64(payload), nil
+}
+
 // ParseProcessExit parses a process exit payload
 func ParseProcessExit(payload []byte) (int, error) {
 	if len(payload) != 4 {
@@ -228,7 +1135,18 @@ func WriteWaitResponse(w io.Writer, status byte) error {
 	return WriteMessage(w, MsgWaitResponse, []byte{status})
 }
 
-// ParseWait parses a wait message payload
+// WriteRecordResponse writes a record response message holding whether the
+// session is being recorded
+func WriteRecordResponse(w io.Writer, recording bool) error {
+	status := RecordStop
+	if recording {
+		status = RecordStart
+	}
+	return WriteMessage(w, MsgRecordResponse, []byte{status})
+}
+
+// ParseWait parses a wait message payload without a pattern, see
+// ParseWaitRequest
 func ParseWait(payload []byte) (timeoutSecs uint32, waitType byte, err error) {
 	if len(payload) != 5 {
 		return 0, 0, fmt.Errorf("invalid wait payload length: expected 5, got %d", len(payload))
@@ -238,6 +1156,101 @@ func ParseWait(payload []byte) (timeoutSecs uint32, waitType byte, err error) {
 	return timeoutSecs, waitType, nil
 }
 
+// WaitRequest is the payload of a wait message
+type WaitRequest struct {
+	TimeoutSecs uint32 // 0 waits forever
+	Type        byte
+	Deadline    time.Time // absolute deadline, replacing TimeoutSecs when set
+	Pattern     string    // regular expression (RE2 syntax), for WaitTypePattern
+	QuietMillis uint32    // period without change, for WaitTypeOutputIdle and WaitTypeScreenStable
+}
+
+// WaitDeadline is set in the wait type of a wait message holding an
+// absolute deadline
+const WaitDeadline byte = 0x80
+
+// WriteWait writes a wait message
+func WriteWait(w io.Writer, req *WaitRequest) error {
+	payload := binary.BigEndian.AppendUint32(nil, req.TimeoutSecs)
+	if req.Deadline.IsZero() {
+		payload = append(payload, req.Type)
+	} else {
+		payload = append(payload, req.Type|WaitDeadline)
+		payload = binary.BigEndian.AppendUint64(payload, uint64(req.Deadline.UnixMilli()))
+	}
+	switch req.Type {
+	case WaitTypePattern:
+		payload = append(payload, req.Pattern...)
+	case WaitTypeOutputIdle, WaitTypeScreenStable:
+		payload = binary.BigEndian.AppendUint32(payload, req.QuietMillis)
+	}
+	return WriteMessage(w, MsgWait, payload)
+}
+
+// ParseWaitRequest parses a wait message payload. The wait type is
+// followed by the deadline, in Unix milliseconds, when it has WaitDeadline
+// set, then by the pattern for WaitTypePattern, and by the quiet period for
+// WaitTypeOutputIdle and WaitTypeScreenStable.
+func ParseWaitRequest(payload []byte) (*WaitRequest, error) {
+	if len(payload) < 5 {
+		return nil, fmt.Errorf("invalid wait payload length: expected at least 5, got %d", len(payload))
+	}
+	req := &WaitRequest{
+		TimeoutSecs: binary.BigEndian.Uint32(payload[0:4]),
+		Type:        payload[4] &^ WaitDeadline,
+	}
+	header := 5
+	if payload[4]&WaitDeadline != 0 {
+		if len(payload) < 13 {
+			return nil, fmt.Errorf("invalid wait payload length: expected at least 13, got %d", len(payload))
+		}
+		req.Deadline = time.UnixMilli(int64(binary.BigEndian.Uint64(payload[5:13])))
+		header = 13
+	}
+	rest := payload[header:]
+
+	switch req.Type {
+	case WaitTypePattern:
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("wait pattern is required")
+		}
+		req.Pattern = string(rest)
+	case WaitTypeOutputIdle, WaitTypeScreenStable:
+		if len(rest) != 4 {
+			return nil, fmt.Errorf("invalid wait payload length: expected %d, got %d", header+4, len(payload))
+		}
+		req.QuietMillis = binary.BigEndian.Uint32(rest)
+	default:
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("invalid wait payload length: expected %d, got %d", header, len(payload))
+		}
+	}
+	return req, nil
+}
+
+// WritePing writes a ping message. A non-zero idle timeout asks the daemon
+// to drop the connection when it receives nothing for that long.
+func WritePing(w io.Writer, idleTimeout time.Duration) error {
+	var payload []byte
+	if idleTimeout > 0 {
+		payload = binary.BigEndian.AppendUint32(nil, uint32((idleTimeout+time.Second-1)/time.Second))
+	}
+	return WriteMessage(w, MsgPing, payload)
+}
+
+// ParsePing parses a ping payload, returning the idle timeout it asks for
+// or 0 for none
+func ParsePing(payload []byte) (time.Duration, error) {
+	switch len(payload) {
+	case 0:
+		return 0, nil
+	case 4:
+		return time.Duration(binary.BigEndian.Uint32(payload)) * time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid ping payload length: expected 0 or 4, got %d", len(payload))
+	}
+}
+
 // ParseWaitResponse parses a wait response payload
 func ParseWaitResponse(payload []byte) (byte, error) {
 	if len(payload) != 1 {
@@ -264,6 +1277,160 @@ func ParseScreenResponse(payload []byte) (*ScreenResponse, error) {
 	return &screen, nil
 }
 
+// WriteScreenCellsResponse writes a cell-level screen response message
+func WriteScreenCellsResponse(w io.Writer, screen *ScreenCellsResponse) error {
+	data, err := json.Marshal(screen)
+	if err != nil {
+		return fmt.Errorf("failed to marshal screen: %w", err)
+	}
+	return WriteMessage(w, MsgScreenCellsResponse, data)
+}
+
+// ParseScreenCellsResponse parses a cell-level screen response payload
+func ParseScreenCellsResponse(payload []byte) (*ScreenCellsResponse, error) {
+	var screen ScreenCellsResponse
+	if err := json.Unmarshal(payload, &screen); err != nil {
+		return nil, fmt.Errorf("failed to parse screen response: %w", err)
+	}
+	return &screen, nil
+}
+
+// WriteScrollbackRequest writes a scrollback request message
+func WriteScrollbackRequest(w io.Writer, req *ScrollbackRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scrollback request: %w", err)
+	}
+	return WriteMessage(w, MsgGetScrollback, data)
+}
+
+// ParseScrollbackRequest parses a scrollback request payload
+func ParseScrollbackRequest(payload []byte) (*ScrollbackRequest, error) {
+	var req ScrollbackRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse scrollback request: %w", err)
+	}
+	return &req, nil
+}
+
+// WriteScrollbackResponse writes a scrollback response message
+func WriteScrollbackResponse(w io.Writer, resp *ScrollbackResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scrollback response: %w", err)
+	}
+	return WriteMessage(w, MsgScrollbackResponse, data)
+}
+
+// ParseScrollbackResponse parses a scrollback response payload
+func ParseScrollbackResponse(payload []byte) (*ScrollbackResponse, error) {
+	var resp ScrollbackResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse scrollback response: %w", err)
+	}
+	return &resp, nil
+}
+
+// WriteHealthResponse writes a health response message
+func WriteHealthResponse(w io.Writer, health *HealthResponse) error {
+	data, err := json.Marshal(health)
+	if err != nil {
+		return fmt.Errorf("failed to marshal health: %w", err)
+	}
+	return WriteMessage(w, MsgHealthResponse, data)
+}
+
+// ParseHealthResponse parses a health response payload
+func ParseHealthResponse(payload []byte) (*HealthResponse, error) {
+	var health HealthResponse
+	if err := json.Unmarshal(payload, &health); err != nil {
+		return nil, fmt.Errorf("failed to parse health response: %w", err)
+	}
+	return &health, nil
+}
+
+// WriteSubscribeScreen writes a screen subscription message
+func WriteSubscribeScreen(w io.Writer, action byte) error {
+	return WriteMessage(w, MsgSubscribeScreen, []byte{action})
+}
+
+// WriteSubscribe writes an event subscription message
+func WriteSubscribe(w io.Writer, action byte) error {
+	return WriteMessage(w, MsgSubscribe, []byte{action})
+}
+
+// ParseEvent parses an event payload
+func ParseEvent(payload []byte) (*Event, error) {
+	var ev Event
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	return &ev, nil
+}
+
+// WriteExpectRequest writes an expect message
+func WriteExpectRequest(w io.Writer, req *ExpectRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal expect request: %w", err)
+	}
+	return WriteMessage(w, MsgExpect, data)
+}
+
+// ParseExpectRequest parses an expect request payload
+func ParseExpectRequest(payload []byte) (*ExpectRequest, error) {
+	var req ExpectRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse expect request: %w", err)
+	}
+	return &req, nil
+}
+
+// ParseExpectMatch parses an expect match payload
+func ParseExpectMatch(payload []byte) (*ExpectMatch, error) {
+	var match ExpectMatch
+	if err := json.Unmarshal(payload, &match); err != nil {
+		return nil, fmt.Errorf("failed to parse expect match: %w", err)
+	}
+	return &match, nil
+}
+
+// WriteStdinFileRequest writes a stdin file message
+func WriteStdinFileRequest(w io.Writer, req *StdinFileRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stdin file request: %w", err)
+	}
+	return WriteMessage(w, MsgStdinFile, data)
+}
+
+// ParseStdinFileRequest parses a stdin file request payload
+func ParseStdinFileRequest(payload []byte) (*StdinFileRequest, error) {
+	var req StdinFileRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse stdin file request: %w", err)
+	}
+	return &req, nil
+}
+
+// ParseStdinFileProgress parses a stdin file progress payload
+func ParseStdinFileProgress(payload []byte) (*StdinFileProgress, error) {
+	var progress StdinFileProgress
+	if err := json.Unmarshal(payload, &progress); err != nil {
+		return nil, fmt.Errorf("failed to parse stdin file progress: %w", err)
+	}
+	return &progress, nil
+}
+
+// ParseScreenUpdate parses a screen update payload
+func ParseScreenUpdate(payload []byte) (*ScreenUpdate, error) {
+	var update ScreenUpdate
+	if err := json.Unmarshal(payload, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse screen update: %w", err)
+	}
+	return &update, nil
+}
+
 // WriteExportRequest writes an export request message
 func WriteExportRequest(w io.Writer, req *ExportRequest) error {
 	data, err := json.Marshal(req)
@@ -299,3 +1466,156 @@ func ParseExportResponse(payload []byte) (*ExportResponse, error) {
 	}
 	return &resp, nil
 }
+
+// WriteTitleResponse writes a title response message
+func WriteTitleResponse(w io.Writer, title *TitleResponse) error {
+	data, err := json.Marshal(title)
+	if err != nil {
+		return fmt.Errorf("failed to marshal title: %w", err)
+	}
+	return WriteMessage(w, MsgTitleResponse, data)
+}
+
+// ParseTitleResponse parses a title response payload
+func ParseTitleResponse(payload []byte) (*TitleResponse, error) {
+	var title TitleResponse
+	if err := json.Unmarshal(payload, &title); err != nil {
+		return nil, fmt.Errorf("failed to parse title response: %w", err)
+	}
+	return &title, nil
+}
+
+// WriteQuotaExceeded writes a quota exceeded message
+func WriteQuotaExceeded(w io.Writer, q *QuotaExceeded) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quota error: %w", err)
+	}
+	return WriteMessage(w, MsgQuotaExceeded, data)
+}
+
+// ParseQuotaExceeded parses a quota exceeded payload
+func ParseQuotaExceeded(payload []byte) (*QuotaExceeded, error) {
+	var q QuotaExceeded
+	if err := json.Unmarshal(payload, &q); err != nil {
+		return nil, fmt.Errorf("failed to parse quota error: %w", err)
+	}
+	return &q, nil
+}
+
+// WriteCommandsResponse writes a commands response message
+func WriteCommandsResponse(w io.Writer, resp *CommandsResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal commands: %w", err)
+	}
+	return WriteMessage(w, MsgCommandsResponse, data)
+}
+
+// ParseCommandsResponse parses a commands response payload
+func ParseCommandsResponse(payload []byte) (*CommandsResponse, error) {
+	var resp CommandsResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse commands response: %w", err)
+	}
+	return &resp, nil
+}
+
+// WriteCommandOutputRequest writes a command output request message
+func WriteCommandOutputRequest(w io.Writer, req *CommandOutputRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal command output request: %w", err)
+	}
+	return WriteMessage(w, MsgGetCommandOutput, data)
+}
+
+// ParseCommandOutputRequest parses a command output request payload
+func ParseCommandOutputRequest(payload []byte) (*CommandOutputRequest, error) {
+	var req CommandOutputRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse command output request: %w", err)
+	}
+	return &req, nil
+}
+
+// WriteSearchRequest writes a search request message
+func WriteSearchRequest(w io.Writer, req *SearchRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal search request: %w", err)
+	}
+	return WriteMessage(w, MsgSearch, data)
+}
+
+// ParseSearchRequest parses a search request payload
+func ParseSearchRequest(payload []byte) (*SearchRequest, error) {
+	var req SearchRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse search request: %w", err)
+	}
+	return &req, nil
+}
+
+// WriteSearchResponse writes a search response message
+func WriteSearchResponse(w io.Writer, resp *SearchResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal search response: %w", err)
+	}
+	return WriteMessage(w, MsgSearchResponse, data)
+}
+
+// ParseSearchResponse parses a search response payload
+func ParseSearchResponse(payload []byte) (*SearchResponse, error) {
+	var resp SearchResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse search response: %w", err)
+	}
+	return &resp, nil
+}
+
+// WriteCapabilities writes a capabilities response message
+func WriteCapabilities(w io.Writer, caps *Capabilities) error {
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return fmt.Errorf("failed to marshal capabilities: %w", err)
+	}
+	return WriteMessage(w, MsgCapabilitiesResponse, data)
+}
+
+// ParseCapabilities parses a capabilities response payload
+func ParseCapabilities(payload []byte) (*Capabilities, error) {
+	var caps Capabilities
+	if err := json.Unmarshal(payload, &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse capabilities: %w", err)
+	}
+	return &caps, nil
+}
+
+// WriteReplayRequest writes a replay request message
+func WriteReplayRequest(w io.Writer, req *ReplayRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal replay request: %w", err)
+	}
+	return WriteMessage(w, MsgReplay, data)
+}
+
+// ParseReplayRequest parses a replay request payload. An empty payload
+// replays at normal speed.
+func ParseReplayRequest(payload []byte) (*ReplayRequest, error) {
+	var req ReplayRequest
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, fmt.Errorf("failed to parse replay request: %w", err)
+		}
+	}
+	if req.Speed < 0 {
+		return nil, fmt.Errorf("invalid replay speed %g", req.Speed)
+	}
+	if req.Speed == 0 {
+		req.Speed = 1
+	}
+	return &req, nil
+}
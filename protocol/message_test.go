@@ -3,7 +3,12 @@ package protocol
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestReadWriteMessage(t *testing.T) {
@@ -175,6 +180,108 @@ func TestOutput(t *testing.T) {
 	}
 }
 
+// unixPair returns both ends of a unix socket connection
+func unixPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("unix", filepath.Join(tb.TempDir(), "test.sock"))
+	if err != nil {
+		tb.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		tb.Fatalf("Dial failed: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatalf("Accept failed: %v", err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// buffersConn records whether WriteOutputTo went through WriteBuffers
+type buffersConn struct {
+	net.Conn
+	used bool
+}
+
+func (c *buffersConn) WriteBuffers(bufs *net.Buffers) (int64, error) {
+	c.used = true
+	return bufs.WriteTo(c.Conn)
+}
+
+func TestWriteOutputTo(t *testing.T) {
+	client, server := unixPair(t)
+	wrapped := &buffersConn{Conn: server}
+
+	testData := []byte("test output data\x00\xFF")
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		WriteOutputTo(server, StreamStderr, testData)
+		WriteOutputTo(wrapped, StreamStdout, nil)
+	}()
+
+	for _, want := range []struct {
+		stream byte
+		data   []byte
+	}{{StreamStderr, testData}, {StreamStdout, nil}} {
+		msg, err := ReadMessage(client)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.Type != MsgOutput {
+			t.Fatalf("expected type %d, got %d", MsgOutput, msg.Type)
+		}
+		stream, data, err := ParseOutput(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseOutput failed: %v", err)
+		}
+		if stream != want.stream || !bytes.Equal(data, want.data) {
+			t.Errorf("expected stream %d data %q, got stream %d data %q", want.stream, want.data, stream, data)
+		}
+	}
+	<-written
+	if !wrapped.used {
+		t.Error("WriteBuffers was not used")
+	}
+}
+
+// benchmarkOutput measures writing 4 KiB output chunks to a unix socket
+// with write
+func benchmarkOutput(b *testing.B, write func(w io.Writer, data []byte) error) {
+	client, server := unixPair(b)
+	go io.Copy(io.Discard, client)
+
+	data := bytes.Repeat([]byte("x"), 4096)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if err := write(server, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteOutputCopy is the framing WriteOutput used to do: copy the
+// data into a new payload, then write it with WriteMessage
+func BenchmarkWriteOutputCopy(b *testing.B) {
+	benchmarkOutput(b, func(w io.Writer, data []byte) error {
+		return WriteMessage(w, MsgOutput, append([]byte{StreamStdout}, data...))
+	})
+}
+
+func BenchmarkWriteOutputTo(b *testing.B) {
+	benchmarkOutput(b, func(w io.Writer, data []byte) error {
+		return WriteOutputTo(w, StreamStdout, data)
+	})
+}
+
 func TestProcessExit(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -280,6 +387,48 @@ func TestWaitAPI(t *testing.T) {
 	}
 }
 
+func TestWaitRequest(t *testing.T) {
+	for _, req := range []*WaitRequest{
+		{TimeoutSecs: 30, Type: WaitTypeExit},
+		{TimeoutSecs: 5, Type: WaitTypePattern, Pattern: `^Ready on port \d+$`},
+		{TimeoutSecs: 10, Type: WaitTypeOutputIdle, QuietMillis: 500},
+		{TimeoutSecs: 10, Type: WaitTypeScreenStable, QuietMillis: 250},
+		{Type: WaitTypeExit, Deadline: time.UnixMilli(1767225600123)},
+		{Type: WaitTypePattern, Deadline: time.UnixMilli(1767225600000), Pattern: `\$ $`},
+	} {
+		var buf bytes.Buffer
+		if err := WriteWait(&buf, req); err != nil {
+			t.Fatalf("WriteWait failed: %v", err)
+		}
+		msg, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		got, err := ParseWaitRequest(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseWaitRequest failed: %v", err)
+		}
+		if *got != *req {
+			t.Errorf("Expected %+v, got %+v", *req, *got)
+		}
+	}
+
+	// A pattern is required for pattern waits, and only for them, and a
+	// quiet period for idle and stable waits
+	for _, payload := range [][]byte{
+		{0, 0, 0, 1, WaitTypePattern},
+		{0, 0, 0, 1, WaitTypeExit, 'x'},
+		{0, 0, 0, 1, WaitTypeOutputIdle},
+		{0, 0, 0, 1, WaitTypeScreenStable, 0, 0, 1},
+		{0, 0, 0, 0, WaitTypeExit | WaitDeadline, 0, 0, 1},
+		{0, 0, 0, 1},
+	} {
+		if _, err := ParseWaitRequest(payload); err == nil {
+			t.Errorf("Expected wait payload %v to be rejected", payload)
+		}
+	}
+}
+
 func TestWaitResponse(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -360,6 +509,84 @@ func TestParseWaitErrors(t *testing.T) {
 	}
 }
 
+func TestPing(t *testing.T) {
+	tests := []struct {
+		timeout, want time.Duration
+	}{
+		{0, 0},
+		{30 * time.Second, 30 * time.Second},
+		{1500 * time.Millisecond, 2 * time.Second}, // rounded up to whole seconds
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WritePing(&buf, tt.timeout); err != nil {
+			t.Fatalf("WritePing failed: %v", err)
+		}
+		msg, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.Type != MsgPing {
+			t.Fatalf("Expected PING, got %s", msg.Type.Name())
+		}
+		got, err := ParsePing(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParsePing failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("Expected timeout %s to be sent as %s, got %s", tt.timeout, tt.want, got)
+		}
+	}
+
+	if _, err := ParsePing([]byte{0x00, 0x01}); err == nil {
+		t.Error("Expected an invalid ping payload to be rejected")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	tests := []*AttachRequest{
+		{Streams: StreamBoth},
+		{Streams: StreamStdout, Resume: true, Offset: 1 << 40},
+		{Streams: StreamBoth, Resume: true, Offset: 42, Flow: FlowBlock, Window: 65536},
+		{Streams: StreamBoth, Exclusive: true},
+		{Streams: StreamBoth, Resume: true, Offset: 42, Exclusive: true},
+		{Streams: StreamStdout, Notify: true},
+	}
+	for _, req := range tests {
+		var buf bytes.Buffer
+		if err := WriteAttach(&buf, req); err != nil {
+			t.Fatalf("WriteAttach failed: %v", err)
+		}
+		msg, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		got, err := ParseAttach(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseAttach failed: %v", err)
+		}
+		if *got != *req {
+			t.Errorf("Expected %+v, got %+v", *req, *got)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCredit(&buf, 4096); err != nil {
+		t.Fatalf("WriteCredit failed: %v", err)
+	}
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if n, err := ParseCredit(msg.Payload); msg.Type != MsgCredit || err != nil || n != 4096 {
+		t.Errorf("Expected a credit of 4096, got %s %d (%v)", msg.Type.Name(), n, err)
+	}
+
+	if _, err := ParseAttach([]byte{StreamBoth, 0x00}); err == nil {
+		t.Error("Expected an invalid attach payload to be rejected")
+	}
+}
+
 func TestParseWaitResponseErrors(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -526,3 +753,189 @@ func TestParseScreenResponseErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestTitleResponse(t *testing.T) {
+	var buf bytes.Buffer
+
+	title := &TitleResponse{Title: "vim main.go", IconName: "vim"}
+	if err := WriteTitleResponse(&buf, title); err != nil {
+		t.Fatalf("WriteTitleResponse failed: %v", err)
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	if msg.Type != MsgTitleResponse {
+		t.Errorf("expected type %d, got %d", MsgTitleResponse, msg.Type)
+	}
+
+	parsed, err := ParseTitleResponse(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseTitleResponse failed: %v", err)
+	}
+
+	if *parsed != *title {
+		t.Errorf("title mismatch: expected %+v, got %+v", title, parsed)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	var buf bytes.Buffer
+
+	q := &QuotaExceeded{Quota: QuotaStdinBytes, Limit: 1024, Used: 1000}
+	if err := WriteQuotaExceeded(&buf, q); err != nil {
+		t.Fatalf("WriteQuotaExceeded failed: %v", err)
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	if msg.Type != MsgQuotaExceeded {
+		t.Errorf("expected type %d, got %d", MsgQuotaExceeded, msg.Type)
+	}
+
+	parsed, err := ParseQuotaExceeded(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseQuotaExceeded failed: %v", err)
+	}
+
+	if *parsed != *q {
+		t.Errorf("quota mismatch: expected %+v, got %+v", q, parsed)
+	}
+	if parsed.Error() == "" {
+		t.Error("expected a non-empty error message")
+	}
+}
+
+func TestCommandsResponse(t *testing.T) {
+	var buf bytes.Buffer
+
+	exitCode := 2
+	finished := "2025-01-01T00:00:05Z"
+	resp := &CommandsResponse{Commands: []CommandInfo{
+		{Index: 0, Command: "make", ExitCode: &exitCode, StartedAt: "2025-01-01T00:00:00Z", FinishedAt: &finished},
+		{Index: 1, Command: "cat", StartedAt: "2025-01-01T00:00:06Z"},
+	}}
+	if err := WriteCommandsResponse(&buf, resp); err != nil {
+		t.Fatalf("WriteCommandsResponse failed: %v", err)
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	if msg.Type != MsgCommandsResponse {
+		t.Errorf("expected type %d, got %d", MsgCommandsResponse, msg.Type)
+	}
+
+	parsed, err := ParseCommandsResponse(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseCommandsResponse failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(parsed, resp) {
+		t.Errorf("commands mismatch: expected %+v, got %+v", resp, parsed)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var buf bytes.Buffer
+
+	caps := &Capabilities{
+		Version:       Version,
+		Messages:      []string{MsgStatus.Name(), MsgCapabilities.Name()},
+		ExportFormats: []string{ExportFormatANSI.String()},
+		WaitTypes:     []string{"exit"},
+		Features:      []string{"vty"},
+	}
+	if err := WriteCapabilities(&buf, caps); err != nil {
+		t.Fatalf("WriteCapabilities failed: %v", err)
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if msg.Type != MsgCapabilitiesResponse {
+		t.Errorf("expected type %d, got %d", MsgCapabilitiesResponse, msg.Type)
+	}
+
+	parsed, err := ParseCapabilities(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseCapabilities failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, caps) {
+		t.Errorf("capabilities mismatch: expected %+v, got %+v", caps, parsed)
+	}
+
+	if !parsed.HasMessage(MsgCapabilities) || parsed.HasMessage(MsgGetScreen) {
+		t.Errorf("HasMessage mismatch for %v", parsed.Messages)
+	}
+	if !parsed.HasFeature("vty") || parsed.HasFeature("record") {
+		t.Errorf("HasFeature mismatch for %v", parsed.Features)
+	}
+	if s := MessageType(0x7F).Name(); s != "0x7F" {
+		t.Errorf("expected unknown type to be shown as 0x7F, got %q", s)
+	}
+}
+
+func TestParseRecording(t *testing.T) {
+	data := []byte(`{"version":2,"width":80,"height":24,"timestamp":0}` + "\n" +
+		`[0.1,"o","hello\r\n"]` + "\n" +
+		`[0.25,"r","100x30"]` + "\n" +
+		`[1.5,"o","wor`)
+
+	events, err := ParseRecording(data)
+	if err != nil {
+		t.Fatalf("ParseRecording failed: %v", err)
+	}
+	expected := []RecordingEvent{
+		{Time: 0.1, Type: "o", Data: "hello\r\n"},
+		{Time: 0.25, Type: "r", Data: "100x30"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+
+	if _, err := ParseRecording([]byte(`{"version":1}`)); err == nil {
+		t.Error("expected version 1 recordings to be rejected")
+	}
+	if _, err := ParseRecording([]byte(`{"version":2}` + "\n" + `[1,"o"]` + "\n" + `[2,"o","x"]`)); err == nil {
+		t.Error("expected a malformed event to be rejected")
+	}
+
+	req, err := ParseReplayRequest(nil)
+	if err != nil || req.Speed != 1 {
+		t.Errorf("expected the default speed to be 1, got %+v, %v", req, err)
+	}
+}
+
+func TestParseTimeline(t *testing.T) {
+	data := []byte(`{"time":0,"type":"start","rows":24,"cols":80,"timestamp":1700000000}` + "\n" +
+		`{"time":0.5,"type":"input","data":"ls\r","client":3}` + "\n" +
+		`{"time":0.75,"type":"exit","exit_code":0}` + "\n" +
+		`{"time":1,"type":"out`)
+
+	events, err := ParseTimeline(data)
+	if err != nil {
+		t.Fatalf("ParseTimeline failed: %v", err)
+	}
+	code := 0
+	expected := []TimelineEvent{
+		{Time: 0, Type: TimelineStart, Rows: 24, Cols: 80, Timestamp: 1700000000},
+		{Time: 0.5, Type: TimelineInput, Data: "ls\r", Client: 3},
+		{Time: 0.75, Type: TimelineExit, ExitCode: &code},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+
+	if _, err := ParseTimeline([]byte(`{"time":1,"type":"out` + "\n" + `{"time":2,"type":"exit"}`)); err == nil {
+		t.Error("expected a malformed event to be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+// Package registry maintains the index of the daemons of a user: a JSON
+// file in the runtime root mapping the PID of each daemon to its runtime
+// directory and command. Daemons register when they start and record their
+// exit; clients list them without scanning directories, and prune the
+// entries of daemons that died or whose runtime directory was removed.
+//
+// Updates are serialized with an exclusive lock on a separate lock file and
+// replace the file atomically, so that it can be read without locking.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// FileName is the name of the registry in the runtime root
+const FileName = "registry.json"
+
+// lockFileName is the name of the file locked while the registry is updated
+const lockFileName = "registry.lock"
+
+// SocketFileName is the name of the control socket in a runtime directory,
+// whose presence tells a daemon runs
+const SocketFileName = "control.sock"
+
+// Entry describes a daemon
+type Entry struct {
+	PID        int        `json:"pid"`
+	RuntimeDir string     `json:"runtime_dir"`
+	Command    []string   `json:"command"`
+	StartedAt  time.Time  `json:"started_at"`
+	Running    bool       `json:"running"`             // false once the process exited or the daemon died
+	EndedAt    *time.Time `json:"ended_at,omitempty"`  // when the exit was recorded
+	ExitCode   *int       `json:"exit_code,omitempty"` // exit code of the process, unknown if the daemon died
+}
+
+// file is the content of the registry
+type file struct {
+	Daemons []Entry `json:"daemons"`
+}
+
+// Registry is the registry of a runtime root
+type Registry struct {
+	root string
+}
+
+// Open returns the registry of the runtime root, which is created with the
+// first update
+func Open(root string) *Registry {
+	return &Registry{root: root}
+}
+
+// Path returns the path of the registry file
+func (r *Registry) Path() string {
+	return filepath.Join(r.root, FileName)
+}
+
+// List returns the registered daemons, ordered by PID, as last recorded:
+// see Prune for the current state. It fails with an error wrapping
+// os.ErrNotExist when no daemon ever registered.
+func (r *Registry) List() ([]Entry, error) {
+	data, err := os.ReadFile(r.Path())
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", r.Path(), err)
+	}
+	return f.Daemons, nil
+}
+
+// Register adds a daemon, replacing the entry of a previous daemon with the
+// same PID
+func (r *Registry) Register(e Entry) error {
+	return r.update(func(entries []Entry) []Entry {
+		entries = slices.DeleteFunc(entries, func(old Entry) bool { return old.PID == e.PID })
+		return append(entries, e)
+	})
+}
+
+// SetExited records the exit of the process of a daemon
+func (r *Registry) SetExited(pid int, runtimeDir string, exitCode int) error {
+	now := time.Now()
+	return r.update(func(entries []Entry) []Entry {
+		for i := range entries {
+			if entries[i].PID == pid && entries[i].RuntimeDir == runtimeDir {
+				entries[i].Running = false
+				entries[i].EndedAt = &now
+				entries[i].ExitCode = &exitCode
+			}
+		}
+		return entries
+	})
+}
+
+// Remove drops the entry of a daemon, once its runtime directory is
+// cleaned up
+func (r *Registry) Remove(pid int, runtimeDir string) error {
+	return r.update(func(entries []Entry) []Entry {
+		return slices.DeleteFunc(entries, func(e Entry) bool { return e.PID == pid && e.RuntimeDir == runtimeDir })
+	})
+}
+
+// Prune drops the entries whose runtime directory is gone, and marks the
+// daemons registered as running whose process is gone. It returns the
+// remaining entries, those of the daemons whose control socket was removed
+// being reported as not running, or an error wrapping os.ErrNotExist when
+// no daemon ever registered.
+func (r *Registry) Prune() ([]Entry, error) {
+	if _, err := os.Stat(r.Path()); err != nil {
+		return nil, err
+	}
+	var pruned []Entry
+	err := r.update(func(entries []Entry) []Entry {
+		pruned = prune(entries)
+		return pruned
+	})
+	return listening(pruned), err
+}
+
+// Check returns the entries as Prune would leave them without updating the
+// registry, for readers that do not own it
+func (r *Registry) Check() ([]Entry, error) {
+	entries, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	return listening(prune(entries)), nil
+}
+
+// prune drops the entries whose runtime directory is gone and marks those
+// of the daemons that died
+func prune(entries []Entry) []Entry {
+	entries = slices.DeleteFunc(entries, func(e Entry) bool {
+		_, err := os.Stat(e.RuntimeDir)
+		return errors.Is(err, os.ErrNotExist)
+	})
+	for i := range entries {
+		if entries[i].Running && errors.Is(syscall.Kill(entries[i].PID, 0), syscall.ESRCH) {
+			entries[i].Running = false
+		}
+	}
+	return entries
+}
+
+// listening returns the entries with the daemons without control socket
+// not running. This is not recorded: the socket of a daemon that is
+// starting does not exist yet.
+func listening(entries []Entry) []Entry {
+	entries = slices.Clone(entries)
+	for i := range entries {
+		if !entries[i].Running {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(entries[i].RuntimeDir, SocketFileName)); err != nil {
+			entries[i].Running = false
+		}
+	}
+	return entries
+}
+
+// update applies fn to the entries with the registry locked, writing them
+// back when they changed
+func (r *Registry) update(fn func([]Entry) []Entry) error {
+	if err := os.MkdirAll(r.root, 0700); err != nil {
+		return fmt.Errorf("failed to create runtime root: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(r.root, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open registry lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock registry: %w", err)
+	}
+	// Closing the file releases the lock
+
+	entries, err := r.List()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// A corrupted registry is rebuilt by the next registrations
+		entries = nil
+	}
+	updated := fn(slices.Clone(entries))
+	if err == nil && slices.EqualFunc(entries, updated, equal) {
+		return nil
+	}
+	slices.SortFunc(updated, func(a, b Entry) int { return a.PID - b.PID })
+
+	data, err := json.MarshalIndent(file{Daemons: updated}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.root, FileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.Path()); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return nil
+}
+
+// equal compares two entries
+func equal(a, b Entry) bool {
+	return a.PID == b.PID && a.RuntimeDir == b.RuntimeDir && a.Running == b.Running &&
+		slices.Equal(a.Command, b.Command) && a.StartedAt.Equal(b.StartedAt) &&
+		((a.EndedAt == nil) == (b.EndedAt == nil)) && ((a.ExitCode == nil) == (b.ExitCode == nil))
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	root := t.TempDir()
+	r := Open(root)
+	if _, err := r.List(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no registry, got %v", err)
+	}
+	if _, err := r.Prune(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected pruning not to create the registry, got %v", err)
+	}
+
+	// Concurrent registrations are all kept
+	var wg sync.WaitGroup
+	for pid := 1; pid <= 20; pid++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dir := filepath.Join(root, "run", string(rune('a'+pid)))
+			if err := r.Register(Entry{PID: pid, RuntimeDir: dir, Command: []string{"true"}, Running: true}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	entries, err := r.List()
+	if err != nil || len(entries) != 20 || entries[0].PID != 1 || entries[19].PID != 20 {
+		t.Fatalf("Expected 20 ordered entries, got %+v (%v)", entries, err)
+	}
+
+	if err := r.SetExited(2, entries[1].RuntimeDir, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(1, entries[0].RuntimeDir); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = r.List()
+	if len(entries) != 19 || entries[0].Running || entries[0].ExitCode == nil || *entries[0].ExitCode != 3 {
+		t.Fatalf("Expected the exit to be recorded, got %+v", entries[0])
+	}
+
+	// Of the live daemon, only the one with its runtime directory and
+	// control socket is kept running
+	live := filepath.Join(root, "live")
+	if err := os.MkdirAll(live, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(live, SocketFileName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dead := filepath.Join(root, "dead")
+	if err := os.MkdirAll(dead, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dead, SocketFileName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.Register(Entry{PID: os.Getpid(), RuntimeDir: live, Running: true})
+	r.Register(Entry{PID: 999999, RuntimeDir: dead, Running: true})
+
+	entries, err = r.Prune()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected the entries without runtime directory to be pruned, got %+v (%v)", entries, err)
+	}
+	if entries[0].PID != os.Getpid() || !entries[0].Running {
+		t.Errorf("Expected the live daemon to run, got %+v", entries[0])
+	}
+	if entries[1].PID != 999999 || entries[1].Running {
+		t.Errorf("Expected the dead daemon not to run, got %+v", entries[1])
+	}
+}
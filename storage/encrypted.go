@@ -0,0 +1,498 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyEnv is the environment variable holding the artifact encryption key
+// when no key file is configured
+const KeyEnv = "BGRUN_LOG_KEY"
+
+// fileMagic starts every encrypted artifact
+const fileMagic = "\x00BGE"
+
+// fileVersion is the version of the format written
+const fileVersion = 2
+
+// Key derivation functions, recorded in the header of each artifact
+const (
+	kdfHKDF   = 1 // raw 256-bit keys
+	kdfPBKDF2 = 2 // passphrases
+)
+
+// saltSize is the size of the random salt of each artifact
+const saltSize = 16
+
+// fileHeaderSize is the magic, the version, the key derivation function and
+// the salt. The records follow, each its big-endian sealed length, then the
+// nonce and the sealed data.
+const fileHeaderSize = len(fileMagic) + 2 + saltSize
+
+// recordHeaderSize is the size of the length preceding each record
+const recordHeaderSize = 4
+
+// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 work factor for passphrases
+const pbkdf2Iterations = 600000
+
+// ErrEncrypted is returned when reading an encrypted artifact without a key
+var ErrEncrypted = errors.New("artifact is encrypted and no key is available (set " + KeyEnv + " or the log key file)")
+
+// ErrTruncated is returned after the data of the complete records of an
+// encrypted artifact whose last record was cut short, as a crash while
+// writing it leaves behind
+var ErrTruncated = errors.New("encrypted artifact ends with a truncated record")
+
+// LoadKey returns the encryption key from keyFile, or from the KeyEnv
+// environment variable if keyFile is empty. It returns nil if neither is set.
+func LoadKey(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		key := bytes.TrimSpace(data)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", keyFile)
+		}
+		return key, nil
+	}
+
+	if key := strings.TrimSpace(os.Getenv(KeyEnv)); key != "" {
+		return []byte(key), nil
+	}
+	return nil, nil
+}
+
+// IsEncrypted reports whether data is an encrypted artifact
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(fileMagic))
+}
+
+// Encrypted wraps a Storage and encrypts the selected artifacts with
+// AES-256-GCM. Other artifacts are passed through untouched, and artifacts
+// written without encryption are still read as they are: a selected
+// artifact replaced by a plaintext file is not detected.
+//
+// Each artifact has a random salt the AES key is derived from, and its
+// records are sealed with the artifact name and their sequence number as
+// associated data, so records reordered, dropped from the middle or taken
+// from another artifact fail to decrypt. Whole records cut from the end are
+// not detected, since nothing records how many there are.
+type Encrypted struct {
+	Storage
+	key   []byte
+	kdf   byte
+	names map[string]bool
+
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD // by key derivation function and salt
+}
+
+// NewEncrypted encrypts the named artifacts of s with key. A key of 64
+// hexadecimal digits is a raw 256-bit key, expanded with HKDF-SHA256; any
+// other key is a passphrase, stretched with PBKDF2-HMAC-SHA256.
+func NewEncrypted(s Storage, key []byte, names ...string) (*Encrypted, error) {
+	if len(key) == 0 {
+		return nil, errors.New("encryption key is empty")
+	}
+
+	e := &Encrypted{Storage: s, key: key, kdf: kdfPBKDF2, names: make(map[string]bool), aeads: make(map[string]cipher.AEAD)}
+	if raw, err := hex.DecodeString(string(key)); err == nil && len(raw) == 32 {
+		e.key, e.kdf = raw, kdfHKDF
+	}
+	for _, name := range names {
+		e.names[name] = true
+	}
+	return e, nil
+}
+
+// aead returns the cipher of the artifacts whose header has kdf and salt
+func (e *Encrypted) aead(kdf byte, salt []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := string(kdf) + string(salt)
+	if aead, ok := e.aeads[id]; ok {
+		return aead, nil
+	}
+
+	var key []byte
+	var err error
+	switch kdf {
+	case kdfHKDF:
+		if e.kdf != kdfHKDF {
+			return nil, errors.New("artifact is encrypted with a raw key, not a passphrase")
+		}
+		key, err = hkdf.Key(sha256.New, e.key, salt, "bgrun artifact encryption", 32)
+	case kdfPBKDF2:
+		if e.kdf != kdfPBKDF2 {
+			return nil, errors.New("artifact is encrypted with a passphrase, not a raw key")
+		}
+		key, err = pbkdf2.Key(sha256.New, string(e.key), salt, pbkdf2Iterations, 32)
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %d", kdf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[id] = aead
+	return aead, nil
+}
+
+// newHeader returns the header of a new artifact, with a fresh salt, and
+// its cipher
+func (e *Encrypted) newHeader() ([]byte, cipher.AEAD, error) {
+	header := make([]byte, fileHeaderSize)
+	copy(header, fileMagic)
+	header[len(fileMagic)] = fileVersion
+	header[len(fileMagic)+1] = e.kdf
+	if _, err := rand.Read(header[len(fileMagic)+2:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := e.aead(e.kdf, header[len(fileMagic)+2:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// parseHeader returns the cipher of the artifact starting with header
+func (e *Encrypted) parseHeader(header []byte) (cipher.AEAD, error) {
+	if len(header) < fileHeaderSize || !IsEncrypted(header) {
+		return nil, errors.New("corrupt encrypted artifact header")
+	}
+	if v := header[len(fileMagic)]; v != fileVersion {
+		return nil, fmt.Errorf("unsupported encrypted artifact version %d", v)
+	}
+	return e.aead(header[len(fileMagic)+1], header[len(fileMagic)+2:fileHeaderSize])
+}
+
+// Append opens the named artifact for appending; each Write is sealed as
+// one record. The records already there are counted to number the next
+// ones, and an artifact ending with a truncated record is refused, since
+// the records appended after it could not be read back.
+func (e *Encrypted) Append(name string) (io.WriteCloser, error) {
+	if !e.names[name] {
+		return e.Storage.Append(name)
+	}
+
+	var header []byte
+	var aead cipher.AEAD
+	var seq uint64
+	r, err := e.Storage.Open(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		d, err := e.newDecrypter(name, r)
+		if err == nil && d.truncated {
+			err = fmt.Errorf("%s: %w", name, ErrTruncated)
+		}
+		if err == nil && d.aead == nil {
+			if end, _ := r.Seek(0, io.SeekEnd); end > 0 {
+				err = fmt.Errorf("%s was written without encryption", name)
+			}
+		}
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		aead, seq = d.aead, uint64(len(d.records))
+	}
+	if aead == nil {
+		// New or empty artifact
+		if header, aead, err = e.newHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := e.Storage.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		if _, err := w.Write(header); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return &encryptedWriter{name: name, aead: aead, seq: seq, w: w}, nil
+}
+
+// WriteFile replaces the named artifact, sealing it as a single record
+func (e *Encrypted) WriteFile(name string, data []byte) error {
+	if !e.names[name] {
+		return e.Storage.WriteFile(name, data)
+	}
+	header, aead, err := e.newHeader()
+	if err != nil {
+		return err
+	}
+	record, err := seal(header, aead, name, 0, data)
+	if err != nil {
+		return err
+	}
+	return e.Storage.WriteFile(name, record)
+}
+
+// ReadFile returns the decrypted content of the named artifact
+func (e *Encrypted) ReadFile(name string) ([]byte, error) {
+	data, err := e.Storage.ReadFile(name)
+	if err != nil || !e.names[name] {
+		return data, err
+	}
+	return e.Decrypt(name, data)
+}
+
+// Open opens the named artifact for reading, records being decrypted as
+// they are read
+func (e *Encrypted) Open(name string) (io.ReadSeekCloser, error) {
+	r, err := e.Storage.Open(name)
+	if err != nil || !e.names[name] {
+		return r, err
+	}
+
+	d, err := e.newDecrypter(name, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if d.aead == nil {
+		// Not encrypted
+		return r, nil
+	}
+	return d, nil
+}
+
+// Decrypt decrypts the named artifact read as data. Data that is not
+// encrypted is returned as is.
+func (e *Encrypted) Decrypt(name string, data []byte) ([]byte, error) {
+	d, err := e.newDecrypter(name, nopCloser{bytes.NewReader(data)})
+	if err != nil || d.aead == nil {
+		return data, err
+	}
+	return io.ReadAll(d)
+}
+
+// seal appends to dst the record seq of the named artifact holding data
+func seal(dst []byte, aead cipher.AEAD, name string, seq uint64, data []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	size := nonceSize + len(data) + aead.Overhead()
+
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(size))
+	dst = append(dst, make([]byte, nonceSize)...)
+	nonce := dst[start+recordHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(dst, nonce, data, recordAD(name, seq)), nil
+}
+
+// recordAD is the associated data of the record seq of the named artifact
+func recordAD(name string, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(name), 0), seq)
+}
+
+// encryptedWriter seals every Write as a record of the underlying artifact
+type encryptedWriter struct {
+	name string
+	aead cipher.AEAD
+
+	mu  sync.Mutex // stdout and stderr readers share the log
+	seq uint64
+	w   io.WriteCloser
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record, err := seal(nil, w.aead, w.name, w.seq, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(record); err != nil {
+		return 0, err
+	}
+	w.seq++
+	return len(p), nil
+}
+
+func (w *encryptedWriter) Close() error {
+	return w.w.Close()
+}
+
+// record locates a record of an encrypted artifact
+type record struct {
+	offset int64 // of the record header in the artifact
+	start  int64 // of the data of the record once decrypted
+	size   int   // sealed length
+}
+
+// decrypter reads an encrypted artifact, decrypting the record holding the
+// position read only
+type decrypter struct {
+	name      string
+	aead      cipher.AEAD
+	r         io.ReadSeekCloser
+	records   []record
+	size      int64 // of the decrypted data
+	truncated bool
+
+	pos   int64
+	cur   int    // index of the record in plain, -1 if none
+	plain []byte // decrypted data of records[cur]
+}
+
+// newDecrypter indexes the records of the named artifact read from r. The
+// returned decrypter has no cipher if the artifact is empty or not
+// encrypted.
+func (e *Encrypted) newDecrypter(name string, r io.ReadSeekCloser) (*decrypter, error) {
+	d := &decrypter{name: name, r: r, cur: -1}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && err != io.EOF {
+		return nil, err
+	}
+	if !IsEncrypted(header[:n]) {
+		return d, nil
+	}
+	if d.aead, err = e.parseHeader(header[:n]); err != nil {
+		return nil, err
+	}
+
+	minSize := d.aead.NonceSize() + d.aead.Overhead()
+	offset := int64(fileHeaderSize)
+	var length [recordHeaderSize]byte
+	for offset < end {
+		if offset+recordHeaderSize > end {
+			d.truncated = true
+			break
+		}
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint32(length[:]))
+		if size < minSize {
+			return nil, errors.New("corrupt encrypted record size")
+		}
+		if offset+recordHeaderSize+int64(size) > end {
+			d.truncated = true
+			break
+		}
+		d.records = append(d.records, record{offset: offset, start: d.size, size: size})
+		d.size += int64(size - minSize)
+		offset += recordHeaderSize + int64(size)
+	}
+	return d, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		if d.truncated {
+			return 0, fmt.Errorf("%s: %w", d.name, ErrTruncated)
+		}
+		return 0, io.EOF
+	}
+
+	// The record holding pos
+	i := sort.Search(len(d.records), func(i int) bool {
+		return d.records[i].start+int64(d.recordLen(i)) > d.pos
+	})
+	if i != d.cur {
+		if err := d.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-d.records[i].start:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// recordLen returns the decrypted length of record i
+func (d *decrypter) recordLen(i int) int {
+	return d.records[i].size - d.aead.NonceSize() - d.aead.Overhead()
+}
+
+// load decrypts record i
+func (d *decrypter) load(i int) error {
+	rec := d.records[i]
+	if _, err := d.r.Seek(rec.offset+recordHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, rec.size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return err
+	}
+	nonceSize := d.aead.NonceSize()
+	plain, err := d.aead.Open(sealed[nonceSize:nonceSize], sealed[:nonceSize], sealed[nonceSize:], recordAD(d.name, uint64(i)))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt record %d: %w", i, err)
+	}
+	d.cur, d.plain = i, plain
+	return nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.r.Close()
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewEncrypted(Dir(tmpDir), []byte("secret key"), "output.log")
+	if err != nil {
+		t.Fatalf("NewEncrypted failed: %v", err)
+	}
+
+	for _, chunk := range []string{"password=hunter2\n", "second line\n"} {
+		w, err := s.Append("output.log")
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		w.Close()
+	}
+
+	// Nothing readable at rest
+	raw, err := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	if err != nil {
+		t.Fatalf("Failed to read raw log: %v", err)
+	}
+	if !IsEncrypted(raw) || bytes.Contains(raw, []byte("hunter2")) {
+		t.Errorf("Expected encrypted log at rest, got %q", raw)
+	}
+
+	r, err := s.Open("output.log")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "password=hunter2\nsecond line\n" {
+		t.Errorf("Unexpected decrypted log: %q", data)
+	}
+
+	// A truncated trailing record is an error, after the records before it
+	truncated := raw[:len(raw)-3]
+	if data, err := s.Decrypt("output.log", truncated); !errors.Is(err, ErrTruncated) || string(data) != "password=hunter2\n" {
+		t.Errorf("Expected first record then ErrTruncated, got %q (err=%v)", data, err)
+	}
+	os.WriteFile(filepath.Join(tmpDir, "output.log"), truncated, 0600)
+	if _, err := s.Append("output.log"); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected appending after a truncated record to fail, got %v", err)
+	}
+
+	// Artifacts that are not selected stay in the clear
+	if err := s.WriteFile("status.json", []byte("{}")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if raw, _ := os.ReadFile(filepath.Join(tmpDir, "status.json")); string(raw) != "{}" {
+		t.Errorf("Expected status.json in the clear, got %q", raw)
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, _ := NewEncrypted(Dir(tmpDir), []byte("right"), "output.log")
+	if err := s.WriteFile("output.log", []byte("data")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	wrong, _ := NewEncrypted(Dir(tmpDir), []byte("wrong"), "output.log")
+	if _, err := wrong.ReadFile("output.log"); err == nil {
+		t.Error("Expected decryption with the wrong key to fail")
+	}
+}
+
+// appendRecords writes each chunk as a record of the named artifact of s
+func appendRecords(t *testing.T, s *Encrypted, name string, chunks ...string) {
+	t.Helper()
+	w, err := s.Append(name)
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	defer w.Close()
+	for _, chunk := range chunks {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// splitRecords returns the header and the records of an encrypted artifact
+func splitRecords(data []byte) ([]byte, [][]byte) {
+	header, data := data[:fileHeaderSize], data[fileHeaderSize:]
+	var records [][]byte
+	for len(data) > 0 {
+		size := recordHeaderSize + int(binary.BigEndian.Uint32(data))
+		records = append(records, data[:size])
+		data = data[size:]
+	}
+	return header, records
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewEncrypted(Dir(tmpDir), []byte("secret key"), "output.log", "session.cast")
+	if err != nil {
+		t.Fatalf("NewEncrypted failed: %v", err)
+	}
+	appendRecords(t, s, "output.log", "one\n", "two\n", "three\n")
+	appendRecords(t, s, "session.cast", "cast\n")
+	raw, _ := os.ReadFile(filepath.Join(tmpDir, "output.log"))
+	header, records := splitRecords(raw)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+
+	join := func(records ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, records...), nil)
+	}
+	if data, err := s.Decrypt("output.log", join(records...)); err != nil || string(data) != "one\ntwo\nthree\n" {
+		t.Fatalf("Expected the log back, got %q (err=%v)", data, err)
+	}
+	if _, err := s.Decrypt("output.log", join(records[1], records[0], records[2])); err == nil {
+		t.Error("Expected reordered records to fail")
+	}
+	if _, err := s.Decrypt("output.log", join(records[0], records[2])); err == nil {
+		t.Error("Expected a dropped record to fail")
+	}
+	if _, err := s.Decrypt("session.cast", raw); err == nil {
+		t.Error("Expected an artifact read under another name to fail")
+	}
+
+	// Each artifact has a salt, and the records of another do not decrypt
+	other, _ := os.ReadFile(filepath.Join(tmpDir, "session.cast"))
+	otherHeader, otherRecords := splitRecords(other)
+	if bytes.Equal(header, otherHeader) {
+		t.Error("Expected artifacts to have salts of their own")
+	}
+	if _, err := s.Decrypt("output.log", join(records[0], otherRecords[0])); err == nil {
+		t.Error("Expected a record of another artifact to fail")
+	}
+}
+
+func TestEncryptedAppendAndSeek(t *testing.T) {
+	tmpDir := t.TempDir()
+	// A raw key, expanded with HKDF
+	key := []byte("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff")
+	s, err := NewEncrypted(Dir(tmpDir), key, "output.log")
+	if err != nil {
+		t.Fatalf("NewEncrypted failed: %v", err)
+	}
+	appendRecords(t, s, "output.log", "abc", "", "defg")
+	// Appending again continues the numbering
+	appendRecords(t, s, "output.log", "hij")
+
+	r, err := s.Open("output.log")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+	if end, err := r.Seek(0, io.SeekEnd); err != nil || end != 10 {
+		t.Errorf("Expected 10 bytes, got %d (err=%v)", end, err)
+	}
+	r.Seek(2, io.SeekStart)
+	if data, err := io.ReadAll(r); err != nil || string(data) != "cdefghij" {
+		t.Errorf("Expected the log from offset 2, got %q (err=%v)", data, err)
+	}
+
+	// The passphrase of the same text does not read it
+	passphrase, _ := NewEncrypted(Dir(tmpDir), []byte("secret key"), "output.log")
+	if _, err := passphrase.ReadFile("output.log"); err == nil {
+		t.Error("Expected a passphrase to fail on an artifact of a raw key")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	t.Setenv(KeyEnv, "")
+	if key, err := LoadKey(""); key != nil || err != nil {
+		t.Errorf("Expected no key, got %q (err=%v)", key, err)
+	}
+
+	t.Setenv(KeyEnv, " from-env\n")
+	if key, _ := LoadKey(""); string(key) != "from-env" {
+		t.Errorf("Expected key from environment, got %q", key)
+	}
+
+	// The key file takes precedence over the environment
+	keyFile := filepath.Join(t.TempDir(), "log.key")
+	os.WriteFile(keyFile, []byte("from-file\n"), 0600)
+	if key, _ := LoadKey(keyFile); string(key) != "from-file" {
+		t.Errorf("Expected key from file, got %q", key)
+	}
+
+	if _, err := LoadKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for missing key file")
+	}
+}
@@ -0,0 +1,78 @@
+// Package storage abstracts where bgrun keeps the artifacts of a run
+// (output log, recorded configuration, final status).
+//
+// The control socket always lives in the local runtime directory; only the
+// artifacts go through a Storage, so embedders can keep them on tmpfs, in a
+// database or in a remote store.
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage stores the named artifacts of a single run. Implementations must
+// return an error matching fs.ErrNotExist for artifacts that do not exist.
+type Storage interface {
+	// Append opens the named artifact for appending, creating it if needed
+	Append(name string) (io.WriteCloser, error)
+
+	// WriteFile replaces the named artifact. Readers must never observe a
+	// partially written artifact.
+	WriteFile(name string, data []byte) error
+
+	// ReadFile returns the content of the named artifact
+	ReadFile(name string) ([]byte, error)
+
+	// Open opens the named artifact for reading
+	Open(name string) (io.ReadSeekCloser, error)
+
+	// RemoveAll removes every artifact of the run
+	RemoveAll() error
+}
+
+// Dir is the default Storage, keeping artifacts as files in a local directory
+type Dir string
+
+// Append opens the named file for appending, creating it if needed
+func (d Dir) Append(name string) (io.WriteCloser, error) {
+	return os.OpenFile(d.path(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// WriteFile replaces the named file through a temporary file and a rename
+func (d Dir) WriteFile(name string, data []byte) error {
+	path := d.path(name)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// ReadFile returns the content of the named file
+func (d Dir) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(d.path(name))
+}
+
+// Open opens the named file for reading
+func (d Dir) Open(name string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RemoveAll removes the directory and everything in it
+func (d Dir) RemoveAll() error {
+	return os.RemoveAll(string(d))
+}
+
+func (d Dir) path(name string) string {
+	return filepath.Join(string(d), name)
+}
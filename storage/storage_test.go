@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirStorage(t *testing.T) {
+	tmpDir := t.TempDir()
+	s := Dir(tmpDir)
+
+	if _, err := s.ReadFile("missing.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist for missing artifact, got %v", err)
+	}
+
+	if err := s.WriteFile("status.json", []byte("one")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := s.WriteFile("status.json", []byte("two")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if data, err := s.ReadFile("status.json"); err != nil || string(data) != "two" {
+		t.Errorf("Expected %q, got %q (err=%v)", "two", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "status.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be renamed away")
+	}
+
+	for _, chunk := range []string{"hello ", "world"} {
+		w, err := s.Append("output.log")
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		w.Write([]byte(chunk))
+		w.Close()
+	}
+
+	r, err := s.Open("output.log")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("Expected %q, got %q (err=%v)", "hello world", data, err)
+	}
+
+	if err := s.RemoveAll(); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("Expected directory to be removed")
+	}
+}
@@ -0,0 +1,332 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// Restart policies, set in JobConfig.Restart
+const (
+	RestartNo        = "no"         // the job stays exited (default)
+	RestartOnFailure = "on-failure" // the job is restarted when it exits with a non-zero code
+	RestartAlways    = "always"     // the job is restarted whenever it exits
+)
+
+// jobNamePattern restricts job names to what is safe as a directory name
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Config lists the jobs of a supervisor
+type Config struct {
+	Jobs []JobConfig `json:"jobs"`
+
+	// RuntimeDir holds the control socket of the supervisor and the runtime
+	// directory of each job, named after it (RuntimeRoot()/bgrund if empty)
+	RuntimeDir string `json:"runtime_dir,omitempty"`
+
+	// StopTimeout is how many seconds a job has to exit after SIGTERM
+	// before it is killed (DefaultStopTimeout if zero)
+	StopTimeout int `json:"stop_timeout,omitempty"`
+
+	// RestartDelay is how many milliseconds a job waits to be restarted by
+	// its restart policy (DefaultRestartDelay if zero)
+	RestartDelay int `json:"restart_delay_ms,omitempty"`
+}
+
+// DefaultStopTimeout is how long a job has to exit after SIGTERM by default
+const DefaultStopTimeout = 10 * time.Second
+
+// DefaultRestartDelay is how long a job waits to be restarted by default,
+// so that a job failing right away does not spin
+const DefaultRestartDelay = time.Second
+
+// stopTimeout returns how long a job has to exit after SIGTERM
+func (c *Config) stopTimeout() time.Duration {
+	if c.StopTimeout > 0 {
+		return time.Duration(c.StopTimeout) * time.Second
+	}
+	return DefaultStopTimeout
+}
+
+// restartDelay returns how long a job waits to be restarted
+func (c *Config) restartDelay() time.Duration {
+	if c.RestartDelay > 0 {
+		return time.Duration(c.RestartDelay) * time.Millisecond
+	}
+	return DefaultRestartDelay
+}
+
+// JobConfig describes a job. The modes of the streams are given as on the
+// bgrun command line.
+type JobConfig struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Dir     string   `json:"dir,omitempty"`           // working directory, that of the supervisor if empty
+	VTY     bool     `json:"vty,omitempty"`           // run in a pseudo-terminal
+	Record  bool     `json:"record,omitempty"`        // record the session (VTY only)
+	Replay  bool     `json:"replay_screen,omitempty"` // replay output.log for screen and export requests (without VTY)
+	Size    string   `json:"size_policy,omitempty"`   // latest (default), smallest or <cols>x<rows> (VTY only)
+	Stdin   string   `json:"stdin,omitempty"`         // null (default), stream, stream:<path> or a file path
+	Stdout  string   `json:"stdout,omitempty"`        // log (default), null, syslog, journal, |command or a file path
+	Stderr  string   `json:"stderr,omitempty"`        // as Stdout
+
+	// StdoutTee and StderrTee are files the streams are appended to as
+	// well, whatever their mode
+	StdoutTee []string `json:"stdout_tee,omitempty"`
+	StderrTee []string `json:"stderr_tee,omitempty"`
+
+	// MaxLogBytes caps the output.log of each run, as -output-max-size,
+	// and MaxOutputRate the rate of its output, as -output-rate
+	MaxLogBytes   int64 `json:"max_log_bytes,omitempty"`
+	MaxOutputRate int64 `json:"max_output_rate,omitempty"`
+
+	// Restart is the restart policy of the job: RestartNo, RestartOnFailure
+	// or RestartAlways. A job stopped on request is never restarted.
+	Restart string `json:"restart,omitempty"`
+
+	// Schedule is a cron expression (minute hour day-of-month month
+	// day-of-week) the job runs on: each run waits for its next match, and
+	// the job is started again once it exited, whatever its restart policy
+	Schedule string `json:"schedule,omitempty"`
+
+	// Manual jobs are not started with the supervisor, only on request
+	Manual bool `json:"manual,omitempty"`
+
+	// After lists the jobs this one depends on: it is started once they are
+	// ready, and stopped before them when the supervisor shuts down
+	After []string `json:"after,omitempty"`
+
+	// Ready tells when the job is ready for the jobs depending on it, as
+	// soon as it runs if nil
+	Ready *ReadyCheck `json:"ready,omitempty"`
+
+	// Health checks the job while it runs. With its Restart set, the job
+	// killed for being unhealthy is restarted whatever its exit code, which
+	// requires a restart policy.
+	Health *daemon.HealthCheck `json:"health,omitempty"`
+
+	// Webhooks are URLs notified of each exit of the job, with its last
+	// WebhookLines lines of output, as with daemon.Config
+	Webhooks     []string `json:"webhooks,omitempty"`
+	WebhookLines int      `json:"webhook_lines,omitempty"`
+
+	// Hooks are shell commands run on the lifecycle events of the job, its
+	// on_restart hook whenever it starts again
+	Hooks daemon.Hooks `json:"hooks,omitzero"`
+
+	// AllowedUIDs, AllowedGIDs and Permissions limit the clients of the
+	// job as with daemon.Config, both on the control socket of the
+	// supervisor and once they selected the job. Starting, stopping and
+	// restarting the job requires the shutdown permission.
+	AllowedUIDs []int              `json:"allowed_uids,omitempty"`
+	AllowedGIDs []int              `json:"allowed_gids,omitempty"`
+	Permissions daemon.Permissions `json:"permissions,omitempty"`
+}
+
+// ReadyCheck tells when a job is ready. Exactly one of Exit, Port and
+// Pattern is set.
+type ReadyCheck struct {
+	Exit    bool   `json:"exit,omitempty"`    // the job exited with code 0, for setup tasks
+	Port    string `json:"port,omitempty"`    // TCP address accepting connections, such as localhost:5432
+	Pattern string `json:"pattern,omitempty"` // regular expression (RE2 syntax) matching the output, or the screen in VTY mode
+
+	// Timeout is how many seconds the job has to get ready once started
+	// (DefaultReadyTimeout if zero). Jobs depending on a job that failed to
+	// get ready are not started.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// DefaultReadyTimeout is how long a job has to get ready by default
+const DefaultReadyTimeout = time.Minute
+
+// timeout returns how long the job has to get ready
+func (r *ReadyCheck) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return time.Duration(r.Timeout) * time.Second
+	}
+	return DefaultReadyTimeout
+}
+
+// validate checks exactly one condition is set
+func (r *ReadyCheck) validate() error {
+	n := 0
+	if r.Exit {
+		n++
+	}
+	if r.Port != "" {
+		if _, _, err := net.SplitHostPort(r.Port); err != nil {
+			return fmt.Errorf("invalid ready port: %w", err)
+		}
+		n++
+	}
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid ready pattern: %w", err)
+		}
+		n++
+	}
+	if n != 1 {
+		return errors.New("ready needs one of exit, port and pattern")
+	}
+	return nil
+}
+
+// LoadConfig reads a supervisor configuration from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// daemonConfig returns the configuration of the daemon running the job in
+// runtimeDir
+func (c *JobConfig) daemonConfig(runtimeDir string) (*daemon.Config, error) {
+	config := &daemon.Config{
+		Command:      c.Command,
+		UseVTY:       c.VTY,
+		Record:       c.Record,
+		ReplayScreen: c.Replay,
+		Dir:          c.Dir,
+		RuntimeDir:   runtimeDir,
+		Embedded:     true,
+		StdoutTee:    c.StdoutTee,
+		StderrTee:    c.StderrTee,
+
+		MaxLogBytes:   c.MaxLogBytes,
+		MaxOutputRate: c.MaxOutputRate,
+
+		HealthCheck: c.Health,
+		Hooks:       c.Hooks,
+		Schedule:    c.Schedule,
+
+		Webhooks:     c.Webhooks,
+		WebhookLines: c.WebhookLines,
+
+		AllowedUIDs: c.AllowedUIDs,
+		AllowedGIDs: c.AllowedGIDs,
+		Permissions: c.Permissions,
+	}
+
+	switch {
+	case c.Stdin == "" || c.Stdin == "null":
+		config.StdinMode = daemon.StdinNull
+	case c.Stdin == "stream":
+		config.StdinMode = daemon.StdinStream
+	case strings.HasPrefix(c.Stdin, "stream:"):
+		config.StdinMode = daemon.StdinStream
+		config.StdinPath = strings.TrimPrefix(c.Stdin, "stream:")
+	default:
+		config.StdinMode = daemon.StdinFile
+		config.StdinPath = c.Stdin
+	}
+
+	var err error
+	if config.SizePolicy, config.FixedRows, config.FixedCols, err = daemon.ParseSizePolicy(c.Size); err != nil {
+		return nil, err
+	}
+	if config.StdoutMode, config.StdoutPath, err = parseOutput(c.Stdout); err != nil {
+		return nil, fmt.Errorf("invalid stdout mode: %w", err)
+	}
+	if config.StdoutMode == daemon.IOModeFilter {
+		config.StdoutFilter, config.StdoutPath = config.StdoutPath, ""
+	}
+	if config.StderrMode, config.StderrPath, err = parseOutput(c.Stderr); err != nil {
+		return nil, fmt.Errorf("invalid stderr mode: %w", err)
+	}
+	if config.StderrMode == daemon.IOModeFilter {
+		config.StderrFilter, config.StderrPath = config.StderrPath, ""
+	}
+	return config, nil
+}
+
+// jobPermission returns the permission a client needs for a job action:
+// starting and stopping the job end its process as SHUTDOWN does
+func jobPermission(action string) daemon.Permissions {
+	switch action {
+	case protocol.JobStart, protocol.JobStop, protocol.JobRestart:
+		return daemon.PermShutdown
+	}
+	return daemon.PermObserve
+}
+
+// permitted checks that the client of conn may run action on the job, as
+// the daemon of the job checks its clients
+func (c *JobConfig) permitted(conn net.Conn, action string) error {
+	perms, err := daemon.ClientPermissions(&daemon.Config{
+		AllowedUIDs: c.AllowedUIDs,
+		AllowedGIDs: c.AllowedGIDs,
+		Permissions: c.Permissions,
+	}, conn)
+	if err != nil {
+		return err
+	}
+	if need := jobPermission(action); perms&need == 0 {
+		return fmt.Errorf("permission denied: %s requires the %s permission", action, need)
+	}
+	return nil
+}
+
+// parseOutput parses the mode of an output stream, logged by default
+func parseOutput(mode string) (daemon.IOMode, string, error) {
+	if mode == "" {
+		return daemon.IOModeLog, "", nil
+	}
+	return daemon.ParseIOMode(mode)
+}
+
+// validate checks the configuration of the job, creating a daemon for it
+// that is not started
+func (c *JobConfig) validate() error {
+	if !jobNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid job name %q (letters, digits, - and _ only)", c.Name)
+	}
+	switch c.Restart {
+	case "", RestartNo, RestartOnFailure, RestartAlways:
+	default:
+		return fmt.Errorf("job %s: unknown restart policy %q (no, on-failure or always)", c.Name, c.Restart)
+	}
+	if c.Ready != nil {
+		if err := c.Ready.validate(); err != nil {
+			return fmt.Errorf("job %s: %w", c.Name, err)
+		}
+	}
+	if c.Health != nil && c.Health.Restart && !c.restarts(1) {
+		return fmt.Errorf("job %s: restarting unhealthy jobs requires a restart policy", c.Name)
+	}
+	config, err := c.daemonConfig("")
+	if err == nil {
+		_, err = daemon.New(config)
+	}
+	if err != nil {
+		return fmt.Errorf("job %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// restarts tells whether the job is restarted after exiting with exitCode
+func (c *JobConfig) restarts(exitCode int) bool {
+	if c.Schedule != "" {
+		return true
+	}
+	switch c.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// portCheckInterval is how often a ready port is tried
+const portCheckInterval = 250 * time.Millisecond
+
+// resolveDependencies links the jobs to those they depend on, refusing
+// unknown jobs and cycles
+func (s *Supervisor) resolveDependencies() error {
+	for _, j := range s.jobs {
+		for _, name := range j.config.After {
+			dep, err := s.job(name)
+			if err != nil {
+				return fmt.Errorf("job %s depends on %w", j.config.Name, err)
+			}
+			j.after = append(j.after, dep)
+			dep.dependents = append(dep.dependents, j)
+		}
+	}
+
+	// Depth-first search, a job met again while its dependencies are being
+	// visited closing a cycle
+	const visiting, visited = 1, 2
+	marks := make(map[*job]int)
+	var visit func(j *job, path []string) error
+	visit = func(j *job, path []string) error {
+		path = append(path, j.config.Name)
+		switch marks[j] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		marks[j] = visiting
+		for _, dep := range j.after {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		marks[j] = visited
+		return nil
+	}
+	for _, j := range s.jobs {
+		if err := visit(j, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedLocked wakes up the waiters on the state of the jobs, s.mu being
+// held
+func (s *Supervisor) changedLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitReady waits for a job another depends on to be ready, failing when
+// it cannot become ready without being started: stopped, failed, exited
+// or having failed its ready check
+func (s *Supervisor) waitReady(dep *job) error {
+	for {
+		s.mu.Lock()
+		ready, state, readyErr, changed := dep.ready, dep.state, dep.readyErr, s.changed
+		s.mu.Unlock()
+
+		switch {
+		case ready:
+			return nil
+		case readyErr != "":
+			return fmt.Errorf("job %s is not ready: %s", dep.config.Name, readyErr)
+		case state != protocol.JobStarting && state != protocol.JobRunning && state != protocol.JobRestarting:
+			return fmt.Errorf("job %s is not ready: it is %s", dep.config.Name, state)
+		}
+
+		select {
+		case <-changed:
+		case <-s.closeCh:
+			return errors.New("supervisor is shutting down")
+		}
+	}
+}
+
+// checkReady runs the ready check of a run of the job, the exit check
+// being done by watch
+func (s *Supervisor) checkReady(j *job, d *daemon.Daemon, run int) {
+	check := j.config.Ready
+	var err error
+	switch {
+	case check == nil:
+	case check.Exit:
+		return
+	case check.Port != "":
+		err = waitPort(d, check.Port, check.timeout())
+	case check.Pattern != "":
+		err = waitPattern(d, check.Pattern, check.timeout())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j.run != run {
+		return
+	}
+	if err != nil {
+		j.readyErr = err.Error()
+		log.Printf("Job %s is not ready: %v", j.config.Name, err)
+	} else {
+		j.ready = true
+		if check != nil {
+			log.Printf("Job %s is ready", j.config.Name)
+		}
+	}
+	s.changedLocked()
+}
+
+// waitPort waits for addr to accept connections while the process runs
+func waitPort(d *daemon.Daemon, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, portCheckInterval)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not accepting connections after %v", addr, timeout)
+		}
+		select {
+		case <-d.Done():
+			return errors.New("exited before being ready")
+		case <-time.After(portCheckInterval):
+		}
+	}
+}
+
+// waitPattern waits for the output of the process to match pattern,
+// through the control socket of its daemon
+func waitPattern(d *daemon.Daemon, pattern string, timeout time.Duration) error {
+	c, err := bgclient.Connect(d.SocketPath())
+	if err != nil {
+		select {
+		case <-d.Done():
+			// The socket is removed when the process exits
+			return errors.New("exited before being ready")
+		default:
+			return err
+		}
+	}
+	defer c.Close()
+
+	status, err := c.WaitForPattern(uint32((timeout+time.Second-1)/time.Second), pattern)
+	switch {
+	case err != nil:
+		return err
+	case status == protocol.WaitStatusTimeout:
+		return fmt.Errorf("output not matching %q after %v", pattern, timeout)
+	case status != protocol.WaitStatusCompleted:
+		return errors.New("exited before being ready")
+	}
+	return nil
+}
@@ -0,0 +1,634 @@
+// Package supervisor runs several named jobs behind a single control
+// socket, as cmd/bgrund does. Each job is run by a daemon in a runtime
+// directory of its own; the socket starts, stops and restarts the jobs,
+// and hands the connections selecting a job over to its daemon, so that
+// every request of the bgrun protocol works on the jobs.
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+// SocketFileName is the name of the control socket in the runtime
+// directory of the supervisor
+const SocketFileName = "control.sock"
+
+// ErrNoSuchJob is returned for a job name the supervisor does not know
+var ErrNoSuchJob = errors.New("no such job")
+
+// Supervisor runs the jobs of a Config
+type Supervisor struct {
+	runtimeDir string
+	socketPath string
+	jobs       []*job
+	listener   net.Listener
+	closeCh    chan struct{}
+	closeOnce  sync.Once
+
+	stopTimeout  time.Duration
+	restartDelay time.Duration
+
+	// wg counts the goroutines watching the runs of the jobs, waited for
+	// by Close
+	wg sync.WaitGroup
+
+	// mu protects the state of the jobs, changed being closed and replaced
+	// whenever it changes
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// job is a job of the supervisor and the state of its last run
+type job struct {
+	config     JobConfig
+	dir        string
+	after      []*job // jobs this one depends on
+	dependents []*job // jobs depending on this one
+
+	// op serializes the actions on the job, such as a stop requested while
+	// a restart is pending
+	op sync.Mutex
+
+	daemon    *daemon.Daemon // last run, nil if never started
+	run       int            // incremented at each start, telling the runs apart
+	state     string         // protocol.JobStopped, JobRunning...
+	startErr  string
+	ready     bool          // the run passed the ready check
+	readyErr  string        // the run failed the ready check
+	stopping  bool          // the job is stopped on request, not to be restarted
+	exited    chan struct{} // closed once the exit of the run was handled
+	pid       int
+	startedAt time.Time
+	exitCode  *int
+	restarts  int
+}
+
+// New creates a supervisor for the jobs of config, which are checked but
+// not started
+func New(config *Config) (*Supervisor, error) {
+	runtimeDir := config.RuntimeDir
+	if runtimeDir == "" {
+		runtimeDir = filepath.Join(daemon.RuntimeRoot(), "bgrund")
+	}
+
+	s := &Supervisor{
+		runtimeDir: runtimeDir,
+		socketPath: filepath.Join(runtimeDir, SocketFileName),
+		closeCh:    make(chan struct{}),
+		changed:    make(chan struct{}),
+
+		stopTimeout:  config.stopTimeout(),
+		restartDelay: config.restartDelay(),
+	}
+	names := make(map[string]bool)
+	for _, jc := range config.Jobs {
+		if err := jc.validate(); err != nil {
+			return nil, err
+		}
+		if names[jc.Name] {
+			return nil, fmt.Errorf("duplicate job name %q", jc.Name)
+		}
+		names[jc.Name] = true
+		s.jobs = append(s.jobs, &job{
+			config: jc,
+			dir:    filepath.Join(runtimeDir, jc.Name),
+			state:  protocol.JobStopped,
+		})
+	}
+	if err := s.resolveDependencies(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SocketPath returns the path of the control socket
+func (s *Supervisor) SocketPath() string {
+	return s.socketPath
+}
+
+// RuntimeDir returns the directory holding the control socket and the
+// runtime directories of the jobs
+func (s *Supervisor) RuntimeDir() string {
+	return s.runtimeDir
+}
+
+// Start listens on the control socket, then starts the jobs that are not
+// manual, each once the jobs it depends on are ready. It returns when they
+// all started or failed to, a failure being reported in the job state.
+func (s *Supervisor) Start() error {
+	if err := os.MkdirAll(s.runtimeDir, 0700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+
+	// A socket left by a supervisor that died can be replaced, not the
+	// socket of one that runs
+	if conn, err := net.Dial("unix", s.socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("a supervisor is already listening on %s", s.socketPath)
+	}
+	os.Remove(s.socketPath)
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.socketPath, err)
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	s.listener = listener
+	go s.acceptConnections()
+
+	var autostart []*job
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		if !j.config.Manual {
+			j.state = protocol.JobStarting
+			autostart = append(autostart, j)
+		}
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, j := range autostart {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.StartJob(j.config.Name); err != nil {
+				log.Printf("Failed to start job %s: %v", j.config.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// Close stops the jobs, closing their daemons, and the control socket. A
+// job is stopped once the jobs depending on it are.
+func (s *Supervisor) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		if s.listener != nil {
+			s.listener.Close()
+			os.Remove(s.socketPath)
+		}
+
+		var wg sync.WaitGroup
+		stopped := make(map[*job]chan struct{})
+		for _, j := range s.jobs {
+			stopped[j] = make(chan struct{})
+		}
+		for _, j := range s.jobs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(stopped[j])
+				for _, dependent := range j.dependents {
+					<-stopped[dependent]
+				}
+
+				j.op.Lock()
+				defer j.op.Unlock()
+				s.stop(j)
+				s.mu.Lock()
+				d := j.daemon
+				s.mu.Unlock()
+				if d != nil {
+					d.Close()
+				}
+			}()
+		}
+		wg.Wait()
+		s.wg.Wait()
+	})
+}
+
+// job returns the job with the given name
+func (s *Supervisor) job(name string) (*job, error) {
+	for _, j := range s.jobs {
+		if j.config.Name == name {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoSuchJob, name)
+}
+
+// Jobs returns the state of every job, in the order of the configuration
+func (s *Supervisor) Jobs() []protocol.JobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]protocol.JobState, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		states = append(states, j.stateLocked())
+	}
+	return states
+}
+
+// Job returns the state of a job
+func (s *Supervisor) Job(name string) (protocol.JobState, error) {
+	j, err := s.job(name)
+	if err != nil {
+		return protocol.JobState{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.stateLocked(), nil
+}
+
+// stateLocked describes the job, s.mu being held
+func (j *job) stateLocked() protocol.JobState {
+	state := protocol.JobState{
+		Name:       j.config.Name,
+		State:      j.state,
+		Ready:      j.ready,
+		PID:        j.pid,
+		RuntimeDir: j.dir,
+		ExitCode:   j.exitCode,
+		Restarts:   j.restarts,
+		Error:      j.startErr,
+	}
+	if j.daemon != nil {
+		state.Health = j.daemon.Health()
+		if state.PID == 0 {
+			state.PID = j.daemon.PID()
+		}
+		if at := j.daemon.ScheduledAt(); !at.IsZero() && j.state == protocol.JobRunning {
+			state.State = protocol.JobScheduled
+			state.ScheduledAt = &at
+		}
+	}
+	if j.readyErr != "" {
+		state.Error = j.readyErr
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		state.StartedAt = &startedAt
+	}
+	return state
+}
+
+// StartJob starts a job that is not running. Starting a running job does
+// nothing.
+func (s *Supervisor) StartJob(name string) error {
+	j, err := s.job(name)
+	if err != nil {
+		return err
+	}
+	j.op.Lock()
+	defer j.op.Unlock()
+
+	s.mu.Lock()
+	if j.state != protocol.JobRunning {
+		j.restarts = 0
+	}
+	s.mu.Unlock()
+	return s.start(j)
+}
+
+// StopJob stops a job with SIGTERM, killing it if it did not exit within
+// the stop timeout. Its daemon is kept until the job is started again, for
+// its status and output.
+func (s *Supervisor) StopJob(name string) error {
+	j, err := s.job(name)
+	if err != nil {
+		return err
+	}
+	j.op.Lock()
+	defer j.op.Unlock()
+	s.stop(j)
+	return nil
+}
+
+// RestartJob stops a job if it runs, then starts it again
+func (s *Supervisor) RestartJob(name string) error {
+	j, err := s.job(name)
+	if err != nil {
+		return err
+	}
+	j.op.Lock()
+	defer j.op.Unlock()
+
+	s.stop(j)
+	s.mu.Lock()
+	j.restarts = 0
+	s.mu.Unlock()
+	return s.start(j)
+}
+
+// start runs the job in a new daemon, closing that of its previous run.
+// j.op is held.
+func (s *Supervisor) start(j *job) error {
+	select {
+	case <-s.closeCh:
+		return errors.New("supervisor is shutting down")
+	default:
+	}
+
+	s.mu.Lock()
+	if j.state == protocol.JobRunning {
+		s.mu.Unlock()
+		return nil
+	}
+	previous := j.daemon
+	restarted := j.run > 0
+	if len(j.after) > 0 {
+		j.state = protocol.JobStarting
+		s.changedLocked()
+	}
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	for _, dep := range j.after {
+		if err := s.waitReady(dep); err != nil {
+			s.mu.Lock()
+			j.state = protocol.JobFailed
+			j.startErr = err.Error()
+			s.changedLocked()
+			s.mu.Unlock()
+			return err
+		}
+	}
+
+	config, err := j.config.daemonConfig(j.dir)
+	if err != nil {
+		return err
+	}
+	config.Restarted = restarted
+	d, err := daemon.New(config)
+	if err == nil {
+		err = d.Start()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.run++
+	j.stopping = false
+	j.ready, j.readyErr = false, ""
+	defer s.changedLocked()
+	if err != nil {
+		j.daemon = nil
+		j.state = protocol.JobFailed
+		j.startErr = err.Error()
+		return err
+	}
+	status := d.GetStatus()
+	j.daemon = d
+	j.state = protocol.JobRunning
+	j.startErr = ""
+	j.pid = status.PID
+	j.startedAt = time.Now()
+	j.exitCode = nil
+	j.exited = make(chan struct{})
+	if at := d.ScheduledAt(); !at.IsZero() {
+		log.Printf("Scheduled job %s at %s", j.config.Name, at.Format(time.RFC3339))
+	} else {
+		log.Printf("Started job %s: process %d", j.config.Name, j.pid)
+	}
+
+	s.wg.Add(2)
+	go func(run int, exited chan struct{}) {
+		defer s.wg.Done()
+		s.watch(j, d, run, exited)
+	}(j.run, j.exited)
+	go func(run int) {
+		defer s.wg.Done()
+		s.checkReady(j, d, run)
+	}(j.run)
+	return nil
+}
+
+// stop signals the job to exit and waits for it. j.op is held.
+func (s *Supervisor) stop(j *job) {
+	s.mu.Lock()
+	j.stopping = true
+	if j.state == protocol.JobRestarting {
+		// Cancels the pending restart
+		j.state = protocol.JobStopped
+		s.changedLocked()
+	}
+	d, exited := j.daemon, j.exited
+	running := j.state == protocol.JobRunning
+	s.mu.Unlock()
+	if !running {
+		return
+	}
+
+	if d.CancelStart() {
+		<-exited
+		return
+	}
+	if err := d.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(s.stopTimeout):
+			log.Printf("Job %s did not exit within %v, killing it", j.config.Name, s.stopTimeout)
+			d.Signal(syscall.SIGKILL)
+		}
+	}
+	<-exited
+}
+
+// watch records the exit of a run of the job, and restarts the job when
+// its restart policy says so
+func (s *Supervisor) watch(j *job, d *daemon.Daemon, run int, exited chan struct{}) {
+	<-d.Done()
+	if err := d.WriteStatus(); err != nil {
+		log.Printf("Failed to write the final status of job %s: %v", j.config.Name, err)
+	}
+	exitCode := -1
+	if status := d.GetStatus(); status.ExitCode != nil {
+		exitCode = *status.ExitCode
+	}
+
+	s.mu.Lock()
+	j.exitCode = &exitCode
+	if ready := j.config.Ready; ready != nil && ready.Exit && exitCode == 0 && !j.ready {
+		j.ready = true
+		log.Printf("Job %s is ready", j.config.Name)
+	}
+	// A job killed for being unhealthy may exit cleanly on SIGTERM
+	unhealthy := j.config.Health != nil && j.config.Health.Restart && d.Health() == protocol.HealthUnhealthy
+	restart := !j.stopping && (j.config.restarts(exitCode) || unhealthy)
+	switch {
+	case j.stopping:
+		j.state = protocol.JobStopped
+	case restart:
+		j.state = protocol.JobRestarting
+	default:
+		j.state = protocol.JobExited
+	}
+	s.changedLocked()
+	s.mu.Unlock()
+	close(exited)
+	if unhealthy {
+		log.Printf("Job %s exited with code %d, unhealthy", j.config.Name, exitCode)
+	} else {
+		log.Printf("Job %s exited with code %d", j.config.Name, exitCode)
+	}
+
+	if !restart {
+		return
+	}
+	select {
+	case <-time.After(s.restartDelay):
+	case <-s.closeCh:
+		return
+	}
+
+	j.op.Lock()
+	defer j.op.Unlock()
+	s.mu.Lock()
+	pending := j.run == run && j.state == protocol.JobRestarting
+	if pending {
+		j.restarts++
+	}
+	s.mu.Unlock()
+	if !pending {
+		return
+	}
+	if err := s.start(j); err != nil {
+		log.Printf("Failed to restart job %s: %v", j.config.Name, err)
+	}
+}
+
+// acceptConnections serves the clients of the control socket
+func (s *Supervisor) acceptConnections() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closeCh:
+				return
+			default:
+				log.Printf("Accept error: %v", err)
+				continue
+			}
+		}
+		go s.handleClient(conn)
+	}
+}
+
+// handleClient answers the requests of a client until it selects a job,
+// the connection then going to the daemon of the job
+func (s *Supervisor) handleClient(conn net.Conn) {
+	for {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgJobControl:
+			err = s.handleJobControl(conn, msg.Payload)
+
+		case protocol.MsgSelectJob:
+			var d *daemon.Daemon
+			if d, err = s.selectJob(conn, string(msg.Payload)); err == nil {
+				d.ServeConn(conn)
+				return
+			}
+
+		default:
+			err = fmt.Errorf("unknown message type: 0x%02X", msg.Type)
+		}
+
+		if err != nil {
+			if err := protocol.WriteMessage(conn, protocol.MsgError, []byte(err.Error())); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// handleJobControl runs the action of a JobRequest, answering with the
+// state of the jobs once it is done
+func (s *Supervisor) handleJobControl(conn net.Conn, payload []byte) error {
+	var req protocol.JobRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("invalid job request: %w", err)
+	}
+
+	if req.Action == protocol.JobList {
+		// Only the jobs the client may observe
+		var states []protocol.JobState
+		for i, state := range s.Jobs() {
+			if s.jobs[i].config.permitted(conn, req.Action) == nil {
+				states = append(states, state)
+			}
+		}
+		return writeJobs(conn, states...)
+	}
+	j, err := s.job(req.Name)
+	if err != nil {
+		return err
+	}
+	if err := j.config.permitted(conn, req.Action); err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case protocol.JobStatus:
+	case protocol.JobStart:
+		err = s.StartJob(req.Name)
+	case protocol.JobStop:
+		err = s.StopJob(req.Name)
+	case protocol.JobRestart:
+		err = s.RestartJob(req.Name)
+	default:
+		return fmt.Errorf("unknown job action %q", req.Action)
+	}
+	if err != nil {
+		return err
+	}
+
+	state, err := s.Job(req.Name)
+	if err != nil {
+		return err
+	}
+	return writeJobs(conn, state)
+}
+
+// selectJob answers SELECT_JOB with the state of the job, returning the
+// daemon of its last run to hand the connection to
+func (s *Supervisor) selectJob(conn net.Conn, name string) (*daemon.Daemon, error) {
+	j, err := s.job(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	d, state := j.daemon, j.stateLocked()
+	s.mu.Unlock()
+	if d == nil {
+		return nil, fmt.Errorf("job %s has not been started", name)
+	}
+	return d, writeJobs(conn, state)
+}
+
+// writeJobs sends a JOB_RESPONSE holding states
+func writeJobs(conn net.Conn, states ...protocol.JobState) error {
+	data, err := json.Marshal(protocol.JobResponse{Jobs: states})
+	if err != nil {
+		return err
+	}
+	return protocol.WriteMessage(conn, protocol.MsgJobResponse, data)
+}
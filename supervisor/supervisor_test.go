@@ -0,0 +1,321 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/bgrun/bgclient"
+	"github.com/KarpelesLab/bgrun/daemon"
+	"github.com/KarpelesLab/bgrun/protocol"
+)
+
+func TestSupervisor(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := New(&Config{
+		RuntimeDir:   tmpDir,
+		StopTimeout:  2,
+		RestartDelay: 100,
+		Jobs: []JobConfig{
+			{Name: "sleeper", Command: []string{"bash", "-c", "echo up; exec sleep 60"}},
+			{Name: "flaky", Command: []string{"bash", "-c", "exit 3"}, Restart: RestartOnFailure,
+				Hooks: daemon.Hooks{OnRestart: "echo restarted >> " + filepath.Join(tmpDir, "restarts")}},
+			{Name: "manual", Command: []string{"echo", "hello"}, Manual: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create supervisor: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor: %v", err)
+	}
+	defer s.Close()
+	socket := s.SocketPath()
+
+	jobs, err := bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobList})
+	if err != nil {
+		t.Fatalf("Failed to list jobs: %v", err)
+	}
+	if len(jobs) != 3 || jobs[0].State != protocol.JobRunning || jobs[2].State != protocol.JobStopped {
+		t.Fatalf("Unexpected jobs %+v", jobs)
+	}
+	if jobs[0].RuntimeDir != filepath.Join(tmpDir, "sleeper") {
+		t.Errorf("Expected the job in its own directory, got %s", jobs[0].RuntimeDir)
+	}
+
+	// The selected job is served by its daemon
+	c, err := bgclient.ConnectJob(socket, "sleeper")
+	if err != nil {
+		t.Fatalf("Failed to select job: %v", err)
+	}
+	status, err := c.GetStatus()
+	c.Close()
+	if err != nil || !status.Running || status.PID != jobs[0].PID {
+		t.Errorf("Expected the status of the job, got %+v (%v)", status, err)
+	}
+
+	// The failing job is restarted by its policy, its exit code being
+	// cleared while a run starts
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, _ := s.Job("flaky")
+		if state.Restarts >= 2 && state.ExitCode != nil {
+			if *state.ExitCode != 3 {
+				t.Errorf("Expected exit code 3, got %+v", state)
+			}
+			// The last restart may still be running its hook
+			if data, err := os.ReadFile(filepath.Join(tmpDir, "restarts")); err != nil || strings.Count(string(data), "restarted\n") < state.Restarts-1 {
+				t.Errorf("Expected the restart hook to run at each restart, got %q (%v)", data, err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the job to be restarted, got %+v", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	jobs, err = bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobStop, Name: "flaky"})
+	if err != nil || jobs[0].State != protocol.JobStopped {
+		t.Errorf("Expected the job to stop, got %+v (%v)", jobs, err)
+	}
+
+	// Stopping sends SIGTERM and waits for the exit
+	jobs, err = bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobStop, Name: "sleeper"})
+	if err != nil || jobs[0].State != protocol.JobStopped || jobs[0].ExitCode == nil {
+		t.Fatalf("Expected the job to stop, got %+v (%v)", jobs, err)
+	}
+	pid := jobs[0].PID
+	jobs, err = bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobRestart, Name: "sleeper"})
+	if err != nil || jobs[0].State != protocol.JobRunning || jobs[0].PID == pid {
+		t.Errorf("Expected the job to run again, got %+v (%v)", jobs, err)
+	}
+
+	// The output of a job that exited stays reachable
+	if _, err := bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobStart, Name: "manual"}); err != nil {
+		t.Fatalf("Failed to start job: %v", err)
+	}
+	c, err = bgclient.ConnectJob(socket, "manual")
+	if err != nil {
+		t.Fatalf("Failed to select job: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Wait(5, protocol.WaitTypeExit); err != nil {
+		t.Fatalf("Failed to wait for the job: %v", err)
+	}
+	if status, err := c.GetStatus(); err != nil || status.ExitCode == nil || *status.ExitCode != 0 {
+		t.Errorf("Expected the status of the exited job, got %+v (%v)", status, err)
+	}
+	if output, err := c.Storage().ReadFile("output.log"); err != nil || string(output) != "hello\n" {
+		t.Errorf("Expected the output of the job, got %q (%v)", output, err)
+	}
+
+	if _, err := bgclient.JobControl(socket, &protocol.JobRequest{Action: protocol.JobStart, Name: "missing"}); err == nil || !strings.Contains(err.Error(), ErrNoSuchJob.Error()) {
+		t.Errorf("Expected an unknown job to be refused, got %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, config := range []*Config{
+		{Jobs: []JobConfig{{Name: "../up", Command: []string{"true"}}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}}, {Name: "a", Command: []string{"true"}}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Restart: "sometimes"}}},
+		{Jobs: []JobConfig{{Name: "a"}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Stdout: "|"}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Health: &daemon.HealthCheck{}}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Health: &daemon.HealthCheck{Command: "true", Restart: true}}}},
+		{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Schedule: "* * *"}}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected %+v to be refused", config.Jobs)
+		}
+	}
+}
+
+func TestUnhealthyRestart(t *testing.T) {
+	// The job exits cleanly when terminated, which its policy alone would
+	// not restart
+	s, err := New(&Config{
+		RuntimeDir:   t.TempDir(),
+		StopTimeout:  2,
+		RestartDelay: 100,
+		Jobs: []JobConfig{{
+			Name:    "wedged",
+			Command: []string{"bash", "-c", "trap 'kill $!; exit 0' TERM; sleep 60 & wait"},
+			Restart: RestartOnFailure,
+			Health:  &daemon.HealthCheck{Command: "false", Interval: 1, Retries: 1, Restart: true},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create supervisor: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor: %v", err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		state, _ := s.Job("wedged")
+		if state.Restarts >= 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the unhealthy job to be restarted, got %+v", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestScheduledJob(t *testing.T) {
+	s, err := New(&Config{
+		RuntimeDir: t.TempDir(),
+		Jobs:       []JobConfig{{Name: "nightly", Command: []string{"true"}, Schedule: "0 0 1 1 *"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create supervisor: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor: %v", err)
+	}
+	defer s.Close()
+
+	state, _ := s.Job("nightly")
+	if state.State != protocol.JobScheduled || state.ScheduledAt == nil || state.ScheduledAt.Month() != time.January || state.PID != 0 {
+		t.Fatalf("Expected the job to be scheduled, got %+v", state)
+	}
+
+	// Stopping the job cancels its run
+	if err := s.StopJob("nightly"); err != nil {
+		t.Fatalf("Failed to stop job: %v", err)
+	}
+	if state, _ := s.Job("nightly"); state.State != protocol.JobStopped {
+		t.Errorf("Expected the job to be stopped, got %+v", state)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().String()
+	ln.Close()
+
+	tmpDir := t.TempDir()
+	order := filepath.Join(tmpDir, "order")
+	appendOrder := func(name string) string { return "echo " + name + " >> " + order }
+	s, err := New(&Config{
+		RuntimeDir: tmpDir,
+		Jobs: []JobConfig{
+			// Listed before what it depends on
+			{Name: "app", Command: []string{"bash", "-c", appendOrder("app") + "; trap '" + appendOrder("app-stop") + "; exit' TERM; sleep 60 >/dev/null 2>&1 & wait"}, After: []string{"db", "migrate"}},
+			{Name: "db", Command: []string{"bash", "-c", "sleep 0.3; " + appendOrder("db") + "; echo listening; trap '" + appendOrder("db-stop") + "; exit' TERM; sleep 60 >/dev/null 2>&1 & wait"}, Ready: &ReadyCheck{Pattern: "^listening$"}},
+			{Name: "migrate", Command: []string{"bash", "-c", "sleep 0.2; " + appendOrder("migrate")}, Ready: &ReadyCheck{Exit: true}, After: []string{"db"}},
+			{Name: "web", Command: []string{"sleep", "60"}, Ready: &ReadyCheck{Port: port, Timeout: 1}},
+			{Name: "proxy", Command: []string{"sleep", "60"}, After: []string{"web"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create supervisor: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor: %v", err)
+	}
+
+	states := make(map[string]protocol.JobState)
+	for _, state := range s.Jobs() {
+		states[state.Name] = state
+	}
+	if state := states["app"]; state.State != protocol.JobRunning || !state.Ready {
+		t.Errorf("Expected app to run, got %+v", state)
+	}
+	if state := states["migrate"]; state.State != protocol.JobExited || !state.Ready {
+		t.Errorf("Expected migrate to be done, got %+v", state)
+	}
+	if state := states["web"]; state.Ready || !strings.Contains(state.Error, "not accepting connections") {
+		t.Errorf("Expected web not to get ready, got %+v", state)
+	}
+	if state := states["proxy"]; state.State != protocol.JobFailed || !strings.Contains(state.Error, "job web is not ready") {
+		t.Errorf("Expected proxy not to start, got %+v", state)
+	}
+
+	s.Close()
+	data, _ := os.ReadFile(order)
+	if got := strings.Fields(string(data)); !slices.Equal(got, []string{"db", "migrate", "app", "app-stop", "db-stop"}) {
+		t.Errorf("Unexpected start and stop order %q", got)
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	_, err := New(&Config{Jobs: []JobConfig{
+		{Name: "a", Command: []string{"true"}, After: []string{"b"}},
+		{Name: "b", Command: []string{"true"}, After: []string{"c"}},
+		{Name: "c", Command: []string{"true"}, After: []string{"a"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("Expected the cycle to be refused, got %v", err)
+	}
+	_, err = New(&Config{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, After: []string{"nope"}}}})
+	if !errors.Is(err, ErrNoSuchJob) {
+		t.Errorf("Expected an unknown dependency to be refused, got %v", err)
+	}
+	_, err = New(&Config{Jobs: []JobConfig{{Name: "a", Command: []string{"true"}, Ready: &ReadyCheck{Exit: true, Port: "localhost:1"}}}})
+	if err == nil {
+		t.Error("Expected a ready check with two conditions to be refused")
+	}
+}
+
+func TestJobPermissions(t *testing.T) {
+	s, err := New(&Config{
+		RuntimeDir: t.TempDir(),
+		Jobs: []JobConfig{
+			{Name: "shared", Command: []string{"true"}, Manual: true, Permissions: daemon.PermObserve},
+			{Name: "private", Command: []string{"true"}, Manual: true, AllowedUIDs: []int{54321}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create supervisor: %v", err)
+	}
+
+	// Without peer credentials, the client is another user
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleClient(conn)
+	control := func(req *protocol.JobRequest) (*protocol.Message, error) {
+		t.Helper()
+		data, _ := json.Marshal(req)
+		if err := protocol.WriteMessage(client, protocol.MsgJobControl, data); err != nil {
+			return nil, err
+		}
+		return protocol.ReadMessage(client)
+	}
+
+	msg, err := control(&protocol.JobRequest{Action: protocol.JobList})
+	var jobs protocol.JobResponse
+	if err != nil || json.Unmarshal(msg.Payload, &jobs) != nil || len(jobs.Jobs) != 1 || jobs.Jobs[0].Name != "shared" {
+		t.Fatalf("Expected only the shared job to be listed, got %+v (%v)", msg, err)
+	}
+	for _, tc := range []struct {
+		req     protocol.JobRequest
+		allowed bool
+	}{
+		{protocol.JobRequest{Action: protocol.JobStatus, Name: "shared"}, true},
+		{protocol.JobRequest{Action: protocol.JobStart, Name: "shared"}, false},
+		{protocol.JobRequest{Action: protocol.JobStop, Name: "shared"}, false},
+		{protocol.JobRequest{Action: protocol.JobStatus, Name: "private"}, false},
+	} {
+		msg, err := control(&tc.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (msg.Type == protocol.MsgJobResponse) != tc.allowed {
+			t.Errorf("Expected %s of %s to be allowed: %v, got %s %q", tc.req.Action, tc.req.Name, tc.allowed, msg.Type.Name(), msg.Payload)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package termemu
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCommands is the number of commands kept in the command history
+const maxCommands = 1000
+
+// ErrNoSuchCommand is returned when a command index is out of range
+var ErrNoSuchCommand = errors.New("no such command")
+
+// Command is a command executed at a shell prompt, delimited by the shell
+// integration marks (OSC 133) that shells such as bash, zsh and fish emit
+// when configured for it:
+//
+//	OSC 133;A  prompt start
+//	OSC 133;B  prompt end, command input start
+//	OSC 133;C  command executed, output start
+//	OSC 133;D[;exit code]  command finished
+type Command struct {
+	Command    string    // Command line typed at the prompt
+	ExitCode   *int      // Exit status reported by the shell, nil if unknown
+	StartedAt  time.Time // When the command was executed (OSC 133;C)
+	FinishedAt time.Time // When the command finished (OSC 133;D), zero while running
+
+	prompt, input, output, end markPosition
+}
+
+// Running reports whether the command has not finished yet
+func (c *Command) Running() bool {
+	return c.FinishedAt.IsZero()
+}
+
+// markPosition is a position in the terminal content. Lines are counted
+// from the first line ever written so positions survive scrolling.
+type markPosition struct {
+	line, col int
+	set       bool
+}
+
+// Commands returns the commands delimited by shell integration marks, oldest
+// first. Prompts that were never executed are not included.
+func (t *Terminal) Commands() []Command {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	commands := make([]Command, 0, len(t.commands))
+	for _, cmd := range t.commands {
+		if cmd.output.set {
+			commands = append(commands, *cmd)
+		}
+	}
+	return commands
+}
+
+// ExportCommand exports the output of a command returned by Commands in the
+// specified format. Negative indexes count from the end, -1 being the last
+// command. The output of a running command is exported up to the cursor.
+// Output that was trimmed from the scrollback is lost.
+func (t *Terminal) ExportCommand(index int, format ExportFormat) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var executed []*Command
+	for _, cmd := range t.commands {
+		if cmd.output.set {
+			executed = append(executed, cmd)
+		}
+	}
+	if index < 0 {
+		index += len(executed)
+	}
+	if index < 0 || index >= len(executed) {
+		return "", ErrNoSuchCommand
+	}
+
+	cmd := executed[index]
+	end := cmd.end
+	if !end.set {
+		end = t.markPosition()
+	}
+	lines := t.linesBetween(cmd.output, end)
+
+	return t.exportLines(lines, ExportOptions{Format: format}), nil
+}
+
+// SetMarkHandler sets the function notified of each shell integration mark
+// (OSC 133) received, with its parameters such as "A" or "D;0". It is called
+// once the Write holding the mark has been processed.
+func (t *Terminal) SetMarkHandler(handler func(mark string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.markHandler = handler
+}
+
+// shellMark handles an OSC 133 shell integration mark
+func (t *Terminal) shellMark(data string) {
+	if t.markHandler != nil {
+		t.marks = append(t.marks, data)
+	}
+
+	params := strings.Split(data, ";")
+	pos := t.markPosition()
+
+	var cmd *Command
+	if len(t.commands) > 0 {
+		cmd = t.commands[len(t.commands)-1]
+	}
+
+	switch params[0] {
+	case "A":
+		// A new prompt ends a command whose shell did not send D
+		if cmd != nil && cmd.output.set && !cmd.end.set {
+			cmd.end = pos
+			cmd.FinishedAt = time.Now()
+		}
+		if cmd != nil && !cmd.output.set {
+			// The previous prompt was never executed, reuse its entry
+			*cmd = Command{}
+		} else {
+			cmd = t.newCommand()
+		}
+		cmd.prompt = pos
+	case "B":
+		if cmd != nil && !cmd.output.set {
+			cmd.input = pos
+		}
+	case "C":
+		if cmd == nil || cmd.output.set {
+			// Output without a prompt, e.g. the shell started mid-command
+			cmd = t.newCommand()
+		}
+		if cmd.input.set {
+			var sb strings.Builder
+			for i, row := range t.linesBetween(cmd.input, pos) {
+				if i > 0 {
+					sb.WriteByte(' ')
+				}
+				sb.WriteString(strings.TrimSpace(t.rowToPlainText(row, false)))
+			}
+			cmd.Command = strings.TrimSpace(sb.String())
+		}
+		cmd.output = pos
+		cmd.StartedAt = time.Now()
+	case "D":
+		if cmd == nil || !cmd.output.set || cmd.end.set {
+			// Command aborted at the prompt (e.g. Ctrl+C), nothing ran
+			return
+		}
+		cmd.end = pos
+		cmd.FinishedAt = time.Now()
+		if len(params) > 1 {
+			if code, err := strconv.Atoi(params[1]); err == nil {
+				cmd.ExitCode = &code
+			}
+		}
+	}
+}
+
+// newCommand appends a command to the history, dropping the oldest one when
+// the history is full
+func (t *Terminal) newCommand() *Command {
+	cmd := &Command{}
+	t.commands = append(t.commands, cmd)
+	if len(t.commands) > maxCommands {
+		t.commands = t.commands[1:]
+	}
+	return cmd
+}
+
+// markPosition returns the cursor position as a mark position
+func (t *Terminal) markPosition() markPosition {
+	col := t.cursorCol
+	if t.wrapPending {
+		col = t.cols
+	}
+	return markPosition{
+		line: t.droppedLines + len(t.scrollback) + t.cursorRow,
+		col:  col,
+		set:  true,
+	}
+}
+
+// linesBetween returns the cells from start up to end (exclusive), the first
+// and last lines being cut at the mark columns. A line ending exactly at
+// column 0 of end is not included.
+func (t *Terminal) linesBetween(start, end markPosition) [][]Cell {
+	first := t.droppedLines
+	last := t.droppedLines + len(t.scrollback) + t.rows - 1
+
+	var lines [][]Cell
+	for line := max(start.line, first); line <= min(end.line, last); line++ {
+		row := t.contentRow(line - t.droppedLines)
+
+		from, to := 0, len(row)
+		if line == start.line {
+			from = min(start.col, len(row))
+		}
+		if line == end.line {
+			if end.col == 0 {
+				break
+			}
+			to = min(end.col, len(row))
+		}
+		if from > to {
+			from = to
+		}
+		lines = append(lines, row[from:to])
+	}
+	return lines
+}
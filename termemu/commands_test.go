@@ -0,0 +1,126 @@
+package termemu
+
+import (
+	"slices"
+	"testing"
+)
+
+// prompt writes a shell prompt with OSC 133 marks and runs line
+func prompt(line string) string {
+	return "\x1b]133;A\x07$ \x1b]133;B\x07" + line + "\r\n\x1b]133;C\x07"
+}
+
+func TestShellIntegrationCommands(t *testing.T) {
+	term := NewTerminal(4, 20)
+
+	term.Write([]byte(prompt("ls")))
+	term.Write([]byte("a.txt\r\nb.txt\r\n\x1b]133;D;0\x07"))
+	term.Write([]byte(prompt("false")))
+	term.Write([]byte("\x1b]133;D;1\x07"))
+
+	// A prompt aborted with Ctrl+C is not a command
+	term.Write([]byte("\x1b]133;A\x07$ \x1b]133;B\x07sle^C\r\n\x1b]133;D\x07"))
+
+	term.Write([]byte(prompt("cat")))
+	term.Write([]byte("partial"))
+
+	commands := term.Commands()
+	if len(commands) != 3 {
+		t.Fatalf("Expected 3 commands, got %d", len(commands))
+	}
+
+	expected := []struct {
+		command  string
+		exitCode int
+		running  bool
+	}{
+		{"ls", 0, false},
+		{"false", 1, false},
+		{"cat", -1, true},
+	}
+	for i, want := range expected {
+		cmd := commands[i]
+		if cmd.Command != want.command {
+			t.Errorf("Command %d: expected %q, got %q", i, want.command, cmd.Command)
+		}
+		if cmd.Running() != want.running {
+			t.Errorf("Command %d: expected running=%v", i, want.running)
+		}
+		if want.exitCode < 0 {
+			if cmd.ExitCode != nil {
+				t.Errorf("Command %d: expected no exit code, got %d", i, *cmd.ExitCode)
+			}
+		} else if cmd.ExitCode == nil || *cmd.ExitCode != want.exitCode {
+			t.Errorf("Command %d: expected exit code %d, got %v", i, want.exitCode, cmd.ExitCode)
+		}
+		if cmd.StartedAt.IsZero() {
+			t.Errorf("Command %d: expected a start time", i)
+		}
+	}
+
+	// The output of ls has scrolled into the scrollback by now
+	tests := []struct {
+		index  int
+		output string
+	}{
+		{0, "a.txt\nb.txt\n"},
+		{1, ""},
+		{-1, "partial\n"},
+	}
+	for _, tt := range tests {
+		output, err := term.ExportCommand(tt.index, FormatPlainText)
+		if err != nil {
+			t.Fatalf("ExportCommand(%d) failed: %v", tt.index, err)
+		}
+		if output != tt.output {
+			t.Errorf("ExportCommand(%d): expected %q, got %q", tt.index, tt.output, output)
+		}
+	}
+
+	if _, err := term.ExportCommand(3, FormatPlainText); err != ErrNoSuchCommand {
+		t.Errorf("Expected ErrNoSuchCommand, got %v", err)
+	}
+}
+
+func TestShellIntegrationWithoutFinishMark(t *testing.T) {
+	term := NewTerminal(10, 20)
+
+	// Shells that only send A and C still delimit commands
+	term.Write([]byte("\x1b]133;A\x07$ make\r\n\x1b]133;C\x07done\r\n"))
+	term.Write([]byte("\x1b]133;A\x07$ "))
+
+	commands := term.Commands()
+	if len(commands) != 1 {
+		t.Fatalf("Expected 1 command, got %d", len(commands))
+	}
+	if commands[0].Running() || commands[0].ExitCode != nil {
+		t.Errorf("Expected a finished command without exit code, got %+v", commands[0])
+	}
+
+	output, err := term.ExportCommand(0, FormatPlainText)
+	if err != nil {
+		t.Fatalf("ExportCommand failed: %v", err)
+	}
+	if output != "done\n" {
+		t.Errorf("Expected %q, got %q", "done\n", output)
+	}
+}
+
+func TestMarkHandler(t *testing.T) {
+	term := NewTerminal(4, 20)
+
+	var marks []string
+	term.SetMarkHandler(func(mark string) {
+		// Called outside the lock, the terminal is usable
+		term.Commands()
+		marks = append(marks, mark)
+	})
+
+	term.Write([]byte(prompt("ls")))
+	term.Write([]byte("a.txt\r\n\x1b]133;D;0\x07"))
+
+	expected := []string{"A", "B", "C", "D;0"}
+	if !slices.Equal(marks, expected) {
+		t.Errorf("Expected marks %q, got %q", expected, marks)
+	}
+}
@@ -0,0 +1,42 @@
+package termemu
+
+// DirtyRow is a screen row that changed, with a copy of its cells
+type DirtyRow struct {
+	Row   int
+	Cells []Cell
+}
+
+// TakeDamage returns the screen rows changed since the previous call, top
+// to bottom, and resets the tracking. Scrolling, clearing the screen and
+// resizing change every row; all rows are dirty after NewTerminal. Cursor
+// moves alone are not damage.
+func (t *Terminal) TakeDamage() []DirtyRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var rows []DirtyRow
+	for i, dirty := range t.dirty {
+		if !dirty {
+			continue
+		}
+		cells := make([]Cell, len(t.screen[i]))
+		copy(cells, t.screen[i])
+		rows = append(rows, DirtyRow{Row: i, Cells: cells})
+		t.dirty[i] = false
+	}
+	return rows
+}
+
+// markDirty records a change of a screen row
+func (t *Terminal) markDirty(row int) {
+	if row >= 0 && row < len(t.dirty) {
+		t.dirty[row] = true
+	}
+}
+
+// markAllDirty records a change of every screen row
+func (t *Terminal) markAllDirty() {
+	for i := range t.dirty {
+		t.dirty[i] = true
+	}
+}
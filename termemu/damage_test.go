@@ -0,0 +1,62 @@
+package termemu
+
+import (
+	"slices"
+	"testing"
+)
+
+// damagedRows returns the row numbers of the damage of term
+func damagedRows(term *Terminal) []int {
+	var rows []int
+	for _, r := range term.TakeDamage() {
+		rows = append(rows, r.Row)
+	}
+	return rows
+}
+
+func TestTakeDamage(t *testing.T) {
+	term := NewTerminal(4, 10)
+
+	// Everything is dirty initially, then nothing
+	if rows := damagedRows(term); !slices.Equal(rows, []int{0, 1, 2, 3}) {
+		t.Errorf("Expected all rows initially, got %v", rows)
+	}
+	if rows := damagedRows(term); len(rows) != 0 {
+		t.Errorf("Expected no damage, got %v", rows)
+	}
+
+	term.Write([]byte("\x1b[2;1Hab\x1b[4;3H\x1b[1;31mc"))
+	damage := term.TakeDamage()
+	if len(damage) != 2 || damage[0].Row != 1 || damage[1].Row != 3 {
+		t.Fatalf("Expected rows 1 and 3, got %+v", damage)
+	}
+	if string(damage[0].Cells[0].Char)+string(damage[0].Cells[1].Char) != "ab" || len(damage[0].Cells) != 10 {
+		t.Errorf("Unexpected cells for row 1: %+v", damage[0].Cells)
+	}
+	if cell := damage[1].Cells[2]; cell.Char != 'c' || !cell.Attr.Bold || cell.Attr.Fg != ColorRed {
+		t.Errorf("Unexpected cell with attributes: %+v", cell)
+	}
+
+	// Cursor moves are not damage
+	term.Write([]byte("\x1b[1;1H\x1b[3C"))
+	if rows := damagedRows(term); len(rows) != 0 {
+		t.Errorf("Expected no damage for cursor moves, got %v", rows)
+	}
+
+	// Erasing part of a line damages it
+	term.Write([]byte("\x1b[2;2H\x1b[K"))
+	if rows := damagedRows(term); !slices.Equal(rows, []int{1}) {
+		t.Errorf("Expected row 1 after erase, got %v", rows)
+	}
+
+	// Scrolling moves every row
+	term.Write([]byte("\x1b[4;1H\n"))
+	if rows := damagedRows(term); len(rows) != 4 {
+		t.Errorf("Expected all rows after scrolling, got %v", rows)
+	}
+
+	term.Resize(2, 10)
+	if rows := damagedRows(term); !slices.Equal(rows, []int{0, 1}) {
+		t.Errorf("Expected all rows after resize, got %v", rows)
+	}
+}
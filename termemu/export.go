@@ -1,7 +1,10 @@
 package termemu
 
 import (
+	"encoding/json"
+	"fmt"
 	"html"
+	"strconv"
 	"strings"
 )
 
@@ -15,6 +18,14 @@ const (
 	FormatMarkdown
 	// FormatHTML exports as HTML with hyperlinks and styling
 	FormatHTML
+	// FormatANSI exports as text with SGR and OSC 8 escape sequences, to be
+	// displayed in a terminal
+	FormatANSI
+	// FormatSVG exports as an SVG image of the terminal
+	FormatSVG
+	// FormatJSON exports as a JSONExport object, the lines being runs of
+	// cells sharing the same attributes
+	FormatJSON
 )
 
 // ExportOptions configures the export behavior
@@ -46,7 +57,11 @@ func (t *Terminal) Export(opts ExportOptions) string {
 	// Determine which lines to export
 	lines := t.getLinesForExport(opts)
 
-	// Export based on format
+	return t.exportLines(lines, opts)
+}
+
+// exportLines formats lines according to opts.Format
+func (t *Terminal) exportLines(lines [][]Cell, opts ExportOptions) string {
 	switch opts.Format {
 	case FormatPlainText:
 		return t.exportPlainText(lines, opts)
@@ -54,6 +69,12 @@ func (t *Terminal) Export(opts ExportOptions) string {
 		return t.exportMarkdown(lines, opts)
 	case FormatHTML:
 		return t.exportHTML(lines, opts)
+	case FormatANSI:
+		return t.exportANSI(lines, opts)
+	case FormatSVG:
+		return t.exportSVG(lines, opts)
+	case FormatJSON:
+		return t.exportJSON(lines, opts)
 	default:
 		return t.exportPlainText(lines, opts)
 	}
@@ -61,19 +82,15 @@ func (t *Terminal) Export(opts ExportOptions) string {
 
 // getLinesForExport extracts the lines to be exported based on options
 func (t *Terminal) getLinesForExport(opts ExportOptions) [][]Cell {
-	var allLines [][]Cell
-
+	// Lines are numbered from the top of the scrollback when it is included,
+	// of the screen otherwise
+	offset := len(t.scrollback)
 	if opts.IncludeScrollback {
-		// Include scrollback buffer
-		allLines = make([][]Cell, 0, len(t.scrollback)+len(t.screen))
-		allLines = append(allLines, t.scrollback...)
-		allLines = append(allLines, t.screen...)
-	} else {
-		// Only current screen
-		allLines = t.screen
+		offset = 0
 	}
+	total := len(t.scrollback) + len(t.screen) - offset
 
-	if len(allLines) == 0 {
+	if total == 0 {
 		return [][]Cell{}
 	}
 
@@ -87,16 +104,21 @@ func (t *Terminal) getLinesForExport(opts ExportOptions) [][]Cell {
 	}
 
 	// Handle negative/unset end (use all remaining lines)
-	if endIdx < 0 || endIdx >= len(allLines) {
-		endIdx = len(allLines) - 1
+	if endIdx < 0 || endIdx >= total {
+		endIdx = total - 1
 	}
 
 	// Validate range
-	if startIdx > endIdx || startIdx >= len(allLines) {
+	if startIdx > endIdx || startIdx >= total {
 		return [][]Cell{}
 	}
 
-	return allLines[startIdx : endIdx+1]
+	// Scrollback lines are only expanded to cells when exported
+	lines := make([][]Cell, 0, endIdx+1-startIdx)
+	for i := startIdx; i <= endIdx; i++ {
+		lines = append(lines, t.contentRow(offset+i))
+	}
+	return lines
 }
 
 // exportPlainText exports as plain text
@@ -336,6 +358,323 @@ func (t *Terminal) rowToHTML(row []Cell, preserveTrailing bool) string {
 	return str
 }
 
+// exportANSI exports as text with escape sequences reproducing the colors,
+// attributes and hyperlinks when written to a terminal
+func (t *Terminal) exportANSI(lines [][]Cell, opts ExportOptions) string {
+	var sb strings.Builder
+
+	for _, row := range lines {
+		sb.WriteString(t.rowToANSI(row, opts.PreserveTrailingSpaces))
+		sb.WriteByte('\n')
+	}
+
+	return sb.String()
+}
+
+// rowToANSI converts a row of cells to text with SGR and OSC 8 sequences.
+// Every line starts and ends with default attributes and no open link, so
+// that lines can be displayed on their own.
+func (t *Terminal) rowToANSI(row []Cell, preserveTrailing bool) string {
+	end := len(row)
+	if !preserveTrailing {
+		// Trailing blanks only matter when they show a background
+		for end > 0 {
+			cell := row[end-1]
+			if cell.Char != 0 && (cell.Char != ' ' || cell.Attr.Bg != ColorDefault || cell.Attr.Reverse || cell.HyperlinkURL != "") {
+				break
+			}
+			end--
+		}
+	}
+
+	var sb strings.Builder
+	defaultAttr := Attributes{Fg: ColorDefault, Bg: ColorDefault}
+	attr := defaultAttr
+	url, linkID := "", ""
+
+	for _, cell := range row[:end] {
+		if cell.Char == 0 {
+			// Never written, shown as a blank with the default attributes
+			cell = Cell{Char: ' ', Attr: defaultAttr}
+		}
+		if cell.HyperlinkURL != url || cell.HyperlinkID != linkID {
+			url, linkID = cell.HyperlinkURL, cell.HyperlinkID
+			sb.WriteString("\x1b]8;")
+			if url != "" && linkID != "" {
+				sb.WriteString("id=" + linkID)
+			}
+			sb.WriteString(";" + url + "\x1b\\")
+		}
+		if cell.Attr != attr {
+			attr = cell.Attr
+			sb.WriteString(attributesToSGR(attr))
+		}
+		sb.WriteRune(cell.Char)
+	}
+
+	if url != "" {
+		sb.WriteString("\x1b]8;;\x1b\\")
+	}
+	if attr != defaultAttr {
+		sb.WriteString("\x1b[0m")
+	}
+	return sb.String()
+}
+
+// attributesToSGR returns the SGR sequence that resets the attributes and
+// sets attr
+func attributesToSGR(attr Attributes) string {
+	params := []string{"0"}
+
+	flags := []struct {
+		set  bool
+		code string
+	}{
+		{attr.Bold, "1"},
+		{attr.Dim, "2"},
+		{attr.Italic, "3"},
+		{attr.Underline, "4"},
+		{attr.Blink, "5"},
+		{attr.Reverse, "7"},
+		{attr.Hidden, "8"},
+		{attr.Strike, "9"},
+	}
+	for _, flag := range flags {
+		if flag.set {
+			params = append(params, flag.code)
+		}
+	}
+
+	if attr.Fg != ColorDefault {
+		params = append(params, colorToSGR(attr.Fg, 30, 90, 38))
+	}
+	if attr.Bg != ColorDefault {
+		params = append(params, colorToSGR(attr.Bg, 40, 100, 48))
+	}
+
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+// colorToSGR returns the SGR parameters selecting c, given the base codes of
+// the standard, bright and extended colors of the plane (foreground or
+// background)
+func colorToSGR(c Color, base, bright, extended int) string {
+	switch {
+	case c < 8:
+		return strconv.Itoa(base + int(c))
+	case c < 16:
+		return strconv.Itoa(bright + int(c) - 8)
+	default:
+		return strconv.Itoa(extended) + ";5;" + strconv.Itoa(int(c))
+	}
+}
+
+// span is a run of cells of a row sharing the same attributes and hyperlink
+type span struct {
+	col  int // column of the first cell
+	text string
+	attr Attributes
+	url  string
+}
+
+// rowToSpans splits a row into spans. Cells never written are blanks with
+// the default attributes; trailing blanks are dropped unless preserveTrailing
+// is set or they show a background.
+func rowToSpans(row []Cell, preserveTrailing bool) []span {
+	blank := Cell{Char: ' ', Attr: Attributes{Fg: ColorDefault, Bg: ColorDefault}}
+	cells := make([]Cell, len(row))
+	for i, cell := range row {
+		if cell.Char == 0 {
+			cell = blank
+		}
+		cells[i] = cell
+	}
+
+	end := len(cells)
+	for !preserveTrailing && end > 0 {
+		cell := cells[end-1]
+		if cell.Char != ' ' || cell.Attr.Bg != ColorDefault || cell.Attr.Reverse || cell.HyperlinkURL != "" {
+			break
+		}
+		end--
+	}
+
+	var spans []span
+	for i := 0; i < end; {
+		s := span{col: i, attr: cells[i].Attr, url: cells[i].HyperlinkURL}
+		var text []rune
+		for ; i < end && cells[i].Attr == s.attr && cells[i].HyperlinkURL == s.url; i++ {
+			text = append(text, cells[i].Char)
+		}
+		s.text = string(text)
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+// JSONExport is the document produced by FormatJSON
+type JSONExport struct {
+	Cols  int        `json:"cols"`
+	Lines []JSONLine `json:"lines"`
+}
+
+// JSONLine is an exported line. Cells after the last span are blank.
+type JSONLine struct {
+	Spans []JSONSpan `json:"spans"`
+}
+
+// JSONSpan is a run of cells with the same attributes. Colors are -1 for the
+// default color, 0-255 otherwise.
+type JSONSpan struct {
+	Text      string `json:"text"`
+	Fg        int    `json:"fg"`
+	Bg        int    `json:"bg"`
+	Bold      bool   `json:"bold,omitempty"`
+	Dim       bool   `json:"dim,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Blink     bool   `json:"blink,omitempty"`
+	Reverse   bool   `json:"reverse,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"`
+	Strike    bool   `json:"strike,omitempty"`
+	Link      string `json:"link,omitempty"` // OSC 8 hyperlink URL
+}
+
+// exportJSON exports as a JSONExport document
+func (t *Terminal) exportJSON(lines [][]Cell, opts ExportOptions) string {
+	doc := JSONExport{Cols: t.cols, Lines: make([]JSONLine, len(lines))}
+	for i, row := range lines {
+		doc.Lines[i].Spans = []JSONSpan{}
+		for _, s := range rowToSpans(row, opts.PreserveTrailingSpaces) {
+			doc.Lines[i].Spans = append(doc.Lines[i].Spans, JSONSpan{
+				Text:      s.text,
+				Fg:        int(s.attr.Fg),
+				Bg:        int(s.attr.Bg),
+				Bold:      s.attr.Bold,
+				Dim:       s.attr.Dim,
+				Italic:    s.attr.Italic,
+				Underline: s.attr.Underline,
+				Blink:     s.attr.Blink,
+				Reverse:   s.attr.Reverse,
+				Hidden:    s.attr.Hidden,
+				Strike:    s.attr.Strike,
+				Link:      s.url,
+			})
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		// Only strings and numbers, this cannot happen
+		return ""
+	}
+	return string(data) + "\n"
+}
+
+// Geometry of the SVG export, for a 14px monospace font
+const (
+	svgCellWidth  = 8.4
+	svgLineHeight = 17
+	svgPadding    = 10
+)
+
+// exportSVG exports as an SVG image drawn like the HTML export: light text
+// on a black background. Each span is placed at the column of its first
+// cell, so the layout does not depend on the width of the font.
+func (t *Terminal) exportSVG(lines [][]Cell, opts ExportOptions) string {
+	cols := t.cols
+	for _, row := range lines {
+		cols = max(cols, len(row))
+	}
+	width := float64(cols)*svgCellWidth + 2*svgPadding
+	height := len(lines)*svgLineHeight + 2*svgPadding
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%s\" height=\"%d\" viewBox=\"0 0 %s %d\">\n", svgNumber(width), height, svgNumber(width), height)
+	sb.WriteString("<rect width=\"100%\" height=\"100%\" fill=\"#000\"/>\n")
+	sb.WriteString("<g font-family=\"monospace\" font-size=\"14\" fill=\"#fff\" xml:space=\"preserve\">\n")
+
+	for i, row := range lines {
+		y := svgPadding + i*svgLineHeight
+		for _, s := range rowToSpans(row, opts.PreserveTrailingSpaces) {
+			x := svgPadding + float64(s.col)*svgCellWidth
+			fg, bg := svgColors(s.attr)
+			if bg != "" {
+				fmt.Fprintf(&sb, "<rect x=\"%s\" y=\"%d\" width=\"%s\" height=\"%d\" fill=\"%s\"/>\n",
+					svgNumber(x), y, svgNumber(float64(len([]rune(s.text)))*svgCellWidth), svgLineHeight, bg)
+			}
+			if s.attr.Hidden || strings.TrimSpace(s.text) == "" {
+				continue
+			}
+
+			if s.url != "" {
+				fmt.Fprintf(&sb, "<a href=\"%s\">", html.EscapeString(s.url))
+			}
+			// The baseline sits about a quarter of the line above its bottom
+			fmt.Fprintf(&sb, "<text x=\"%s\" y=\"%d\"%s>%s</text>", svgNumber(x), y+svgLineHeight-4, svgTextAttributes(s, fg), html.EscapeString(s.text))
+			if s.url != "" {
+				sb.WriteString("</a>")
+			}
+			sb.WriteByte('\n')
+		}
+	}
+
+	sb.WriteString("</g>\n</svg>\n")
+	return sb.String()
+}
+
+// svgNumber formats a coordinate, rounded to hide floating point noise
+func svgNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 32)
+}
+
+// svgColors returns the text and background colors of attr, empty for the
+// defaults of the image
+func svgColors(attr Attributes) (fg, bg string) {
+	if !attr.Reverse {
+		return colorToCSS(attr.Fg, false), colorToCSS(attr.Bg, true)
+	}
+	fg, bg = colorToCSS(attr.Bg, true), colorToCSS(attr.Fg, false)
+	if fg == "" {
+		fg = "#000"
+	}
+	if bg == "" {
+		bg = "#fff"
+	}
+	return fg, bg
+}
+
+// svgTextAttributes returns the presentation attributes of a span's text
+func svgTextAttributes(s span, fg string) string {
+	var sb strings.Builder
+	if fg != "" {
+		fmt.Fprintf(&sb, " fill=\"%s\"", fg)
+	} else if s.url != "" {
+		sb.WriteString(" fill=\"#4af\"")
+	}
+	if s.attr.Bold {
+		sb.WriteString(" font-weight=\"bold\"")
+	}
+	if s.attr.Italic {
+		sb.WriteString(" font-style=\"italic\"")
+	}
+	if s.attr.Dim {
+		sb.WriteString(" opacity=\"0.5\"")
+	}
+
+	var decorations []string
+	if s.attr.Underline || s.url != "" {
+		decorations = append(decorations, "underline")
+	}
+	if s.attr.Strike {
+		decorations = append(decorations, "line-through")
+	}
+	if len(decorations) > 0 {
+		fmt.Fprintf(&sb, " text-decoration=\"%s\"", strings.Join(decorations, " "))
+	}
+	return sb.String()
+}
+
 // attributesToCSS converts terminal attributes to CSS style string
 func attributesToCSS(attr Attributes) string {
 	var styles []string
@@ -1,6 +1,8 @@
 package termemu
 
 import (
+	"encoding/json"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -180,6 +182,83 @@ func TestExportHTMLEscaping(t *testing.T) {
 	}
 }
 
+func TestExportJSON(t *testing.T) {
+	term := NewTerminal(3, 20)
+	term.Write([]byte("\x1b[1;31mred\x1b[0m \x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\\r\n\r\n\x1b[44m  \x1b[0m"))
+
+	var doc JSONExport
+	if err := json.Unmarshal([]byte(term.ExportCurrentScreen(FormatJSON)), &doc); err != nil {
+		t.Fatalf("Failed to parse JSON export: %v", err)
+	}
+
+	expected := JSONExport{
+		Cols: 20,
+		Lines: []JSONLine{
+			{Spans: []JSONSpan{
+				{Text: "red", Fg: 1, Bg: -1, Bold: true},
+				{Text: " ", Fg: -1, Bg: -1},
+				{Text: "link", Fg: -1, Bg: -1, Link: "https://example.com"},
+			}},
+			{Spans: []JSONSpan{}},
+			{Spans: []JSONSpan{{Text: "  ", Fg: -1, Bg: 4}}},
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, doc)
+	}
+
+	// Trailing blanks are kept on request
+	output := term.Export(ExportOptions{Format: FormatJSON, EndLine: 1, PreserveTrailingSpaces: true})
+	if err := json.Unmarshal([]byte(output), &doc); err != nil {
+		t.Fatalf("Failed to parse JSON export: %v", err)
+	}
+	if len(doc.Lines) != 2 || len(doc.Lines[1].Spans) != 1 || doc.Lines[1].Spans[0].Text != strings.Repeat(" ", 20) {
+		t.Errorf("Expected full width lines, got %+v", doc.Lines)
+	}
+}
+
+func TestExportSVG(t *testing.T) {
+	term := NewTerminal(2, 10)
+	term.Write([]byte("a<b \x1b[1;31mred\x1b[0m\r\n\x1b[7mrev\x1b[0m \x1b]8;;https://example.com?a=1&b=2\x1b\\x\x1b]8;;\x1b\\"))
+
+	output := term.ExportCurrentScreen(FormatSVG)
+
+	for _, want := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="104" height="54" viewBox="0 0 104 54">`,
+		`<text x="10" y="23">a&lt;b </text>`,
+		`<text x="43.6" y="23" fill="#aa0000" font-weight="bold">red</text>`,
+		`<rect x="10" y="27" width="25.2" height="17" fill="#fff"/>`,
+		`<text x="10" y="40" fill="#000">rev</text>`,
+		`<a href="https://example.com?a=1&amp;b=2"><text x="43.6" y="40" fill="#4af" text-decoration="underline">x</text></a>`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %s in:\n%s", want, output)
+		}
+	}
+}
+
+func TestExportANSI(t *testing.T) {
+	term := NewTerminal(3, 40)
+	term.Write([]byte("\x1b[1;31mred\x1b[0m plain \x1b[38;5;208;44mext\x1b[0m\r\n"))
+	term.Write([]byte("\x1b]8;id=a;https://example.com\x1b\\\x1b[4mLink\x1b]8;;\x1b\\\x1b[0m  \r\n"))
+	term.Write([]byte("\x1b[42m  \x1b[0m"))
+
+	output := term.ExportCurrentScreen(FormatANSI)
+	expected := "\x1b[0;1;31mred\x1b[0m plain \x1b[0;38;5;208;44mext\x1b[0m\n" +
+		"\x1b]8;id=a;https://example.com\x1b\\\x1b[0;4mLink\x1b]8;;\x1b\\\x1b[0m\n" +
+		"\x1b[0;42m  \x1b[0m\n"
+	if output != expected {
+		t.Errorf("Expected %q, got %q", expected, output)
+	}
+
+	// Writing the export to a terminal reproduces the same screen
+	replay := NewTerminal(3, 40)
+	replay.Write([]byte(strings.ReplaceAll(strings.TrimSuffix(output, "\n"), "\n", "\r\n")))
+	if again := replay.ExportCurrentScreen(FormatANSI); again != output {
+		t.Errorf("Replayed export differs: %q", again)
+	}
+}
+
 func TestExportWithScrollback(t *testing.T) {
 	term := NewTerminal(3, 80)
 
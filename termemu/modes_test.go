@@ -0,0 +1,33 @@
+package termemu
+
+import "testing"
+
+func TestInputModes(t *testing.T) {
+	term := NewTerminal(5, 20)
+
+	if modes := term.InputModes(); modes != (InputModes{}) {
+		t.Errorf("Expected no input mode initially, got %+v", modes)
+	}
+
+	term.Write([]byte("\x1b[?2004h\x1b[?1h\x1b="))
+	expected := InputModes{BracketedPaste: true, ApplicationCursor: true, ApplicationKeypad: true}
+	if modes := term.InputModes(); modes != expected {
+		t.Errorf("Expected %+v, got %+v", expected, modes)
+	}
+
+	// Several modes in one sequence
+	term.Write([]byte("\x1b[?1;2004l\x1b>"))
+	if modes := term.InputModes(); modes != (InputModes{}) {
+		t.Errorf("Expected modes to be reset, got %+v", modes)
+	}
+
+	// DECSTR resets the keys modes but not bracketed paste, RIS resets all
+	term.Write([]byte("\x1b[?2004h\x1b[?1h\x1b=\x1b[!p"))
+	if modes := term.InputModes(); modes != (InputModes{BracketedPaste: true}) {
+		t.Errorf("Expected only bracketed paste after DECSTR, got %+v", modes)
+	}
+	term.Write([]byte("\x1bc"))
+	if modes := term.InputModes(); modes != (InputModes{}) {
+		t.Errorf("Expected no input mode after RIS, got %+v", modes)
+	}
+}
@@ -1,15 +1,18 @@
 package termemu
 
 import (
+	"bytes"
+	"fmt"
 	"strconv"
 	"strings"
 )
 
 // vt100Parser handles VT100/ANSI escape sequence parsing
 type vt100Parser struct {
-	term  *Terminal
-	state parserState
-	buf   []byte
+	term   *Terminal
+	state  parserState
+	buf    []byte
+	params []int // Parameters of the sequence being executed
 }
 
 type parserState int
@@ -18,8 +21,9 @@ const (
 	stateNormal parserState = iota
 	stateEscape
 	stateCSI
-	stateOSC        // Operating System Command
-	stateOSCEscape  // After ESC in OSC (expecting \)
+	stateOSC       // Operating System Command
+	stateOSCEscape // After ESC in OSC (expecting \)
+	stateEscapeIntermediate
 )
 
 func newVT100Parser(term *Terminal) *vt100Parser {
@@ -31,12 +35,36 @@ func newVT100Parser(term *Terminal) *vt100Parser {
 }
 
 func (p *vt100Parser) parse(data []byte) {
-	for _, b := range data {
-		p.processByte(b)
+	for i := 0; i < len(data); {
+		// Plain text is written as a whole run rather than byte by byte
+		if p.state == stateNormal {
+			end := i
+			for end < len(data) && isPrintable(data[end]) {
+				end++
+			}
+			if end > i {
+				p.term.putText(data[i:end])
+				i = end
+				continue
+			}
+		}
+		p.processByte(data[i])
+		i++
 	}
 }
 
+// isPrintable reports whether a byte is a character written to the screen
+func isPrintable(b byte) bool {
+	return b >= 32 && b < 127 || b >= 160
+}
+
 func (p *vt100Parser) processByte(b byte) {
+	// CAN and SUB abort any sequence in progress
+	if (b == '\x18' || b == '\x1a') && p.state != stateNormal {
+		p.state = stateNormal
+		return
+	}
+
 	switch p.state {
 	case stateNormal:
 		p.processNormal(b)
@@ -48,6 +76,8 @@ func (p *vt100Parser) processByte(b byte) {
 		p.processOSC(b)
 	case stateOSCEscape:
 		p.processOSCEscape(b)
+	case stateEscapeIntermediate:
+		p.processEscapeIntermediate(b)
 	}
 }
 
@@ -63,13 +93,10 @@ func (p *vt100Parser) processNormal(b byte) {
 	case '\b': // Backspace
 		p.term.backspace()
 	case '\t': // Tab
-		// Move to next tab stop (every 8 columns)
-		nextTab := ((p.term.cursorCol / 8) + 1) * 8
-		if nextTab < p.term.cols {
-			p.term.cursorCol = nextTab
-		}
+		// Move to next tab stop
+		p.term.tabForward(1)
 	default:
-		if b >= 32 && b < 127 || b >= 160 { // Printable characters
+		if isPrintable(b) {
 			p.term.putChar(rune(b))
 		}
 	}
@@ -83,23 +110,64 @@ func (p *vt100Parser) processEscape(b byte) {
 	case ']': // OSC - Operating System Command
 		p.state = stateOSC
 		p.buf = p.buf[:0]
+	case 'H': // Set tab stop at cursor (HTS)
+		p.term.setTabStop()
+		p.state = stateNormal
 	case 'M': // Reverse index (move up with scroll)
+		p.term.wrapPending = false
 		if p.term.cursorRow > 0 {
 			p.term.cursorRow--
+		} else {
+			// TODO: scroll down
+			p.term.unsupportedSequence("ESC M")
 		}
 		p.state = stateNormal
 	case '7': // Save cursor position (DECSC)
 		// TODO: implement cursor save
+		p.term.unsupportedSequence("ESC 7")
 		p.state = stateNormal
 	case '8': // Restore cursor position (DECRC)
 		// TODO: implement cursor restore
+		p.term.unsupportedSequence("ESC 8")
+		p.state = stateNormal
+	case 'c': // Full reset (RIS)
+		p.term.fullReset()
+		p.state = stateNormal
+	case '=': // Application keypad (DECKPAM)
+		p.term.inputModes.ApplicationKeypad = true
+		p.state = stateNormal
+	case '>': // Normal keypad (DECKPNM)
+		p.term.inputModes.ApplicationKeypad = false
 		p.state = stateNormal
 	default:
+		if b >= 0x20 && b <= 0x2f {
+			// Intermediate byte, e.g. character set designation
+			p.buf = append(p.buf, b)
+			p.state = stateEscapeIntermediate
+			return
+		}
 		// Unknown escape sequence, back to normal
+		p.term.unsupportedSequence("ESC " + string(rune(b)))
 		p.state = stateNormal
 	}
 }
 
+// processEscapeIntermediate handles ESC sequences with intermediate bytes,
+// such as ESC ( B
+func (p *vt100Parser) processEscapeIntermediate(b byte) {
+	if b >= 0x20 && b <= 0x2f {
+		p.buf = append(p.buf, b)
+		return
+	}
+	p.state = stateNormal
+
+	// Designating US ASCII to G0-G3 is what the emulator always uses
+	if len(p.buf) == 1 && strings.IndexByte("()*+", p.buf[0]) >= 0 && b == 'B' {
+		return
+	}
+	p.term.unsupportedSequence("ESC " + string(p.buf) + string(rune(b)))
+}
+
 func (p *vt100Parser) processCSI(b byte) {
 	// CSI sequences end with a letter (A-Z, a-z) or @, `, ~
 	if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || b == '@' || b == '`' || b == '~' {
@@ -108,15 +176,23 @@ func (p *vt100Parser) processCSI(b byte) {
 		return
 	}
 
+	// ESC aborts the sequence and starts a new one
+	if b == '\x1b' {
+		p.state = stateEscape
+		p.buf = p.buf[:0]
+		return
+	}
+
 	// Accumulate parameters
 	p.buf = append(p.buf, b)
 }
 
 func (p *vt100Parser) executeCSI(cmd byte) {
-	params := p.parseParams(string(p.buf))
+	params := p.parseParams(p.buf)
 
 	switch cmd {
 	case 'A': // Cursor up
+		p.term.wrapPending = false
 		n := 1
 		if len(params) > 0 {
 			n = params[0]
@@ -127,6 +203,7 @@ func (p *vt100Parser) executeCSI(cmd byte) {
 		}
 
 	case 'B': // Cursor down
+		p.term.wrapPending = false
 		n := 1
 		if len(params) > 0 {
 			n = params[0]
@@ -137,6 +214,7 @@ func (p *vt100Parser) executeCSI(cmd byte) {
 		}
 
 	case 'C': // Cursor forward
+		p.term.wrapPending = false
 		n := 1
 		if len(params) > 0 {
 			n = params[0]
@@ -147,6 +225,7 @@ func (p *vt100Parser) executeCSI(cmd byte) {
 		}
 
 	case 'D': // Cursor back
+		p.term.wrapPending = false
 		n := 1
 		if len(params) > 0 {
 			n = params[0]
@@ -176,9 +255,13 @@ func (p *vt100Parser) executeCSI(cmd byte) {
 		switch mode {
 		case 0: // Clear from cursor to end of screen
 			// TODO: implement partial clear
+			if p.term.cursorRow != 0 || p.term.cursorCol != 0 {
+				p.term.unsupportedSequence("CSI 0J")
+			}
 			p.term.clearScreen()
 		case 1: // Clear from cursor to beginning of screen
 			// TODO: implement partial clear
+			p.term.unsupportedSequence("CSI 1J")
 		case 2: // Clear entire screen
 			p.term.clearScreen()
 		}
@@ -193,45 +276,214 @@ func (p *vt100Parser) executeCSI(cmd byte) {
 			for i := p.term.cursorCol; i < p.term.cols; i++ {
 				p.term.screen[p.term.cursorRow][i] = Cell{}
 			}
+			p.term.markDirty(p.term.cursorRow)
 		case 1: // Clear from cursor to beginning of line
 			for i := 0; i <= p.term.cursorCol && i < p.term.cols; i++ {
 				p.term.screen[p.term.cursorRow][i] = Cell{}
 			}
+			p.term.markDirty(p.term.cursorRow)
 		case 2: // Clear entire line
 			p.term.clearLine()
 		}
 
+	case 'I': // Cursor forward tabulation (CHT)
+		n := 1
+		if len(params) > 0 && params[0] > 0 {
+			n = params[0]
+		}
+		p.term.tabForward(n)
+
+	case 'Z': // Cursor backward tabulation (CBT)
+		n := 1
+		if len(params) > 0 && params[0] > 0 {
+			n = params[0]
+		}
+		p.term.tabBackward(n)
+
+	case 'g': // Tab clear (TBC)
+		mode := 0
+		if len(params) > 0 {
+			mode = params[0]
+		}
+		switch mode {
+		case 0: // Clear tab stop at cursor
+			p.term.clearTabStop()
+		case 3: // Clear all tab stops
+			p.term.clearAllTabStops()
+		}
+
+	case 'n': // Device status report (DSR)
+		p.deviceStatusReport(params)
+
+	case 'c': // Device attributes (DA)
+		p.deviceAttributes()
+
+	case 't': // Window manipulation
+		if len(params) > 0 && params[0] == 18 && !p.hasPrefix() {
+			// Report text area size in characters
+			p.term.respond(fmt.Sprintf("\x1b[8;%d;%dt", p.term.rows, p.term.cols))
+		}
+
 	case 'm': // SGR - Select Graphic Rendition (colors, bold, etc.)
 		p.processSGR(params)
 
 	case 'r': // Set scrolling region
 		// TODO: implement scrolling regions
+		if len(params) > 0 && !(params[0] <= 1 && (len(params) < 2 || params[1] == 0 || params[1] >= p.term.rows)) {
+			p.term.unsupportedSequence("CSI r")
+		}
+
+	case 'p':
+		if string(p.buf) == "!" { // Soft terminal reset (DECSTR)
+			p.term.softReset()
+		} else {
+			p.term.unsupportedSequence(p.csiName(cmd))
+		}
 
 	case 'l', 'h': // Reset/Set mode
-		// TODO: implement mode settings
+		p.setMode(cmd == 'h')
+
+	case 'q': // Cursor style (DECSCUSR) and others, no effect on the screen
 
 	default:
 		// Unknown CSI command, ignore
+		p.term.unsupportedSequence(p.csiName(cmd))
+	}
+}
+
+// hasPrefix reports whether the sequence has a private parameter prefix
+// (one of < = > ?)
+func (p *vt100Parser) hasPrefix() bool {
+	return len(p.buf) > 0 && p.buf[0] >= '<' && p.buf[0] <= '?'
+}
+
+// deviceStatusReport answers DSR queries
+func (p *vt100Parser) deviceStatusReport(params []int) {
+	private := len(p.buf) > 0 && p.buf[0] == '?'
+	if private {
+		params = p.parseParams(p.buf[1:])
+	} else if p.hasPrefix() {
+		return
+	}
+	if len(params) == 0 {
+		return
+	}
+
+	switch params[0] {
+	case 5: // Operating status: no malfunction
+		if !private {
+			p.term.respond("\x1b[0n")
+		}
+	case 6: // Cursor position report (CPR), 1-indexed
+		row, col := p.term.cursorRow+1, p.term.cursorCol+1
+		if col > p.term.cols {
+			col = p.term.cols
+		}
+		if private {
+			p.term.respond(fmt.Sprintf("\x1b[?%d;%dR", row, col))
+		} else {
+			p.term.respond(fmt.Sprintf("\x1b[%d;%dR", row, col))
+		}
+	}
+}
+
+// deviceAttributes answers primary (CSI c) and secondary (CSI > c) DA queries
+func (p *vt100Parser) deviceAttributes() {
+	switch {
+	case len(p.buf) > 0 && p.buf[0] == '>':
+		// VT100, firmware version 0, no ROM cartridge
+		p.term.respond("\x1b[>0;0;0c")
+	case p.hasPrefix():
+		// Tertiary DA and others are not supported
+	default:
+		params := p.parseParams(p.buf)
+		if len(params) == 0 || params[0] == 0 {
+			// VT100 with Advanced Video Option
+			p.term.respond("\x1b[?1;2c")
+		}
+	}
+}
+
+// setMode handles SM/RM and the DEC private (CSI ?) variants
+func (p *vt100Parser) setMode(enabled bool) {
+	if len(p.buf) == 0 || p.buf[0] != '?' {
+		// ANSI modes are not implemented
+		if enabled {
+			for _, mode := range p.parseParams(p.buf) {
+				p.term.unsupportedSequence(fmt.Sprintf("CSI %dh", mode))
+			}
+		}
+		return
+	}
+
+	for _, mode := range p.parseParams(p.buf[1:]) {
+		switch mode {
+		case 1: // Application cursor keys (DECCKM)
+			p.term.inputModes.ApplicationCursor = enabled
+		case 7: // Auto-wrap mode (DECAWM)
+			p.term.setAutoWrap(enabled)
+		case 2004: // Bracketed paste
+			p.term.inputModes.BracketedPaste = enabled
+		case 12, 25, 1000, 1002, 1003, 1004, 1005, 1006, 1015:
+			// Cursor blinking and visibility, mouse and focus reporting
+			// do not change the screen content
+		default:
+			// Disabling a mode leaves the emulator in the default state it
+			// assumes anyway
+			if enabled {
+				p.term.unsupportedSequence(fmt.Sprintf("CSI ?%dh", mode))
+			}
+		}
 	}
 }
 
-func (p *vt100Parser) parseParams(s string) []int {
-	if s == "" {
-		return nil
+// csiName names the CSI sequence being executed for the unsupported
+// sequence counters, keeping its prefix and intermediates but not its
+// numeric parameters
+func (p *vt100Parser) csiName(cmd byte) string {
+	name := []byte("CSI ")
+	for _, b := range p.buf {
+		if (b >= '<' && b <= '?') || (b >= 0x20 && b <= 0x2f) {
+			name = append(name, b)
+		}
 	}
+	return string(append(name, cmd))
+}
 
-	parts := strings.Split(s, ";")
-	params := make([]int, 0, len(parts))
-	for _, part := range parts {
-		if part == "" {
-			continue
+// parseParams parses the numeric parameters of a sequence. The returned
+// slice is reused by the next call.
+func (p *vt100Parser) parseParams(s []byte) []int {
+	p.params = p.params[:0]
+	for len(s) > 0 {
+		part := s
+		if i := bytes.IndexByte(s, ';'); i >= 0 {
+			part, s = s[:i], s[i+1:]
+		} else {
+			s = nil
+		}
+		if n, ok := parseDigits(part); ok {
+			p.params = append(p.params, n)
+		} else if n, err := strconv.Atoi(string(part)); err == nil {
+			p.params = append(p.params, n)
 		}
-		n, err := strconv.Atoi(part)
-		if err == nil {
-			params = append(params, n)
+	}
+	return p.params
+}
+
+// parseDigits parses a parameter made of a few decimal digits, the common
+// case, without allocating
+func parseDigits(s []byte) (int, bool) {
+	if len(s) == 0 || len(s) > 9 {
+		return 0, false
+	}
+	n := 0
+	for _, b := range s {
+		if b < '0' || b > '9' {
+			return 0, false
 		}
+		n = n*10 + int(b-'0')
 	}
-	return params
+	return n, true
 }
 
 func (p *vt100Parser) processOSC(b byte) {
@@ -255,9 +507,11 @@ func (p *vt100Parser) processOSCEscape(b byte) {
 		p.state = stateNormal
 		return
 	}
-	// Not a valid ST, treat ESC as part of data and continue
-	p.buf = append(p.buf, '\x1b', b)
-	p.state = stateOSC
+	// Not a valid ST: the ESC aborts the OSC and starts a new sequence, so
+	// that an unterminated OSC does not swallow the output that follows
+	p.state = stateEscape
+	p.buf = p.buf[:0]
+	p.processEscape(b)
 }
 
 func (p *vt100Parser) executeOSC(data string) {
@@ -269,8 +523,26 @@ func (p *vt100Parser) executeOSC(data string) {
 	}
 
 	cmd := parts[0]
-	if cmd != "8" {
-		// Only handle OSC 8 (hyperlinks) for now
+	switch cmd {
+	case "0", "1", "2": // Set icon name and/or window title
+		text := ""
+		if len(parts) > 1 {
+			text = parts[1]
+		}
+		if cmd != "2" {
+			p.term.iconName = text
+		}
+		if cmd != "1" {
+			p.term.title = text
+		}
+		return
+	case "133": // Shell integration marks
+		if len(parts) > 1 {
+			p.term.shellMark(parts[1])
+		}
+		return
+	case "8": // Hyperlink
+	default:
 		return
 	}
 
@@ -403,8 +675,7 @@ func (p *vt100Parser) processSGR(params []int) {
 			if i+2 < len(params) && params[i+1] == 5 {
 				// 256 color mode: 38;5;n
 				colorIdx := params[i+2]
-				// For now, map 256 colors to basic 16 colors
-				if colorIdx < 16 {
+				if colorIdx >= 0 && colorIdx < 256 {
 					p.term.currentAttr.Fg = Color(colorIdx)
 				}
 				i += 2 // Skip next two params
@@ -440,8 +711,7 @@ func (p *vt100Parser) processSGR(params []int) {
 			if i+2 < len(params) && params[i+1] == 5 {
 				// 256 color mode: 48;5;n
 				colorIdx := params[i+2]
-				// For now, map 256 colors to basic 16 colors
-				if colorIdx < 16 {
+				if colorIdx >= 0 && colorIdx < 256 {
 					p.term.currentAttr.Bg = Color(colorIdx)
 				}
 				i += 2 // Skip next two params
@@ -0,0 +1,77 @@
+package termemu
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteRuns(t *testing.T) {
+	output := benchmarkOutput(3*writeChunkSize, func(i int) string {
+		return fmt.Sprintf("line %d \x1b[1m%s\x1b[0m\x1b]8;;http://x\x07link\x1b]8;;\x07\xa0\r\n", i, strings.Repeat("ab", i%40))
+	}) // Rows wrapped, text around sequences and more than a chunk
+	output = append(output, "\x1b[?7l0123456789012345678901234567890123456789X\x1b[?7h"...)
+
+	// Runs of text are written as they would be byte by byte
+	whole, bytewise := NewTerminal(5, 30), NewTerminal(5, 30)
+	whole.Write(output)
+	for _, b := range output {
+		bytewise.Write([]byte{b})
+	}
+	if want, got := bytewise.ExportWithScrollback(FormatANSI), whole.ExportWithScrollback(FormatANSI); want != got {
+		t.Errorf("Expected the same content written at once, got:\n%s\ninstead of:\n%s", got, want)
+	}
+	if want, got := screenLines(bytewise), screenLines(whole); !slices.Equal(want, got) {
+		t.Errorf("Expected the screen %q, got %q", want, got)
+	}
+	if lines := screenLines(whole); lines[4] != "01234567890123456789012345678X" {
+		t.Errorf("Expected the last column overwritten without auto-wrap, got %q", lines[4])
+	}
+}
+
+// benchmarkOutput returns about size bytes of program output built from line
+func benchmarkOutput(size int, line func(i int) string) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		buf.WriteString(line(i))
+	}
+	return buf.Bytes()
+}
+
+func benchmarkWrite(b *testing.B, data []byte) {
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		term := NewTerminal(24, 80)
+		// Written the way the daemon does, as it reads the PTY
+		for chunk := range slices.Chunk(data, 4096) {
+			term.Write(chunk)
+		}
+	}
+}
+
+func BenchmarkWritePlainText(b *testing.B) {
+	benchmarkWrite(b, benchmarkOutput(4<<20, func(i int) string {
+		return fmt.Sprintf("%06d the quick brown fox jumps over the lazy dog, again and again\r\n", i)
+	}))
+}
+
+func BenchmarkWriteColored(b *testing.B) {
+	benchmarkWrite(b, benchmarkOutput(4<<20, func(i int) string {
+		return fmt.Sprintf("\x1b[32m%06d\x1b[0m \x1b[1;34mINFO\x1b[0m request \x1b[4mhandled\x1b[24m in \x1b[33m%dms\x1b[0m\r\n", i, i%100)
+	}))
+}
+
+func BenchmarkWriteLongLines(b *testing.B) {
+	benchmarkWrite(b, benchmarkOutput(4<<20, func(i int) string {
+		return fmt.Sprintf("%d %s\r\n", i, bytes.Repeat([]byte("x"), 300))
+	}))
+}
+
+func BenchmarkWriteCursorMovement(b *testing.B) {
+	benchmarkWrite(b, benchmarkOutput(4<<20, func(i int) string {
+		return fmt.Sprintf("\x1b[%d;%dH\x1b[K%d%%", i%24+1, i%70+1, i%100)
+	}))
+}
@@ -0,0 +1,64 @@
+package termemu
+
+import "testing"
+
+// queryReplies feeds input to a new terminal and returns the collected replies
+func queryReplies(t *testing.T, term *Terminal, input string) string {
+	t.Helper()
+	var replies []byte
+	term.SetResponseHandler(func(data []byte) {
+		replies = append(replies, data...)
+	})
+	term.Write([]byte(input))
+	return string(replies)
+}
+
+func TestCursorPositionReport(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	if got := queryReplies(t, term, "\x1b[5;10HX\x1b[6n"); got != "\x1b[5;11R" {
+		t.Errorf("Expected CPR %q, got %q", "\x1b[5;11R", got)
+	}
+
+	// DEC private variant
+	if got := queryReplies(t, term, "\x1b[?6n"); got != "\x1b[?5;11R" {
+		t.Errorf("Expected DECXCPR %q, got %q", "\x1b[?5;11R", got)
+	}
+
+	// Pending wrap reports the last column
+	if got := queryReplies(t, term, "\x1b[1;79HAB\x1b[6n"); got != "\x1b[1;80R" {
+		t.Errorf("Expected CPR %q, got %q", "\x1b[1;80R", got)
+	}
+}
+
+func TestDeviceQueries(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"\x1b[5n", "\x1b[0n"},
+		{"\x1b[c", "\x1b[?1;2c"},
+		{"\x1b[0c", "\x1b[?1;2c"},
+		{"\x1b[>c", "\x1b[>0;0;0c"},
+		{"\x1b[18t", "\x1b[8;24;80t"},
+		{"\x1b[=c", ""},
+	}
+
+	for _, tt := range tests {
+		if got := queryReplies(t, term, tt.query); got != tt.expected {
+			t.Errorf("Query %q: expected %q, got %q", tt.query, tt.expected, got)
+		}
+	}
+}
+
+func TestQueriesWithoutHandler(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	// Without a handler queries are ignored and nothing accumulates
+	term.Write([]byte("\x1b[6n\x1b[c"))
+	if len(term.responses) != 0 {
+		t.Errorf("Expected no pending responses, got %q", term.responses)
+	}
+}
@@ -0,0 +1,133 @@
+package termemu
+
+// reflow rewraps the screen and scrollback to a new size. The rows joined by
+// automatic wraps form logical lines, which are split again at the new
+// width; the cursor and the shell integration marks keep their position in
+// the text. The screen starts on the row holding its former first row,
+// moving down when the cursor would not fit.
+func (t *Terminal) reflow(rows, cols int) {
+	// Screen rows below the cursor and the last row written are not part of
+	// the text, they are blank again on the new screen
+	used := t.cursorRow + 1
+	for i := t.rows - 1; i >= used; i-- {
+		if trimRow(t.screen[i]) > 0 {
+			used = i + 1
+			break
+		}
+	}
+
+	old := make([][]Cell, 0, len(t.scrollback)+used)
+	oldWrapped := make([]bool, 0, len(t.scrollback)+used)
+	for _, row := range t.scrollback {
+		old = append(old, row.cells())
+		oldWrapped = append(oldWrapped, row.Wrapped)
+	}
+	old = append(old, t.screen[:used]...)
+	oldWrapped = append(oldWrapped, t.wrapped[:used]...)
+
+	// Join the rows into logical lines, remembering where each row starts
+	var lines [][]Cell
+	lineOf := make([]int, len(old))
+	offsetOf := make([]int, len(old))
+	var line []Cell
+	for i, row := range old {
+		lineOf[i], offsetOf[i] = len(lines), len(line)
+		if oldWrapped[i] && i < len(old)-1 {
+			line = append(line, row...)
+			continue
+		}
+		line = append(line, row[:trimRow(row)]...)
+		lines = append(lines, line)
+		line = nil
+	}
+
+	// Split the lines at the new width
+	var newRows [][]Cell
+	var newWrapped []bool
+	firstRow := make([]int, len(lines))
+	for i, line := range lines {
+		firstRow[i] = len(newRows)
+		n := max(1, (len(line)+cols-1)/cols)
+		for r := range n {
+			row := make([]Cell, cols)
+			copy(row, line[min(r*cols, len(line)):min((r+1)*cols, len(line))])
+			newRows = append(newRows, row)
+			newWrapped = append(newWrapped, r < n-1)
+		}
+	}
+
+	// position maps a position in the old rows to the new ones. Past the
+	// text of its line, it stays on the last row of the line, the column
+	// possibly beyond the last one.
+	position := func(idx, col int) (int, int) {
+		if idx >= len(old) {
+			return len(newRows) + idx - len(old), col
+		}
+		l := lineOf[idx]
+		offset := offsetOf[idx] + col
+		if offset < len(lines[l]) {
+			return firstRow[l] + offset/cols, offset % cols
+		}
+		last := max(1, (len(lines[l])+cols-1)/cols) - 1
+		return firstRow[l] + last, offset - last*cols
+	}
+
+	cursorCol := t.cursorCol
+	if t.wrapPending {
+		cursorCol = t.cols
+	}
+	cursorRow, cursorCol := position(len(t.scrollback)+t.cursorRow, cursorCol)
+
+	for _, cmd := range t.commands {
+		for _, pos := range []*markPosition{&cmd.prompt, &cmd.input, &cmd.output, &cmd.end} {
+			if idx := pos.line - t.droppedLines; pos.set && idx >= 0 {
+				pos.line, pos.col = position(idx, pos.col)
+				pos.line += t.droppedLines
+				pos.col = min(pos.col, cols)
+			}
+		}
+	}
+
+	top, _ := position(len(t.scrollback), 0)
+	if cursorRow-top >= rows {
+		top = cursorRow - rows + 1
+	}
+
+	screen := make([][]Cell, rows)
+	wrapped := make([]bool, rows)
+	for i := range screen {
+		if top+i < len(newRows) {
+			screen[i], wrapped[i] = newRows[top+i], newWrapped[top+i]
+		} else {
+			screen[i] = make([]Cell, cols)
+		}
+	}
+
+	trim := max(0, top-t.maxScrollback)
+	scrollback := make([]compactRow, 0, top-trim)
+	for i := trim; i < top; i++ {
+		scrollback = append(scrollback, compactCells(newRows[i], newWrapped[i]))
+	}
+	t.droppedLines += trim
+
+	t.rows, t.cols = rows, cols
+	t.screen, t.wrapped = screen, wrapped
+	t.scrollback = scrollback
+	t.cursorRow = cursorRow - top
+
+	// A cursor right after a character written in the last column is a
+	// pending wrap, further right it stays in the last column
+	t.wrapPending = cursorCol == cols && t.autoWrap
+	t.cursorCol = min(cursorCol, cols-1)
+}
+
+// trimRow returns the length of a row without its trailing blanks: cells
+// never written and spaces with the default attributes
+func trimRow(row []Cell) int {
+	blank := Cell{Char: ' ', Attr: Attributes{Fg: ColorDefault, Bg: ColorDefault}}
+	end := len(row)
+	for end > 0 && (row[end-1] == Cell{} || row[end-1] == blank) {
+		end--
+	}
+	return end
+}
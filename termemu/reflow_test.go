@@ -0,0 +1,129 @@
+package termemu
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// screenLines returns the screen rows as text, without trailing spaces
+func screenLines(term *Terminal) []string {
+	var lines []string
+	for _, line := range strings.Split(term.GetScreenAsString(), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
+
+func TestResizeReflow(t *testing.T) {
+	term := NewTerminal(4, 10)
+	term.Write([]byte("0123456789abcde\r\nxyz"))
+
+	// Wider: the wrapped line is joined
+	term.Resize(4, 20)
+	if lines := screenLines(term); !slices.Equal(lines, []string{"0123456789abcde", "xyz", "", ""}) {
+		t.Errorf("Expected the wrapped line to be joined, got %q", lines)
+	}
+	if row, col := term.GetCursor(); row != 1 || col != 3 {
+		t.Errorf("Expected cursor at (1,3), got (%d,%d)", row, col)
+	}
+
+	// Narrower: it is split again, other lines are not
+	term.Resize(4, 5)
+	if lines := screenLines(term); !slices.Equal(lines, []string{"01234", "56789", "abcde", "xyz"}) {
+		t.Errorf("Expected the line to be split, got %q", lines)
+	}
+	if row, col := term.GetCursor(); row != 3 || col != 3 {
+		t.Errorf("Expected cursor at (3,3), got (%d,%d)", row, col)
+	}
+
+	// Back to the original width
+	term.Resize(4, 10)
+	if lines := screenLines(term); !slices.Equal(lines, []string{"0123456789", "abcde", "xyz", ""}) {
+		t.Errorf("Expected the original layout, got %q", lines)
+	}
+
+	// Output keeps going where the cursor is
+	term.Write([]byte("!"))
+	if lines := screenLines(term); lines[2] != "xyz!" {
+		t.Errorf("Expected output after the cursor, got %q", lines)
+	}
+}
+
+func TestResizeReflowScrollback(t *testing.T) {
+	term := NewTerminal(2, 5)
+	term.Write([]byte("abcdefghij\r\nkl\r\nmn"))
+
+	// The line wrapped into the scrollback is joined with its end
+	term.Resize(2, 10)
+	if n, text := len(term.GetScrollback()), term.ExportWithScrollback(FormatPlainText); n != 1 || text != "abcdefghij\nkl\nmn\n" {
+		t.Errorf("Expected the joined line in the scrollback, got %d rows: %q", n, text)
+	}
+	if lines := screenLines(term); !slices.Equal(lines, []string{"kl", "mn"}) {
+		t.Errorf("Expected the screen to be kept, got %q", lines)
+	}
+
+	// A narrower screen pushes rows to the scrollback to keep the cursor
+	term.Resize(2, 2)
+	if lines := screenLines(term); !slices.Equal(lines, []string{"kl", "mn"}) {
+		t.Errorf("Expected the cursor line on the screen, got %q", lines)
+	}
+	if n := len(term.GetScrollback()); n != 5 {
+		t.Errorf("Expected 5 scrollback rows, got %d", n)
+	}
+}
+
+func TestResizeReflowPendingWrap(t *testing.T) {
+	term := NewTerminal(3, 10)
+	term.Write([]byte("0123456789"))
+
+	// The cursor stays after the last character
+	term.Resize(3, 20)
+	if row, col := term.GetCursor(); row != 0 || col != 10 {
+		t.Errorf("Expected cursor at (0,10), got (%d,%d)", row, col)
+	}
+
+	// and wraps with the next character when it ends a row again
+	term.Resize(3, 5)
+	term.Write([]byte("X"))
+	if lines := screenLines(term); !slices.Equal(lines, []string{"01234", "56789", "X"}) {
+		t.Errorf("Expected X on the next row, got %q", lines)
+	}
+}
+
+func TestResizeReflowCommands(t *testing.T) {
+	term := NewTerminal(5, 10)
+	term.Write([]byte(prompt("ls")))
+	term.Write([]byte("0123456789abc\r\n\x1b]133;D;0\x07"))
+	term.Write([]byte("\x1b]133;A\x07$ "))
+
+	term.Resize(5, 20)
+	if out, err := term.ExportCommand(0, FormatPlainText); err != nil || out != "0123456789abc\n" {
+		t.Errorf("Expected the command output to follow the reflow, got %q (%v)", out, err)
+	}
+
+	term.Resize(5, 4)
+	if out, err := term.ExportCommand(0, FormatPlainText); err != nil || out != "0123\n4567\n89ab\nc\n" {
+		t.Errorf("Expected the command output to follow the reflow, got %q (%v)", out, err)
+	}
+}
+
+func TestResizeReflowSnapshot(t *testing.T) {
+	term := NewTerminal(4, 10)
+	term.Write([]byte("0123456789abcde"))
+
+	data, err := term.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	restored := NewTerminal(4, 10)
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// Continuations are part of the snapshot
+	restored.Resize(4, 20)
+	if lines := screenLines(restored); lines[0] != "0123456789abcde" {
+		t.Errorf("Expected the restored line to be joined, got %q", lines)
+	}
+}
@@ -0,0 +1,43 @@
+package termemu
+
+import (
+	"bytes"
+	"io"
+)
+
+// maxReplay bounds the end of an output log ReplayLog reads
+const maxReplay = 1 << 20
+
+// ReplayLog returns a terminal of rows x cols that was written the end of
+// an output log captured from a pipe, up to 1 MiB of it starting at a line.
+// The bare line feeds of such output are turned into CR LF, as a terminal
+// driver would have (ONLCR), so that programs writing ANSI sequences, such
+// as colors and progress bars, are rendered as on a terminal. The scrollback
+// holds all the lines replayed.
+func ReplayLog(r io.ReadSeeker, rows, cols int) (*Terminal, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	start := max(size-maxReplay, 0)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if start > 0 {
+		// Skip the line cut
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+
+	data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	t := NewTerminal(rows, cols)
+	// Wrapping adds at most a row per cols bytes to the lines
+	t.maxScrollback = max(t.maxScrollback, bytes.Count(data, []byte("\n"))+len(data)/cols)
+	t.Write(data)
+	return t, nil
+}
@@ -0,0 +1,55 @@
+package termemu
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReplayLog(t *testing.T) {
+	log := "first\n\x1b[32mgreen\x1b[0m\nprogress 10%\rprogress 100%\n"
+	term, err := ReplayLog(strings.NewReader(log), 5, 20)
+	if err != nil {
+		t.Fatalf("ReplayLog failed: %v", err)
+	}
+
+	lines := strings.Split(term.ExportCurrentScreen(FormatPlainText), "\n")
+	if lines[0] != "first" || lines[1] != "green" || lines[2] != "progress 100%" {
+		t.Errorf("Expected the output as on a terminal, got %q", lines[:3])
+	}
+	if cell := term.GetScreen()[1][0]; cell.Attr.Fg != ColorGreen {
+		t.Errorf("Expected the colors to be kept, got %+v", cell)
+	}
+}
+
+func TestReplayLogEnd(t *testing.T) {
+	var log bytes.Buffer
+	for log.Len() <= maxReplay {
+		log.WriteString(strings.Repeat("x", 99) + "\n")
+	}
+	log.WriteString("last\n")
+
+	term, err := ReplayLog(bytes.NewReader(log.Bytes()), 3, 20)
+	if err != nil {
+		t.Fatalf("ReplayLog failed: %v", err)
+	}
+	if output := term.ExportCurrentScreen(FormatPlainText); !strings.Contains(output, "last") {
+		t.Errorf("Expected the end of the log, got %q", output)
+	}
+}
+
+func TestReplayLogScrollback(t *testing.T) {
+	var log strings.Builder
+	for i := range 2000 {
+		fmt.Fprintf(&log, "%d\n", i)
+	}
+	term, err := ReplayLog(strings.NewReader(log.String()), 3, 20)
+	if err != nil {
+		t.Fatalf("ReplayLog failed: %v", err)
+	}
+	output := term.Export(ExportOptions{Format: FormatPlainText, IncludeScrollback: true, EndLine: 1})
+	if output != "0\n1\n" {
+		t.Errorf("Expected all the lines in the scrollback, got %q", output)
+	}
+}
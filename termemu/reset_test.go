@@ -0,0 +1,88 @@
+package termemu
+
+import "testing"
+
+func TestSoftReset(t *testing.T) {
+	term := NewTerminal(5, 10)
+
+	term.Write([]byte("\x1b[1;31m\x1b[?7l\x1b]8;;http://example.com\x07ab\x1b[!p"))
+
+	// Content and cursor are kept
+	if row, col := term.GetCursor(); row != 0 || col != 2 {
+		t.Errorf("Expected cursor at (0,2), got (%d,%d)", row, col)
+	}
+
+	term.Write([]byte("c0123456789"))
+	screen := term.GetScreen()
+	if screen[0][0].Char != 'a' || screen[0][1].Char != 'b' {
+		t.Errorf("Expected content to be kept, got %q", term.GetScreenAsString())
+	}
+
+	cell := screen[0][2]
+	if cell.Attr.Bold || cell.Attr.Fg != ColorDefault || cell.HyperlinkURL != "" {
+		t.Errorf("Expected default attributes after DECSTR, got %+v", cell)
+	}
+
+	// Auto-wrap is enabled again
+	if screen[1][0].Char != '7' {
+		t.Errorf("Expected output to wrap after DECSTR, got %q", term.GetScreenAsString())
+	}
+}
+
+func TestFullReset(t *testing.T) {
+	term := NewTerminal(5, 20)
+
+	term.Write([]byte("\x1b]2;title\x07\x1b[3g\x1b[4mhello\r\nworld\x1bc"))
+
+	if term.GetScreenAsString() != NewTerminal(5, 20).GetScreenAsString() {
+		t.Errorf("Expected an empty screen, got %q", term.GetScreenAsString())
+	}
+	if row, col := term.GetCursor(); row != 0 || col != 0 {
+		t.Errorf("Expected cursor at (0,0), got (%d,%d)", row, col)
+	}
+	if stops := term.TabStops(); len(stops) != 3 {
+		t.Errorf("Expected default tab stops, got %v", stops)
+	}
+
+	term.Write([]byte("x"))
+	if cell := term.GetScreen()[0][0]; cell.Attr.Underline {
+		t.Errorf("Expected default attributes after RIS, got %+v", cell.Attr)
+	}
+	if term.Title() != "title" {
+		t.Errorf("Expected title to be kept, got %q", term.Title())
+	}
+}
+
+func TestResetAfterUnterminatedSequence(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"OSC", "\x1b]0;never terminated"},
+		{"CSI", "\x1b[12;"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := NewTerminal(5, 20)
+
+			// A program crashing mid-sequence, then the shell resetting
+			term.Write([]byte(tt.data))
+			term.Write([]byte("\x1bcok"))
+
+			if line := term.GetScreenAsString()[:2]; line != "ok" {
+				t.Errorf("Expected output after reset, got %q", term.GetScreenAsString())
+			}
+		})
+	}
+
+	// CAN aborts a sequence without further effect
+	term := NewTerminal(5, 20)
+	term.Write([]byte("\x1b]0;never terminated\x18ok"))
+	if line := term.GetScreenAsString()[:2]; line != "ok" {
+		t.Errorf("Expected output after CAN, got %q", term.GetScreenAsString())
+	}
+	if term.Title() != "" {
+		t.Errorf("Expected aborted OSC to be ignored, got title %q", term.Title())
+	}
+}
@@ -0,0 +1,94 @@
+package termemu
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// compactRow is a row of cells stored compactly, as in the scrollback and
+// snapshots: runs of cells sharing the same attributes and hyperlink, the
+// cells never written at the end of the row being left out. A line of plain
+// text takes a single run instead of a Cell per column.
+type compactRow struct {
+	Width   int       `json:"w"`
+	Runs    []cellRun `json:"r,omitempty"`
+	Wrapped bool      `json:"c,omitempty"` // continued on the next row by an automatic wrap
+}
+
+// cellRun is a run of cells, cells never written having a NUL character
+type cellRun struct {
+	Text string     `json:"t"`
+	Attr Attributes `json:"a"`
+	URL  string     `json:"u,omitempty"`
+	ID   string     `json:"i,omitempty"`
+}
+
+// compactCells converts a row of cells to runs
+func compactCells(row []Cell, wrapped bool) compactRow {
+	end := len(row)
+	for end > 0 && row[end-1] == (Cell{}) {
+		end--
+	}
+
+	// The text of the runs is built at once, each run taking its part, and
+	// the runs allocated once their number is known
+	var text strings.Builder
+	text.Grow(end)
+	type bound struct{ cell, text int }
+	var boundsBuf [16]bound
+	bounds := boundsBuf[:0]
+	for i := 0; i < end; {
+		cell := &row[i]
+		bounds = append(bounds, bound{i, text.Len()})
+		for ; i < end && row[i].Attr == cell.Attr && row[i].HyperlinkURL == cell.HyperlinkURL && row[i].HyperlinkID == cell.HyperlinkID; i++ {
+			if ch := row[i].Char; ch < utf8.RuneSelf {
+				text.WriteByte(byte(ch))
+			} else {
+				text.WriteRune(ch)
+			}
+		}
+	}
+	bounds = append(bounds, bound{end, text.Len()})
+
+	r := compactRow{Width: len(row), Wrapped: wrapped}
+	if end == 0 {
+		return r
+	}
+	all := text.String()
+	r.Runs = make([]cellRun, len(bounds)-1)
+	for i := range r.Runs {
+		cell := &row[bounds[i].cell]
+		r.Runs[i] = cellRun{
+			Text: all[bounds[i].text:bounds[i+1].text],
+			Attr: cell.Attr,
+			URL:  cell.HyperlinkURL,
+			ID:   cell.HyperlinkID,
+		}
+	}
+	return r
+}
+
+// cells converts the runs back to a row of cells
+func (r compactRow) cells() []Cell {
+	row := make([]Cell, r.Width)
+	col := 0
+	for _, run := range r.Runs {
+		for _, ch := range run.Text {
+			if col >= len(row) {
+				return row
+			}
+			row[col] = Cell{Char: ch, Attr: run.Attr, HyperlinkURL: run.URL, HyperlinkID: run.ID}
+			col++
+		}
+	}
+	return row
+}
+
+// contentRow returns the cells of a line of the content, the scrollback
+// followed by the screen
+func (t *Terminal) contentRow(idx int) []Cell {
+	if idx < len(t.scrollback) {
+		return t.scrollback[idx].cells()
+	}
+	return t.screen[idx-len(t.scrollback)]
+}
@@ -0,0 +1,77 @@
+package termemu
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestScrollbackCompact(t *testing.T) {
+	term := NewTerminal(2, 80)
+	term.Write([]byte("plain \x1b[1;31mred\x1b[0m \x1b]8;;https://example.com\x07link\x1b]8;;\x07"))
+	screen := term.GetScreen()
+	term.Write([]byte("\r\n\r\n\r\n"))
+
+	// Lines are stored as runs, without the cells never written
+	if runs := len(term.scrollback[0].Runs); runs != 4 {
+		t.Errorf("Expected 4 runs, got %d", runs)
+	}
+	if runs := term.scrollback[1].Runs; len(runs) != 0 {
+		t.Errorf("Expected an empty line to have no runs, got %+v", runs)
+	}
+
+	// and come back as they were on the screen
+	scrollback := term.GetScrollback()
+	if !reflect.DeepEqual(scrollback[0], screen[0]) || !reflect.DeepEqual(scrollback[1], screen[1]) {
+		t.Errorf("Expected the scrollback to match the screen it came from")
+	}
+}
+
+func TestScrollbackLines(t *testing.T) {
+	term := NewTerminal(2, 10)
+	for i := range 5 {
+		term.Write(fmt.Appendf(nil, "line %d\r\n", i))
+	}
+	// The screen holds line 4 and the cursor, the scrollback lines 0 to 3
+
+	text := func(lines [][]Cell) []string {
+		var texts []string
+		for _, line := range lines {
+			var text []rune
+			for _, cell := range line {
+				if cell.Char != 0 {
+					text = append(text, cell.Char)
+				}
+			}
+			texts = append(texts, string(text))
+		}
+		return texts
+	}
+	for _, test := range []struct {
+		offset, limit int
+		expected      []string
+		start         int
+	}{
+		{1, 2, []string{"line 1", "line 2"}, 1},
+		{0, 0, []string{"line 0", "line 1", "line 2", "line 3"}, 0},
+		{-1, 0, []string{"line 3"}, 3},
+		{-10, 1, []string{"line 0"}, 0},
+		{10, 1, nil, 4},
+	} {
+		lines, offset, total := term.ScrollbackLines(test.offset, test.limit)
+		if !reflect.DeepEqual(text(lines), test.expected) || offset != test.start || total != 4 {
+			t.Errorf("ScrollbackLines(%d, %d): expected %q from %d of 4, got %q from %d of %d",
+				test.offset, test.limit, test.expected, test.start, text(lines), offset, total)
+		}
+	}
+}
+
+func BenchmarkScrollback(b *testing.B) {
+	line := []byte("\x1b[32m2025-01-01 00:00:00\x1b[0m INFO request handled in 12ms\r\n")
+	for b.Loop() {
+		term := NewTerminal(24, 80)
+		for range 1000 {
+			term.Write(line)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package termemu
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SearchOptions configures a search
+type SearchOptions struct {
+	// IncludeScrollback searches the scrollback buffer as well as the screen
+	IncludeScrollback bool
+
+	// IgnoreCase makes the pattern case-insensitive
+	IgnoreCase bool
+
+	// MaxMatches stops the search after that many matches, 0 means no limit
+	MaxMatches int
+}
+
+// Match is an occurrence of a search pattern
+type Match struct {
+	// Row is the line of the match, counted from the top of the screen.
+	// Scrollback lines have negative rows, -1 being the most recent one.
+	Row int
+
+	// Col and EndCol are the columns of the first cell of the match and of
+	// the cell following it
+	Col, EndCol int
+
+	// Text is the matched text
+	Text string
+}
+
+// Search returns the matches of the regular expression pattern (RE2 syntax)
+// in the terminal content, top to bottom. Each line is searched separately,
+// without its trailing spaces, so a match never spans several lines.
+func (t *Terminal) Search(pattern string, opts SearchOptions) ([]Match, error) {
+	if opts.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	first := len(t.scrollback)
+	if opts.IncludeScrollback {
+		first = 0
+	}
+
+	matches := []Match{}
+	for i := first; i < len(t.scrollback)+len(t.screen); i++ {
+		text, cols := rowToSearchText(t.contentRow(i))
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				// Empty matches carry no information
+				continue
+			}
+			matches = append(matches, Match{
+				Row:    i - len(t.scrollback),
+				Col:    cols[loc[0]],
+				EndCol: cols[loc[1]],
+				Text:   text[loc[0]:loc[1]],
+			})
+			if opts.MaxMatches > 0 && len(matches) >= opts.MaxMatches {
+				return matches, nil
+			}
+		}
+	}
+	return matches, nil
+}
+
+// rowToSearchText converts a row of cells to plain text without trailing
+// spaces, along with the column of the cell at each byte offset of the
+// text (the last entry being the column following the text)
+func rowToSearchText(row []Cell) (string, []int) {
+	var sb strings.Builder
+	cols := make([]int, 0, len(row)+1)
+
+	for col, cell := range row {
+		ch := cell.Char
+		if ch == 0 {
+			ch = ' '
+		}
+		n, _ := sb.WriteRune(ch)
+		for range n {
+			cols = append(cols, col)
+		}
+	}
+
+	text := strings.TrimRight(sb.String(), " ")
+	end := len(row)
+	if len(text) < len(cols) {
+		end = cols[len(text)]
+	}
+	return text, append(cols[:len(text)], end)
+}
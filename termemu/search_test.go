@@ -0,0 +1,60 @@
+package termemu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	term := NewTerminal(3, 30)
+	term.Write([]byte("Starting server\r\nListening on port 8080\r\nlistening on port 9090\r\n"))
+	term.Write([]byte("hello port 1"))
+
+	// "Starting server" scrolled off
+	matches, err := term.Search(`port (\d+)`, SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	expected := []Match{
+		{Row: 0, Col: 13, EndCol: 22, Text: "port 8080"},
+		{Row: 1, Col: 13, EndCol: 22, Text: "port 9090"},
+		{Row: 2, Col: 6, EndCol: 12, Text: "port 1"},
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, matches)
+	}
+
+	matches, err = term.Search(`^listening`, SearchOptions{IncludeScrollback: true, IgnoreCase: true})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	expected = []Match{
+		{Row: 0, Col: 0, EndCol: 9, Text: "Listening"},
+		{Row: 1, Col: 0, EndCol: 9, Text: "listening"},
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, matches)
+	}
+
+	matches, err = term.Search(`\w+`, SearchOptions{IncludeScrollback: true, MaxMatches: 3})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(matches) != 3 || matches[0].Text != "Starting" || matches[0].Row != -1 || matches[2].Row != 0 {
+		t.Errorf("Unexpected limited matches %+v", matches)
+	}
+
+	// Trailing spaces are not searched, and empty matches are skipped
+	matches, err = term.Search(`\s*$`, SearchOptions{})
+	if err != nil || len(matches) != 0 {
+		t.Errorf("Expected no matches, got %+v, %v", matches, err)
+	}
+	matches, err = term.Search(`1 *$`, SearchOptions{})
+	if err != nil || len(matches) != 1 || matches[0].EndCol != 12 {
+		t.Errorf("Unexpected matches at the end of the line %+v, %v", matches, err)
+	}
+
+	if _, err := term.Search(`(`, SearchOptions{}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,165 @@
+package termemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// snapshotVersion is the format version of snapshots, changed when the
+// emulator state they hold changes incompatibly
+const snapshotVersion = 1
+
+// snapshot is the serialized state of a terminal
+type snapshot struct {
+	Version       int            `json:"version"`
+	Rows          int            `json:"rows"`
+	Cols          int            `json:"cols"`
+	Screen        []compactRow   `json:"screen"`
+	Scrollback    []compactRow   `json:"scrollback,omitempty"`
+	MaxScrollback int            `json:"max_scrollback"`
+	DroppedLines  int            `json:"dropped_lines,omitempty"`
+	CursorRow     int            `json:"cursor_row"`
+	CursorCol     int            `json:"cursor_col"`
+	WrapPending   bool           `json:"wrap_pending,omitempty"`
+	AutoWrap      bool           `json:"auto_wrap"`
+	Attr          Attributes     `json:"attr"`
+	Hyperlink     *Hyperlink     `json:"hyperlink,omitempty"`
+	Title         string         `json:"title,omitempty"`
+	IconName      string         `json:"icon_name,omitempty"`
+	TabStops      []int          `json:"tab_stops"`
+	InputModes    InputModes     `json:"input_modes"`
+	Commands      []snapshotCmd  `json:"commands,omitempty"`
+	Unsupported   map[string]int `json:"unsupported,omitempty"`
+}
+
+// snapshotCmd is a command of the shell integration history
+type snapshotCmd struct {
+	Command    string     `json:"command,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	StartedAt  time.Time  `json:"started_at,omitzero"`
+	FinishedAt time.Time  `json:"finished_at,omitzero"`
+	Marks      [4]*[2]int `json:"marks"` // prompt, input, output and end positions, as line and column
+}
+
+// Snapshot serializes the state of the terminal: screen, scrollback, cursor,
+// attributes, modes, title, tab stops and command history. Restore brings
+// it back, in this process or a later one. An escape sequence split across
+// two writes is not part of the state; a snapshot is best taken once the
+// output received so far was written.
+func (t *Terminal) Snapshot() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s := snapshot{
+		Version:       snapshotVersion,
+		Rows:          t.rows,
+		Cols:          t.cols,
+		Screen:        make([]compactRow, len(t.screen)),
+		Scrollback:    slices.Clone(t.scrollback),
+		MaxScrollback: t.maxScrollback,
+		DroppedLines:  t.droppedLines,
+		CursorRow:     t.cursorRow,
+		CursorCol:     t.cursorCol,
+		WrapPending:   t.wrapPending,
+		AutoWrap:      t.autoWrap,
+		Attr:          t.currentAttr,
+		Hyperlink:     t.hyperlink,
+		Title:         t.title,
+		IconName:      t.iconName,
+		TabStops:      t.tabStopColumns(),
+		InputModes:    t.inputModes,
+		Commands:      make([]snapshotCmd, len(t.commands)),
+		Unsupported:   t.unsupported,
+	}
+	for i, row := range t.screen {
+		s.Screen[i] = compactCells(row, t.wrapped[i])
+	}
+	for i, cmd := range t.commands {
+		s.Commands[i] = snapshotCmd{
+			Command:    cmd.Command,
+			ExitCode:   cmd.ExitCode,
+			StartedAt:  cmd.StartedAt,
+			FinishedAt: cmd.FinishedAt,
+		}
+		for j, pos := range []markPosition{cmd.prompt, cmd.input, cmd.output, cmd.end} {
+			if pos.set {
+				s.Commands[i].Marks[j] = &[2]int{pos.line, pos.col}
+			}
+		}
+	}
+
+	return json.Marshal(&s)
+}
+
+// Restore replaces the state of the terminal with a snapshot taken by
+// Snapshot. The handlers set on the terminal are kept, and the whole screen
+// is reported as damaged.
+func (t *Terminal) Restore(data []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if s.Rows <= 0 || s.Cols <= 0 || len(s.Screen) != s.Rows {
+		return fmt.Errorf("invalid snapshot size %dx%d with %d rows", s.Cols, s.Rows, len(s.Screen))
+	}
+	if s.CursorRow < 0 || s.CursorRow >= s.Rows || s.CursorCol < 0 || s.CursorCol >= s.Cols {
+		return fmt.Errorf("invalid snapshot cursor position %d,%d", s.CursorRow, s.CursorCol)
+	}
+
+	screen := make([][]Cell, len(s.Screen))
+	wrapped := make([]bool, len(s.Screen))
+	for i, row := range s.Screen {
+		if row.Width != s.Cols {
+			return fmt.Errorf("invalid width %d of snapshot row %d", row.Width, i)
+		}
+		screen[i], wrapped[i] = row.cells(), row.Wrapped
+	}
+	commands := make([]*Command, len(s.Commands))
+	for i, c := range s.Commands {
+		cmd := &Command{
+			Command:    c.Command,
+			ExitCode:   c.ExitCode,
+			StartedAt:  c.StartedAt,
+			FinishedAt: c.FinishedAt,
+		}
+		for j, pos := range []*markPosition{&cmd.prompt, &cmd.input, &cmd.output, &cmd.end} {
+			if m := c.Marks[j]; m != nil {
+				*pos = markPosition{line: m[0], col: m[1], set: true}
+			}
+		}
+		commands[i] = cmd
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rows, t.cols = s.Rows, s.Cols
+	t.screen, t.wrapped = screen, wrapped
+	t.scrollback = s.Scrollback
+	t.maxScrollback = s.MaxScrollback
+	t.droppedLines = s.DroppedLines
+	t.cursorRow, t.cursorCol = s.CursorRow, s.CursorCol
+	t.wrapPending = s.WrapPending
+	t.autoWrap = s.AutoWrap
+	t.currentAttr = s.Attr
+	t.hyperlink = s.Hyperlink
+	t.title, t.iconName = s.Title, s.IconName
+	t.tabStops = make([]bool, s.Cols)
+	for _, col := range s.TabStops {
+		if col >= 0 && col < s.Cols {
+			t.tabStops[col] = true
+		}
+	}
+	t.inputModes = s.InputModes
+	t.commands = commands
+	t.unsupported = s.Unsupported
+	t.parser = newVT100Parser(t)
+	t.dirty = make([]bool, s.Rows)
+	t.markAllDirty()
+	return nil
+}
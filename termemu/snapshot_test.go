@@ -0,0 +1,100 @@
+package termemu
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	term := NewTerminal(4, 20)
+	term.Write([]byte("\x1b]2;build\x07\x1b[?2004h\x1b[3g\x1bH"))
+	term.Write([]byte(prompt("make")))
+	term.Write([]byte("\x1b[1;31merror\x1b[0m \x1b]8;;https://example.com\x07link\x1b]8;;\x07\r\n\x1b]133;D;2\x07"))
+	term.Write([]byte(prompt("ls")))
+	term.Write([]byte("\x1b[44mblue background "))
+
+	data, err := term.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	restored := NewTerminal(24, 80)
+	restored.SetMarkHandler(func(string) {})
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// Writing the same output to both keeps them identical, attributes and
+	// tab stops included
+	for _, t2 := range []*Terminal{term, restored} {
+		t2.Write([]byte("\tdone\x1b[0m\r\n\x1b]133;D;0\x07"))
+	}
+
+	compare := func(name string, get func(*Terminal) any) {
+		t.Helper()
+		if want, got := get(term), get(restored); !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+	compare("screen", func(t *Terminal) any { return t.GetScreen() })
+	compare("scrollback", func(t *Terminal) any { return t.GetScrollback() })
+	compare("export", func(t *Terminal) any { return t.ExportWithScrollback(FormatANSI) })
+	compare("cursor", func(t *Terminal) any { row, col := t.GetCursor(); return [2]int{row, col} })
+	compare("title", func(t *Terminal) any { return t.Title() })
+	compare("tab stops", func(t *Terminal) any { return t.TabStops() })
+	compare("input modes", func(t *Terminal) any { return t.InputModes() })
+	compare("commands", func(t *Terminal) any {
+		var commands []string
+		for _, cmd := range t.Commands() {
+			commands = append(commands, fmt.Sprintf("%s %d %+v", cmd.Command, *cmd.ExitCode, [4]markPosition{cmd.prompt, cmd.input, cmd.output, cmd.end}))
+		}
+		return commands
+	})
+	compare("command output", func(t *Terminal) any {
+		out, err := t.ExportCommand(0, FormatPlainText)
+		return [2]any{out, err}
+	})
+	compare("damage", func(t *Terminal) any { return len(t.TakeDamage()) })
+
+	if restored.markHandler == nil {
+		t.Error("Expected the handlers to be kept")
+	}
+}
+
+func TestSnapshotGolden(t *testing.T) {
+	term := NewTerminal(2, 4)
+	term.Write([]byte("\x1b[1mab\x1b[0m"))
+
+	data, err := term.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	expected := `{"version":1,"rows":2,"cols":4,"screen":[{"w":4,"r":[{"t":"ab","a":{"Bold":true,"Dim":false,"Italic":false,"Underline":false,"Blink":false,"Reverse":false,"Hidden":false,"Strike":false,"Fg":-1,"Bg":-1}}]},{"w":4}],` +
+		`"max_scrollback":1000,"cursor_row":0,"cursor_col":2,"auto_wrap":true,"attr":{"Bold":false,"Dim":false,"Italic":false,"Underline":false,"Blink":false,"Reverse":false,"Hidden":false,"Strike":false,"Fg":-1,"Bg":-1},` +
+		`"tab_stops":[0],"input_modes":{"BracketedPaste":false,"ApplicationCursor":false,"ApplicationKeypad":false}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	term := NewTerminal(2, 4)
+	for _, data := range []string{
+		`not json`,
+		`{"version":2,"rows":1,"cols":1,"screen":[{"w":1}]}`,
+		`{"version":1,"rows":2,"cols":4,"screen":[{"w":4}]}`,
+		`{"version":1,"rows":1,"cols":4,"screen":[{"w":3}]}`,
+		`{"version":1,"rows":1,"cols":4,"screen":[{"w":4}],"cursor_row":1}`,
+	} {
+		if err := term.Restore([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+
+	// A rejected snapshot leaves the terminal alone
+	if rows, cols := term.Size(); rows != 2 || cols != 4 {
+		t.Errorf("Expected the terminal to keep its size, got %dx%d", cols, rows)
+	}
+}
@@ -0,0 +1,87 @@
+package termemu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultTabStops(t *testing.T) {
+	term := NewTerminal(24, 20)
+
+	expected := []int{0, 8, 16}
+	if stops := term.TabStops(); !reflect.DeepEqual(stops, expected) {
+		t.Errorf("Expected tab stops %v, got %v", expected, stops)
+	}
+}
+
+func TestSetTabStop(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	// Set a tab stop at column 4 (HTS) then tab from column 0
+	term.Write([]byte("\x1b[1;5H\x1bH\r\tX"))
+
+	_, col := term.GetCursor()
+	if col != 5 {
+		t.Errorf("Expected cursor col 5 after tab to custom stop, got %d", col)
+	}
+
+	screen := term.GetScreen()
+	if screen[0][4].Char != 'X' {
+		t.Errorf("Expected 'X' at col 4, got %q", screen[0][4].Char)
+	}
+}
+
+func TestClearTabStops(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	// Clear the stop at column 8 (TBC 0), tab should skip to 16
+	term.Write([]byte("\x1b[1;9H\x1b[g\r\t"))
+	if _, col := term.GetCursor(); col != 16 {
+		t.Errorf("Expected cursor col 16, got %d", col)
+	}
+
+	// Clear all stops (TBC 3), tab should go to the last column
+	term.Write([]byte("\x1b[3g\r\t"))
+	if _, col := term.GetCursor(); col != 79 {
+		t.Errorf("Expected cursor col 79, got %d", col)
+	}
+
+	if stops := term.TabStops(); len(stops) != 0 {
+		t.Errorf("Expected no tab stops, got %v", stops)
+	}
+}
+
+func TestTabForwardBackward(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	// CHT: forward 3 tab stops from column 0
+	term.Write([]byte("\x1b[3I"))
+	if _, col := term.GetCursor(); col != 24 {
+		t.Errorf("Expected cursor col 24 after CSI 3 I, got %d", col)
+	}
+
+	// CBT: back 2 tab stops
+	term.Write([]byte("\x1b[2Z"))
+	if _, col := term.GetCursor(); col != 8 {
+		t.Errorf("Expected cursor col 8 after CSI 2 Z, got %d", col)
+	}
+
+	// CBT past the first column stops at column 0
+	term.Write([]byte("\x1b[5Z"))
+	if _, col := term.GetCursor(); col != 0 {
+		t.Errorf("Expected cursor col 0, got %d", col)
+	}
+}
+
+func TestTabStopsSurviveResize(t *testing.T) {
+	term := NewTerminal(24, 10)
+
+	// Custom stop at column 3
+	term.Write([]byte("\x1b[1;4H\x1bH"))
+	term.Resize(24, 20)
+
+	expected := []int{0, 3, 8, 16}
+	if stops := term.TabStops(); !reflect.DeepEqual(stops, expected) {
+		t.Errorf("Expected tab stops %v, got %v", expected, stops)
+	}
+}
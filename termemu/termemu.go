@@ -12,14 +12,14 @@ type Color int
 const (
 	ColorDefault Color = -1 // Default color
 	// Standard 16 colors (0-15)
-	ColorBlack   Color = 0
-	ColorRed     Color = 1
-	ColorGreen   Color = 2
-	ColorYellow  Color = 3
-	ColorBlue    Color = 4
-	ColorMagenta Color = 5
-	ColorCyan    Color = 6
-	ColorWhite   Color = 7
+	ColorBlack         Color = 0
+	ColorRed           Color = 1
+	ColorGreen         Color = 2
+	ColorYellow        Color = 3
+	ColorBlue          Color = 4
+	ColorMagenta       Color = 5
+	ColorCyan          Color = 6
+	ColorWhite         Color = 7
 	ColorBrightBlack   Color = 8
 	ColorBrightRed     Color = 9
 	ColorBrightGreen   Color = 10
@@ -58,31 +58,67 @@ type Hyperlink struct {
 	ID  string
 }
 
+// InputModes are the terminal modes that change how keyboard input and
+// pasted text must be encoded for the program
+type InputModes struct {
+	BracketedPaste    bool // Pasted text is wrapped in ESC [200~ / ESC [201~ (mode 2004)
+	ApplicationCursor bool // Cursor keys send ESC O instead of ESC [ (DECCKM)
+	ApplicationKeypad bool // Keypad sends application sequences (DECKPAM)
+}
+
 // Terminal represents a terminal emulator with VT100 support
 type Terminal struct {
 	mu            sync.RWMutex
 	rows          int
 	cols          int
-	screen        [][]Cell // Current screen buffer
-	scrollback    [][]Cell // Scrollback buffer
-	cursorRow     int      // Current cursor row (0-indexed)
-	cursorCol     int      // Current cursor column (0-indexed)
-	maxScrollback int      // Maximum scrollback lines
+	screen        [][]Cell     // Current screen buffer
+	dirty         []bool       // Screen rows changed since the last TakeDamage
+	wrapped       []bool       // Screen rows continued on the next one by an automatic wrap
+	scrollback    []compactRow // Scrollback buffer, oldest line first
+	cursorRow     int          // Current cursor row (0-indexed)
+	cursorCol     int          // Current cursor column (0-indexed)
+	maxScrollback int          // Maximum scrollback lines
+	droppedLines  int          // Lines trimmed from the top of the scrollback
 	parser        *vt100Parser
-	hyperlink     *Hyperlink  // Current active hyperlink (OSC 8)
-	currentAttr   Attributes  // Current text attributes for new characters
+	hyperlink     *Hyperlink // Current active hyperlink (OSC 8)
+	currentAttr   Attributes // Current text attributes for new characters
+	title         string     // Window title (OSC 0/2)
+	iconName      string     // Icon name (OSC 0/1)
+	tabStops      []bool     // Tab stop set at each column
+	autoWrap      bool       // Auto-wrap mode (DECAWM)
+	wrapPending   bool       // Cursor is past the last column, wrap on next character
+	commands      []*Command // Commands delimited by shell integration marks (OSC 133)
+	inputModes    InputModes // Modes changing what the program expects as input
+
+	responses       []byte       // Replies to queries, pending delivery
+	responseHandler func([]byte) // Receives replies to queries (DSR, DA, ...)
+
+	unsupported        map[string]int // Occurrences of sequences that are not emulated
+	newUnsupported     []string       // Kinds seen for the first time, pending delivery
+	unsupportedHandler func(string)   // Notified of each new kind of unsupported sequence
+
+	marks       []string     // Shell integration marks, pending delivery
+	markHandler func(string) // Notified of each shell integration mark
 }
 
+// defaultTabWidth is the spacing of the initial tab stops
+const defaultTabWidth = 8
+
+// writeChunkSize is the amount of output parsed at once by Write, which lets
+// readers in between chunks
+const writeChunkSize = 4096
+
 // NewTerminal creates a new terminal emulator
 func NewTerminal(rows, cols int) *Terminal {
 	t := &Terminal{
 		rows:          rows,
 		cols:          cols,
 		screen:        make([][]Cell, rows),
-		scrollback:    make([][]Cell, 0),
+		scrollback:    make([]compactRow, 0),
 		maxScrollback: 1000, // Keep 1000 lines of scrollback
 		cursorRow:     0,
 		cursorCol:     0,
+		autoWrap:      true,
 		currentAttr: Attributes{
 			Fg: ColorDefault,
 			Bg: ColorDefault,
@@ -93,6 +129,10 @@ func NewTerminal(rows, cols int) *Terminal {
 	for i := 0; i < rows; i++ {
 		t.screen[i] = make([]Cell, cols)
 	}
+	t.dirty = make([]bool, rows)
+	t.wrapped = make([]bool, rows)
+	t.markAllDirty()
+	t.resetTabStops()
 
 	t.parser = newVT100Parser(t)
 	return t
@@ -101,45 +141,71 @@ func NewTerminal(rows, cols int) *Terminal {
 // Write processes input and updates the terminal state
 func (t *Terminal) Write(data []byte) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	for len(data) > writeChunkSize {
+		t.parser.parse(data[:writeChunkSize])
+		data = data[writeChunkSize:]
+
+		// Let readers such as GetScreen in between the chunks of a large
+		// write instead of waiting for all of it
+		t.mu.Unlock()
+		t.mu.Lock()
+	}
 	t.parser.parse(data)
+	responses, handler := t.responses, t.responseHandler
+	t.responses = nil
+	unsupported, unsupportedHandler := t.newUnsupported, t.unsupportedHandler
+	t.newUnsupported = nil
+	marks, markHandler := t.marks, t.markHandler
+	t.marks = nil
+	t.mu.Unlock()
+
+	// Deliver replies without holding the lock, the handler typically
+	// writes them to the program's input
+	if len(responses) > 0 && handler != nil {
+		handler(responses)
+	}
+	for _, seq := range unsupported {
+		unsupportedHandler(seq)
+	}
+	for _, mark := range marks {
+		markHandler(mark)
+	}
 }
 
-// Resize changes the terminal size
-func (t *Terminal) Resize(rows, cols int) {
+// SetResponseHandler sets the function receiving the replies the terminal
+// generates for queries such as device status (CSI 6n) and device attributes
+// (CSI c). The replies are meant to be written back to the program's input.
+// Queries are ignored while no handler is set.
+func (t *Terminal) SetResponseHandler(handler func(data []byte)) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.responseHandler = handler
+}
 
-	// Create new screen buffer
-	newScreen := make([][]Cell, rows)
-	for i := 0; i < rows; i++ {
-		newScreen[i] = make([]Cell, cols)
+// Resize changes the terminal size. Lines wrapped automatically are
+// reflowed to the new width, in the screen and the scrollback, and the
+// cursor stays on the same character. When the cursor no longer fits on the
+// screen, the top rows move to the scrollback.
+func (t *Terminal) Resize(rows, cols int) {
+	if rows <= 0 || cols <= 0 {
+		return
 	}
 
-	// Copy existing content
-	copyRows := rows
-	if t.rows < copyRows {
-		copyRows = t.rows
-	}
-	for i := 0; i < copyRows; i++ {
-		copyCols := cols
-		if t.cols < copyCols {
-			copyCols = t.cols
-		}
-		copy(newScreen[i][:copyCols], t.screen[i][:copyCols])
-	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	t.rows = rows
-	t.cols = cols
-	t.screen = newScreen
+	t.reflow(rows, cols)
 
-	// Adjust cursor position
-	if t.cursorRow >= rows {
-		t.cursorRow = rows - 1
-	}
-	if t.cursorCol >= cols {
-		t.cursorCol = cols - 1
+	// Keep existing tab stops, new columns get the default stops
+	newTabStops := make([]bool, cols)
+	copy(newTabStops, t.tabStops)
+	for i := len(t.tabStops); i < cols; i++ {
+		newTabStops[i] = i%defaultTabWidth == 0
 	}
+
+	t.tabStops = newTabStops
+	t.dirty = make([]bool, rows)
+	t.markAllDirty()
 }
 
 // GetScreen returns a copy of the current screen buffer
@@ -161,13 +227,38 @@ func (t *Terminal) GetScrollback() [][]Cell {
 	defer t.mu.RUnlock()
 
 	scrollback := make([][]Cell, len(t.scrollback))
-	for i := range t.scrollback {
-		scrollback[i] = make([]Cell, len(t.scrollback[i]))
-		copy(scrollback[i], t.scrollback[i])
+	for i, row := range t.scrollback {
+		scrollback[i] = row.cells()
 	}
 	return scrollback
 }
 
+// ScrollbackLines returns a copy of up to limit lines of the scrollback
+// from offset, the oldest line being 0, along with the offset of the first
+// line returned and the number of lines in the scrollback. A negative
+// offset counts from the end of the scrollback, and a limit of 0 returns
+// the lines up to the end.
+func (t *Terminal) ScrollbackLines(offset, limit int) ([][]Cell, int, int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	total := len(t.scrollback)
+	if offset < 0 {
+		offset = max(total+offset, 0)
+	}
+	offset = min(offset, total)
+	end := total
+	if limit > 0 {
+		end = min(offset+limit, total)
+	}
+
+	lines := make([][]Cell, end-offset)
+	for i := range lines {
+		lines[i] = t.scrollback[offset+i].cells()
+	}
+	return lines, offset, total
+}
+
 // GetScreenAsString returns the screen as a string
 func (t *Terminal) GetScreenAsString() string {
 	screen := t.GetScreen()
@@ -187,6 +278,13 @@ func (t *Terminal) GetScreenAsString() string {
 	return buf.String()
 }
 
+// Size returns the terminal dimensions
+func (t *Terminal) Size() (rows, cols int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rows, t.cols
+}
+
 // GetCursor returns the current cursor position
 func (t *Terminal) GetCursor() (row, col int) {
 	t.mu.RLock()
@@ -194,64 +292,228 @@ func (t *Terminal) GetCursor() (row, col int) {
 	return t.cursorRow, t.cursorCol
 }
 
+// Title returns the window title set by the program (OSC 0 or OSC 2)
+func (t *Terminal) Title() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.title
+}
+
+// IconName returns the icon name set by the program (OSC 0 or OSC 1)
+func (t *Terminal) IconName() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.iconName
+}
+
+// InputModes returns the input modes set by the program
+func (t *Terminal) InputModes() InputModes {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.inputModes
+}
+
+// TabStops returns the columns (0-indexed) that have a tab stop set
+func (t *Terminal) TabStops() []int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tabStopColumns()
+}
+
+// tabStopColumns returns the columns that have a tab stop set
+func (t *Terminal) tabStopColumns() []int {
+	stops := make([]int, 0, len(t.tabStops)/defaultTabWidth+1)
+	for col, set := range t.tabStops {
+		if set {
+			stops = append(stops, col)
+		}
+	}
+	return stops
+}
+
 // Internal methods for terminal operations
 
+// respond queues a reply to a query, delivered once the current Write is done
+func (t *Terminal) respond(reply string) {
+	if t.responseHandler != nil {
+		t.responses = append(t.responses, reply...)
+	}
+}
+
 func (t *Terminal) putChar(ch rune) {
-	if t.cursorCol >= t.cols {
+	if t.wrapPending {
+		// Deferred wrap from a character written in the last column
+		t.wrapped[t.cursorRow] = true
 		t.lineFeed()
 		t.cursorCol = 0
 	}
 	if t.cursorRow >= t.rows {
 		t.cursorRow = t.rows - 1
 	}
-	cell := Cell{
-		Char: ch,
-		Attr: t.currentAttr, // Apply current text attributes
+	cell := t.newCell()
+	cell.Char = ch
+	t.screen[t.cursorRow][t.cursorCol] = cell
+	t.markDirty(t.cursorRow)
+
+	// In the last column the cursor stays put; with auto-wrap enabled the
+	// wrap happens when the next printable character arrives
+	if t.cursorCol < t.cols-1 {
+		t.cursorCol++
+	} else if t.autoWrap {
+		t.wrapPending = true
+	}
+}
+
+// putText writes a run of printable single byte characters, as putChar would
+// one by one, filling a row at a time
+func (t *Terminal) putText(text []byte) {
+	cell := t.newCell()
+	for len(text) > 0 {
+		if t.wrapPending {
+			t.wrapped[t.cursorRow] = true
+			t.lineFeed()
+			t.cursorCol = 0
+		}
+		if t.cursorRow >= t.rows {
+			t.cursorRow = t.rows - 1
+		}
+
+		row := t.screen[t.cursorRow][t.cursorCol:]
+		n := min(len(text), len(row))
+		for i, b := range text[:n] {
+			cell.Char = rune(b)
+			row[i] = cell
+		}
+		t.markDirty(t.cursorRow)
+		text = text[n:]
+
+		if t.cursorCol+n < t.cols {
+			t.cursorCol += n
+			continue
+		}
+		t.cursorCol = t.cols - 1
+		if t.autoWrap {
+			t.wrapPending = true
+		} else if len(text) > 0 {
+			// Without auto-wrap the rest overwrites the last column
+			cell.Char = rune(text[len(text)-1])
+			row[len(row)-1] = cell
+			return
+		}
 	}
-	// Apply current hyperlink if active
+}
+
+// newCell returns a blank cell with the current attributes and hyperlink
+func (t *Terminal) newCell() Cell {
+	cell := Cell{Attr: t.currentAttr}
 	if t.hyperlink != nil {
 		cell.HyperlinkURL = t.hyperlink.URL
 		cell.HyperlinkID = t.hyperlink.ID
 	}
-	t.screen[t.cursorRow][t.cursorCol] = cell
-	t.cursorCol++
+	return cell
 }
 
 func (t *Terminal) lineFeed() {
+	t.wrapPending = false
 	t.cursorRow++
 	if t.cursorRow >= t.rows {
 		// Scroll up - move top line to scrollback
 		if len(t.screen) > 0 {
-			topLine := make([]Cell, t.cols)
-			copy(topLine, t.screen[0])
-			t.scrollback = append(t.scrollback, topLine)
+			t.scrollback = append(t.scrollback, compactCells(t.screen[0], t.wrapped[0]))
 
 			// Trim scrollback if too long
 			if len(t.scrollback) > t.maxScrollback {
 				t.scrollback = t.scrollback[1:]
+				t.droppedLines++
 			}
 		}
 
-		// Shift screen up
+		// Shift screen up, the top row now in the scrollback becomes the
+		// cleared bottom one
+		top := t.screen[0]
 		copy(t.screen[0:], t.screen[1:])
+		copy(t.wrapped[0:], t.wrapped[1:])
 
-		// Clear bottom line
-		t.screen[t.rows-1] = make([]Cell, t.cols)
+		clear(top)
+		t.screen[t.rows-1] = top
+		t.wrapped[t.rows-1] = false
 		t.cursorRow = t.rows - 1
+		t.markAllDirty()
 	}
 }
 
 func (t *Terminal) carriageReturn() {
+	t.wrapPending = false
 	t.cursorCol = 0
 }
 
 func (t *Terminal) backspace() {
+	t.wrapPending = false
 	if t.cursorCol > 0 {
 		t.cursorCol--
 	}
 }
 
+// resetTabStops restores the default tab stops every 8 columns
+func (t *Terminal) resetTabStops() {
+	t.tabStops = make([]bool, t.cols)
+	for i := range t.tabStops {
+		t.tabStops[i] = i%defaultTabWidth == 0
+	}
+}
+
+// setTabStop sets a tab stop at the cursor column (HTS)
+func (t *Terminal) setTabStop() {
+	if t.cursorCol < t.cols {
+		t.tabStops[t.cursorCol] = true
+	}
+}
+
+// clearTabStop clears the tab stop at the cursor column (TBC 0)
+func (t *Terminal) clearTabStop() {
+	if t.cursorCol < t.cols {
+		t.tabStops[t.cursorCol] = false
+	}
+}
+
+// clearAllTabStops clears every tab stop (TBC 3)
+func (t *Terminal) clearAllTabStops() {
+	for i := range t.tabStops {
+		t.tabStops[i] = false
+	}
+}
+
+// tabForward moves the cursor to the n-th next tab stop, or the last column
+func (t *Terminal) tabForward(n int) {
+	t.wrapPending = false
+	col := t.cursorCol
+	for ; n > 0 && col < t.cols-1; n-- {
+		col++
+		for col < t.cols-1 && !t.tabStops[col] {
+			col++
+		}
+	}
+	t.cursorCol = col
+}
+
+// tabBackward moves the cursor to the n-th previous tab stop, or the first column
+func (t *Terminal) tabBackward(n int) {
+	t.wrapPending = false
+	col := t.cursorCol
+	if col >= t.cols {
+		col = t.cols - 1
+	}
+	for ; n > 0 && col > 0; n-- {
+		col--
+		for col > 0 && !t.tabStops[col] {
+			col--
+		}
+	}
+	t.cursorCol = col
+}
+
 func (t *Terminal) moveCursor(row, col int) {
+	t.wrapPending = false
 	if row < 0 {
 		row = 0
 	}
@@ -269,16 +531,53 @@ func (t *Terminal) moveCursor(row, col int) {
 }
 
 func (t *Terminal) clearScreen() {
-	for i := 0; i < t.rows; i++ {
-		t.screen[i] = make([]Cell, t.cols)
+	for _, row := range t.screen {
+		clear(row)
 	}
+	clear(t.wrapped)
+	t.markAllDirty()
 	t.cursorRow = 0
 	t.cursorCol = 0
+	t.wrapPending = false
 }
 
 func (t *Terminal) clearLine() {
-	t.screen[t.cursorRow] = make([]Cell, t.cols)
+	clear(t.screen[t.cursorRow])
+	t.wrapped[t.cursorRow] = false
+	t.markDirty(t.cursorRow)
 	t.cursorCol = 0
+	t.wrapPending = false
+}
+
+// setAutoWrap enables or disables auto-wrap mode (DECAWM)
+func (t *Terminal) setAutoWrap(enabled bool) {
+	t.autoWrap = enabled
+	if !enabled {
+		t.wrapPending = false
+	}
+}
+
+// softReset restores the default attributes and modes, keeping the screen
+// content and cursor position (DECSTR). Like xterm, auto-wrap is left enabled.
+func (t *Terminal) softReset() {
+	t.currentAttr = Attributes{
+		Fg: ColorDefault,
+		Bg: ColorDefault,
+	}
+	t.hyperlink = nil
+	t.autoWrap = true
+	t.wrapPending = false
+	t.inputModes.ApplicationCursor = false
+	t.inputModes.ApplicationKeypad = false
+}
+
+// fullReset returns the terminal to its initial state (RIS). The scrollback,
+// window title and command history are kept.
+func (t *Terminal) fullReset() {
+	t.softReset()
+	t.clearScreen()
+	t.resetTabStops()
+	t.inputModes = InputModes{}
 }
 
 // Format returns a debug string representation
@@ -660,3 +660,33 @@ func TestOSC8ComplexParams(t *testing.T) {
 		}
 	}
 }
+
+// OSC 0/1/2 (Window title) Tests
+
+func TestOSCWindowTitle(t *testing.T) {
+	term := NewTerminal(24, 80)
+
+	// OSC 0 sets both the title and the icon name
+	term.Write([]byte("\x1b]0;vim main.go\x07"))
+	if term.Title() != "vim main.go" || term.IconName() != "vim main.go" {
+		t.Errorf("Expected title and icon name 'vim main.go', got %q and %q", term.Title(), term.IconName())
+	}
+
+	// OSC 1 only sets the icon name
+	term.Write([]byte("\x1b]1;vim\x1b\\"))
+	if term.Title() != "vim main.go" || term.IconName() != "vim" {
+		t.Errorf("Expected title 'vim main.go' and icon name 'vim', got %q and %q", term.Title(), term.IconName())
+	}
+
+	// OSC 2 only sets the title, semicolons are part of it
+	term.Write([]byte("\x1b]2;make; make install\x07"))
+	if term.Title() != "make; make install" || term.IconName() != "vim" {
+		t.Errorf("Expected title 'make; make install' and icon name 'vim', got %q and %q", term.Title(), term.IconName())
+	}
+
+	// An empty title clears it
+	term.Write([]byte("\x1b]2;\x07"))
+	if term.Title() != "" {
+		t.Errorf("Expected empty title, got %q", term.Title())
+	}
+}
@@ -0,0 +1,48 @@
+package termemu
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// SetUnsupportedHandler sets the function notified the first time each kind
+// of sequence the emulator cannot reproduce is received, such as alternate
+// screen switches or scrolling regions. Once one has been seen the screen
+// content may no longer match what a real terminal would show.
+func (t *Terminal) SetUnsupportedHandler(handler func(seq string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unsupportedHandler = handler
+}
+
+// UnsupportedSequences returns how many times each kind of unsupported
+// sequence was received, keyed by a name such as "CSI ?1049h" or "CSI r"
+func (t *Terminal) UnsupportedSequences() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return maps.Clone(t.unsupported)
+}
+
+// UnsupportedSummary describes the unsupported sequences received, e.g.
+// "CSI ?1049h (1), CSI r (3)", or returns an empty string if there were none
+func UnsupportedSummary(counts map[string]int) string {
+	parts := make([]string, 0, len(counts))
+	for _, name := range slices.Sorted(maps.Keys(counts)) {
+		parts = append(parts, fmt.Sprintf("%s (%d)", name, counts[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// unsupportedSequence counts a sequence the emulator ignored or only
+// partially applied
+func (t *Terminal) unsupportedSequence(name string) {
+	if t.unsupported == nil {
+		t.unsupported = make(map[string]int)
+	}
+	if t.unsupported[name] == 0 && t.unsupportedHandler != nil {
+		t.newUnsupported = append(t.newUnsupported, name)
+	}
+	t.unsupported[name]++
+}
@@ -0,0 +1,53 @@
+package termemu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnsupportedSequences(t *testing.T) {
+	term := NewTerminal(5, 20)
+
+	var notified []string
+	term.SetUnsupportedHandler(func(seq string) {
+		notified = append(notified, seq)
+	})
+
+	// Alternate screen, scrolling region (twice), line insertion, a
+	// non-ASCII character set and DECSC
+	term.Write([]byte("\x1b[?1049h\x1b[2;4r\x1b[1;3r\x1b[2L\x1b(0\x1b7"))
+
+	expected := map[string]int{
+		"CSI ?1049h": 1,
+		"CSI r":      2,
+		"CSI L":      1,
+		"ESC (0":     1,
+		"ESC 7":      1,
+	}
+	if got := term.UnsupportedSequences(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if len(notified) != len(expected) {
+		t.Errorf("Expected one notification per kind, got %q", notified)
+	}
+
+	if summary := UnsupportedSummary(expected); summary != "CSI ?1049h (1), CSI L (1), CSI r (2), ESC (0 (1), ESC 7 (1)" {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+}
+
+func TestUnsupportedSequencesIgnored(t *testing.T) {
+	term := NewTerminal(5, 20)
+
+	// Sequences that are emulated or do not change the screen content:
+	// US ASCII charset, cursor visibility, mouse reporting, full screen
+	// scrolling region, clear from home, disabling unknown modes
+	term.Write([]byte("\x1b(B\x1b[?25l\x1b[?1000h\x1b[r\x1b[1;5r\x1b[H\x1b[J\x1b[?1049l\x1b[2 qok"))
+
+	if got := term.UnsupportedSequences(); len(got) != 0 {
+		t.Errorf("Expected no unsupported sequences, got %v", got)
+	}
+	if line := term.GetScreenAsString(); line[:2] != "ok" {
+		t.Errorf("Expected charset designation to print nothing, got %q", line)
+	}
+}
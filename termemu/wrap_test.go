@@ -0,0 +1,71 @@
+package termemu
+
+import "testing"
+
+func TestPendingWrap(t *testing.T) {
+	term := NewTerminal(5, 10)
+
+	// Filling the line leaves the cursor on the last column
+	term.Write([]byte("0123456789"))
+	if row, col := term.GetCursor(); row != 0 || col != 9 {
+		t.Errorf("Expected cursor at (0,9), got (%d,%d)", row, col)
+	}
+
+	// A CR/LF after a full line must not produce an empty line
+	term.Write([]byte("\r\nabc"))
+	screen := term.GetScreen()
+	if screen[1][0].Char != 'a' {
+		t.Errorf("Expected 'a' at (1,0), got %q", screen[1][0].Char)
+	}
+	if row, col := term.GetCursor(); row != 1 || col != 3 {
+		t.Errorf("Expected cursor at (1,3), got (%d,%d)", row, col)
+	}
+}
+
+func TestPendingWrapNextChar(t *testing.T) {
+	term := NewTerminal(5, 10)
+
+	term.Write([]byte("0123456789X"))
+	screen := term.GetScreen()
+	if screen[0][9].Char != '9' {
+		t.Errorf("Expected '9' at (0,9), got %q", screen[0][9].Char)
+	}
+	if screen[1][0].Char != 'X' {
+		t.Errorf("Expected 'X' at (1,0), got %q", screen[1][0].Char)
+	}
+}
+
+func TestPendingWrapCancelledByCursorMove(t *testing.T) {
+	term := NewTerminal(5, 10)
+
+	// Moving the cursor clears the pending wrap
+	term.Write([]byte("0123456789\x1b[1;10HZ"))
+	screen := term.GetScreen()
+	if screen[0][9].Char != 'Z' {
+		t.Errorf("Expected 'Z' at (0,9), got %q", screen[0][9].Char)
+	}
+	if screen[1][0].Char != 0 {
+		t.Errorf("Expected empty cell at (1,0), got %q", screen[1][0].Char)
+	}
+}
+
+func TestAutoWrapDisabled(t *testing.T) {
+	term := NewTerminal(5, 10)
+
+	// With DECAWM reset, extra characters overwrite the last column
+	term.Write([]byte("\x1b[?7l0123456789XYZ"))
+	screen := term.GetScreen()
+	if screen[0][9].Char != 'Z' {
+		t.Errorf("Expected 'Z' at (0,9), got %q", screen[0][9].Char)
+	}
+	if row, col := term.GetCursor(); row != 0 || col != 9 {
+		t.Errorf("Expected cursor at (0,9), got (%d,%d)", row, col)
+	}
+
+	// Re-enable auto-wrap
+	term.Write([]byte("\x1b[?7h\rabcdefghijk"))
+	screen = term.GetScreen()
+	if screen[1][0].Char != 'k' {
+		t.Errorf("Expected 'k' at (1,0), got %q", screen[1][0].Char)
+	}
+}